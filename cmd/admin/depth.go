@@ -0,0 +1,91 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/depth"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// Path of the depth of the queue by service.
+	depthPath = "/depth"
+	// maxDepthScan bounds the requests read to count them by service.
+	maxDepthScan = 10000
+)
+
+// serviceDepth is the number of requests of the queue for a service that are
+// not acked yet.
+type serviceDepth struct {
+	// Target is the host of the service, empty for the requests that could
+	// not be read.
+	Target   string `json:"target"`
+	Depth    int    `json:"depth"`
+	InFlight int    `json:"inFlight"`
+	// OldestAge is the age of the oldest request, in seconds.
+	OldestAge float64 `json:"oldestAge,omitempty"`
+}
+
+type depthResponse struct {
+	// Total is the backlog of the whole queue, when the backend reports it.
+	Total *int64 `json:"total,omitempty"`
+	// Services are sorted by decreasing depth.
+	Services []serviceDepth `json:"services"`
+	// Truncated reports that only the first maxDepthScan requests were
+	// counted by service.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// getDepth answers with the number of requests of the queue that are not
+// acked yet, by service.
+func (a *admin) getDepth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	logger := logging.FromContext(r.Context())
+	msgs, err := queue.ListPending(r.Context(), a.queue, maxDepthScan)
+	if errors.Is(err, queue.ErrListNotSupported) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		logger.Errorw("Error listing requests", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp := depthResponse{Truncated: len(msgs) == maxDepthScan}
+	if b, err := queue.ReadBacklog(r.Context(), a.queue); err == nil {
+		resp.Total = &b.Depth
+	} else if !errors.Is(err, queue.ErrBacklogNotSupported) {
+		logger.Warnw("Error reading the backlog", zap.Error(err))
+	}
+
+	now := a.now()
+	services := depth.ByService(msgs)
+	resp.Services = make([]serviceDepth, 0, len(services))
+	for _, s := range services {
+		sd := serviceDepth{Target: s.Target, Depth: s.Depth, InFlight: s.InFlight}
+		if !s.Oldest.IsZero() && s.Oldest.Before(now) {
+			sd.OldestAge = now.Sub(s.Oldest).Round(time.Second).Seconds()
+		}
+		resp.Services = append(resp.Services, sd)
+	}
+	writeJSON(w, r, resp)
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+)
+
+func TestGetDepth(t *testing.T) {
+	ctx := context.Background()
+	q := queue.NewMemory(queue.MemoryConfig{MemoryQueueName: fmt.Sprint(t.Name(), time.Now().UnixNano()), MemoryReadTimeout: time.Second})
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	for i, target := range []string{"orders.default.svc", "orders.default.svc", "users.default.svc"} {
+		enqueued := now.Add(time.Duration(i-3) * time.Minute)
+		b, err := request.Marshal(request.Data{ReqURL: "http://" + target + "/", EnqueuedAt: &enqueued}, request.FormatJSON, enqueued)
+		if err != nil {
+			t.Fatal("Marshal() =", err)
+		}
+		if err := q.Enqueue(ctx, fmt.Sprint(i), b); err != nil {
+			t.Fatal("Enqueue() =", err)
+		}
+	}
+	if err := q.Enqueue(ctx, "unreadable", []byte("not a request")); err != nil {
+		t.Fatal("Enqueue() =", err)
+	}
+	if msgs, err := q.Dequeue(ctx); err != nil || len(msgs) != 1 {
+		t.Fatalf("Dequeue() = %v, %v, want 1 message", msgs, err)
+	}
+	a := &admin{queue: q, now: func() time.Time { return now }}
+
+	w := httptest.NewRecorder()
+	a.getDepth(w, httptest.NewRequest(http.MethodGet, depthPath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var got depthResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal("Error decoding response:", err)
+	}
+	total := int64(4)
+	want := depthResponse{
+		Total: &total,
+		Services: []serviceDepth{{
+			Target:    "orders.default.svc",
+			Depth:     2,
+			InFlight:  1,
+			OldestAge: 180,
+		}, {
+			// The request that cannot be read was enqueued after now.
+			Depth: 1,
+		}, {
+			Target:    "users.default.svc",
+			Depth:     1,
+			OldestAge: 60,
+		}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("depth (-want, +got):", diff)
+	}
+}
+
+func TestGetDepthNotSupported(t *testing.T) {
+	a := &admin{queue: &queue.Channel{}, now: time.Now}
+	w := httptest.NewRecorder()
+	a.getDepth(w, httptest.NewRequest(http.MethodGet, depthPath, nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotImplemented)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The admin command serves the requests held by the queue to operators,
+// on an endpoint authenticated with a bearer token. Dead-lettered requests
+// are listed and replayed on it as well, the requests of a service can be
+// purged, and the deliveries to a service paused and resumed.
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/config"
+	"knative.dev/async-component/pkg/deadletter"
+	"knative.dev/async-component/pkg/health"
+	"knative.dev/async-component/pkg/observability"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/reconciler/events"
+	"knative.dev/async-component/pkg/status"
+	kubeclient "knative.dev/pkg/client/injection/kube/client"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/signals"
+)
+
+// Name of the admin service in logs.
+const serviceName = "async-admin"
+
+// bearerPrefix starts the Authorization header of the callers.
+const bearerPrefix = "Bearer "
+
+type envInfo struct {
+	queue.Config
+	status.StoreConfig
+	// AdminPort is the port serving the admin API and the probes.
+	AdminPort string `envconfig:"ADMIN_PORT" default:"8080"`
+	// AdminToken is the bearer token callers of the admin API must send.
+	AdminToken string `envconfig:"ADMIN_TOKEN"`
+	// ConfigNamespace is the namespace of the config-async-pauses ConfigMap
+	// watched by the consumer. Services cannot be paused when it is empty.
+	ConfigNamespace string `envconfig:"CONFIG_NAMESPACE"`
+}
+
+func main() {
+	logger, _ := observability.NewLogger(serviceName, "")
+	defer logger.Sync()
+
+	var env envInfo
+	if err := envconfig.Process("", &env); err != nil {
+		logger.Fatalw("Failed to process the environment", zap.Error(err))
+	}
+	if env.AdminToken == "" {
+		logger.Fatal("ADMIN_TOKEN must be set")
+	}
+	ctx := logging.WithLogger(signals.NewContext(), logger)
+
+	q, err := queue.New(ctx, env.Config)
+	if err != nil {
+		logger.Fatalw("Failed to create queue client", zap.Error(err))
+	}
+	defer q.Close()
+	statuses, err := status.New(env.StoreConfig, env.RedisConfig)
+	if err != nil {
+		logger.Fatalw("Failed to create status store", zap.Error(err))
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(health.LivenessPath, health.Liveness())
+	mux.Handle(health.ReadinessPath, health.Readiness(func(ctx context.Context) error {
+		return queue.CheckHealth(ctx, q, false)
+	}))
+	a := &admin{queue: q, statuses: statuses, now: time.Now, secret: []byte(env.AdminToken)}
+	if kc, err := config.NewClient(); err != nil {
+		logger.Warnw("Purges are only audited in the logs, and services cannot be paused", zap.Error(err))
+	} else {
+		a.recorder = events.NewRecorder(context.WithValue(ctx, kubeclient.Key{}, kc), serviceName)
+		if env.ConfigNamespace != "" {
+			a.configMaps = kc.CoreV1().ConfigMaps(env.ConfigNamespace)
+		}
+	}
+	mux.Handle(requestsPath, authenticated(env.AdminToken, http.HandlerFunc(a.listRequests)))
+	mux.Handle(requestsPath+"/", authenticated(env.AdminToken, http.HandlerFunc(a.getRequest)))
+	mux.Handle(depthPath, authenticated(env.AdminToken, http.HandlerFunc(a.getDepth)))
+	mux.Handle(searchPath, authenticated(env.AdminToken, http.HandlerFunc(a.search)))
+	mux.Handle(purgePath, authenticated(env.AdminToken, http.HandlerFunc(a.purge)))
+	mux.Handle(pausePath, authenticated(env.AdminToken, http.HandlerFunc(a.pause)))
+	mux.Handle(resumePath, authenticated(env.AdminToken, http.HandlerFunc(a.resume)))
+	mux.Handle(pausesPath, authenticated(env.AdminToken, http.HandlerFunc(a.listPauses)))
+	mux.Handle(deadletter.ListPath, authenticated(env.AdminToken, deadletter.ListHandler(q)))
+	mux.Handle(deadletter.ReplayPath, authenticated(env.AdminToken, deadletter.ReplayHandler(q)))
+	server := &http.Server{
+		Addr:        ":" + env.AdminPort,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	logger.Infow("Serving the admin API", zap.String("port", env.AdminPort))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Fatalw("Failed to serve the admin API", zap.Error(err))
+	}
+}
+
+// authenticated serves the requests to h that carry token as their bearer
+// token, and answers 401 to the others.
+func authenticated(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := r.Header.Get("Authorization")
+		if !strings.HasPrefix(got, bearerPrefix) ||
+			subtle.ConstantTimeCompare([]byte(got[len(bearerPrefix):]), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
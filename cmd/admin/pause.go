@@ -0,0 +1,259 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/util/retry"
+	"knative.dev/async-component/pkg/pause"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// Paths pausing and resuming the deliveries to a service, and listing
+	// the services paused or draining.
+	pausePath  = "/pause"
+	resumePath = "/resume"
+	pausesPath = "/pauses"
+	// defaultDrainFor is how long a resumed service drains at its rate when
+	// drainFor is not set.
+	defaultDrainFor = 10 * time.Minute
+	// Reasons of the Events auditing pauses.
+	pausedReason  = "Paused"
+	resumedReason = "Resumed"
+)
+
+// pauseRequest selects the service paused or resumed.
+type pauseRequest struct {
+	Namespace string `json:"namespace"`
+	Service   string `json:"service"`
+	// DrainRate caps the requests delivered per second to a resumed
+	// service, for DrainFor, a duration such as 10m. The queued requests
+	// are delivered as fast as possible when it is zero.
+	DrainRate float64 `json:"drainRate,omitempty"`
+	DrainFor  string  `json:"drainFor,omitempty"`
+}
+
+// pausedService is the state of a service paused or draining.
+type pausedService struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"service"`
+	pause.Service
+}
+
+type pausesResponse struct {
+	Services []pausedService `json:"services"`
+}
+
+// validate returns an error unless pr names a service by valid names, with a
+// valid drain rate.
+func (pr pauseRequest) validate() error {
+	for kind, name := range map[string]string{"namespace": pr.Namespace, "service": pr.Service} {
+		if name == "" {
+			return fmt.Errorf("the %s must be set", kind)
+		}
+		if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+			return fmt.Errorf("invalid %s %q: %s", kind, name, strings.Join(errs, ", "))
+		}
+	}
+	if pr.DrainRate < 0 {
+		return errors.New("drainRate must not be negative")
+	}
+	if pr.DrainFor != "" {
+		if d, err := time.ParseDuration(pr.DrainFor); err != nil || d <= 0 {
+			return fmt.Errorf("drainFor %q is not a positive duration", pr.DrainFor)
+		}
+	}
+	return nil
+}
+
+// pause stops the deliveries to a service until it is resumed. Its requests
+// are still accepted and queued meanwhile.
+func (a *admin) pause(w http.ResponseWriter, r *http.Request) {
+	a.updatePause(w, r, func(pr pauseRequest, now time.Time) (pause.Service, bool) {
+		return pause.Service{Paused: true, Since: now}, true
+	})
+}
+
+// resume restarts the deliveries to a paused service, capped to the drain
+// rate of the request if any.
+func (a *admin) resume(w http.ResponseWriter, r *http.Request) {
+	a.updatePause(w, r, func(pr pauseRequest, now time.Time) (pause.Service, bool) {
+		if pr.DrainRate == 0 {
+			return pause.Service{Since: now}, false
+		}
+		drainFor := defaultDrainFor
+		if pr.DrainFor != "" {
+			drainFor, _ = time.ParseDuration(pr.DrainFor)
+		}
+		until := now.Add(drainFor)
+		return pause.Service{Since: now, DrainRate: pr.DrainRate, DrainUntil: &until}, true
+	})
+}
+
+// updatePause records the state returned by update for the service of the
+// request in the config-async-pauses ConfigMap, or deletes it when update
+// does not keep it, and answers with that state. The services no longer
+// paused nor draining are deleted from the ConfigMap.
+func (a *admin) updatePause(w http.ResponseWriter, r *http.Request, update func(pauseRequest, time.Time) (pause.Service, bool)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if a.configMaps == nil {
+		http.Error(w, "pausing services is disabled, set CONFIG_NAMESPACE", http.StatusNotImplemented)
+		return
+	}
+	var pr pauseRequest
+	if err := json.NewDecoder(r.Body).Decode(&pr); err != nil {
+		http.Error(w, "invalid pause request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := pr.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := a.now()
+	s, keep := update(pr, now)
+	key := pause.Key(pr.Namespace, pr.Service)
+	err := a.updatePauses(r.Context(), func(services pause.Services) {
+		for k, s := range services {
+			if s.Expired(now) {
+				delete(services, k)
+			}
+		}
+		if keep {
+			services[key] = s
+		} else {
+			delete(services, key)
+		}
+	})
+	if err != nil {
+		logging.FromContext(r.Context()).Errorw("Error updating "+pause.ConfigMapName, zap.String("service", key), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	a.auditPause(r, pr, s)
+	writeJSON(w, r, pausedService{Namespace: pr.Namespace, Name: pr.Service, Service: s})
+}
+
+// updatePauses applies update to the services of the config-async-pauses
+// ConfigMap, creating it if needed, and retrying on conflicts with other
+// updates.
+func (a *admin) updatePauses(ctx context.Context, update func(pause.Services)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := a.configMaps.Get(ctx, pause.ConfigMapName, metav1.GetOptions{})
+		create := apierrs.IsNotFound(err)
+		if create {
+			cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: pause.ConfigMapName}}
+		} else if err != nil {
+			return err
+		}
+		services, err := pause.Parse(cm.Data)
+		if err != nil {
+			return err
+		}
+		update(services)
+		if cm.Data, err = services.Data(); err != nil {
+			return err
+		}
+		if create {
+			_, err = a.configMaps.Create(ctx, cm, metav1.CreateOptions{})
+			if apierrs.IsAlreadyExists(err) {
+				// Created by a concurrent update, which is retried.
+				return apierrs.NewConflict(corev1.Resource("configmaps"), pause.ConfigMapName, err)
+			}
+			return err
+		}
+		_, err = a.configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// listPauses answers with the services paused or draining.
+func (a *admin) listPauses(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if a.configMaps == nil {
+		http.Error(w, "pausing services is disabled, set CONFIG_NAMESPACE", http.StatusNotImplemented)
+		return
+	}
+	resp := pausesResponse{Services: []pausedService{}}
+	cm, err := a.configMaps.Get(r.Context(), pause.ConfigMapName, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		writeJSON(w, r, resp)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Errorw("Error reading "+pause.ConfigMapName, zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	services, err := pause.Parse(cm.Data)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorw("Error reading "+pause.ConfigMapName, zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	now := a.now()
+	for key, s := range services {
+		if s.Expired(now) {
+			continue
+		}
+		// Namespaces have no dots, unlike the names of services.
+		parts := strings.SplitN(key, ".", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		resp.Services = append(resp.Services, pausedService{Namespace: parts[0], Name: parts[1], Service: s})
+	}
+	sort.Slice(resp.Services, func(i, j int) bool {
+		a, b := resp.Services[i], resp.Services[j]
+		return a.Namespace < b.Namespace || a.Namespace == b.Namespace && a.Name < b.Name
+	})
+	writeJSON(w, r, resp)
+}
+
+// auditPause records that the service of pr was paused or resumed to s in
+// the logs, and as an Event of the service when a.recorder is set.
+func (a *admin) auditPause(r *http.Request, pr pauseRequest, s pause.Service) {
+	reason, message := resumedReason, "Resumed the deliveries with the admin API"
+	if s.Paused {
+		reason, message = pausedReason, "Paused the deliveries with the admin API, requests are queued until the service is resumed"
+	} else if s.DrainRate > 0 {
+		message = fmt.Sprintf("Resumed the deliveries with the admin API, at up to %g requests per second until %s", s.DrainRate, s.DrainUntil.Format(time.RFC3339))
+	}
+	logging.FromContext(r.Context()).Infow(message,
+		zap.String("namespace", pr.Namespace), zap.String("service", pr.Service),
+		zap.String("remoteAddr", r.RemoteAddr), zap.String("userAgent", r.UserAgent()))
+	if a.recorder == nil {
+		return
+	}
+	ref := &corev1.ObjectReference{APIVersion: "serving.knative.dev/v1", Kind: "Service", Name: pr.Service, Namespace: pr.Namespace}
+	a.recorder.Event(ref, corev1.EventTypeNormal, reason, message)
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"knative.dev/async-component/pkg/pause"
+)
+
+func TestPause(t *testing.T) {
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	drainUntil := now.Add(5 * time.Minute)
+	kc := fake.NewSimpleClientset()
+	recorder := record.NewFakeRecorder(10)
+	a := &admin{now: func() time.Time { return now }, recorder: recorder, configMaps: kc.CoreV1().ConfigMaps("knative-serving")}
+
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		body      string
+		wantCode  int
+		want      pause.Services
+		wantEvent string
+	}{{
+		name:      "pause",
+		handler:   a.pause,
+		body:      `{"namespace": "default", "service": "orders"}`,
+		wantCode:  http.StatusOK,
+		want:      pause.Services{"default.orders": {Paused: true, Since: now}},
+		wantEvent: "Normal Paused Paused the deliveries with the admin API, requests are queued until the service is resumed",
+	}, {
+		name:      "pause another service",
+		handler:   a.pause,
+		body:      `{"namespace": "default", "service": "billing"}`,
+		wantCode:  http.StatusOK,
+		want:      pause.Services{"default.orders": {Paused: true, Since: now}, "default.billing": {Paused: true, Since: now}},
+		wantEvent: "Normal Paused Paused the deliveries with the admin API, requests are queued until the service is resumed",
+	}, {
+		name:      "resume with a drain rate",
+		handler:   a.resume,
+		body:      `{"namespace": "default", "service": "orders", "drainRate": 2.5, "drainFor": "5m"}`,
+		wantCode:  http.StatusOK,
+		want:      pause.Services{"default.orders": {Since: now, DrainRate: 2.5, DrainUntil: &drainUntil}, "default.billing": {Paused: true, Since: now}},
+		wantEvent: "Normal Resumed Resumed the deliveries with the admin API, at up to 2.5 requests per second until 2021-03-01T10:05:00Z",
+	}, {
+		name:      "resume",
+		handler:   a.resume,
+		body:      `{"namespace": "default", "service": "billing"}`,
+		wantCode:  http.StatusOK,
+		want:      pause.Services{"default.orders": {Since: now, DrainRate: 2.5, DrainUntil: &drainUntil}},
+		wantEvent: "Normal Resumed Resumed the deliveries with the admin API",
+	}, {
+		name:     "no service",
+		handler:  a.pause,
+		body:     `{"namespace": "default"}`,
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "invalid drain duration",
+		handler:  a.resume,
+		body:     `{"namespace": "default", "service": "orders", "drainRate": 1, "drainFor": "-1m"}`,
+		wantCode: http.StatusBadRequest,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			test.handler(w, httptest.NewRequest(http.MethodPost, pausePath, strings.NewReader(test.body)))
+			if w.Code != test.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, test.wantCode, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			cm, err := kc.CoreV1().ConfigMaps("knative-serving").Get(context.Background(), pause.ConfigMapName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal("Get() =", err)
+			}
+			got, err := pause.Parse(cm.Data)
+			if err != nil {
+				t.Fatal("Parse() =", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Error("services (-want, +got):", diff)
+			}
+			select {
+			case got := <-recorder.Events:
+				if got != test.wantEvent {
+					t.Errorf("event = %q, want %q", got, test.wantEvent)
+				}
+			default:
+				t.Error("no event was recorded")
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	a.listPauses(w, httptest.NewRequest(http.MethodGet, pausesPath, nil))
+	var resp pausesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal("Error decoding response:", err)
+	}
+	want := []pausedService{{Namespace: "default", Name: "orders", Service: pause.Service{Since: now, DrainRate: 2.5, DrainUntil: &drainUntil}}}
+	if diff := cmp.Diff(want, resp.Services); diff != "" {
+		t.Error("services (-want, +got):", diff)
+	}
+
+	// The drained services are not listed.
+	now = drainUntil
+	w = httptest.NewRecorder()
+	a.listPauses(w, httptest.NewRequest(http.MethodGet, pausesPath, nil))
+	if got := strings.TrimSpace(w.Body.String()); got != `{"services":[]}` {
+		t.Errorf("listed %s once drained, want no service", got)
+	}
+}
+
+func TestPauseDisabled(t *testing.T) {
+	a := &admin{now: time.Now}
+	w := httptest.NewRecorder()
+	a.pause(w, httptest.NewRequest(http.MethodPost, pausePath, strings.NewReader(`{"namespace": "default", "service": "orders"}`)))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotImplemented)
+	}
+}
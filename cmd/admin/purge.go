@@ -0,0 +1,247 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"knative.dev/async-component/pkg/headers"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/async-component/pkg/status"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// Path of the purges of the requests of a service or a namespace.
+	purgePath = "/purge"
+	// confirmationTTL is how long the confirmation of a purge is valid.
+	confirmationTTL = 5 * time.Minute
+	// Reason of the Events auditing purges.
+	purgedReason = "Purged"
+	// purgedStatusReason is the reason recorded in the status of the purged
+	// requests.
+	purgedStatusReason = "purged by an operator"
+)
+
+// purgeRequest selects the requests of a purge.
+type purgeRequest struct {
+	Namespace string `json:"namespace"`
+	// Service is the name of a Knative Service of the namespace, all of them
+	// when empty.
+	Service string `json:"service,omitempty"`
+	// Confirmation is the token answered to the same selection, without
+	// which nothing is purged.
+	Confirmation string `json:"confirmation,omitempty"`
+}
+
+type purgeResponse struct {
+	// Matched is the number of requests that would be purged, among the
+	// first maxDepthScan, when no confirmation was sent.
+	Matched *int `json:"matched,omitempty"`
+	// Confirmation is the token to send back to purge the requests, until
+	// ExpiresAt.
+	Confirmation string     `json:"confirmation,omitempty"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	Purged       int        `json:"purged"`
+}
+
+// purge deletes the requests of a service or a namespace that are waiting in
+// the queue. Without a confirmation, it only counts them and answers with the
+// confirmation of the purge. Purges are audited with an Event of the service
+// or namespace.
+func (a *admin) purge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var pr purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&pr); err != nil {
+		http.Error(w, "invalid purge request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := pr.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger := logging.FromContext(r.Context()).With(zap.String("namespace", pr.Namespace), zap.String("service", pr.Service))
+
+	if pr.Confirmation == "" {
+		expires := a.now().Add(confirmationTTL).Truncate(time.Second)
+		resp := purgeResponse{Confirmation: a.confirmation(pr, expires), ExpiresAt: &expires}
+		msgs, err := queue.ListPending(r.Context(), a.queue, maxDepthScan)
+		if err != nil && !errors.Is(err, queue.ErrListNotSupported) {
+			logger.Errorw("Error listing requests", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if err == nil {
+			matched := 0
+			for _, msg := range msgs {
+				if !msg.InFlight && pr.matches(msg.Data) {
+					matched++
+				}
+			}
+			resp.Matched = &matched
+		}
+		writeJSON(w, r, resp)
+		return
+	}
+	if !a.confirmed(pr) {
+		http.Error(w, "invalid or expired confirmation, send the purge without it for a new one", http.StatusForbidden)
+		return
+	}
+
+	var ids []string
+	n, err := queue.Purge(r.Context(), a.queue, func(data []byte) bool {
+		if !pr.matches(data) {
+			return false
+		}
+		if d, err := request.Unmarshal(data); err == nil && d.ID != "" {
+			ids = append(ids, d.ID)
+		}
+		return true
+	})
+	if errors.Is(err, queue.ErrPurgeNotSupported) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	// Partial purges are audited as well.
+	a.audit(r, pr, n)
+	if err != nil {
+		logger.Errorw("Error purging requests", zap.Int("count", n), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if a.statuses != nil {
+		a.cancel(r, ids)
+	}
+	writeJSON(w, r, purgeResponse{Purged: n})
+}
+
+// validate returns an error unless pr names a namespace, and a service if
+// any, by valid names.
+func (pr purgeRequest) validate() error {
+	if pr.Namespace == "" {
+		return errors.New("the namespace of the requests purged must be set")
+	}
+	if errs := validation.IsDNS1123Label(pr.Namespace); len(errs) > 0 {
+		return fmt.Errorf("invalid namespace %q: %s", pr.Namespace, strings.Join(errs, ", "))
+	}
+	if pr.Service != "" {
+		if errs := validation.IsDNS1123Label(pr.Service); len(errs) > 0 {
+			return fmt.Errorf("invalid service %q: %s", pr.Service, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// matches reports whether the request of record data is for the service or
+// namespace of pr. Its service is read from its cluster-local host, else from
+// the host of its URL, which start with the name and namespace of the service.
+func (pr purgeRequest) matches(data []byte) bool {
+	d, err := request.Unmarshal(data)
+	if err != nil {
+		return false
+	}
+	host := http.Header(d.ReqHeader).Get(headers.OriginalHost)
+	if host == "" {
+		u, err := url.Parse(d.ReqURL)
+		if err != nil {
+			return false
+		}
+		host = u.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	labels := strings.SplitN(host, ".", 3)
+	return len(labels) >= 2 && labels[1] == pr.Namespace && (pr.Service == "" || labels[0] == pr.Service)
+}
+
+// confirmation returns the confirmation of the purge of pr until expires: the
+// expiry time, signed with the admin token along with the selection.
+func (a *admin) confirmation(pr purgeRequest, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, a.secret)
+	fmt.Fprintf(mac, "purge\n%s\n%s\n%s", pr.Namespace, pr.Service, exp)
+	return exp + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// confirmed reports whether the confirmation of pr was answered for it by
+// a.confirmation and has not expired.
+func (a *admin) confirmed(pr purgeRequest) bool {
+	i := strings.Index(pr.Confirmation, ".")
+	if i < 0 {
+		return false
+	}
+	exp, err := strconv.ParseInt(pr.Confirmation[:i], 10, 64)
+	if err != nil || !a.now().Before(time.Unix(exp, 0)) {
+		return false
+	}
+	return hmac.Equal([]byte(pr.Confirmation), []byte(a.confirmation(pr, time.Unix(exp, 0))))
+}
+
+// audit records the purge of n requests of pr in the logs, and as an Event of
+// the service, or of the namespace, when a.recorder is set.
+func (a *admin) audit(r *http.Request, pr purgeRequest, n int) {
+	logging.FromContext(r.Context()).Infow("Purged queued requests",
+		zap.String("namespace", pr.Namespace), zap.String("service", pr.Service),
+		zap.Int("count", n), zap.String("remoteAddr", r.RemoteAddr), zap.String("userAgent", r.UserAgent()))
+	if a.recorder == nil {
+		return
+	}
+	ref := &corev1.ObjectReference{APIVersion: "v1", Kind: "Namespace", Name: pr.Namespace, Namespace: pr.Namespace}
+	of := "namespace " + pr.Namespace
+	if pr.Service != "" {
+		ref = &corev1.ObjectReference{APIVersion: "serving.knative.dev/v1", Kind: "Service", Name: pr.Service, Namespace: pr.Namespace}
+		of = "service " + pr.Service
+	}
+	a.recorder.Eventf(ref, corev1.EventTypeWarning, purgedReason, "Purged %d queued requests of %s with the admin API", n, of)
+}
+
+// cancel records the requests of ids as cancelled in the status store, when
+// they are known as pending there.
+func (a *admin) cancel(r *http.Request, ids []string) {
+	logger := logging.FromContext(r.Context())
+	for _, id := range ids {
+		s, err := a.statuses.Get(r.Context(), id)
+		if errors.Is(err, status.ErrNotFound) {
+			continue
+		} else if err != nil {
+			logger.Warnw("Error reading request status", zap.String("id", id), zap.Error(err))
+			continue
+		}
+		if s.State != status.Pending {
+			continue
+		}
+		s.State, s.Reason, s.Updated = status.Cancelled, purgedStatusReason, a.now()
+		if err := a.statuses.Set(r.Context(), s); err != nil {
+			logger.Warnw("Error cancelling purged request", zap.String("id", id), zap.Error(err))
+		}
+	}
+}
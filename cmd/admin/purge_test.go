@@ -0,0 +1,263 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/tools/record"
+	"knative.dev/async-component/pkg/headers"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/async-component/pkg/status"
+)
+
+func TestPurgeRequestMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		header map[string][]string
+		pr     purgeRequest
+		want   bool
+	}{{
+		name: "service",
+		url:  "http://orders.default.svc.cluster.local/orders",
+		pr:   purgeRequest{Namespace: "default", Service: "orders"},
+		want: true,
+	}, {
+		name: "other service",
+		url:  "http://users.default.svc.cluster.local/users",
+		pr:   purgeRequest{Namespace: "default", Service: "orders"},
+	}, {
+		name: "namespace",
+		url:  "http://users.default.example.com:8080/users",
+		pr:   purgeRequest{Namespace: "default"},
+		want: true,
+	}, {
+		name: "other namespace",
+		url:  "http://orders.shop.svc.cluster.local/orders",
+		pr:   purgeRequest{Namespace: "default"},
+	}, {
+		name:   "cluster-local host",
+		url:    "https://orders.example.com/orders",
+		header: map[string][]string{headers.OriginalHost: {"orders.default.svc.cluster.local"}},
+		pr:     purgeRequest{Namespace: "default", Service: "orders"},
+		want:   true,
+	}, {
+		name: "host without namespace",
+		url:  "http://localhost/orders",
+		pr:   purgeRequest{Namespace: "default"},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := request.Marshal(request.Data{ReqURL: test.url, ReqHeader: test.header}, request.FormatJSON, time.Now())
+			if err != nil {
+				t.Fatal("Marshal() =", err)
+			}
+			if got := test.pr.matches(b); got != test.want {
+				t.Errorf("matches() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPurge(t *testing.T) {
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	// confirm asks for the confirmation of the purge of body.
+	confirm := func(a *admin, body string) string {
+		w := httptest.NewRecorder()
+		a.purge(w, httptest.NewRequest(http.MethodPost, purgePath, strings.NewReader(body)))
+		var resp purgeResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal("Error decoding confirmation:", err)
+		}
+		return resp.Confirmation
+	}
+	tests := []struct {
+		name string
+		body string
+		// confirm sets the confirmation of body to the one answered for
+		// the selection of confirm, at confirmAt.
+		confirm   string
+		confirmAt time.Time
+		hidden    bool
+		wantCode  int
+		// wantMatched is the number of requests counted for a
+		// confirmation, if any.
+		wantMatched int
+		wantPurged  int
+		// wantLeft is the number of requests left in the queue, including
+		// the one in flight.
+		wantLeft  int
+		wantEvent string
+	}{{
+		name:     "asks for a confirmation",
+		body:     `{"namespace": "default", "service": "orders"}`,
+		wantCode: http.StatusOK,
+		// The request in flight is not counted.
+		wantMatched: 2,
+		wantLeft:    5,
+	}, {
+		name:       "purges the service",
+		body:       `{"namespace": "default", "service": "orders"}`,
+		confirm:    `{"namespace": "default", "service": "orders"}`,
+		confirmAt:  now,
+		wantCode:   http.StatusOK,
+		wantPurged: 2,
+		wantLeft:   3,
+		wantEvent:  "Warning Purged Purged 2 queued requests of service orders with the admin API",
+	}, {
+		name:       "purges the namespace",
+		body:       `{"namespace": "default"}`,
+		confirm:    `{"namespace": "default"}`,
+		confirmAt:  now.Add(-time.Minute),
+		wantCode:   http.StatusOK,
+		wantPurged: 3,
+		wantLeft:   2,
+		wantEvent:  "Warning Purged Purged 3 queued requests of namespace default with the admin API",
+	}, {
+		name:      "confirmation of another selection",
+		body:      `{"namespace": "default"}`,
+		confirm:   `{"namespace": "default", "service": "orders"}`,
+		confirmAt: now,
+		wantCode:  http.StatusForbidden,
+		wantLeft:  5,
+	}, {
+		name:      "expired confirmation",
+		body:      `{"namespace": "default", "service": "orders"}`,
+		confirm:   `{"namespace": "default", "service": "orders"}`,
+		confirmAt: now.Add(-confirmationTTL),
+		wantCode:  http.StatusForbidden,
+		wantLeft:  5,
+	}, {
+		name:     "forged confirmation",
+		body:     `{"namespace": "default", "service": "orders", "confirmation": "1614596400.forged"}`,
+		wantCode: http.StatusForbidden,
+		wantLeft: 5,
+	}, {
+		name:     "no namespace",
+		body:     `{"service": "orders"}`,
+		wantCode: http.StatusBadRequest,
+		wantLeft: 5,
+	}, {
+		name:     "invalid service",
+		body:     `{"namespace": "default", "service": "Orders!"}`,
+		wantCode: http.StatusBadRequest,
+		wantLeft: 5,
+	}, {
+		name:      "not supported",
+		body:      `{"namespace": "default"}`,
+		confirm:   `{"namespace": "default"}`,
+		confirmAt: now,
+		hidden:    true,
+		wantCode:  http.StatusNotImplemented,
+		wantLeft:  5,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			mem := queue.NewMemory(queue.MemoryConfig{MemoryQueueName: fmt.Sprint(t.Name(), time.Now().UnixNano()), MemoryReadTimeout: time.Second})
+			statuses := status.NewMemory()
+			for i, host := range []string{"orders.default.svc", "orders.default.svc", "orders.default.svc", "users.default.svc", "orders.shop.svc"} {
+				id := fmt.Sprint("request-", i)
+				b, err := request.Marshal(request.Data{ID: id, ReqURL: "http://" + host + "/"}, request.FormatJSON, now)
+				if err != nil {
+					t.Fatal("Marshal() =", err)
+				}
+				if err := mem.Enqueue(ctx, id, b); err != nil {
+					t.Fatal("Enqueue() =", err)
+				}
+				if err := statuses.Set(ctx, status.Status{ID: id, State: status.Pending}); err != nil {
+					t.Fatal("Set() =", err)
+				}
+			}
+			if msgs, err := mem.Dequeue(ctx); err != nil || len(msgs) != 1 {
+				t.Fatalf("Dequeue() = %v, %v, want 1 message", msgs, err)
+			}
+			var q queue.Queue = mem
+			if test.hidden {
+				// Hides the Purge method of the memory queue.
+				q = struct{ queue.Queue }{mem}
+			}
+			recorder := record.NewFakeRecorder(10)
+			a := &admin{queue: q, statuses: statuses, secret: []byte("secret"), recorder: recorder}
+
+			body := test.body
+			if test.confirm != "" {
+				a.now = func() time.Time { return test.confirmAt }
+				c := confirm(a, test.confirm)
+				body = strings.TrimSuffix(body, "}") + fmt.Sprintf(`, "confirmation": %q}`, c)
+			}
+			a.now = func() time.Time { return now }
+			w := httptest.NewRecorder()
+			a.purge(w, httptest.NewRequest(http.MethodPost, purgePath, strings.NewReader(body)))
+			if w.Code != test.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, test.wantCode, w.Body)
+			}
+			if w.Code == http.StatusOK {
+				var resp purgeResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal("Error decoding response:", err)
+				}
+				if resp.Purged != test.wantPurged {
+					t.Errorf("purged = %d, want %d", resp.Purged, test.wantPurged)
+				}
+				if test.wantMatched > 0 && (resp.Matched == nil || *resp.Matched != test.wantMatched || resp.Confirmation == "" ||
+					resp.ExpiresAt == nil || !resp.ExpiresAt.Equal(now.Add(confirmationTTL))) {
+					t.Errorf("response = %s, want the confirmation of %d requests", w.Body, test.wantMatched)
+				}
+			}
+			if b, err := mem.Backlog(ctx); err != nil || b.Depth != int64(test.wantLeft) {
+				t.Errorf("Backlog() = %v, %v, want %d requests left", b, err, test.wantLeft)
+			}
+
+			select {
+			case got := <-recorder.Events:
+				if got != test.wantEvent {
+					t.Errorf("Event = %q, want %q", got, test.wantEvent)
+				}
+			default:
+				if test.wantEvent != "" {
+					t.Errorf("no Event, want %q", test.wantEvent)
+				}
+			}
+			// The purged requests are cancelled, and the one in flight
+			// is left as it is.
+			wantCancelled := 5 - test.wantLeft
+			cancelled := 0
+			for i := 0; i < 5; i++ {
+				s, err := statuses.Get(ctx, fmt.Sprint("request-", i))
+				if err != nil {
+					t.Fatal("Get() =", err)
+				}
+				if s.State == status.Cancelled {
+					cancelled++
+					if s.Reason != purgedStatusReason {
+						t.Errorf("reason of request-%d = %q, want %q", i, s.Reason, purgedStatusReason)
+					}
+				}
+			}
+			if cancelled != wantCancelled {
+				t.Errorf("got %d cancelled requests, want %d", cancelled, wantCancelled)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/async-component/pkg/status"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// Path of the requests held by the queue. The status of a request is
+	// served under it, by ID.
+	requestsPath = "/requests"
+	// Number of requests listed when the limit parameter is not set.
+	defaultListLimit = 100
+	// maxListLimit bounds the limit parameter, as the requests are read
+	// from the backend for each call.
+	maxListLimit = 1000
+)
+
+// admin serves the requests of a queue and their status.
+type admin struct {
+	queue queue.Queue
+	// statuses is nil when status tracking is disabled.
+	statuses status.Store
+	// now returns the current time, to compute the age of requests.
+	now func() time.Time
+	// secret signs the confirmations of purges.
+	secret []byte
+	// recorder records the Events auditing purges and pauses, nil when they
+	// are only logged.
+	recorder record.EventRecorder
+	// configMaps are those of CONFIG_NAMESPACE, where the paused services
+	// are recorded, nil when services cannot be paused.
+	configMaps corev1client.ConfigMapInterface
+}
+
+// pendingRequest is a request of the queue that is not acked yet.
+type pendingRequest struct {
+	ID string `json:"id"`
+	// Target is the host of the service the request is delivered to.
+	Target string `json:"target,omitempty"`
+	// State is pending or in-flight.
+	State      status.State `json:"state"`
+	EnqueuedAt *time.Time   `json:"enqueuedAt,omitempty"`
+	// Age is the time since the request was enqueued, in seconds.
+	Age float64 `json:"age,omitempty"`
+	// Attempts is the number of times the request was sent to the service
+	// when the status store knows it, and read from the queue otherwise.
+	Attempts int `json:"attempts"`
+}
+
+type listResponse struct {
+	Requests []pendingRequest `json:"requests"`
+}
+
+// listRequests answers with up to the limit query parameter of the requests
+// of the queue that are not acked yet, those being delivered first.
+func (a *admin) listRequests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	limit := defaultListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			http.Error(w, "limit must be a number from 1 to "+strconv.Itoa(maxListLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	logger := logging.FromContext(r.Context())
+	msgs, err := queue.ListPending(r.Context(), a.queue, limit)
+	if errors.Is(err, queue.ErrListNotSupported) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		logger.Errorw("Error listing requests", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp := listResponse{Requests: make([]pendingRequest, 0, len(msgs))}
+	for _, msg := range msgs {
+		resp.Requests = append(resp.Requests, a.pendingRequest(r, msg))
+	}
+	writeJSON(w, r, resp)
+}
+
+// pendingRequest describes msg, with the attempts recorded in the status
+// store when there are some.
+func (a *admin) pendingRequest(r *http.Request, msg queue.PendingMessage) pendingRequest {
+	p := pendingRequest{ID: msg.ID, State: status.Pending, Attempts: msg.Deliveries}
+	if msg.InFlight {
+		p.State = status.InFlight
+	}
+	enqueued := msg.Enqueued
+	if d, err := request.Unmarshal(msg.Data); err == nil {
+		if d.ID != "" {
+			p.ID = d.ID
+		}
+		if u, err := url.Parse(d.ReqURL); err == nil {
+			p.Target = u.Host
+		}
+		if d.EnqueuedAt != nil {
+			enqueued = *d.EnqueuedAt
+		}
+	}
+	if !enqueued.IsZero() {
+		p.EnqueuedAt = &enqueued
+		p.Age = a.now().Sub(enqueued).Round(time.Second).Seconds()
+	}
+	if a.statuses != nil {
+		if s, err := a.statuses.Get(r.Context(), p.ID); err == nil && s.Attempts > 0 {
+			p.Attempts = s.Attempts
+		} else if err != nil && !errors.Is(err, status.ErrNotFound) {
+			logging.FromContext(r.Context()).Warnw("Error reading request status", zap.String("id", p.ID), zap.Error(err))
+		}
+	}
+	return p
+}
+
+// getRequest answers with the status of the request whose ID ends the path.
+func (a *admin) getRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if a.statuses == nil {
+		http.Error(w, "status tracking is disabled, set STATUS_BACKEND", http.StatusNotImplemented)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, requestsPath+"/")
+	s, err := a.statuses.Get(r.Context(), id)
+	if errors.Is(err, status.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Errorw("Error reading request status", zap.String("id", id), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, r, s)
+}
+
+// writeJSON writes v as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.FromContext(r.Context()).Errorw("Error writing response", zap.Error(err))
+	}
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/async-component/pkg/status"
+)
+
+func TestAuthenticated(t *testing.T) {
+	h := authenticated("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{{
+		name: "no token",
+		want: http.StatusUnauthorized,
+	}, {
+		name:   "wrong token",
+		header: "Bearer other",
+		want:   http.StatusUnauthorized,
+	}, {
+		name:   "not a bearer token",
+		header: "secret",
+		want:   http.StatusUnauthorized,
+	}, {
+		name:   "token",
+		header: "Bearer secret",
+		want:   http.StatusOK,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, requestsPath, nil)
+			if test.header != "" {
+				r.Header.Set("Authorization", test.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != test.want {
+				t.Errorf("status = %d, want %d", w.Code, test.want)
+			}
+		})
+	}
+}
+
+func TestListRequests(t *testing.T) {
+	ctx := context.Background()
+	q := queue.NewMemory(queue.MemoryConfig{MemoryQueueName: fmt.Sprint(t.Name(), time.Now().UnixNano()), MemoryReadTimeout: time.Second})
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	for i, id := range []string{"first", "second"} {
+		enqueued := now.Add(time.Duration(i-2) * time.Minute)
+		b, err := request.Marshal(request.Data{ID: id, ReqURL: "http://orders.default.svc/orders", EnqueuedAt: &enqueued}, request.FormatJSON, enqueued)
+		if err != nil {
+			t.Fatal("Marshal() =", err)
+		}
+		if err := q.Enqueue(ctx, "msg-"+id, b); err != nil {
+			t.Fatal("Enqueue() =", err)
+		}
+	}
+	if err := q.Enqueue(ctx, "msg-unreadable", []byte("not a request")); err != nil {
+		t.Fatal("Enqueue() =", err)
+	}
+	if msgs, err := q.Dequeue(ctx); err != nil || len(msgs) != 1 {
+		t.Fatalf("Dequeue() = %v, %v, want 1 message", msgs, err)
+	}
+	statuses := status.NewMemory()
+	if err := statuses.Set(ctx, status.Status{ID: "first", State: status.Pending, Attempts: 3}); err != nil {
+		t.Fatal("Set() =", err)
+	}
+	a := &admin{queue: q, statuses: statuses, now: func() time.Time { return now }}
+
+	tests := []struct {
+		name     string
+		query    string
+		want     []pendingRequest
+		wantCode int
+	}{{
+		name:     "all",
+		wantCode: http.StatusOK,
+		want: []pendingRequest{{
+			ID:         "first",
+			Target:     "orders.default.svc",
+			State:      status.InFlight,
+			EnqueuedAt: timePtr(now.Add(-2 * time.Minute)),
+			Age:        120,
+			Attempts:   3,
+		}, {
+			ID:         "second",
+			Target:     "orders.default.svc",
+			State:      status.Pending,
+			EnqueuedAt: timePtr(now.Add(-time.Minute)),
+			Age:        60,
+		}, {
+			ID:    "msg-unreadable",
+			State: status.Pending,
+		}},
+	}, {
+		name:     "limit",
+		query:    "?limit=1",
+		wantCode: http.StatusOK,
+		want: []pendingRequest{{
+			ID:         "first",
+			Target:     "orders.default.svc",
+			State:      status.InFlight,
+			EnqueuedAt: timePtr(now.Add(-2 * time.Minute)),
+			Age:        120,
+			Attempts:   3,
+		}},
+	}, {
+		name:     "invalid limit",
+		query:    "?limit=0",
+		wantCode: http.StatusBadRequest,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			a.listRequests(w, httptest.NewRequest(http.MethodGet, requestsPath+test.query, nil))
+			if w.Code != test.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, test.wantCode, w.Body)
+			}
+			if test.wantCode != http.StatusOK {
+				return
+			}
+			var got listResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal("Error decoding response:", err)
+			}
+			// The enqueue time of requests that cannot be read is the time
+			// of the queue.
+			for i := range got.Requests {
+				if got.Requests[i].ID == "msg-unreadable" {
+					got.Requests[i].EnqueuedAt, got.Requests[i].Age = nil, 0
+				}
+			}
+			if diff := cmp.Diff(test.want, got.Requests); diff != "" {
+				t.Error("requests (-want, +got):", diff)
+			}
+		})
+	}
+}
+
+func TestListRequestsNotSupported(t *testing.T) {
+	a := &admin{queue: &queue.Channel{}, now: time.Now}
+	w := httptest.NewRecorder()
+	a.listRequests(w, httptest.NewRequest(http.MethodGet, requestsPath, nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotImplemented)
+	}
+}
+
+func TestGetRequest(t *testing.T) {
+	statuses := status.NewMemory()
+	want := status.Status{ID: "known", State: status.Failed, StatusCode: 500, Attempts: 2, Updated: time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)}
+	if err := statuses.Set(context.Background(), want); err != nil {
+		t.Fatal("Set() =", err)
+	}
+	tests := []struct {
+		name     string
+		statuses status.Store
+		id       string
+		wantCode int
+	}{{
+		name:     "known",
+		statuses: statuses,
+		id:       "known",
+		wantCode: http.StatusOK,
+	}, {
+		name:     "unknown",
+		statuses: statuses,
+		id:       "unknown",
+		wantCode: http.StatusNotFound,
+	}, {
+		name:     "status tracking disabled",
+		id:       "known",
+		wantCode: http.StatusNotImplemented,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := &admin{statuses: test.statuses, now: time.Now}
+			w := httptest.NewRecorder()
+			a.getRequest(w, httptest.NewRequest(http.MethodGet, requestsPath+"/"+test.id, nil))
+			if w.Code != test.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, test.wantCode)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var got status.Status
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal("Error decoding response:", err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Error("status (-want, +got):", diff)
+			}
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
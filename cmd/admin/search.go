@@ -0,0 +1,101 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/status"
+	"knative.dev/pkg/logging"
+)
+
+// Path searching the requests indexed by the status store.
+const searchPath = "/search"
+
+// states are the states the requests are searched by.
+var states = map[status.State]bool{
+	status.Pending:   true,
+	status.InFlight:  true,
+	status.Succeeded: true,
+	status.Failed:    true,
+	status.Cancelled: true,
+	status.Expired:   true,
+}
+
+type searchResponse struct {
+	Requests []status.Match `json:"requests"`
+}
+
+// search answers with the requests matching the target, subject, state,
+// from and to query parameters, up to limit, the most recent first.
+func (a *admin) search(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if a.statuses == nil {
+		http.Error(w, "status tracking is disabled, set STATUS_BACKEND", http.StatusNotImplemented)
+		return
+	}
+	params := r.URL.Query()
+	q := status.Query{
+		Target:  params.Get("target"),
+		Subject: params.Get("subject"),
+		State:   status.State(params.Get("state")),
+		Limit:   defaultListLimit,
+	}
+	if q.State != "" && !states[q.State] {
+		http.Error(w, "unknown state "+strconv.Quote(string(q.State)), http.StatusBadRequest)
+		return
+	}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		if v := params.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, p.name+" must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			*p.t = t
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			http.Error(w, "limit must be a number from 1 to "+strconv.Itoa(maxListLimit), http.StatusBadRequest)
+			return
+		}
+		q.Limit = n
+	}
+	matches, err := status.Search(r.Context(), a.statuses, q)
+	if errors.Is(err, status.ErrSearchNotSupported) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Errorw("Error searching requests", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp := searchResponse{Requests: matches}
+	if resp.Requests == nil {
+		resp.Requests = []status.Match{}
+	}
+	writeJSON(w, r, resp)
+}
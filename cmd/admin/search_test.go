@@ -0,0 +1,115 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"knative.dev/async-component/pkg/status"
+)
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	statuses := status.NewMemory()
+	submitted := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	for _, s := range []status.Status{
+		{ID: "pending", State: status.Pending},
+		{ID: "succeeded", State: status.Succeeded, StatusCode: 200},
+	} {
+		s.Updated = submitted
+		if err := statuses.Index(ctx, status.IndexEntry{ID: s.ID, Target: "orders.default.svc", Subject: "alice", Submitted: submitted}); err != nil {
+			t.Fatal("Index() =", err)
+		}
+		if err := statuses.Set(ctx, s); err != nil {
+			t.Fatal("Set() =", err)
+		}
+	}
+	tests := []struct {
+		name     string
+		statuses status.Store
+		query    string
+		wantCode int
+		want     []string
+	}{{
+		name:     "target and state",
+		statuses: statuses,
+		query:    "?target=orders.default.svc&state=pending",
+		wantCode: http.StatusOK,
+		want:     []string{"pending"},
+	}, {
+		name:     "time range",
+		statuses: statuses,
+		query:    "?subject=alice&from=2021-03-01T09:00:00Z&to=2021-03-01T11:00:00Z",
+		wantCode: http.StatusOK,
+		want:     []string{"pending", "succeeded"},
+	}, {
+		name:     "no match",
+		statuses: statuses,
+		query:    "?to=2021-03-01T09:00:00Z",
+		wantCode: http.StatusOK,
+		want:     []string{},
+	}, {
+		name:     "unknown state",
+		statuses: statuses,
+		query:    "?state=done",
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "invalid time",
+		statuses: statuses,
+		query:    "?from=yesterday",
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "invalid limit",
+		statuses: statuses,
+		query:    "?limit=0",
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "status tracking disabled",
+		wantCode: http.StatusNotImplemented,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := &admin{statuses: test.statuses, now: time.Now}
+			w := httptest.NewRecorder()
+			a.search(w, httptest.NewRequest(http.MethodGet, searchPath+test.query, nil))
+			if w.Code != test.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, test.wantCode)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var resp searchResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal("Error decoding response:", err)
+			}
+			got := []string{}
+			for _, m := range resp.Requests {
+				got = append(got, m.ID)
+			}
+			// Requests submitted at the same time are in any order.
+			if len(got) == 2 && got[0] > got[1] {
+				got[0], got[1] = got[1], got[0]
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("requests = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
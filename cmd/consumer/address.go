@@ -0,0 +1,61 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"knative.dev/async-component/pkg/headers"
+)
+
+const (
+	// Header carrying the Host the request was sent to, stored by the
+	// producer.
+	requestHostHeader = "Async-Request-Host"
+)
+
+// addressConfig holds the environment configuration of the address the
+// requests are delivered to.
+type addressConfig struct {
+	// DeliveryClusterLocal delivers the requests to the cluster-local
+	// address of their service, with the Host header they were sent with,
+	// rather than to their URL.
+	DeliveryClusterLocal bool `envconfig:"DELIVERY_CLUSTER_LOCAL"`
+}
+
+// deliveryAddress returns the URL a request to reqURL with header is
+// delivered to and its Host header, empty to use the host of the URL. When
+// clusterLocal is set, the request is sent to the cluster-local host of its
+// service with the Host it was sent with, if they are known.
+func deliveryAddress(reqURL string, header http.Header, clusterLocal bool) (string, string) {
+	if !clusterLocal {
+		return reqURL, ""
+	}
+	u, err := url.Parse(reqURL)
+	if err != nil {
+		return reqURL, ""
+	}
+	host := u.Host
+	if h := header.Get(requestHostHeader); h != "" {
+		host = h
+	}
+	if local := header.Get(headers.OriginalHost); local != "" {
+		u.Host = local
+	}
+	if host == u.Host {
+		return reqURL, ""
+	}
+	return u.String(), host
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"knative.dev/async-component/pkg/headers"
+	"knative.dev/async-component/pkg/request"
+)
+
+func TestDeliveryAddress(t *testing.T) {
+	stored := http.Header{
+		headers.OriginalHost: {"hello.default.svc.cluster.local"},
+		requestHostHeader:    {"hello.example.com"},
+	}
+	tests := []struct {
+		name         string
+		reqURL       string
+		header       http.Header
+		clusterLocal bool
+		wantURL      string
+		wantHost     string
+	}{{
+		name:    "disabled",
+		reqURL:  "http://hello.default.svc.cluster.local/path?a=1",
+		header:  stored,
+		wantURL: "http://hello.default.svc.cluster.local/path?a=1",
+	}, {
+		name:         "cluster-local URL",
+		reqURL:       "http://hello.default.svc.cluster.local/path?a=1",
+		header:       stored,
+		clusterLocal: true,
+		wantURL:      "http://hello.default.svc.cluster.local/path?a=1",
+		wantHost:     "hello.example.com",
+	}, {
+		name:         "external URL",
+		reqURL:       "https://hello.example.com/path",
+		header:       http.Header{headers.OriginalHost: {"hello.default.svc.cluster.local"}},
+		clusterLocal: true,
+		wantURL:      "https://hello.default.svc.cluster.local/path",
+		wantHost:     "hello.example.com",
+	}, {
+		name:         "unknown hosts",
+		reqURL:       "http://hello.default.svc.cluster.local/path",
+		clusterLocal: true,
+		wantURL:      "http://hello.default.svc.cluster.local/path",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gotURL, gotHost := deliveryAddress(test.reqURL, test.header, test.clusterLocal)
+			if gotURL != test.wantURL || gotHost != test.wantHost {
+				t.Errorf("deliveryAddress() = %s, %q, want %s, %q", gotURL, gotHost, test.wantURL, test.wantHost)
+			}
+		})
+	}
+}
+
+func TestDeliverClusterLocal(t *testing.T) {
+	var gotHost, gotPath string
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost, gotPath = r.Host, r.URL.Path
+	}))
+	defer testserver.Close()
+	env = envInfo{retryConfig: retryConfig{DeliveryAttempts: 1}, addressConfig: addressConfig{DeliveryClusterLocal: true}}
+	defer func() { env = envInfo{} }()
+
+	out, err := json.Marshal(request.Data{
+		ID:        "123",
+		ReqURL:    "http://hello.example.com/path",
+		ReqMethod: http.MethodGet,
+		ReqHeader: map[string][]string{headers.OriginalHost: {strings.TrimPrefix(testserver.URL, "http://")}},
+	})
+	if err != nil {
+		t.Fatalf("Error marshaling json for test")
+	}
+	if err := deliver(context.Background(), out); err != nil {
+		t.Fatal("deliver() =", err)
+	}
+	if gotHost != "hello.example.com" || gotPath != "/path" {
+		t.Errorf("service got Host %q and path %q, want hello.example.com and /path", gotHost, gotPath)
+	}
+}
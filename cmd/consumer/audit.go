@@ -0,0 +1,95 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"knative.dev/async-component/pkg/audit"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/async-component/pkg/status"
+)
+
+// Name of the consumer in the audit trail.
+const auditComponent = "consumer"
+
+type auditRequestKey struct{}
+
+// withAuditRequest returns ctx carrying the request of the audit events
+// recorded with it.
+func withAuditRequest(ctx context.Context, data *request.Data) context.Context {
+	if auditor == nil {
+		return ctx
+	}
+	e := audit.Event{RequestID: data.ID, Target: requestHost(data.ReqURL), Method: data.ReqMethod}
+	if u, err := url.Parse(data.ReqURL); err == nil {
+		e.Path = u.Path
+	}
+	return context.WithValue(ctx, auditRequestKey{}, e)
+}
+
+// recordAudit records e, about the request of ctx unless it names another.
+func recordAudit(ctx context.Context, e audit.Event) {
+	if auditor == nil {
+		return
+	}
+	if r, ok := ctx.Value(auditRequestKey{}).(audit.Event); ok && (e.RequestID == "" || e.RequestID == r.RequestID) {
+		e.RequestID, e.Target, e.Method, e.Path = r.RequestID, r.Target, r.Method, r.Path
+	}
+	auditor.Record(ctx, e)
+}
+
+// auditAttempt records a delivery attempt, answered with resp or failed with
+// err.
+func auditAttempt(ctx context.Context, attempt int, resp *http.Response, err error) {
+	e := audit.Event{Type: audit.Attempted, Attempt: attempt}
+	if err != nil {
+		e.Reason = err.Error()
+	} else {
+		e.StatusCode = resp.StatusCode
+	}
+	recordAudit(ctx, e)
+}
+
+// auditOutcome records the outcome of the delivery of request id, when
+// state is final.
+func auditOutcome(ctx context.Context, id string, state status.State, attempts, statusCode int, reason string) {
+	e := audit.Event{RequestID: id, Attempt: attempts, StatusCode: statusCode, Reason: reason}
+	switch state {
+	case status.Succeeded:
+		e.Type = audit.Succeeded
+	case status.Failed:
+		e.Type = audit.Failed
+	case status.Expired:
+		e.Type = audit.Expired
+	default:
+		return
+	}
+	recordAudit(ctx, e)
+}
+
+// auditDeadLettered records that msg was dead-lettered for reason.
+func auditDeadLettered(ctx context.Context, msg queue.Message, reason string) {
+	if auditor == nil {
+		return
+	}
+	e := audit.Event{Type: audit.DeadLettered, RequestID: msg.ID, Reason: reason}
+	if data, err := request.Unmarshal(msg.Data); err == nil {
+		ctx, e.RequestID = withAuditRequest(ctx, data), data.ID
+	}
+	recordAudit(ctx, e)
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"knative.dev/async-component/pkg/audit"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+)
+
+// auditSink records the audit events written.
+type auditSink struct {
+	events []audit.Event
+}
+
+func (s *auditSink) Write(ctx context.Context, e audit.Event) error {
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *auditSink) Close() error { return nil }
+
+func TestAudit(t *testing.T) {
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer testserver.Close()
+	host := strings.TrimPrefix(testserver.URL, "http://")
+
+	tests := []struct {
+		name   string
+		reqURL string
+		want   []audit.Event
+	}{{
+		name:   "delivered",
+		reqURL: testserver.URL + "/orders",
+		want: []audit.Event{
+			{Type: audit.Attempted, Target: host, Path: "/orders", Attempt: 1, StatusCode: http.StatusCreated},
+			{Type: audit.Succeeded, Target: host, Path: "/orders", Attempt: 1, StatusCode: http.StatusCreated},
+		},
+	}, {
+		name:   "dead-lettered",
+		reqURL: "http://127.0.0.1:1/orders",
+		want: []audit.Event{
+			{Type: audit.Attempted, Target: "127.0.0.1:1", Path: "/orders", Attempt: 1},
+			{Type: audit.Failed, Target: "127.0.0.1:1", Path: "/orders", Attempt: 1},
+			{Type: audit.DeadLettered, Target: "127.0.0.1:1", Path: "/orders"},
+		},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sink := &auditSink{}
+			auditor = audit.NewRecorder(sink, auditComponent, time.Second)
+			defer func() { auditor = nil }()
+
+			out, err := json.Marshal(request.Data{ID: "123", ReqURL: test.reqURL, ReqMethod: http.MethodPost})
+			if err != nil {
+				t.Fatal("Error marshaling request:", err)
+			}
+			handleMessage(context.Background(), &fakeQueue{}, queue.Message{ID: "1-0", Data: out})
+
+			for i := range test.want {
+				test.want[i].Component, test.want[i].RequestID, test.want[i].Method = auditComponent, "123", http.MethodPost
+			}
+			// The reasons are the errors of the delivery.
+			for _, e := range sink.events {
+				if (e.StatusCode == 0) != (e.Reason != "") {
+					t.Errorf("event %s has reason %q, want one only without a response", e.Type, e.Reason)
+				}
+			}
+			if diff := cmp.Diff(test.want, sink.events, cmpopts.IgnoreFields(audit.Event{}, "Time", "Reason")); diff != "" {
+				t.Error("audit events (-want, +got):", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/prefer"
+	"knative.dev/async-component/pkg/status"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// Header naming the callback URL, for clients that cannot add a callback
+	// parameter to the Prefer header.
+	callbackHeader = "Async-Callback-Url"
+	// The Prefer parameter of respond-async naming the callback URL.
+	callbackParam = "callback"
+	// Header set on callbacks to the ID of the async request.
+	requestIDHeader = "Async-Request-Id"
+)
+
+// callbackConfig holds the environment configuration of result callbacks.
+type callbackConfig struct {
+	CallbackRetries int           `envconfig:"CALLBACK_RETRIES" default:"5"`
+	CallbackBackoff time.Duration `envconfig:"CALLBACK_BACKOFF" default:"1s"`
+	CallbackTimeout time.Duration `envconfig:"CALLBACK_TIMEOUT" default:"10s"`
+	// CallbackMaxElapsed bounds the time spent on a callback, its attempts
+	// and the waits between them included, so failing callback endpoints do
+	// not hold a delivery slot. It is not bounded when zero.
+	CallbackMaxElapsed time.Duration `envconfig:"CALLBACK_MAX_ELAPSED" default:"1m"`
+	// CallbackBodyLimit is the number of bytes of the response body sent to
+	// the callback URL, which is cut beyond it. It is not limited when zero.
+	CallbackBodyLimit int64 `envconfig:"CALLBACK_BODY_LIMIT" default:"1048576"`
+	// CallbackAllowedHosts lists the hosts callbacks may be sent to, those
+	// starting with a dot matching their subdomains. Any host is allowed
+	// when empty.
+	CallbackAllowedHosts []string `envconfig:"CALLBACK_ALLOWED_HOSTS"`
+	// CallbackAllowPrivate allows callbacks to loopback, private and
+	// link-local addresses, such as those of the cluster, which are refused
+	// otherwise.
+	CallbackAllowPrivate bool `envconfig:"CALLBACK_ALLOW_PRIVATE"`
+	// CallbackOnDeadline has the callback URL of requests read after their
+	// deadline told that they expired.
+	CallbackOnDeadline bool `envconfig:"CALLBACK_ON_DEADLINE"`
+}
+
+// callbackResult is the body POSTed to the callback URL.
+type callbackResult struct {
+	ID         string              `json:"id"`
+	StatusCode int                 `json:"status"`
+	Header     map[string][]string `json:"header"`
+	Body       string              `json:"body"`
+	// Truncated is set when the body was cut at CALLBACK_BODY_LIMIT.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// expiredCallback is the body POSTed to the callback URL of requests that
+// expired before being delivered.
+type expiredCallback struct {
+	ID     string       `json:"id"`
+	State  status.State `json:"state"`
+	Reason string       `json:"reason"`
+}
+
+// errCallbackNotAllowed is returned for callbacks refused by the policy of
+// CALLBACK_ALLOWED_HOSTS and CALLBACK_ALLOW_PRIVATE. They are not retried.
+var errCallbackNotAllowed = errors.New("callback not allowed")
+
+// privateNetworks are the networks callbacks are refused to without
+// CALLBACK_ALLOW_PRIVATE, along with loopback, link-local, multicast and
+// unspecified addresses.
+var privateNetworks = parseNetworks("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+
+// callbackTransport carries the callbacks to public addresses.
+var callbackTransport = newCallbackTransport()
+
+// callbackURL returns the URL the result of a request should be sent to, if
+// the caller asked for one.
+func callbackURL(header http.Header) string {
+	if pref, ok := prefer.Parse(header).Get(prefer.RespondAsync); ok && pref.Params[callbackParam] != "" {
+		return pref.Params[callbackParam]
+	}
+	return header.Get(callbackHeader)
+}
+
+// sendCallback POSTs the response of request id to url.
+func sendCallback(ctx context.Context, url, id string, resp *http.Response, cfg callbackConfig) error {
+	var r io.Reader = resp.Body
+	if cfg.CallbackBodyLimit > 0 {
+		r = io.LimitReader(resp.Body, cfg.CallbackBodyLimit+1)
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	truncated := cfg.CallbackBodyLimit > 0 && int64(len(body)) > cfg.CallbackBodyLimit
+	if truncated {
+		body = body[:cfg.CallbackBodyLimit]
+	}
+	payload, err := json.Marshal(callbackResult{
+		ID:         id,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       string(body),
+		Truncated:  truncated,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal callback: %w", err)
+	}
+	return postWithRetries(ctx, url, id, payload, cfg)
+}
+
+// sendExpiredCallback tells url that request id expired for reason, with the
+// same retries as sendCallback.
+func sendExpiredCallback(ctx context.Context, url, id, reason string, cfg callbackConfig) error {
+	payload, err := json.Marshal(expiredCallback{ID: id, State: status.Expired, Reason: reason})
+	if err != nil {
+		return fmt.Errorf("failed to marshal callback: %w", err)
+	}
+	return postWithRetries(ctx, url, id, payload, cfg)
+}
+
+// postWithRetries POSTs the callback payload of request id to url, retrying
+// with exponential backoff while the callback endpoint is unreachable or fails
+// with a retryable status, for up to CALLBACK_MAX_ELAPSED.
+func postWithRetries(ctx context.Context, url, id string, payload []byte, cfg callbackConfig) error {
+	if err := checkCallbackURL(url, cfg); err != nil {
+		return err
+	}
+	if cfg.CallbackMaxElapsed > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.CallbackMaxElapsed)
+		defer cancel()
+	}
+	client := callbackClient(cfg)
+	backoff := cfg.CallbackBackoff
+	for attempt := 0; ; attempt++ {
+		retryable, err := postCallback(ctx, client, url, id, payload)
+		if err == nil || !retryable || attempt >= cfg.CallbackRetries {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			return fmt.Errorf("gave up on callback after %d attempts: %w", attempt+1, err)
+		}
+		logging.FromContext(ctx).Infow("Error sending callback, retrying", zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up on callback after %d attempts: %w", attempt+1, err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// postCallback makes a single callback attempt and reports whether a failure
+// is worth retrying.
+func postCallback(ctx context.Context, client *http.Client, url, id string, payload []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return false, fmt.Errorf("unable to create callback request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(requestIDHeader, id)
+	resp, err := client.Do(req)
+	if err != nil {
+		return !errors.Is(err, errCallbackNotAllowed) && ctx.Err() == nil, fmt.Errorf("problem calling callback url: %w", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("callback url returned %d", resp.StatusCode)
+	case resp.StatusCode >= http.StatusBadRequest:
+		return false, fmt.Errorf("callback url returned %d", resp.StatusCode)
+	}
+	return false, nil
+}
+
+// callbackClient returns the client sending callbacks with cfg. Unless
+// CALLBACK_ALLOW_PRIVATE is set, it only connects to public addresses,
+// whatever the host of the callback URL resolves to.
+func callbackClient(cfg callbackConfig) *http.Client {
+	client := &http.Client{
+		Timeout:   cfg.CallbackTimeout,
+		Transport: callbackTransport,
+		// Redirects are held to the policy of the callback URL.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return checkCallbackURL(req.URL.String(), cfg)
+		},
+	}
+	if cfg.CallbackAllowPrivate {
+		client.Transport = http.DefaultTransport
+	}
+	return client
+}
+
+// checkCallbackURL returns an error wrapping errCallbackNotAllowed unless
+// rawURL is an http or https URL of a host allowed by cfg.
+func checkCallbackURL(rawURL string, cfg callbackConfig) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: %q is not an http or https URL", errCallbackNotAllowed, rawURL)
+	}
+	if len(cfg.CallbackAllowedHosts) == 0 {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range cfg.CallbackAllowedHosts {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: host %q is not in CALLBACK_ALLOWED_HOSTS", errCallbackNotAllowed, host)
+}
+
+// newCallbackTransport returns a transport refusing to connect to addresses
+// that are not public. It does not use proxies, which would connect on its
+// behalf.
+func newCallbackTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublic(ip) {
+				return fmt.Errorf("%w: %s is not a public address", errCallbackNotAllowed, host)
+			}
+			return nil
+		},
+	}).DialContext
+	return transport
+}
+
+// isPublic reports whether ip is a public unicast address.
+func isPublic(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseNetworks parses the CIDR notations of networks.
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
@@ -0,0 +1,268 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCallbackURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   string
+	}{{
+		name:   "no callback",
+		header: http.Header{"Prefer": {"respond-async"}},
+	}, {
+		name:   "prefer parameter",
+		header: http.Header{"Prefer": {`respond-async; callback="http://example.com/done", wait=10`}},
+		want:   "http://example.com/done",
+	}, {
+		name:   "dedicated header",
+		header: http.Header{"Prefer": {"respond-async"}, "Async-Callback-Url": {"http://example.com/header"}},
+		want:   "http://example.com/header",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := callbackURL(test.header); got != test.want {
+				t.Errorf("callbackURL() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSendCallback(t *testing.T) {
+	tests := []struct {
+		name          string
+		statuses      []int
+		limit         int64
+		wantAttempts  int
+		wantErr       bool
+		wantBody      string
+		wantTruncated bool
+	}{{
+		name:         "accepted",
+		statuses:     []int{http.StatusOK},
+		wantAttempts: 1,
+	}, {
+		name:          "body over the limit",
+		statuses:      []int{http.StatusOK},
+		limit:         4,
+		wantAttempts:  1,
+		wantBody:      "crea",
+		wantTruncated: true,
+	}, {
+		name:         "body at the limit",
+		statuses:     []int{http.StatusOK},
+		limit:        7,
+		wantAttempts: 1,
+	}, {
+		name:         "retried until accepted",
+		statuses:     []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusNoContent},
+		wantAttempts: 3,
+	}, {
+		name:         "retries exhausted",
+		statuses:     []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError},
+		wantAttempts: 3,
+		wantErr:      true,
+	}, {
+		name:         "client error is not retried",
+		statuses:     []int{http.StatusNotFound},
+		wantAttempts: 1,
+		wantErr:      true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			var got callbackResult
+			callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if id := r.Header.Get(requestIDHeader); id != "123" {
+					t.Errorf("%s = %q, want 123", requestIDHeader, id)
+				}
+				json.NewDecoder(r.Body).Decode(&got)
+				w.WriteHeader(test.statuses[attempts])
+				attempts++
+			}))
+			defer callback.Close()
+
+			resp := &http.Response{
+				StatusCode: http.StatusCreated,
+				Header:     http.Header{"Content-Type": {"text/plain"}},
+				Body:       ioutil.NopCloser(strings.NewReader("created")),
+			}
+			cfg := callbackConfig{CallbackRetries: 2, CallbackBodyLimit: test.limit, CallbackAllowPrivate: true}
+			err := sendCallback(context.Background(), callback.URL, "123", resp, cfg)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("sendCallback() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if attempts != test.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, test.wantAttempts)
+			}
+			wantBody := test.wantBody
+			if wantBody == "" {
+				wantBody = "created"
+			}
+			if got.ID != "123" || got.StatusCode != http.StatusCreated || got.Body != wantBody || got.Truncated != test.wantTruncated {
+				t.Errorf("callback got %+v, want body %q, truncated: %v", got, wantBody, test.wantTruncated)
+			}
+		})
+	}
+}
+
+func TestSendCallbackMaxElapsed(t *testing.T) {
+	attempts := 0
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer callback.Close()
+
+	cfg := callbackConfig{
+		CallbackRetries:      10,
+		CallbackBackoff:      50 * time.Millisecond,
+		CallbackMaxElapsed:   200 * time.Millisecond,
+		CallbackAllowPrivate: true,
+	}
+	start := time.Now()
+	if err := sendExpiredCallback(context.Background(), callback.URL, "123", "expired", cfg); err == nil {
+		t.Fatal("sendExpiredCallback() = nil, want an error")
+	}
+	// Waits of 50ms, 100ms then 200ms, which would go past the 200ms.
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("sendExpiredCallback() took %v, want less than CALLBACK_MAX_ELAPSED", elapsed)
+	}
+}
+
+func TestSendCallbackNotAllowed(t *testing.T) {
+	attempts := 0
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+	}))
+	defer callback.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(callback.URL, http.StatusTemporaryRedirect))
+	defer redirect.Close()
+	_, redirectPort, err := net.SplitHostPort(strings.TrimPrefix(redirect.URL, "http://"))
+	if err != nil {
+		t.Fatal("SplitHostPort() =", err)
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		cfg  callbackConfig
+	}{{
+		name: "private address",
+		url:  callback.URL,
+		cfg:  callbackConfig{CallbackRetries: 2},
+	}, {
+		name: "host not allowed",
+		url:  callback.URL,
+		cfg:  callbackConfig{CallbackRetries: 2, CallbackAllowPrivate: true, CallbackAllowedHosts: []string{"example.com"}},
+	}, {
+		name: "redirect to a host not allowed",
+		url:  "http://localhost:" + redirectPort,
+		cfg:  callbackConfig{CallbackRetries: 2, CallbackAllowPrivate: true, CallbackAllowedHosts: []string{"localhost"}},
+	}, {
+		name: "not an http url",
+		url:  "file:///etc/passwd",
+		cfg:  callbackConfig{CallbackRetries: 2, CallbackAllowPrivate: true},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts = 0
+			err := sendExpiredCallback(context.Background(), test.url, "123", "expired", test.cfg)
+			if !errors.Is(err, errCallbackNotAllowed) {
+				t.Errorf("sendExpiredCallback() = %v, want %v", err, errCallbackNotAllowed)
+			}
+			if attempts != 0 {
+				t.Errorf("callback got %d attempts, want none", attempts)
+			}
+		})
+	}
+}
+
+func TestCheckCallbackURL(t *testing.T) {
+	allowed := []string{"example.com", ".example.org"}
+	tests := []struct {
+		url     string
+		allowed []string
+		wantErr bool
+	}{{
+		url: "https://anything.example.net/done",
+	}, {
+		url:     "https://EXAMPLE.com:8443/done",
+		allowed: allowed,
+	}, {
+		url:     "https://api.example.org/done",
+		allowed: allowed,
+	}, {
+		url:     "https://api.example.com/done",
+		allowed: allowed,
+		wantErr: true,
+	}, {
+		url:     "https://example.org.evil.com/done",
+		allowed: allowed,
+		wantErr: true,
+	}, {
+		url:     "ftp://example.com/done",
+		wantErr: true,
+	}, {
+		url:     "/done",
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			err := checkCallbackURL(test.url, callbackConfig{CallbackAllowedHosts: test.allowed})
+			if (err != nil) != test.wantErr {
+				t.Errorf("checkCallbackURL() = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	tests := map[string]bool{
+		"93.184.216.34":   true,
+		"2606:2800:220::": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.96.0.1":       false,
+		"172.20.3.4":      false,
+		"192.168.1.1":     false,
+		"100.64.0.10":     false,
+		"169.254.169.254": false,
+		"fd00::1":         false,
+		"fe80::1":         false,
+		"0.0.0.0":         false,
+		"224.0.0.1":       false,
+	}
+	for addr, want := range tests {
+		if got := isPublic(net.ParseIP(addr)); got != want {
+			t.Errorf("isPublic(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
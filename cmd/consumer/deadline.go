@@ -0,0 +1,73 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/async-component/pkg/status"
+	"knative.dev/pkg/logging"
+)
+
+// errDeadlinePassed is the reason recorded for requests read after the
+// deadline set by their caller. They are acked without being delivered.
+var errDeadlinePassed = errors.New("request deadline passed")
+
+// pastDeadline reports whether the deadline of the request passed before it
+// was read. The request is then recorded as expired, its offloaded body is
+// deleted and, with CALLBACK_ON_DEADLINE, its callback URL is told.
+func pastDeadline(ctx context.Context, data *request.Data) bool {
+	if data.Deadline == nil || !time.Now().After(*data.Deadline) {
+		return false
+	}
+	logger := logging.FromContext(ctx)
+	logger.Infow("Request deadline passed, skipping it", zap.Time("deadline", *data.Deadline))
+	reason := fmt.Sprintf("%v at %s", errDeadlinePassed, data.Deadline.Format(time.RFC3339))
+	setStatus(ctx, data, status.Expired, 0, reason)
+	if data.ReqBodyRef != "" && blobs != nil {
+		if err := blobs.Delete(ctx, data.ReqBodyRef); err != nil {
+			logger.Errorw("Error deleting request body", zap.Error(err))
+		}
+	}
+	cfg := current().callbackConfig
+	if !cfg.CallbackOnDeadline {
+		return true
+	}
+	header := http.Header(data.ReqHeader)
+	// The callback URL of sealed requests is encrypted with their headers.
+	if data.Sealed != "" {
+		if encryptor == nil {
+			logger.Error("Cannot read the callback URL of an encrypted request, encryption is not configured")
+			return true
+		}
+		opened := *data
+		if err := encryptor.Open(&opened); err != nil {
+			logger.Errorw("Error reading the callback URL of an encrypted request", zap.Error(err))
+			return true
+		}
+		header = http.Header(opened.ReqHeader)
+	}
+	if callback := callbackURL(header); callback != "" {
+		if err := sendExpiredCallback(ctx, callback, data.ID, reason, cfg); err != nil {
+			logger.Errorw("Error sending callback", zap.Error(err))
+		}
+	}
+	return true
+}
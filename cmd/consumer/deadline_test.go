@@ -0,0 +1,117 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/async-component/pkg/status"
+)
+
+func TestDeliverPastDeadline(t *testing.T) {
+	delivered := false
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered = true
+	}))
+	defer testserver.Close()
+	callbacks := make(chan expiredCallback, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var res expiredCallback
+		if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+			t.Error("Error decoding callback:", err)
+		}
+		callbacks <- res
+	}))
+	defer callback.Close()
+	statuses = status.NewMemory()
+	defer func() { statuses = nil }()
+
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	tests := []struct {
+		name          string
+		deadline      *time.Time
+		notify        bool
+		wantDelivered bool
+		wantCallback  bool
+	}{{
+		name:          "no deadline",
+		wantDelivered: true,
+	}, {
+		name:          "before the deadline",
+		deadline:      &future,
+		notify:        true,
+		wantDelivered: true,
+	}, {
+		name:     "past the deadline",
+		deadline: &past,
+	}, {
+		name:         "past the deadline with a callback",
+		deadline:     &past,
+		notify:       true,
+		wantCallback: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delivered = false
+			env = envInfo{callbackConfig: callbackConfig{CallbackOnDeadline: test.notify, CallbackTimeout: time.Second, CallbackAllowPrivate: true}}
+			defer func() { env = envInfo{} }()
+			out, err := json.Marshal(request.Data{
+				ID:        test.name,
+				ReqURL:    testserver.URL,
+				ReqMethod: http.MethodPost,
+				ReqHeader: map[string][]string{callbackHeader: {callback.URL}},
+				Deadline:  test.deadline,
+			})
+			if err != nil {
+				t.Fatalf("Error marshaling json for test")
+			}
+			if err := deliver(context.Background(), out); err != nil {
+				t.Fatal("deliver() =", err)
+			}
+			if delivered != test.wantDelivered {
+				t.Errorf("delivered = %v, want %v", delivered, test.wantDelivered)
+			}
+			got, err := statuses.Get(context.Background(), test.name)
+			if err != nil {
+				t.Fatal("Error reading status:", err)
+			}
+			if expired := got.State == status.Expired; expired == test.wantDelivered {
+				t.Errorf("got status %+v, want expired: %v", got, !test.wantDelivered)
+			}
+			// Delivered requests get the callback of their result.
+			if test.wantDelivered {
+				<-callbacks
+				return
+			}
+			select {
+			case res := <-callbacks:
+				if !test.wantCallback {
+					t.Errorf("got callback %+v, want none", res)
+				} else if res.ID != test.name || res.State != status.Expired || res.Reason != got.Reason {
+					t.Errorf("got callback %+v, want the expiry of %q", res, test.name)
+				}
+			default:
+				if test.wantCallback {
+					t.Error("Callback was not sent")
+				}
+			}
+		})
+	}
+}
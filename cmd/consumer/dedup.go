@@ -0,0 +1,83 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"knative.dev/async-component/pkg/idempotency"
+	"knative.dev/async-component/pkg/queue"
+)
+
+const (
+	// Header carrying the async.knative.dev/idempotent annotation of the
+	// service, set by the ingress and stored with the request.
+	serviceIdempotentHeader = "Async-Service-Idempotent"
+	// Prefix of the keys recording the requests being or already delivered.
+	deliveredKeyPrefix = "delivered:"
+)
+
+// dedupConfig holds the environment configuration of the deduplication of
+// deliveries to the services that are not idempotent.
+type dedupConfig struct {
+	// DeliveryDedupBackend is the idempotency backend recording the
+	// requests delivered to services annotated with
+	// async.knative.dev/idempotent: "false", redis or memory. Requests are
+	// not deduplicated when it is empty.
+	DeliveryDedupBackend string `envconfig:"DELIVERY_DEDUP_BACKEND"`
+	// DeliveryDedupWindow is how long delivered requests are remembered.
+	// It must be longer than the time it takes for a request left pending
+	// by a crashed consumer to be read again.
+	DeliveryDedupWindow time.Duration `envconfig:"DELIVERY_DEDUP_WINDOW" default:"1h"`
+}
+
+// deliveries records the requests being or already delivered, when
+// deduplication is enabled.
+var deliveries idempotency.Store
+
+// newDeliveryStore returns the store deduplicating deliveries described by
+// cfg, or nil when deduplication is disabled.
+func newDeliveryStore(ctx context.Context, cfg dedupConfig, redisCfg queue.RedisConfig) (idempotency.Store, error) {
+	return idempotency.New(ctx, idempotency.DedupConfig{
+		IdempotencyBackend: cfg.DeliveryDedupBackend,
+		IdempotencyWindow:  cfg.DeliveryDedupWindow,
+	}, redisCfg)
+}
+
+// serviceIdempotent reports whether the service of a request with header
+// can be sent the request twice, which is the case unless it is annotated
+// otherwise.
+func serviceIdempotent(header http.Header) bool {
+	return header.Get(serviceIdempotentHeader) != "false"
+}
+
+// claimDelivery records that request id is being delivered. It returns
+// false when the request was delivered already, such as by a consumer that
+// crashed before acking it, or is being delivered.
+func claimDelivery(ctx context.Context, id string) (bool, error) {
+	_, claimed, err := deliveries.Claim(ctx, deliveredKeyPrefix+id, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to record the delivery: %w", err)
+	}
+	return claimed, nil
+}
+
+// releaseDelivery forgets the delivery of request id, which failed, so a
+// replay of the request is delivered.
+func releaseDelivery(ctx context.Context, id string) error {
+	return deliveries.Release(ctx, deliveredKeyPrefix+id)
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"knative.dev/async-component/pkg/encryption"
+	"knative.dev/async-component/pkg/idempotency"
+	"knative.dev/async-component/pkg/request"
+)
+
+func TestDeliverDedup(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     map[string][]string
+		status     int
+		wantServed int
+	}{{
+		name:       "not idempotent",
+		header:     map[string][]string{serviceIdempotentHeader: {"false"}},
+		status:     http.StatusOK,
+		wantServed: 1,
+	}, {
+		name:       "idempotent",
+		header:     map[string][]string{serviceIdempotentHeader: {"true"}},
+		status:     http.StatusOK,
+		wantServed: 2,
+	}, {
+		name:       "not annotated",
+		status:     http.StatusOK,
+		wantServed: 2,
+	}, {
+		name:       "failed deliveries are released",
+		header:     map[string][]string{serviceIdempotentHeader: {"false"}},
+		status:     http.StatusServiceUnavailable,
+		wantServed: 2,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			served := 0
+			testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				served++
+				w.WriteHeader(test.status)
+			}))
+			defer testserver.Close()
+			env = envInfo{retryConfig: retryConfig{DeliveryAttempts: 1}}
+			defer func() { env = envInfo{} }()
+			deliveries = idempotency.NewMemory(idempotency.DedupConfig{IdempotencyWindow: time.Hour})
+			defer func() { deliveries = nil }()
+
+			out, err := json.Marshal(request.Data{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodPost, ReqHeader: test.header})
+			if err != nil {
+				t.Fatalf("Error marshaling json for test")
+			}
+			// The request is read again, such as after a crash between its
+			// delivery and its ack.
+			for i := 0; i < 2; i++ {
+				deliver(context.Background(), out)
+			}
+			if served != test.wantServed {
+				t.Errorf("service got %d requests, want %d", served, test.wantServed)
+			}
+		})
+	}
+}
+
+func TestDeliverDedupSealed(t *testing.T) {
+	served := 0
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+	}))
+	defer testserver.Close()
+	env = envInfo{retryConfig: retryConfig{DeliveryAttempts: 1}}
+	defer func() { env = envInfo{} }()
+	deliveries = idempotency.NewMemory(idempotency.DedupConfig{IdempotencyWindow: time.Hour})
+	defer func() { deliveries = nil }()
+
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "key1"), []byte(base64.StdEncoding.EncodeToString(make([]byte, 32))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	encryptor, err = encryption.New(encryption.EncryptionConfig{EncryptionKeysDir: dir, EncryptionKeyID: "key1"})
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	defer func() { encryptor = nil }()
+
+	// The headers of sealed requests, which tell whether the service is
+	// idempotent, are only readable once the request is opened.
+	d := request.Data{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodPost, ReqHeader: map[string][]string{serviceIdempotentHeader: {"false"}}}
+	if err := encryptor.Seal(&d); err != nil {
+		t.Fatal("Seal() =", err)
+	}
+	out, err := json.Marshal(d)
+	if err != nil {
+		t.Fatalf("Error marshaling json for test")
+	}
+	for i := 0; i < 2; i++ {
+		if err := deliver(context.Background(), out); err != nil {
+			t.Fatal("deliver() =", err)
+		}
+	}
+	if served != 1 {
+		t.Errorf("service got %d requests, want 1", served)
+	}
+}
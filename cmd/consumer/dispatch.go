@@ -0,0 +1,215 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+)
+
+// dispatchConfig holds the environment configuration of the workers
+// delivering requests read from the queue.
+type dispatchConfig struct {
+	// Concurrency is the number of requests delivered in parallel.
+	Concurrency int `envconfig:"CONCURRENCY" default:"1"`
+	// HostConcurrency caps the requests delivered in parallel to a single
+	// service. There is no cap when it is zero.
+	HostConcurrency int `envconfig:"HOST_CONCURRENCY"`
+}
+
+// workers returns the number of requests delivered in parallel.
+func (c dispatchConfig) workers() int {
+	if c.Concurrency < 1 {
+		return 1
+	}
+	return c.Concurrency
+}
+
+// hostFull reports whether n requests in flight reach the cap of a service.
+func (c dispatchConfig) hostFull(n int) bool {
+	return c.HostConcurrency > 0 && n >= c.HostConcurrency
+}
+
+// pendingMessage is a message waiting for its service to be under its cap.
+type pendingMessage struct {
+	msg  queue.Message
+	host string
+}
+
+// dispatcher delivers messages on a bounded number of workers. Messages of a
+// service at its cap wait without taking a worker, so a slow service does
+// not starve the others. Deliveries to the services draining after a pause
+// are spaced to their drain rate the same way. The limits are read from the
+// configuration in effect each time a message is dispatched.
+type dispatcher struct {
+	handle func(queue.Message)
+	// now returns the current time, to space deliveries.
+	now func() time.Time
+
+	mu      sync.Mutex
+	running int
+	inHost  map[string]int
+	pending []pendingMessage
+	// nextStart is when the next delivery to each draining service may
+	// start, and wake starts the pending messages at the earliest of them.
+	nextStart map[string]time.Time
+	wake      *time.Timer
+	wakeAt    time.Time
+	stopped   bool
+	// done is closed, and replaced, whenever a delivery ends.
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newDispatcher(handle func(queue.Message)) *dispatcher {
+	return &dispatcher{
+		handle:    handle,
+		now:       time.Now,
+		inHost:    make(map[string]int),
+		nextStart: make(map[string]time.Time),
+		done:      make(chan struct{}),
+	}
+}
+
+// wait blocks until a worker is free and fewer messages than workers are
+// pending, so no more messages are read than can be delivered soon.
+func (d *dispatcher) wait(ctx context.Context) error {
+	for {
+		d.mu.Lock()
+		workers := current().workers()
+		if d.running < workers && len(d.pending) < workers {
+			d.mu.Unlock()
+			return nil
+		}
+		done := d.done
+		d.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// free returns how many more messages can be read without waiting for a
+// worker, at least one.
+func (d *dispatcher) free() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if n := current().workers() - d.running - len(d.pending); n > 1 {
+		return n
+	}
+	return 1
+}
+
+// dispatch delivers msg on a free worker, or queues it until one is free and
+// its service is under its cap.
+func (d *dispatcher) dispatch(msg queue.Message) {
+	host := messageHost(msg)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending = append(d.pending, pendingMessage{msg: msg, host: host})
+	d.startPending()
+}
+
+// startPending starts the oldest pending messages that can be delivered. d.mu
+// must be held.
+func (d *dispatcher) startPending() {
+	if d.stopped {
+		return
+	}
+	cfg := current().dispatchConfig
+	services := currentPauses()
+	now := d.now()
+	for i := 0; i < len(d.pending) && d.running < cfg.workers(); {
+		p := d.pending[i]
+		if cfg.hostFull(d.inHost[p.host]) {
+			i++
+			continue
+		}
+		if rate := services.Lookup(p.host).Draining(now); rate > 0 {
+			if next := d.nextStart[p.host]; now.Before(next) {
+				d.wakeUp(next)
+				i++
+				continue
+			}
+			d.nextStart[p.host] = now.Add(time.Duration(float64(time.Second) / rate))
+		} else {
+			delete(d.nextStart, p.host)
+		}
+		d.pending = append(d.pending[:i], d.pending[i+1:]...)
+		d.running++
+		d.inHost[p.host]++
+		d.wg.Add(1)
+		go func() {
+			defer d.finish(p.host)
+			d.handle(p.msg)
+		}()
+	}
+}
+
+// wakeUp starts the pending messages at t, unless they are started earlier
+// already. d.mu must be held.
+func (d *dispatcher) wakeUp(t time.Time) {
+	if d.wake != nil && !d.wakeAt.After(t) {
+		return
+	}
+	if d.wake != nil {
+		d.wake.Stop()
+	}
+	d.wakeAt = t
+	d.wake = time.AfterFunc(t.Sub(d.now()), func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.wake = nil
+		d.startPending()
+	})
+}
+
+// finish releases the worker and the service slot of a delivery.
+func (d *dispatcher) finish(host string) {
+	d.mu.Lock()
+	d.running--
+	if d.inHost[host]--; d.inHost[host] == 0 {
+		delete(d.inHost, host)
+	}
+	close(d.done)
+	d.done = make(chan struct{})
+	d.startPending()
+	d.mu.Unlock()
+	d.wg.Done()
+}
+
+// stop waits for the deliveries in flight. Pending messages are not acked,
+// so they are delivered again.
+func (d *dispatcher) stop() {
+	d.mu.Lock()
+	d.stopped = true
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+// messageHost returns the host of the service msg is sent to. Messages that
+// cannot be read share the empty host, and fail when delivered.
+func messageHost(msg queue.Message) string {
+	data, err := request.Unmarshal(msg.Data)
+	if err != nil {
+		return ""
+	}
+	return requestHost(data.ReqURL)
+}
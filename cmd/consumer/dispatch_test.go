@@ -0,0 +1,164 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"knative.dev/async-component/pkg/pause"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+)
+
+func testMessage(t *testing.T, id, url string) queue.Message {
+	t.Helper()
+	b, err := json.Marshal(request.Data{ID: id, ReqURL: url})
+	if err != nil {
+		t.Fatal("Error marshaling request:", err)
+	}
+	return queue.Message{ID: id, Data: b}
+}
+
+func TestDispatcher(t *testing.T) {
+	env = envInfo{dispatchConfig: dispatchConfig{Concurrency: 2, HostConcurrency: 1}}
+	defer func() { env = envInfo{} }()
+
+	var mu sync.Mutex
+	inHost := make(map[string]int)
+	started := make(chan string, 3)
+	release := make(chan struct{})
+	d := newDispatcher(func(msg queue.Message) {
+		host := messageHost(msg)
+		mu.Lock()
+		inHost[host]++
+		if inHost[host] > 1 {
+			t.Errorf("%d deliveries in flight to %s, want at most 1", inHost[host], host)
+		}
+		mu.Unlock()
+		started <- msg.ID
+		if host == "slow.default.svc.cluster.local" {
+			<-release
+		}
+		mu.Lock()
+		inHost[host]--
+		mu.Unlock()
+	})
+
+	d.dispatch(testMessage(t, "slow-1", "http://slow.default.svc.cluster.local/"))
+	d.dispatch(testMessage(t, "slow-2", "http://slow.default.svc.cluster.local/"))
+	d.dispatch(testMessage(t, "fast", "http://fast.default.svc.cluster.local/"))
+
+	// The second request of the slow service waits for the first one, and
+	// leaves its worker to the other service.
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-started:
+			got[id] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("requests were not delivered")
+		}
+	}
+	if !got["slow-1"] || !got["fast"] {
+		t.Errorf("delivered %v first, want slow-1 and fast", got)
+	}
+	close(release)
+	select {
+	case id := <-started:
+		if id != "slow-2" {
+			t.Errorf("delivered %s last, want slow-2", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow-2 was not delivered")
+	}
+	d.stop()
+}
+
+func TestDispatcherWait(t *testing.T) {
+	env = envInfo{dispatchConfig: dispatchConfig{Concurrency: 1}}
+	defer func() { env = envInfo{} }()
+
+	release := make(chan struct{})
+	d := newDispatcher(func(queue.Message) { <-release })
+	d.dispatch(testMessage(t, "1", "http://hello.default.svc.cluster.local/"))
+
+	// All workers are busy, so no more messages should be read.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := d.wait(ctx); err == nil {
+		t.Error("wait() returned while all workers were busy")
+	}
+	close(release)
+	if err := d.wait(context.Background()); err != nil {
+		t.Error("wait() =", err)
+	}
+	d.stop()
+}
+
+func TestDispatcherFree(t *testing.T) {
+	env = envInfo{dispatchConfig: dispatchConfig{Concurrency: 3}}
+	defer func() { env = envInfo{} }()
+
+	release := make(chan struct{})
+	d := newDispatcher(func(queue.Message) { <-release })
+	if got := d.free(); got != 3 {
+		t.Errorf("free() = %d with no delivery, want 3", got)
+	}
+	d.dispatch(testMessage(t, "1", "http://hello.default.svc.cluster.local/"))
+	if got := d.free(); got != 2 {
+		t.Errorf("free() = %d with one delivery, want 2", got)
+	}
+	d.dispatch(testMessage(t, "2", "http://hello.default.svc.cluster.local/"))
+	d.dispatch(testMessage(t, "3", "http://hello.default.svc.cluster.local/"))
+	d.dispatch(testMessage(t, "4", "http://hello.default.svc.cluster.local/"))
+	// At least one message is read once a worker frees up.
+	if got := d.free(); got != 1 {
+		t.Errorf("free() = %d with all workers busy, want 1", got)
+	}
+	close(release)
+	d.stop()
+}
+
+func TestDispatcherDrain(t *testing.T) {
+	env = envInfo{dispatchConfig: dispatchConfig{Concurrency: 3}}
+	defer func() { env = envInfo{} }()
+	until := time.Now().Add(time.Hour)
+	pauses = pause.Services{pause.Key("default", "orders"): {DrainRate: 20, DrainUntil: &until}}
+	defer func() { pauses = nil }()
+
+	started := make(chan time.Time, 3)
+	d := newDispatcher(func(queue.Message) { started <- time.Now() })
+	for i := 0; i < 3; i++ {
+		d.dispatch(testMessage(t, fmt.Sprint(i), "http://orders.default.svc.cluster.local/"))
+	}
+	// 20 requests per second are started 50ms apart.
+	var times []time.Time
+	for i := 0; i < 3; i++ {
+		select {
+		case at := <-started:
+			times = append(times, at)
+		case <-time.After(5 * time.Second):
+			t.Fatal("requests were not delivered")
+		}
+	}
+	if elapsed := times[2].Sub(times[0]); elapsed < 90*time.Millisecond {
+		t.Errorf("delivered 3 requests in %v, want at least 100ms at 20 per second", elapsed)
+	}
+	d.stop()
+}
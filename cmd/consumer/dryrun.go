@@ -0,0 +1,198 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/compression"
+	"knative.dev/async-component/pkg/logkey"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/pkg/logging"
+)
+
+// Header set on the requests sent to the shadow endpoint to the URL of the
+// service the request is for.
+const dryRunURLHeader = "Async-Dry-Run-Url"
+
+const (
+	// Results of the requests read in dry-run mode.
+	dryRunValid          = "valid"
+	dryRunInvalid        = "invalid"
+	dryRunShadowed       = "shadowed"
+	dryRunShadowRejected = "shadow-rejected"
+)
+
+// dryRunConfig holds the environment configuration of the dry-run mode, in
+// which requests are read and checked, but neither delivered to their
+// service, acked nor dead-lettered, so a new backend or record format can be
+// tried on production traffic. The consumer should read with a consumer
+// group, or subscription, of its own.
+type dryRunConfig struct {
+	DryRun bool `envconfig:"DRY_RUN"`
+	// DryRunShadowURL is the URL the requests are sent to in dry-run mode,
+	// with their method, path, query, headers and body, instead of their
+	// service. They are only checked when it is empty.
+	DryRunShadowURL string `envconfig:"DRY_RUN_SHADOW_URL"`
+}
+
+// validate returns an error if the shadow URL is not an http or https URL.
+func (c dryRunConfig) validate() error {
+	if c.DryRunShadowURL == "" {
+		return nil
+	}
+	u, err := url.Parse(c.DryRunShadowURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("DRY_RUN_SHADOW_URL %q is not an http or https URL", c.DryRunShadowURL)
+	}
+	return nil
+}
+
+// dryRun checks and logs the request of msg, and sends it to the shadow
+// endpoint when there is one. msg is left in the queue, and no status,
+// audit event or history record is written.
+func dryRun(ctx context.Context, msg queue.Message) {
+	logger := logging.FromContext(ctx).With(zap.String("message", msg.ID), zap.Int("deliveries", msg.Deliveries))
+	data, err := request.Unmarshal(msg.Data)
+	if err != nil {
+		logger.Warnw("Dry run: unreadable request", zap.Error(err))
+		recordDryRun(ctx, "", dryRunInvalid)
+		return
+	}
+	host := requestHost(data.ReqURL)
+	logger = logger.With(zap.String(logkey.RequestID, data.ID), zap.String(logkey.Host, host))
+	body, err := checkRequest(data)
+	if err != nil {
+		logger.Warnw("Dry run: invalid request", zap.Error(err))
+		recordDryRun(ctx, host, dryRunInvalid)
+		return
+	}
+	fields := []interface{}{zap.String("method", data.ReqMethod), zap.String("url", data.ReqURL), zap.Int("bodySize", len(body))}
+	if data.ReqBodyRef != "" {
+		fields = append(fields, zap.String("bodyRef", data.ReqBodyRef))
+	}
+	if data.EnqueuedAt != nil {
+		fields = append(fields, zap.Duration("age", time.Since(*data.EnqueuedAt)))
+	}
+	if data.ExpiresAt != nil && time.Now().After(*data.ExpiresAt) {
+		fields = append(fields, zap.Bool("expired", true))
+	}
+	if data.Deadline != nil && time.Now().After(*data.Deadline) {
+		fields = append(fields, zap.Bool("pastDeadline", true))
+	}
+	shadow := current().DryRunShadowURL
+	if shadow == "" {
+		logger.Infow("Dry run: read request", fields...)
+		recordDryRun(ctx, host, dryRunValid)
+		return
+	}
+	code, err := sendToShadow(logging.WithLogger(ctx, logger), shadow, data, body)
+	if err != nil {
+		logger.Warnw("Dry run: error sending request to the shadow endpoint", append(fields, zap.Error(err))...)
+		recordDryRun(ctx, host, dryRunShadowRejected)
+		return
+	}
+	fields = append(fields, zap.Int("shadowStatus", code))
+	if code >= http.StatusBadRequest {
+		logger.Warnw("Dry run: shadow endpoint rejected the request", fields...)
+		recordDryRun(ctx, host, dryRunShadowRejected)
+		return
+	}
+	logger.Infow("Dry run: sent request to the shadow endpoint", fields...)
+	recordDryRun(ctx, host, dryRunShadowed)
+}
+
+// checkRequest returns an error if data could not be delivered, and its
+// inline body otherwise. Sealed requests are opened in place.
+func checkRequest(data *request.Data) (string, error) {
+	u, err := url.Parse(data.ReqURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("URL %q is not an http or https URL", data.ReqURL)
+	}
+	if data.ReqMethod == "" {
+		return "", errors.New("request has no method")
+	}
+	if data.Sealed != "" {
+		if encryptor == nil {
+			return "", errors.New("request is encrypted but encryption is not configured")
+		}
+		if err := encryptor.Open(data); err != nil {
+			return "", err
+		}
+	}
+	body, err := compression.Decompress(data.ReqBody, data.ReqBodyEncoding)
+	if err != nil {
+		return "", err
+	}
+	if data.ReqBodyRef != "" && blobs == nil {
+		return "", fmt.Errorf("request body stored at %q but body offloading is not configured", data.ReqBodyRef)
+	}
+	return body, nil
+}
+
+// sendToShadow sends the request of data to shadow, with its path and query,
+// and returns the status code answered. Only the headers of the caller are
+// sent, without the credentials injected for the service.
+func sendToShadow(ctx context.Context, shadow string, data *request.Data, body string) (int, error) {
+	target, err := url.Parse(data.ReqURL)
+	if err != nil {
+		return 0, err
+	}
+	var reqBody io.Reader = strings.NewReader(body)
+	if data.ReqBodyRef != "" {
+		rc, err := blobs.Get(ctx, data.ReqBodyRef)
+		if err != nil {
+			return 0, fmt.Errorf("unable to fetch request body: %w", err)
+		}
+		defer rc.Close()
+		reqBody = rc
+	}
+	req, err := http.NewRequestWithContext(ctx, data.ReqMethod, strings.TrimSuffix(shadow, "/")+target.RequestURI(), reqBody)
+	if err != nil {
+		return 0, fmt.Errorf("unable to create shadow request: %w", err)
+	}
+	req.Header = http.Header(data.ReqHeader).Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set(preferHeaderField, preferSyncValue)
+	req.Header.Set(requestIDHeader, data.ID)
+	req.Header.Set(dryRunURLHeader, data.ReqURL)
+	if data.ReqBodyRef != "" {
+		req.ContentLength = bodyLength(req.Header)
+	}
+	client := &http.Client{Transport: &ochttp.Transport{Base: deliveryTransport, Propagation: &tracecontext.HTTPFormat{}}, Timeout: current().DeliveryTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("problem calling the shadow endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+)
+
+func TestDryRunConfig(t *testing.T) {
+	for url, valid := range map[string]bool{
+		"":                        true,
+		"http://shadow.test/base": true,
+		"ftp://shadow.test":       false,
+		"shadow.test":             false,
+	} {
+		if err := (dryRunConfig{DryRunShadowURL: url}).validate(); (err == nil) != valid {
+			t.Errorf("validate() of %q = %v, want valid %v", url, err, valid)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	if err := view.Register(metricViews...); err != nil {
+		t.Fatal("Register() =", err)
+	}
+	defer view.Unregister(metricViews...)
+
+	var got *http.Request
+	var gotBody string
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the service was called in dry-run mode")
+	}))
+	defer service.Close()
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		b, _ := ioutil.ReadAll(r.Body)
+		gotBody = string(b)
+		if r.URL.Path == "/base/reject" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer shadow.Close()
+
+	record := func(d request.Data) []byte {
+		b, err := json.Marshal(d)
+		if err != nil {
+			t.Fatal("Error marshaling request:", err)
+		}
+		return b
+	}
+	tests := []struct {
+		name       string
+		shadow     string
+		data       []byte
+		wantResult string
+		wantShadow bool
+	}{{
+		name:       "unreadable",
+		data:       []byte("{"),
+		wantResult: dryRunInvalid,
+	}, {
+		name:       "invalid URL",
+		data:       record(request.Data{ID: "1", ReqURL: "orders", ReqMethod: http.MethodPost}),
+		wantResult: dryRunInvalid,
+	}, {
+		name:       "sealed without encryption",
+		data:       record(request.Data{ID: "1", ReqURL: service.URL + "/orders", ReqMethod: http.MethodPost, Sealed: "abc"}),
+		wantResult: dryRunInvalid,
+	}, {
+		name:       "checked",
+		data:       record(request.Data{ID: "1", ReqURL: service.URL + "/orders", ReqMethod: http.MethodPost, ReqBody: "order"}),
+		wantResult: dryRunValid,
+	}, {
+		name:       "shadowed",
+		shadow:     shadow.URL + "/base",
+		data:       record(request.Data{ID: "1", ReqURL: service.URL + "/orders?id=1", ReqMethod: http.MethodPost, ReqBody: "order", ReqHeader: map[string][]string{"Content-Type": {"text/plain"}}}),
+		wantResult: dryRunShadowed,
+		wantShadow: true,
+	}, {
+		name:       "rejected by the shadow",
+		shadow:     shadow.URL + "/base",
+		data:       record(request.Data{ID: "1", ReqURL: service.URL + "/reject", ReqMethod: http.MethodPost}),
+		wantResult: dryRunShadowRejected,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{dryRunConfig: dryRunConfig{DryRun: true, DryRunShadowURL: test.shadow}}
+			defer func() { env = envInfo{} }()
+			got = nil
+			resultTag := tag.Tag{Key: resultKey, Value: test.wantResult}
+			before := rowValue(t, dryRunCount.Name(), resultTag)
+
+			fq := &fakeQueue{}
+			handleMessage(context.Background(), fq, queue.Message{ID: "1-0", Data: test.data})
+			if len(fq.acked) != 0 || len(fq.deadLettered) != 0 {
+				t.Errorf("acked %v and dead-lettered %v, want the message left in the queue", fq.acked, fq.deadLettered)
+			}
+			if n := rowValue(t, dryRunCount.Name(), resultTag) - before; n != 1 {
+				t.Errorf("%s dry runs recorded %v times, want once", test.wantResult, n)
+			}
+			if !test.wantShadow {
+				return
+			}
+			if got == nil {
+				t.Fatal("the shadow endpoint was not called")
+			}
+			if got.Method != http.MethodPost || got.URL.RequestURI() != "/base/orders?id=1" || gotBody != "order" {
+				t.Errorf("shadow got %s %s with %q, want POST /base/orders?id=1 with \"order\"", got.Method, got.URL.RequestURI(), gotBody)
+			}
+			for name, want := range map[string]string{
+				"Content-Type":    "text/plain",
+				requestIDHeader:   "1",
+				dryRunURLHeader:   service.URL + "/orders?id=1",
+				preferHeaderField: preferSyncValue,
+			} {
+				if v := got.Header.Get(name); v != want {
+					t.Errorf("shadow got %s %q, want %q", name, v, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/compression"
+	"knative.dev/async-component/pkg/history"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/async-component/pkg/status"
+	"knative.dev/pkg/logging"
+)
+
+// historyStream receives the records of completed requests, when their
+// history is exported.
+var historyStream *history.Stream
+
+type historyRequestKey struct{}
+
+// withHistoryRequest returns ctx carrying the request whose outcome is
+// recorded in the history.
+func withHistoryRequest(ctx context.Context, data *request.Data) context.Context {
+	if historyStream == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, historyRequestKey{}, data)
+}
+
+// recordHistory adds the outcome of the delivery of request id to the
+// history, when state is final. resp is the response of the service, if any.
+func recordHistory(ctx context.Context, id string, state status.State, attempts int, resp *http.Response, reason string) {
+	if historyStream == nil || (state != status.Succeeded && state != status.Failed && state != status.Expired) {
+		return
+	}
+	r := history.Record{ID: id, State: state, Attempts: attempts, Reason: reason, CompletedAt: time.Now()}
+	if resp != nil {
+		r.StatusCode = resp.StatusCode
+	}
+	cfg := current().HistoryConfig
+	data, _ := ctx.Value(historyRequestKey{}).(*request.Data)
+	if data != nil && data.ID == id {
+		r.Target, r.Method, r.EnqueuedAt = requestHost(data.ReqURL), data.ReqMethod, data.EnqueuedAt
+		if u, err := url.Parse(data.ReqURL); err == nil {
+			r.Path = u.Path
+		}
+		if cfg.HistoryPayload {
+			r.Payload = &history.Payload{}
+			historyRequestPayload(r.Payload, data, cfg.HistoryBodyLimit)
+		}
+	}
+	if cfg.HistoryPayload && resp != nil {
+		if r.Payload == nil {
+			r.Payload = &history.Payload{}
+		}
+		r.Payload.ResponseHeader = resp.Header
+		r.Payload.ResponseBody, r.Payload.ResponseTruncated = peekBody(ctx, resp, cfg.HistoryBodyLimit)
+	}
+	if err := historyStream.Add(ctx, r); err != nil {
+		logging.FromContext(ctx).Errorw("Error recording request history", zap.Error(err))
+	}
+}
+
+// historyRequestPayload records the headers and body of data in p. Requests
+// still encrypted, and bodies offloaded to object storage, are left out.
+func historyRequestPayload(p *history.Payload, data *request.Data, limit int64) {
+	if data.Sealed != "" {
+		return
+	}
+	p.RequestHeader = data.ReqHeader
+	if data.ReqBodyRef != "" {
+		return
+	}
+	body, err := compression.Decompress(data.ReqBody, data.ReqBodyEncoding)
+	if err != nil {
+		return
+	}
+	if int64(len(body)) > limit {
+		body, p.RequestTruncated = body[:limit], true
+	}
+	p.RequestBody = body
+}
+
+// peekBody returns up to limit bytes of the body of resp, and whether it is
+// longer, leaving the body to be read again from resp.
+func peekBody(ctx context.Context, resp *http.Response, limit int64) (string, bool) {
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		logging.FromContext(ctx).Errorw("Error reading response body", zap.Error(err))
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	if int64(len(body)) > limit {
+		return string(body[:limit]), true
+	}
+	return string(body), false
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"knative.dev/async-component/pkg/history"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/async-component/pkg/status"
+)
+
+// historyWriter records the entries added to the history stream.
+type historyWriter struct {
+	redis.Cmdable
+	records []history.Record
+}
+
+func (h *historyWriter) XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd {
+	for _, v := range a.Values.(map[string]interface{}) {
+		var r history.Record
+		if err := json.Unmarshal(v.([]byte), &r); err == nil {
+			h.records = append(h.records, r)
+		}
+	}
+	return redis.NewStringResult("1-0", nil)
+}
+
+func TestHistory(t *testing.T) {
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "order created")
+	}))
+	defer testserver.Close()
+	host := strings.TrimPrefix(testserver.URL, "http://")
+
+	tests := []struct {
+		name   string
+		cfg    history.HistoryConfig
+		reqURL string
+		want   []history.Record
+	}{{
+		name:   "metadata",
+		cfg:    history.HistoryConfig{HistoryBodyLimit: 64},
+		reqURL: testserver.URL + "/orders",
+		want: []history.Record{{
+			ID: "123", Target: host, Method: http.MethodPost, Path: "/orders",
+			State: status.Succeeded, StatusCode: http.StatusCreated, Attempts: 1,
+		}},
+	}, {
+		name:   "payload",
+		cfg:    history.HistoryConfig{HistoryPayload: true, HistoryBodyLimit: 5},
+		reqURL: testserver.URL + "/orders",
+		want: []history.Record{{
+			ID: "123", Target: host, Method: http.MethodPost, Path: "/orders",
+			State: status.Succeeded, StatusCode: http.StatusCreated, Attempts: 1,
+			Payload: &history.Payload{
+				RequestHeader:     map[string][]string{"Content-Type": {"application/json"}},
+				RequestBody:       `{"id"`,
+				RequestTruncated:  true,
+				ResponseHeader:    map[string][]string{"Content-Type": {"text/plain"}, "Content-Length": {"13"}},
+				ResponseBody:      "order",
+				ResponseTruncated: true,
+			},
+		}},
+	}, {
+		name:   "undeliverable",
+		cfg:    history.HistoryConfig{HistoryBodyLimit: 64},
+		reqURL: "http://127.0.0.1:1/orders",
+		want: []history.Record{{
+			ID: "123", Target: "127.0.0.1:1", Method: http.MethodPost, Path: "/orders",
+			State: status.Failed, Attempts: 1,
+		}},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{retryConfig: retryConfig{DeliveryAttempts: 1}, HistoryConfig: test.cfg}
+			defer func() { env = envInfo{} }()
+			client := &historyWriter{}
+			historyStream = history.NewStream(client, "async-history", 0)
+			defer func() { historyStream = nil }()
+
+			data := request.Data{
+				ID:        "123",
+				ReqURL:    test.reqURL,
+				ReqMethod: http.MethodPost,
+				ReqHeader: map[string][]string{"Content-Type": {"application/json"}},
+				ReqBody:   `{"id":1}`,
+			}
+			out, err := json.Marshal(data)
+			if err != nil {
+				t.Fatal("Error marshaling request:", err)
+			}
+			deliver(context.Background(), out)
+
+			if diff := cmp.Diff(test.want, client.records, cmpopts.IgnoreFields(history.Record{}, "CompletedAt", "Reason"), cmpopts.IgnoreMapEntries(func(k string, _ []string) bool {
+				return k == "Date"
+			})); diff != "" {
+				t.Error("history (-want, +got):", diff)
+			}
+		})
+	}
+}
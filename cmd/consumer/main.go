@@ -15,60 +15,682 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"contrib.go.opencensus.io/exporter/prometheus"
+	"github.com/kelseyhightower/envconfig"
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/async-component/pkg/audit"
+	"knative.dev/async-component/pkg/blob"
+	"knative.dev/async-component/pkg/compression"
+	"knative.dev/async-component/pkg/config"
+	"knative.dev/async-component/pkg/deadletter"
+	"knative.dev/async-component/pkg/encryption"
+	"knative.dev/async-component/pkg/headers"
+	"knative.dev/async-component/pkg/health"
+	"knative.dev/async-component/pkg/history"
+	"knative.dev/async-component/pkg/logkey"
+	"knative.dev/async-component/pkg/observability"
+	"knative.dev/async-component/pkg/pause"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/async-component/pkg/status"
+	"knative.dev/async-component/pkg/tracing"
+	"knative.dev/pkg/configmap"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/signals"
 )
 
-type requestData struct {
-	ID        string              `json:"id"`
-	ReqURL    string              `json:"url"`
-	ReqBody   string              `json:"body"`
-	ReqHeader map[string][]string `json:"header"`
-	ReqMethod string              `json:"method"`
+const (
+	// Path of the metrics endpoint on HEALTH_PORT.
+	metricsPath = "/metrics"
+	// Prefix of the exported metric names.
+	metricsNamespace = "async"
+)
+
+type envInfo struct {
+	queue.Config
+	status.StoreConfig
+	audit.AuditConfig
+	history.HistoryConfig
+	blob.StorageConfig
+	encryption.EncryptionConfig
+	headers.InjectionConfig
+	callbackConfig
+	dispatchConfig
+	retryConfig
+	tlsConfig
+	transportConfig
+	addressConfig
+	poisonConfig
+	dedupConfig
+	pauseConfig
+	dryRunConfig
+	// HealthPort is the port serving the liveness and readiness probes.
+	HealthPort string `envconfig:"HEALTH_PORT" default:"8081"`
+	// BacklogInterval is how often the backlog of the queue is exported,
+	// for backends reporting it. It is not exported when zero.
+	BacklogInterval time.Duration `envconfig:"BACKLOG_INTERVAL" default:"15s"`
+	// ShutdownTimeout bounds how long in-flight deliveries are waited for on
+	// shutdown.
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"30s"`
+	// ConfigNamespace is the namespace of the config-async ConfigMap. It
+	// is not watched when empty.
+	ConfigNamespace string `envconfig:"CONFIG_NAMESPACE"`
 }
 
+// Name of the consumer in traces.
+const serviceName = "async-consumer"
+
+// Name of the span covering the delivery of a request to its target.
+const deliverySpan = "delivery"
+
 const (
 	preferHeaderField = "Prefer"
 	preferSyncValue   = "respond-sync"
 )
 
-func consumeEvent(event cloudevents.Event) error {
-	data := &requestData{}
-	datastrings := make([]string, 0)
-	event.DataAs(&datastrings)
-	// unmarshal the string to request
-	if err := json.Unmarshal([]byte(datastrings[1]), data); err != nil {
-		return fmt.Errorf("error unmarshalling json: %w", err)
+var env envInfo
+
+// envMu guards env, whose tunables are updated from the config-async
+// ConfigMap. baseEnv is the configuration read from the environment.
+var envMu sync.RWMutex
+var baseEnv envInfo
+
+// errExpired is returned for requests whose time to live passed while they
+// were queued. They are dead-lettered instead of being delivered.
+var errExpired = errors.New("request expired")
+var statuses status.Store
+var auditor *audit.Recorder
+var blobs blob.Store
+var encryptor *encryption.Encryptor
+var injector *headers.Injector
+
+// deliveryTransport carries the requests to the services, the default
+// transport when nil.
+var deliveryTransport http.RoundTripper
+var tracer = tracing.New(context.Background(), serviceName)
+
+// How long to wait before reading again after a failed dequeue.
+var dequeueRetryInterval = time.Second
+
+// current returns the configuration in effect.
+func current() envInfo {
+	envMu.RLock()
+	defer envMu.RUnlock()
+	return env
+}
+
+// applyConfig overrides the tunables read from the environment with the
+// values set in the config-async ConfigMap. Invalid ConfigMaps are ignored
+// and the configuration in effect is kept.
+func applyConfig(ctx context.Context, cm *corev1.ConfigMap) {
+	next := baseEnv
+	if err := configmap.Parse(cm.Data,
+		configmap.AsInt("callback-retries", &next.CallbackRetries),
+		configmap.AsDuration("callback-backoff", &next.CallbackBackoff),
+		configmap.AsDuration("callback-timeout", &next.CallbackTimeout),
+		configmap.AsDuration("callback-max-elapsed", &next.CallbackMaxElapsed),
+		configmap.AsInt("concurrency", &next.Concurrency),
+		configmap.AsInt("host-concurrency", &next.HostConcurrency),
+		configmap.AsInt("delivery-attempts", &next.DeliveryAttempts),
+		configmap.AsDuration("delivery-backoff", &next.DeliveryBackoff),
+		configmap.AsDuration("delivery-max-backoff", &next.DeliveryMaxBackoff),
+		configmap.AsDuration("delivery-timeout", &next.DeliveryTimeout),
+		configmap.AsDuration("delivery-max-retry-after", &next.DeliveryMaxRetryAfter),
+		configmap.AsInt("poison-threshold", &next.PoisonThreshold),
+	); err != nil {
+		logging.FromContext(ctx).Errorw("Error applying "+config.Name+", keeping the current configuration", zap.Error(err))
+		return
+	}
+	envMu.Lock()
+	env = next
+	envMu.Unlock()
+	logging.FromContext(ctx).Info("Applied " + config.Name)
+}
+
+// serveProbes serves the liveness and readiness probes on HEALTH_PORT, along
+// with the consumer and queue metrics in the Prometheus format and the replay of
+// dead-lettered requests. The consumer is ready once it can read from q.
+func serveProbes(ctx context.Context, q queue.Queue) {
+	logger := logging.FromContext(ctx)
+	mux := http.NewServeMux()
+	mux.Handle(health.LivenessPath, health.Liveness())
+	mux.Handle(health.ReadinessPath, health.Readiness(func(ctx context.Context) error {
+		return queue.CheckHealth(ctx, q, true)
+	}))
+	if err := view.Register(append(metricViews, queue.Views...)...); err != nil {
+		logger.Fatalw("Failed to register metrics", zap.Error(err))
+	}
+	exporter, err := prometheus.NewExporter(prometheus.Options{Namespace: metricsNamespace})
+	if err != nil {
+		logger.Fatalw("Failed to create metrics exporter", zap.Error(err))
+	}
+	mux.Handle(metricsPath, exporter)
+	mux.Handle(deadletter.ReplayPath, deadletter.ReplayHandler(q))
+	logger.Fatalw("Failed to serve probes", zap.Error(http.ListenAndServe(":"+env.HealthPort, mux)))
+}
+
+// run reads requests from the queue and delivers them until ctx is done,
+// CONCURRENCY at a time. Deliveries in flight are then waited for, up to
+// SHUTDOWN_TIMEOUT, and cancelled past it. Requests that were read but not
+// delivered are left pending for other consumers.
+func run(ctx context.Context, q queue.Queue) error {
+	logger := logging.FromContext(ctx)
+	// Deliveries outlive ctx, so they can finish when the consumer stops.
+	deliveryCtx, cancel := context.WithCancel(logging.WithLogger(context.Background(), logger))
+	defer cancel()
+	d := newDispatcher(func(msg queue.Message) {
+		handleMessage(deliveryCtx, q, msg)
+	})
+	defer func() {
+		stopped := make(chan struct{})
+		go func() {
+			d.stop()
+			close(stopped)
+		}()
+		logger.Info("Shutting down, finishing in-flight deliveries")
+		select {
+		case <-stopped:
+		case <-time.After(current().ShutdownTimeout):
+			logger.Warn("Shutdown timeout reached, cancelling in-flight deliveries")
+			cancel()
+			<-stopped
+		}
+	}()
+	for d.wait(ctx) == nil {
+		msgs, err := q.Dequeue(queue.WithReadLimit(ctx, d.free()))
+		if err != nil {
+			logging.FromContext(ctx).Errorw("Error reading from queue", zap.Error(err))
+			time.Sleep(dequeueRetryInterval)
+			continue
+		}
+		for _, msg := range msgs {
+			d.dispatch(msg)
+		}
+	}
+	return ctx.Err()
+}
+
+// handleMessage delivers a single message, acking it on success and moving it
+// to the dead-letter queue on failure. Deliveries cancelled on shutdown are
+// left pending, so they are delivered again. Messages read too many times,
+// or whose delivery panics, are quarantined. Messages of paused services are
+// held in the queue. In dry-run mode, messages are only checked and left in
+// the queue.
+func handleMessage(ctx context.Context, q queue.Queue, msg queue.Message) {
+	logger := logging.FromContext(ctx)
+	if current().DryRun {
+		dryRun(ctx, msg)
+		return
+	}
+	if current().poisoned(msg) {
+		quarantine(ctx, q, msg, fmt.Sprintf("read %d times without being acked", msg.Deliveries))
+		return
+	}
+	if holdPaused(ctx, q, msg) {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			quarantine(ctx, q, msg, fmt.Sprintf("delivery panicked: %v", r))
+		}
+	}()
+	if err := deliver(ctx, msg.Data); err != nil {
+		if ctx.Err() != nil {
+			logger.Infow("Delivery cancelled on shutdown, leaving the request pending", zap.String("message", msg.ID))
+			return
+		}
+		var later *retryLaterError
+		if errors.As(err, &later) && requeue(ctx, q, msg, later.after) {
+			logger.Infow("Service asked to retry later, requeued the request", zap.String("message", msg.ID), zap.Duration("after", later.after))
+			return
+		}
+		var derr *deliveryError
+		if errors.As(err, &derr) {
+			ctx = queue.WithFailure(ctx, derr.failure)
+		} else if later != nil {
+			ctx = queue.WithFailure(ctx, later.failure)
+		}
+		if derr := q.DeadLetter(ctx, msg, err.Error()); derr != nil {
+			logger.Errorw("Error dead-lettering request", zap.Error(derr))
+		} else {
+			auditDeadLettered(ctx, msg, err.Error())
+		}
+		return
+	}
+	if err := q.Ack(ctx, msg); err != nil {
+		logger.Errorw("Error acknowledging request", zap.Error(err))
+	}
+}
+
+// requeue enqueues msg again to be delivered after a wait, such as the one
+// asked for by its service, and acks it. It reports whether msg was requeued, which backends
+// without delayed delivery cannot do.
+func requeue(ctx context.Context, q queue.Queue, msg queue.Message, after time.Duration) bool {
+	logger := logging.FromContext(ctx)
+	err := q.Enqueue(queue.WithDeliverAt(ctx, time.Now().Add(after)), msg.ID, msg.Data)
+	if errors.Is(err, queue.ErrDelayNotSupported) {
+		return false
+	} else if err != nil {
+		logger.Errorw("Error requeueing request", zap.Error(err))
+		return false
+	}
+	if err := q.Ack(ctx, msg); err != nil {
+		logger.Errorw("Error acknowledging request", zap.Error(err))
+	}
+	return true
+}
+
+// deliver makes the stored request to the target service. Failures are
+// logged with the ID and host of the request.
+func deliver(ctx context.Context, b []byte) (err error) {
+	data, err := request.Unmarshal(b)
+	if err != nil {
+		logging.FromContext(ctx).Errorw("Error reading request", zap.Error(err))
+		return fmt.Errorf("%w: unreadable request: %v", errQuarantined, err)
+	}
+	host := requestHost(data.ReqURL)
+	logger := logging.FromContext(ctx).With(zap.String(logkey.RequestID, data.ID), zap.String(logkey.Host, host))
+	ctx = withHistoryRequest(withAuditRequest(logging.WithLogger(ctx, logger), data), data)
+	// Requests cancelled by their caller are acked without being delivered.
+	if cancelled(ctx, data.ID) {
+		logger.Info("Request was cancelled, skipping it")
+		if data.ReqBodyRef != "" && blobs != nil {
+			if err := blobs.Delete(ctx, data.ReqBodyRef); err != nil {
+				logger.Errorw("Error deleting request body", zap.Error(err))
+			}
+		}
+		return nil
+	}
+	// Requests read after their deadline are acked without being delivered.
+	if pastDeadline(ctx, data) {
+		return nil
+	}
+	succeeded := false
+	defer func() {
+		if err != nil {
+			logger.Errorw("Error delivering request", zap.Error(err))
+		}
+		// Deliveries cancelled on shutdown are done again.
+		if ctx.Err() == nil {
+			recordDelivery(ctx, host, succeeded)
+		}
+	}()
+	ctx, span := startDelivery(ctx, data)
+	defer span.End()
+
+	if data.ExpiresAt != nil && time.Now().After(*data.ExpiresAt) {
+		setStatus(ctx, data, status.Failed, 0, errExpired.Error())
+		return fmt.Errorf("%w at %s", errExpired, data.ExpiresAt.Format(time.RFC3339))
+	}
+
+	// Sealed requests are opened first, as their headers tell whether the
+	// service is idempotent.
+	if data.Sealed != "" {
+		if encryptor == nil {
+			return errors.New("request is encrypted but encryption is not configured")
+		}
+		if err := encryptor.Open(data); err != nil {
+			setStatus(ctx, data, status.Failed, 0, err.Error())
+			return err
+		}
+	}
+
+	// Services that are not idempotent are sent each request at most once.
+	if deliveries != nil && !serviceIdempotent(http.Header(data.ReqHeader)) {
+		claimed, cerr := claimDelivery(ctx, data.ID)
+		if cerr != nil {
+			return cerr
+		}
+		if !claimed {
+			logger.Info("Request already delivered, skipping it")
+			return nil
+		}
+		defer func() {
+			if err == nil {
+				return
+			}
+			if err := releaseDelivery(context.Background(), data.ID); err != nil {
+				logger.Errorw("Error releasing the delivery", zap.Error(err))
+			}
+		}()
 	}
 
-	// client for sending request
-	client := &http.Client{}
-	req, err := http.NewRequest(data.ReqMethod, data.ReqURL, strings.NewReader(data.ReqBody))
+	setStatus(ctx, data, status.InFlight, 0, "")
+
+	reqBody, err := compression.Decompress(data.ReqBody, data.ReqBodyEncoding)
 	if err != nil {
-		return fmt.Errorf("unable to create new request %w", err)
+		setStatus(ctx, data, status.Failed, 0, err.Error())
+		return err
+	}
+	if data.ReqBodyRef != "" && blobs == nil {
+		return fmt.Errorf("request body stored at %q but body offloading is not configured", data.ReqBodyRef)
+	}
+
+	// The headers of the record are left as the caller sent them, without
+	// the credentials injected for the service.
+	header := http.Header(data.ReqHeader).Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	callback := callbackURL(header)
+	// Credentials kept out of the queue are added back.
+	if injector != nil {
+		if err := injector.Inject(header, host); err != nil {
+			return err
+		}
+	}
+	header.Set(preferHeaderField, preferSyncValue) // We do not want to make this request as async
+	// Every attempt reads the body again.
+	openBody := func() (io.Reader, error) {
+		if data.ReqBodyRef == "" {
+			return strings.NewReader(reqBody), nil
+		}
+		rc, err := blobs.Get(ctx, data.ReqBodyRef)
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch request body: %w", err)
+		}
+		return rc, nil
 	}
-	req.Header = data.ReqHeader
-	if req.Header == nil {
-		req.Header = make(map[string][]string)
+	reqURL, reqHost := deliveryAddress(data.ReqURL, header, current().DeliveryClusterLocal)
+	newRequest := func() (*http.Request, error) {
+		body, err := openBody()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, data.ReqMethod, reqURL, body)
+		if err != nil {
+			if rc, ok := body.(io.Closer); ok {
+				rc.Close()
+			}
+			return nil, fmt.Errorf("unable to create new request %w", err)
+		}
+		req.Header = header
+		if reqHost != "" {
+			req.Host = reqHost
+		}
+		if data.ReqBodyRef != "" {
+			// Offloaded bodies are streamed with the length the caller
+			// sent, rather than chunked.
+			req.ContentLength = bodyLength(header)
+		}
+		return req, nil
+	}
+
+	// client for sending request, propagating the trace context
+	cfg := current().retryConfig.forService(header)
+	client := &http.Client{Transport: &ochttp.Transport{Base: deliveryTransport, Propagation: &tracecontext.HTTPFormat{}}, Timeout: cfg.DeliveryTimeout}
+	// Requests the service could not process are handed to its dead-letter
+	// sink, if it has one, and dead-lettered in the queue when there is none
+	// or it failed too.
+	sink := deadLetterSink(header)
+	fail := func(derr *deliveryError) error {
+		if sink == "" || ctx.Err() != nil {
+			return derr
+		}
+		body, err := openBody()
+		if err == nil {
+			err = sendToSink(ctx, client, sink, data, body, derr)
+		}
+		if err != nil {
+			logger.Errorw("Error sending request to the dead-letter sink", zap.Error(err))
+			return derr
+		}
+		logger.Infow("Sent undeliverable request to the dead-letter sink", zap.String("sink", sink), zap.NamedError("reason", derr))
+		if data.ReqBodyRef != "" {
+			if err := blobs.Delete(ctx, data.ReqBodyRef); err != nil {
+				logger.Errorw("Error deleting request body", zap.Error(err))
+			}
+		}
+		return nil
+	}
+	resp, failure, err := sendWithRetries(ctx, client, newRequest, cfg)
+	recordAttempts(ctx, host, failure)
+	var later *retryLaterError
+	if errors.As(err, &later) {
+		setStatus(ctx, data, status.Pending, failure.Attempts, later.Error())
+		return later
 	}
-	req.Header.Set(preferHeaderField, preferSyncValue) // We do not want to make this request as async
-	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("problem calling url: %w", err)
+		setStatus(ctx, data, status.Failed, failure.Attempts, err.Error())
+		return fail(&deliveryError{err: err, failure: failure})
 	}
 	defer resp.Body.Close()
+	if retryable(data.ReqMethod, resp, nil) {
+		// The request is dead-lettered, keeping its body for a replay, unless
+		// the dead-letter sink takes it.
+		setResponseStatus(ctx, data, status.Failed, failure.Attempts, resp, resp.Status)
+		if callback != "" {
+			if err := sendCallback(ctx, callback, data.ID, resp, current().callbackConfig); err != nil {
+				logger.Errorw("Error sending callback", zap.Error(err))
+			}
+		}
+		return fail(&deliveryError{err: fmt.Errorf("url returned %d after %d attempts", resp.StatusCode, failure.Attempts), failure: failure})
+	}
+	if data.ReqBodyRef != "" {
+		if err := blobs.Delete(ctx, data.ReqBodyRef); err != nil {
+			logger.Errorw("Error deleting request body", zap.Error(err))
+		}
+	}
+	if succeeded = resp.StatusCode < http.StatusBadRequest; succeeded {
+		setResponseStatus(ctx, data, status.Succeeded, failure.Attempts, resp, "")
+	} else {
+		setResponseStatus(ctx, data, status.Failed, failure.Attempts, resp, resp.Status)
+	}
+	if callback != "" {
+		// The request was processed, so a failed callback must not cause it
+		// to be delivered again.
+		if err := sendCallback(ctx, callback, data.ID, resp, current().callbackConfig); err != nil {
+			logger.Errorw("Error sending callback", zap.Error(err))
+		}
+	}
 	return nil
 }
 
+// startDelivery starts the delivery span of a request. It continues the trace
+// of the producer after the time the request waited in the queue, when the
+// record carries one.
+func startDelivery(ctx context.Context, data *request.Data) (context.Context, *trace.Span) {
+	if data.TraceParent == "" {
+		return trace.StartSpan(ctx, deliverySpan)
+	}
+	parent, err := tracing.ParseTraceParent(data.TraceParent)
+	if err != nil {
+		logging.FromContext(ctx).Errorw("Error parsing trace context", zap.Error(err))
+		return trace.StartSpan(ctx, deliverySpan)
+	}
+	if data.EnqueuedAt != nil {
+		parent = tracer.QueueWait(parent, *data.EnqueuedAt, time.Now())
+	}
+	return trace.StartSpanWithRemoteParent(ctx, deliverySpan, parent)
+}
+
+// bodyLength returns the length of the body of a request with header, or -1
+// if it is unknown.
+func bodyLength(header http.Header) int64 {
+	n, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// requestHost returns the host of the service a request is sent to.
+func requestHost(reqURL string) string {
+	u, err := url.Parse(reqURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// setStatus records the state of request data, sent attempts times to the
+// service, when status tracking is enabled. Final states are recorded in the
+// audit trail and the history as well.
+func setStatus(ctx context.Context, data *request.Data, state status.State, attempts int, reason string) {
+	auditOutcome(ctx, data.ID, state, attempts, 0, reason)
+	recordHistory(ctx, data.ID, state, attempts, nil, reason)
+	if statuses == nil {
+		return
+	}
+	writeStatus(ctx, status.Status{ID: data.ID, State: state, Host: requestHost(data.ReqURL), Attempts: attempts, Reason: reason, Updated: time.Now()})
+}
+
+// setResponseStatus records the state of request data along with the
+// response of the service when status tracking is enabled. Up to
+// RESULT_BODY_LIMIT bytes of the body are stored, and left to be read again
+// from resp. Final states are recorded in the audit trail and the history as
+// well.
+func setResponseStatus(ctx context.Context, data *request.Data, state status.State, attempts int, resp *http.Response, reason string) {
+	auditOutcome(ctx, data.ID, state, attempts, resp.StatusCode, reason)
+	recordHistory(ctx, data.ID, state, attempts, resp, reason)
+	if statuses == nil {
+		return
+	}
+	s := status.Status{ID: data.ID, State: state, Host: requestHost(data.ReqURL), StatusCode: resp.StatusCode, Attempts: attempts, Reason: reason, Updated: time.Now()}
+	if limit := current().ResultBodyLimit; limit > 0 {
+		s.Result = &status.Result{Header: resp.Header}
+		s.Result.Body, s.Result.Truncated = peekBody(ctx, resp, limit)
+	}
+	writeStatus(ctx, s)
+}
+
+// cancelled reports whether request id was cancelled by its caller, when
+// status tracking is enabled. Requests whose status cannot be read are not
+// considered cancelled, so they are still delivered.
+func cancelled(ctx context.Context, id string) bool {
+	if statuses == nil {
+		return false
+	}
+	s, err := statuses.Get(ctx, id)
+	if err != nil {
+		if !errors.Is(err, status.ErrNotFound) {
+			logging.FromContext(ctx).Errorw("Error reading request status", zap.Error(err))
+		}
+		return false
+	}
+	return s.State == status.Cancelled
+}
+
+// writeStatus records s, logging failures.
+func writeStatus(ctx context.Context, s status.Status) {
+	if err := statuses.Set(ctx, s); err != nil {
+		logging.FromContext(ctx).Errorw("Error writing request status", zap.Error(err))
+	}
+}
+
 func main() {
-	c, err := cloudevents.NewDefaultClient()
+	logger, atomicLevel := observability.NewLogger(serviceName, "")
+
+	if err := envconfig.Process("", &env); err != nil {
+		logger.Fatalw("Failed to process the environment", zap.Error(err))
+	}
+	if env.ConfigNamespace != "" {
+		// The logger is configured by config-logging, and its level updated.
+		logger, atomicLevel = observability.NewLogger(serviceName, env.ConfigNamespace)
+	}
+	defer logger.Sync()
+	if env.StreamName != "" {
+		logger = logger.With(zap.String(logkey.Stream, env.StreamName))
+	}
+	ctx := logging.WithLogger(signals.NewContext(), logger)
+	tracer = tracing.New(ctx, serviceName)
+	if err := env.dryRunConfig.validate(); err != nil {
+		logger.Fatalw("Invalid dry-run configuration", zap.Error(err))
+	}
+	if env.DryRun {
+		// Requests are never acked, so they would be claimed again and again.
+		env.RedisClaimIdle = 0
+		logger.Warnw("Running in dry-run mode, requests are not delivered nor acked", zap.String("shadowURL", env.DryRunShadowURL))
+	}
+	if env.ConfigNamespace != "" {
+		baseEnv = env
+		watchers := observability.Watchers(ctx, serviceName, atomicLevel, updateMetricsExporter(ctx))
+		watchers[config.Name] = func(cm *corev1.ConfigMap) { applyConfig(ctx, cm) }
+		watchers[pause.ConfigMapName] = func(cm *corev1.ConfigMap) { applyPauses(ctx, cm) }
+		watchers[tracing.ConfigName] = tracer.ApplyConfig
+		if err := config.WatchAll(ctx, env.ConfigNamespace, watchers); err != nil {
+			logger.Fatalw("Failed to watch the configuration", zap.Error(err))
+		}
+	}
+	q, err := queue.New(ctx, env.Config)
+	if err != nil {
+		logger.Fatalw("Failed to create queue client", zap.Error(err))
+	}
+	statuses, err = status.New(env.StoreConfig, env.RedisConfig)
+	if err != nil {
+		logger.Fatalw("Failed to create status store", zap.Error(err))
+	}
+	if !env.DryRun {
+		go status.RunJanitor(ctx, statuses, env.StatusTTL, env.StatusCollectInterval)
+	}
+	auditor, err = audit.New(env.AuditConfig, env.RedisConfig, auditComponent)
+	if err != nil {
+		logger.Fatalw("Failed to create audit recorder", zap.Error(err))
+	}
+	historyStream, err = history.New(env.HistoryConfig, env.RedisConfig)
 	if err != nil {
-		log.Fatal("Failed to create client, ", err)
+		logger.Fatalw("Failed to create history stream", zap.Error(err))
+	}
+	blobs, err = blob.New(env.StorageConfig, env.RedisConfig)
+	if err != nil {
+		logger.Fatalw("Failed to create blob store", zap.Error(err))
+	}
+	encryptor, err = encryption.New(env.EncryptionConfig)
+	if err != nil {
+		logger.Fatalw("Failed to create request encryptor", zap.Error(err))
+	}
+	deliveries, err = newDeliveryStore(ctx, env.dedupConfig, env.RedisConfig)
+	if err != nil {
+		logger.Fatalw("Failed to create delivery store", zap.Error(err))
+	}
+	injector = headers.NewInjector(env.InjectionConfig)
+	deliveryTransport, err = newDeliveryTransport(env.tlsConfig, env.transportConfig)
+	if err != nil {
+		logger.Fatalw("Failed to configure the delivery transport", zap.Error(err))
+	}
+	go serveProbes(ctx, q)
+	go watchBacklog(ctx, q)
+	if _, ok := q.(queue.Receiver); ok && env.DryRun {
+		logger.Fatal("Dry-run mode is not supported by push-based backends, which ack the requests they push")
+	}
+	if r, ok := q.(queue.Receiver); ok {
+		// Push-based backends retry and dead-letter failed deliveries themselves.
+		err = r.Receive(ctx, func(ctx context.Context, data []byte) error {
+			return deliver(ctx, data)
+		})
+	} else {
+		err = run(ctx, q)
+	}
+	if ctx.Err() == nil {
+		logger.Fatalw("Failed to read requests", zap.Error(err))
+	}
+	if err := q.Close(); err != nil {
+		logger.Errorw("Error closing queue client", zap.Error(err))
+	}
+	if auditor != nil {
+		if err := auditor.Close(); err != nil {
+			logger.Errorw("Error closing audit recorder", zap.Error(err))
+		}
+	}
+	if historyStream != nil {
+		if err := historyStream.Close(); err != nil {
+			logger.Errorw("Error closing history stream", zap.Error(err))
+		}
 	}
-	log.Fatal(c.StartReceiver(context.Background(), consumeEvent))
+	logger.Info("Consumer stopped")
 }
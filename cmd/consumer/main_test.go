@@ -14,32 +14,39 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
-	"flag"
+	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
-	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/async-component/pkg/compression"
+	"knative.dev/async-component/pkg/encryption"
+	"knative.dev/async-component/pkg/headers"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/async-component/pkg/status"
+	"knative.dev/async-component/pkg/tracing"
 )
 
-var (
-	eventSource string
-	eventType   string
-	data        requestData
-)
+var data request.Data
 
-func TestConsumeEvent(t *testing.T) {
-	// t.Run("consume cloud event", func(t *testing.T) {
-	myEvent := cloudevents.NewEvent("1.0")
-	flag.StringVar(&eventSource, "eventSource", "redis-source", "the event-source (CloudEvents)")
-	flag.StringVar(&eventType, "eventType", "dev.knative.async.request", "the event-type (CloudEvents)")
-	myEvent.SetType(eventType)
-	myEvent.SetSource(eventSource)
-	myEvent.SetID("123")
+type fakeQueue struct {
+	acked        []string
+	deadLettered []string
+}
 
+func TestDeliver(t *testing.T) {
 	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodPost:
@@ -91,17 +98,13 @@ func TestConsumeEvent(t *testing.T) {
 			if data.ReqMethod == "POST" {
 				data.ReqBody = `{"body":"test body"}`
 			}
-			// marshal data to json and then translate to string to encode as base64
+			// marshal data to json as the producer would.
 			out, err := json.Marshal(data)
 			if err != nil {
 				t.Errorf("Error marshaling json for test")
 			}
-			testData := []string{"data", string(out)}
 
-			// setdata in the event
-			myEvent.SetData(cloudevents.ApplicationJSON, testData)
-
-			got := consumeEvent(myEvent)
+			got := deliver(context.Background(), out)
 			if test.expectedErr != "" {
 				msg := got.Error()
 				if !strings.Contains(msg, test.expectedErr) {
@@ -113,3 +116,627 @@ func TestConsumeEvent(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleMessage(t *testing.T) {
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer testserver.Close()
+
+	tests := []struct {
+		name             string
+		reqURL           string
+		wantAcked        bool
+		wantDeadLettered bool
+	}{{
+		name:      "successful delivery is acked",
+		reqURL:    testserver.URL,
+		wantAcked: true,
+	}, {
+		name:             "failed delivery is dead-lettered",
+		reqURL:           "",
+		wantDeadLettered: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := json.Marshal(request.Data{ID: "123", ReqURL: test.reqURL, ReqMethod: http.MethodGet})
+			if err != nil {
+				t.Fatalf("Error marshaling json for test")
+			}
+			fq := &fakeQueue{}
+			handleMessage(context.Background(), fq, queue.Message{ID: "1-0", Data: out})
+			if got := len(fq.acked) == 1; got != test.wantAcked {
+				t.Errorf("acked = %v, want %v", got, test.wantAcked)
+			}
+			if got := len(fq.deadLettered) == 1; got != test.wantDeadLettered {
+				t.Errorf("dead-lettered = %v, want %v", got, test.wantDeadLettered)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	delivered := make(chan string, 1)
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- r.URL.Path
+	}))
+	defer testserver.Close()
+
+	q := queue.NewMemory(queue.MemoryConfig{MemoryQueueName: t.Name(), MemoryReadTimeout: time.Second})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		run(ctx, q)
+		close(done)
+	}()
+	// Wait for run to return, it reads the configuration.
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	out, err := json.Marshal(request.Data{ID: "123", ReqURL: testserver.URL + "/hello", ReqMethod: http.MethodGet})
+	if err != nil {
+		t.Fatalf("Error marshaling json for test")
+	}
+	if err := q.Enqueue(ctx, "123", out); err != nil {
+		t.Fatal("Enqueue() =", err)
+	}
+	select {
+	case path := <-delivered:
+		if path != "/hello" {
+			t.Errorf("delivered to %q, want /hello", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not delivered")
+	}
+}
+
+func TestRunShutdown(t *testing.T) {
+	tests := []struct {
+		name        string
+		timeout     time.Duration
+		wantAcked   bool
+		wantPending bool
+	}{{
+		name:      "delivery finishes",
+		timeout:   5 * time.Second,
+		wantAcked: true,
+	}, {
+		name:        "delivery cancelled",
+		timeout:     10 * time.Millisecond,
+		wantPending: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			started := make(chan struct{})
+			testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				select {
+				case <-time.After(200 * time.Millisecond):
+				case <-r.Context().Done():
+				}
+			}))
+			defer testserver.Close()
+			env = envInfo{ShutdownTimeout: test.timeout}
+			defer func() { env = envInfo{} }()
+
+			q := queue.NewMemory(queue.MemoryConfig{MemoryQueueName: t.Name(), MemoryReadTimeout: 10 * time.Millisecond})
+			out, err := json.Marshal(request.Data{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodGet})
+			if err != nil {
+				t.Fatalf("Error marshaling json for test")
+			}
+			if err := q.Enqueue(context.Background(), "123", out); err != nil {
+				t.Fatal("Enqueue() =", err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			errs := make(chan error)
+			go func() { errs <- run(ctx, q) }()
+			<-started
+			// Stop reading while the request is delivered.
+			cancel()
+			select {
+			case <-errs:
+			case <-time.After(5 * time.Second):
+				t.Fatal("run() did not return")
+			}
+
+			if got := len(q.DeadLetters()); got != 0 {
+				t.Errorf("got %d dead letters, want none", got)
+			}
+			// Requests that were not acked are delivered again once the
+			// queue is closed.
+			q.Close()
+			msgs, err := q.Dequeue(context.Background())
+			if err != nil {
+				t.Fatal("Dequeue() =", err)
+			}
+			if pending := len(msgs) == 1; pending != test.wantPending {
+				t.Errorf("request pending = %v, want %v", pending, test.wantPending)
+			}
+		})
+	}
+}
+
+func TestDeliverExpired(t *testing.T) {
+	delivered := false
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered = true
+	}))
+	defer testserver.Close()
+
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	tests := []struct {
+		name          string
+		expiresAt     *time.Time
+		wantDelivered bool
+	}{{
+		name:          "no ttl",
+		wantDelivered: true,
+	}, {
+		name:          "not expired",
+		expiresAt:     &future,
+		wantDelivered: true,
+	}, {
+		name:      "expired",
+		expiresAt: &past,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delivered = false
+			out, err := json.Marshal(request.Data{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodGet, ExpiresAt: test.expiresAt})
+			if err != nil {
+				t.Fatalf("Error marshaling json for test")
+			}
+			err = deliver(context.Background(), out)
+			if delivered != test.wantDelivered {
+				t.Errorf("delivered = %v, want %v", delivered, test.wantDelivered)
+			}
+			if got := errors.Is(err, errExpired); got == test.wantDelivered {
+				t.Errorf("deliver() = %v, want expired: %v", err, !test.wantDelivered)
+			}
+		})
+	}
+}
+
+func TestDeliverStatus(t *testing.T) {
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer testserver.Close()
+	host := strings.TrimPrefix(testserver.URL, "http://")
+	statuses = status.NewMemory()
+	defer func() { statuses = nil }()
+
+	tests := []struct {
+		name     string
+		reqURL   string
+		wantErr  bool
+		want     status.State
+		wantCode int
+		wantHost string
+	}{{
+		name:     "successful response",
+		reqURL:   testserver.URL,
+		want:     status.Succeeded,
+		wantCode: http.StatusOK,
+		wantHost: host,
+	}, {
+		name:     "error response",
+		reqURL:   testserver.URL + "/missing",
+		want:     status.Failed,
+		wantCode: http.StatusNotFound,
+		wantHost: host,
+	}, {
+		name:    "delivery failure",
+		reqURL:  "",
+		wantErr: true,
+		want:    status.Failed,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := json.Marshal(request.Data{ID: test.name, ReqURL: test.reqURL, ReqMethod: http.MethodGet})
+			if err != nil {
+				t.Fatalf("Error marshaling json for test")
+			}
+			if err := deliver(context.Background(), out); (err != nil) != test.wantErr {
+				t.Fatalf("deliver() error = %v, wantErr %v", err, test.wantErr)
+			}
+			got, err := statuses.Get(context.Background(), test.name)
+			if err != nil {
+				t.Fatal("Error reading status:", err)
+			}
+			if got.State != test.want || got.StatusCode != test.wantCode {
+				t.Errorf("got status %+v, want %s with code %d", got, test.want, test.wantCode)
+			}
+			if got.Host != test.wantHost {
+				t.Errorf("got status host %q, want %q", got.Host, test.wantHost)
+			}
+		})
+	}
+}
+
+func TestDeliverCancelled(t *testing.T) {
+	delivered := false
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered = true
+	}))
+	defer testserver.Close()
+	statuses = status.NewMemory()
+	defer func() { statuses = nil }()
+	if err := statuses.Set(context.Background(), status.Status{ID: "cancelled", State: status.Cancelled, Updated: time.Now()}); err != nil {
+		t.Fatal("Set() =", err)
+	}
+
+	out, err := json.Marshal(request.Data{ID: "cancelled", ReqURL: testserver.URL, ReqMethod: http.MethodGet})
+	if err != nil {
+		t.Fatalf("Error marshaling json for test")
+	}
+	if err := deliver(context.Background(), out); err != nil {
+		t.Fatal("deliver() =", err)
+	}
+	if delivered {
+		t.Error("Cancelled request was delivered")
+	}
+	if got, err := statuses.Get(context.Background(), "cancelled"); err != nil || got.State != status.Cancelled {
+		t.Errorf("got status %+v, %v, want it cancelled", got, err)
+	}
+}
+
+func TestDeliverResult(t *testing.T) {
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Result-Header", "value")
+		w.Write([]byte("hello world"))
+	}))
+	defer testserver.Close()
+	statuses = status.NewMemory()
+	defer func() { statuses = nil }()
+
+	tests := []struct {
+		name  string
+		limit int64
+		want  *status.Result
+	}{{
+		name:  "whole body",
+		limit: 100,
+		want:  &status.Result{Body: "hello world"},
+	}, {
+		name:  "truncated body",
+		limit: 5,
+		want:  &status.Result{Body: "hello", Truncated: true},
+	}, {
+		name: "results disabled",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The callback still gets the whole body.
+			callbacks := make(chan callbackResult, 1)
+			callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var res callbackResult
+				if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+					t.Error("Error decoding callback:", err)
+				}
+				callbacks <- res
+			}))
+			defer callback.Close()
+			env = envInfo{
+				StoreConfig:    status.StoreConfig{ResultBodyLimit: test.limit},
+				callbackConfig: callbackConfig{CallbackAllowPrivate: true},
+			}
+			defer func() { env = envInfo{} }()
+
+			out, err := json.Marshal(request.Data{
+				ID:        test.name,
+				ReqURL:    testserver.URL,
+				ReqMethod: http.MethodGet,
+				ReqHeader: map[string][]string{callbackHeader: {callback.URL}},
+			})
+			if err != nil {
+				t.Fatalf("Error marshaling json for test")
+			}
+			if err := deliver(context.Background(), out); err != nil {
+				t.Fatal("deliver() =", err)
+			}
+			got, err := statuses.Get(context.Background(), test.name)
+			if err != nil {
+				t.Fatal("Error reading status:", err)
+			}
+			if test.want == nil {
+				if got.Result != nil {
+					t.Errorf("got result %+v, want none", got.Result)
+				}
+			} else if got.Result == nil || got.Result.Body != test.want.Body || got.Result.Truncated != test.want.Truncated || got.Result.Header["Result-Header"][0] != "value" {
+				t.Errorf("got result %+v, want %+v with the response header", got.Result, test.want)
+			}
+			if res := <-callbacks; res.Body != "hello world" {
+				t.Errorf("callback got body %q, want the whole body", res.Body)
+			}
+		})
+	}
+}
+
+type fakeBlobStore struct {
+	objects map[string]string
+}
+
+func (f *fakeBlobStore) Put(ctx context.Context, key string, body io.Reader) (string, error) {
+	return "", errors.New("not implemented")
+}
+
+func (f *fakeBlobStore) Get(ctx context.Context, ref string) (io.ReadCloser, error) {
+	obj, ok := f.objects[ref]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return ioutil.NopCloser(strings.NewReader(obj)), nil
+}
+
+func (f *fakeBlobStore) Delete(ctx context.Context, ref string) error {
+	delete(f.objects, ref)
+	return nil
+}
+
+func TestDeliverOffloadedBody(t *testing.T) {
+	var gotBody string
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		gotBody = string(b)
+	}))
+	defer testserver.Close()
+	store := &fakeBlobStore{objects: map[string]string{"fake://123": "a large body"}}
+	blobs = store
+	defer func() { blobs = nil }()
+
+	out, err := json.Marshal(request.Data{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodPost, ReqBodyRef: "fake://123"})
+	if err != nil {
+		t.Fatalf("Error marshaling json for test")
+	}
+	if err := deliver(context.Background(), out); err != nil {
+		t.Fatal("deliver() =", err)
+	}
+	if gotBody != "a large body" {
+		t.Errorf("delivered body = %q, want the offloaded body", gotBody)
+	}
+	if _, ok := store.objects["fake://123"]; ok {
+		t.Error("offloaded body was not deleted after delivery")
+	}
+	if err := deliver(context.Background(), out); err == nil {
+		t.Error("deliver() succeeded with a missing offloaded body")
+	}
+}
+
+func TestDeliverOffloadedBodyLength(t *testing.T) {
+	tests := []struct {
+		name          string
+		header        map[string][]string
+		wantLength    int64
+		wantChunked   bool
+		wantDelivered bool
+	}{{
+		name:          "declared length",
+		header:        map[string][]string{"Content-Length": {"12"}},
+		wantLength:    12,
+		wantDelivered: true,
+	}, {
+		name:          "unknown length",
+		wantLength:    -1,
+		wantChunked:   true,
+		wantDelivered: true,
+	}, {
+		name:   "wrong length",
+		header: map[string][]string{"Content-Length": {"100"}},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got *http.Request
+			testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r
+			}))
+			defer testserver.Close()
+			blobs = &fakeBlobStore{objects: map[string]string{"fake://123": "a large body"}}
+			defer func() { blobs = nil }()
+			env = envInfo{retryConfig: retryConfig{DeliveryAttempts: 1}}
+			defer func() { env = envInfo{} }()
+
+			out, err := json.Marshal(request.Data{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodPost, ReqHeader: test.header, ReqBodyRef: "fake://123"})
+			if err != nil {
+				t.Fatalf("Error marshaling json for test")
+			}
+			err = deliver(context.Background(), out)
+			if (err == nil) != test.wantDelivered {
+				t.Fatalf("deliver() = %v, want delivered %v", err, test.wantDelivered)
+			}
+			if !test.wantDelivered {
+				return
+			}
+			chunked := len(got.TransferEncoding) > 0 && got.TransferEncoding[0] == "chunked"
+			if got.ContentLength != test.wantLength || chunked != test.wantChunked {
+				t.Errorf("service got length %d, chunked %v, want %d, %v", got.ContentLength, chunked, test.wantLength, test.wantChunked)
+			}
+		})
+	}
+}
+
+func TestDeliverCompressedBody(t *testing.T) {
+	var gotBody string
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		gotBody = string(b)
+	}))
+	defer testserver.Close()
+
+	want := strings.Repeat(`{"name":"value"},`, 100)
+	c, _ := compression.New(compression.CompressionConfig{BodyCompression: compression.Zstd})
+	body, encoding, err := c.Compress(want)
+	if err != nil {
+		t.Fatal("Compress() =", err)
+	}
+	out, err := json.Marshal(request.Data{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodPost, ReqBody: body, ReqBodyEncoding: encoding})
+	if err != nil {
+		t.Fatalf("Error marshaling json for test")
+	}
+	if err := deliver(context.Background(), out); err != nil {
+		t.Fatal("deliver() =", err)
+	}
+	if gotBody != want {
+		t.Errorf("delivered body = %q, want the decompressed body", gotBody)
+	}
+
+	out, _ = json.Marshal(request.Data{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodPost, ReqBody: body, ReqBodyEncoding: "br"})
+	if err := deliver(context.Background(), out); err == nil {
+		t.Error("deliver() succeeded with an unknown body encoding")
+	}
+}
+
+func TestDeliverEncrypted(t *testing.T) {
+	var gotBody, gotAuth string
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		gotBody, gotAuth = string(b), r.Header.Get("Authorization")
+	}))
+	defer testserver.Close()
+
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "key1"), []byte(base64.StdEncoding.EncodeToString(make([]byte, 32))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sealer, err := encryption.New(encryption.EncryptionConfig{EncryptionKeysDir: dir, EncryptionKeyID: "key1"})
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	d := request.Data{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodPost, ReqBody: "secret", ReqHeader: map[string][]string{"Authorization": {"Bearer token"}}}
+	if err := sealer.Seal(&d); err != nil {
+		t.Fatal("Seal() =", err)
+	}
+	out, err := json.Marshal(d)
+	if err != nil {
+		t.Fatalf("Error marshaling json for test")
+	}
+
+	if err := deliver(context.Background(), out); err == nil {
+		t.Error("deliver() succeeded without encryption configured")
+	}
+
+	// The consumer only needs the keys to open requests.
+	encryptor, err = encryption.New(encryption.EncryptionConfig{EncryptionKeysDir: dir})
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	defer func() { encryptor = nil }()
+	if err := deliver(context.Background(), out); err != nil {
+		t.Fatal("deliver() =", err)
+	}
+	if gotBody != "secret" || gotAuth != "Bearer token" {
+		t.Errorf("delivered body %q with Authorization %q, want the decrypted ones", gotBody, gotAuth)
+	}
+}
+
+func TestDeliverInjectsHeaders(t *testing.T) {
+	var gotAuth string
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+	}))
+	defer testserver.Close()
+
+	dir, err := ioutil.TempDir("", "headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "Authorization"), []byte("Bearer token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	injector = headers.NewInjector(headers.InjectionConfig{HeaderSecretDir: dir})
+	defer func() { injector = nil }()
+
+	d := request.Data{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodGet}
+	out, err := json.Marshal(d)
+	if err != nil {
+		t.Fatalf("Error marshaling json for test")
+	}
+	if err := deliver(context.Background(), out); err != nil {
+		t.Fatal("deliver() =", err)
+	}
+	if gotAuth != "Bearer token" {
+		t.Errorf("delivered Authorization %q, want the one of the Secret", gotAuth)
+	}
+}
+
+func TestDeliverTraceContext(t *testing.T) {
+	var got string
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Traceparent")
+	}))
+	defer testserver.Close()
+
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	enqueued := time.Now().Add(-time.Second)
+	out, err := json.Marshal(request.Data{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodGet, TraceParent: traceParent, EnqueuedAt: &enqueued})
+	if err != nil {
+		t.Fatalf("Error marshaling json for test")
+	}
+	if err := deliver(context.Background(), out); err != nil {
+		t.Fatal("deliver() =", err)
+	}
+	parent, _ := tracing.ParseTraceParent(traceParent)
+	sc, err := tracing.ParseTraceParent(got)
+	if err != nil {
+		t.Fatal("ParseTraceParent() =", err)
+	}
+	if sc.TraceID != parent.TraceID || sc.SpanID == parent.SpanID || !sc.IsSampled() {
+		t.Errorf("delivered traceparent %q does not continue %q", got, traceParent)
+	}
+}
+
+func (fq *fakeQueue) Enqueue(ctx context.Context, id string, data []byte) error {
+	return nil
+}
+
+func (fq *fakeQueue) Dequeue(ctx context.Context) ([]queue.Message, error) {
+	return nil, nil
+}
+
+func (fq *fakeQueue) Ack(ctx context.Context, msg queue.Message) error {
+	fq.acked = append(fq.acked, msg.ID)
+	return nil
+}
+
+func (fq *fakeQueue) DeadLetter(ctx context.Context, msg queue.Message, reason string) error {
+	fq.deadLettered = append(fq.deadLettered, msg.ID)
+	return nil
+}
+
+func (fq *fakeQueue) Close() error {
+	return nil
+}
+
+func TestApplyConfig(t *testing.T) {
+	baseEnv = envInfo{callbackConfig: callbackConfig{CallbackRetries: 5, CallbackBackoff: time.Second, CallbackTimeout: 10 * time.Second}}
+	env = baseEnv
+	defer func() { env, baseEnv = envInfo{}, envInfo{} }()
+
+	applyConfig(context.Background(), &corev1.ConfigMap{Data: map[string]string{"callback-retries": "2", "callback-timeout": "1m", "callback-max-elapsed": "5m"}})
+	want := callbackConfig{CallbackRetries: 2, CallbackBackoff: time.Second, CallbackTimeout: time.Minute, CallbackMaxElapsed: 5 * time.Minute}
+	if diff := cmp.Diff(want, current().callbackConfig); diff != "" {
+		t.Error("callbackConfig (-want, +got):", diff)
+	}
+
+	applyConfig(context.Background(), &corev1.ConfigMap{Data: map[string]string{"callback-retries": "many"}})
+	if diff := cmp.Diff(want, current().callbackConfig); diff != "" {
+		t.Error("callbackConfig after an invalid ConfigMap (-want, +got):", diff)
+	}
+
+	applyConfig(context.Background(), &corev1.ConfigMap{Data: map[string]string{"concurrency": "8", "host-concurrency": "2"}})
+	if got, want := current().dispatchConfig, (dispatchConfig{Concurrency: 8, HostConcurrency: 2}); got != want {
+		t.Errorf("dispatchConfig = %+v, want %+v", got, want)
+	}
+
+	applyConfig(context.Background(), &corev1.ConfigMap{Data: map[string]string{"delivery-attempts": "5", "delivery-backoff": "2s", "delivery-timeout": "1m"}})
+	if got, want := current().retryConfig, (retryConfig{DeliveryAttempts: 5, DeliveryBackoff: 2 * time.Second, DeliveryTimeout: time.Minute}); got != want {
+		t.Errorf("retryConfig = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/metrics"
+)
+
+const (
+	// Domain and component of the metrics exported to the backend of
+	// config-observability.
+	metricsDomain    = "knative.dev/async"
+	metricsComponent = "async_consumer"
+)
+
+const (
+	// resultSucceeded counts requests the service processed successfully.
+	resultSucceeded = "succeeded"
+	// resultFailed counts requests marked as failed, dead-lettered or not.
+	resultFailed = "failed"
+)
+
+var (
+	deliveryCount    = stats.Int64("delivery_count", "Number of requests delivered, by result", stats.UnitDimensionless)
+	deliveryLatency  = stats.Float64("delivery_latencies", "Time taken to deliver a request to its target, retries included", stats.UnitMilliseconds)
+	deliveryRetries  = stats.Int64("delivery_retry_count", "Number of times requests were sent again to their target", stats.UnitDimensionless)
+	queueDepth       = stats.Int64("queue_depth", "Number of requests waiting in the queue or being delivered", stats.UnitDimensionless)
+	oldestRequestAge = stats.Float64("oldest_request_age_seconds", "Time since the oldest request not delivered yet was enqueued", stats.UnitSeconds)
+	dryRunCount      = stats.Int64("dry_run_count", "Number of requests read in dry-run mode, by result", stats.UnitDimensionless)
+
+	resultKey = tag.MustNewKey("result")
+	targetKey = tag.MustNewKey("target")
+)
+
+// metricViews are the views of the consumer metrics.
+var metricViews = []*view.View{{
+	Description: deliveryCount.Description(),
+	Measure:     deliveryCount,
+	Aggregation: view.Count(),
+	TagKeys:     []tag.Key{resultKey, targetKey},
+}, {
+	Description: deliveryLatency.Description(),
+	Measure:     deliveryLatency,
+	Aggregation: view.Distribution(metrics.Buckets125(1, 600000)...),
+	TagKeys:     []tag.Key{targetKey},
+}, {
+	Description: deliveryRetries.Description(),
+	Measure:     deliveryRetries,
+	Aggregation: view.Sum(),
+	TagKeys:     []tag.Key{targetKey},
+}, {
+	Description: queueDepth.Description(),
+	Measure:     queueDepth,
+	Aggregation: view.LastValue(),
+}, {
+	Description: oldestRequestAge.Description(),
+	Measure:     oldestRequestAge,
+	Aggregation: view.LastValue(),
+}, {
+	Description: dryRunCount.Description(),
+	Measure:     dryRunCount,
+	Aggregation: view.Count(),
+	TagKeys:     []tag.Key{resultKey, targetKey},
+}}
+
+// recordDelivery records the result of the delivery of a request to target.
+func recordDelivery(ctx context.Context, target string, succeeded bool) {
+	result := resultFailed
+	if succeeded {
+		result = resultSucceeded
+	}
+	stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(resultKey, result), tag.Upsert(targetKey, target)}, deliveryCount.M(1))
+}
+
+// recordDryRun records the result of a request to target read in dry-run
+// mode.
+func recordDryRun(ctx context.Context, target, result string) {
+	stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(resultKey, result), tag.Upsert(targetKey, target)}, dryRunCount.M(1))
+}
+
+// recordAttempts records how long the attempts recorded in f took, and how
+// many of them were retries.
+func recordAttempts(ctx context.Context, target string, f queue.Failure) {
+	if f.Attempts == 0 {
+		return
+	}
+	ms := []stats.Measurement{deliveryLatency.M(float64(time.Since(f.FirstAttempt)) / float64(time.Millisecond))}
+	if f.Attempts > 1 {
+		ms = append(ms, deliveryRetries.M(int64(f.Attempts-1)))
+	}
+	stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(targetKey, target)}, ms...)
+}
+
+// recordBacklog records the backlog of q. It returns ErrBacklogNotSupported
+// for backends that do not report it.
+func recordBacklog(ctx context.Context, q queue.Queue) error {
+	b, err := queue.ReadBacklog(ctx, q)
+	if err != nil {
+		return err
+	}
+	var age time.Duration
+	if !b.Oldest.IsZero() {
+		age = time.Since(b.Oldest)
+	}
+	stats.Record(ctx, queueDepth.M(b.Depth), oldestRequestAge.M(age.Seconds()))
+	return nil
+}
+
+// watchBacklog records the backlog of q every BACKLOG_INTERVAL until ctx is
+// done, for backends that report it.
+func watchBacklog(ctx context.Context, q queue.Queue) {
+	logger := logging.FromContext(ctx)
+	interval := current().BacklogInterval
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := recordBacklog(ctx, q); errors.Is(err, queue.ErrBacklogNotSupported) {
+			logger.Info("The queue backend does not report its backlog, queue_depth is not exported")
+			return
+		} else if err != nil {
+			logger.Errorw("Error reading the queue backlog", zap.Error(err))
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// updateMetricsExporter exports the metrics to the backend of the
+// config-observability ConfigMap, such as an OpenCensus collector. They are
+// always served in the Prometheus format on HEALTH_PORT, so the prometheus
+// backend exports nothing more.
+func updateMetricsExporter(ctx context.Context) func(*corev1.ConfigMap) {
+	return func(cm *corev1.ConfigMap) {
+		// Errors are logged, the current exporter is kept.
+		metrics.UpdateExporter(ctx, metrics.ExporterOptions{
+			Domain:    metricsDomain,
+			Component: metricsComponent,
+			ConfigMap: exporterConfig(cm.Data),
+		}, logging.FromContext(ctx))
+	}
+}
+
+// exporterConfig returns the config-observability data, with the prometheus
+// backend, the default, replaced by none.
+func exporterConfig(data map[string]string) map[string]string {
+	config := make(map[string]string, len(data)+1)
+	for k, v := range data {
+		config[k] = v
+	}
+	if backend := strings.ToLower(config[metrics.BackendDestinationKey]); backend == "" || backend == "prometheus" {
+		config[metrics.BackendDestinationKey] = "none"
+	}
+	return config
+}
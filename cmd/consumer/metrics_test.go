@@ -0,0 +1,180 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/pkg/metrics"
+)
+
+// rowValue returns the value of the rows of view name whose tags include
+// tags: the sum of counts and sums, or the last value.
+func rowValue(t *testing.T, name string, tags ...tag.Tag) float64 {
+	t.Helper()
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatalf("RetrieveData(%q) = %v", name, err)
+	}
+	var v float64
+rows:
+	for _, row := range rows {
+		for _, want := range tags {
+			found := false
+			for _, got := range row.Tags {
+				found = found || got == want
+			}
+			if !found {
+				continue rows
+			}
+		}
+		switch d := row.Data.(type) {
+		case *view.CountData:
+			v += float64(d.Value)
+		case *view.SumData:
+			v += d.Value
+		case *view.DistributionData:
+			v += float64(d.Count)
+		case *view.LastValueData:
+			v = d.Value
+		}
+	}
+	return v
+}
+
+func TestDeliveryMetrics(t *testing.T) {
+	if err := view.Register(metricViews...); err != nil {
+		t.Fatal("Register() =", err)
+	}
+	defer view.Unregister(metricViews...)
+
+	attempts := 0
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		switch r.URL.Path {
+		case "/flaky":
+			if attempts == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		case "/invalid":
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer testserver.Close()
+	target := requestHost(testserver.URL)
+	env = envInfo{retryConfig: retryConfig{DeliveryAttempts: 3, DeliveryBackoff: time.Millisecond, DeliveryMaxBackoff: time.Millisecond}}
+	defer func() { env = envInfo{} }()
+
+	for _, path := range []string{"/flaky", "/invalid"} {
+		out, err := json.Marshal(request.Data{ID: "123", ReqURL: testserver.URL + path, ReqMethod: http.MethodGet})
+		if err != nil {
+			t.Fatalf("Error marshaling json for test")
+		}
+		if err := deliver(context.Background(), out); err != nil {
+			t.Fatalf("deliver(%s) = %v", path, err)
+		}
+	}
+
+	targetTag := tag.Tag{Key: targetKey, Value: target}
+	for _, test := range []struct {
+		view string
+		tags []tag.Tag
+		want float64
+	}{
+		{"delivery_count", []tag.Tag{targetTag, {Key: resultKey, Value: resultSucceeded}}, 1},
+		{"delivery_count", []tag.Tag{targetTag, {Key: resultKey, Value: resultFailed}}, 1},
+		{"delivery_latencies", []tag.Tag{targetTag}, 2},
+		{"delivery_retry_count", []tag.Tag{targetTag}, 1},
+	} {
+		if got := rowValue(t, test.view, test.tags...); got != test.want {
+			t.Errorf("%s%v = %v, want %v", test.view, test.tags, got, test.want)
+		}
+	}
+}
+
+func TestRecordBacklog(t *testing.T) {
+	if err := view.Register(metricViews...); err != nil {
+		t.Fatal("Register() =", err)
+	}
+	defer view.Unregister(metricViews...)
+
+	ctx := context.Background()
+	q := queue.NewMemory(queue.MemoryConfig{MemoryQueueName: fmt.Sprint(t.Name(), time.Now().UnixNano()), MemoryReadTimeout: time.Second})
+	for _, id := range []string{"1", "2"} {
+		if err := q.Enqueue(ctx, id, nil); err != nil {
+			t.Fatal("Enqueue() =", err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := recordBacklog(ctx, q); err != nil {
+		t.Fatal("recordBacklog() =", err)
+	}
+	if got := rowValue(t, "queue_depth"); got != 2 {
+		t.Errorf("queue_depth = %v, want 2", got)
+	}
+	if got := rowValue(t, "oldest_request_age_seconds"); got < 0.01 {
+		t.Errorf("oldest_request_age_seconds = %v, want at least 0.01", got)
+	}
+
+	if err := recordBacklog(ctx, &queue.Channel{}); err != queue.ErrBacklogNotSupported {
+		t.Errorf("recordBacklog() = %v, want %v", err, queue.ErrBacklogNotSupported)
+	}
+}
+
+func TestExporterConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+		want    string
+	}{{
+		name: "default",
+		want: "none",
+	}, {
+		name:    "prometheus",
+		backend: "Prometheus",
+		want:    "none",
+	}, {
+		name:    "opencensus",
+		backend: "opencensus",
+		want:    "opencensus",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := map[string]string{"metrics.request-metrics-reporting-period-seconds": "10"}
+			if test.backend != "" {
+				data[metrics.BackendDestinationKey] = test.backend
+			}
+			got := exporterConfig(data)
+			if got[metrics.BackendDestinationKey] != test.want {
+				t.Errorf("backend = %q, want %q", got[metrics.BackendDestinationKey], test.want)
+			}
+			if got["metrics.request-metrics-reporting-period-seconds"] != "10" {
+				t.Errorf("exporterConfig() = %v, want the other keys kept", got)
+			}
+			if data[metrics.BackendDestinationKey] != test.backend {
+				t.Error("exporterConfig() modified the ConfigMap data")
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/async-component/pkg/logkey"
+	"knative.dev/async-component/pkg/pause"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/pkg/logging"
+)
+
+// pauseConfig holds the environment configuration of the services paused
+// by operators.
+type pauseConfig struct {
+	// PauseRecheckInterval is how long the requests of a paused service are
+	// requeued for before they are read again.
+	PauseRecheckInterval time.Duration `envconfig:"PAUSE_RECHECK_INTERVAL" default:"30s"`
+}
+
+// pausesMu guards pauses, the services paused or draining, read from the
+// config-async-pauses ConfigMap.
+var pausesMu sync.RWMutex
+var pauses pause.Services
+
+// currentPauses returns the services paused or draining.
+func currentPauses() pause.Services {
+	pausesMu.RLock()
+	defer pausesMu.RUnlock()
+	return pauses
+}
+
+// applyPauses replaces the services paused or draining with those of cm.
+// Invalid ConfigMaps are ignored and the services in effect are kept.
+func applyPauses(ctx context.Context, cm *corev1.ConfigMap) {
+	services, err := pause.Parse(cm.Data)
+	if err != nil {
+		logging.FromContext(ctx).Errorw("Error applying "+pause.ConfigMapName+", keeping the paused services", zap.Error(err))
+		return
+	}
+	pausesMu.Lock()
+	pauses = services
+	pausesMu.Unlock()
+	logging.FromContext(ctx).Infow("Applied "+pause.ConfigMapName, zap.Int("services", len(services)))
+}
+
+// holdPaused keeps msg in the queue while the deliveries to its service are
+// paused, requeueing it to be read again after PAUSE_RECHECK_INTERVAL. With
+// backends that cannot delay requests, msg is held by the worker, unacked,
+// until the service is resumed. It reports whether msg was held, in which
+// case it must not be delivered.
+func holdPaused(ctx context.Context, q queue.Queue, msg queue.Message) bool {
+	host := messageHost(msg)
+	if !currentPauses().Lookup(host).Paused {
+		return false
+	}
+	interval := current().PauseRecheckInterval
+	logger := logging.FromContext(ctx).With(zap.String(logkey.Host, host), zap.String("message", msg.ID))
+	if requeue(ctx, q, msg, interval) {
+		logger.Debugw("Service is paused, requeued the request", zap.Duration("after", interval))
+		return true
+	}
+	logger.Info("Service is paused, holding the request until it is resumed")
+	for currentPauses().Lookup(host).Paused {
+		select {
+		case <-ctx.Done():
+			// Left pending, to be read again.
+			return true
+		case <-time.After(interval):
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/async-component/pkg/pause"
+	"knative.dev/async-component/pkg/queue"
+)
+
+func TestApplyPauses(t *testing.T) {
+	ctx := context.Background()
+	defer func() { pauses = nil }()
+	applyPauses(ctx, &corev1.ConfigMap{Data: map[string]string{
+		pause.Key("default", "orders"): `{"paused":true,"since":"2021-03-01T10:00:00Z"}`,
+	}})
+	if !currentPauses().Lookup("orders.default.svc.cluster.local").Paused {
+		t.Error("orders is not paused")
+	}
+	// Invalid ConfigMaps keep the services in effect.
+	applyPauses(ctx, &corev1.ConfigMap{Data: map[string]string{pause.Key("default", "orders"): "no"}})
+	if !currentPauses().Lookup("orders.default.svc.cluster.local").Paused {
+		t.Error("orders is not paused after an invalid ConfigMap")
+	}
+	applyPauses(ctx, &corev1.ConfigMap{})
+	if currentPauses().Lookup("orders.default.svc.cluster.local").Paused {
+		t.Error("orders is paused after it was deleted from the ConfigMap")
+	}
+}
+
+// delaylessQueue is a queue that cannot delay requests.
+type delaylessQueue struct {
+	fakeQueue
+}
+
+func (q *delaylessQueue) Enqueue(ctx context.Context, id string, data []byte) error {
+	return queue.ErrDelayNotSupported
+}
+
+func setPaused(paused bool) {
+	pausesMu.Lock()
+	defer pausesMu.Unlock()
+	pauses = pause.Services{pause.Key("default", "orders"): {Paused: paused}}
+}
+
+func TestHoldPaused(t *testing.T) {
+	env = envInfo{pauseConfig: pauseConfig{PauseRecheckInterval: 10 * time.Millisecond}}
+	defer func() { env = envInfo{} }()
+	defer func() { pauses = nil }()
+	ctx := context.Background()
+	msg := testMessage(t, "1", "http://orders.default.svc.cluster.local/")
+
+	setPaused(false)
+	if holdPaused(ctx, &fakeQueue{}, msg) {
+		t.Error("holdPaused() = true for a service that is not paused")
+	}
+
+	setPaused(true)
+	q := &requeueRecorder{Memory: queue.NewMemory(queue.MemoryConfig{MemoryQueueName: fmt.Sprint(t.Name(), time.Now().UnixNano()), MemoryReadTimeout: 10 * time.Millisecond})}
+	start := time.Now()
+	if !holdPaused(ctx, q, msg) {
+		t.Error("holdPaused() = false for a paused service")
+	}
+	if len(q.deliverAt) != 1 || q.deliverAt[0].Before(start.Add(10*time.Millisecond)) {
+		t.Errorf("requeued to be delivered at %v, want after the recheck interval", q.deliverAt)
+	}
+
+	// Without delayed delivery, the request is held until the service is
+	// resumed, and then delivered.
+	time.AfterFunc(50*time.Millisecond, func() { setPaused(false) })
+	dq := &delaylessQueue{}
+	if holdPaused(ctx, dq, msg) {
+		t.Error("holdPaused() = true once the service was resumed")
+	}
+	if len(dq.acked) != 0 {
+		t.Errorf("acked %v, want the held request left pending", dq.acked)
+	}
+
+	// Requests held on shutdown are left pending.
+	setPaused(true)
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if !holdPaused(cctx, dq, msg) {
+		t.Error("holdPaused() = false on shutdown")
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/async-component/pkg/status"
+	"knative.dev/pkg/logging"
+)
+
+// errQuarantined prefixes the dead-letter reason of requests that can never
+// be delivered, such as unreadable ones, as opposed to those that failed.
+var errQuarantined = errors.New("quarantined")
+
+// poisonConfig holds the environment configuration of the detection of
+// poison messages.
+type poisonConfig struct {
+	// PoisonThreshold is the number of times a request may be read without
+	// being acked or dead-lettered, such as when the consumer crashed while
+	// delivering it, before it is quarantined. Requests are never
+	// quarantined for it when it is zero.
+	PoisonThreshold int `envconfig:"POISON_THRESHOLD" default:"3"`
+}
+
+// poisoned reports whether msg was read more than PoisonThreshold times, for
+// backends counting deliveries.
+func (c poisonConfig) poisoned(msg queue.Message) bool {
+	return c.PoisonThreshold > 0 && msg.Deliveries > c.PoisonThreshold
+}
+
+// quarantine dead-letters msg without delivering it, and records the request
+// as failed.
+func quarantine(ctx context.Context, q queue.Queue, msg queue.Message, reason string) {
+	logger := logging.FromContext(ctx)
+	reason = fmt.Sprintf("%v: %s", errQuarantined, reason)
+	logger.Warnw("Quarantining request", zap.String("message", msg.ID), zap.String("reason", reason))
+	if data, err := request.Unmarshal(msg.Data); err == nil {
+		setStatus(ctx, data, status.Failed, 0, reason)
+	}
+	if err := q.DeadLetter(ctx, msg, reason); err != nil {
+		logger.Errorw("Error dead-lettering request", zap.Error(err))
+	} else {
+		auditDeadLettered(ctx, msg, reason)
+	}
+}
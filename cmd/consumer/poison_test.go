@@ -0,0 +1,119 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"knative.dev/async-component/pkg/blob"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+)
+
+// panickingStore panics when a body is read.
+type panickingStore struct {
+	blob.Store
+}
+
+func (panickingStore) Get(ctx context.Context, ref string) (io.ReadCloser, error) {
+	panic("corrupted body")
+}
+
+func TestHandleMessagePoison(t *testing.T) {
+	delivered := false
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered = true
+	}))
+	defer testserver.Close()
+
+	tests := []struct {
+		name          string
+		data          request.Data
+		unreadable    bool
+		deliveries    int
+		wantDelivered bool
+		wantReason    string
+	}{{
+		name:          "within threshold",
+		data:          request.Data{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodGet},
+		deliveries:    3,
+		wantDelivered: true,
+	}, {
+		name:       "read too many times",
+		data:       request.Data{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodGet},
+		deliveries: 4,
+		wantReason: "quarantined: read 4 times without being acked",
+	}, {
+		name:       "unreadable",
+		unreadable: true,
+		deliveries: 1,
+		wantReason: "quarantined: unreadable request",
+	}, {
+		name:       "delivery panics",
+		data:       request.Data{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodPost, ReqBodyRef: "ref"},
+		deliveries: 1,
+		wantReason: "quarantined: delivery panicked: corrupted body",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delivered = false
+			env = envInfo{poisonConfig: poisonConfig{PoisonThreshold: 3}}
+			defer func() { env = envInfo{} }()
+			blobs = panickingStore{}
+			defer func() { blobs = nil }()
+
+			ctx := context.Background()
+			q := queue.NewMemory(queue.MemoryConfig{MemoryQueueName: fmt.Sprint(t.Name(), time.Now().UnixNano()), MemoryReadTimeout: time.Second})
+			out := []byte("not json")
+			if !test.unreadable {
+				b, err := json.Marshal(test.data)
+				if err != nil {
+					t.Fatalf("Error marshaling json for test")
+				}
+				out = b
+			}
+			if err := q.Enqueue(ctx, "123", out); err != nil {
+				t.Fatal("Enqueue() =", err)
+			}
+			msgs, err := q.Dequeue(ctx)
+			if err != nil || len(msgs) != 1 {
+				t.Fatalf("Dequeue() = %v, %v, want 1 message", msgs, err)
+			}
+			msgs[0].Deliveries = test.deliveries
+			handleMessage(ctx, q, msgs[0])
+
+			if delivered != test.wantDelivered {
+				t.Errorf("delivered = %v, want %v", delivered, test.wantDelivered)
+			}
+			dead := q.DeadLetters()
+			if test.wantReason == "" {
+				if len(dead) != 0 {
+					t.Errorf("got dead letters %+v, want none", dead)
+				}
+				return
+			}
+			if len(dead) != 1 || !strings.HasPrefix(dead[0].Reason, test.wantReason) {
+				t.Errorf("got dead letters %+v, want one with reason %q", dead, test.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/pkg/logging"
+)
+
+// retryConfig holds the environment configuration of delivery retries.
+type retryConfig struct {
+	// DeliveryAttempts is the number of times a request is sent before its
+	// delivery fails.
+	DeliveryAttempts int `envconfig:"DELIVERY_ATTEMPTS" default:"3"`
+	// DeliveryBackoff is the wait before the first retry. It doubles with
+	// every retry, up to DeliveryMaxBackoff.
+	DeliveryBackoff    time.Duration `envconfig:"DELIVERY_BACKOFF" default:"1s"`
+	DeliveryMaxBackoff time.Duration `envconfig:"DELIVERY_MAX_BACKOFF" default:"30s"`
+	// DeliveryTimeout bounds each attempt, reading the response included.
+	// There is no bound when it is zero.
+	DeliveryTimeout time.Duration `envconfig:"DELIVERY_TIMEOUT" default:"5m"`
+	// DeliveryMaxRetryAfter is the longest Retry-After of a service that
+	// is honored by requeueing the request. Services asking to wait up to
+	// DeliveryMaxBackoff are waited for in place, and longer waits are
+	// ignored.
+	DeliveryMaxRetryAfter time.Duration `envconfig:"DELIVERY_MAX_RETRY_AFTER" default:"1h"`
+}
+
+const (
+	// Header carrying the async.knative.dev/retries annotation of the
+	// service, set by the ingress and stored with the request.
+	serviceRetriesHeader = "Async-Service-Retries"
+	// Header carrying the async.knative.dev/backoff annotation of the
+	// service.
+	serviceBackoffHeader = "Async-Service-Backoff"
+)
+
+// forService returns c with the retries and backoff of the service of a
+// request with header, when its annotations set them. Invalid values are
+// ignored, the ingress rejects them.
+func (c retryConfig) forService(header http.Header) retryConfig {
+	if n, err := strconv.Atoi(header.Get(serviceRetriesHeader)); err == nil && n >= 0 {
+		c.DeliveryAttempts = n + 1
+	}
+	if d, err := time.ParseDuration(header.Get(serviceBackoffHeader)); err == nil && d > 0 {
+		c.DeliveryBackoff = d
+		if c.DeliveryMaxBackoff < d {
+			c.DeliveryMaxBackoff = d
+		}
+	}
+	return c
+}
+
+// retryable reports whether a delivery with method that ended with resp or
+// err may succeed if tried again: the service could not be reached, failed,
+// or asked to be called later. A service that timed out may still process
+// the request, so only idempotent requests are sent again.
+func retryable(method string, resp *http.Response, err error) bool {
+	if err != nil {
+		return !timedOut(err) || idempotent(method)
+	}
+	return resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// deliveryError is returned by deliver when the service could not process a
+// request after all attempts, along with their record.
+type deliveryError struct {
+	err     error
+	failure queue.Failure
+}
+
+func (e *deliveryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *deliveryError) Unwrap() error {
+	return e.err
+}
+
+// retryLaterError is returned by deliver when the service asked for a
+// request to be sent again after a wait too long to be made in place.
+type retryLaterError struct {
+	after   time.Duration
+	failure queue.Failure
+}
+
+func (e *retryLaterError) Error() string {
+	return fmt.Sprintf("url asked to retry after %s", e.after)
+}
+
+// retryAfter returns the wait asked for by the Retry-After header of a 429
+// or 503 response, in seconds or as an HTTP date, if any.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return 0, false
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := time.Until(t); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// sendWithRetries sends the requests made by newRequest until one is not
+// worth retrying or DeliveryAttempts are made, waiting between attempts with
+// exponential backoff and jitter, or for as long as the service asked with
+// Retry-After. Waits longer than DeliveryMaxBackoff, up to
+// DeliveryMaxRetryAfter, end the attempts with a retryLaterError. It returns
+// the last response and the record of the attempts.
+func sendWithRetries(ctx context.Context, client *http.Client, newRequest func() (*http.Request, error), cfg retryConfig) (*http.Response, queue.Failure, error) {
+	var failure queue.Failure
+	backoff := cfg.DeliveryBackoff
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, failure, err
+		}
+		failure.Attempts = attempt
+		failure.LastAttempt = time.Now()
+		if attempt == 1 {
+			failure.FirstAttempt = failure.LastAttempt
+		}
+		resp, err := client.Do(req)
+		switch {
+		case err != nil && timedOut(err):
+			err = fmt.Errorf("delivery timed out after %s: %w", cfg.DeliveryTimeout, err)
+		case err != nil:
+			err = fmt.Errorf("problem calling url: %w", err)
+		default:
+			failure.StatusCode = resp.StatusCode
+		}
+		auditAttempt(ctx, attempt, resp, err)
+		after, hasAfter := retryAfter(resp)
+		if hasAfter && after > cfg.DeliveryMaxBackoff && after <= cfg.DeliveryMaxRetryAfter {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			return nil, failure, &retryLaterError{after: after, failure: failure}
+		}
+		if !retryable(req.Method, resp, err) || attempt >= cfg.DeliveryAttempts {
+			return resp, failure, err
+		}
+		if err == nil {
+			// Drain the body so the connection is reused.
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			err = fmt.Errorf("url returned %d", resp.StatusCode)
+		}
+		wait := jitter(backoff)
+		if hasAfter && after <= cfg.DeliveryMaxBackoff {
+			wait = after
+		}
+		logging.FromContext(ctx).Infow("Error delivering request, retrying", zap.Int("attempt", attempt), zap.Duration("backoff", wait), zap.Error(err))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, failure, ctx.Err()
+		}
+		if backoff *= 2; backoff > cfg.DeliveryMaxBackoff {
+			backoff = cfg.DeliveryMaxBackoff
+		}
+	}
+}
+
+// timedOut reports whether err is the timeout of a delivery attempt, rather
+// than a failure to connect.
+func timedOut(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, context.DeadlineExceeded)
+}
+
+// idempotent reports whether requests with method can be sent more than once
+// with the same effect, as defined in RFC 7231.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// jitter returns a random duration between half of d and d, so requests
+// failing together are not retried together.
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,349 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/async-component/pkg/status"
+)
+
+func TestDeliverRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		failStatus   int
+		attempts     int
+		wantAttempts int
+		want         status.State
+		wantCode     int
+		wantErr      bool
+	}{{
+		name:         "recovers",
+		failures:     2,
+		failStatus:   http.StatusServiceUnavailable,
+		attempts:     3,
+		wantAttempts: 3,
+		want:         status.Succeeded,
+		wantCode:     http.StatusOK,
+	}, {
+		name:         "throttled",
+		failures:     1,
+		failStatus:   http.StatusTooManyRequests,
+		attempts:     3,
+		wantAttempts: 2,
+		want:         status.Succeeded,
+		wantCode:     http.StatusOK,
+	}, {
+		name:         "attempts exhausted",
+		failures:     5,
+		failStatus:   http.StatusInternalServerError,
+		attempts:     3,
+		wantAttempts: 3,
+		want:         status.Failed,
+		wantCode:     http.StatusInternalServerError,
+		wantErr:      true,
+	}, {
+		name:         "client error is not retried",
+		failures:     5,
+		failStatus:   http.StatusBadRequest,
+		attempts:     3,
+		wantAttempts: 1,
+		want:         status.Failed,
+		wantCode:     http.StatusBadRequest,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				if b, _ := ioutil.ReadAll(r.Body); string(b) != "body" {
+					t.Errorf("attempt %d got body %q, want body", attempts, b)
+				}
+				if attempts <= test.failures {
+					w.WriteHeader(test.failStatus)
+				}
+			}))
+			defer testserver.Close()
+			env = envInfo{retryConfig: retryConfig{DeliveryAttempts: test.attempts, DeliveryBackoff: time.Millisecond, DeliveryMaxBackoff: time.Millisecond}}
+			defer func() { env = envInfo{} }()
+			statuses = status.NewMemory()
+			defer func() { statuses = nil }()
+
+			out, err := json.Marshal(request.Data{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodPost, ReqBody: "body"})
+			if err != nil {
+				t.Fatalf("Error marshaling json for test")
+			}
+			if err := deliver(context.Background(), out); (err != nil) != test.wantErr {
+				t.Fatalf("deliver() = %v, want error %v", err, test.wantErr)
+			}
+			if attempts != test.wantAttempts {
+				t.Errorf("got %d attempts, want %d", attempts, test.wantAttempts)
+			}
+			got, err := statuses.Get(context.Background(), "123")
+			if err != nil {
+				t.Fatal("Error reading status:", err)
+			}
+			if got.State != test.want || got.StatusCode != test.wantCode {
+				t.Errorf("got status %+v, want %s with code %d", got, test.want, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestDeliverRetriesUnreachable(t *testing.T) {
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := testserver.URL
+	testserver.Close()
+	env = envInfo{retryConfig: retryConfig{DeliveryAttempts: 2, DeliveryBackoff: time.Millisecond, DeliveryMaxBackoff: time.Millisecond}}
+	defer func() { env = envInfo{} }()
+
+	out, err := json.Marshal(request.Data{ID: "123", ReqURL: url, ReqMethod: http.MethodGet})
+	if err != nil {
+		t.Fatalf("Error marshaling json for test")
+	}
+	if err := deliver(context.Background(), out); err == nil {
+		t.Error("deliver() succeeded with an unreachable service")
+	}
+}
+
+func TestDeliverTimeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		wantAttempts int
+	}{{
+		name:         "idempotent request is retried",
+		method:       http.MethodPut,
+		wantAttempts: 2,
+	}, {
+		name:         "other request is not retried",
+		method:       http.MethodPost,
+		wantAttempts: 1,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			release := make(chan struct{})
+			var attempts int32
+			testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&attempts, 1)
+				<-release
+			}))
+			defer testserver.Close()
+			defer close(release)
+			env = envInfo{retryConfig: retryConfig{DeliveryAttempts: 2, DeliveryBackoff: time.Millisecond, DeliveryMaxBackoff: time.Millisecond, DeliveryTimeout: 20 * time.Millisecond}}
+			defer func() { env = envInfo{} }()
+
+			out, err := json.Marshal(request.Data{ID: "123", ReqURL: testserver.URL, ReqMethod: test.method})
+			if err != nil {
+				t.Fatalf("Error marshaling json for test")
+			}
+			err = deliver(context.Background(), out)
+			if err == nil || !strings.Contains(err.Error(), "timed out") {
+				t.Errorf("deliver() = %v, want a timeout", err)
+			}
+			if got := int(atomic.LoadInt32(&attempts)); got != test.wantAttempts {
+				t.Errorf("got %d attempts, want %d", got, test.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestDeadLetterFailure(t *testing.T) {
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer testserver.Close()
+	env = envInfo{retryConfig: retryConfig{DeliveryAttempts: 2, DeliveryBackoff: time.Millisecond, DeliveryMaxBackoff: time.Millisecond}}
+	defer func() { env = envInfo{} }()
+
+	ctx := context.Background()
+	q := queue.NewMemory(queue.MemoryConfig{MemoryQueueName: t.Name(), MemoryReadTimeout: time.Second})
+	out, err := json.Marshal(request.Data{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodGet})
+	if err != nil {
+		t.Fatalf("Error marshaling json for test")
+	}
+	if err := q.Enqueue(ctx, "123", out); err != nil {
+		t.Fatal("Enqueue() =", err)
+	}
+	msgs, err := q.Dequeue(ctx)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Dequeue() = %v, %v, want 1 message", msgs, err)
+	}
+	start := time.Now()
+	handleMessage(ctx, q, msgs[0])
+
+	dead := q.DeadLetters()
+	if len(dead) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(dead))
+	}
+	f := dead[0].Failure
+	if f.StatusCode != http.StatusBadGateway || f.Attempts != 2 {
+		t.Errorf("got failure %+v, want status %d after 2 attempts", f, http.StatusBadGateway)
+	}
+	if f.FirstAttempt.Before(start) || f.LastAttempt.Before(f.FirstAttempt) {
+		t.Errorf("got attempts at %v and %v, want after %v", f.FirstAttempt, f.LastAttempt, start)
+	}
+
+	// Replayed requests are read again.
+	if n, err := queue.Replay(ctx, q, 10); err != nil || n != 1 {
+		t.Fatalf("Replay() = %d, %v, want 1", n, err)
+	}
+	if msgs, err := q.Dequeue(ctx); err != nil || len(msgs) != 1 || msgs[0].ID != "123" {
+		t.Errorf("Dequeue() = %v, %v, want the replayed request", msgs, err)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if got := jitter(time.Second); got < 500*time.Millisecond || got > time.Second {
+			t.Fatalf("jitter(1s) = %v, want between 500ms and 1s", got)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header string
+		want   time.Duration
+		wantOK bool
+	}{{
+		name:   "seconds",
+		status: http.StatusServiceUnavailable,
+		header: "120",
+		want:   2 * time.Minute,
+		wantOK: true,
+	}, {
+		name:   "past date",
+		status: http.StatusTooManyRequests,
+		header: "Wed, 21 Oct 2015 07:28:00 GMT",
+		wantOK: true,
+	}, {
+		name:   "not throttled",
+		status: http.StatusInternalServerError,
+		header: "120",
+	}, {
+		name:   "missing",
+		status: http.StatusServiceUnavailable,
+	}, {
+		name:   "invalid",
+		status: http.StatusServiceUnavailable,
+		header: "later",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: test.status, Header: http.Header{}}
+			if test.header != "" {
+				resp.Header.Set("Retry-After", test.header)
+			}
+			got, ok := retryAfter(resp)
+			if got != test.want || ok != test.wantOK {
+				t.Errorf("retryAfter() = %v, %v, want %v, %v", got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
+
+// requeueRecorder records the delivery times of the requests enqueued.
+type requeueRecorder struct {
+	*queue.Memory
+	deliverAt []time.Time
+}
+
+func (q *requeueRecorder) Enqueue(ctx context.Context, id string, data []byte) error {
+	q.deliverAt = append(q.deliverAt, queue.DeliverAtFrom(ctx))
+	return q.Memory.Enqueue(ctx, id, data)
+}
+
+func TestHandleMessageRetryAfter(t *testing.T) {
+	tests := []struct {
+		name         string
+		retryAfter   string
+		wantAttempts int
+		wantRequeued bool
+		wantDead     bool
+	}{{
+		name:         "waited for in place",
+		retryAfter:   "0",
+		wantAttempts: 2,
+	}, {
+		name:         "requeued",
+		retryAfter:   "60",
+		wantAttempts: 1,
+		wantRequeued: true,
+	}, {
+		name:         "longer than the max is ignored",
+		retryAfter:   "7200",
+		wantAttempts: 3,
+		wantDead:     true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				if test.wantDead || attempts == 1 {
+					w.Header().Set("Retry-After", test.retryAfter)
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}))
+			defer testserver.Close()
+			env = envInfo{retryConfig: retryConfig{DeliveryAttempts: 3, DeliveryBackoff: time.Millisecond, DeliveryMaxBackoff: time.Second, DeliveryMaxRetryAfter: time.Hour}}
+			defer func() { env = envInfo{} }()
+
+			ctx := context.Background()
+			q := &requeueRecorder{Memory: queue.NewMemory(queue.MemoryConfig{MemoryQueueName: fmt.Sprint(t.Name(), time.Now().UnixNano()), MemoryReadTimeout: 10 * time.Millisecond})}
+			out, err := json.Marshal(request.Data{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodPost})
+			if err != nil {
+				t.Fatalf("Error marshaling json for test")
+			}
+			if err := q.Enqueue(ctx, "123", out); err != nil {
+				t.Fatal("Enqueue() =", err)
+			}
+			msgs, err := q.Dequeue(ctx)
+			if err != nil || len(msgs) != 1 {
+				t.Fatalf("Dequeue() = %v, %v, want 1 message", msgs, err)
+			}
+			q.deliverAt = nil
+			start := time.Now()
+			handleMessage(ctx, q, msgs[0])
+
+			if attempts != test.wantAttempts {
+				t.Errorf("got %d attempts, want %d", attempts, test.wantAttempts)
+			}
+			if dead := q.DeadLetters(); (len(dead) > 0) != test.wantDead {
+				t.Errorf("got dead letters %+v, want dead-lettered %v", dead, test.wantDead)
+			}
+			if requeued := len(q.deliverAt) > 0; requeued != test.wantRequeued {
+				t.Errorf("got requeues at %v, want requeued %v", q.deliverAt, test.wantRequeued)
+			}
+			if test.wantRequeued && q.deliverAt[0].Sub(start) < time.Minute {
+				t.Errorf("requeued to be delivered at %v, want a minute after %v", q.deliverAt[0], start)
+			}
+		})
+	}
+}
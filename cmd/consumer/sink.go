@@ -0,0 +1,81 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"knative.dev/async-component/pkg/request"
+)
+
+const (
+	// Header carrying the async.knative.dev/dead-letter-sink annotation of
+	// the service, set by the ingress and stored with the request.
+	serviceDeadLetterSinkHeader = "Async-Service-Dead-Letter-Sink"
+	// Headers set on the requests sent to a dead-letter sink to the URL and
+	// method of the undeliverable request and to the reason it failed.
+	deadLetterURLHeader    = "Async-Dead-Letter-Url"
+	deadLetterMethodHeader = "Async-Dead-Letter-Method"
+	deadLetterReasonHeader = "Async-Dead-Letter-Reason"
+	// Prefix of the headers holding the failure fields, see queue.Failure.
+	deadLetterFailureHeaderPrefix = "Async-Dead-Letter-"
+)
+
+// deadLetterSink returns the dead-letter sink stored with a request, or an
+// empty string when it has none. The producer only stores the sink set by
+// the ingress, which only sets http and https URLs; any other value, such as
+// that of a request stored by an older producer, is ignored.
+func deadLetterSink(header http.Header) string {
+	sink := header.Get(serviceDeadLetterSinkHeader)
+	if u, err := url.Parse(sink); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return sink
+}
+
+// sendToSink POSTs the body of request data, read from body, to the
+// dead-letter sink of its service along with the reason its delivery failed.
+// Only the content type of the request is passed on, so credentials added
+// for the service do not reach the sink.
+func sendToSink(ctx context.Context, client *http.Client, sink string, data *request.Data, body io.Reader, derr *deliveryError) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sink, body)
+	if err != nil {
+		return fmt.Errorf("unable to create dead-letter request: %w", err)
+	}
+	if ct := http.Header(data.ReqHeader).Get("Content-Type"); ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+	req.Header.Set(requestIDHeader, data.ID)
+	req.Header.Set(deadLetterURLHeader, data.ReqURL)
+	req.Header.Set(deadLetterMethodHeader, data.ReqMethod)
+	req.Header.Set(deadLetterReasonHeader, derr.Error())
+	for k, v := range derr.failure.Fields() {
+		req.Header.Set(deadLetterFailureHeaderPrefix+k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("problem calling dead-letter sink: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("dead-letter sink returned %d", resp.StatusCode)
+	}
+	return nil
+}
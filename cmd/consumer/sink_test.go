@@ -0,0 +1,193 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"knative.dev/async-component/pkg/request"
+)
+
+func TestRetryConfigForService(t *testing.T) {
+	base := retryConfig{DeliveryAttempts: 3, DeliveryBackoff: time.Second, DeliveryMaxBackoff: 30 * time.Second}
+	tests := []struct {
+		name   string
+		header http.Header
+		want   retryConfig
+	}{{
+		name: "not annotated",
+		want: base,
+	}, {
+		name:   "retries and backoff",
+		header: http.Header{serviceRetriesHeader: {"5"}, serviceBackoffHeader: {"2s"}},
+		want:   retryConfig{DeliveryAttempts: 6, DeliveryBackoff: 2 * time.Second, DeliveryMaxBackoff: 30 * time.Second},
+	}, {
+		name:   "no retries",
+		header: http.Header{serviceRetriesHeader: {"0"}},
+		want:   retryConfig{DeliveryAttempts: 1, DeliveryBackoff: time.Second, DeliveryMaxBackoff: 30 * time.Second},
+	}, {
+		name:   "backoff above the max",
+		header: http.Header{serviceBackoffHeader: {"1m"}},
+		want:   retryConfig{DeliveryAttempts: 3, DeliveryBackoff: time.Minute, DeliveryMaxBackoff: time.Minute},
+	}, {
+		name:   "invalid values",
+		header: http.Header{serviceRetriesHeader: {"-1"}, serviceBackoffHeader: {"soon"}},
+		want:   base,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := base.forService(test.header); got != test.want {
+				t.Errorf("forService() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDeadLetterSink(t *testing.T) {
+	tests := []struct {
+		name string
+		sink string
+		want string
+	}{{
+		name: "none",
+	}, {
+		name: "http",
+		sink: "http://sink.default.svc.cluster.local/failed",
+		want: "http://sink.default.svc.cluster.local/failed",
+	}, {
+		name: "https",
+		sink: "https://example.com",
+		want: "https://example.com",
+	}, {
+		name: "other scheme",
+		sink: "gopher://example.com",
+	}, {
+		name: "relative",
+		sink: "/failed",
+	}, {
+		name: "invalid",
+		sink: "http://%zz",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			if test.sink != "" {
+				header.Set(serviceDeadLetterSinkHeader, test.sink)
+			}
+			if got := deadLetterSink(header); got != test.want {
+				t.Errorf("deadLetterSink() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDeliverDeadLetterSink(t *testing.T) {
+	attempts := 0
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer testserver.Close()
+
+	tests := []struct {
+		name         string
+		sinkStatus   int
+		noSink       bool
+		wantAttempts int
+		wantErr      bool
+	}{{
+		name:         "sink accepts the request",
+		sinkStatus:   http.StatusAccepted,
+		wantAttempts: 2,
+	}, {
+		name:         "sink fails",
+		sinkStatus:   http.StatusInternalServerError,
+		wantAttempts: 2,
+		wantErr:      true,
+	}, {
+		name:         "no sink",
+		noSink:       true,
+		wantAttempts: 2,
+		wantErr:      true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts = 0
+			var got *http.Request
+			var gotBody string
+			sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := ioutil.ReadAll(r.Body)
+				got, gotBody = r, string(b)
+				w.WriteHeader(test.sinkStatus)
+			}))
+			defer sink.Close()
+			env = envInfo{retryConfig: retryConfig{DeliveryAttempts: 5, DeliveryBackoff: time.Millisecond, DeliveryMaxBackoff: time.Millisecond}}
+			defer func() { env = envInfo{} }()
+
+			header := map[string][]string{
+				"Content-Type":       {"application/json"},
+				"Authorization":      {"Bearer secret"},
+				serviceRetriesHeader: {"1"},
+			}
+			if !test.noSink {
+				header[serviceDeadLetterSinkHeader] = []string{sink.URL}
+			}
+			out, err := json.Marshal(request.Data{ID: "123", ReqURL: testserver.URL + "/path", ReqMethod: http.MethodPost, ReqBody: `{"a":1}`, ReqHeader: header})
+			if err != nil {
+				t.Fatalf("Error marshaling json for test")
+			}
+			err = deliver(context.Background(), out)
+			var derr *deliveryError
+			if test.wantErr != errors.As(err, &derr) {
+				t.Fatalf("deliver() = %v, want delivery error %v", err, test.wantErr)
+			}
+			if attempts != test.wantAttempts {
+				t.Errorf("service got %d attempts, want %d", attempts, test.wantAttempts)
+			}
+			if test.noSink {
+				if got != nil {
+					t.Error("sink got a request, want none")
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("sink got no request")
+			}
+			for name, want := range map[string]string{
+				"Content-Type":                             "application/json",
+				"Authorization":                            "",
+				requestIDHeader:                            "123",
+				deadLetterURLHeader:                        testserver.URL + "/path",
+				deadLetterMethodHeader:                     http.MethodPost,
+				deadLetterReasonHeader:                     "url returned 503 after 2 attempts",
+				deadLetterFailureHeaderPrefix + "Attempts": "2",
+				deadLetterFailureHeaderPrefix + "Status":   "503",
+			} {
+				if v := got.Header.Get(name); v != want {
+					t.Errorf("sink got %s: %q, want %q", name, v, want)
+				}
+			}
+			if gotBody != `{"a":1}` {
+				t.Errorf("sink got body %q, want the request body", gotBody)
+			}
+		})
+	}
+}
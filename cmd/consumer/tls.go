@@ -0,0 +1,76 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// tlsConfig holds the environment configuration of the TLS connections to
+// https:// services, read from files such as mounted Secrets.
+type tlsConfig struct {
+	// DeliveryCAFile holds PEM encoded CA certificates trusted to verify
+	// the services, along with the system ones.
+	DeliveryCAFile string `envconfig:"DELIVERY_CA_FILE"`
+	// The client certificate and key presented to services requiring
+	// mutual TLS.
+	DeliveryClientCertFile string `envconfig:"DELIVERY_CLIENT_CERT_FILE"`
+	DeliveryClientKeyFile  string `envconfig:"DELIVERY_CLIENT_KEY_FILE"`
+}
+
+// newDeliveryTransport returns the transport of the requests delivered to the
+// services, tuned by cfg and with the TLS settings of tlsCfg.
+func newDeliveryTransport(tlsCfg tlsConfig, cfg transportConfig) (http.RoundTripper, error) {
+	tc, err := newTLSConfig(tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+	return newTransport(cfg, tc), nil
+}
+
+// newTLSConfig returns the TLS configuration of the connections to https://
+// services, or nil to use the system one when no TLS setting is set.
+func newTLSConfig(cfg tlsConfig) (*tls.Config, error) {
+	if cfg.DeliveryCAFile == "" && cfg.DeliveryClientCertFile == "" && cfg.DeliveryClientKeyFile == "" {
+		return nil, nil
+	}
+	tc := &tls.Config{}
+	if cfg.DeliveryCAFile != "" {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(cfg.DeliveryCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read delivery CA certificates: %w", err)
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no valid CA certificate found in DELIVERY_CA_FILE")
+		}
+		tc.RootCAs = roots
+	}
+	if cfg.DeliveryClientCertFile != "" || cfg.DeliveryClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.DeliveryClientCertFile, cfg.DeliveryClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load delivery client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
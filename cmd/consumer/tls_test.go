@@ -0,0 +1,170 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"knative.dev/async-component/pkg/request"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1, usable by
+// servers and clients, and its key to dir.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Error generating key:", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "async-consumer"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("Error creating certificate:", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal("Error marshaling key:", err)
+	}
+	certFile, keyFile = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal("Error writing certificate:", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal("Error writing key:", err)
+	}
+	return certFile, keyFile
+}
+
+func TestDeliverMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal("Error creating directory:", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal("Error loading certificate:", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(mustParse(t, cert.Certificate[0]))
+
+	testserver := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	testserver.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	testserver.StartTLS()
+	defer testserver.Close()
+
+	tests := []struct {
+		name    string
+		cfg     tlsConfig
+		wantErr bool
+	}{{
+		name: "client certificate",
+		cfg:  tlsConfig{DeliveryCAFile: certFile, DeliveryClientCertFile: certFile, DeliveryClientKeyFile: keyFile},
+	}, {
+		name:    "no client certificate",
+		cfg:     tlsConfig{DeliveryCAFile: certFile},
+		wantErr: true,
+	}, {
+		name:    "unknown CA",
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport, err := newDeliveryTransport(test.cfg, transportConfig{})
+			if err != nil {
+				t.Fatal("newDeliveryTransport() =", err)
+			}
+			deliveryTransport = transport
+			defer func() { deliveryTransport = nil }()
+
+			out, err := json.Marshal(request.Data{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodPost})
+			if err != nil {
+				t.Fatalf("Error marshaling json for test")
+			}
+			if err := deliver(context.Background(), out); (err != nil) != test.wantErr {
+				t.Errorf("deliver() = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewDeliveryTransportErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal("Error creating directory:", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, _ := writeTestCert(t, dir)
+	tests := []struct {
+		name string
+		cfg  tlsConfig
+	}{{
+		name: "missing CA file",
+		cfg:  tlsConfig{DeliveryCAFile: filepath.Join(dir, "missing")},
+	}, {
+		name: "invalid CA file",
+		cfg:  tlsConfig{DeliveryCAFile: filepath.Join(dir, "tls.key")},
+	}, {
+		name: "client certificate without key",
+		cfg:  tlsConfig{DeliveryClientCertFile: certFile},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newDeliveryTransport(test.cfg, transportConfig{}); err == nil {
+				t.Error("newDeliveryTransport() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func mustParse(t *testing.T, der []byte) *x509.Certificate {
+	t.Helper()
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("Error parsing certificate:", err)
+	}
+	return c
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+// transportConfig holds the environment configuration of the connections
+// carrying the requests to the services.
+type transportConfig struct {
+	// DeliveryMaxIdleConnsPerHost is how many idle connections are kept
+	// open to each service. The default transport keeps two, so busy
+	// consumers keep opening new connections.
+	DeliveryMaxIdleConnsPerHost int `envconfig:"DELIVERY_MAX_IDLE_CONNS_PER_HOST" default:"100"`
+	// DeliveryIdleConnTimeout is how long idle connections are kept open.
+	DeliveryIdleConnTimeout time.Duration `envconfig:"DELIVERY_IDLE_CONN_TIMEOUT" default:"90s"`
+	// DeliveryKeepAlive is the interval between the TCP keep-alive probes
+	// of the connections. They are disabled when negative.
+	DeliveryKeepAlive time.Duration `envconfig:"DELIVERY_KEEP_ALIVE" default:"30s"`
+	// DeliveryTLSHandshakeTimeout bounds the TLS handshakes with https://
+	// services.
+	DeliveryTLSHandshakeTimeout time.Duration `envconfig:"DELIVERY_TLS_HANDSHAKE_TIMEOUT" default:"10s"`
+	// DeliveryHTTP2 negotiates HTTP/2 with https:// services supporting it.
+	DeliveryHTTP2 bool `envconfig:"DELIVERY_HTTP2" default:"true"`
+}
+
+// Timeout of the connections to the services, as in the default transport.
+const dialTimeout = 30 * time.Second
+
+// newTransport returns a transport tuned by cfg verifying https:// services
+// with tc, or with the system settings when nil.
+func newTransport(cfg transportConfig, tc *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: cfg.DeliveryKeepAlive,
+	}).DialContext
+	transport.MaxIdleConnsPerHost = cfg.DeliveryMaxIdleConnsPerHost
+	if cfg.DeliveryMaxIdleConnsPerHost > transport.MaxIdleConns {
+		transport.MaxIdleConns = cfg.DeliveryMaxIdleConnsPerHost
+	}
+	transport.IdleConnTimeout = cfg.DeliveryIdleConnTimeout
+	transport.TLSHandshakeTimeout = cfg.DeliveryTLSHandshakeTimeout
+	transport.TLSClientConfig = tc
+	transport.ForceAttemptHTTP2 = cfg.DeliveryHTTP2
+	if !cfg.DeliveryHTTP2 {
+		// A non-nil empty map stops the transport from upgrading to HTTP/2.
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
+}
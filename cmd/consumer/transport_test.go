@@ -0,0 +1,82 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewTransport(t *testing.T) {
+	transport := newTransport(transportConfig{
+		DeliveryMaxIdleConnsPerHost: 500,
+		DeliveryIdleConnTimeout:     time.Minute,
+		DeliveryKeepAlive:           time.Second,
+		DeliveryTLSHandshakeTimeout: 5 * time.Second,
+	}, nil)
+	if transport.MaxIdleConnsPerHost != 500 {
+		t.Errorf("MaxIdleConnsPerHost = %d, want 500", transport.MaxIdleConnsPerHost)
+	}
+	if transport.MaxIdleConns < 500 {
+		t.Errorf("MaxIdleConns = %d, want at least the idle connections per host", transport.MaxIdleConns)
+	}
+	if transport.IdleConnTimeout != time.Minute {
+		t.Errorf("IdleConnTimeout = %v, want 1m", transport.IdleConnTimeout)
+	}
+	if transport.TLSHandshakeTimeout != 5*time.Second {
+		t.Errorf("TLSHandshakeTimeout = %v, want 5s", transport.TLSHandshakeTimeout)
+	}
+}
+
+func TestNewTransportHTTP2(t *testing.T) {
+	testserver := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	testserver.EnableHTTP2 = true
+	testserver.StartTLS()
+	defer testserver.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(testserver.Certificate())
+
+	tests := []struct {
+		name      string
+		http2     bool
+		wantProto string
+	}{{
+		name:      "enabled",
+		http2:     true,
+		wantProto: "HTTP/2.0",
+	}, {
+		name:      "disabled",
+		wantProto: "HTTP/1.1",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := newTransport(transportConfig{DeliveryHTTP2: test.http2}, &tls.Config{RootCAs: roots})
+			defer transport.CloseIdleConnections()
+			resp, err := (&http.Client{Transport: transport}).Get(testserver.URL)
+			if err != nil {
+				t.Fatal("Get() =", err)
+			}
+			resp.Body.Close()
+			if resp.Proto != test.wantProto {
+				t.Errorf("got %s, want %s", resp.Proto, test.wantProto)
+			}
+		})
+	}
+}
@@ -14,6 +14,8 @@ limitations under the License.
 package main
 
 import (
+	"knative.dev/async-component/pkg/reconciler/asyncconfig"
+	"knative.dev/async-component/pkg/reconciler/consumer"
 	"knative.dev/async-component/pkg/reconciler/ingress"
 
 	// This defines the shared main for injected controllers.
@@ -23,5 +25,7 @@ import (
 func main() {
 	sharedmain.Main("async-controller",
 		ingress.NewController,
+		consumer.NewController,
+		asyncconfig.NewController,
 	)
 }
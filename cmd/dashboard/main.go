@@ -0,0 +1,110 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The dashboard command serves a web page showing the backlog of the queue
+// by service, the delivery rates of the consumer and the recent dead-lettered
+// requests. It is not authenticated, and meant to be reached with a port
+// forward.
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/health"
+	"knative.dev/async-component/pkg/observability"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/signals"
+)
+
+// Name of the dashboard in logs.
+const serviceName = "async-dashboard"
+
+type envInfo struct {
+	queue.Config
+	// DashboardPort is the port serving the dashboard and the probes.
+	DashboardPort string `envconfig:"DASHBOARD_PORT" default:"8080"`
+	// DashboardRefresh is how often the page reloads itself.
+	DashboardRefresh time.Duration `envconfig:"DASHBOARD_REFRESH" default:"15s"`
+	// DashboardScanLimit is the most requests listed to count them by
+	// service.
+	DashboardScanLimit int `envconfig:"DASHBOARD_SCAN_LIMIT" default:"10000"`
+	// DashboardDeadLetters is the number of recent dead-lettered requests
+	// shown.
+	DashboardDeadLetters int `envconfig:"DASHBOARD_DEAD_LETTERS" default:"20"`
+	// PrometheusURL is the Prometheus server scraping the consumer, which
+	// the delivery rates are read from. They are not shown when it is
+	// empty.
+	PrometheusURL string `envconfig:"PROMETHEUS_URL"`
+	// PrometheusRateWindow is the range the delivery rates are computed
+	// over.
+	PrometheusRateWindow time.Duration `envconfig:"PROMETHEUS_RATE_WINDOW" default:"5m"`
+}
+
+func main() {
+	logger, _ := observability.NewLogger(serviceName, "")
+	defer logger.Sync()
+
+	var env envInfo
+	if err := envconfig.Process("", &env); err != nil {
+		logger.Fatalw("Failed to process the environment", zap.Error(err))
+	}
+	ctx := logging.WithLogger(signals.NewContext(), logger)
+
+	q, err := queue.New(ctx, env.Config)
+	if err != nil {
+		logger.Fatalw("Failed to create queue client", zap.Error(err))
+	}
+	defer q.Close()
+	d := &dashboard{
+		queue:           q,
+		scanLimit:       env.DashboardScanLimit,
+		deadLetterLimit: env.DashboardDeadLetters,
+		refresh:         env.DashboardRefresh,
+		now:             time.Now,
+	}
+	if env.PrometheusURL != "" {
+		d.metrics = &prometheus{
+			url:    strings.TrimSuffix(env.PrometheusURL, "/"),
+			client: &http.Client{Timeout: 10 * time.Second},
+			window: env.PrometheusRateWindow,
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(health.LivenessPath, health.Liveness())
+	mux.Handle(health.ReadinessPath, health.Readiness(func(ctx context.Context) error {
+		return queue.CheckHealth(ctx, q, false)
+	}))
+	mux.HandleFunc(pagePath, d.servePage)
+	mux.HandleFunc(summaryPath, d.serveSummary)
+	server := &http.Server{
+		Addr:        ":" + env.DashboardPort,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	logger.Infow("Serving the dashboard", zap.String("port", env.DashboardPort))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Fatalw("Failed to serve the dashboard", zap.Error(err))
+	}
+}
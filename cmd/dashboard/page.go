@@ -0,0 +1,134 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// pagePath is the path of the dashboard page.
+	pagePath = "/"
+	// summaryPath is the path of the summary shown by the page, as JSON.
+	summaryPath = "/api/summary"
+)
+
+// page renders a summary, reloaded every Refresh seconds.
+var page = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"duration": func(seconds float64) string {
+		return (time.Duration(seconds) * time.Second).String()
+	},
+	"rate": func(v *float64) string {
+		if v == nil {
+			return "-"
+		}
+		return fmt.Sprintf("%.2f/s", *v)
+	},
+	"percent": func(v *float64) string {
+		if v == nil {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f%%", *v*100)
+	},
+	"bar": func(depth int, s summary) int {
+		max := 1
+		for _, svc := range s.Services {
+			if svc.Depth > max {
+				max = svc.Depth
+			}
+		}
+		return depth * 100 / max
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>Async requests</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 0.3em 0.8em; text-align: left; border-bottom: 1px solid #ddd; }
+td.number { text-align: right; }
+.bar { background: #4a90d9; height: 0.8em; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+{{with .Summary}}
+<h1>Async requests</h1>
+<p>{{if .Total}}{{.Total}} requests queued or being delivered. {{end}}Updated {{.Generated.Format "15:04:05 MST"}}.</p>
+{{range .Errors}}<p class="error">{{.}}</p>{{end}}
+<h2>Services</h2>
+<table>
+<tr><th>Service</th><th>Depth</th><th></th><th>In flight</th><th>Oldest</th><th>Throughput</th><th>Failures</th></tr>
+{{range .Services}}
+<tr><td>{{or .Target "(unreadable)"}}</td><td class="number">{{.Depth}}</td><td><div class="bar" style="width: {{bar .Depth $.Summary}}px"></div></td><td class="number">{{.InFlight}}</td><td class="number">{{duration .OldestAge}}</td><td class="number">{{rate .Throughput}}</td><td class="number">{{percent .FailureRate}}</td></tr>
+{{else}}
+<tr><td colspan="7">No requests.</td></tr>
+{{end}}
+</table>
+{{if .Truncated}}<p>Only the oldest requests are counted by service.</p>{{end}}
+<h2>Recent dead letters</h2>
+<table>
+<tr><th>Dead-lettered</th><th>ID</th><th>Service</th><th>Reason</th><th>Status</th><th>Attempts</th></tr>
+{{range .DeadLetters}}
+<tr><td>{{with .DeadLetteredAt}}{{.Format "2006-01-02 15:04:05"}}{{end}}</td><td>{{.ID}}</td><td>{{.Target}}</td><td>{{.Reason}}</td><td class="number">{{with .StatusCode}}{{.}}{{end}}</td><td class="number">{{with .Attempts}}{{.}}{{end}}</td></tr>
+{{else}}
+<tr><td colspan="6">No dead-lettered requests.</td></tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+// servePage renders the summary of d.
+func (d *dashboard) servePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != pagePath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := struct {
+		Refresh int
+		Summary summary
+	}{int(d.refresh.Seconds()), d.summarize(r.Context())}
+	if err := page.Execute(w, data); err != nil {
+		logging.FromContext(r.Context()).Errorw("Error rendering the dashboard", zap.Error(err))
+	}
+}
+
+// serveSummary answers with the summary of d as JSON.
+func (d *dashboard) serveSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(d.summarize(r.Context())); err != nil {
+		logging.FromContext(r.Context()).Errorw("Error writing the summary", zap.Error(err))
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// queryPath is the path of the instant queries of the Prometheus HTTP API.
+const queryPath = "/api/v1/query"
+
+// prometheus queries the delivery metrics the consumer exports from a
+// Prometheus server scraping it.
+type prometheus struct {
+	url    string
+	client *http.Client
+	// window is the range the rates are computed over.
+	window time.Duration
+}
+
+// queryResponse is the body of the answers of the Prometheus HTTP API to
+// instant queries.
+type queryResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		Result []struct {
+			Metric map[string]string `json:"metric"`
+			// Value is the time and value of the sample, as a number and a
+			// string.
+			Value [2]interface{} `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// rates returns the requests delivered per second to each target, and those
+// of them marked as failed.
+func (p *prometheus) rates(ctx context.Context) (delivered, failed map[string]float64, err error) {
+	window := strconv.Itoa(int(p.window.Seconds())) + "s"
+	delivered, err = p.query(ctx, `sum by (target) (rate(async_delivery_count[`+window+`]))`)
+	if err != nil {
+		return nil, nil, err
+	}
+	failed, err = p.query(ctx, `sum by (target) (rate(async_delivery_count{result="failed"}[`+window+`]))`)
+	if err != nil {
+		return nil, nil, err
+	}
+	return delivered, failed, nil
+}
+
+// query returns the values of the vector returned by query, by target.
+func (p *prometheus) query(ctx context.Context, query string) (map[string]float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url+queryPath+"?"+url.Values{"query": {query}}.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the query: %w", err)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query Prometheus: %w", err)
+	}
+	defer resp.Body.Close()
+	var body queryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode the answer of Prometheus, status %d: %w", resp.StatusCode, err)
+	}
+	if body.Status != "success" {
+		return nil, fmt.Errorf("failed to query Prometheus: %s", body.Error)
+	}
+	values := make(map[string]float64, len(body.Data.Result))
+	for _, r := range body.Data.Result {
+		s, ok := r.Value[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected value %v of %v", r.Value[1], r.Metric)
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected value %q of %v: %w", s, r.Metric, err)
+		}
+		values[r.Metric["target"]] = v
+	}
+	return values, nil
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/deadletter"
+	"knative.dev/async-component/pkg/depth"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/pkg/logging"
+)
+
+// summary is what the dashboard shows, also served as JSON.
+type summary struct {
+	Generated time.Time `json:"generated"`
+	// Total is the backlog of the whole queue, unset if the backend does
+	// not report it.
+	Total *int64 `json:"total,omitempty"`
+	// Services are sorted by decreasing depth, followed by the services
+	// with a delivery rate but no requests left.
+	Services []serviceSummary `json:"services"`
+	// Truncated reports that only the oldest scanLimit requests were
+	// counted by service.
+	Truncated bool `json:"truncated,omitempty"`
+	// DeadLetters are the most recent dead-lettered requests, newest first.
+	DeadLetters []deadletter.Entry `json:"deadLetters"`
+	// Errors are the parts of the summary that could not be read.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// serviceSummary is the backlog and delivery rates of a service.
+type serviceSummary struct {
+	Target   string `json:"target"`
+	Depth    int    `json:"depth"`
+	InFlight int    `json:"inFlight"`
+	// OldestAge is the number of seconds since the oldest request was
+	// enqueued.
+	OldestAge float64 `json:"oldestAge,omitempty"`
+	// Throughput is the number of requests delivered per second, and
+	// FailureRate the fraction of them marked as failed, when the metrics
+	// of the consumer are known.
+	Throughput  *float64 `json:"throughput,omitempty"`
+	FailureRate *float64 `json:"failureRate,omitempty"`
+}
+
+// dashboard reads the summary from the queue and from the metrics of the
+// consumer.
+type dashboard struct {
+	queue queue.Queue
+	// metrics is nil when no Prometheus server is configured.
+	metrics *prometheus
+	// scanLimit is the most requests listed to count them by service, and
+	// deadLetterLimit the most dead-lettered requests shown.
+	scanLimit       int
+	deadLetterLimit int
+	// refresh is how often the page reloads itself.
+	refresh time.Duration
+	now     func() time.Time
+}
+
+// summarize reads the summary. The parts that cannot be read are reported
+// in its Errors, and left empty, as are those the backend does not support.
+func (d *dashboard) summarize(ctx context.Context) summary {
+	logger := logging.FromContext(ctx)
+	now := d.now()
+	s := summary{Generated: now, Services: []serviceSummary{}, DeadLetters: []deadletter.Entry{}}
+	fail := func(msg string, err error) {
+		logger.Errorw(msg, zap.Error(err))
+		s.Errors = append(s.Errors, msg+": "+err.Error())
+	}
+
+	if b, err := queue.ReadBacklog(ctx, d.queue); err == nil {
+		s.Total = &b.Depth
+	} else if !errors.Is(err, queue.ErrBacklogNotSupported) {
+		fail("Error reading the backlog", err)
+	}
+	msgs, err := queue.ListPending(ctx, d.queue, d.scanLimit)
+	if err != nil && !errors.Is(err, queue.ErrListNotSupported) {
+		fail("Error listing the requests", err)
+	}
+	s.Truncated = len(msgs) == d.scanLimit
+	listed := make(map[string]bool)
+	for _, svc := range depth.ByService(msgs) {
+		ss := serviceSummary{Target: svc.Target, Depth: svc.Depth, InFlight: svc.InFlight}
+		if !svc.Oldest.IsZero() && svc.Oldest.Before(now) {
+			ss.OldestAge = now.Sub(svc.Oldest).Seconds()
+		}
+		s.Services = append(s.Services, ss)
+		listed[svc.Target] = true
+	}
+
+	if d.metrics != nil {
+		delivered, failed, err := d.metrics.rates(ctx)
+		if err != nil {
+			fail("Error reading the delivery rates", err)
+		}
+		var idle []string
+		for target := range delivered {
+			if !listed[target] {
+				idle = append(idle, target)
+			}
+		}
+		sort.Strings(idle)
+		for _, target := range idle {
+			s.Services = append(s.Services, serviceSummary{Target: target})
+		}
+		for i := range s.Services {
+			svc := &s.Services[i]
+			rate, ok := delivered[svc.Target]
+			if !ok {
+				continue
+			}
+			svc.Throughput = &rate
+			if rate > 0 {
+				f := failed[svc.Target] / rate
+				svc.FailureRate = &f
+			}
+		}
+	}
+
+	dls, err := queue.ListRecentDeadLetters(ctx, d.queue, d.deadLetterLimit)
+	if err != nil && !errors.Is(err, queue.ErrListNotSupported) {
+		fail("Error listing the dead-lettered requests", err)
+	}
+	for _, msg := range dls {
+		s.DeadLetters = append(s.DeadLetters, deadletter.NewEntry(msg))
+	}
+	return s
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+)
+
+// fakePrometheus answers the rate queries with delivered and failed.
+func fakePrometheus(t *testing.T, delivered, failed string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != queryPath {
+			t.Errorf("got path %q, want %q", r.URL.Path, queryPath)
+		}
+		result := delivered
+		if strings.Contains(r.URL.Query().Get("query"), `result="failed"`) {
+			result = failed
+		}
+		fmt.Fprintf(w, `{"status": "success", "data": {"resultType": "vector", "result": %s}}`, result)
+	}))
+}
+
+func newTestDashboard(t *testing.T) *dashboard {
+	ctx := context.Background()
+	q := queue.NewMemory(queue.MemoryConfig{MemoryQueueName: fmt.Sprint(t.Name(), time.Now().UnixNano()), MemoryReadTimeout: time.Second})
+	now := time.Now().Add(time.Hour)
+	enqueue := func(id, target string, enqueued time.Time) {
+		b, err := request.Marshal(request.Data{ID: id, ReqURL: "http://" + target + "/", EnqueuedAt: &enqueued}, request.FormatJSON, enqueued)
+		if err != nil {
+			t.Fatal("Marshal() =", err)
+		}
+		if err := q.Enqueue(ctx, id, b); err != nil {
+			t.Fatal("Enqueue() =", err)
+		}
+	}
+	dequeue := func() queue.Message {
+		msgs, err := q.Dequeue(ctx)
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("Dequeue() = %v, %v, want 1 message", msgs, err)
+		}
+		return msgs[0]
+	}
+	enqueue("failing", "failing.default.svc", now.Add(-time.Hour))
+	if err := q.DeadLetter(queue.WithFailure(ctx, queue.Failure{StatusCode: 500, Attempts: 3}), dequeue(), "url returned 500"); err != nil {
+		t.Fatal("DeadLetter() =", err)
+	}
+	for i, target := range []string{"orders.default.svc", "orders.default.svc", "users.default.svc"} {
+		enqueue(fmt.Sprint(i), target, now.Add(time.Duration(i-4)*time.Minute))
+	}
+	// The first request is being delivered.
+	dequeue()
+	return &dashboard{queue: q, scanLimit: 100, deadLetterLimit: 10, refresh: time.Minute, now: func() time.Time { return now }}
+}
+
+func TestSummarize(t *testing.T) {
+	d := newTestDashboard(t)
+	prom := fakePrometheus(t,
+		`[{"metric": {"target": "orders.default.svc"}, "value": [1614592800, "2"]}, {"metric": {"target": "idle.default.svc"}, "value": [1614592800, "0"]}]`,
+		`[{"metric": {"target": "orders.default.svc"}, "value": [1614592800, "0.5"]}]`)
+	defer prom.Close()
+	d.metrics = &prometheus{url: prom.URL, client: prom.Client(), window: 5 * time.Minute}
+
+	got := d.summarize(context.Background())
+	if len(got.Errors) != 0 {
+		t.Fatal("summarize() errors:", got.Errors)
+	}
+	two, zero, quarter := 2.0, 0.0, 0.25
+	want := []serviceSummary{{
+		Target:      "orders.default.svc",
+		Depth:       2,
+		InFlight:    1,
+		OldestAge:   240,
+		Throughput:  &two,
+		FailureRate: &quarter,
+	}, {
+		Target:    "users.default.svc",
+		Depth:     1,
+		OldestAge: 120,
+	}, {
+		Target:     "idle.default.svc",
+		Throughput: &zero,
+	}}
+	if diff := cmp.Diff(want, got.Services); diff != "" {
+		t.Error("services (-want, +got):", diff)
+	}
+	if got.Total == nil || *got.Total != 3 {
+		t.Errorf("total = %v, want 3", got.Total)
+	}
+	if len(got.DeadLetters) != 1 || got.DeadLetters[0].Target != "failing.default.svc" || got.DeadLetters[0].StatusCode != 500 {
+		t.Errorf("dead letters = %+v, want the request to failing.default.svc", got.DeadLetters)
+	}
+}
+
+func TestSummarizeMetricsError(t *testing.T) {
+	d := newTestDashboard(t)
+	prom := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"status": "error", "error": "parse error"}`)
+	}))
+	defer prom.Close()
+	d.metrics = &prometheus{url: prom.URL, client: prom.Client(), window: 5 * time.Minute}
+
+	got := d.summarize(context.Background())
+	if len(got.Errors) != 1 || !strings.Contains(got.Errors[0], "parse error") {
+		t.Errorf("summarize() errors = %v, want the error of Prometheus", got.Errors)
+	}
+	// The backlog is shown without the rates.
+	if len(got.Services) != 2 || got.Services[0].Throughput != nil {
+		t.Errorf("services = %+v, want orders and users without rates", got.Services)
+	}
+}
+
+func TestServePage(t *testing.T) {
+	d := newTestDashboard(t)
+
+	w := httptest.NewRecorder()
+	d.servePage(w, httptest.NewRequest(http.MethodGet, pagePath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	for _, want := range []string{
+		`<meta http-equiv="refresh" content="60">`,
+		"3 requests queued or being delivered.",
+		"<td>orders.default.svc</td><td class=\"number\">2</td>",
+		"<td class=\"number\">4m0s</td>",
+		"<td>url returned 500</td>",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("page does not contain %q:\n%s", want, w.Body)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	d.servePage(w, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
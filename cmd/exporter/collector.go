@@ -0,0 +1,160 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/depth"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/pkg/logging"
+)
+
+var (
+	streamDepth      = stats.Int64("stream_queue_depth", "Number of requests of a stream waiting or being delivered", stats.UnitDimensionless)
+	streamOldestAge  = stats.Float64("stream_oldest_request_age_seconds", "Time since the oldest request of a stream not delivered yet was enqueued", stats.UnitSeconds)
+	serviceDepth     = stats.Int64("service_queue_depth", "Number of requests for a service waiting or being delivered", stats.UnitDimensionless)
+	serviceInFlight  = stats.Int64("service_in_flight_requests", "Number of requests for a service being delivered", stats.UnitDimensionless)
+	serviceOldestAge = stats.Float64("service_oldest_request_age_seconds", "Time since the oldest request for a service not delivered yet was enqueued", stats.UnitSeconds)
+
+	streamKey = tag.MustNewKey("stream")
+	targetKey = tag.MustNewKey("target")
+)
+
+// metricViews are the views of the exporter metrics.
+var metricViews = []*view.View{{
+	Description: streamDepth.Description(),
+	Measure:     streamDepth,
+	Aggregation: view.LastValue(),
+	TagKeys:     []tag.Key{streamKey},
+}, {
+	Description: streamOldestAge.Description(),
+	Measure:     streamOldestAge,
+	Aggregation: view.LastValue(),
+	TagKeys:     []tag.Key{streamKey},
+}, {
+	Description: serviceDepth.Description(),
+	Measure:     serviceDepth,
+	Aggregation: view.LastValue(),
+	TagKeys:     []tag.Key{targetKey},
+}, {
+	Description: serviceInFlight.Description(),
+	Measure:     serviceInFlight,
+	Aggregation: view.LastValue(),
+	TagKeys:     []tag.Key{targetKey},
+}, {
+	Description: serviceOldestAge.Description(),
+	Measure:     serviceOldestAge,
+	Aggregation: view.LastValue(),
+	TagKeys:     []tag.Key{targetKey},
+}}
+
+// collector records the backlog of a queue.
+type collector struct {
+	queue queue.Queue
+	// scanLimit is the most requests listed to count them by service, zero
+	// when they are not counted.
+	scanLimit int
+	// noBacklog is set once the backend told it does not report its
+	// backlog.
+	noBacklog bool
+	// targets are the services recorded by the last poll, whose metrics are
+	// reset once they have no requests left.
+	targets map[string]bool
+	now     func() time.Time
+}
+
+func newCollector(q queue.Queue, scanLimit int) *collector {
+	return &collector{queue: q, scanLimit: scanLimit, now: time.Now}
+}
+
+// run records the backlog every interval until ctx is done.
+func (c *collector) run(ctx context.Context, interval time.Duration) {
+	logger := logging.FromContext(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := c.collect(ctx); err != nil {
+			logger.Errorw("Error polling the backlog of the queue", zap.Error(err))
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// collect records the backlog of each stream of the queue, and of each
+// service among the first scanLimit requests.
+func (c *collector) collect(ctx context.Context) error {
+	logger := logging.FromContext(ctx)
+	now := c.now()
+	if !c.noBacklog {
+		backlogs, err := queue.ReadStreamBacklogs(ctx, c.queue)
+		if errors.Is(err, queue.ErrBacklogNotSupported) {
+			logger.Info("The queue backend does not report its backlog, stream_queue_depth is not exported")
+			c.noBacklog = true
+		} else if err != nil {
+			return fmt.Errorf("failed to read the backlog: %w", err)
+		}
+		for stream, b := range backlogs {
+			stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(streamKey, stream)},
+				streamDepth.M(b.Depth), streamOldestAge.M(age(now, b.Oldest)))
+		}
+	}
+	if c.scanLimit <= 0 {
+		return nil
+	}
+	msgs, err := queue.ListPending(ctx, c.queue, c.scanLimit)
+	if errors.Is(err, queue.ErrListNotSupported) {
+		logger.Info("The queue backend cannot list its requests, service_queue_depth is not exported")
+		c.scanLimit = 0
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to list the requests: %w", err)
+	}
+	if len(msgs) == c.scanLimit {
+		logger.Debugw("Only the first requests of the queue are counted by service", zap.Int("limit", c.scanLimit))
+	}
+	targets := make(map[string]bool)
+	for _, s := range depth.ByService(msgs) {
+		targets[s.Target] = true
+		stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(targetKey, s.Target)},
+			serviceDepth.M(int64(s.Depth)), serviceInFlight.M(int64(s.InFlight)), serviceOldestAge.M(age(now, s.Oldest)))
+	}
+	for target := range c.targets {
+		if !targets[target] {
+			stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(targetKey, target)},
+				serviceDepth.M(0), serviceInFlight.M(0), serviceOldestAge.M(0))
+		}
+	}
+	c.targets = targets
+	return nil
+}
+
+// age returns the seconds from t to now, zero if t is unknown.
+func age(now, t time.Time) float64 {
+	if t.IsZero() || t.After(now) {
+		return 0
+	}
+	return now.Sub(t).Seconds()
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+)
+
+// rowValue returns the last value of the row of view name whose tags include
+// tags.
+func rowValue(t *testing.T, name string, tags ...tag.Tag) float64 {
+	t.Helper()
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatalf("RetrieveData(%q) = %v", name, err)
+	}
+	var v float64
+rows:
+	for _, row := range rows {
+		for _, want := range tags {
+			found := false
+			for _, got := range row.Tags {
+				found = found || got == want
+			}
+			if !found {
+				continue rows
+			}
+		}
+		if d, ok := row.Data.(*view.LastValueData); ok {
+			v = d.Value
+		}
+	}
+	return v
+}
+
+func TestCollect(t *testing.T) {
+	if err := view.Register(metricViews...); err != nil {
+		t.Fatal("Register() =", err)
+	}
+	defer view.Unregister(metricViews...)
+
+	ctx := context.Background()
+	q := queue.NewMemory(queue.MemoryConfig{MemoryQueueName: fmt.Sprint(t.Name(), time.Now().UnixNano()), MemoryReadTimeout: time.Second})
+	now := time.Now().Add(time.Hour)
+	for i, target := range []string{"orders.default.svc", "orders.default.svc", "users.default.svc"} {
+		enqueued := now.Add(time.Duration(i-3) * time.Minute)
+		b, err := request.Marshal(request.Data{ReqURL: "http://" + target + "/", EnqueuedAt: &enqueued}, request.FormatJSON, enqueued)
+		if err != nil {
+			t.Fatal("Marshal() =", err)
+		}
+		if err := q.Enqueue(ctx, fmt.Sprint(i), b); err != nil {
+			t.Fatal("Enqueue() =", err)
+		}
+	}
+	if msgs, err := q.Dequeue(ctx); err != nil || len(msgs) != 1 {
+		t.Fatalf("Dequeue() = %v, %v, want 1 message", msgs, err)
+	}
+	c := newCollector(q, 10)
+	c.now = func() time.Time { return now }
+
+	if err := c.collect(ctx); err != nil {
+		t.Fatal("collect() =", err)
+	}
+	// The memory queue has a single stream, exported without a stream tag.
+	if got := rowValue(t, "stream_queue_depth"); got != 3 {
+		t.Errorf("stream_queue_depth = %v, want 3", got)
+	}
+	// The memory queue tracks the time of Enqueue, an hour before now.
+	if got := rowValue(t, "stream_oldest_request_age_seconds"); got < 3500 {
+		t.Errorf("stream_oldest_request_age_seconds = %v, want about 3600", got)
+	}
+	orders := tag.Tag{Key: targetKey, Value: "orders.default.svc"}
+	users := tag.Tag{Key: targetKey, Value: "users.default.svc"}
+	for _, tc := range []struct {
+		name string
+		tag  tag.Tag
+		want float64
+	}{
+		{"service_queue_depth", orders, 2},
+		{"service_in_flight_requests", orders, 1},
+		{"service_oldest_request_age_seconds", orders, 180},
+		{"service_queue_depth", users, 1},
+		{"service_in_flight_requests", users, 0},
+		{"service_oldest_request_age_seconds", users, 60},
+	} {
+		if got := rowValue(t, tc.name, tc.tag); got != tc.want {
+			t.Errorf("%s{%s} = %v, want %v", tc.name, tc.tag.Value, got, tc.want)
+		}
+	}
+
+	// The metrics of a service are reset once it has no requests.
+	if _, err := queue.Purge(ctx, q, func(data []byte) bool {
+		return strings.Contains(string(data), "users.default.svc")
+	}); err != nil {
+		t.Fatal("Purge() =", err)
+	}
+	if err := c.collect(ctx); err != nil {
+		t.Fatal("collect() =", err)
+	}
+	if got := rowValue(t, "service_queue_depth", users); got != 0 {
+		t.Errorf("service_queue_depth{users.default.svc} = %v, want 0", got)
+	}
+	if got := rowValue(t, "service_oldest_request_age_seconds", users); got != 0 {
+		t.Errorf("service_oldest_request_age_seconds{users.default.svc} = %v, want 0", got)
+	}
+	if got := rowValue(t, "service_queue_depth", orders); got != 2 {
+		t.Errorf("service_queue_depth{orders.default.svc} = %v, want 2", got)
+	}
+	if c.targets["users.default.svc"] {
+		t.Error("users.default.svc is still tracked after its metrics were reset")
+	}
+}
+
+func TestAge(t *testing.T) {
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name string
+		t    time.Time
+		want float64
+	}{
+		{"past", now.Add(-time.Minute), 60},
+		{"unknown", time.Time{}, 0},
+		{"future", now.Add(time.Minute), 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := age(now, tc.t); got != tc.want {
+				t.Errorf("age() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The exporter command polls the backlog of the queue and serves it as
+// Prometheus metrics, by stream and by service, so it is monitored even when
+// the consumer is scaled to zero.
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"contrib.go.opencensus.io/exporter/prometheus"
+	"github.com/kelseyhightower/envconfig"
+	"go.opencensus.io/stats/view"
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/health"
+	"knative.dev/async-component/pkg/observability"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/signals"
+)
+
+const (
+	// Name of the exporter in logs.
+	serviceName = "async-exporter"
+	// Path of the metrics, served with the probes on EXPORTER_PORT.
+	metricsPath = "/metrics"
+	// Prefix of the names of the metrics.
+	metricsNamespace = "async"
+)
+
+type envInfo struct {
+	queue.Config
+	// ExporterPort is the port serving the metrics and the probes.
+	ExporterPort string `envconfig:"EXPORTER_PORT" default:"9090"`
+	// ExporterInterval is how often the backlog is polled.
+	ExporterInterval time.Duration `envconfig:"EXPORTER_INTERVAL" default:"15s"`
+	// ExporterScanLimit is the most requests listed to count them by
+	// service, zero to only export the backlog of the streams.
+	ExporterScanLimit int `envconfig:"EXPORTER_SCAN_LIMIT" default:"10000"`
+}
+
+func main() {
+	logger, _ := observability.NewLogger(serviceName, "")
+	defer logger.Sync()
+
+	var env envInfo
+	if err := envconfig.Process("", &env); err != nil {
+		logger.Fatalw("Failed to process the environment", zap.Error(err))
+	}
+	if env.ExporterInterval <= 0 {
+		logger.Fatal("EXPORTER_INTERVAL must be positive")
+	}
+	ctx := logging.WithLogger(signals.NewContext(), logger)
+
+	q, err := queue.New(ctx, env.Config)
+	if err != nil {
+		logger.Fatalw("Failed to create queue client", zap.Error(err))
+	}
+	defer q.Close()
+
+	if err := view.Register(metricViews...); err != nil {
+		logger.Fatalw("Failed to register metrics", zap.Error(err))
+	}
+	exporter, err := prometheus.NewExporter(prometheus.Options{Namespace: metricsNamespace})
+	if err != nil {
+		logger.Fatalw("Failed to create metrics exporter", zap.Error(err))
+	}
+	mux := http.NewServeMux()
+	mux.Handle(health.LivenessPath, health.Liveness())
+	mux.Handle(health.ReadinessPath, health.Readiness(func(ctx context.Context) error {
+		return queue.CheckHealth(ctx, q, false)
+	}))
+	mux.Handle(metricsPath, exporter)
+	server := &http.Server{
+		Addr:        ":" + env.ExporterPort,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go newCollector(q, env.ExporterScanLimit).run(ctx, env.ExporterInterval)
+
+	logger.Infow("Serving the metrics of the queue", zap.String("port", env.ExporterPort))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Fatalw("Failed to serve the metrics", zap.Error(err))
+	}
+}
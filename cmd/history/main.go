@@ -0,0 +1,109 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The history exporter ships the records of completed requests, which the
+// consumer adds to HISTORY_STREAM, to an external sink for long-term
+// analysis. It reads the stream with a consumer group, so it can be scaled
+// out and restarted without losing records.
+package main
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/blob"
+	"knative.dev/async-component/pkg/health"
+	"knative.dev/async-component/pkg/history"
+	"knative.dev/async-component/pkg/observability"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/signals"
+)
+
+// Name of the history exporter in logs.
+const serviceName = "async-history"
+
+type envInfo struct {
+	queue.RedisConfig
+	history.HistoryConfig
+	history.SinkConfig
+	blob.StorageConfig
+	// HistoryGroup is the consumer group reading the stream.
+	HistoryGroup string `envconfig:"HISTORY_GROUP" default:"async-history"`
+	// HistoryBatchSize is the most records shipped at once, and
+	// HistoryBatchWait how long to wait for records when there are none.
+	HistoryBatchSize int64         `envconfig:"HISTORY_BATCH_SIZE" default:"500"`
+	HistoryBatchWait time.Duration `envconfig:"HISTORY_BATCH_WAIT" default:"5s"`
+	// HistoryRetryInterval is how long to wait before shipping a failed
+	// batch again.
+	HistoryRetryInterval time.Duration `envconfig:"HISTORY_RETRY_INTERVAL" default:"10s"`
+	// HealthPort is the port serving the liveness probe.
+	HealthPort string `envconfig:"HEALTH_PORT" default:"8080"`
+}
+
+func main() {
+	logger, _ := observability.NewLogger(serviceName, "")
+	defer logger.Sync()
+
+	var env envInfo
+	if err := envconfig.Process("", &env); err != nil {
+		logger.Fatalw("Failed to process the environment", zap.Error(err))
+	}
+	if env.HistoryStream == "" {
+		logger.Fatal("HISTORY_STREAM must be set")
+	}
+	if env.HistoryBatchSize <= 0 {
+		logger.Fatal("HISTORY_BATCH_SIZE must be positive")
+	}
+	ctx := logging.WithLogger(signals.NewContext(), logger)
+
+	stream, err := history.New(env.HistoryConfig, env.RedisConfig)
+	if err != nil {
+		logger.Fatalw("Failed to create history stream", zap.Error(err))
+	}
+	defer stream.Close()
+	if err := stream.CreateGroup(ctx, env.HistoryGroup); err != nil {
+		logger.Fatalw("Failed to create consumer group", zap.Error(err))
+	}
+	sink, err := history.NewSink(env.SinkConfig, env.StorageConfig, env.RedisConfig)
+	if err != nil {
+		logger.Fatalw("Failed to create history sink", zap.Error(err))
+	}
+	defer sink.Close()
+
+	consumer := env.ConsumerName
+	if consumer == "" {
+		consumer, _ = os.Hostname()
+	}
+	go func() {
+		mux := http.NewServeMux()
+		mux.Handle(health.LivenessPath, health.Liveness())
+		logger.Fatalw("Failed to serve probes", zap.Error(http.ListenAndServe(":"+env.HealthPort, mux)))
+	}()
+
+	logger.Infow("Shipping request history", zap.String("stream", env.HistoryStream), zap.String("sink", env.HistorySink))
+	s := &shipper{
+		source:        stream,
+		sink:          sink,
+		group:         env.HistoryGroup,
+		consumer:      consumer,
+		batchSize:     env.HistoryBatchSize,
+		block:         env.HistoryBatchWait,
+		retryInterval: env.HistoryRetryInterval,
+	}
+	s.run(ctx)
+	logger.Info("History exporter stopped")
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/history"
+	"knative.dev/pkg/logging"
+)
+
+// source is the stream the records are read from.
+type source interface {
+	Read(ctx context.Context, group, consumer string, pending bool, count int64, block time.Duration) ([]history.Entry, error)
+	Ack(ctx context.Context, group string, ids ...string) error
+}
+
+// shipper moves the records of a stream to a sink in batches. Records are
+// acknowledged once shipped, so those of a failed batch are read and shipped
+// again, after retryInterval.
+type shipper struct {
+	source        source
+	sink          history.Sink
+	group         string
+	consumer      string
+	batchSize     int64
+	block         time.Duration
+	retryInterval time.Duration
+}
+
+// run ships the records until ctx is done. The records read but not shipped
+// before a restart are shipped first.
+func (s *shipper) run(ctx context.Context) {
+	logger := logging.FromContext(ctx)
+	pending := true
+	for ctx.Err() == nil {
+		entries, err := s.source.Read(ctx, s.group, s.consumer, pending, s.batchSize, s.block)
+		if err == nil && len(entries) == 0 {
+			pending = false
+			continue
+		}
+		if err == nil {
+			err = s.ship(ctx, entries)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Errorw("Error shipping request history", zap.Error(err))
+			pending = true
+			select {
+			case <-ctx.Done():
+			case <-time.After(s.retryInterval):
+			}
+		}
+	}
+}
+
+// ship writes the records of entries to the sink, and acknowledges them.
+// Entries that could not be read are dropped.
+func (s *shipper) ship(ctx context.Context, entries []history.Entry) error {
+	records := make([]history.Record, 0, len(entries))
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+		if e.Record == nil {
+			logging.FromContext(ctx).Errorw("Dropping unreadable history record", zap.String("entry", e.ID))
+			continue
+		}
+		records = append(records, *e.Record)
+	}
+	if len(records) > 0 {
+		if err := s.sink.Ship(ctx, records); err != nil {
+			return err
+		}
+	}
+	return s.source.Ack(ctx, s.group, ids...)
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"knative.dev/async-component/pkg/history"
+	"knative.dev/async-component/pkg/status"
+)
+
+// fakeSource is a stream of entries read by a single consumer.
+type fakeSource struct {
+	entries   []history.Entry
+	delivered int
+	acked     []string
+	readErr   error
+}
+
+func (f *fakeSource) Read(ctx context.Context, group, consumer string, pending bool, count int64, block time.Duration) ([]history.Entry, error) {
+	if f.readErr != nil {
+		err := f.readErr
+		f.readErr = nil
+		return nil, err
+	}
+	var entries []history.Entry
+	if pending {
+		for _, e := range f.entries[:f.delivered] {
+			if !f.isAcked(e.ID) && int64(len(entries)) < count {
+				entries = append(entries, e)
+			}
+		}
+		return entries, nil
+	}
+	for f.delivered < len(f.entries) && int64(len(entries)) < count {
+		entries = append(entries, f.entries[f.delivered])
+		f.delivered++
+	}
+	return entries, nil
+}
+
+func (f *fakeSource) isAcked(id string) bool {
+	for _, a := range f.acked {
+		if a == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeSource) Ack(ctx context.Context, group string, ids ...string) error {
+	f.acked = append(f.acked, ids...)
+	return nil
+}
+
+// fakeSink records the batches shipped, failing the first failures times.
+type fakeSink struct {
+	batches  [][]string
+	failures int
+	// done is called once all the records are shipped.
+	want int
+	done func()
+}
+
+func (f *fakeSink) Ship(ctx context.Context, records []history.Record) error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("unavailable")
+	}
+	var ids []string
+	for _, r := range records {
+		ids = append(ids, r.ID)
+	}
+	f.batches = append(f.batches, ids)
+	if f.want -= len(ids); f.want == 0 {
+		f.done()
+	}
+	return nil
+}
+
+func (f *fakeSink) Close() error { return nil }
+
+func TestShipper(t *testing.T) {
+	entry := func(id string) history.Entry {
+		return history.Entry{ID: id + "-0", Record: &history.Record{ID: id, State: status.Succeeded}}
+	}
+	tests := []struct {
+		name     string
+		entries  []history.Entry
+		readErr  error
+		failures int
+		want     [][]string
+	}{{
+		name:    "batches",
+		entries: []history.Entry{entry("1"), entry("2"), entry("3")},
+		want:    [][]string{{"1", "2"}, {"3"}},
+	}, {
+		name:     "failed batch shipped again",
+		entries:  []history.Entry{entry("1"), entry("2"), entry("3")},
+		failures: 1,
+		want:     [][]string{{"1", "2"}, {"3"}},
+	}, {
+		name:    "failed read",
+		entries: []history.Entry{entry("1")},
+		readErr: errors.New("connection refused"),
+		want:    [][]string{{"1"}},
+	}, {
+		name:    "unreadable entry dropped",
+		entries: []history.Entry{entry("1"), {ID: "2-0"}, entry("3")},
+		want:    [][]string{{"1"}, {"3"}},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			source := &fakeSource{entries: test.entries, readErr: test.readErr}
+			want := 0
+			for _, b := range test.want {
+				want += len(b)
+			}
+			sink := &fakeSink{failures: test.failures, want: want, done: cancel}
+			s := &shipper{source: source, sink: sink, group: "async-history", consumer: "exporter", batchSize: 2, retryInterval: time.Millisecond}
+			s.run(ctx)
+
+			if diff := cmp.Diff(test.want, sink.batches); diff != "" {
+				t.Error("batches (-want, +got):", diff)
+			}
+			if len(source.acked) != len(test.entries) {
+				t.Errorf("acknowledged %v, want all %d entries", source.acked, len(test.entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// deadLetter is a dead-lettered request listed by the admin service.
+type deadLetter struct {
+	ID             string     `json:"id"`
+	Target         string     `json:"target"`
+	Method         string     `json:"method"`
+	URL            string     `json:"url"`
+	Reason         string     `json:"reason"`
+	StatusCode     int        `json:"statusCode"`
+	Attempts       int        `json:"attempts"`
+	EnqueuedAt     *time.Time `json:"enqueuedAt"`
+	DeadLetteredAt *time.Time `json:"deadLetteredAt"`
+}
+
+type deadLettersResponse struct {
+	DeadLetters []deadLetter `json:"deadLetters"`
+}
+
+// replayRequest selects the dead-lettered requests replayed.
+type replayRequest struct {
+	IDs    []string `json:"ids,omitempty"`
+	Target string   `json:"target,omitempty"`
+}
+
+type replayResponse struct {
+	Replayed int `json:"replayed"`
+}
+
+// stringsFlag is a repeated flag of strings.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// deadLetters lists the oldest dead-lettered requests.
+func (c *cli) deadLetters(args []string) error {
+	fs := c.flagSet("dead-letters", "[flags]")
+	limit := fs.Int("limit", 100, "most requests listed, up to 1000")
+	f := c.adminFlags(fs)
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	if err := f.check(); err != nil {
+		return err
+	}
+	var resp deadLettersResponse
+	if err := c.callAdminList(f, "/dead-letters?limit="+strconv.Itoa(*limit), &resp); err != nil {
+		return err
+	}
+	if f.output == "json" {
+		return nil
+	}
+	if len(resp.DeadLetters) == 0 {
+		fmt.Fprintln(c.out, "No dead-lettered requests.")
+		return nil
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSERVICE\tREASON\tATTEMPTS\tDEAD-LETTERED")
+	for _, d := range resp.DeadLetters {
+		age := "-"
+		if d.DeadLetteredAt != nil {
+			age = c.since(*d.DeadLetteredAt).String() + " ago"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", d.ID, d.Target, d.Reason, d.Attempts, age)
+	}
+	return w.Flush()
+}
+
+// replay moves dead-lettered requests back to the queue.
+func (c *cli) replay(args []string) error {
+	fs := c.flagSet("replay", "[flags]")
+	var ids stringsFlag
+	fs.Var(&ids, "id", "ID of a request to replay, repeated for several requests")
+	all := fs.Bool("all", false, "replay the oldest dead-lettered requests rather than selected ones")
+	target := fs.String("target", "", "URL whose scheme and host replace those of the requests, such as to send them to another service")
+	max := fs.Int("max", 100, "most requests replayed")
+	f := c.adminFlags(fs)
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	if len(ids) == 0 && !*all {
+		return fmt.Errorf("select the requests to replay with --id, or replay them all with --all")
+	} else if len(ids) > 0 && *all {
+		return fmt.Errorf("--id and --all cannot be combined")
+	}
+	if err := f.check(); err != nil {
+		return err
+	}
+	var resp replayResponse
+	found, err := c.callAdmin(f, http.MethodPost, "/dead-letters/replay?max="+strconv.Itoa(*max), replayRequest{IDs: ids, Target: *target}, &resp)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("the admin service does not serve /dead-letters/replay, it may need to be updated")
+	}
+	if f.output == "json" {
+		return nil
+	}
+	fmt.Fprintf(c.out, "Replayed %d dead-lettered requests.\n", resp.Replayed)
+	if len(ids) > resp.Replayed && resp.Replayed < *max {
+		fmt.Fprintf(c.out, "%d of the requests were not found among the dead-lettered ones.\n", len(ids)-resp.Replayed)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The kn-async command is a kn plugin, run as "kn async", to submit
+// asynchronous requests and follow them, and to inspect and replay the
+// requests of the queue through the admin service.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// Environment variables holding the defaults of the admin flags.
+	adminURLEnv   = "ASYNC_ADMIN_URL"
+	adminTokenEnv = "ASYNC_ADMIN_TOKEN"
+	// Timeout of the calls to the services and the admin service.
+	requestTimeout = 30 * time.Second
+)
+
+const usage = `Submit asynchronous requests and manage the queue of the async component.
+
+Usage:
+  kn async <command> [flags]
+
+Commands:
+  submit        Submit an asynchronous request to a service
+  status        Show the status of a request
+  pending       List the requests of the queue that are not delivered yet
+  search        Find requests by service, caller, state and submission time
+  depth         Show the number of queued requests by service
+  dead-letters  List the dead-lettered requests
+  replay        Replay dead-lettered requests
+  purge         Delete the queued requests of a service or a namespace
+  pause         Pause the deliveries to a service, queueing its requests
+  resume        Resume the deliveries to a paused service
+  pauses        List the paused services
+
+The commands but submit, and status with --url, call the admin service at
+the URL of --admin-url or ` + adminURLEnv + `, with the token of --token or
+` + adminTokenEnv + `. Run "kn async <command> -h" for the flags of a command.
+`
+
+// errUsage is returned for invalid command lines, once their usage is
+// printed.
+var errUsage = errors.New("invalid usage")
+
+// cli runs the commands, writing their output to out.
+type cli struct {
+	out    io.Writer
+	errOut io.Writer
+	client *http.Client
+	// getenv reads the defaults of the flags from the environment.
+	getenv func(string) string
+	// now returns the current time, to show the age of requests.
+	now func() time.Time
+}
+
+// command runs a command with its arguments.
+type command func(c *cli, args []string) error
+
+var commands = map[string]command{
+	"submit":       (*cli).submit,
+	"status":       (*cli).status,
+	"pending":      (*cli).pending,
+	"search":       (*cli).search,
+	"depth":        (*cli).depth,
+	"dead-letters": (*cli).deadLetters,
+	"replay":       (*cli).replay,
+	"purge":        (*cli).purge,
+	"pause":        (*cli).pause,
+	"resume":       (*cli).resume,
+	"pauses":       (*cli).pauses,
+}
+
+func main() {
+	c := &cli{
+		out:    os.Stdout,
+		errOut: os.Stderr,
+		client: &http.Client{Timeout: requestTimeout},
+		getenv: os.Getenv,
+		now:    time.Now,
+	}
+	if err := c.run(os.Args[1:]); err != nil && err != flag.ErrHelp {
+		if err != errUsage {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// run runs the command named by the first argument.
+func (c *cli) run(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(c.errOut, usage)
+		return errUsage
+	}
+	if args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		fmt.Fprint(c.out, usage)
+		return nil
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(c.errOut, "Unknown command %q.\n\n%s", args[0], usage)
+		return errUsage
+	}
+	return cmd(c, args[1:])
+}
+
+// flagSet returns the flags of command name, whose arguments are described
+// by args.
+func (c *cli) flagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.errOut)
+	fs.Usage = func() {
+		fmt.Fprintf(c.errOut, "Usage:\n  kn async %s %s\n\nFlags:\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses the flags of fs in args, and checks that nargs arguments are
+// left. It returns flag.ErrHelp when the usage was asked for.
+func parse(fs *flag.FlagSet, args []string, nargs int) error {
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return err
+	} else if err != nil {
+		return errUsage
+	}
+	if fs.NArg() != nargs {
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// adminFlags are the flags of the commands calling the admin service.
+type adminFlags struct {
+	url    string
+	token  string
+	output string
+}
+
+// adminFlags adds the flags of the admin service to fs.
+func (c *cli) adminFlags(fs *flag.FlagSet) *adminFlags {
+	f := &adminFlags{}
+	fs.StringVar(&f.url, "admin-url", c.getenv(adminURLEnv), "URL of the admin service, such as http://localhost:8080 through a port-forward to async-admin")
+	fs.StringVar(&f.token, "token", c.getenv(adminTokenEnv), "bearer token of the admin service")
+	fs.StringVar(&f.output, "output", "table", "output format, table or json")
+	return f
+}
+
+// check returns an error unless the admin service and the output are set.
+func (f *adminFlags) check() error {
+	if f.url == "" {
+		return fmt.Errorf("the URL of the admin service must be set with --admin-url or %s", adminURLEnv)
+	}
+	if f.token == "" {
+		return fmt.Errorf("the token of the admin service must be set with --token or %s", adminTokenEnv)
+	}
+	if f.output != "table" && f.output != "json" {
+		return fmt.Errorf("output %q is not table or json", f.output)
+	}
+	return nil
+}
+
+// callAdmin sends a request to path of the admin service, with the JSON of
+// body if not nil, and decodes the JSON response into v. With the json
+// output, the response is written as it is instead.
+func (c *cli) callAdmin(f *adminFlags, method, path string, body, v interface{}) (bool, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return false, fmt.Errorf("failed to encode the request: %w", err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(f.url, "/")+path, r)
+	if err != nil {
+		return false, fmt.Errorf("failed to create the request to the admin service: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+f.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.do(req, f.output == "json", v)
+}
+
+// do sends req and decodes its JSON response into v, or writes it to out
+// when raw is set. It returns false when the response is 404 Not Found.
+func (c *cli) do(req *http.Request, raw bool, v interface{}) (bool, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to call %s: %w", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("failed to read the response of %s: %w", req.URL.Host, err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	} else if resp.StatusCode/100 != 2 {
+		return false, fmt.Errorf("%s answered %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(b)))
+	}
+	if raw {
+		_, err := c.out.Write(b)
+		return true, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, fmt.Errorf("failed to decode the response of %s: %w", req.URL.Host, err)
+	}
+	return true, nil
+}
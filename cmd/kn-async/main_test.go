@@ -0,0 +1,297 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordedRequest is a request received by the fake services.
+type recordedRequest struct {
+	method, path, body string
+	header             http.Header
+}
+
+// fakeServer answers the requests to the paths of responses with their
+// status and body, and 404 to the others.
+func fakeServer(responses map[string]fakeResponse, got *[]recordedRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		*got = append(*got, recordedRequest{method: r.Method, path: r.URL.RequestURI(), body: string(b), header: r.Header})
+		resp, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		for name, v := range resp.header {
+			w.Header().Set(name, v)
+		}
+		w.WriteHeader(resp.code)
+		w.Write([]byte(resp.body))
+	}))
+}
+
+type fakeResponse struct {
+	code   int
+	header map[string]string
+	body   string
+}
+
+func TestCommands(t *testing.T) {
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	responses := map[string]fakeResponse{
+		"/orders": {
+			code:   http.StatusAccepted,
+			header: map[string]string{"Location": "/async/status/abc"},
+			body:   `{"id":"abc","status":"accepted"}`,
+		},
+		"/sync": {
+			code: http.StatusOK,
+			body: "done",
+		},
+		"/async/status/abc": {
+			code: http.StatusOK,
+			body: `{"id":"abc","state":"delivered","status":200,"updated":"2021-03-01T09:59:00Z","attempts":1}`,
+		},
+		"/requests/abc": {
+			code: http.StatusOK,
+			body: `{"id":"abc","state":"failed","status":500,"updated":"2021-03-01T09:58:00Z","attempts":3}`,
+		},
+		"/requests": {
+			code: http.StatusOK,
+			body: `{"requests":[{"id":"abc","target":"orders.default.svc","state":"in-flight","age":120,"attempts":2},{"id":"def","state":"pending","attempts":0}]}`,
+		},
+		"/search": {
+			code: http.StatusOK,
+			body: `{"requests":[{"id":"abc","target":"orders.default.svc","subject":"alice","submitted":"2021-03-01T09:55:00Z","status":{"id":"abc","state":"pending","updated":"2021-03-01T09:55:00Z"}}]}`,
+		},
+		"/depth": {
+			code: http.StatusOK,
+			body: `{"total":3,"services":[{"target":"orders.default.svc","depth":2,"inFlight":1,"oldestAge":90},{"target":"","depth":1,"inFlight":0}]}`,
+		},
+		"/dead-letters": {
+			code: http.StatusOK,
+			body: `{"deadLetters":[{"id":"abc","target":"orders.default.svc","reason":"url returned 500","statusCode":500,"attempts":3,"deadLetteredAt":"2021-03-01T09:00:00Z"}]}`,
+		},
+		"/dead-letters/replay": {
+			code: http.StatusOK,
+			body: `{"replayed":1}`,
+		},
+		"/pause": {
+			code: http.StatusOK,
+			body: `{"namespace":"default","service":"orders","paused":true,"since":"2021-03-01T10:00:00Z"}`,
+		},
+		"/resume": {
+			code: http.StatusOK,
+			body: `{"namespace":"default","service":"orders","since":"2021-03-01T10:00:00Z","drainRate":5,"drainUntil":"2021-03-01T10:10:00Z"}`,
+		},
+		"/pauses": {
+			code: http.StatusOK,
+			body: `{"services":[{"namespace":"default","service":"orders","paused":true,"since":"2021-03-01T09:30:00Z"}]}`,
+		},
+		"/purge": {
+			code: http.StatusOK,
+			body: `{"matched":2,"confirmation":"1614593100.abc","expiresAt":"2021-03-01T10:05:00Z","purged":0}`,
+		},
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		// wantOut, and the URLs of args, replace {{url}} with the URL of
+		// the fake services.
+		wantErr  string
+		wantOut  string
+		wantReq  recordedRequest
+		wantHdrs map[string]string
+	}{{
+		name:    "submit",
+		args:    []string{"submit", "-d", `{"item":1}`, "-H", "Authorization: Bearer xyz", "--delay", "5m", "--deadline", "2021-07-01T12:00:00Z", "{{url}}/orders"},
+		wantOut: "Request abc accepted.\nFollow it with: kn async status --url {{url}} abc\n",
+		wantReq: recordedRequest{method: http.MethodPost, path: "/orders", body: `{"item":1}`},
+		wantHdrs: map[string]string{
+			"Prefer":         "respond-async",
+			"Authorization":  "Bearer xyz",
+			"Async-Delay":    "5m",
+			"Async-Deadline": "2021-07-01T12:00:00Z",
+		},
+	}, {
+		name:    "submit json",
+		args:    []string{"submit", "--output", "json", "{{url}}/orders"},
+		wantOut: `{"id":"abc","status":"accepted"}`,
+		wantReq: recordedRequest{method: http.MethodGet, path: "/orders"},
+	}, {
+		name:    "submit not queued",
+		args:    []string{"submit", "{{url}}/sync"},
+		wantErr: "the request was not queued",
+		wantReq: recordedRequest{method: http.MethodGet, path: "/sync"},
+	}, {
+		name:    "submit invalid URL",
+		args:    []string{"submit", "orders"},
+		wantErr: `"orders" is not the http or https URL of a service`,
+	}, {
+		name:    "status from the service",
+		args:    []string{"status", "--url", "{{url}}", "abc"},
+		wantOut: "ID:           abc\nState:        delivered\nStatus code:  200\nAttempts:     1\nUpdated:      2021-03-01T09:59:00Z (1m0s ago)\n",
+		wantReq: recordedRequest{method: http.MethodGet, path: "/async/status/abc"},
+	}, {
+		name:     "status from the admin service",
+		args:     []string{"status", "--admin-url", "{{url}}", "abc"},
+		wantOut:  "ID:           abc\nState:        failed\nStatus code:  500\nAttempts:     3\nUpdated:      2021-03-01T09:58:00Z (2m0s ago)\n",
+		wantReq:  recordedRequest{method: http.MethodGet, path: "/requests/abc"},
+		wantHdrs: map[string]string{"Authorization": "Bearer secret"},
+	}, {
+		name:    "status unknown",
+		args:    []string{"status", "--admin-url", "{{url}}", "unknown"},
+		wantErr: "request unknown is not known",
+		wantReq: recordedRequest{method: http.MethodGet, path: "/requests/unknown"},
+	}, {
+		name:    "pending",
+		args:    []string{"pending", "--admin-url", "{{url}}", "--limit", "2"},
+		wantOut: "ID   SERVICE             STATE      AGE   ATTEMPTS\nabc  orders.default.svc  in-flight  2m0s  2\ndef                      pending    -     0\n",
+		wantReq: recordedRequest{method: http.MethodGet, path: "/requests?limit=2"},
+	}, {
+		name:    "search",
+		args:    []string{"search", "--admin-url", "{{url}}", "--target", "orders.default.svc", "--state", "pending", "--since", "1h"},
+		wantOut: "ID   SERVICE             SUBJECT  STATE    SUBMITTED\nabc  orders.default.svc  alice    pending  5m0s ago\n",
+		wantReq: recordedRequest{method: http.MethodGet, path: "/search?from=2021-03-01T09%3A00%3A00Z&limit=100&state=pending&target=orders.default.svc"},
+	}, {
+		name:    "pause",
+		args:    []string{"pause", "--admin-url", "{{url}}", "--namespace", "default", "--service", "orders"},
+		wantOut: "Service orders in namespace default is paused.\n",
+		wantReq: recordedRequest{method: http.MethodPost, path: "/pause", body: `{"namespace":"default","service":"orders"}`},
+	}, {
+		name:    "resume with a drain rate",
+		args:    []string{"resume", "--admin-url", "{{url}}", "--namespace", "default", "--service", "orders", "--drain-rate", "5"},
+		wantOut: "Service orders in namespace default is draining at 5 requests per second for 10m0s.\n",
+		wantReq: recordedRequest{method: http.MethodPost, path: "/resume", body: `{"namespace":"default","service":"orders","drainRate":5,"drainFor":"10m0s"}`},
+	}, {
+		name:    "pause without a service",
+		args:    []string{"pause", "--admin-url", "{{url}}", "--namespace", "default"},
+		wantErr: "the service must be set with --namespace and --service",
+	}, {
+		name:    "pauses",
+		args:    []string{"pauses", "--admin-url", "{{url}}"},
+		wantOut: "NAMESPACE  SERVICE  STATE   SINCE\ndefault    orders   paused  30m0s ago\n",
+		wantReq: recordedRequest{method: http.MethodGet, path: "/pauses"},
+	}, {
+		name:    "depth",
+		args:    []string{"depth", "--admin-url", "{{url}}"},
+		wantOut: "SERVICE             DEPTH  IN-FLIGHT  OLDEST\norders.default.svc  2      1          1m30s\n<unreadable>        1      0          -\n\nTotal: 3 requests\n",
+		wantReq: recordedRequest{method: http.MethodGet, path: "/depth"},
+	}, {
+		name:    "dead letters",
+		args:    []string{"dead-letters", "--admin-url", "{{url}}"},
+		wantOut: "ID   SERVICE             REASON            ATTEMPTS  DEAD-LETTERED\nabc  orders.default.svc  url returned 500  3         1h0m0s ago\n",
+		wantReq: recordedRequest{method: http.MethodGet, path: "/dead-letters?limit=100"},
+	}, {
+		name:    "replay",
+		args:    []string{"replay", "--admin-url", "{{url}}", "--id", "abc", "--id", "def", "--target", "https://orders-v2.default.svc"},
+		wantOut: "Replayed 1 dead-lettered requests.\n1 of the requests were not found among the dead-lettered ones.\n",
+		wantReq: recordedRequest{
+			method: http.MethodPost,
+			path:   "/dead-letters/replay?max=100",
+			body:   `{"ids":["abc","def"],"target":"https://orders-v2.default.svc"}`,
+		},
+	}, {
+		name:    "replay json",
+		args:    []string{"replay", "--admin-url", "{{url}}", "--all", "--max", "10", "--output", "json"},
+		wantOut: `{"replayed":1}`,
+		wantReq: recordedRequest{method: http.MethodPost, path: "/dead-letters/replay?max=10", body: `{}`},
+	}, {
+		name:    "replay without selection",
+		args:    []string{"replay", "--admin-url", "{{url}}"},
+		wantErr: "select the requests to replay with --id, or replay them all with --all",
+	}, {
+		name:    "purge asks for a confirmation",
+		args:    []string{"purge", "--admin-url", "{{url}}", "--namespace", "default", "--service", "orders"},
+		wantOut: "2 queued requests of service orders in namespace default would be purged, requests in flight are left.\nTo purge them, run within 5m0s:\n  kn async purge --namespace default --service orders --confirm 1614593100.abc\n",
+		wantReq: recordedRequest{method: http.MethodPost, path: "/purge", body: `{"namespace":"default","service":"orders"}`},
+	}, {
+		name:    "purge",
+		args:    []string{"purge", "--admin-url", "{{url}}", "--namespace", "default", "--confirm", "1614593100.abc"},
+		wantOut: "Purged 0 queued requests.\n",
+		wantReq: recordedRequest{method: http.MethodPost, path: "/purge", body: `{"namespace":"default","confirmation":"1614593100.abc"}`},
+	}, {
+		name:    "purge without namespace",
+		args:    []string{"purge", "--admin-url", "{{url}}"},
+		wantErr: "the namespace of the requests to purge must be set with --namespace",
+	}, {
+		name:    "no admin service",
+		args:    []string{"depth"},
+		wantErr: "the URL of the admin service must be set with --admin-url or ASYNC_ADMIN_URL",
+	}, {
+		name:    "unknown command",
+		args:    []string{"drain"},
+		wantErr: errUsage.Error(),
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []recordedRequest
+			server := fakeServer(responses, &got)
+			defer server.Close()
+			args := make([]string, len(test.args))
+			for i, a := range test.args {
+				args[i] = strings.ReplaceAll(a, "{{url}}", server.URL)
+			}
+			var out, errOut bytes.Buffer
+			c := &cli{
+				out:    &out,
+				errOut: &errOut,
+				client: server.Client(),
+				getenv: func(name string) string {
+					if name == adminTokenEnv {
+						return "secret"
+					}
+					return ""
+				},
+				now: func() time.Time { return now },
+			}
+
+			err := c.run(args)
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("run() = %v, want no error", err)
+			} else if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("run() = %v, want an error containing %q", err, test.wantErr)
+			}
+			if want := strings.ReplaceAll(test.wantOut, "{{url}}", server.URL); out.String() != want {
+				t.Errorf("output = %q, want %q", out.String(), want)
+			}
+			if test.wantReq.method == "" {
+				if len(got) != 0 {
+					t.Errorf("got requests %v, want none", got)
+				}
+				return
+			}
+			if len(got) != 1 {
+				t.Fatalf("got %d requests, want 1", len(got))
+			}
+			if got[0].method != test.wantReq.method || got[0].path != test.wantReq.path || got[0].body != test.wantReq.body {
+				t.Errorf("request = %s %s %s, want %s %s %s", got[0].method, got[0].path, got[0].body,
+					test.wantReq.method, test.wantReq.path, test.wantReq.body)
+			}
+			for name, want := range test.wantHdrs {
+				if v := got[0].header.Get(name); v != want {
+					t.Errorf("header %s = %q, want %q", name, v, want)
+				}
+			}
+		})
+	}
+}
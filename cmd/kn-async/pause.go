@@ -0,0 +1,140 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"text/tabwriter"
+	"time"
+)
+
+// pauseRequest selects the service paused or resumed.
+type pauseRequest struct {
+	Namespace string  `json:"namespace"`
+	Service   string  `json:"service"`
+	DrainRate float64 `json:"drainRate,omitempty"`
+	DrainFor  string  `json:"drainFor,omitempty"`
+}
+
+// pausedService is the state of a service paused or draining.
+type pausedService struct {
+	Namespace  string     `json:"namespace"`
+	Service    string     `json:"service"`
+	Paused     bool       `json:"paused"`
+	Since      time.Time  `json:"since"`
+	DrainRate  float64    `json:"drainRate"`
+	DrainUntil *time.Time `json:"drainUntil"`
+}
+
+type pausesResponse struct {
+	Services []pausedService `json:"services"`
+}
+
+// pause stops the deliveries to a service, whose requests are queued until
+// it is resumed.
+func (c *cli) pause(args []string) error {
+	fs := c.flagSet("pause", "--namespace NAMESPACE --service NAME [flags]")
+	namespace := fs.String("namespace", "", "namespace of the service")
+	service := fs.String("service", "", "name of the Knative Service whose deliveries are paused")
+	f := c.adminFlags(fs)
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	return c.updatePause(f, "/pause", pauseRequest{Namespace: *namespace, Service: *service})
+}
+
+// resume restarts the deliveries to a paused service, at up to --drain-rate
+// requests per second for --drain-for when it is set.
+func (c *cli) resume(args []string) error {
+	fs := c.flagSet("resume", "--namespace NAMESPACE --service NAME [flags]")
+	namespace := fs.String("namespace", "", "namespace of the service")
+	service := fs.String("service", "", "name of the Knative Service whose deliveries are resumed")
+	rate := fs.Float64("drain-rate", 0, "most requests delivered per second while the queued requests drain, no limit when 0")
+	drainFor := fs.Duration("drain-for", 10*time.Minute, "how long deliveries are limited to --drain-rate")
+	f := c.adminFlags(fs)
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	pr := pauseRequest{Namespace: *namespace, Service: *service, DrainRate: *rate}
+	if *rate > 0 {
+		pr.DrainFor = drainFor.String()
+	}
+	return c.updatePause(f, "/resume", pr)
+}
+
+// updatePause sends pr to path of the admin service, and prints the state
+// of the service.
+func (c *cli) updatePause(f *adminFlags, path string, pr pauseRequest) error {
+	if pr.Namespace == "" || pr.Service == "" {
+		return fmt.Errorf("the service must be set with --namespace and --service")
+	}
+	if err := f.check(); err != nil {
+		return err
+	}
+	var s pausedService
+	found, err := c.callAdmin(f, http.MethodPost, path, pr, &s)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("the admin service does not serve %s, it may need to be updated", path)
+	}
+	if f.output == "json" {
+		return nil
+	}
+	fmt.Fprintf(c.out, "Service %s in namespace %s is %s.\n", pr.Service, pr.Namespace, c.pauseState(s))
+	return nil
+}
+
+// pauses lists the services paused or draining.
+func (c *cli) pauses(args []string) error {
+	fs := c.flagSet("pauses", "[flags]")
+	f := c.adminFlags(fs)
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	if err := f.check(); err != nil {
+		return err
+	}
+	var resp pausesResponse
+	if err := c.callAdminList(f, "/pauses", &resp); err != nil {
+		return err
+	}
+	if f.output == "json" {
+		return nil
+	}
+	if len(resp.Services) == 0 {
+		fmt.Fprintln(c.out, "No paused services.")
+		return nil
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tSERVICE\tSTATE\tSINCE")
+	for _, s := range resp.Services {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s ago\n", s.Namespace, s.Service, c.pauseState(s), c.since(s.Since))
+	}
+	return w.Flush()
+}
+
+// pauseState describes the state of s.
+func (c *cli) pauseState(s pausedService) string {
+	switch {
+	case s.Paused:
+		return "paused"
+	case s.DrainRate > 0 && s.DrainUntil != nil:
+		return fmt.Sprintf("draining at %g requests per second for %s", s.DrainRate, s.DrainUntil.Sub(c.now()).Round(time.Second))
+	default:
+		return "resumed"
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// purgeRequest selects the requests purged.
+type purgeRequest struct {
+	Namespace    string `json:"namespace"`
+	Service      string `json:"service,omitempty"`
+	Confirmation string `json:"confirmation,omitempty"`
+}
+
+type purgeResponse struct {
+	Matched      *int       `json:"matched"`
+	Confirmation string     `json:"confirmation"`
+	ExpiresAt    *time.Time `json:"expiresAt"`
+	Purged       int        `json:"purged"`
+}
+
+// purge deletes the queued requests of a service or a namespace. Without
+// --confirm, it prints the command confirming the purge.
+func (c *cli) purge(args []string) error {
+	fs := c.flagSet("purge", "--namespace NAMESPACE [--service NAME] [flags]")
+	namespace := fs.String("namespace", "", "namespace whose queued requests are purged")
+	service := fs.String("service", "", "name of the Knative Service whose queued requests are purged, all those of the namespace when not set")
+	confirm := fs.String("confirm", "", "confirmation of the purge, printed when it is run without it")
+	f := c.adminFlags(fs)
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	if *namespace == "" {
+		return fmt.Errorf("the namespace of the requests to purge must be set with --namespace")
+	}
+	if err := f.check(); err != nil {
+		return err
+	}
+	var resp purgeResponse
+	found, err := c.callAdmin(f, http.MethodPost, "/purge", purgeRequest{Namespace: *namespace, Service: *service, Confirmation: *confirm}, &resp)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("the admin service does not serve /purge, it may need to be updated")
+	}
+	if f.output == "json" {
+		return nil
+	}
+	if *confirm != "" {
+		fmt.Fprintf(c.out, "Purged %d queued requests.\n", resp.Purged)
+		return nil
+	}
+	of := "namespace " + *namespace
+	cmd := "kn async purge --namespace " + *namespace
+	if *service != "" {
+		of = fmt.Sprintf("service %s in namespace %s", *service, *namespace)
+		cmd += " --service " + *service
+	}
+	if resp.Matched != nil {
+		fmt.Fprintf(c.out, "%d queued requests of %s would be purged, requests in flight are left.\n", *resp.Matched, of)
+	} else {
+		fmt.Fprintf(c.out, "The queued requests of %s would be purged, requests in flight are left.\n", of)
+	}
+	expires := ""
+	if resp.ExpiresAt != nil {
+		expires = " within " + resp.ExpiresAt.Sub(c.now()).Round(time.Second).String()
+	}
+	fmt.Fprintf(c.out, "To purge them, run%s:\n  %s --confirm %s\n", expires, cmd, resp.Confirmation)
+	return nil
+}
@@ -0,0 +1,265 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"knative.dev/async-component/pkg/status"
+)
+
+// pendingRequest is a request listed by the admin service.
+type pendingRequest struct {
+	ID         string       `json:"id"`
+	Target     string       `json:"target"`
+	State      status.State `json:"state"`
+	EnqueuedAt *time.Time   `json:"enqueuedAt"`
+	Age        float64      `json:"age"`
+	Attempts   int          `json:"attempts"`
+}
+
+type pendingResponse struct {
+	Requests []pendingRequest `json:"requests"`
+}
+
+// matchingRequest is a request found by the admin service.
+type matchingRequest struct {
+	ID        string        `json:"id"`
+	Target    string        `json:"target"`
+	Subject   string        `json:"subject"`
+	Submitted time.Time     `json:"submitted"`
+	Status    status.Status `json:"status"`
+}
+
+type searchResponse struct {
+	Requests []matchingRequest `json:"requests"`
+}
+
+// serviceDepth is the number of queued requests of a service.
+type serviceDepth struct {
+	Target    string  `json:"target"`
+	Depth     int     `json:"depth"`
+	InFlight  int     `json:"inFlight"`
+	OldestAge float64 `json:"oldestAge"`
+}
+
+type depthResponse struct {
+	Total     *int64         `json:"total"`
+	Services  []serviceDepth `json:"services"`
+	Truncated bool           `json:"truncated"`
+}
+
+// status prints the status of a request, read from the status API of the
+// producer with --url, and from the admin service otherwise.
+func (c *cli) status(args []string) error {
+	fs := c.flagSet("status", "[flags] ID")
+	service := fs.String("url", "", "URL of a service whose status API is called, rather than the admin service")
+	header := headerFlag{}
+	fs.Var(header, "H", "header of the request to the status API, as \"Name: value\", repeated for several headers")
+	f := c.adminFlags(fs)
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	id := fs.Arg(0)
+	var s status.Status
+	var found bool
+	if *service != "" {
+		if f.output != "table" && f.output != "json" {
+			return fmt.Errorf("output %q is not table or json", f.output)
+		}
+		req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(*service, "/")+statusPath+url.PathEscape(id), nil)
+		if err != nil {
+			return fmt.Errorf("failed to create the request to the status API: %w", err)
+		}
+		req.Header = http.Header(header)
+		if found, err = c.do(req, f.output == "json", &s); err != nil {
+			return err
+		}
+	} else {
+		if err := f.check(); err != nil {
+			return err
+		}
+		var err error
+		if found, err = c.callAdmin(f, http.MethodGet, "/requests/"+url.PathEscape(id), nil, &s); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("request %s is not known, or its status expired", id)
+	}
+	if f.output == "json" {
+		return nil
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", s.ID)
+	fmt.Fprintf(w, "State:\t%s\n", s.State)
+	if s.StatusCode != 0 {
+		fmt.Fprintf(w, "Status code:\t%d\n", s.StatusCode)
+	}
+	if s.Reason != "" {
+		fmt.Fprintf(w, "Reason:\t%s\n", s.Reason)
+	}
+	if s.Attempts != 0 {
+		fmt.Fprintf(w, "Attempts:\t%d\n", s.Attempts)
+	}
+	fmt.Fprintf(w, "Updated:\t%s (%s ago)\n", s.Updated.Format(time.RFC3339), c.since(s.Updated))
+	if s.Result != nil {
+		fmt.Fprintf(w, "Result:\t%s\n", s.Result.Body)
+	}
+	return w.Flush()
+}
+
+// pending lists the requests of the queue that are not acked yet.
+func (c *cli) pending(args []string) error {
+	fs := c.flagSet("pending", "[flags]")
+	limit := fs.Int("limit", 100, "most requests listed, up to 1000")
+	f := c.adminFlags(fs)
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	if err := f.check(); err != nil {
+		return err
+	}
+	var resp pendingResponse
+	if err := c.callAdminList(f, "/requests?limit="+strconv.Itoa(*limit), &resp); err != nil {
+		return err
+	}
+	if f.output == "json" {
+		return nil
+	}
+	if len(resp.Requests) == 0 {
+		fmt.Fprintln(c.out, "No pending requests.")
+		return nil
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSERVICE\tSTATE\tAGE\tATTEMPTS")
+	for _, r := range resp.Requests {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", r.ID, r.Target, r.State, seconds(r.Age), r.Attempts)
+	}
+	return w.Flush()
+}
+
+// search lists the requests indexed by the status store matching the
+// flags, the most recent first.
+func (c *cli) search(args []string) error {
+	fs := c.flagSet("search", "[flags]")
+	target := fs.String("target", "", "host of the service of the requests")
+	subject := fs.String("subject", "", "caller that submitted the requests")
+	state := fs.String("state", "", "state of the requests, such as pending")
+	since := fs.Duration("since", 0, "only list the requests submitted since this long ago")
+	limit := fs.Int("limit", 100, "most requests listed, up to 1000")
+	f := c.adminFlags(fs)
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	if err := f.check(); err != nil {
+		return err
+	}
+	query := url.Values{"limit": {strconv.Itoa(*limit)}}
+	for name, v := range map[string]string{"target": *target, "subject": *subject, "state": *state} {
+		if v != "" {
+			query.Set(name, v)
+		}
+	}
+	if *since > 0 {
+		query.Set("from", c.now().Add(-*since).UTC().Format(time.RFC3339))
+	}
+	var resp searchResponse
+	if err := c.callAdminList(f, "/search?"+query.Encode(), &resp); err != nil {
+		return err
+	}
+	if f.output == "json" {
+		return nil
+	}
+	if len(resp.Requests) == 0 {
+		fmt.Fprintln(c.out, "No matching requests.")
+		return nil
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSERVICE\tSUBJECT\tSTATE\tSUBMITTED")
+	for _, r := range resp.Requests {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s ago\n", r.ID, r.Target, r.Subject, r.Status.State, c.since(r.Submitted))
+	}
+	return w.Flush()
+}
+
+// depth prints the number of requests of the queue that are not acked yet,
+// by service.
+func (c *cli) depth(args []string) error {
+	fs := c.flagSet("depth", "[flags]")
+	f := c.adminFlags(fs)
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	if err := f.check(); err != nil {
+		return err
+	}
+	var resp depthResponse
+	if err := c.callAdminList(f, "/depth", &resp); err != nil {
+		return err
+	}
+	if f.output == "json" {
+		return nil
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tDEPTH\tIN-FLIGHT\tOLDEST")
+	for _, s := range resp.Services {
+		target := s.Target
+		if target == "" {
+			target = "<unreadable>"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", target, s.Depth, s.InFlight, seconds(s.OldestAge))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if resp.Total != nil {
+		fmt.Fprintf(c.out, "\nTotal: %d requests\n", *resp.Total)
+	}
+	if resp.Truncated {
+		fmt.Fprintln(c.out, "Only the oldest requests were counted by service.")
+	}
+	return nil
+}
+
+// callAdminList calls path of the admin service, which must serve it.
+func (c *cli) callAdminList(f *adminFlags, path string, v interface{}) error {
+	found, err := c.callAdmin(f, http.MethodGet, path, nil, v)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("the admin service does not serve %s, it may need to be updated", strings.SplitN(path, "?", 2)[0])
+	}
+	return nil
+}
+
+// since returns the time elapsed since t, to the second.
+func (c *cli) since(t time.Time) time.Duration {
+	return c.now().Sub(t).Round(time.Second)
+}
+
+// seconds formats an age in seconds as a duration, "-" when it is unknown.
+func seconds(s float64) string {
+	if s <= 0 {
+		return "-"
+	}
+	return (time.Duration(s) * time.Second).String()
+}
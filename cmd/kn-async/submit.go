@@ -0,0 +1,168 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	// Headers of the asynchronous requests understood by the producer.
+	preferHeader   = "Prefer"
+	respondAsync   = "respond-async"
+	delayHeader    = "Async-Delay"
+	ttlHeader      = "Async-Ttl"
+	deadlineHeader = "Async-Deadline"
+	callbackHeader = "Async-Callback-Url"
+	// statusPath is the path of the status API of the producer, under
+	// which the status of a request is served by ID.
+	statusPath = "/async/status/"
+)
+
+// headerFlag is a repeated flag of "Name: value" headers.
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	var s []string
+	for name, values := range h {
+		for _, v := range values {
+			s = append(s, name+": "+v)
+		}
+	}
+	return strings.Join(s, ", ")
+}
+
+func (h headerFlag) Set(v string) error {
+	i := strings.Index(v, ":")
+	if i <= 0 {
+		return fmt.Errorf("header %q is not of the form \"Name: value\"", v)
+	}
+	http.Header(h).Add(strings.TrimSpace(v[:i]), strings.TrimSpace(v[i+1:]))
+	return nil
+}
+
+// acceptedResponse is the response of the producer to queued requests.
+type acceptedResponse struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// submit sends a request to a service with the respond-async preference, so
+// the producer queues it, and prints its ID.
+func (c *cli) submit(args []string) error {
+	fs := c.flagSet("submit", "[flags] URL")
+	method := fs.String("X", "", "method of the request, POST when there is data and GET otherwise")
+	data := fs.String("d", "", "body of the request, or @file to read it from a file, @- from the standard input")
+	header := headerFlag{}
+	fs.Var(header, "H", "header of the request, as \"Name: value\", repeated for several headers")
+	delay := fs.String("delay", "", "delay before the request is delivered, in seconds or as a duration such as 5m")
+	ttl := fs.String("ttl", "", "time the request may wait in the queue, in seconds or as a duration such as 1h")
+	deadline := fs.String("deadline", "", "time after which the request is not delivered anymore, in RFC 3339 such as 2021-07-01T12:00:00Z")
+	callback := fs.String("callback", "", "URL the result of the request is sent to")
+	output := fs.String("output", "table", "output format, table or json")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	if *output != "table" && *output != "json" {
+		return fmt.Errorf("output %q is not table or json", *output)
+	}
+	target, err := url.Parse(fs.Arg(0))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("%q is not the http or https URL of a service", fs.Arg(0))
+	}
+
+	var body io.Reader
+	if *data != "" {
+		b, err := readData(*data)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	if *method == "" {
+		*method = http.MethodGet
+		if body != nil {
+			*method = http.MethodPost
+		}
+	}
+	req, err := http.NewRequest(*method, target.String(), body)
+	if err != nil {
+		return fmt.Errorf("failed to create the request: %w", err)
+	}
+	req.Header = http.Header(header)
+	// Conditionally asynchronous services are routed on the exact value
+	// of the preference, so the other options are sent as headers.
+	req.Header.Set(preferHeader, respondAsync)
+	for name, v := range map[string]string{delayHeader: *delay, ttlHeader: *ttl, deadlineHeader: *deadline, callbackHeader: *callback} {
+		if v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s: %w", target.Host, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read the response of %s: %w", target.Host, err)
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("the request was not queued, %s answered %s: %s", target.Host, resp.Status, strings.TrimSpace(string(b)))
+	}
+	if *output == "json" {
+		_, err := c.out.Write(b)
+		return err
+	}
+	var accepted acceptedResponse
+	if err := json.Unmarshal(b, &accepted); err != nil || accepted.ID == "" {
+		return fmt.Errorf("the request was queued, but the response of %s has no ID: %s", target.Host, strings.TrimSpace(string(b)))
+	}
+	fmt.Fprintf(c.out, "Request %s accepted.\n", accepted.ID)
+	if resp.Header.Get("Location") != "" {
+		base := url.URL{Scheme: target.Scheme, Host: target.Host}
+		fmt.Fprintf(c.out, "Follow it with: kn async status --url %s %s\n", base.String(), accepted.ID)
+	}
+	return nil
+}
+
+// readData returns the body given by the -d flag: its value, or the content
+// of the file it names after an @, the standard input for @-.
+func readData(v string) ([]byte, error) {
+	if !strings.HasPrefix(v, "@") {
+		return []byte(v), nil
+	}
+	name := v[1:]
+	if name == "-" {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the standard input: %w", err)
+		}
+		return b, nil
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The migrate command moves the requests of a queue backend to another one,
+// so the backend of the components can be switched on a live cluster.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/kelseyhightower/envconfig"
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/observability"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/signals"
+)
+
+// Name of the migration in logs.
+const serviceName = "async-migrate"
+
+// targetPrefix is the prefix of the environment variables of the target
+// backend, such as TARGET_QUEUE_BACKEND. Those that are not set fall back to
+// the variables of the source backend.
+const targetPrefix = "TARGET"
+
+// priorityHeader is the header of the records asking for a priority level,
+// as stored by the producer.
+const priorityHeader = "Async-Priority"
+
+// delayedPageSize is the number of delayed requests read at once.
+const delayedPageSize = 100
+
+func main() {
+	logger, _ := observability.NewLogger(serviceName, "")
+	defer logger.Sync()
+
+	var source, target queue.Config
+	if err := envconfig.Process("", &source); err != nil {
+		logger.Fatalw("Failed to process the environment of the source", zap.Error(err))
+	}
+	if err := envconfig.Process(targetPrefix, &target); err != nil {
+		logger.Fatalw("Failed to process the environment of the target", zap.Error(err))
+	}
+	if reflect.DeepEqual(source, target) {
+		logger.Fatal("The target backend is the source backend, set the TARGET_ variables")
+	}
+	ctx := logging.WithLogger(signals.NewContext(), logger)
+
+	from, err := queue.New(ctx, source)
+	if err != nil {
+		logger.Fatalw("Failed to create the source queue client", zap.Error(err))
+	}
+	defer from.Close()
+	to, err := queue.New(ctx, target)
+	if err != nil {
+		logger.Fatalw("Failed to create the target queue client", zap.Error(err))
+	}
+	defer to.Close()
+
+	logger.Infow("Migrating requests", zap.String("source", source.Backend), zap.String("target", target.Backend))
+	moved, err := migrate(ctx, from, to)
+	if err != nil {
+		logger.Fatalw("Failed to migrate requests", zap.Int("moved", moved), zap.Error(err))
+	}
+	logger.Infow("Migrated requests", zap.Int("moved", moved))
+}
+
+// migrate moves the requests of from to to until from is drained, and
+// returns how many were moved. A request is only acked in from once it is
+// stored in to, so none is lost, but one may be moved twice if the migration
+// is interrupted in between. from is drained when a read returns no request
+// and its backlog, for backends reporting one, is empty: requests being
+// delivered by the consumers of from are waited for, and moved if they are
+// released. The delayed requests are then moved with their delivery time.
+// Requests keep their priority level. Dead-lettered requests are not moved.
+func migrate(ctx context.Context, from, to queue.Queue) (int, error) {
+	moved, err := drain(ctx, from, to)
+	if err != nil {
+		return moved, err
+	}
+	delayed, err := moveDelayed(ctx, from, to)
+	return moved + delayed, err
+}
+
+// drain moves the requests of from that are due to to until from is drained.
+func drain(ctx context.Context, from, to queue.Queue) (int, error) {
+	logger := logging.FromContext(ctx)
+	moved := 0
+	for {
+		msgs, err := from.Dequeue(ctx)
+		if err != nil {
+			return moved, fmt.Errorf("failed to read requests: %w", err)
+		}
+		if len(msgs) == 0 {
+			b, err := queue.ReadBacklog(ctx, from)
+			if errors.Is(err, queue.ErrBacklogNotSupported) || (err == nil && b.Depth == 0) {
+				return moved, nil
+			} else if err != nil {
+				return moved, err
+			}
+			logger.Infow("Waiting for the requests being delivered", zap.Int64("depth", b.Depth))
+			continue
+		}
+		for _, msg := range msgs {
+			if err := to.Enqueue(queue.WithPriority(ctx, priority(msg)), requestID(msg), msg.Data); err != nil {
+				return moved, fmt.Errorf("failed to write request %s: %w", msg.ID, err)
+			}
+			if err := from.Ack(ctx, msg); err != nil {
+				return moved, fmt.Errorf("failed to ack request %s: %w", msg.ID, err)
+			}
+			moved++
+		}
+	}
+}
+
+// moveDelayed moves the delayed requests of from to to, to be delivered at
+// the same time, and returns how many were moved. A request that becomes due
+// while it is moved may be delivered from both queues.
+func moveDelayed(ctx context.Context, from, to queue.Queue) (int, error) {
+	moved := 0
+	for {
+		msgs, err := queue.ListDelayed(ctx, from, delayedPageSize)
+		if errors.Is(err, queue.ErrDelayedNotSupported) {
+			return moved, nil
+		} else if err != nil {
+			return moved, fmt.Errorf("failed to read delayed requests: %w", err)
+		}
+		if len(msgs) == 0 {
+			return moved, nil
+		}
+		for _, msg := range msgs {
+			id := requestID(msg.Message)
+			ctx := queue.WithPriority(queue.WithDeliverAt(ctx, msg.DeliverAt), priority(msg.Message))
+			if err := to.Enqueue(ctx, id, msg.Data); err != nil {
+				return moved, fmt.Errorf("failed to write delayed request %s: %w", id, err)
+			}
+			if err := queue.RemoveDelayed(ctx, from, msg); err != nil {
+				return moved, fmt.Errorf("failed to remove delayed request %s: %w", id, err)
+			}
+			moved++
+		}
+	}
+}
+
+// priority returns the priority level of msg: the level it was read from, for
+// sources with priority levels, else the one its record asks for, normal by
+// default.
+func priority(msg queue.Message) queue.Priority {
+	if p, ok := queue.MessagePriority(msg); ok {
+		return p
+	}
+	if d, err := request.Unmarshal(msg.Data); err == nil {
+		if p, err := queue.ParsePriority(http.Header(d.ReqHeader).Get(priorityHeader)); err == nil {
+			return p
+		}
+	}
+	return queue.PriorityNormal
+}
+
+// requestID returns the async request ID of msg, or its ID in the queue when
+// its record cannot be read.
+func requestID(msg queue.Message) string {
+	if d, err := request.Unmarshal(msg.Data); err == nil && d.ID != "" {
+		return d.ID
+	}
+	return msg.ID
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+	logtesting "knative.dev/pkg/logging/testing"
+)
+
+// memory returns a client of the memory queue name of the test.
+func memory(t *testing.T, name string) *queue.Memory {
+	return queue.NewMemory(queue.MemoryConfig{MemoryQueueName: t.Name() + "-" + name, MemoryReadTimeout: 10 * time.Millisecond})
+}
+
+// failingQueue fails to store requests.
+type failingQueue struct {
+	queue.Queue
+}
+
+func (failingQueue) Enqueue(context.Context, string, []byte) error {
+	return errors.New("unavailable")
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := logtesting.TestContextWithLogger(t)
+	from, to := memory(t, "from"), memory(t, "to")
+	record, err := request.Marshal(request.Data{ID: "request-1", ReqURL: "http://hello.default.svc.cluster.local"}, request.FormatJSON, time.Now())
+	if err != nil {
+		t.Fatal("Marshal() =", err)
+	}
+	from.Enqueue(ctx, "request-1", record)
+	from.Enqueue(ctx, "request-2", []byte("not a record"))
+
+	// A request being delivered by a consumer is waited for.
+	consumer := memory(t, "from")
+	msgs, err := consumer.Dequeue(ctx)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Dequeue() = %v, %v, want one request", msgs, err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		consumer.Close()
+	}()
+
+	moved, err := migrate(ctx, from, to)
+	if err != nil {
+		t.Fatal("migrate() =", err)
+	}
+	if moved != 2 {
+		t.Errorf("migrate() moved %d requests, want 2", moved)
+	}
+	if b, err := queue.ReadBacklog(ctx, from); err != nil || b.Depth != 0 {
+		t.Errorf("source backlog = %+v, %v, want it drained", b, err)
+	}
+	var got []string
+	for i := 0; i < 2; i++ {
+		msgs, err := to.Dequeue(ctx)
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("Dequeue() = %v, %v, want one request", msgs, err)
+		}
+		got = append(got, msgs[0].ID)
+	}
+	// The record of request 1 names it, the other one keeps its ID.
+	if diff := cmp.Diff([]string{"request-2", "request-1"}, got); diff != "" {
+		t.Error("target requests (-want, +got):", diff)
+	}
+}
+
+func TestMigrateTargetFailure(t *testing.T) {
+	ctx := logtesting.TestContextWithLogger(t)
+	from := memory(t, "from")
+	from.Enqueue(ctx, "request-1", []byte("request"))
+
+	if _, err := migrate(ctx, from, failingQueue{}); err == nil {
+		t.Fatal("migrate() succeeded, want the write error")
+	}
+	// The request is not acked, so it is read again from the source.
+	from.Close()
+	from = memory(t, "from")
+	msgs, err := from.Dequeue(ctx)
+	if err != nil || len(msgs) != 1 || msgs[0].ID != "request-1" {
+		t.Fatalf("Dequeue() = %v, %v, want the request kept", msgs, err)
+	}
+	from.Ack(ctx, msgs[0])
+}
+
+func TestMigrateDelayedAndPriorities(t *testing.T) {
+	ctx := logtesting.TestContextWithLogger(t)
+	from := memory(t, "from")
+	to, err := queue.NewPrioritized(ctx, queue.Config{
+		Backend:      queue.BackendMemory,
+		MemoryConfig: queue.MemoryConfig{MemoryQueueName: t.Name() + "-to", MemoryReadTimeout: 10 * time.Millisecond},
+		PriorityConfig: queue.PriorityConfig{
+			PriorityQueues:      true,
+			PriorityWeights:     map[string]int{"high": 6, "normal": 3, "low": 1},
+			PriorityReadTimeout: 100 * time.Millisecond,
+		},
+	})
+	if err != nil {
+		t.Fatal("NewPrioritized() =", err)
+	}
+	defer to.Close()
+	record := func(id, priority string) []byte {
+		b, err := request.Marshal(request.Data{
+			ID:        id,
+			ReqURL:    "http://hello.default.svc.cluster.local",
+			ReqHeader: map[string][]string{priorityHeader: {priority}},
+		}, request.FormatJSON, time.Now())
+		if err != nil {
+			t.Fatal("Marshal() =", err)
+		}
+		return b
+	}
+	deliverAt := time.Now().Add(time.Hour)
+	from.Enqueue(ctx, "high", record("high", "high"))
+	from.Enqueue(queue.WithDeliverAt(ctx, deliverAt), "delayed", record("delayed", "low"))
+
+	moved, err := migrate(ctx, from, to)
+	if err != nil {
+		t.Fatal("migrate() =", err)
+	}
+	if moved != 2 {
+		t.Errorf("migrate() moved %d requests, want 2", moved)
+	}
+	if msgs, err := queue.ListDelayed(ctx, from, 10); err != nil || len(msgs) != 0 {
+		t.Errorf("source delayed requests = %v, %v, want none", msgs, err)
+	}
+
+	msgs, err := to.Dequeue(ctx)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Dequeue() = %v, %v, want one request", msgs, err)
+	}
+	if p, _ := queue.MessagePriority(msgs[0]); p != queue.PriorityHigh {
+		t.Errorf("request stored at priority %q, want %q", p, queue.PriorityHigh)
+	}
+	delayed, err := queue.ListDelayed(ctx, to, 10)
+	if err != nil || len(delayed) != 1 {
+		t.Fatalf("target delayed requests = %v, %v, want one", delayed, err)
+	}
+	if p, _ := queue.MessagePriority(delayed[0].Message); p != queue.PriorityLow || !delayed[0].DeliverAt.Equal(deliverAt) {
+		t.Errorf("delayed request stored at priority %q for %v, want %q for %v", p, delayed[0].DeliverAt, queue.PriorityLow, deliverAt)
+	}
+}
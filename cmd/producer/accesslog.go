@@ -0,0 +1,190 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"knative.dev/async-component/pkg/headers"
+)
+
+// Formats of the access log, which is disabled when ACCESS_LOG is empty.
+const (
+	// accessLogCommon is the Common Log Format, followed by the async
+	// request ID and the latency in milliseconds.
+	accessLogCommon = "common"
+	// accessLogJSON writes an object per line.
+	accessLogJSON = "json"
+)
+
+// Layout of the time in the Common Log Format.
+const commonLogTime = "02/Jan/2006:15:04:05 -0700"
+
+// accessLogOut is where access log lines are written.
+var accessLogOut io.Writer = os.Stdout
+
+// accessLogMu serializes the lines written to accessLogOut.
+var accessLogMu sync.Mutex
+
+// accessLogEntry is a line of the access log.
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Method     string    `json:"method"`
+	Host       string    `json:"host"`
+	URI        string    `json:"uri"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	LatencyMS  float64   `json:"latencyMs"`
+	RequestID  string    `json:"requestID,omitempty"`
+}
+
+type accessLogIDKey struct{}
+
+// setAccessLogID records the ID given to the request of ctx, for its access
+// log line.
+func setAccessLogID(ctx context.Context, id string) {
+	if p, ok := ctx.Value(accessLogIDKey{}).(*string); ok {
+		*p = id
+	}
+}
+
+// checkAccessLog checks an access log format.
+func checkAccessLog(format string) error {
+	switch format {
+	case "", accessLogCommon, accessLogJSON:
+		return nil
+	default:
+		return fmt.Errorf("invalid access log format %q", format)
+	}
+}
+
+// accessLog returns h writing a line per request to accessLogOut in the
+// format in effect, except for the probes of the kubelet.
+func accessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := current().AccessLog
+		if format == "" || isProbe(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		start := now()
+		var id string
+		rw := &accessLogWriter{ResponseWriter: w}
+		h.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), accessLogIDKey{}, &id)))
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		host := r.Header.Get(headers.OriginalHost)
+		if host == "" {
+			host = r.Host
+		}
+		entry := accessLogEntry{
+			Time:       start,
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Host:       host,
+			URI:        r.RequestURI,
+			Proto:      r.Proto,
+			Status:     rw.status,
+			Bytes:      rw.bytes,
+			LatencyMS:  float64(now().Sub(start)) / float64(time.Millisecond),
+			RequestID:  id,
+		}
+		writeAccessLog(format, entry)
+	})
+}
+
+func writeAccessLog(format string, e accessLogEntry) {
+	var line []byte
+	if format == accessLogJSON {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		line = append(b, '\n')
+	} else {
+		line = []byte(fmt.Sprintf("%s - - [%s] %q %d %s %s %.3f\n",
+			orDash(remoteHost(e.RemoteAddr)), e.Time.Format(commonLogTime),
+			e.Method+" "+e.URI+" "+e.Proto, e.Status, orDash(bytesField(e.Bytes)),
+			orDash(e.RequestID), e.LatencyMS))
+	}
+	accessLogMu.Lock()
+	defer accessLogMu.Unlock()
+	accessLogOut.Write(line)
+}
+
+// remoteHost strips the port from a remote address.
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func bytesField(n int64) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// accessLogWriter records the status and the size of a response.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher, so streamed responses are relayed as they
+// are read.
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"knative.dev/async-component/pkg/queue"
+)
+
+func TestAccessLog(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("processed"))
+	}))
+	defer service.Close()
+	serviceHost := strings.TrimPrefix(service.URL, "http://")
+
+	start := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+	defer func() { now = time.Now }()
+	var out bytes.Buffer
+	accessLogOut = &out
+	defer func() { accessLogOut = os.Stdout }()
+
+	tests := []struct {
+		name    string
+		format  string
+		queue   queue.Queue
+		probe   bool
+		want    string
+		wantLog bool
+	}{{
+		name:  "disabled",
+		queue: &recordingQueue{},
+	}, {
+		name:    "common, accepted",
+		format:  accessLogCommon,
+		queue:   &recordingQueue{},
+		want:    `192.0.2.1 - - [01/Jul/2021:12:00:00 +0000] "POST /hello HTTP/1.1" 202 {bytes} {id} 0.000` + "\n",
+		wantLog: true,
+	}, {
+		name:    "common, proxied",
+		format:  accessLogCommon,
+		queue:   &flakyQueue{failures: 1},
+		want:    `192.0.2.1 - - [01/Jul/2021:12:00:00 +0000] "POST /hello HTTP/1.1" 201 9 {id} 0.000` + "\n",
+		wantLog: true,
+	}, {
+		name:   "probes are not logged",
+		format: accessLogJSON,
+		queue:  &recordingQueue{},
+		probe:  true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out.Reset()
+			env = envInfo{RequestSizeLimit: 25, QueueFailurePolicy: policyFallbackSync, AccessLog: test.format}
+			q = test.queue
+			r := httptest.NewRequest(http.MethodPost, "/hello", strings.NewReader("body"))
+			r.Header.Set("Async-Original-Host", serviceHost)
+			if test.probe {
+				r = httptest.NewRequest(http.MethodGet, "/healthz", nil)
+			}
+			rr := httptest.NewRecorder()
+			accessLog(probe(http.HandlerFunc(handleRequest))).ServeHTTP(rr, r)
+
+			if !test.wantLog {
+				if out.Len() != 0 {
+					t.Errorf("access log = %q, want none", out.String())
+				}
+				return
+			}
+			// Proxied requests are logged with the ID they would have been
+			// queued with.
+			got := out.String()
+			id := "-"
+			if fields := strings.Fields(got); len(fields) > 2 {
+				id = fields[len(fields)-2]
+			}
+			var resp acceptedResponse
+			if json.Unmarshal(rr.Body.Bytes(), &resp) == nil && resp.ID != id {
+				t.Errorf("logged request ID %q, want %q", id, resp.ID)
+			}
+			if id == "-" {
+				t.Error("request logged without its ID")
+			}
+			want := strings.Replace(test.want, "{bytes}", strconv.Itoa(rr.Body.Len()), 1)
+			want = strings.Replace(want, "{id}", id, 1)
+			if got != want {
+				t.Errorf("access log = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	start := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+	defer func() { now = time.Now }()
+	var out bytes.Buffer
+	accessLogOut = &out
+	defer func() { accessLogOut = os.Stdout }()
+	env = envInfo{RequestSizeLimit: 25, AccessLog: accessLogJSON}
+	q = &recordingQueue{}
+
+	r := httptest.NewRequest(http.MethodPost, "/hello?name=world", strings.NewReader("body"))
+	r.Header.Set("Async-Original-Host", "hello.default.svc.cluster.local")
+	rr := httptest.NewRecorder()
+	accessLog(http.HandlerFunc(handleRequest)).ServeHTTP(rr, r)
+
+	var resp acceptedResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal("Error decoding response:", err)
+	}
+	var got accessLogEntry
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("Error decoding access log %q: %v", out.String(), err)
+	}
+	want := accessLogEntry{
+		Time:       start,
+		RemoteAddr: "192.0.2.1:1234",
+		Method:     http.MethodPost,
+		Host:       "hello.default.svc.cluster.local",
+		URI:        "/hello?name=world",
+		Proto:      "HTTP/1.1",
+		Status:     http.StatusAccepted,
+		Bytes:      int64(rr.Body.Len()),
+		RequestID:  resp.ID,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("access log entry (-want, +got):", diff)
+	}
+}
+
+func TestCheckAccessLog(t *testing.T) {
+	for format, wantErr := range map[string]bool{"": false, "common": false, "json": false, "combined": true} {
+		if err := checkAccessLog(format); (err != nil) != wantErr {
+			t.Errorf("checkAccessLog(%q) = %v, wantErr %v", format, err, wantErr)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+
+	"knative.dev/async-component/pkg/audit"
+	"knative.dev/async-component/pkg/headers"
+)
+
+// Name of the producer in the audit trail.
+const auditComponent = "producer"
+
+// auditRequest records the event typ of request id, submitted or cancelled
+// by the caller of r, with the method and path of the request when they are
+// given.
+func auditRequest(r *http.Request, typ audit.Type, id, method, path string) {
+	if auditor == nil {
+		return
+	}
+	e := audit.Event{
+		Type:       typ,
+		RequestID:  id,
+		Target:     r.Header.Get(headers.OriginalHost),
+		Method:     method,
+		Path:       path,
+		RemoteAddr: r.RemoteAddr,
+	}
+	if authorizer != nil {
+		e.Subject = authorizer.Subject(r)
+	}
+	auditor.Record(r.Context(), e)
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"knative.dev/async-component/pkg/audit"
+	"knative.dev/async-component/pkg/status"
+)
+
+// auditSink records the audit events written.
+type auditSink struct {
+	events []audit.Event
+}
+
+func (s *auditSink) Write(ctx context.Context, e audit.Event) error {
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *auditSink) Close() error { return nil }
+
+func TestAudit(t *testing.T) {
+	q = &fakeQueue{}
+	env = envInfo{RequestSizeLimit: 25}
+	statuses = status.NewMemory()
+	defer func() { statuses = nil }()
+	sink := &auditSink{}
+	auditor = audit.NewRecorder(sink, auditComponent, time.Second)
+	defer func() { auditor = nil }()
+
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/orders?id=1", strings.NewReader("order"))
+	r.Header.Set("Async-Original-Host", "orders.default.svc.cluster.local")
+	r.RemoteAddr = "10.0.0.1:4321"
+	rr := httptest.NewRecorder()
+	handleRequest(rr, r)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("got %d, want %d", rr.Code, http.StatusAccepted)
+	}
+	var accepted acceptedResponse
+	if err := json.NewDecoder(rr.Body).Decode(&accepted); err != nil {
+		t.Fatal("Error decoding response:", err)
+	}
+
+	r = httptest.NewRequest(http.MethodDelete, "http://example.com"+requestsPath+accepted.ID, nil)
+	r.Header.Set("Async-Original-Host", "orders.default.svc.cluster.local")
+	r.RemoteAddr = "10.0.0.2:4321"
+	rr = httptest.NewRecorder()
+	handleCancel(rr, r)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	want := []audit.Event{{
+		Type:       audit.Submitted,
+		Component:  auditComponent,
+		RequestID:  accepted.ID,
+		Target:     "orders.default.svc.cluster.local",
+		Method:     http.MethodPost,
+		Path:       "/orders",
+		RemoteAddr: "10.0.0.1:4321",
+	}, {
+		Type:       audit.Cancelled,
+		Component:  auditComponent,
+		RequestID:  accepted.ID,
+		Target:     "orders.default.svc.cluster.local",
+		RemoteAddr: "10.0.0.2:4321",
+	}}
+	if diff := cmp.Diff(want, sink.events, cmpopts.IgnoreFields(audit.Event{}, "Time")); diff != "" {
+		t.Error("audit events (-want, +got):", diff)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/pkg/logging"
+)
+
+// backpressureConfig holds the environment configuration of the
+// backpressure applied to callers when the queue is backlogged.
+type backpressureConfig struct {
+	// BackpressureMaxDepth is the backlog of the queue, in requests, from
+	// which new requests are answered with 429 Too Many Requests. There is
+	// no backpressure when it is zero.
+	BackpressureMaxDepth int64 `envconfig:"BACKPRESSURE_MAX_DEPTH"`
+	// BackpressureRefresh is how often the backlog is read from the queue.
+	BackpressureRefresh time.Duration `envconfig:"BACKPRESSURE_REFRESH" default:"5s"`
+	// BackpressureRetryAfter is the Retry-After answered to the callers
+	// turned away.
+	BackpressureRetryAfter time.Duration `envconfig:"BACKPRESSURE_RETRY_AFTER" default:"30s"`
+}
+
+// validate returns an error if the backpressure is enabled without a
+// refresh interval.
+func (c backpressureConfig) validate() error {
+	if c.BackpressureMaxDepth < 0 {
+		return errors.New("BACKPRESSURE_MAX_DEPTH must not be negative")
+	}
+	if c.BackpressureMaxDepth > 0 && c.BackpressureRefresh <= 0 {
+		return errors.New("BACKPRESSURE_REFRESH must be positive when BACKPRESSURE_MAX_DEPTH is set")
+	}
+	return nil
+}
+
+// backlogWatcher caches the backlog of a queue, so it is not read for each
+// request.
+type backlogWatcher struct {
+	queue queue.Queue
+
+	mu    sync.RWMutex
+	depth int64
+	// read is when depth was read, zero until it is.
+	read time.Time
+}
+
+// backlog watches the backlog of the queue when the backpressure is
+// enabled.
+var backlog *backlogWatcher
+
+func newBacklogWatcher(q queue.Queue) *backlogWatcher {
+	return &backlogWatcher{queue: q}
+}
+
+// run reads the backlog every refresh interval of config while the
+// backpressure is enabled, until ctx is done or the backend turns out not to
+// report it. The configuration is read before each wait, so changes to the
+// interval apply from the next read on. A refresh interval that is not
+// positive keeps the previous one.
+func (b *backlogWatcher) run(ctx context.Context, config func() backpressureConfig) {
+	logger := logging.FromContext(ctx)
+	interval := config().BackpressureRefresh
+	for {
+		cfg := config()
+		if cfg.BackpressureMaxDepth > 0 {
+			if err := b.refresh(ctx); errors.Is(err, queue.ErrBacklogNotSupported) {
+				logger.Error("The queue backend does not report its backlog, no backpressure is applied")
+				return
+			} else if err != nil {
+				logger.Errorw("Error reading the queue backlog", zap.Error(err))
+			}
+		}
+		if cfg.BackpressureRefresh > 0 {
+			interval = cfg.BackpressureRefresh
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// refresh reads the backlog from the queue.
+func (b *backlogWatcher) refresh(ctx context.Context) error {
+	bl, err := queue.ReadBacklog(ctx, b.queue)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.depth, b.read = bl.Depth, now()
+	b.mu.Unlock()
+	return nil
+}
+
+// current returns the backlog, and whether it was read within maxAge.
+func (b *backlogWatcher) current(maxAge time.Duration) (int64, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.read.IsZero() || now().Sub(b.read) > maxAge {
+		return 0, false
+	}
+	return b.depth, true
+}
+
+// backpressure answers r with 429 Too Many Requests when the backlog of the
+// queue reaches BACKPRESSURE_MAX_DEPTH, and reports whether it did. Requests
+// are accepted while the backlog is unknown, or was last read more than
+// three refresh intervals ago.
+func backpressure(w http.ResponseWriter, r *http.Request) bool {
+	cfg := current().backpressureConfig
+	if backlog == nil || cfg.BackpressureMaxDepth <= 0 {
+		return false
+	}
+	depth, ok := backlog.current(3 * cfg.BackpressureRefresh)
+	if !ok || depth < cfg.BackpressureMaxDepth {
+		return false
+	}
+	recordRequest(r.Context(), resultBackpressure)
+	logging.FromContext(r.Context()).Infow("Queue is backlogged, turning the request away",
+		zap.Int64("backlog", depth), zap.Int64("maxDepth", cfg.BackpressureMaxDepth))
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(cfg.BackpressureRetryAfter.Seconds()))))
+	http.Error(w, "the queue is backlogged, retry later", http.StatusTooManyRequests)
+	return true
+}
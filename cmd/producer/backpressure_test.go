@@ -0,0 +1,185 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"knative.dev/async-component/pkg/queue"
+)
+
+func TestBackpressure(t *testing.T) {
+	ctx := context.Background()
+	mq := queue.NewMemory(queue.MemoryConfig{MemoryQueueName: fmt.Sprint(t.Name(), time.Now().UnixNano()), MemoryReadTimeout: time.Millisecond})
+	for _, id := range []string{"1", "2"} {
+		if err := mq.Enqueue(ctx, id, []byte(id)); err != nil {
+			t.Fatal("Enqueue() =", err)
+		}
+	}
+	q = mq
+	backlog = newBacklogWatcher(mq)
+	defer func() { backlog = nil }()
+	if err := backlog.refresh(ctx); err != nil {
+		t.Fatal("refresh() =", err)
+	}
+	start := time.Now()
+	defer func() { now = time.Now }()
+
+	tests := []struct {
+		name     string
+		maxDepth int64
+		elapsed  time.Duration
+		want     int
+	}{{
+		name: "disabled",
+		want: http.StatusAccepted,
+	}, {
+		name:     "under the threshold",
+		maxDepth: 3,
+		want:     http.StatusAccepted,
+	}, {
+		name:     "backlogged",
+		maxDepth: 2,
+		elapsed:  10 * time.Second,
+		want:     http.StatusTooManyRequests,
+	}, {
+		name:     "backlog read too long ago",
+		maxDepth: 2,
+		elapsed:  time.Minute,
+		want:     http.StatusAccepted,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{
+				RequestSizeLimit:   25,
+				QueueFailurePolicy: policyFail,
+				backpressureConfig: backpressureConfig{
+					BackpressureMaxDepth:   test.maxDepth,
+					BackpressureRefresh:    5 * time.Second,
+					BackpressureRetryAfter: 30 * time.Second,
+				},
+			}
+			defer func() { env = envInfo{} }()
+			now = func() time.Time { return start.Add(test.elapsed) }
+
+			r := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("body"))
+			r.Header.Set("Async-Original-Host", "orders.default.svc.cluster.local")
+			rr := httptest.NewRecorder()
+			handleRequest(rr, r)
+			if rr.Code != test.want {
+				t.Fatalf("got %d, want %d", rr.Code, test.want)
+			}
+			if rr.Code != http.StatusTooManyRequests {
+				return
+			}
+			if got := rr.Header().Get("Retry-After"); got != "30" {
+				t.Errorf("Retry-After = %q, want 30", got)
+			}
+		})
+	}
+}
+
+func TestBackpressureConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     backpressureConfig
+		wantErr bool
+	}{{
+		name: "disabled",
+	}, {
+		name: "enabled",
+		cfg:  backpressureConfig{BackpressureMaxDepth: 1000, BackpressureRefresh: time.Second},
+	}, {
+		name:    "negative depth",
+		cfg:     backpressureConfig{BackpressureMaxDepth: -1},
+		wantErr: true,
+	}, {
+		name:    "no refresh",
+		cfg:     backpressureConfig{BackpressureMaxDepth: 1000},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.cfg.validate(); (err != nil) != test.wantErr {
+				t.Errorf("validate() = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// countingBacklog counts the reads of its backlog.
+type countingBacklog struct {
+	queue.Queue
+	mu    sync.Mutex
+	reads int
+}
+
+func (c *countingBacklog) Backlog(ctx context.Context) (queue.Backlog, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reads++
+	return queue.Backlog{Depth: 1}, nil
+}
+
+func (c *countingBacklog) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reads
+}
+
+func TestBacklogWatcherRefreshChange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cq := &countingBacklog{}
+	var mu sync.Mutex
+	cfg := backpressureConfig{BackpressureMaxDepth: 1000, BackpressureRefresh: time.Millisecond}
+	config := func() backpressureConfig {
+		mu.Lock()
+		defer mu.Unlock()
+		return cfg
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newBacklogWatcher(cq).run(ctx, config)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for cq.count() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("backlog read", cq.count(), "times, want at least 3")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// A longer interval applies from the next read on, so at most the read
+	// already waited for happens.
+	mu.Lock()
+	cfg.BackpressureRefresh = time.Hour
+	mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	reads := cq.count()
+	time.Sleep(50 * time.Millisecond)
+	if got := cq.count(); got != reads {
+		t.Errorf("backlog read %d times after the interval changed to an hour, want %d", got, reads)
+	}
+	cancel()
+	<-done
+}
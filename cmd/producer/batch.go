@@ -0,0 +1,411 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bradleypeabody/gouuidv6"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/audit"
+	"knative.dev/async-component/pkg/headers"
+	"knative.dev/async-component/pkg/logkey"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/async-component/pkg/status"
+	"knative.dev/async-component/pkg/tracing"
+	"knative.dev/pkg/logging"
+)
+
+// Path of the batch endpoint. Like the status endpoint, it is under /async/
+// so it does not shadow a path of the services.
+const batchPath = "/async/batch"
+
+// batchItem is a request of a JSON batch.
+type batchItem struct {
+	// Method defaults to POST.
+	Method string `json:"method,omitempty"`
+	// Path is the path and query of the request, "/" by default.
+	Path    string            `json:"path,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body is a JSON string holding the body, or any other JSON value sent
+	// as is.
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// batchRequest is a request of a batch, in either format.
+type batchRequest struct {
+	method string
+	uri    string
+	header http.Header
+	body   []byte
+}
+
+// batchResponse is the body of the 202 response to a batch, with the
+// requests in the order of the batch.
+type batchResponse struct {
+	Requests []acceptedResponse `json:"requests"`
+}
+
+// errBatchTooLarge is returned for batches over BATCH_SIZE_LIMIT or
+// BATCH_MAX_REQUESTS.
+var errBatchTooLarge = errors.New("batch too large")
+
+// handleBatch queues the requests of a batch atomically: either all of them
+// are accepted or none is. The async headers of the batch, such as its TTL,
+// delay, deadline and priority, apply to all its requests.
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	originalHost := r.Header.Get(headers.OriginalHost)
+	logger := logging.FromContext(r.Context()).With(zap.String(logkey.Host, originalHost))
+	r = r.WithContext(logging.WithLogger(r.Context(), logger))
+	// Batches cannot be delivered synchronously instead.
+	if !asyncEnabled(current(), originalHost) {
+		w.WriteHeader(http.StatusForbidden)
+		logger.Info("Asynchronous requests not enabled for the service")
+		return
+	}
+	if authorizer != nil {
+		if err := authorizer.Authorize(r); err != nil {
+			denied(w, r, err)
+			return
+		}
+	}
+	if backpressure(w, r) {
+		return
+	}
+	ttl, err := requestTTL(r.Header)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Infow("Invalid request TTL", zap.Error(err))
+		return
+	}
+	delay, err := requestDelay(r.Header)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Infow("Invalid request delay", zap.Error(err))
+		return
+	}
+	deliverAt := now().Add(delay)
+	deadline, err := requestDeadline(r.Header, deliverAt)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		logger.Infow("Invalid request deadline", zap.Error(err))
+		return
+	}
+	priority, err := requestPriority(r.Header)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Infow("Invalid request priority", zap.Error(err))
+		return
+	}
+	limit, err := requestSizeLimit(r.Header)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Infow("Invalid request size limit", zap.Error(err))
+		return
+	}
+
+	cfg := current()
+	reqs, err := readBatch(w, r, cfg.BatchSizeLimit, cfg.BatchMaxRequests)
+	if errors.Is(err, errBatchTooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		logger.Infow("Batch too large", zap.Error(err))
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		logger.Infow("Invalid batch", zap.Error(err))
+		return
+	}
+	if limiter != nil {
+		if ok, retry := limiter.AllowN(limiter.Key(r), len(reqs)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	ids := make([]string, len(reqs))
+	records := make([][]byte, len(reqs))
+	route := ""
+	// The consumer continues the trace of each request from the span of
+	// the batch.
+	ctx, span := trace.StartSpan(r.Context(), enqueueSpan)
+	defer span.End()
+	for i, br := range reqs {
+		ir := itemRequest(r, br)
+		if int64(len(br.body)) > limit {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			logger.Infow("Batch request body too large", zap.Int("index", i))
+			return
+		}
+		// Unlike single requests, those of batches cannot be sent
+		// synchronously instead.
+		if !asyncPath(ir) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "batch request %d: path %s does not accept asynchronous requests", i, ir.URL.Path)
+			logger.Infow("Asynchronous requests not enabled for the path of a batch request", zap.Int("index", i), zap.String("path", ir.URL.Path))
+			return
+		}
+		if !validRequest(w, ir, br.body) {
+			return
+		}
+		if router != nil {
+			if rt := router.Route(ir); i == 0 {
+				route = rt
+			} else if rt != route {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("batch requests are routed to different queues"))
+				logger.Infow("Batch requests are routed to different queues", zap.Int("index", i))
+				return
+			}
+		}
+		ids[i] = gouuidv6.NewFromTime(now()).String()
+		data := request.Data{
+			ID:        ids[i],
+			ReqBody:   string(br.body),
+			ReqURL:    requestScheme(r) + "://" + originalHost + br.uri,
+			ReqHeader: ir.Header,
+			ReqMethod: br.method,
+			Deadline:  deadline,
+		}
+		if ttl > 0 {
+			expires := deliverAt.Add(ttl)
+			data.ExpiresAt = &expires
+		}
+		if records[i], err = marshalStored(data, tracing.TraceParent(span.SpanContext())); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			logger.Errorw("Failed to marshal request", zap.String(logkey.RequestID, ids[i]), zap.Error(err))
+			return
+		}
+	}
+
+	var usage int64
+	for _, record := range records {
+		usage += int64(len(record))
+	}
+	release, ok := reserveQuota(w, r, originalHost, int64(len(ids)), usage)
+	if !ok {
+		return
+	}
+	accepted := false
+	defer func() {
+		if !accepted {
+			release()
+		}
+	}()
+
+	if statuses != nil {
+		for _, id := range ids {
+			if err := statuses.Set(ctx, status.Status{ID: id, State: status.Pending, Host: originalHost, Updated: now()}); err != nil {
+				recordStorageError(ctx, storeStatus)
+				w.WriteHeader(http.StatusInternalServerError)
+				logger.Errorw("Error writing request status", zap.String(logkey.RequestID, id), zap.Error(err))
+				return
+			}
+			indexRequest(ctx, r, id, now())
+		}
+	}
+
+	if key := r.Header.Get(orderingKeyHeader); key != "" {
+		ctx = queue.WithOrderingKey(ctx, key)
+	}
+	if delay > 0 {
+		ctx = queue.WithDeliverAt(ctx, deliverAt)
+	}
+	ctx = queue.WithPriority(ctx, priority)
+	ctx = queue.WithShardKey(ctx, originalHost)
+	if router != nil {
+		ctx = queue.WithRoute(ctx, route)
+	}
+	start := now()
+	err = withRetries(ctx, func() error {
+		return queue.EnqueueBatch(ctx, q, ids, records)
+	})
+	recordEnqueue(ctx, start, err)
+	switch {
+	case errors.Is(err, queue.ErrBatchNotSupported):
+		w.WriteHeader(http.StatusNotImplemented)
+		logger.Infow("Cannot queue batch", zap.Error(err))
+		return
+	case errors.Is(err, queue.ErrDelayNotSupported):
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Infow("Cannot delay batch", zap.Error(err))
+		return
+	case err != nil:
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnavailable, Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		logger.Errorw("Error writing batch to the queue", zap.Error(err))
+		return
+	}
+	logger.Infow("Batch accepted", zap.Int("requests", len(ids)))
+	accepted = true
+	resp := batchResponse{Requests: make([]acceptedResponse, len(ids))}
+	for i, id := range ids {
+		recordRequest(ctx, resultAccepted)
+		// The URIs of the requests were checked when reading the batch.
+		u, _ := url.ParseRequestURI(reqs[i].uri)
+		auditRequest(r, audit.Submitted, id, reqs[i].method, u.Path)
+		resp.Requests[i] = acceptedResponse{ID: id, Status: acceptedStatus}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Errorw("Error writing batch response", zap.Error(err))
+	}
+}
+
+// readBatch reads the requests of a batch, either a JSON array of batchItem
+// or a multipart/mixed body with an application/http part per request.
+func readBatch(w http.ResponseWriter, r *http.Request, sizeLimit int64, maxRequests int) ([]batchRequest, error) {
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, sizeLimit))
+	if err != nil {
+		if err.Error() == "http: request body too large" {
+			return nil, fmt.Errorf("%w: more than %d bytes", errBatchTooLarge, sizeLimit)
+		}
+		return nil, err
+	}
+	var reqs []batchRequest
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/mixed" {
+		reqs, err = readMultipartBatch(bytes.NewReader(b), params["boundary"], maxRequests)
+	} else {
+		reqs, err = readJSONBatch(b)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(reqs) == 0 {
+		return nil, errors.New("empty batch")
+	}
+	if len(reqs) > maxRequests {
+		return nil, fmt.Errorf("%w: more than %d requests", errBatchTooLarge, maxRequests)
+	}
+	return reqs, nil
+}
+
+func readJSONBatch(b []byte) ([]batchRequest, error) {
+	var items []batchItem
+	if err := json.Unmarshal(b, &items); err != nil {
+		return nil, fmt.Errorf("failed to parse batch: %w", err)
+	}
+	reqs := make([]batchRequest, len(items))
+	for i, item := range items {
+		br := batchRequest{method: item.Method, uri: item.Path, header: make(http.Header, len(item.Headers))}
+		if br.method == "" {
+			br.method = http.MethodPost
+		}
+		if br.uri == "" {
+			br.uri = "/"
+		}
+		// Requests are sent to the service of the batch, the path must not
+		// change the host.
+		u, err := url.ParseRequestURI(br.uri)
+		if err != nil || !strings.HasPrefix(br.uri, "/") {
+			return nil, fmt.Errorf("request %d: invalid path %q", i, br.uri)
+		}
+		br.uri = u.RequestURI()
+		for k, v := range item.Headers {
+			br.header.Set(k, v)
+		}
+		if len(item.Body) > 0 && item.Body[0] == '"' {
+			var s string
+			if err := json.Unmarshal(item.Body, &s); err != nil {
+				return nil, fmt.Errorf("request %d: invalid body: %w", i, err)
+			}
+			br.body = []byte(s)
+		} else {
+			br.body = item.Body
+		}
+		reqs[i] = br
+	}
+	return reqs, nil
+}
+
+func readMultipartBatch(body io.Reader, boundary string, maxRequests int) ([]batchRequest, error) {
+	if boundary == "" {
+		return nil, errors.New("multipart batch without boundary")
+	}
+	mr := multipart.NewReader(body, boundary)
+	var reqs []batchRequest
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return reqs, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read batch: %w", err)
+		}
+		if len(reqs) == maxRequests {
+			return nil, fmt.Errorf("%w: more than %d requests", errBatchTooLarge, maxRequests)
+		}
+		if mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); mediaType != "application/http" {
+			return nil, fmt.Errorf("request %d: parts must be application/http, got %q", len(reqs), mediaType)
+		}
+		pr, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			return nil, fmt.Errorf("request %d: %w", len(reqs), err)
+		}
+		b, err := ioutil.ReadAll(pr.Body)
+		if err != nil {
+			return nil, fmt.Errorf("request %d: %w", len(reqs), err)
+		}
+		// Only the path and query are used, requests are sent to the
+		// service of the batch.
+		reqs = append(reqs, batchRequest{method: pr.Method, uri: pr.URL.RequestURI(), header: pr.Header, body: b})
+	}
+}
+
+// itemRequest returns the request of a batch as if it had been submitted on
+// its own: with the headers of the batch, except those describing its body,
+// overridden by its own, but for those set by the ingress, and the Host the
+// batch was sent to.
+func itemRequest(r *http.Request, br batchRequest) *http.Request {
+	ir := r.Clone(r.Context())
+	ir.Method = br.method
+	ir.URL, _ = url.ParseRequestURI(br.uri)
+	ir.RequestURI = br.uri
+	ir.Header = withoutHopHeaders(r.Header)
+	ir.Header.Del("Content-Type")
+	ir.Header.Del("Content-Length")
+	for k, v := range br.header {
+		// Only the ingress sets the service and original host headers.
+		if isIngressHeader(k) {
+			continue
+		}
+		ir.Header[k] = v
+	}
+	ir.Header.Set(requestHostHeader, r.Host)
+	ir.Body = ioutil.NopCloser(bytes.NewReader(br.body))
+	ir.ContentLength = int64(len(br.body))
+	return ir
+}
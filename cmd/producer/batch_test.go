@@ -0,0 +1,215 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+)
+
+const multipartBatch = "--batch\r\n" +
+	"Content-Type: application/http\r\n\r\n" +
+	"POST /orders?id=1 HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/json\r\nContent-Length: 9\r\n\r\n{\"id\": 1}\r\n" +
+	"--batch\r\n" +
+	"Content-Type: application/http\r\n\r\n" +
+	"DELETE /orders/2 HTTP/1.1\r\nHost: example.com\r\n\r\n\r\n" +
+	"--batch--\r\n"
+
+func TestBatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		paths       string
+		body        string
+		want        []request.Data
+	}{{
+		name:        "json",
+		contentType: "application/json",
+		body: `[
+			{"path": "/orders?id=1", "headers": {"Content-Type": "application/json", "async-service-dead-letter-sink": "http://example.com", "Async-Original-Host": "admin.internal.svc.cluster.local"}, "body": {"id": 1}},
+			{"method": "DELETE", "path": "/orders/2"},
+			{"body": "text"}
+		]`,
+		want: []request.Data{
+			{ReqMethod: http.MethodPost, ReqURL: "http://hello.default.svc.cluster.local/orders?id=1", ReqBody: `{"id": 1}`},
+			{ReqMethod: http.MethodDelete, ReqURL: "http://hello.default.svc.cluster.local/orders/2"},
+			{ReqMethod: http.MethodPost, ReqURL: "http://hello.default.svc.cluster.local/", ReqBody: "text"},
+		},
+	}, {
+		name:        "multipart",
+		contentType: "multipart/mixed; boundary=batch",
+		body:        multipartBatch,
+		want: []request.Data{
+			{ReqMethod: http.MethodPost, ReqURL: "http://hello.default.svc.cluster.local/orders?id=1", ReqBody: `{"id": 1}`},
+			{ReqMethod: http.MethodDelete, ReqURL: "http://hello.default.svc.cluster.local/orders/2"},
+		},
+	}, {
+		name:        "paths filter",
+		contentType: "application/json",
+		paths:       "/orders/*",
+		body:        `[{"method": "DELETE", "path": "/orders/2"}]`,
+		want: []request.Data{
+			{ReqMethod: http.MethodDelete, ReqURL: "http://hello.default.svc.cluster.local/orders/2"},
+		},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{RequestSizeLimit: 25, BatchSizeLimit: 1000, BatchMaxRequests: 10}
+			mq := queue.NewMemory(queue.MemoryConfig{MemoryQueueName: t.Name(), MemoryReadTimeout: time.Millisecond})
+			q = mq
+
+			r := httptest.NewRequest(http.MethodPost, batchPath, strings.NewReader(test.body))
+			r.Header.Set("Async-Original-Host", "hello.default.svc.cluster.local")
+			r.Header.Set("Content-Type", test.contentType)
+			r.Header.Set("Authorization", "Bearer token")
+			if test.paths != "" {
+				r.Header.Set(servicePathsHeader, test.paths)
+			}
+			rr := httptest.NewRecorder()
+			handleBatch(rr, r)
+			if rr.Code != http.StatusAccepted {
+				t.Fatalf("got %d %q, want %d", rr.Code, rr.Body.String(), http.StatusAccepted)
+			}
+			var resp batchResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatal("Error decoding response:", err)
+			}
+			if len(resp.Requests) != len(test.want) {
+				t.Fatalf("got %d requests, want %d", len(resp.Requests), len(test.want))
+			}
+			for i, want := range test.want {
+				msgs, err := mq.Dequeue(context.Background())
+				if err != nil || len(msgs) != 1 {
+					t.Fatalf("Dequeue() = %v, %v, want request %d", msgs, err, i)
+				}
+				got := enqueuedRequest(t, msgs[0].Data)
+				if got.ID != resp.Requests[i].ID || resp.Requests[i].Status != acceptedStatus {
+					t.Errorf("request %d stored as %q, answered %+v", i, got.ID, resp.Requests[i])
+				}
+				if got.ReqMethod != want.ReqMethod || got.ReqURL != want.ReqURL || got.ReqBody != want.ReqBody {
+					t.Errorf("request %d = %s %s %q, want %s %s %q", i, got.ReqMethod, got.ReqURL, got.ReqBody, want.ReqMethod, want.ReqURL, want.ReqBody)
+				}
+				// Requests keep the headers of the batch, but those of
+				// their own body.
+				if h := http.Header(got.ReqHeader); h.Get("Authorization") != "Bearer token" || strings.HasPrefix(h.Get("Content-Type"), "multipart/") {
+					t.Errorf("request %d headers = %v", i, got.ReqHeader)
+				}
+				// Only the ingress sets the service headers, on the batch.
+				for k := range got.ReqHeader {
+					if isIngressHeader(k) && r.Header.Get(k) == "" {
+						t.Errorf("request %d stored with the %s header of the caller", i, k)
+					}
+				}
+				if h := http.Header(got.ReqHeader).Get("Async-Original-Host"); h != "hello.default.svc.cluster.local" {
+					t.Errorf("request %d stored for %q, want the host of the batch", i, h)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		header map[string]string
+		body   string
+		queue  queue.Queue
+		opted  []string
+		want   int
+	}{{
+		name:   "not POST",
+		method: http.MethodGet,
+		want:   http.StatusMethodNotAllowed,
+	}, {
+		name: "not JSON",
+		body: `{"path": "/"}`,
+		want: http.StatusBadRequest,
+	}, {
+		name: "empty",
+		body: `[]`,
+		want: http.StatusBadRequest,
+	}, {
+		name: "path changing the host",
+		body: `[{"path": "@evil.example.com/"}]`,
+		want: http.StatusBadRequest,
+	}, {
+		name: "too many requests",
+		body: `[{}, {}, {}]`,
+		want: http.StatusRequestEntityTooLarge,
+	}, {
+		name: "too large",
+		body: `[{"body": "` + strings.Repeat("a", 100) + `"}]`,
+		want: http.StatusRequestEntityTooLarge,
+	}, {
+		name: "request body too large",
+		body: `[{"body": "` + strings.Repeat("a", 30) + `"}]`,
+		want: http.StatusRequestEntityTooLarge,
+	}, {
+		name:   "deadline passed",
+		header: map[string]string{"Async-Deadline": "2021-07-01T12:00:00Z"},
+		body:   `[{}]`,
+		want:   http.StatusBadRequest,
+	}, {
+		name:   "path not accepting asynchronous requests",
+		header: map[string]string{"Async-Service-Paths": "/orders/*"},
+		body:   `[{"path": "/orders/1"}, {"path": "/admin"}]`,
+		want:   http.StatusBadRequest,
+	}, {
+		name:  "service not opted in",
+		body:  `[{}]`,
+		opted: []string{"*.batch.svc.cluster.local"},
+		want:  http.StatusForbidden,
+	}, {
+		name:  "backend without batches",
+		body:  `[{}]`,
+		queue: &recordingQueue{},
+		want:  http.StatusNotImplemented,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{RequestSizeLimit: 25, BatchSizeLimit: 80, BatchMaxRequests: 2, AsyncServices: test.opted}
+			mq := queue.NewMemory(queue.MemoryConfig{MemoryQueueName: t.Name(), MemoryReadTimeout: time.Millisecond})
+			q = mq
+			if test.queue != nil {
+				q = test.queue
+			}
+			method := test.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			r := httptest.NewRequest(method, batchPath, strings.NewReader(test.body))
+			r.Header.Set("Async-Original-Host", "hello.default.svc.cluster.local")
+			for k, v := range test.header {
+				r.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			handleBatch(rr, r)
+			if rr.Code != test.want {
+				t.Errorf("got %d, want %d", rr.Code, test.want)
+			}
+			if msgs, _ := mq.Dequeue(context.Background()); len(msgs) != 0 {
+				t.Errorf("queued %d requests, want none", len(msgs))
+			}
+		})
+	}
+}
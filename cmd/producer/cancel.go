@@ -0,0 +1,80 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/audit"
+	"knative.dev/async-component/pkg/logkey"
+	"knative.dev/async-component/pkg/status"
+	"knative.dev/pkg/logging"
+)
+
+// Path prefix of the requests, followed by their ID. Like the status
+// endpoint, it is under /async/ so it does not shadow a path of the services.
+const requestsPath = "/async/requests/"
+
+// cancelledReason is the reason recorded for the requests cancelled by their
+// caller.
+const cancelledReason = "cancelled by the caller"
+
+// handleCancel cancels the request whose ID is in the path, with a DELETE, if
+// it was not delivered yet. Its status is set to cancelled, and the consumer
+// skips it when reading it.
+func handleCancel(w http.ResponseWriter, r *http.Request) {
+	if statuses == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if authorizer != nil {
+		if err := authorizer.Authorize(r); err != nil {
+			denied(w, r, err)
+			return
+		}
+	}
+	id := strings.TrimPrefix(r.URL.Path, requestsPath)
+	logger := logging.FromContext(r.Context()).With(zap.String(logkey.RequestID, id))
+	s, ok := requestStatus(w, r, id)
+	if !ok {
+		return
+	}
+	switch s.State {
+	case status.Cancelled:
+	case status.Pending:
+		s.State, s.Reason, s.Updated = status.Cancelled, cancelledReason, now()
+		if err := statuses.Set(r.Context(), s); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			logger.Errorw("Error cancelling request", zap.Error(err))
+			return
+		}
+		logger.Info("Cancelled request")
+		auditRequest(r, audit.Cancelled, id, "", "")
+	default:
+		// The request is being delivered, or was.
+		http.Error(w, "request is "+string(s.State), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		logger.Errorw("Error writing status response", zap.Error(err))
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"knative.dev/async-component/pkg/status"
+)
+
+func TestCancel(t *testing.T) {
+	statuses = status.NewMemory()
+	defer func() { statuses = nil }()
+	for id, state := range map[string]status.State{
+		"pending":   status.Pending,
+		"cancelled": status.Cancelled,
+		"in-flight": status.InFlight,
+		"succeeded": status.Succeeded,
+	} {
+		if err := statuses.Set(context.Background(), status.Status{ID: id, State: state, Updated: time.Now()}); err != nil {
+			t.Fatal("Set() =", err)
+		}
+	}
+	other := status.Status{ID: "other-service", State: status.Pending, Host: "other.default.svc.cluster.local", Updated: time.Now()}
+	if err := statuses.Set(context.Background(), other); err != nil {
+		t.Fatal("Set() =", err)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		id         string
+		returncode int
+		wantState  status.State
+	}{{
+		name:       "pending request",
+		method:     http.MethodDelete,
+		id:         "pending",
+		returncode: http.StatusOK,
+		wantState:  status.Cancelled,
+	}, {
+		name:       "cancelled request",
+		method:     http.MethodDelete,
+		id:         "cancelled",
+		returncode: http.StatusOK,
+		wantState:  status.Cancelled,
+	}, {
+		name:       "request being delivered",
+		method:     http.MethodDelete,
+		id:         "in-flight",
+		returncode: http.StatusConflict,
+		wantState:  status.InFlight,
+	}, {
+		name:       "delivered request",
+		method:     http.MethodDelete,
+		id:         "succeeded",
+		returncode: http.StatusConflict,
+		wantState:  status.Succeeded,
+	}, {
+		name:       "unknown request",
+		method:     http.MethodDelete,
+		id:         "unknown",
+		returncode: http.StatusNotFound,
+	}, {
+		name:       "request of another service",
+		method:     http.MethodDelete,
+		id:         "other-service",
+		returncode: http.StatusNotFound,
+		wantState:  status.Pending,
+	}, {
+		name:       "wrong method",
+		method:     http.MethodGet,
+		id:         "pending",
+		returncode: http.StatusMethodNotAllowed,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handleCancel(rr, httptest.NewRequest(test.method, "http://example.com"+requestsPath+test.id, nil))
+			if rr.Code != test.returncode {
+				t.Fatalf("got %d, want %d", rr.Code, test.returncode)
+			}
+			if test.wantState == "" {
+				return
+			}
+			got, err := statuses.Get(context.Background(), test.id)
+			if err != nil {
+				t.Fatal("Get() =", err)
+			}
+			if got.State != test.wantState {
+				t.Errorf("got state %s, want %s", got.State, test.wantState)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+			var resp status.Status
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatal("Error decoding status:", err)
+			}
+			if resp.ID != test.id || resp.State != status.Cancelled {
+				t.Errorf("got status %+v, want %s cancelled", resp, test.id)
+			}
+		})
+	}
+}
+
+func TestCancelWithoutStatus(t *testing.T) {
+	rr := httptest.NewRecorder()
+	handleCancel(rr, httptest.NewRequest(http.MethodDelete, "http://example.com"+requestsPath+"id", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("got %d, want %d", rr.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,39 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/headers"
+	"knative.dev/async-component/pkg/logkey"
+	"knative.dev/async-component/pkg/status"
+	"knative.dev/pkg/logging"
+)
+
+// indexRequest indexes request id, submitted by the caller of r at
+// submitted, so operators can search it by service and caller. Failures are
+// only logged, as the request is tracked by its status anyway.
+func indexRequest(ctx context.Context, r *http.Request, id string, submitted time.Time) {
+	e := status.IndexEntry{ID: id, Target: r.Header.Get(headers.OriginalHost), Submitted: submitted}
+	if authorizer != nil {
+		e.Subject = authorizer.Subject(r)
+	}
+	if err := status.Index(ctx, statuses, e); err != nil {
+		logging.FromContext(ctx).Warnw("Error indexing request", zap.String(logkey.RequestID, id), zap.Error(err))
+	}
+}
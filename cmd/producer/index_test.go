@@ -0,0 +1,52 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"knative.dev/async-component/pkg/status"
+)
+
+func TestIndex(t *testing.T) {
+	q = &fakeQueue{}
+	env = envInfo{RequestSizeLimit: 25}
+	statuses = status.NewMemory()
+	defer func() { statuses = nil }()
+
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/orders", strings.NewReader("order"))
+	r.Header.Set("Async-Original-Host", "orders.default.svc.cluster.local")
+	rr := httptest.NewRecorder()
+	handleRequest(rr, r)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("got %d, want %d", rr.Code, http.StatusAccepted)
+	}
+	var accepted acceptedResponse
+	if err := json.NewDecoder(rr.Body).Decode(&accepted); err != nil {
+		t.Fatal("Error decoding response:", err)
+	}
+
+	got, err := status.Search(context.Background(), statuses, status.Query{Target: "orders.default.svc.cluster.local"})
+	if err != nil {
+		t.Fatal("Search() =", err)
+	}
+	if len(got) != 1 || got[0].ID != accepted.ID || got[0].Status.State != status.Pending {
+		t.Errorf("Search() = %+v, want pending request %s", got, accepted.ID)
+	}
+}
@@ -14,134 +14,1275 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/bradleypeabody/gouuidv6"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/kelseyhightower/envconfig"
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/async-component/pkg/audit"
+	"knative.dev/async-component/pkg/auth"
+	"knative.dev/async-component/pkg/blob"
+	"knative.dev/async-component/pkg/compression"
+	"knative.dev/async-component/pkg/config"
+	"knative.dev/async-component/pkg/encryption"
+	"knative.dev/async-component/pkg/headers"
+	"knative.dev/async-component/pkg/health"
+	"knative.dev/async-component/pkg/idempotency"
+	"knative.dev/async-component/pkg/logkey"
+	"knative.dev/async-component/pkg/observability"
+	"knative.dev/async-component/pkg/paths"
+	"knative.dev/async-component/pkg/prefer"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/quota"
+	"knative.dev/async-component/pkg/ratelimit"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/async-component/pkg/routing"
+	"knative.dev/async-component/pkg/status"
+	"knative.dev/async-component/pkg/tracing"
+	"knative.dev/async-component/pkg/validation"
+	"knative.dev/pkg/configmap"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/signals"
 )
 
 // Request size limit in bytes.
 const bytesInMB = 1000000
 
-type envInfo struct {
-	StreamName       string `envconfig:"REDIS_STREAM_NAME"`
-	RedisAddress     string `envconfig:"REDIS_ADDRESS"`
-	RequestSizeLimit int64  `envconfig:"REQUEST_SIZE_LIMIT"`
-	TlsCert          string `envconfig:"TLS_CERT"`
-}
+// Requests sharing a value for this header are delivered in order by
+// backends that support it.
+const orderingKeyHeader = "Async-Ordering-Key"
 
-type requestData struct {
-	ID        string              `json:"id"`
-	ReqURL    string              `json:"url"`
-	ReqBody   string              `json:"body"`
-	ReqHeader map[string][]string `json:"header"`
-	ReqMethod string              `json:"method"`
-}
+// Path prefix of the status endpoint, followed by the request ID.
+const statusPath = "/async/status/"
 
-type redisInterface interface {
-	write(ctx context.Context, s envInfo, reqJSON []byte, id string) error
-}
+const (
+	// Header with which callers set the time to live of a request.
+	ttlHeader = "Async-Ttl"
+	// Header carrying the async.knative.dev/ttl annotation of the service,
+	// set by the ingress.
+	serviceTTLHeader = "Async-Service-Ttl"
+	// Header carrying the async.knative.dev/request-size-limit annotation
+	// of the service, set by the ingress.
+	serviceSizeLimitHeader = "Async-Service-Request-Size-Limit"
+	// Header with which callers delay the delivery of a request.
+	delayHeader = "Async-Delay"
+	// Parameter of the respond-async preference delaying the request.
+	delayParam = "delay"
+	// Header with which callers set the time after which a request is not
+	// delivered anymore.
+	deadlineHeader = "Async-Deadline"
+	// Alias of deadlineHeader, used when deadlineHeader is not set.
+	deadlineAliasHeader = "X-Async-Deadline"
+	// Header with which callers set the priority of a request.
+	priorityHeader = "Async-Priority"
+	// Header carrying the async.knative.dev/mode annotation of the service,
+	// set by the ingress.
+	serviceModeHeader = "Async-Service-Mode"
+	// Header carrying the async.knative.dev/paths annotation of services
+	// accepting asynchronous requests on some paths only, set by the ingress.
+	servicePathsHeader = "Async-Service-Paths"
+	// Header stored with requests to the Host they were sent to, with which
+	// the consumer can deliver them to the cluster-local address of their
+	// service.
+	requestHostHeader = "Async-Request-Host"
+)
+
+// Value of serviceModeHeader for always asynchronous services.
+const alwaysMode = "always"
+
+// Seconds after which the duplicates of a request still being accepted are
+// told to try again.
+const idempotencyRetryAfter = 1
+
+// Name of the producer in traces.
+const serviceName = "async-producer"
+
+// Name of the span covering the write of a request to the queue.
+const enqueueSpan = "enqueue"
+
+// Preference asking the ingress to route a request to the service itself.
+const preferSyncValue = "respond-sync"
 
-type myRedis struct {
-	client redis.Cmdable
+// Policies applied when a request cannot be written to the queue.
+const (
+	// policyFail answers with an error.
+	policyFail = "fail"
+	// policyFallbackSync delivers the request synchronously instead.
+	policyFallbackSync = "fallback-sync"
+	// policyRetryThenFail retries the write before answering with an error.
+	policyRetryThenFail = "retry-then-fail"
+)
+
+type envInfo struct {
+	queue.Config
+	queue.BreakerConfig
+	status.StoreConfig
+	audit.AuditConfig
+	blob.StorageConfig
+	idempotency.DedupConfig
+	ratelimit.RateLimitConfig
+	quota.QuotaConfig
+	auth.AuthConfig
+	compression.CompressionConfig
+	encryption.EncryptionConfig
+	headers.FilterConfig
+	routing.RoutingConfig
+	validation.ValidationConfig
+	backpressureConfig
+	RequestSizeLimit int64         `envconfig:"REQUEST_SIZE_LIMIT"`
+	RequestTTL       time.Duration `envconfig:"REQUEST_TTL"`
+	// MaxPriority caps the priority callers can ask for.
+	MaxPriority queue.Priority `envconfig:"MAX_PRIORITY" default:"high"`
+	// ShutdownTimeout bounds how long in-flight requests are waited for on
+	// shutdown.
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"30s"`
+	// ConfigNamespace is the namespace of the config-async ConfigMap. It
+	// is not watched when empty.
+	ConfigNamespace string `envconfig:"CONFIG_NAMESPACE"`
+	// QueueFailurePolicy is applied when a request cannot be queued.
+	QueueFailurePolicy string        `envconfig:"QUEUE_FAILURE_POLICY" default:"fail"`
+	QueueRetries       int           `envconfig:"QUEUE_RETRIES" default:"3"`
+	QueueRetryBackoff  time.Duration `envconfig:"QUEUE_RETRY_BACKOFF" default:"100ms"`
+	// RecordFormat is the format requests are stored in: cloudevents,
+	// protobuf, or json for the format of earlier releases. It stays json
+	// for a release, so consumers of earlier releases still running during
+	// an upgrade can read the requests.
+	RecordFormat string `envconfig:"RECORD_FORMAT" default:"json"`
+	// AccessLog is the format of the access log, common or json. Requests
+	// are not logged when it is empty.
+	AccessLog string `envconfig:"ACCESS_LOG"`
+	// BatchSizeLimit and BatchMaxRequests bound the size in bytes and the
+	// number of requests of a batch.
+	BatchSizeLimit   int64 `envconfig:"BATCH_SIZE_LIMIT" default:"10000000"`
+	BatchMaxRequests int   `envconfig:"BATCH_MAX_REQUESTS" default:"1000"`
+	// AsyncServices opts services in to asynchronous requests, which are
+	// then not queued for other services. SyncServices opts services out.
+	// Both list service hosts, or suffixes of them when starting with "*.".
+	AsyncServices []string `envconfig:"ASYNC_SERVICES"`
+	SyncServices  []string `envconfig:"SYNC_SERVICES"`
+	// ResultRetryAfter is the Retry-After answered to callers asking for the
+	// result of a request that was not delivered yet.
+	ResultRetryAfter time.Duration `envconfig:"RESULT_RETRY_AFTER" default:"5s"`
+	// SyncTimeout bounds the requests delivered synchronously, reading the
+	// response included. They are not bounded when zero.
+	SyncTimeout time.Duration `envconfig:"SYNC_TIMEOUT" default:"5m"`
 }
 
-type TLSConfig struct {
-	TLSCertificate string
+// acceptedResponse is the body of the 202 response, so clients can correlate
+// and look up the request later.
+type acceptedResponse struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
 }
 
+const acceptedStatus = "accepted"
+
 var env envInfo
-var rc redisInterface
+
+// envMu guards env, whose tunables are updated from the config-async
+// ConfigMap. baseEnv is the configuration read from the environment.
+var envMu sync.RWMutex
+var baseEnv envInfo
+var q queue.Queue
+var statuses status.Store
+var auditor *audit.Recorder
+var blobs blob.Store
+var dedup idempotency.Store
+var limiter *ratelimit.Limiter
+var quotas *quota.Tracker
+var authorizer *auth.Authorizer
+var compressor *compression.Compressor
+var encryptor *encryption.Encryptor
+var headerFilter *headers.Filter
+var router *routing.Router
+var validator *validation.Validator
 var now = time.Now
 
 func main() {
+	logger, atomicLevel := observability.NewLogger(serviceName, "")
+
 	// Get env info for queue.
-	err := envconfig.Process("", &env)
-	if err != nil {
-		log.Fatal(err.Error())
+	if err := envconfig.Process("", &env); err != nil {
+		logger.Fatalw("Failed to process the environment", zap.Error(err))
 	}
-
-	// set up redis client
-	roots := x509.NewCertPool()
-	roots.AppendCertsFromPEM([]byte(env.TlsCert))
-	opt, err := redis.ParseURL(env.RedisAddress)
-	opt.TLSConfig = &tls.Config{
-		RootCAs: roots,
+	if env.ConfigNamespace != "" {
+		// The logger is configured by config-logging, and its level updated.
+		logger, atomicLevel = observability.NewLogger(serviceName, env.ConfigNamespace)
+	}
+	defer logger.Sync()
+	if err := validate(env); err != nil {
+		logger.Fatalw("Invalid configuration", zap.Error(err))
+	}
+	if env.StreamName != "" {
+		logger = logger.With(zap.String(logkey.Stream, env.StreamName))
+	}
+	ctx := logging.WithLogger(signals.NewContext(), logger)
+	if err := view.Register(metricViews...); err != nil {
+		logger.Fatalw("Failed to register metrics", zap.Error(err))
+	}
+	updateMetrics := updateMetricsExporter(ctx)
+	updateMetrics(&corev1.ConfigMap{})
+	tracer := tracing.New(ctx, serviceName)
+	if env.ConfigNamespace != "" {
+		baseEnv = env
+		watchers := observability.Watchers(ctx, serviceName, atomicLevel, updateMetrics)
+		watchers[config.Name] = func(cm *corev1.ConfigMap) { applyConfig(ctx, cm) }
+		watchers[tracing.ConfigName] = tracer.ApplyConfig
+		if err := config.WatchAll(ctx, env.ConfigNamespace, watchers); err != nil {
+			logger.Fatalw("Failed to watch the configuration", zap.Error(err))
+		}
 	}
 
-	rc = &myRedis{
-		client: redis.NewClient(opt),
+	// set up the queue client, with a queue per route
+	var err error
+	router, err = routing.New(env.RoutingConfig)
+	if err != nil {
+		logger.Fatalw("Failed to create router", zap.Error(err))
+	}
+	if router != nil {
+		q, err = queue.NewRouted(context.Background(), env.Config, router.Routes())
+	} else {
+		q, err = queue.New(context.Background(), env.Config)
+	}
+	if err != nil {
+		logger.Fatalw("Failed to create queue client", zap.Error(err))
+	}
+	// The usage of the quotas and the backlog are read from the queue
+	// itself, which the breaker does not list.
+	quotas = quota.NewTracker(q, env.QuotaScanLimit)
+	if env.QuotaRefresh > 0 {
+		go quotas.Run(ctx, env.QuotaRefresh, func() bool { return current().QuotaConfig.Enabled() })
+	}
+	backlog = newBacklogWatcher(q)
+	if env.BackpressureRefresh > 0 {
+		go backlog.run(ctx, func() backpressureConfig { return current().backpressureConfig })
+	}
+	if env.BreakerFailureThreshold > 0 {
+		q = queue.NewBreaker(q, env.BreakerConfig)
+	}
+	statuses, err = status.New(env.StoreConfig, env.RedisConfig)
+	if err != nil {
+		logger.Fatalw("Failed to create status store", zap.Error(err))
+	}
+	auditor, err = audit.New(env.AuditConfig, env.RedisConfig, auditComponent)
+	if err != nil {
+		logger.Fatalw("Failed to create audit recorder", zap.Error(err))
+	}
+	blobs, err = blob.New(env.StorageConfig, env.RedisConfig)
+	if err != nil {
+		logger.Fatalw("Failed to create blob store", zap.Error(err))
+	}
+	dedup, err = idempotency.New(context.Background(), env.DedupConfig, env.RedisConfig)
+	if err != nil {
+		logger.Fatalw("Failed to create idempotency store", zap.Error(err))
+	}
+	limiter, err = ratelimit.New(env.RateLimitConfig)
+	if err != nil {
+		logger.Fatalw("Failed to create rate limiter", zap.Error(err))
+	}
+	authorizer, err = auth.New(env.AuthConfig)
+	if err != nil {
+		logger.Fatalw("Failed to create authorizer", zap.Error(err))
+	}
+	compressor, err = compression.New(env.CompressionConfig)
+	if err != nil {
+		logger.Fatalw("Failed to create body compressor", zap.Error(err))
+	}
+	encryptor, err = encryption.New(env.EncryptionConfig)
+	if err != nil {
+		logger.Fatalw("Failed to create request encryptor", zap.Error(err))
+	}
+	headerFilter = headers.NewFilter(env.FilterConfig)
+	validator, err = validation.New(env.ValidationConfig)
+	if err != nil {
+		logger.Fatalw("Failed to create request validator", zap.Error(err))
 	}
 
 	// Start an HTTP Server,
 	http.HandleFunc("/", handleRequest)
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	http.HandleFunc(statusPath, handleStatus)
+	http.HandleFunc(batchPath, handleBatch)
+	http.HandleFunc(requestsPath, handleCancel)
+	http.HandleFunc(resultsPath, handleResult)
+	http.Handle(health.LivenessPath, probe(health.Liveness()))
+	http.Handle(health.ReadinessPath, probe(health.Readiness(func(ctx context.Context) error {
+		return queue.CheckHealth(ctx, q, false)
+	})))
+	l, err := net.Listen("tcp", ":8080")
+	if err != nil {
+		logger.Fatalw("Failed to listen", zap.Error(err))
+	}
+	// Requests are handled with the logger of ctx, but must not be canceled
+	// with it while draining.
+	server := newServer(accessLog(traced(ingressServiceHeaders(http.DefaultServeMux))))
+	server.BaseContext = func(net.Listener) context.Context {
+		return logging.WithLogger(context.Background(), logger)
+	}
+	if err := serve(ctx, server, l, env.ShutdownTimeout); err != nil {
+		logger.Fatalw("Failed to serve", zap.Error(err))
+	}
+
+	// Flush the requests buffered by the clients before exiting.
+	if err := q.Close(); err != nil {
+		logger.Errorw("Error closing queue client", zap.Error(err))
+	}
+	if statuses != nil {
+		if err := statuses.Close(); err != nil {
+			logger.Errorw("Error closing status store", zap.Error(err))
+		}
+	}
+	if dedup != nil {
+		if err := dedup.Close(); err != nil {
+			logger.Errorw("Error closing idempotency store", zap.Error(err))
+		}
+	}
+	if auditor != nil {
+		if err := auditor.Close(); err != nil {
+			logger.Errorw("Error closing audit recorder", zap.Error(err))
+		}
+	}
+	if err := tracer.Close(); err != nil {
+		logger.Errorw("Error closing tracer", zap.Error(err))
+	}
+}
+
+// traced returns h continuing the W3C trace context of the requests, except
+// for the probes of the kubelet.
+func traced(h http.Handler) http.Handler {
+	return &ochttp.Handler{
+		Handler:          h,
+		Propagation:      &tracecontext.HTTPFormat{},
+		IsHealthEndpoint: isProbe,
+	}
+}
+
+// isProbe reports whether r is a probe of the kubelet rather than a request
+// routed by the ingress.
+func isProbe(r *http.Request) bool {
+	return r.Header.Get(headers.OriginalHost) == "" &&
+		(r.URL.Path == health.LivenessPath || r.URL.Path == health.ReadinessPath)
+}
+
+// probe returns a handler serving h to the kubelet. Requests routed by the
+// ingress carry the Async-Original-Host header and are requests to the
+// service that happen to use the same path.
+func probe(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(headers.OriginalHost) != "" {
+			handleRequest(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// newServer returns a server for h, accepting HTTP/1 as well as HTTP/2 over
+// cleartext (h2c), which the ingress may forward.
+func newServer(h http.Handler) *http.Server {
+	return &http.Server{Handler: h2c.NewHandler(h, &http2.Server{})}
+}
+
+// serve runs server on l until ctx is done. It then stops accepting
+// connections and waits up to timeout for in-flight requests to be enqueued,
+// so rolling updates don't drop requests.
+func serve(ctx context.Context, server *http.Server, l net.Listener, timeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(l)
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	logging.FromContext(ctx).Info("Shutting down, draining in-flight requests")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to drain in-flight requests: %w", err)
+	}
+	return nil
+}
+
+// current returns the configuration in effect.
+func current() envInfo {
+	envMu.RLock()
+	defer envMu.RUnlock()
+	return env
+}
+
+// validate checks the settings that cannot be checked by envconfig.
+func validate(e envInfo) error {
+	if _, err := queue.ParsePriority(string(e.MaxPriority)); err != nil {
+		return fmt.Errorf("invalid max priority: %w", err)
+	}
+	switch e.QueueFailurePolicy {
+	case policyFail, policyFallbackSync, policyRetryThenFail:
+	default:
+		return fmt.Errorf("invalid queue failure policy %q", e.QueueFailurePolicy)
+	}
+	if err := request.CheckFormat(e.RecordFormat); err != nil {
+		return err
+	}
+	if err := e.QuotaConfig.Validate(); err != nil {
+		return err
+	}
+	if err := e.backpressureConfig.validate(); err != nil {
+		return err
+	}
+	return checkAccessLog(e.AccessLog)
+}
+
+// applyConfig updates the tunables from the config-async ConfigMap. Settings
+// missing from it fall back to the environment. An invalid ConfigMap is
+// ignored and the configuration in effect is kept.
+func applyConfig(ctx context.Context, cm *corev1.ConfigMap) {
+	next := baseEnv
+	err := configmap.Parse(cm.Data,
+		configmap.AsInt64("request-size-limit", &next.RequestSizeLimit),
+		configmap.AsDuration("request-ttl", &next.RequestTTL),
+		configmap.AsString("max-priority", (*string)(&next.MaxPriority)),
+		configmap.AsString("queue-failure-policy", &next.QueueFailurePolicy),
+		configmap.AsInt("queue-retries", &next.QueueRetries),
+		configmap.AsDuration("queue-retry-backoff", &next.QueueRetryBackoff),
+		configmap.AsDuration("sync-timeout", &next.SyncTimeout),
+		configmap.AsString("access-log", &next.AccessLog),
+		configmap.AsInt64("quota-max-pending-requests", &next.QuotaMaxPendingRequests),
+		configmap.AsInt64("quota-max-stored-bytes", &next.QuotaMaxStoredBytes),
+		quota.AsNamespaces("quota-namespaces", &next.QuotaNamespaces),
+		configmap.AsInt64("backpressure-max-depth", &next.BackpressureMaxDepth),
+		configmap.AsDuration("backpressure-refresh", &next.BackpressureRefresh),
+		configmap.AsDuration("backpressure-retry-after", &next.BackpressureRetryAfter),
+	)
+	if err == nil {
+		err = validate(next)
+	}
+	logger := logging.FromContext(ctx)
+	if err != nil {
+		logger.Errorw("Error applying "+config.Name+", keeping the current configuration", zap.Error(err))
+		return
+	}
+	envMu.Lock()
+	env = next
+	envMu.Unlock()
+	logger.Info("Applied " + config.Name)
 }
 
 // Handle requests coming to producer service by error checking and writing to storage.
 func handleRequest(w http.ResponseWriter, r *http.Request) {
-	// Check that body length doesn't exceed limit.
-	r.Body = http.MaxBytesReader(w, r.Body, env.RequestSizeLimit)
-	// read the request body
-	b, err := ioutil.ReadAll(r.Body)
+	// Always asynchronous services are reached synchronously with the
+	// respond-sync preference. The ingress only routes the exact header to
+	// the service, so preferences combined with others land here.
+	if r.Header.Get(serviceModeHeader) == alwaysMode && prefer.Parse(r.Header).Has(preferSyncValue) {
+		passThrough(w, r)
+		return
+	}
+	// The ingress routes the paths of services restricting asynchronous
+	// requests by prefix, the others are answered synchronously.
+	if !asyncPath(r) {
+		logging.FromContext(r.Context()).Infow("Asynchronous requests not enabled for the path",
+			zap.String(logkey.Host, r.Header.Get(headers.OriginalHost)), zap.String("path", r.URL.Path))
+		passThrough(w, r)
+		return
+	}
+	// Services that did not opt in are answered as if the preference had
+	// not been given.
+	if !asyncEnabled(current(), r.Header.Get(headers.OriginalHost)) {
+		logging.FromContext(r.Context()).Infow("Asynchronous requests not enabled for the service",
+			zap.String(logkey.Host, r.Header.Get(headers.OriginalHost)))
+		passThrough(w, r)
+		return
+	}
+	// Untrusted callers are turned away before anything is stored, or
+	// counted against the rate limit of the service.
+	if authorizer != nil {
+		if err := authorizer.Authorize(r); err != nil {
+			denied(w, r, err)
+			return
+		}
+	}
+	if limiter != nil {
+		if ok, retry := limiter.Allow(limiter.Key(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+	}
+	if backpressure(w, r) {
+		return
+	}
+	id := gouuidv6.NewFromTime(now()).String()
+	originalHost := r.Header.Get(headers.OriginalHost)
+	logger := logging.FromContext(r.Context()).With(zap.String(logkey.RequestID, id), zap.String(logkey.Host, originalHost))
+	r = r.WithContext(logging.WithLogger(r.Context(), logger))
+	setAccessLogID(r.Context(), id)
+	ttl, err := requestTTL(r.Header)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Infow("Invalid request TTL", zap.Error(err))
+		return
+	}
+	delay, err := requestDelay(r.Header)
 	if err != nil {
-		if err.Error() == "http: request body too large" {
-			log.Println("HTTP Request body too large ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Infow("Invalid request delay", zap.Error(err))
+		return
+	}
+	deliverAt := now().Add(delay)
+	deadline, err := requestDeadline(r.Header, deliverAt)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		logger.Infow("Invalid request deadline", zap.Error(err))
+		return
+	}
+	priority, err := requestPriority(r.Header)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Infow("Invalid request priority", zap.Error(err))
+		return
+	}
+	limit, err := requestSizeLimit(r.Header)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Infow("Invalid request size limit", zap.Error(err))
+		return
+	}
+
+	// Answer duplicate submissions with the ID of the original request, once
+	// it was accepted.
+	accepted := false
+	if key := r.Header.Get(idempotency.Header); key != "" && dedup != nil {
+		// Keys are scoped to the service they were sent to.
+		key = originalHost + "/" + key
+		existing, claimed, err := dedup.ClaimPending(r.Context(), key, id)
+		if errors.Is(err, idempotency.ErrPending) {
+			// The original may still fail, so its ID cannot be answered.
+			w.Header().Set("Retry-After", strconv.Itoa(idempotencyRetryAfter))
+			w.WriteHeader(http.StatusConflict)
+			logger.Infow("Duplicate of a request being accepted", zap.String("originalRequestID", existing))
+			return
+		} else if err != nil {
+			recordStorageError(r.Context(), storeIdempotency)
 			w.WriteHeader(http.StatusInternalServerError)
-		} else {
-			log.Println("Error writing to buffer: ", err)
+			logger.Errorw("Error checking idempotency key", zap.Error(err))
+			return
+		}
+		if !claimed {
+			logger.Infow("Duplicate request accepted", zap.String("originalRequestID", existing))
+			writeAccepted(w, r, existing)
+			return
+		}
+		defer func() {
+			if accepted {
+				if err := dedup.Confirm(context.Background(), key, id); err != nil {
+					recordStorageError(r.Context(), storeIdempotency)
+					logger.Errorw("Error confirming idempotency key", zap.Error(err))
+				}
+				return
+			}
+			if err := dedup.Release(context.Background(), key); err != nil {
+				logger.Errorw("Error releasing idempotency key", zap.Error(err))
+			}
+		}()
+	}
+
+	var reqBodyString, reqBodyRef string
+	if blobs == nil {
+		// Check that body length doesn't exceed limit.
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		// read the request body
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			if err.Error() == "http: request body too large" {
+				recordBodyTooLarge(r.Context())
+				logger.Infow("HTTP Request body too large", zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+			} else {
+				logger.Errorw("Error writing to buffer", zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+		if !validRequest(w, r, b) {
+			return
+		}
+		reqBodyString = string(b)
+	} else {
+		// Bodies over the limit are streamed to object storage instead, up
+		// to BLOB_MAX_SIZE.
+		maxSize := current().BlobMaxSize
+		if maxSize > 0 && r.ContentLength > maxSize {
+			recordBodyTooLarge(r.Context())
+			logger.Infow("HTTP Request body too large to offload", zap.Int64("size", r.ContentLength))
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+		if err != nil {
+			logger.Errorw("Error writing to buffer", zap.Error(err))
 			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// Offloaded bodies are streamed, so they are not checked.
+		offload := int64(len(b)) > limit
+		checked := b
+		if offload {
+			checked = nil
+		}
+		if !validRequest(w, r, checked) {
+			return
+		}
+		if !offload {
+			reqBodyString = string(b)
+		} else {
+			var body io.Reader = io.MultiReader(bytes.NewReader(b), r.Body)
+			limited := &maxSizeReader{r: body, remaining: maxSize}
+			if maxSize > 0 {
+				body = limited
+			}
+			reqBodyRef, err = blobs.Put(r.Context(), id, body)
+			if limited.exceeded {
+				recordBodyTooLarge(r.Context())
+				logger.Infow("HTTP Request body too large to offload", zap.Error(err))
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				recordStorageError(r.Context(), storeBlob)
+				logger.Errorw("Error offloading request body", zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			// The body is only kept with the request it belongs to.
+			defer func() {
+				if accepted {
+					return
+				}
+				if err := blobs.Delete(context.Background(), reqBodyRef); err != nil {
+					logger.Errorw("Error deleting request body", zap.Error(err))
+				}
+			}()
 		}
-		return
 	}
-	reqBodyString := string(b)
-	id := gouuidv6.NewFromTime(now()).String()
-	originalHost := r.Header.Get("Async-Original-Host")
-	reqData := requestData{
-		ID:        id,
-		ReqBody:   reqBodyString,
-		ReqURL:    "http://" + originalHost + r.URL.String(),
-		ReqHeader: r.Header,
-		ReqMethod: r.Method,
+	reqData := request.Data{
+		ID:         id,
+		ReqBody:    reqBodyString,
+		ReqBodyRef: reqBodyRef,
+		ReqURL:     requestScheme(r) + "://" + originalHost + r.URL.String(),
+		ReqHeader:  storedHeader(r),
+		ReqMethod:  r.Method,
+		Deadline:   deadline,
 	}
-	reqJSON, err := json.Marshal(reqData)
+	// The TTL of delayed requests starts when they become deliverable.
+	if ttl > 0 {
+		expires := deliverAt.Add(ttl)
+		reqData.ExpiresAt = &expires
+	}
+	// The consumer continues the trace from the enqueue span.
+	ctx, span := trace.StartSpan(r.Context(), enqueueSpan)
+	record, err := marshalStored(reqData, tracing.TraceParent(span.SpanContext()))
 	if err != nil {
+		span.End()
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Println("Failed to marshal request: ", err)
+		logger.Errorw("Failed to marshal request", zap.Error(err))
+		return
+	}
+
+	// Requests over the quota of the namespace are turned away.
+	usage := int64(len(record))
+	if reqBodyRef != "" && r.ContentLength > 0 {
+		usage += r.ContentLength
+	}
+	release, ok := reserveQuota(w, r, originalHost, 1, usage)
+	if !ok {
+		span.End()
 		return
 	}
+	defer func() {
+		if !accepted {
+			release()
+		}
+	}()
+
+	// Record the status first, the consumer may pick the request up at once.
+	if statuses != nil {
+		if err := statuses.Set(ctx, status.Status{ID: id, State: status.Pending, Host: originalHost, Updated: now()}); err != nil {
+			span.End()
+			recordStorageError(ctx, storeStatus)
+			logger.Errorw("Error writing request status", zap.Error(err))
+			storageFailed(w, r, reqData, delay)
+			return
+		}
+		indexRequest(ctx, r, id, now())
+	}
 
 	// Write the request information to the storage.
-	if err = rc.write(r.Context(), env, reqJSON, reqData.ID); err != nil {
+	if key := r.Header.Get(orderingKeyHeader); key != "" {
+		ctx = queue.WithOrderingKey(ctx, key)
+	}
+	if delay > 0 {
+		ctx = queue.WithDeliverAt(ctx, deliverAt)
+	}
+	ctx = queue.WithPriority(ctx, priority)
+	ctx = queue.WithShardKey(ctx, originalHost)
+	if router != nil {
+		ctx = queue.WithRoute(ctx, router.Route(r))
+	}
+	start := now()
+	err = enqueue(ctx, reqData.ID, record)
+	recordEnqueue(ctx, start, err)
+	if err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnavailable, Message: err.Error()})
+	}
+	span.End()
+	if errors.Is(err, queue.ErrDelayNotSupported) {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Infow("Cannot delay request", zap.Error(err))
+		return
+	} else if err != nil {
+		logger.Errorw("Error writing request to the queue", zap.Error(err))
+		storageFailed(w, r, reqData, delay)
+		return
+	}
+	logger.Info("Request accepted")
+	recordRequest(ctx, resultAccepted)
+	auditRequest(r, audit.Submitted, id, r.Method, r.URL.Path)
+	accepted = true
+	writeAccepted(w, r, id)
+}
+
+// errBodyTooLarge is returned by maxSizeReader past its limit.
+var errBodyTooLarge = errors.New("request body too large")
+
+// maxSizeReader reads up to remaining bytes from r, and fails past them.
+type maxSizeReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	if m.exceeded {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > m.remaining+1 {
+		p = p[:m.remaining+1]
+	}
+	n, err := m.r.Read(p)
+	if int64(n) > m.remaining {
+		m.exceeded = true
+		return int(m.remaining), errBodyTooLarge
+	}
+	m.remaining -= int64(n)
+	return n, err
+}
+
+// validRequest checks r and its body with the validation rules, answering
+// the request when it is invalid.
+func validRequest(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	if validator == nil {
+		return true
+	}
+	err := validator.Validate(r, body)
+	if err == nil {
+		return true
+	}
+	if errors.Is(err, validation.ErrUnsupportedMediaType) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	// The reason is returned to the caller, to fix the request.
+	w.Write([]byte(err.Error()))
+	logging.FromContext(r.Context()).Infow("Invalid request", zap.Error(err))
+	return false
+}
+
+// denied answers a request the caller could not be authorized for.
+func denied(w http.ResponseWriter, r *http.Request, err error) {
+	logger := logging.FromContext(r.Context()).With(zap.String(logkey.Host, r.Header.Get(headers.OriginalHost)))
+	switch {
+	case errors.Is(err, auth.ErrUnauthenticated):
+		if current().AuthMode == auth.ModeJWT {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		logger.Infow("Request not authenticated", zap.Error(err))
+	case errors.Is(err, auth.ErrForbidden):
+		w.WriteHeader(http.StatusForbidden)
+		logger.Infow("Request not authorized", zap.Error(err))
+	default:
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Println("Error asynchronous writing request to storage ", err)
+		logger.Errorw("Error authorizing request", zap.Error(err))
+	}
+}
+
+// marshalStored returns the record of data written to the queue. Only the
+// stored copy is filtered, compressed and encrypted, fallback-sync uses data.
+func marshalStored(data request.Data, traceParent string) ([]byte, error) {
+	if headerFilter != nil {
+		data.ReqHeader = headerFilter.Apply(data.ReqHeader)
+	}
+	if compressor != nil {
+		var err error
+		if data.ReqBody, data.ReqBodyEncoding, err = compressor.Compress(data.ReqBody); err != nil {
+			return nil, fmt.Errorf("failed to compress request body: %w", err)
+		}
+	}
+	if encryptor != nil {
+		if err := encryptor.Seal(&data); err != nil {
+			return nil, fmt.Errorf("failed to encrypt request: %w", err)
+		}
+	}
+	enqueuedAt := now()
+	data.TraceParent = traceParent
+	data.EnqueuedAt = &enqueuedAt
+	return request.Marshal(data, current().RecordFormat, enqueuedAt)
+}
+
+// enqueue writes the request to the queue. Under the retry-then-fail policy
+// failed writes are retried with an exponential backoff, unless the circuit
+// breaker is open.
+func enqueue(ctx context.Context, id string, data []byte) error {
+	return withRetries(ctx, func() error {
+		return q.Enqueue(ctx, id, data)
+	})
+}
+
+// withRetries runs write, retrying it under the retry-then-fail policy, and
+// counts backend errors.
+func withRetries(ctx context.Context, write func() error) error {
+	err := countStorageError(ctx, write())
+	cfg := current()
+	if cfg.QueueFailurePolicy != policyRetryThenFail {
+		return err
+	}
+	backoff := cfg.QueueRetryBackoff
+	for i := 0; i < cfg.QueueRetries && err != nil && !callerError(err) && !errors.Is(err, queue.ErrCircuitOpen); i++ {
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+		err = countStorageError(ctx, write())
+	}
+	return err
+}
+
+// callerError reports whether a write failed because of what the caller
+// asked for, rather than because of the backend.
+func callerError(err error) bool {
+	return errors.Is(err, queue.ErrDelayNotSupported) || errors.Is(err, queue.ErrBatchNotSupported)
+}
+
+// countStorageError counts err if it is a backend error, and returns it.
+func countStorageError(ctx context.Context, err error) error {
+	if err != nil && !callerError(err) && !errors.Is(err, queue.ErrCircuitOpen) {
+		recordStorageError(ctx, storeQueue)
+	}
+	return err
+}
+
+// storageFailed answers a request that could not be stored. Under the
+// fallback-sync policy it is delivered synchronously, unless it was delayed.
+func storageFailed(w http.ResponseWriter, r *http.Request, data request.Data, delay time.Duration) {
+	if current().QueueFailurePolicy == policyFallbackSync && delay == 0 {
+		proxySync(w, r, data)
+		return
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+// proxySync delivers the request to the service as the consumer would and
+// relays the response. Requests received over HTTP/2 are sent over HTTP/2,
+// so services speaking h2c only, such as gRPC ones, are reached.
+func proxySync(w http.ResponseWriter, r *http.Request, data request.Data) {
+	logger := logging.FromContext(r.Context())
+	var body io.Reader = strings.NewReader(data.ReqBody)
+	if data.ReqBodyRef != "" {
+		rc, err := blobs.Get(context.Background(), data.ReqBodyRef)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			logger.Errorw("Error fetching request body", zap.Error(err))
+			return
+		}
+		defer func() {
+			rc.Close()
+			if err := blobs.Delete(context.Background(), data.ReqBodyRef); err != nil {
+				logger.Errorw("Error deleting request body", zap.Error(err))
+			}
+		}()
+		body = rc
+	}
+	deliverSync(w, r, data, body)
+}
+
+// asyncEnabled reports whether requests to the service at host may be
+// queued: it is listed in ASYNC_SERVICES, if set, and not in SYNC_SERVICES.
+func asyncEnabled(cfg envInfo, host string) bool {
+	if len(cfg.AsyncServices) > 0 && !matchesHost(cfg.AsyncServices, host) {
+		return false
+	}
+	return !matchesHost(cfg.SyncServices, host)
+}
+
+// asyncPath reports whether the path of r is one of the paths set by
+// servicePathsHeader, if any.
+func asyncPath(r *http.Request) bool {
+	value := r.Header.Get(servicePathsHeader)
+	if value == "" {
+		return true
+	}
+	filter, err := paths.Parse(value)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorw("Invalid "+servicePathsHeader+" header", zap.Error(err))
+		return false
+	}
+	return filter.Match(r.URL.Path)
+}
+
+// matchesHost reports whether host is one of hosts, or has the suffix of one
+// of them starting with "*.".
+func matchesHost(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if strings.HasPrefix(h, "*.") {
+			if strings.HasSuffix(host, h[1:]) {
+				return true
+			}
+		} else if strings.EqualFold(host, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// passThrough delivers a request the caller wants answered synchronously to
+// the service, streaming its body.
+func passThrough(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context()).With(zap.String(logkey.Host, r.Header.Get(headers.OriginalHost)))
+	r = r.WithContext(logging.WithLogger(r.Context(), logger))
+	deliverSync(w, r, request.Data{
+		ReqURL:    requestScheme(r) + "://" + r.Header.Get(headers.OriginalHost) + r.URL.String(),
+		ReqHeader: withoutHopHeaders(r.Header),
+		ReqMethod: r.Method,
+	}, r.Body)
+}
+
+// deliverSync sends the request described by data, with body, to the
+// service and relays the response, within SYNC_TIMEOUT and for as long as the
+// caller waits. The status of queued requests is recorded.
+func deliverSync(w http.ResponseWriter, r *http.Request, data request.Data, body io.Reader) {
+	logger := logging.FromContext(r.Context())
+	ctx := r.Context()
+	if timeout := current().SyncTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, data.ReqMethod, data.ReqURL, body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		logger.Errorw("Error creating synchronous request", zap.Error(err))
+		return
+	}
+	req.Header = http.Header(data.ReqHeader).Clone()
+	// Keep the ingress from routing the request back to the producer.
+	req.Header.Set(prefer.Header, preferSyncValue)
+	client := syncClient
+	if r.ProtoMajor == 2 && req.URL.Scheme == "http" {
+		client = h2cClient
+	}
+	resp, err := client.Do(req)
+	if errors.Is(err, context.DeadlineExceeded) {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		logger.Errorw("Timeout delivering request synchronously", zap.Error(err))
 		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		logger.Errorw("Error delivering request synchronously", zap.Error(err))
+		return
+	}
+	defer resp.Body.Close()
+	logger.Info("Request delivered synchronously")
+	recordRequest(r.Context(), resultProxied)
+	if statuses != nil && data.ID != "" {
+		st := status.Status{ID: data.ID, State: status.Succeeded, Host: r.Header.Get(headers.OriginalHost), StatusCode: resp.StatusCode, Updated: now()}
+		if resp.StatusCode >= http.StatusBadRequest {
+			st.State, st.Reason = status.Failed, resp.Status
+		}
+		if err := statuses.Set(context.Background(), st); err != nil {
+			recordStorageError(r.Context(), storeStatus)
+			logger.Errorw("Error writing request status", zap.Error(err))
+		}
+	}
+	for k, v := range withoutHopHeaders(resp.Header) {
+		w.Header()[k] = v
 	}
-	log.Println("request accepted")
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		logger.Errorw("Error relaying response", zap.Error(err))
+	}
+	// Trailers, such as the status of gRPC calls, are known once the body
+	// has been read.
+	for k, v := range resp.Trailer {
+		w.Header()[http.TrailerPrefix+k] = v
+	}
+}
+
+// syncClient sends the requests delivered synchronously, with a transport of
+// its own.
+var syncClient = &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+
+// h2cClient sends requests over HTTP/2 with prior knowledge, without TLS.
+var h2cClient = &http.Client{Transport: &http2.Transport{
+	AllowHTTP: true,
+	DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+		return net.Dial(network, addr)
+	},
+}}
+
+// Headers that only apply to a single connection, and are not forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Http2-Settings",
+}
+
+// withoutHopHeaders returns a copy of h without the hop-by-hop headers, nor
+// those listed in its Connection header. "TE: trailers" is kept, gRPC
+// requires it.
+func withoutHopHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	teTrailers := strings.EqualFold(h.Get("Te"), "trailers")
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+	if teTrailers {
+		h.Set("Te", "trailers")
+	}
+	return h
+}
+
+// storedHeader returns the headers of r stored with the request: its
+// end-to-end headers and the Host it was sent to.
+func storedHeader(r *http.Request) http.Header {
+	h := withoutHopHeaders(r.Header)
+	h.Set(requestHostHeader, r.Host)
+	return h
+}
+
+// writeAccepted writes the 202 response for request id.
+func writeAccepted(w http.ResponseWriter, r *http.Request, id string) {
+	logger := logging.FromContext(r.Context())
+	if statuses != nil {
+		w.Header().Set("Location", statusPath+id)
+	}
+	if prefer.Parse(r.Header).Has(prefer.RespondAsync) {
+		w.Header().Set(prefer.AppliedHeader, prefer.RespondAsync)
+	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
-	return
+	if err := json.NewEncoder(w).Encode(acceptedResponse{ID: id, Status: acceptedStatus}); err != nil {
+		logger.Errorw("Error writing accepted response", zap.Error(err))
+	}
 }
 
-// Function to write to Redis stream.
-func (mr *myRedis) write(ctx context.Context, s envInfo, reqJSON []byte, id string) (err error) {
-	strCMD := mr.client.XAdd(ctx, &redis.XAddArgs{
-		Stream: s.StreamName,
-		Values: map[string]interface{}{
-			"data": reqJSON,
-		},
-	})
-	if strCMD.Err() != nil {
-		return fmt.Errorf("failed to publish %q: %v", id, strCMD.Err())
+// requestTTL returns how long the request may wait in the queue: the TTL
+// given by the caller, else the one of the service, else REQUEST_TTL. TTLs
+// are either a number of seconds or a duration such as "1h30m". Zero means
+// the request never expires.
+func requestTTL(h http.Header) (time.Duration, error) {
+	for _, header := range []string{ttlHeader, serviceTTLHeader} {
+		if v := h.Get(header); v != "" {
+			d, err := parseDuration(v)
+			if err != nil {
+				return 0, fmt.Errorf("invalid %s header: %w", header, err)
+			}
+			return d, nil
+		}
+	}
+	return current().RequestTTL, nil
+}
+
+// requestSizeLimit returns the size limit of the request body in bytes: the
+// limit of the service, set with the async.knative.dev/request-size-limit
+// annotation, or REQUEST_SIZE_LIMIT.
+func requestSizeLimit(h http.Header) (int64, error) {
+	v := h.Get(serviceSizeLimitHeader)
+	if v == "" {
+		return current().RequestSizeLimit, nil
+	}
+	limit, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("invalid %s header %q", serviceSizeLimitHeader, v)
+	}
+	return limit, nil
+}
+
+// requestDelay returns how long the delivery of the request is delayed, as
+// given by the delay parameter of the respond-async preference or the
+// Async-Delay header, in the same formats as TTLs.
+func requestDelay(h http.Header) (time.Duration, error) {
+	v := h.Get(delayHeader)
+	if pref, ok := prefer.Parse(h).Get(prefer.RespondAsync); ok && pref.Params[delayParam] != "" {
+		v = pref.Params[delayParam]
+	}
+	if v == "" {
+		return 0, nil
+	}
+	d, err := parseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid delay: %w", err)
+	}
+	return d, nil
+}
+
+// requestDeadline returns the deadline set with the Async-Deadline header,
+// or else its X-Async-Deadline alias, as an RFC 3339 time, or nil. Deadlines
+// must be after deliverAt, the time the request becomes deliverable.
+func requestDeadline(h http.Header, deliverAt time.Time) (*time.Time, error) {
+	name := deadlineHeader
+	v := h.Get(name)
+	if v == "" {
+		name = deadlineAliasHeader
+		v = h.Get(name)
+	}
+	if v == "" {
+		return nil, nil
+	}
+	deadline, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header %q, want an RFC 3339 time", name, v)
+	}
+	if !deadline.After(deliverAt) {
+		return nil, fmt.Errorf("the %s %s passes before the request can be delivered", name, v)
+	}
+	return &deadline, nil
+}
+
+// requestPriority returns the priority asked for with the Async-Priority
+// header, capped to MAX_PRIORITY.
+func requestPriority(h http.Header) (queue.Priority, error) {
+	v := h.Get(priorityHeader)
+	if v == "" {
+		return queue.PriorityNormal, nil
+	}
+	p, err := queue.ParsePriority(v)
+	if err != nil {
+		return "", err
+	}
+	if max := current().MaxPriority; max != "" {
+		p = p.Cap(max)
+	}
+	return p, nil
+}
+
+// parseDuration parses a positive number of seconds or a duration such as
+// "1h30m".
+func parseDuration(v string) (time.Duration, error) {
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%q is not a positive number of seconds or duration", v)
+	}
+	return d, nil
+}
+
+// requestScheme returns the scheme the client used, as reported by the proxy
+// in front of the producer or by the TLS state of the connection.
+func requestScheme(r *http.Request) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		// Proxies may append to the header, the first value is the client's.
+		proto = strings.TrimSpace(strings.SplitN(proto, ",", 2)[0])
+		if strings.EqualFold(proto, "https") {
+			return "https"
+		}
+		return "http"
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// Handle status requests by returning the status recorded for the request ID
+// in the path, result included, to the callers allowed to send requests.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if statuses == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if authorizer != nil {
+		if err := authorizer.Authorize(r); err != nil {
+			denied(w, r, err)
+			return
+		}
+	}
+	id := strings.TrimPrefix(r.URL.Path, statusPath)
+	logger := logging.FromContext(r.Context()).With(zap.String(logkey.RequestID, id))
+	s, ok := requestStatus(w, r, id)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		logger.Errorw("Error writing status response", zap.Error(err))
+	}
+}
+
+// requestStatus returns the status of request id, answering r when it cannot
+// be read. Requests sent to another service than r are not found, so callers
+// only see the requests of the service they call.
+func requestStatus(w http.ResponseWriter, r *http.Request, id string) (status.Status, bool) {
+	s, err := statuses.Get(r.Context(), id)
+	if errors.Is(err, status.ErrNotFound) || (err == nil && s.Host != r.Header.Get(headers.OriginalHost)) {
+		w.WriteHeader(http.StatusNotFound)
+		return status.Status{}, false
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Errorw("Error reading request status", zap.String(logkey.RequestID, id), zap.Error(err))
+		return status.Status{}, false
 	}
-	return
+	return s, true
 }
@@ -14,18 +14,39 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/go-redis/redis/v8"
+	"go.opencensus.io/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/async-component/pkg/auth"
+	"knative.dev/async-component/pkg/compression"
+	"knative.dev/async-component/pkg/encryption"
+	"knative.dev/async-component/pkg/headers"
+	"knative.dev/async-component/pkg/idempotency"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/ratelimit"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/async-component/pkg/routing"
+	"knative.dev/async-component/pkg/status"
+	"knative.dev/async-component/pkg/tracing"
+	"knative.dev/async-component/pkg/validation"
 )
 
-type fakeRedis struct {
-	client redis.Cmdable
-}
+type fakeQueue struct{}
 
 func TestHandleRequest(t *testing.T) {
 	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -33,7 +54,7 @@ func TestHandleRequest(t *testing.T) {
 			t.Errorf("Expected 'POST' OR 'GET' request, got '%s'", r.Method)
 		}
 	}))
-	setupRedis()
+	q = &fakeQueue{}
 
 	tests := []struct {
 		name             string
@@ -41,12 +62,20 @@ func TestHandleRequest(t *testing.T) {
 		method           string
 		body             string
 		contentLengthSet bool
+		prefer           string
 		returncode       int
+		wantApplied      string
 	}{{
 		name:       "async get request",
 		method:     http.MethodGet,
 		body:       "",
 		returncode: http.StatusAccepted,
+	}, {
+		name:        "async get request with preference list",
+		method:      http.MethodGet,
+		prefer:      "respond-async, wait=10",
+		returncode:  http.StatusAccepted,
+		wantApplied: "respond-async",
 	}, {
 		name:       "async post request with too large payload",
 		method:     http.MethodPost,
@@ -66,8 +95,6 @@ func TestHandleRequest(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			env = envInfo{
-				StreamName:       "mystream",
-				RedisAddress:     "address",
 				RequestSizeLimit: 25,
 			}
 			request := httptest.NewRequest(http.MethodGet, testserver.URL, nil)
@@ -78,6 +105,9 @@ func TestHandleRequest(t *testing.T) {
 				}
 				request = httptest.NewRequest(http.MethodPost, testserver.URL, body)
 			}
+			if test.prefer != "" {
+				request.Header.Set("Prefer", test.prefer)
+			}
 
 			rr := httptest.NewRecorder()
 			handleRequest(rr, request)
@@ -88,24 +118,1533 @@ func TestHandleRequest(t *testing.T) {
 			if got != want {
 				t.Errorf("got %d, want %d", got, want)
 			}
+			if got := rr.Header().Get("Preference-Applied"); got != test.wantApplied {
+				t.Errorf("Preference-Applied = %q, want %q", got, test.wantApplied)
+			}
+			if got == http.StatusAccepted {
+				var resp acceptedResponse
+				if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+					t.Fatal("Error decoding response:", err)
+				}
+				if resp.ID == "" || resp.Status != "accepted" {
+					t.Errorf("got response %+v, want an accepted request ID", resp)
+				}
+			}
+		})
+	}
+}
+
+type fakeBlobStore struct {
+	objects map[string]string
+}
+
+func (f *fakeBlobStore) Put(ctx context.Context, key string, body io.Reader) (string, error) {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	f.objects["fake://"+key] = string(b)
+	return "fake://" + key, nil
+}
+
+func (f *fakeBlobStore) Get(ctx context.Context, ref string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(f.objects[ref])), nil
+}
+
+func (f *fakeBlobStore) Delete(ctx context.Context, ref string) error {
+	delete(f.objects, ref)
+	return nil
+}
+
+func TestOffloadBody(t *testing.T) {
+	store := &fakeBlobStore{objects: make(map[string]string)}
+	blobs = store
+	defer func() { blobs = nil }()
+	env = envInfo{RequestSizeLimit: 10}
+	env.BlobMaxSize = 30
+
+	tests := []struct {
+		name          string
+		path          string
+		body          string
+		unknownLength bool
+		wantCode      int
+		wantBody      string
+		wantOffload   bool
+	}{{
+		name:     "body within limit",
+		body:     "small",
+		wantCode: http.StatusAccepted,
+		wantBody: "small",
+	}, {
+		name:        "body over limit",
+		body:        "this body is over the limit",
+		wantCode:    http.StatusAccepted,
+		wantOffload: true,
+	}, {
+		name:     "body over the max size",
+		body:     "this body is over the maximum size",
+		wantCode: http.StatusRequestEntityTooLarge,
+	}, {
+		name:          "streamed body over the max size",
+		body:          "this body is over the maximum size",
+		unknownLength: true,
+		wantCode:      http.StatusRequestEntityTooLarge,
+	}, {
+		name:     "body of a request that could not be enqueued",
+		path:     "/failure",
+		body:     "this body is over the limit",
+		wantCode: http.StatusInternalServerError,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fq := &recordingQueue{}
+			q = fq
+			if test.path != "" {
+				q = &fakeQueue{}
+			}
+			r := httptest.NewRequest(http.MethodPost, "http://example.com"+test.path, strings.NewReader(test.body))
+			if test.unknownLength {
+				r.ContentLength = -1
+			}
+			rr := httptest.NewRecorder()
+			handleRequest(rr, r)
+			if rr.Code != test.wantCode {
+				t.Fatalf("got %d, want %d", rr.Code, test.wantCode)
+			}
+			if rr.Code != http.StatusAccepted {
+				// Bodies are only kept with accepted requests.
+				if len(store.objects) != 0 {
+					t.Errorf("stored %d bodies, want none", len(store.objects))
+				}
+				return
+			}
+			got := enqueuedRequest(t, fq.data)
+			if got.ReqBody != test.wantBody {
+				t.Errorf("enqueued body = %q, want %q", got.ReqBody, test.wantBody)
+			}
+			if (got.ReqBodyRef != "") != test.wantOffload {
+				t.Fatalf("enqueued body reference = %q, want offloaded: %v", got.ReqBodyRef, test.wantOffload)
+			}
+			if test.wantOffload && store.objects[got.ReqBodyRef] != test.body {
+				t.Errorf("offloaded body = %q, want %q", store.objects[got.ReqBodyRef], test.body)
+			}
+			delete(store.objects, got.ReqBodyRef)
+		})
+	}
+}
+
+func TestCompressBody(t *testing.T) {
+	env = envInfo{RequestSizeLimit: 10000}
+	var err error
+	compressor, err = compression.New(compression.CompressionConfig{BodyCompression: compression.Gzip, BodyCompressionThreshold: 100})
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	defer func() { compressor = nil }()
+
+	for _, body := range []string{"small", strings.Repeat(`{"name":"value"},`, 100)} {
+		fq := &recordingQueue{}
+		q = fq
+		rr := httptest.NewRecorder()
+		handleRequest(rr, httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(body)))
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("got %d, want %d", rr.Code, http.StatusAccepted)
+		}
+		got := enqueuedRequest(t, fq.data)
+		if wantCompressed := len(body) >= 100; (got.ReqBodyEncoding != "") != wantCompressed {
+			t.Errorf("body of %d bytes stored with encoding %q", len(body), got.ReqBodyEncoding)
+		}
+		if stored, err := compression.Decompress(got.ReqBody, got.ReqBodyEncoding); err != nil || stored != body {
+			t.Errorf("stored body decompresses to %q, %v, want %q", stored, err, body)
+		}
+	}
+}
+
+func TestEncryptRequest(t *testing.T) {
+	env = envInfo{RequestSizeLimit: 25}
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "key1"), []byte(base64.StdEncoding.EncodeToString(make([]byte, 32))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	encryptor, err = encryption.New(encryption.EncryptionConfig{EncryptionKeysDir: dir, EncryptionKeyID: "key1"})
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	defer func() { encryptor = nil }()
+	rq := &recordingQueue{}
+	q = rq
+
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("secret"))
+	r.Header.Set("Authorization", "Bearer token")
+	rr := httptest.NewRecorder()
+	handleRequest(rr, r)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("got %d, want %d", rr.Code, http.StatusAccepted)
+	}
+	if strings.Contains(string(rq.data), "secret") || strings.Contains(string(rq.data), "token") {
+		t.Errorf("stored record %q holds the body or headers in plaintext", rq.data)
+	}
+	got := enqueuedRequest(t, rq.data)
+	if err := encryptor.Open(got); err != nil {
+		t.Fatal("Open() =", err)
+	}
+	if got.ReqBody != "secret" || got.ReqHeader["Authorization"][0] != "Bearer token" {
+		t.Errorf("opened request = %+v, want the original body and headers", got)
+	}
+}
+
+func TestHeaderFilter(t *testing.T) {
+	env = envInfo{RequestSizeLimit: 25}
+	headerFilter = headers.NewFilter(headers.FilterConfig{HeaderDenylist: []string{"Authorization", "Cookie"}})
+	defer func() { headerFilter = nil }()
+	rq := &recordingQueue{}
+	q = rq
+
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("body"))
+	r.Header.Set("Authorization", "Bearer token")
+	r.Header.Set("Cookie", "session=1")
+	r.Header.Set("Content-Type", "text/plain")
+	rr := httptest.NewRecorder()
+	handleRequest(rr, r)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("got %d, want %d", rr.Code, http.StatusAccepted)
+	}
+	got := enqueuedRequest(t, rq.data)
+	if got.ReqHeader["Authorization"] != nil || got.ReqHeader["Cookie"] != nil {
+		t.Errorf("stored headers %v, want no Authorization nor Cookie", got.ReqHeader)
+	}
+	if got.ReqHeader["Content-Type"] == nil {
+		t.Errorf("stored headers %v, want Content-Type", got.ReqHeader)
+	}
+}
+
+func TestStoredRequestHost(t *testing.T) {
+	env = envInfo{RequestSizeLimit: 25}
+	rq := &recordingQueue{}
+	q = rq
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+	r.Host = "hello.default.example.com"
+	r.Header.Set("Async-Original-Host", "hello.default.svc.cluster.local")
+	r.Header.Set(requestHostHeader, "other.default.example.com")
+	rr := httptest.NewRecorder()
+	handleRequest(rr, r)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("got %d, want %d", rr.Code, http.StatusAccepted)
+	}
+	got := enqueuedRequest(t, rq.data)
+	if h := http.Header(got.ReqHeader).Values(requestHostHeader); len(h) != 1 || h[0] != "hello.default.example.com" {
+		t.Errorf("stored %s = %v, want the Host of the request", requestHostHeader, h)
+	}
+	if want := "http://hello.default.svc.cluster.local/"; got.ReqURL != want {
+		t.Errorf("stored URL = %s, want %s", got.ReqURL, want)
+	}
+}
+
+// enqueuedRequest returns the request stored in a record.
+func enqueuedRequest(t *testing.T, b []byte) *request.Data {
+	t.Helper()
+	data, err := request.Unmarshal(b)
+	if err != nil {
+		t.Fatal("Error unmarshalling enqueued request:", err)
+	}
+	return data
+}
+
+// recordingQueue keeps the last enqueued request.
+type recordingQueue struct {
+	fakeQueue
+	data      []byte
+	deliverAt time.Time
+	priority  queue.Priority
+	route     string
+}
+
+func (rq *recordingQueue) Enqueue(ctx context.Context, id string, data []byte) error {
+	rq.data = data
+	rq.deliverAt = queue.DeliverAtFrom(ctx)
+	rq.priority = queue.PriorityFrom(ctx)
+	rq.route = queue.RouteFrom(ctx)
+	return nil
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	env = envInfo{RequestSizeLimit: 25}
+	dedup = idempotency.NewMemory(idempotency.DedupConfig{IdempotencyWindow: time.Minute, IdempotencyPendingTimeout: time.Minute})
+	defer func() { dedup = nil }()
+
+	submit := func(key, body string) (int, string) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(body))
+		r.Header.Set("Async-Original-Host", "example.default.svc.cluster.local")
+		r.Header.Set("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		handleRequest(rr, r)
+		var resp acceptedResponse
+		json.NewDecoder(rr.Body).Decode(&resp)
+		return rr.Code, resp.ID
+	}
+
+	fq := &recordingQueue{}
+	q = fq
+	code, first := submit("abc", "body")
+	if code != http.StatusAccepted || first == "" {
+		t.Fatalf("first submission got %d with ID %q", code, first)
+	}
+	fq.data = nil
+	if code, id := submit("abc", "body"); code != http.StatusAccepted || id != first {
+		t.Errorf("duplicate submission got %d with ID %q, want %q", code, id, first)
+	}
+	if fq.data != nil {
+		t.Error("duplicate submission was enqueued")
+	}
+	if _, id := submit("def", "body"); id == first {
+		t.Error("different key got the ID of the first request")
+	}
+
+	// A submission that could not be enqueued can be retried.
+	q = &fakeQueue{}
+	if code, _ := submit("ghi", "failure"); code != http.StatusInternalServerError {
+		t.Fatalf("failed submission got %d", code)
+	}
+	q = fq
+	if code, id := submit("ghi", "body"); code != http.StatusAccepted || id == "" {
+		t.Errorf("retried submission got %d with ID %q", code, id)
+	}
+
+	// Duplicates of a submission still being accepted are told to retry,
+	// as the original may fail.
+	key := "example.default.svc.cluster.local/jkl"
+	if _, _, err := dedup.ClaimPending(context.Background(), key, "original"); err != nil {
+		t.Fatal("ClaimPending() =", err)
+	}
+	if code, id := submit("jkl", "body"); code != http.StatusConflict || id != "" {
+		t.Errorf("duplicate of a pending submission got %d with ID %q, want %d", code, id, http.StatusConflict)
+	}
+	dedup.Release(context.Background(), key)
+	if code, id := submit("jkl", "body"); code != http.StatusAccepted || id == "" || id == "original" {
+		t.Errorf("submission after the original failed got %d with ID %q", code, id)
+	}
+}
+
+func TestRequestTTL(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     map[string]string
+		defaultTTL time.Duration
+		want       time.Duration
+		wantErr    bool
+	}{{
+		name: "no ttl",
+	}, {
+		name:       "operator default",
+		defaultTTL: time.Hour,
+		want:       time.Hour,
+	}, {
+		name:       "service annotation overrides default",
+		header:     map[string]string{"Async-Service-Ttl": "30m"},
+		defaultTTL: time.Hour,
+		want:       30 * time.Minute,
+	}, {
+		name:   "caller seconds override service",
+		header: map[string]string{"Async-Ttl": "90", "Async-Service-Ttl": "30m"},
+		want:   90 * time.Second,
+	}, {
+		name:   "caller duration",
+		header: map[string]string{"Async-Ttl": "1h30m"},
+		want:   90 * time.Minute,
+	}, {
+		name:    "invalid caller ttl",
+		header:  map[string]string{"Async-Ttl": "-5"},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{RequestTTL: test.defaultTTL}
+			h := http.Header{}
+			for k, v := range test.header {
+				h.Set(k, v)
+			}
+			got, err := requestTTL(h)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("requestTTL() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("requestTTL() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestServiceSizeLimit(t *testing.T) {
+	env = envInfo{RequestSizeLimit: 10}
+	body := "this body is over the global limit"
+
+	tests := []struct {
+		name     string
+		limit    string
+		wantCode int
+	}{{
+		name:     "global limit",
+		wantCode: http.StatusInternalServerError,
+	}, {
+		name:     "service limit above the body size",
+		limit:    "100",
+		wantCode: http.StatusAccepted,
+	}, {
+		name:     "service limit below the body size",
+		limit:    "20",
+		wantCode: http.StatusInternalServerError,
+	}, {
+		name:     "invalid service limit",
+		limit:    "1MB",
+		wantCode: http.StatusBadRequest,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q = &recordingQueue{}
+			r := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(body))
+			if test.limit != "" {
+				r.Header.Set("Async-Service-Request-Size-Limit", test.limit)
+			}
+			rr := httptest.NewRecorder()
+			handleRequest(rr, r)
+			if rr.Code != test.wantCode {
+				t.Errorf("got %d, want %d", rr.Code, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	env = envInfo{RequestSizeLimit: 25}
+	var err error
+	limiter, err = ratelimit.New(ratelimit.RateLimitConfig{RateLimit: 0.1, RateLimitBurst: 1, RateLimitKey: ratelimit.KeyNamespace})
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	defer func() { limiter = nil }()
+	q = &recordingQueue{}
+
+	submit := func(host string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("body"))
+		r.Header.Set("Async-Original-Host", host)
+		rr := httptest.NewRecorder()
+		handleRequest(rr, r)
+		return rr
+	}
+	if rr := submit("a.tenant-a.svc.cluster.local"); rr.Code != http.StatusAccepted {
+		t.Fatalf("first request got %d, want %d", rr.Code, http.StatusAccepted)
+	}
+	rr := submit("b.tenant-a.svc.cluster.local")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request of the namespace got %d, want %d", rr.Code, http.StatusTooManyRequests)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "10" {
+		t.Errorf("Retry-After = %q, want 10", got)
+	}
+	if rr := submit("a.tenant-b.svc.cluster.local"); rr.Code != http.StatusAccepted {
+		t.Errorf("request of another namespace got %d, want %d", rr.Code, http.StatusAccepted)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	authService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer allowed":
+		case "Bearer forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		case "Bearer broken":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer authService.Close()
+	env = envInfo{RequestSizeLimit: 25}
+	var err error
+	authorizer, err = auth.New(auth.AuthConfig{AuthMode: auth.ModeService, AuthURL: authService.URL, AuthTimeout: time.Second})
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	defer func() { authorizer = nil }()
+
+	tests := []struct {
+		name      string
+		token     string
+		want      int
+		wantQueue bool
+	}{{
+		name:      "allowed",
+		token:     "Bearer allowed",
+		want:      http.StatusAccepted,
+		wantQueue: true,
+	}, {
+		name: "unauthenticated",
+		want: http.StatusUnauthorized,
+	}, {
+		name:  "forbidden",
+		token: "Bearer forbidden",
+		want:  http.StatusForbidden,
+	}, {
+		name:  "auth service failing",
+		token: "Bearer broken",
+		want:  http.StatusInternalServerError,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rq := &recordingQueue{}
+			q = rq
+			r := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("body"))
+			r.Header.Set("Async-Original-Host", "hello.default.svc.cluster.local")
+			if test.token != "" {
+				r.Header.Set("Authorization", test.token)
+			}
+			rr := httptest.NewRecorder()
+			handleRequest(rr, r)
+			if rr.Code != test.want {
+				t.Errorf("got %d, want %d", rr.Code, test.want)
+			}
+			if (rq.data != nil) != test.wantQueue {
+				t.Errorf("request queued: %v, want %v", rq.data != nil, test.wantQueue)
+			}
+		})
+	}
+}
+
+func TestValidation(t *testing.T) {
+	env = envInfo{RequestSizeLimit: 25}
+	var err error
+	validator, err = validation.New(validation.ValidationConfig{ValidationRules: `[{"contentTypes": ["application/json"], "jsonSchema": {"type": "object"}}]`})
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	defer func() { validator = nil }()
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+	}{{
+		name:        "valid",
+		contentType: "application/json",
+		body:        `{"id": 1}`,
+		want:        http.StatusAccepted,
+	}, {
+		name:        "schema violation",
+		contentType: "application/json",
+		body:        `[1]`,
+		want:        http.StatusBadRequest,
+	}, {
+		name:        "unsupported media type",
+		contentType: "text/plain",
+		body:        `{"id": 1}`,
+		want:        http.StatusUnsupportedMediaType,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rq := &recordingQueue{}
+			q = rq
+			r := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(test.body))
+			r.Header.Set("Content-Type", test.contentType)
+			rr := httptest.NewRecorder()
+			handleRequest(rr, r)
+			if rr.Code != test.want {
+				t.Errorf("got %d, want %d", rr.Code, test.want)
+			}
+			if queued := rq.data != nil; queued != (test.want == http.StatusAccepted) {
+				t.Errorf("request queued: %v", queued)
+			}
+		})
+	}
+}
+
+func TestRouting(t *testing.T) {
+	env = envInfo{RequestSizeLimit: 25}
+	var err error
+	router, err = routing.New(routing.RoutingConfig{RoutingRules: `[{"route": "uploads", "pathPrefix": "/upload"}]`})
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	defer func() { router = nil }()
+	rq := &recordingQueue{}
+	q = rq
+
+	for path, want := range map[string]string{"/upload/a": "uploads", "/other": ""} {
+		r := httptest.NewRequest(http.MethodPost, "http://example.com"+path, strings.NewReader("body"))
+		rr := httptest.NewRecorder()
+		handleRequest(rr, r)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("request to %s got %d, want %d", path, rr.Code, http.StatusAccepted)
+		}
+		if rq.route != want {
+			t.Errorf("request to %s was routed to %q, want %q", path, rq.route, want)
+		}
+	}
+}
+
+func TestTraceContext(t *testing.T) {
+	env = envInfo{RequestSizeLimit: 25}
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+	defer trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(1e-4)})
+	start := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+	defer func() { now = time.Now }()
+	rq := &recordingQueue{}
+	q = rq
+
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("body"))
+	r.Header.Set("Traceparent", traceParent)
+	rr := httptest.NewRecorder()
+	traced(http.HandlerFunc(handleRequest)).ServeHTTP(rr, r)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("got %d, want %d", rr.Code, http.StatusAccepted)
+	}
+
+	got := enqueuedRequest(t, rq.data)
+	if got.EnqueuedAt == nil || !got.EnqueuedAt.Equal(start) {
+		t.Errorf("EnqueuedAt = %v, want %v", got.EnqueuedAt, start)
+	}
+	inbound, _ := tracing.ParseTraceParent(traceParent)
+	sc, err := tracing.ParseTraceParent(got.TraceParent)
+	if err != nil {
+		t.Fatal("ParseTraceParent() =", err)
+	}
+	if sc.TraceID != inbound.TraceID || sc.SpanID == inbound.SpanID || !sc.IsSampled() {
+		t.Errorf("stored traceparent %q does not continue %q", got.TraceParent, traceParent)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	start := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+	defer func() { now = time.Now }()
+
+	tests := []struct {
+		name          string
+		header        map[string]string
+		unsupported   bool
+		wantCode      int
+		wantDeliverAt time.Time
+		wantExpiresAt time.Time
+	}{{
+		name:     "not delayed",
+		wantCode: http.StatusAccepted,
+	}, {
+		name:          "delay header",
+		header:        map[string]string{"Async-Delay": "60"},
+		wantCode:      http.StatusAccepted,
+		wantDeliverAt: start.Add(time.Minute),
+	}, {
+		name:          "delay preference",
+		header:        map[string]string{"Prefer": "respond-async; delay=2m", "Async-Delay": "60"},
+		wantCode:      http.StatusAccepted,
+		wantDeliverAt: start.Add(2 * time.Minute),
+	}, {
+		name:          "ttl starts after the delay",
+		header:        map[string]string{"Async-Delay": "1h", "Async-Ttl": "10m"},
+		wantCode:      http.StatusAccepted,
+		wantDeliverAt: start.Add(time.Hour),
+		wantExpiresAt: start.Add(70 * time.Minute),
+	}, {
+		name:     "invalid delay",
+		header:   map[string]string{"Async-Delay": "soon"},
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:        "backend without delays",
+		header:      map[string]string{"Async-Delay": "60"},
+		unsupported: true,
+		wantCode:    http.StatusBadRequest,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{RequestSizeLimit: 25}
+			fq := &recordingQueue{}
+			q = fq
+			if test.unsupported {
+				q = &noDelayQueue{}
+			}
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("body"))
+			for k, v := range test.header {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			handleRequest(rr, req)
+			if rr.Code != test.wantCode {
+				t.Fatalf("got %d, want %d", rr.Code, test.wantCode)
+			}
+			if test.wantCode != http.StatusAccepted || test.unsupported {
+				return
+			}
+			if !fq.deliverAt.Equal(test.wantDeliverAt) {
+				t.Errorf("delivery time = %v, want %v", fq.deliverAt, test.wantDeliverAt)
+			}
+			got := enqueuedRequest(t, fq.data)
+			if test.wantExpiresAt.IsZero() != (got.ExpiresAt == nil) || (got.ExpiresAt != nil && !got.ExpiresAt.Equal(test.wantExpiresAt)) {
+				t.Errorf("ExpiresAt = %v, want %v", got.ExpiresAt, test.wantExpiresAt)
+			}
+		})
+	}
+}
+
+// noDelayQueue is a backend that cannot delay requests.
+type noDelayQueue struct {
+	fakeQueue
+}
+
+func (nq *noDelayQueue) Enqueue(ctx context.Context, id string, data []byte) error {
+	if !queue.DeliverAtFrom(ctx).IsZero() {
+		return queue.ErrDelayNotSupported
+	}
+	return nil
+}
+
+func TestDeadline(t *testing.T) {
+	start := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+	defer func() { now = time.Now }()
+
+	tests := []struct {
+		name         string
+		header       map[string]string
+		wantCode     int
+		wantDeadline time.Time
+	}{{
+		name:     "no deadline",
+		wantCode: http.StatusAccepted,
+	}, {
+		name:         "deadline",
+		header:       map[string]string{"Async-Deadline": "2021-07-01T12:30:00Z"},
+		wantCode:     http.StatusAccepted,
+		wantDeadline: start.Add(30 * time.Minute),
+	}, {
+		name:         "deadline with an offset",
+		header:       map[string]string{"Async-Deadline": "2021-07-01T14:30:00+02:00"},
+		wantCode:     http.StatusAccepted,
+		wantDeadline: start.Add(30 * time.Minute),
+	}, {
+		name:         "deadline alias",
+		header:       map[string]string{"X-Async-Deadline": "2021-07-01T12:30:00Z"},
+		wantCode:     http.StatusAccepted,
+		wantDeadline: start.Add(30 * time.Minute),
+	}, {
+		name:         "deadline over its alias",
+		header:       map[string]string{"Async-Deadline": "2021-07-01T12:30:00Z", "X-Async-Deadline": "2021-07-01T11:00:00Z"},
+		wantCode:     http.StatusAccepted,
+		wantDeadline: start.Add(30 * time.Minute),
+	}, {
+		name:     "invalid deadline alias",
+		header:   map[string]string{"X-Async-Deadline": "in an hour"},
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "invalid deadline",
+		header:   map[string]string{"Async-Deadline": "in an hour"},
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "deadline passed",
+		header:   map[string]string{"Async-Deadline": "2021-07-01T11:00:00Z"},
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "deadline before the delay",
+		header:   map[string]string{"Async-Deadline": "2021-07-01T12:30:00Z", "Async-Delay": "1h"},
+		wantCode: http.StatusBadRequest,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{RequestSizeLimit: 25}
+			fq := &recordingQueue{}
+			q = fq
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("body"))
+			for k, v := range test.header {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			handleRequest(rr, req)
+			if rr.Code != test.wantCode {
+				t.Fatalf("got %d, want %d", rr.Code, test.wantCode)
+			}
+			if test.wantCode != http.StatusAccepted {
+				return
+			}
+			got := enqueuedRequest(t, fq.data)
+			if test.wantDeadline.IsZero() != (got.Deadline == nil) || (got.Deadline != nil && !got.Deadline.Equal(test.wantDeadline)) {
+				t.Errorf("Deadline = %v, want %v", got.Deadline, test.wantDeadline)
+			}
+		})
+	}
+}
+
+func TestPriority(t *testing.T) {
+	tests := []struct {
+		name     string
+		priority string
+		max      queue.Priority
+		wantCode int
+		want     queue.Priority
+	}{{
+		name:     "default",
+		max:      queue.PriorityHigh,
+		wantCode: http.StatusAccepted,
+		want:     queue.PriorityNormal,
+	}, {
+		name:     "high",
+		priority: "high",
+		max:      queue.PriorityHigh,
+		wantCode: http.StatusAccepted,
+		want:     queue.PriorityHigh,
+	}, {
+		name:     "capped by the operator",
+		priority: "HIGH",
+		max:      queue.PriorityNormal,
+		wantCode: http.StatusAccepted,
+		want:     queue.PriorityNormal,
+	}, {
+		name:     "low is not capped",
+		priority: "low",
+		max:      queue.PriorityNormal,
+		wantCode: http.StatusAccepted,
+		want:     queue.PriorityLow,
+	}, {
+		name:     "unknown priority",
+		priority: "urgent",
+		max:      queue.PriorityHigh,
+		wantCode: http.StatusBadRequest,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{RequestSizeLimit: 25, MaxPriority: test.max}
+			fq := &recordingQueue{}
+			q = fq
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("body"))
+			if test.priority != "" {
+				req.Header.Set("Async-Priority", test.priority)
+			}
+			rr := httptest.NewRecorder()
+			handleRequest(rr, req)
+			if rr.Code != test.wantCode {
+				t.Fatalf("got %d, want %d", rr.Code, test.wantCode)
+			}
+			if fq.priority != test.want {
+				t.Errorf("priority = %q, want %q", fq.priority, test.want)
+			}
+		})
+	}
+}
+
+func TestServeDrains(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusAccepted)
+	})}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen() =", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, server, l, time.Minute)
+	}()
+
+	responses := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			t.Error("in-flight request failed:", err)
+			responses <- 0
+			return
+		}
+		resp.Body.Close()
+		responses <- resp.StatusCode
+	}()
+	<-started
+	cancel()
+
+	select {
+	case err := <-served:
+		t.Fatalf("serve() returned with a request in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := http.Get("http://" + l.Addr().String()); err == nil {
+		t.Error("new request was accepted while draining")
+	}
+	close(release)
+	if code := <-responses; code != http.StatusAccepted {
+		t.Errorf("in-flight request got %d, want %d", code, http.StatusAccepted)
+	}
+	if err := <-served; err != nil {
+		t.Error("serve() =", err)
+	}
+}
+
+func TestServeH2C(t *testing.T) {
+	protos := make(chan int, 1)
+	server := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos <- r.ProtoMajor
+	}))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen() =", err)
+	}
+	go server.Serve(l)
+	defer server.Close()
+
+	resp, err := h2cClient.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal("h2c request failed:", err)
+	}
+	resp.Body.Close()
+	if got := <-protos; got != 2 {
+		t.Errorf("request was served over HTTP/%d, want HTTP/2", got)
+	}
+}
+
+func TestProxySyncHTTP2(t *testing.T) {
+	service := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("service got HTTP/%d, want HTTP/2", r.ProtoMajor)
+		}
+		if r.Header.Get("Connection") != "" || r.Header.Get("X-Hop") != "" {
+			t.Errorf("hop-by-hop headers were forwarded: %v", r.Header)
+		}
+		if got := r.Header.Get("Te"); got != "trailers" {
+			t.Errorf("TE = %q, want trailers", got)
+		}
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("response"))
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer service.Close()
+	env = envInfo{}
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/2.0", 2, 0
+	rr := httptest.NewRecorder()
+	proxySync(rr, r, request.Data{
+		ID:        "123",
+		ReqURL:    service.URL,
+		ReqMethod: http.MethodPost,
+		ReqBody:   "body",
+		ReqHeader: withoutHopHeaders(http.Header{
+			"Connection": {"X-Hop"},
+			"X-Hop":      {"yes"},
+			"Te":         {"trailers"},
+		}),
+	})
+	resp := rr.Result()
+	if b, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(b) != "response" {
+		t.Errorf("proxySync() = %d %q, want 200 response", resp.StatusCode, b)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("Grpc-Status trailer = %q, want 0", got)
+	}
+}
+
+func TestProxySyncTimeout(t *testing.T) {
+	release := make(chan struct{})
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer service.Close()
+	defer close(release)
+	env = envInfo{SyncTimeout: 50 * time.Millisecond}
+	defer func() { env = envInfo{} }()
+
+	rr := httptest.NewRecorder()
+	proxySync(rr, httptest.NewRequest(http.MethodGet, "/", nil), request.Data{ReqURL: service.URL, ReqMethod: http.MethodGet, ReqHeader: http.Header{}})
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("proxySync() = %d, want %d", rr.Code, http.StatusGatewayTimeout)
+	}
+}
+
+func TestAlwaysAsyncRespondSync(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Prefer"); got != preferSyncValue {
+			t.Errorf("Prefer = %q, want %q", got, preferSyncValue)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte("echo "), b...))
+	}))
+	defer service.Close()
+	host := strings.TrimPrefix(service.URL, "http://")
+
+	tests := []struct {
+		name       string
+		mode       string
+		wantCode   int
+		wantQueued bool
+	}{{
+		name:     "always async service",
+		mode:     alwaysMode,
+		wantCode: http.StatusOK,
+	}, {
+		name:       "conditionally async service",
+		wantCode:   http.StatusAccepted,
+		wantQueued: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{RequestSizeLimit: 25}
+			rq := &recordingQueue{}
+			q = rq
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+			r.Header.Set("Async-Original-Host", host)
+			r.Header.Set("Prefer", "respond-sync, wait=10")
+			if test.mode != "" {
+				r.Header.Set(serviceModeHeader, test.mode)
+			}
+			rr := httptest.NewRecorder()
+			handleRequest(rr, r)
+			if rr.Code != test.wantCode {
+				t.Errorf("got %d, want %d", rr.Code, test.wantCode)
+			}
+			if test.wantCode == http.StatusOK && rr.Body.String() != "echo body" {
+				t.Errorf("got body %q, want %q", rr.Body.String(), "echo body")
+			}
+			if queued := rq.data != nil; queued != test.wantQueued {
+				t.Errorf("queued = %v, want %v", queued, test.wantQueued)
+			}
+		})
+	}
+}
+
+func TestAsyncPath(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("sync"))
+	}))
+	defer service.Close()
+	host := strings.TrimPrefix(service.URL, "http://")
+
+	tests := []struct {
+		name       string
+		paths      string
+		path       string
+		wantCode   int
+		wantQueued bool
+	}{{
+		name:       "every path",
+		path:       "/reports",
+		wantCode:   http.StatusAccepted,
+		wantQueued: true,
+	}, {
+		name:       "path under an async path",
+		paths:      "/reports/*,/export",
+		path:       "/reports/q1",
+		wantCode:   http.StatusAccepted,
+		wantQueued: true,
+	}, {
+		name:     "path sharing the prefix of an exact path",
+		paths:    "/reports/*,/export",
+		path:     "/exports",
+		wantCode: http.StatusOK,
+	}, {
+		name:     "invalid paths",
+		paths:    "reports",
+		path:     "/reports",
+		wantCode: http.StatusOK,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{RequestSizeLimit: 25}
+			rq := &recordingQueue{}
+			q = rq
+			r := httptest.NewRequest(http.MethodPost, test.path, strings.NewReader("body"))
+			r.Header.Set("Async-Original-Host", host)
+			r.Header.Set("Prefer", "respond-async")
+			if test.paths != "" {
+				r.Header.Set(servicePathsHeader, test.paths)
+			}
+			rr := httptest.NewRecorder()
+			handleRequest(rr, r)
+			if rr.Code != test.wantCode {
+				t.Errorf("got %d, want %d", rr.Code, test.wantCode)
+			}
+			if queued := rq.data != nil; queued != test.wantQueued {
+				t.Errorf("queued = %v, want %v", queued, test.wantQueued)
+			}
+		})
+	}
+}
+
+func TestAsyncEnabled(t *testing.T) {
+	tests := []struct {
+		name  string
+		async []string
+		sync  []string
+		host  string
+		want  bool
+	}{{
+		name: "no policy",
+		host: "hello.default.svc.cluster.local",
+		want: true,
+	}, {
+		name:  "opted in",
+		async: []string{"hello.default.svc.cluster.local"},
+		host:  "hello.default.svc.cluster.local",
+		want:  true,
+	}, {
+		name:  "namespace opted in",
+		async: []string{"*.batch.svc.cluster.local"},
+		host:  "report.batch.svc.cluster.local",
+		want:  true,
+	}, {
+		name:  "not opted in",
+		async: []string{"*.batch.svc.cluster.local"},
+		host:  "hello.default.svc.cluster.local",
+	}, {
+		name: "opted out",
+		sync: []string{"hello.default.svc.cluster.local"},
+		host: "hello.default.svc.cluster.local",
+	}, {
+		name:  "opted out of an opted in namespace",
+		async: []string{"*.batch.svc.cluster.local"},
+		sync:  []string{"report.batch.svc.cluster.local"},
+		host:  "report.batch.svc.cluster.local",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := envInfo{AsyncServices: test.async, SyncServices: test.sync}
+			if got := asyncEnabled(cfg, test.host); got != test.want {
+				t.Errorf("asyncEnabled() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSyncService(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("sync"))
+	}))
+	defer service.Close()
+	host := strings.TrimPrefix(service.URL, "http://")
+	env = envInfo{RequestSizeLimit: 25, SyncServices: []string{host}}
+	defer func() { env = envInfo{} }()
+	rq := &recordingQueue{}
+	q = rq
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+	r.Header.Set("Async-Original-Host", host)
+	r.Header.Set("Prefer", "respond-async")
+	rr := httptest.NewRecorder()
+	handleRequest(rr, r)
+	if rr.Code != http.StatusOK || rr.Body.String() != "sync" {
+		t.Errorf("got %d %q, want 200 sync", rr.Code, rr.Body.String())
+	}
+	if rq.data != nil {
+		t.Error("request of a service that opted out was queued")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	env = envInfo{RequestSizeLimit: 25}
+	q = &fakeQueue{}
+	h := probe(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("probe got %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	// The same path requested through the ingress is a request to the service.
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	req.Header.Set("Async-Original-Host", "example.com")
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Errorf("service request got %d, want %d", rr.Code, http.StatusAccepted)
+	}
+}
+
+// flakyQueue fails its first writes, up to failures.
+type flakyQueue struct {
+	fakeQueue
+	failures int
+	attempts int
+}
+
+func (fq *flakyQueue) Enqueue(ctx context.Context, id string, data []byte) error {
+	fq.attempts++
+	if fq.attempts <= fq.failures {
+		return errors.New("queue unavailable")
+	}
+	return nil
+}
+
+func TestQueueFailurePolicy(t *testing.T) {
+	var gotPrefer string
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPrefer = r.Header.Get("Prefer")
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Service", "yes")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(append([]byte("processed "), b...))
+	}))
+	defer service.Close()
+
+	tests := []struct {
+		name         string
+		policy       string
+		failures     int
+		delay        string
+		breaker      bool
+		wantCode     int
+		wantAttempts int
+		wantBody     string
+	}{{
+		name:         "fail",
+		policy:       "fail",
+		failures:     1,
+		wantCode:     http.StatusInternalServerError,
+		wantAttempts: 1,
+	}, {
+		name:         "retry then succeed",
+		policy:       "retry-then-fail",
+		failures:     2,
+		wantCode:     http.StatusAccepted,
+		wantAttempts: 3,
+	}, {
+		name:         "retry then fail",
+		policy:       "retry-then-fail",
+		failures:     10,
+		wantCode:     http.StatusInternalServerError,
+		wantAttempts: 4,
+	}, {
+		name:         "no retries once the breaker is open",
+		policy:       "retry-then-fail",
+		failures:     10,
+		breaker:      true,
+		wantCode:     http.StatusInternalServerError,
+		wantAttempts: 2,
+	}, {
+		name:         "fallback to synchronous delivery",
+		policy:       "fallback-sync",
+		failures:     1,
+		wantCode:     http.StatusCreated,
+		wantAttempts: 1,
+		wantBody:     "processed body",
+	}, {
+		name:         "no fallback for delayed requests",
+		policy:       "fallback-sync",
+		failures:     1,
+		delay:        "60",
+		wantCode:     http.StatusInternalServerError,
+		wantAttempts: 1,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{
+				RequestSizeLimit:   25,
+				QueueFailurePolicy: test.policy,
+				QueueRetries:       3,
+				QueueRetryBackoff:  time.Millisecond,
+			}
+			fq := &flakyQueue{failures: test.failures}
+			q = fq
+			if test.breaker {
+				q = queue.NewBreaker(fq, queue.BreakerConfig{BreakerFailureThreshold: 2, BreakerOpenTimeout: time.Minute})
+			}
+			gotPrefer = ""
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+			req.Header.Set("Async-Original-Host", strings.TrimPrefix(service.URL, "http://"))
+			if test.delay != "" {
+				req.Header.Set("Async-Delay", test.delay)
+			}
+			rr := httptest.NewRecorder()
+			handleRequest(rr, req)
+			if rr.Code != test.wantCode {
+				t.Errorf("got %d, want %d", rr.Code, test.wantCode)
+			}
+			if fq.attempts != test.wantAttempts {
+				t.Errorf("got %d attempts, want %d", fq.attempts, test.wantAttempts)
+			}
+			if test.wantBody == "" {
+				return
+			}
+			if got := rr.Body.String(); got != test.wantBody {
+				t.Errorf("body = %q, want %q", got, test.wantBody)
+			}
+			if rr.Header().Get("X-Service") != "yes" {
+				t.Error("response headers of the service were not relayed")
+			}
+			if gotPrefer != "respond-sync" {
+				t.Errorf("service got Prefer %q, want respond-sync", gotPrefer)
+			}
+		})
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	baseEnv = envInfo{RequestSizeLimit: 25, MaxPriority: queue.PriorityHigh, QueueFailurePolicy: policyFail, RecordFormat: request.FormatCloudEvents}
+	env = baseEnv
+	defer func() { baseEnv = envInfo{} }()
+
+	tests := []struct {
+		name string
+		data map[string]string
+		want envInfo
+	}{{
+		name: "tunables",
+		data: map[string]string{
+			"request-size-limit":   "1000",
+			"request-ttl":          "1h",
+			"max-priority":         "normal",
+			"queue-failure-policy": "retry-then-fail",
+			"queue-retries":        "5",
+			"queue-retry-backoff":  "1s",
+		},
+		want: envInfo{
+			RequestSizeLimit:   1000,
+			RequestTTL:         time.Hour,
+			MaxPriority:        queue.PriorityNormal,
+			QueueFailurePolicy: policyRetryThenFail,
+			QueueRetries:       5,
+			QueueRetryBackoff:  time.Second,
+		},
+	}, {
+		name: "invalid value keeps the current configuration",
+		data: map[string]string{"request-size-limit": "2000", "queue-failure-policy": "ignore"},
+		want: envInfo{
+			RequestSizeLimit:   1000,
+			RequestTTL:         time.Hour,
+			MaxPriority:        queue.PriorityNormal,
+			QueueFailurePolicy: policyRetryThenFail,
+			QueueRetries:       5,
+			QueueRetryBackoff:  time.Second,
+		},
+	}, {
+		name: "removed values fall back to the environment",
+		data: map[string]string{"request-size-limit": "2000"},
+		want: envInfo{RequestSizeLimit: 2000, MaxPriority: queue.PriorityHigh, QueueFailurePolicy: policyFail},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			applyConfig(context.Background(), &corev1.ConfigMap{Data: test.data})
+			got := current()
+			if got.RequestSizeLimit != test.want.RequestSizeLimit ||
+				got.RequestTTL != test.want.RequestTTL ||
+				got.MaxPriority != test.want.MaxPriority ||
+				got.QueueFailurePolicy != test.want.QueueFailurePolicy ||
+				got.QueueRetries != test.want.QueueRetries ||
+				got.QueueRetryBackoff != test.want.QueueRetryBackoff {
+				t.Errorf("configuration = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRequestScheme(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		header string
+		want   string
+	}{{
+		name: "plain http",
+		url:  "http://example.com/",
+		want: "http",
+	}, {
+		name: "tls connection",
+		url:  "https://example.com/",
+		want: "https",
+	}, {
+		name:   "forwarded https",
+		url:    "http://example.com/",
+		header: "HTTPS",
+		want:   "https",
+	}, {
+		name:   "forwarded through several proxies",
+		url:    "http://example.com/",
+		header: "https, http",
+		want:   "https",
+	}, {
+		name:   "forwarded http over tls",
+		url:    "https://example.com/",
+		header: "http",
+		want:   "http",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.url, nil)
+			if test.header != "" {
+				r.Header.Set("X-Forwarded-Proto", test.header)
+			}
+			if got := requestScheme(r); got != test.want {
+				t.Errorf("requestScheme() = %q, want %q", got, test.want)
+			}
 		})
 	}
 }
 
-func setupRedis() {
-	// set up redis client
-	opts := &redis.UniversalOptions{
-		Addrs: []string{env.RedisAddress},
+func TestStatus(t *testing.T) {
+	q = &fakeQueue{}
+	env = envInfo{RequestSizeLimit: 25}
+	statuses = status.NewMemory()
+	defer func() { statuses = nil }()
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.Header.Set("Async-Original-Host", "hello.default.svc.cluster.local")
+	rr := httptest.NewRecorder()
+	handleRequest(rr, r)
+	location := rr.Header().Get("Location")
+	if rr.Code != http.StatusAccepted || !strings.HasPrefix(location, statusPath) {
+		t.Fatalf("got %d with Location %q, want 202 with a status location", rr.Code, location)
 	}
-	theclient := redis.NewUniversalClient(opts)
-	rc = &fakeRedis{
-		client: theclient,
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		host       string
+		returncode int
+		wantState  status.State
+	}{{
+		name:       "pending request",
+		method:     http.MethodGet,
+		path:       location,
+		host:       "hello.default.svc.cluster.local",
+		returncode: http.StatusOK,
+		wantState:  status.Pending,
+	}, {
+		name:       "request of another service",
+		method:     http.MethodGet,
+		path:       location,
+		host:       "other.default.svc.cluster.local",
+		returncode: http.StatusNotFound,
+	}, {
+		name:       "unknown request",
+		method:     http.MethodGet,
+		path:       statusPath + "unknown",
+		returncode: http.StatusNotFound,
+	}, {
+		name:       "wrong method",
+		method:     http.MethodPost,
+		path:       location,
+		returncode: http.StatusMethodNotAllowed,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "http://example.com"+test.path, nil)
+			if test.host != "" {
+				r.Header.Set("Async-Original-Host", test.host)
+			}
+			rr := httptest.NewRecorder()
+			handleStatus(rr, r)
+			if rr.Code != test.returncode {
+				t.Fatalf("got %d, want %d", rr.Code, test.returncode)
+			}
+			if test.wantState == "" {
+				return
+			}
+			var got status.Status
+			if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+				t.Fatal("Error decoding status:", err)
+			}
+			if got.State != test.wantState || statusPath+got.ID != location {
+				t.Errorf("got status %+v, want %s", got, test.wantState)
+			}
+		})
 	}
 }
 
-func (fr *fakeRedis) write(ctx context.Context, s envInfo, reqJSON []byte, id string) (err error) {
-	if strings.Contains(string(reqJSON), "failure") {
+func TestStatusAuthorize(t *testing.T) {
+	authService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer allowed":
+		case "Bearer forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer authService.Close()
+	statuses = status.NewMemory()
+	defer func() { statuses = nil }()
+	var err error
+	authorizer, err = auth.New(auth.AuthConfig{AuthMode: auth.ModeService, AuthURL: authService.URL, AuthTimeout: time.Second})
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	defer func() { authorizer = nil }()
+	err = statuses.Set(context.Background(), status.Status{
+		ID:     "123",
+		State:  status.Succeeded,
+		Host:   "hello.default.svc.cluster.local",
+		Result: &status.Result{Body: "secret"},
+	})
+	if err != nil {
+		t.Fatal("Set() =", err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{{
+		name:  "allowed",
+		token: "Bearer allowed",
+		want:  http.StatusOK,
+	}, {
+		name: "unauthenticated",
+		want: http.StatusUnauthorized,
+	}, {
+		name:  "forbidden",
+		token: "Bearer forbidden",
+		want:  http.StatusForbidden,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com"+statusPath+"123", nil)
+			r.Header.Set("Async-Original-Host", "hello.default.svc.cluster.local")
+			if test.token != "" {
+				r.Header.Set("Authorization", test.token)
+			}
+			rr := httptest.NewRecorder()
+			handleStatus(rr, r)
+			if rr.Code != test.want {
+				t.Fatalf("got %d, want %d", rr.Code, test.want)
+			}
+			if test.want != http.StatusOK && strings.Contains(rr.Body.String(), "secret") {
+				t.Errorf("denied caller got the result: %s", rr.Body.String())
+			}
+		})
+	}
+}
+
+func (fq *fakeQueue) Enqueue(ctx context.Context, id string, data []byte) error {
+	if strings.Contains(string(data), "failure") {
 		return errors.New("Failure writing")
 	}
-	return // no need to actually write to redis stream for our test case.
+	return nil // no need to actually write to a queue for our test case.
+}
+
+func (fq *fakeQueue) Dequeue(ctx context.Context) ([]queue.Message, error) {
+	return nil, nil
+}
+
+func (fq *fakeQueue) Ack(ctx context.Context, msg queue.Message) error {
+	return nil
+}
+
+func (fq *fakeQueue) DeadLetter(ctx context.Context, msg queue.Message, reason string) error {
+	return nil
+}
+
+func (fq *fakeQueue) Close() error {
+	return nil
 }
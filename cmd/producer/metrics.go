@@ -0,0 +1,130 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/metrics"
+)
+
+const (
+	// Domain and component of the exported metrics, which Prometheus
+	// names async_producer_<metric>.
+	metricsDomain    = "knative.dev/async"
+	metricsComponent = "async_producer"
+)
+
+const (
+	// resultAccepted counts requests written to the queue.
+	resultAccepted = "accepted"
+	// resultProxied counts requests delivered synchronously instead.
+	resultProxied = "proxied"
+	// resultOverQuota counts requests turned away over the quota of their
+	// namespace.
+	resultOverQuota = "over-quota"
+	// resultBackpressure counts requests turned away while the queue is
+	// backlogged.
+	resultBackpressure = "backpressure"
+)
+
+const (
+	// Stores whose errors are counted.
+	storeQueue       = "queue"
+	storeStatus      = "status"
+	storeIdempotency = "idempotency"
+	storeBlob        = "blob"
+)
+
+var (
+	requestCount    = stats.Int64("request_count", "Number of requests accepted, delivered synchronously, over quota or turned away by backpressure", stats.UnitDimensionless)
+	enqueueLatency  = stats.Float64("enqueue_latencies", "Time taken to write a request to the queue, retries included", stats.UnitMilliseconds)
+	enqueueFailures = stats.Int64("enqueue_failure_count", "Number of requests that could not be written to the queue", stats.UnitDimensionless)
+	bodyTooLarge    = stats.Int64("body_too_large_count", "Number of requests rejected for the size of their body", stats.UnitDimensionless)
+	storageErrors   = stats.Int64("storage_error_count", "Number of failed calls to the queue and the stores", stats.UnitDimensionless)
+
+	resultKey = tag.MustNewKey("result")
+	storeKey  = tag.MustNewKey("store")
+)
+
+// metricViews are the views of the producer metrics.
+var metricViews = []*view.View{{
+	Description: requestCount.Description(),
+	Measure:     requestCount,
+	Aggregation: view.Count(),
+	TagKeys:     []tag.Key{resultKey},
+}, {
+	Description: enqueueLatency.Description(),
+	Measure:     enqueueLatency,
+	Aggregation: view.Distribution(metrics.Buckets125(1, 10000)...),
+}, {
+	Description: enqueueFailures.Description(),
+	Measure:     enqueueFailures,
+	Aggregation: view.Count(),
+}, {
+	Description: bodyTooLarge.Description(),
+	Measure:     bodyTooLarge,
+	Aggregation: view.Count(),
+}, {
+	Description: storageErrors.Description(),
+	Measure:     storageErrors,
+	Aggregation: view.Count(),
+	TagKeys:     []tag.Key{storeKey},
+}}
+
+// updateMetricsExporter configures the metrics exporter from the
+// config-observability ConfigMap. Without one, metrics are served in the
+// Prometheus format on port 9090.
+func updateMetricsExporter(ctx context.Context) func(*corev1.ConfigMap) {
+	return func(cm *corev1.ConfigMap) {
+		data := cm.Data
+		if data == nil {
+			data = map[string]string{}
+		}
+		// Errors are logged, the current exporter is kept.
+		metrics.UpdateExporter(ctx, metrics.ExporterOptions{
+			Domain:    metricsDomain,
+			Component: metricsComponent,
+			ConfigMap: data,
+		}, logging.FromContext(ctx))
+	}
+}
+
+func recordRequest(ctx context.Context, result string) {
+	metrics.Record(ctx, requestCount.M(1), stats.WithTags(tag.Upsert(resultKey, result)))
+}
+
+func recordEnqueue(ctx context.Context, start time.Time, err error) {
+	metrics.Record(ctx, enqueueLatency.M(float64(now().Sub(start))/float64(time.Millisecond)))
+	// Rejected delays are the caller's fault.
+	if err != nil && !errors.Is(err, queue.ErrDelayNotSupported) {
+		metrics.Record(ctx, enqueueFailures.M(1))
+	}
+}
+
+func recordBodyTooLarge(ctx context.Context) {
+	metrics.Record(ctx, bodyTooLarge.M(1))
+}
+
+func recordStorageError(ctx context.Context, store string) {
+	metrics.Record(ctx, storageErrors.M(1), stats.WithTags(tag.Upsert(storeKey, store)))
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+	"knative.dev/pkg/metrics"
+)
+
+// count returns the number of measurements of view name with the given tag
+// value, or of all of them when value is empty.
+func count(t *testing.T, name, value string) int64 {
+	t.Helper()
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatalf("RetrieveData(%q) = %v", name, err)
+	}
+	var n int64
+	for _, row := range rows {
+		if value != "" && (len(row.Tags) == 0 || row.Tags[0].Value != value) {
+			continue
+		}
+		switch d := row.Data.(type) {
+		case *view.CountData:
+			n += d.Value
+		case *view.DistributionData:
+			n += d.Count
+		}
+	}
+	return n
+}
+
+func TestMetrics(t *testing.T) {
+	metrics.InitForTesting()
+	if err := view.Register(metricViews...); err != nil {
+		t.Fatal("Register() =", err)
+	}
+	defer view.Unregister(metricViews...)
+
+	submit := func(body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		handleRequest(rr, r)
+		return rr.Code
+	}
+	env = envInfo{RequestSizeLimit: 10, QueueFailurePolicy: policyRetryThenFail, QueueRetries: 1, QueueRetryBackoff: time.Millisecond}
+	q = &flakyQueue{failures: 1}
+	if code := submit("body"); code != http.StatusAccepted {
+		t.Fatalf("request got %d, want %d", code, http.StatusAccepted)
+	}
+	q = &flakyQueue{failures: 2}
+	if code := submit("body"); code != http.StatusInternalServerError {
+		t.Fatalf("request got %d, want %d", code, http.StatusInternalServerError)
+	}
+	if code := submit("a body that is too large"); code == http.StatusAccepted {
+		t.Fatal("request with a body over the limit was accepted")
+	}
+
+	for _, test := range []struct {
+		view, tag string
+		want      int64
+	}{
+		{"request_count", resultAccepted, 1},
+		{"enqueue_latencies", "", 2},
+		{"enqueue_failure_count", "", 1},
+		{"body_too_large_count", "", 1},
+		{"storage_error_count", storeQueue, 3},
+	} {
+		if got := count(t, test.view, test.tag); got != test.want {
+			t.Errorf("%s{%s} = %d, want %d", test.view, test.tag, got, test.want)
+		}
+	}
+}
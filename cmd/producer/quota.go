@@ -0,0 +1,76 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/quota"
+	"knative.dev/pkg/logging"
+)
+
+// quotaExceededResponse is the body of the 429 response to requests over the
+// quota of their namespace.
+type quotaExceededResponse struct {
+	Error     string `json:"error"`
+	Namespace string `json:"namespace"`
+	// Quota is the quota that would be exceeded, maxPendingRequests or
+	// maxStoredBytes, and Limit its value.
+	Quota           string `json:"quota"`
+	Limit           int64  `json:"limit"`
+	PendingRequests int64  `json:"pendingRequests"`
+	StoredBytes     int64  `json:"storedBytes"`
+}
+
+// reserveQuota counts n requests taking size bytes, sent to host, against
+// the quota of its namespace. Requests over the quota are answered with
+// 429 Too Many Requests, and the returned func gives back the reservation of
+// requests that end up not being queued.
+func reserveQuota(w http.ResponseWriter, r *http.Request, host string, n, size int64) (func(), bool) {
+	cfg := current().QuotaConfig
+	if quotas == nil || !cfg.Enabled() {
+		return func() {}, true
+	}
+	ns := quota.Namespace(host)
+	err := quotas.Reserve(ns, cfg.For(ns), n, size)
+	if err == nil {
+		return func() { quotas.Release(ns, n, size) }, true
+	}
+	var exceeded *quota.ExceededError
+	if !errors.As(err, &exceeded) {
+		w.WriteHeader(http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Errorw("Error checking the quota", zap.Error(err))
+		return nil, false
+	}
+	recordRequest(r.Context(), resultOverQuota)
+	logging.FromContext(r.Context()).Infow("Request over quota", zap.Error(err))
+	// The usage is read again within QUOTA_REFRESH.
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(cfg.QuotaRefresh.Seconds()))))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(quotaExceededResponse{
+		Error:           err.Error(),
+		Namespace:       exceeded.Namespace,
+		Quota:           exceeded.Limit,
+		Limit:           exceeded.Max,
+		PendingRequests: exceeded.Used.Requests,
+		StoredBytes:     exceeded.Used.Bytes,
+	})
+	return nil, false
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/quota"
+)
+
+func TestQuota(t *testing.T) {
+	env = envInfo{
+		RequestSizeLimit:   25,
+		QueueFailurePolicy: policyFail,
+		BatchSizeLimit:     1000,
+		BatchMaxRequests:   10,
+		QuotaConfig: quota.QuotaConfig{
+			QuotaMaxPendingRequests: 2,
+			QuotaNamespaces:         quota.Namespaces{"tenant-b": {MaxStoredBytes: 10}},
+			QuotaRefresh:            10 * time.Second,
+		},
+	}
+	defer func() { env = envInfo{} }()
+	mq := queue.NewMemory(queue.MemoryConfig{MemoryQueueName: fmt.Sprint(t.Name(), time.Now().UnixNano()), MemoryReadTimeout: time.Millisecond})
+	quotas = quota.NewTracker(mq, 100)
+	defer func() { quotas = nil }()
+
+	submit := func(host string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("body"))
+		r.Header.Set("Async-Original-Host", host)
+		rr := httptest.NewRecorder()
+		handleRequest(rr, r)
+		return rr
+	}
+	// Requests that cannot be queued do not count.
+	q = &flakyQueue{failures: 1}
+	if rr := submit("a.tenant-a.svc.cluster.local"); rr.Code != http.StatusInternalServerError {
+		t.Fatalf("request failing to be queued got %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+	q = mq
+	for i := 0; i < 2; i++ {
+		if rr := submit("a.tenant-a.svc.cluster.local"); rr.Code != http.StatusAccepted {
+			t.Fatalf("request %d got %d, want %d", i, rr.Code, http.StatusAccepted)
+		}
+	}
+	// The usage read from the queue replaces the requests counted so far.
+	if err := quotas.Refresh(context.Background()); err != nil {
+		t.Fatal("Refresh() =", err)
+	}
+	rr := submit("b.tenant-a.svc.cluster.local")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the quota got %d, want %d", rr.Code, http.StatusTooManyRequests)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "10" {
+		t.Errorf("Retry-After = %q, want 10", got)
+	}
+	var resp quotaExceededResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal("Error decoding response:", err)
+	}
+	if resp.Namespace != "tenant-a" || resp.Quota != "maxPendingRequests" || resp.Limit != 2 || resp.PendingRequests != 2 || resp.Error == "" {
+		t.Errorf("response = %+v, want the maxPendingRequests quota of tenant-a exceeded with 2 requests", resp)
+	}
+
+	// Namespaces with their own quota are not bound by the default one.
+	rr = submit("a.tenant-b.svc.cluster.local")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the stored bytes of its namespace got %d, want %d", rr.Code, http.StatusTooManyRequests)
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.Quota != "maxStoredBytes" {
+		t.Errorf("response = %+v, %v, want the maxStoredBytes quota exceeded", resp, err)
+	}
+	if rr := submit("a.tenant-c.svc.cluster.local"); rr.Code != http.StatusAccepted {
+		t.Errorf("request of another namespace got %d, want %d", rr.Code, http.StatusAccepted)
+	}
+
+	// Batches count all their requests.
+	r := httptest.NewRequest(http.MethodPost, batchPath, strings.NewReader(`[{"body": "1"}, {"body": "2"}]`))
+	r.Header.Set("Async-Original-Host", "a.tenant-c.svc.cluster.local")
+	r.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	handleBatch(rr, r)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("batch over the quota got %d, want %d", rr.Code, http.StatusTooManyRequests)
+	}
+}
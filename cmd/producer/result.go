@@ -0,0 +1,160 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/logkey"
+	"knative.dev/async-component/pkg/status"
+	"knative.dev/pkg/logging"
+)
+
+// Path prefix of the results of the requests, followed by their ID.
+const resultsPath = "/async/results/"
+
+// Header set on results whose body was cut at RESULT_BODY_LIMIT bytes.
+const truncatedHeader = "Async-Result-Truncated"
+
+// resultResponse is the body of a result answered as JSON, when the caller
+// does not accept the content type of the response of the service.
+type resultResponse struct {
+	StatusCode int                 `json:"status"`
+	Header     map[string][]string `json:"header,omitempty"`
+	Body       string              `json:"body,omitempty"`
+	Truncated  bool                `json:"truncated,omitempty"`
+}
+
+// handleResult answers with the response of the service to the request
+// whose ID is in the path, once it was delivered. The response is replayed
+// as is when the caller accepts its content type, and wrapped in JSON when it
+// only accepts application/json. Requests that are not delivered yet get a
+// 404 with a Retry-After.
+func handleResult(w http.ResponseWriter, r *http.Request) {
+	if statuses == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if authorizer != nil {
+		if err := authorizer.Authorize(r); err != nil {
+			denied(w, r, err)
+			return
+		}
+	}
+	id := strings.TrimPrefix(r.URL.Path, resultsPath)
+	logger := logging.FromContext(r.Context()).With(zap.String(logkey.RequestID, id))
+	s, ok := requestStatus(w, r, id)
+	if !ok {
+		return
+	}
+	if s.Result == nil || s.StatusCode == 0 {
+		// The status tells callers why there is no result, and they are
+		// only asked to retry while the request may still get one.
+		if s.State == status.Pending || s.State == status.InFlight {
+			retry := current().ResultRetryAfter.Seconds()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(retry)))))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		if err := json.NewEncoder(w).Encode(s); err != nil {
+			logger.Errorw("Error writing status response", zap.Error(err))
+		}
+		return
+	}
+
+	w.Header().Set("Vary", "Accept")
+	header := http.Header(s.Result.Header)
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	accept := r.Header.Get("Accept")
+	raw, wrapped := acceptQuality(accept, contentType), acceptQuality(accept, "application/json")
+	switch {
+	case raw > 0 && raw >= wrapped:
+		for name, values := range withoutHopHeaders(header) {
+			if name != "Content-Length" {
+				w.Header()[name] = values
+			}
+		}
+		if s.Result.Truncated {
+			w.Header().Set(truncatedHeader, "true")
+		}
+		w.WriteHeader(s.StatusCode)
+		if _, err := w.Write([]byte(s.Result.Body)); err != nil {
+			logger.Errorw("Error writing result response", zap.Error(err))
+		}
+	case wrapped > 0:
+		w.Header().Set("Content-Type", "application/json")
+		resp := resultResponse{StatusCode: s.StatusCode, Header: s.Result.Header, Body: s.Result.Body, Truncated: s.Result.Truncated}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			logger.Errorw("Error writing result response", zap.Error(err))
+		}
+	default:
+		http.Error(w, "result is "+contentType, http.StatusNotAcceptable)
+	}
+}
+
+// acceptQuality returns the quality given to contentType by the Accept
+// header accept, from its most specific matching media range, or 1 when
+// there is no Accept header.
+func acceptQuality(accept, contentType string) float64 {
+	if strings.TrimSpace(accept) == "" {
+		return 1
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return 0
+	}
+	typ := strings.SplitN(mediaType, "/", 2)[0]
+	quality, specificity := 0.0, 0
+	for _, value := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(value)
+		if err != nil {
+			continue
+		}
+		var s int
+		switch mediaRange {
+		case mediaType:
+			s = 3
+		case typ + "/*":
+			s = 2
+		case "*/*":
+			s = 1
+		default:
+			continue
+		}
+		if s <= specificity {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		quality, specificity = q, s
+	}
+	return quality
+}
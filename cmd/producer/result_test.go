@@ -0,0 +1,222 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"knative.dev/async-component/pkg/status"
+)
+
+func TestResult(t *testing.T) {
+	statuses = status.NewMemory()
+	defer func() { statuses = nil }()
+	env.ResultRetryAfter = 2 * time.Second
+	defer func() { env.ResultRetryAfter = 0 }()
+	for _, s := range []status.Status{
+		{ID: "pending", State: status.Pending},
+		{ID: "in-flight", State: status.InFlight},
+		{ID: "cancelled", State: status.Cancelled},
+		{ID: "failed", State: status.Failed, Reason: "connection refused"},
+		{ID: "succeeded", State: status.Succeeded, StatusCode: http.StatusCreated, Result: &status.Result{
+			Header: map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}, "Content-Length": {"5"}, "X-Order": {"42"}},
+			Body:   "hello",
+		}},
+		{ID: "other-service", State: status.Succeeded, Host: "other.default.svc.cluster.local", StatusCode: http.StatusOK, Result: &status.Result{
+			Body: "secret",
+		}},
+		{ID: "truncated", State: status.Succeeded, StatusCode: http.StatusOK, Result: &status.Result{
+			Header:    map[string][]string{"Content-Type": {"application/json"}},
+			Body:      `{"items":[`,
+			Truncated: true,
+		}},
+	} {
+		s.Updated = time.Now()
+		if err := statuses.Set(context.Background(), s); err != nil {
+			t.Fatal("Set() =", err)
+		}
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		id             string
+		accept         string
+		wantCode       int
+		wantRetryAfter string
+		wantType       string
+		wantBody       string
+		wantHeader     http.Header
+	}{{
+		name:           "pending request",
+		id:             "pending",
+		wantCode:       http.StatusNotFound,
+		wantRetryAfter: "2",
+		wantType:       "application/json",
+	}, {
+		name:           "request being delivered",
+		id:             "in-flight",
+		wantCode:       http.StatusNotFound,
+		wantRetryAfter: "2",
+		wantType:       "application/json",
+	}, {
+		name:     "cancelled request",
+		id:       "cancelled",
+		wantCode: http.StatusNotFound,
+		wantType: "application/json",
+	}, {
+		name:     "failed request without response",
+		id:       "failed",
+		wantCode: http.StatusNotFound,
+		wantType: "application/json",
+	}, {
+		name:     "unknown request",
+		id:       "unknown",
+		wantCode: http.StatusNotFound,
+	}, {
+		name:     "response of another service",
+		id:       "other-service",
+		wantCode: http.StatusNotFound,
+	}, {
+		name:     "response without Accept",
+		id:       "succeeded",
+		wantCode: http.StatusCreated,
+		wantType: "text/plain; charset=utf-8",
+		wantBody: "hello",
+		// The stored Content-Length is dropped, the body may be truncated.
+		wantHeader: http.Header{"X-Order": {"42"}, "Vary": {"Accept"}, "Content-Length": {""}},
+	}, {
+		name:     "accepted content type",
+		id:       "succeeded",
+		accept:   "text/*, application/json;q=0.5",
+		wantCode: http.StatusCreated,
+		wantType: "text/plain; charset=utf-8",
+		wantBody: "hello",
+	}, {
+		name:     "response wrapped in JSON",
+		id:       "succeeded",
+		accept:   "application/json",
+		wantCode: http.StatusOK,
+		wantType: "application/json",
+		wantBody: `{"status":201,"header":{"Content-Length":["5"],"Content-Type":["text/plain; charset=utf-8"],"X-Order":["42"]},"body":"hello"}` + "\n",
+	}, {
+		name:     "JSON preferred",
+		id:       "succeeded",
+		accept:   "*/*;q=0.1, application/json",
+		wantCode: http.StatusOK,
+		wantType: "application/json",
+	}, {
+		name:     "not acceptable",
+		id:       "succeeded",
+		accept:   "image/png, text/plain;q=0",
+		wantCode: http.StatusNotAcceptable,
+	}, {
+		// JSON responses are not wrapped.
+		name:       "truncated response",
+		id:         "truncated",
+		accept:     "application/json",
+		wantCode:   http.StatusOK,
+		wantType:   "application/json",
+		wantBody:   `{"items":[`,
+		wantHeader: http.Header{truncatedHeader: {"true"}},
+	}, {
+		name:     "wrong method",
+		method:   http.MethodPost,
+		id:       "succeeded",
+		wantCode: http.StatusMethodNotAllowed,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, "http://example.com"+resultsPath+test.id, nil)
+			if test.accept != "" {
+				r.Header.Set("Accept", test.accept)
+			}
+			rr := httptest.NewRecorder()
+			handleResult(rr, r)
+			if rr.Code != test.wantCode {
+				t.Fatalf("got %d, want %d: %s", rr.Code, test.wantCode, rr.Body)
+			}
+			if got := rr.Header().Get("Retry-After"); got != test.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, test.wantRetryAfter)
+			}
+			if test.wantType != "" {
+				if got := rr.Header().Get("Content-Type"); got != test.wantType {
+					t.Errorf("Content-Type = %q, want %q", got, test.wantType)
+				}
+			}
+			if test.wantBody != "" && rr.Body.String() != test.wantBody {
+				t.Errorf("body = %q, want %q", rr.Body, test.wantBody)
+			}
+			for name := range test.wantHeader {
+				if got, want := rr.Header().Get(name), test.wantHeader.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestResultPendingStatus(t *testing.T) {
+	statuses = status.NewMemory()
+	defer func() { statuses = nil }()
+	want := status.Status{ID: "pending", State: status.Pending, Updated: time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)}
+	if err := statuses.Set(context.Background(), want); err != nil {
+		t.Fatal("Set() =", err)
+	}
+	rr := httptest.NewRecorder()
+	handleResult(rr, httptest.NewRequest(http.MethodGet, "http://example.com"+resultsPath+"pending", nil))
+	// The Retry-After is at least a second.
+	if got := rr.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+	var got status.Status
+	if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+		t.Fatal("Error decoding status:", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("status (-want, +got):", diff)
+	}
+}
+
+func TestAcceptQuality(t *testing.T) {
+	tests := []struct {
+		accept      string
+		contentType string
+		want        float64
+	}{
+		{"", "text/plain", 1},
+		{"text/plain", "text/plain; charset=utf-8", 1},
+		{"text/*;q=0.5", "text/plain", 0.5},
+		{"*/*;q=0.2, text/*;q=0.5, text/plain;q=0.8", "text/plain", 0.8},
+		{"*/*;q=0.2, text/*;q=0", "text/html", 0},
+		{"*/*;q=0.2, text/*;q=0", "application/json", 0.2},
+		{"application/json", "text/plain", 0},
+		{"text/plain", "not a media type", 0},
+	}
+	for _, test := range tests {
+		if got := acceptQuality(test.accept, test.contentType); got != test.want {
+			t.Errorf("acceptQuality(%q, %q) = %v, want %v", test.accept, test.contentType, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"knative.dev/async-component/pkg/headers"
+)
+
+const (
+	// Prefix of the headers the ingress sets from the async.knative.dev
+	// annotations of the service.
+	serviceHeaderPrefix = "Async-Service-"
+	// Header listing the service headers set by the ingress, which always
+	// sets it.
+	serviceHeadersHeader = "Async-Service-Headers"
+)
+
+// ingressServiceHeaders returns h handling requests with only the service
+// headers set by the ingress. Callers would otherwise raise their own size
+// limit, or pick the dead-letter sink, retries or TTL of their requests. The
+// Async-Original-Host header, which the ingress always sets, is the one it
+// added last.
+func ingressServiceHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dropCallerServiceHeaders(r.Header)
+		if hosts := r.Header[headers.OriginalHost]; len(hosts) > 1 {
+			r.Header[headers.OriginalHost] = hosts[len(hosts)-1:]
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// dropCallerServiceHeaders removes from header the service headers that are
+// not listed in its serviceHeadersHeader, and that header itself. Proxies
+// appending rather than replacing headers add theirs after those of the
+// caller, so only the last value of each is kept.
+func dropCallerServiceHeaders(header http.Header) {
+	listed := make(map[string]bool)
+	if values := header[serviceHeadersHeader]; len(values) > 0 {
+		for _, name := range strings.Split(values[len(values)-1], ",") {
+			listed[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+	for name, values := range header {
+		switch {
+		case !strings.HasPrefix(name, serviceHeaderPrefix) || name == serviceHeadersHeader:
+		case !listed[name]:
+			delete(header, name)
+		case len(values) > 1:
+			header[name] = values[len(values)-1:]
+		}
+	}
+	delete(header, serviceHeadersHeader)
+}
+
+// isIngressHeader reports whether name is a header set by the ingress rather
+// than the caller.
+func isIngressHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	return strings.HasPrefix(name, serviceHeaderPrefix) || name == headers.OriginalHost
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDropCallerServiceHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   http.Header
+	}{{
+		name: "not set by the ingress",
+		header: http.Header{
+			"Async-Service-Request-Size-Limit": {"1000000000"},
+			"Async-Service-Dead-Letter-Sink":   {"http://example.com"},
+			"Async-Ttl":                        {"1h"},
+		},
+		want: http.Header{"Async-Ttl": {"1h"}},
+	}, {
+		name: "listed by the ingress",
+		header: http.Header{
+			"Async-Service-Headers":          {"Async-Service-Mode,Async-Service-Ttl"},
+			"Async-Service-Mode":             {"always"},
+			"Async-Service-Ttl":              {"1h"},
+			"Async-Service-Dead-Letter-Sink": {"http://example.com"},
+		},
+		want: http.Header{
+			"Async-Service-Mode": {"always"},
+			"Async-Service-Ttl":  {"1h"},
+		},
+	}, {
+		name: "appended to those of the caller",
+		header: http.Header{
+			"Async-Service-Headers":            {"Async-Service-Request-Size-Limit", "Async-Service-Mode"},
+			"Async-Service-Mode":               {"conditional"},
+			"Async-Service-Request-Size-Limit": {"1000000000", "1000"},
+		},
+		want: http.Header{"Async-Service-Mode": {"conditional"}},
+	}, {
+		name: "last value kept",
+		header: http.Header{
+			"Async-Service-Headers": {"Async-Service-Mode"},
+			"Async-Service-Mode":    {"always", "conditional"},
+		},
+		want: http.Header{"Async-Service-Mode": {"conditional"}},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dropCallerServiceHeaders(test.header)
+			if diff := cmp.Diff(test.want, test.header); diff != "" {
+				t.Error("headers (-want, +got) =", diff)
+			}
+		})
+	}
+}
+
+func TestIngressServiceHeaders(t *testing.T) {
+	var got http.Header
+	h := ingressServiceHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/", nil)
+	r.Header.Set("Async-Service-Request-Size-Limit", "1000000000")
+	r.Header["Async-Original-Host"] = []string{"admin.internal.svc.cluster.local", "example.default.svc.cluster.local"}
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if v := got.Get("Async-Service-Request-Size-Limit"); v != "" {
+		t.Errorf("Async-Service-Request-Size-Limit = %q, want the header of the caller dropped", v)
+	}
+	if v := got.Values("Async-Original-Host"); len(v) != 1 || v[0] != "example.default.svc.cluster.local" {
+		t.Errorf("Async-Original-Host = %q, want the one added by the ingress", v)
+	}
+}
+
+func TestServiceHeadersStored(t *testing.T) {
+	env = envInfo{RequestSizeLimit: 25}
+	rq := &recordingQueue{}
+	q = rq
+
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/", nil)
+	r.Header.Set("Async-Original-Host", "example.default.svc.cluster.local")
+	r.Header.Set("Async-Service-Dead-Letter-Sink", "http://attacker.example.com")
+	r.Header.Set("Async-Service-Backoff", "1ms")
+	// The ingress appends the retries annotation to those of the caller.
+	r.Header["Async-Service-Retries"] = []string{"1000", "2"}
+	r.Header.Set("Async-Service-Headers", "Async-Service-Retries")
+	rr := httptest.NewRecorder()
+	ingressServiceHeaders(http.HandlerFunc(handleRequest)).ServeHTTP(rr, r)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("got %d, want %d", rr.Code, http.StatusAccepted)
+	}
+	got := http.Header(enqueuedRequest(t, rq.data).ReqHeader)
+	for name, want := range map[string]string{
+		"Async-Service-Dead-Letter-Sink": "",
+		"Async-Service-Backoff":          "",
+		"Async-Service-Retries":          "2",
+		"Async-Service-Headers":          "",
+	} {
+		if v := got.Values(name); (want == "" && len(v) != 0) || (want != "" && (len(v) != 1 || v[0] != want)) {
+			t.Errorf("stored %s = %q, want %q", name, v, want)
+		}
+	}
+}
+
+func TestCallerServiceHeadersIgnored(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		value  string
+	}{{
+		name:   "idempotency",
+		header: "Async-Service-Idempotent",
+		value:  "false",
+	}, {
+		name:   "time to live",
+		header: "Async-Service-Ttl",
+		value:  "1s",
+	}, {
+		name:   "always asynchronous",
+		header: "Async-Service-Mode",
+		value:  "always",
+	}, {
+		name:   "asynchronous paths",
+		header: "Async-Service-Paths",
+		value:  "/reports/*",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{RequestSizeLimit: 25}
+			rq := &recordingQueue{}
+			q = rq
+
+			r := httptest.NewRequest(http.MethodPost, "http://example.com/", nil)
+			r.Header.Set("Async-Original-Host", "example.default.svc.cluster.local")
+			// Always asynchronous services deliver these synchronously.
+			r.Header.Set("Prefer", "respond-sync")
+			r.Header.Set(test.header, test.value)
+			rr := httptest.NewRecorder()
+			ingressServiceHeaders(http.HandlerFunc(handleRequest)).ServeHTTP(rr, r)
+			if rr.Code != http.StatusAccepted {
+				t.Fatalf("got %d, want %d", rr.Code, http.StatusAccepted)
+			}
+			data := enqueuedRequest(t, rq.data)
+			if v := http.Header(data.ReqHeader).Get(test.header); v != "" {
+				t.Errorf("stored %s = %q, want none", test.header, v)
+			}
+			if data.ExpiresAt != nil {
+				t.Errorf("request expires at %v, want never", data.ExpiresAt)
+			}
+		})
+	}
+}
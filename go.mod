@@ -3,10 +3,32 @@ module knative.dev/async-component
 go 1.14
 
 require (
+	cloud.google.com/go/pubsub v1.8.3
+	contrib.go.opencensus.io/exporter/prometheus v0.3.0
+	contrib.go.opencensus.io/exporter/zipkin v0.1.2
+	github.com/Azure/azure-amqp-common-go/v3 v3.1.0
+	github.com/Azure/azure-service-bus-go v0.10.16
+	github.com/DATA-DOG/go-sqlmock v1.5.0
+	github.com/Shopify/sarama v1.29.1
+	github.com/aws/aws-sdk-go v1.31.12
 	github.com/bradleypeabody/gouuidv6 v0.0.0-20200224230637-90681a9a9294
 	github.com/cloudevents/sdk-go/v2 v2.2.0
+	github.com/form3tech-oss/jwt-go v3.2.2+incompatible
 	github.com/go-redis/redis/v8 v8.0.0-beta.7
+	github.com/google/go-cmp v0.5.6
 	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/klauspost/compress v1.12.2
+	github.com/lib/pq v1.10.2
+	github.com/openzipkin/zipkin-go v0.2.5
+	github.com/rabbitmq/amqp091-go v1.1.0
+	github.com/xeipuuv/gojsonschema v1.2.0
+	go.opencensus.io v0.23.0
+	go.uber.org/zap v1.17.0
+	golang.org/x/net v0.0.0-20210614182718-04defd469f4e
+	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba
+	google.golang.org/api v0.36.0
+	google.golang.org/grpc v1.38.0
+	google.golang.org/protobuf v1.26.0
 	k8s.io/api v0.20.7
 	k8s.io/apimachinery v0.20.7
 	k8s.io/client-go v0.20.7
@@ -0,0 +1,253 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package admission validates the async.knative.dev annotations of Knative
+// Services, Routes and DomainMappings when they are created or updated, so
+// misconfigured services are rejected rather than silently handled
+// synchronously.
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	admissionlisters "k8s.io/client-go/listers/admissionregistration/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/kmp"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/ptr"
+	pkgreconciler "knative.dev/pkg/reconciler"
+	"knative.dev/pkg/system"
+	"knative.dev/pkg/webhook"
+	certresources "knative.dev/pkg/webhook/certificates/resources"
+
+	"knative.dev/async-component/pkg/reconciler/asyncconfig"
+	"knative.dev/async-component/pkg/reconciler/ingress"
+)
+
+// Prefix of the annotations read by the async component.
+const annotationPrefix = "async.knative.dev/"
+
+// knownAnnotations are the async.knative.dev annotations of Services and
+// Routes.
+var knownAnnotations = map[string]bool{
+	ingress.AsyncModeAnnotationKey:             true,
+	ingress.AsyncTTLAnnotationKey:              true,
+	ingress.AsyncRequestSizeLimitAnnotationKey: true,
+	ingress.AsyncIdempotentAnnotationKey:       true,
+	ingress.AsyncRetriesAnnotationKey:          true,
+	ingress.AsyncBackoffAnnotationKey:          true,
+	ingress.AsyncDeadLetterSinkAnnotationKey:   true,
+	ingress.AsyncPathsAnnotationKey:            true,
+	// Set by the controller on the producer Service.
+	asyncconfig.ManagedKeysAnnotationKey:   true,
+	asyncconfig.ManagedSecretAnnotationKey: true,
+}
+
+// reconciler implements the AdmissionController of the annotations, and
+// keeps its ValidatingWebhookConfiguration up to date.
+type reconciler struct {
+	webhook.StatelessAdmissionImpl
+	pkgreconciler.LeaderAwareFuncs
+
+	key  types.NamespacedName
+	path string
+
+	client       kubernetes.Interface
+	vwhlister    admissionlisters.ValidatingWebhookConfigurationLister
+	secretlister corelisters.SecretLister
+
+	secretName string
+}
+
+var (
+	_ controller.Reconciler                = (*reconciler)(nil)
+	_ pkgreconciler.LeaderAware            = (*reconciler)(nil)
+	_ webhook.AdmissionController          = (*reconciler)(nil)
+	_ webhook.StatelessAdmissionController = (*reconciler)(nil)
+)
+
+// object holds the annotations of a Service, Route or DomainMapping, and
+// those of the template of the revisions of a Service.
+type object struct {
+	Metadata metav1.ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Template *struct {
+			Metadata metav1.ObjectMeta `json:"metadata"`
+		} `json:"template,omitempty"`
+	} `json:"spec"`
+}
+
+// Reconcile implements controller.Reconciler.
+func (ac *reconciler) Reconcile(ctx context.Context, key string) error {
+	logger := logging.FromContext(ctx)
+
+	if !ac.IsLeaderFor(ac.key) {
+		return controller.NewSkipKey(key)
+	}
+
+	secret, err := ac.secretlister.Secrets(system.Namespace()).Get(ac.secretName)
+	if err != nil {
+		logger.Errorw("Error fetching secret ", zap.Error(err))
+		return err
+	}
+	caCert, ok := secret.Data[certresources.CACert]
+	if !ok {
+		return fmt.Errorf("secret %q is missing %q key", ac.secretName, certresources.CACert)
+	}
+	return ac.reconcileValidatingWebhook(ctx, caCert)
+}
+
+// Path implements AdmissionController.
+func (ac *reconciler) Path() string {
+	return ac.path
+}
+
+// Admit implements AdmissionController.
+func (ac *reconciler) Admit(ctx context.Context, request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	switch request.Operation {
+	case admissionv1.Create, admissionv1.Update:
+	default:
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+	var obj object
+	if err := json.Unmarshal(request.Object.Raw, &obj); err != nil {
+		return webhook.MakeErrorStatus("cannot decode incoming new object: %v", err)
+	}
+	if err := Validate(obj.Metadata.Annotations, templateAnnotations(obj)); err != nil {
+		return webhook.MakeErrorStatus("validation failed: %v", err)
+	}
+	return &admissionv1.AdmissionResponse{Allowed: true}
+}
+
+func templateAnnotations(obj object) map[string]string {
+	if obj.Spec.Template == nil {
+		return nil
+	}
+	return obj.Spec.Template.Metadata.Annotations
+}
+
+// Validate returns an error listing the problems of the async.knative.dev
+// annotations of an object, and of those of the template of its revisions:
+// unknown keys, invalid values, and annotations of the template, which are
+// not read, conflicting with those of the object.
+func Validate(annotations, template map[string]string) error {
+	var errs []string
+	for _, k := range sortedKeys(annotations) {
+		if strings.HasPrefix(k, annotationPrefix) && !knownAnnotations[k] {
+			errs = append(errs, fmt.Sprintf("Unknown annotation %s", k))
+		}
+	}
+	if err := ingress.ValidateAnnotations(annotations); err != nil {
+		errs = append(errs, err.Error())
+	}
+	for _, k := range sortedKeys(template) {
+		if !strings.HasPrefix(k, annotationPrefix) {
+			continue
+		}
+		if v, ok := annotations[k]; !ok || v != template[k] {
+			errs = append(errs, fmt.Sprintf("Annotation %s of the template conflicts with the Service, set it on the Service instead", k))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (ac *reconciler) reconcileValidatingWebhook(ctx context.Context, caCert []byte) error {
+	logger := logging.FromContext(ctx)
+
+	ruleScope := admissionregistrationv1.NamespacedScope
+	rules := []admissionregistrationv1.RuleWithOperations{{
+		Operations: []admissionregistrationv1.OperationType{
+			admissionregistrationv1.Create,
+			admissionregistrationv1.Update,
+		},
+		Rule: admissionregistrationv1.Rule{
+			APIGroups:   []string{"serving.knative.dev"},
+			APIVersions: []string{"v1"},
+			Resources:   []string{"services", "routes"},
+			Scope:       &ruleScope,
+		},
+	}, {
+		Operations: []admissionregistrationv1.OperationType{
+			admissionregistrationv1.Create,
+			admissionregistrationv1.Update,
+		},
+		Rule: admissionregistrationv1.Rule{
+			APIGroups:   []string{"serving.knative.dev"},
+			APIVersions: []string{"v1alpha1", "v1beta1"},
+			Resources:   []string{"domainmappings"},
+			Scope:       &ruleScope,
+		},
+	}}
+
+	configuredWebhook, err := ac.vwhlister.Get(ac.key.Name)
+	if err != nil {
+		return fmt.Errorf("error retrieving webhook: %w", err)
+	}
+	webhook := configuredWebhook.DeepCopy()
+
+	// Set the owner to namespace.
+	ns, err := ac.client.CoreV1().Namespaces().Get(ctx, system.Namespace(), metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to fetch namespace: %w", err)
+	}
+	nsRef := *metav1.NewControllerRef(ns, corev1.SchemeGroupVersion.WithKind("Namespace"))
+	webhook.OwnerReferences = []metav1.OwnerReference{nsRef}
+
+	for i, wh := range webhook.Webhooks {
+		if wh.Name != webhook.Name {
+			continue
+		}
+		webhook.Webhooks[i].Rules = rules
+		webhook.Webhooks[i].ClientConfig.CABundle = caCert
+		if webhook.Webhooks[i].ClientConfig.Service == nil {
+			return errors.New("missing service reference for webhook: " + wh.Name)
+		}
+		webhook.Webhooks[i].ClientConfig.Service.Path = ptr.String(ac.Path())
+	}
+
+	if ok, err := kmp.SafeEqual(configuredWebhook, webhook); err != nil {
+		return fmt.Errorf("error diffing webhooks: %w", err)
+	} else if !ok {
+		logger.Info("Updating webhook")
+		vwhclient := ac.client.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+		if _, err := vwhclient.Update(ctx, webhook, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("failed to update webhook: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admission
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		template    map[string]string
+		wantErrs    []string
+	}{{
+		name: "not annotated",
+	}, {
+		name: "valid",
+		annotations: map[string]string{
+			"async.knative.dev/mode":    "always",
+			"async.knative.dev/ttl":     "1h",
+			"async.knative.dev/retries": "3",
+			"async.knative.dev/paths":   "/reports/*",
+			"other.dev/key":             "value",
+		},
+	}, {
+		name:        "unknown key",
+		annotations: map[string]string{"async.knative.dev/mdoe": "always"},
+		wantErrs:    []string{"Unknown annotation async.knative.dev/mdoe"},
+	}, {
+		name:        "invalid duration",
+		annotations: map[string]string{"async.knative.dev/backoff": "soon"},
+		wantErrs:    []string{`Invalid value for key async.knative.dev/backoff: "soon"`},
+	}, {
+		name:        "template annotation conflicts",
+		annotations: map[string]string{"async.knative.dev/mode": "conditional"},
+		template:    map[string]string{"async.knative.dev/mode": "always"},
+		wantErrs:    []string{"Annotation async.knative.dev/mode of the template conflicts with the Service"},
+	}, {
+		name:     "template annotation only",
+		template: map[string]string{"async.knative.dev/mode": "always", "autoscaling.knative.dev/max-scale": "3"},
+		wantErrs: []string{"Annotation async.knative.dev/mode of the template"},
+	}, {
+		name:        "template annotation matches",
+		annotations: map[string]string{"async.knative.dev/mode": "always"},
+		template:    map[string]string{"async.knative.dev/mode": "always"},
+	}, {
+		name:        "several problems",
+		annotations: map[string]string{"async.knative.dev/unknown": "1", "async.knative.dev/mode": "sometimes"},
+		wantErrs:    []string{"Unknown annotation async.knative.dev/unknown", `Invalid value for key async.knative.dev/mode: "sometimes"`},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Validate(test.annotations, test.template)
+			if (err != nil) != (len(test.wantErrs) > 0) {
+				t.Fatalf("Validate() = %v, want errors %v", err, test.wantErrs)
+			}
+			for _, want := range test.wantErrs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate() = %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	ac := &reconciler{path: webhookPath}
+	tests := []struct {
+		name      string
+		operation admissionv1.Operation
+		object    string
+		wantAllow bool
+	}{{
+		name:      "valid service",
+		operation: admissionv1.Create,
+		object:    `{"metadata":{"name":"hello","annotations":{"async.knative.dev/mode":"always"}},"spec":{"template":{"metadata":{}}}}`,
+		wantAllow: true,
+	}, {
+		name:      "invalid service",
+		operation: admissionv1.Update,
+		object:    `{"metadata":{"name":"hello"},"spec":{"template":{"metadata":{"annotations":{"async.knative.dev/mode":"always"}}}}}`,
+	}, {
+		name:      "invalid route",
+		operation: admissionv1.Create,
+		object:    `{"metadata":{"name":"hello","annotations":{"async.knative.dev/ttl":"-1s"}},"spec":{"traffic":[]}}`,
+	}, {
+		name:      "valid domain mapping",
+		operation: admissionv1.Create,
+		object:    `{"metadata":{"name":"api.example.com","annotations":{"async.knative.dev/mode":"always"}},"spec":{"ref":{"name":"hello","kind":"Service","apiVersion":"serving.knative.dev/v1"}}}`,
+		wantAllow: true,
+	}, {
+		name:      "invalid domain mapping",
+		operation: admissionv1.Create,
+		object:    `{"metadata":{"name":"api.example.com","annotations":{"async.knative.dev/mod":"always"}},"spec":{"ref":{"name":"hello","kind":"Service","apiVersion":"serving.knative.dev/v1"}}}`,
+	}, {
+		name:      "delete",
+		operation: admissionv1.Delete,
+		wantAllow: true,
+	}, {
+		name:      "undecodable",
+		operation: admissionv1.Create,
+		object:    `{"metadata":[]}`,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := ac.Admit(context.Background(), &admissionv1.AdmissionRequest{
+				Operation: test.operation,
+				Object:    runtime.RawExtension{Raw: []byte(test.object)},
+			})
+			if resp.Allowed != test.wantAllow {
+				t.Errorf("Admit() allowed = %v, want %v: %v", resp.Allowed, test.wantAllow, resp.Result)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admission
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	kubeclient "knative.dev/pkg/client/injection/kube/client"
+	vwhinformer "knative.dev/pkg/client/injection/kube/informers/admissionregistration/v1/validatingwebhookconfiguration"
+	"knative.dev/pkg/configmap"
+	"knative.dev/pkg/controller"
+	secretinformer "knative.dev/pkg/injection/clients/namespacedkube/informers/core/v1/secret"
+	"knative.dev/pkg/logging"
+	pkgreconciler "knative.dev/pkg/reconciler"
+	"knative.dev/pkg/system"
+	"knative.dev/pkg/webhook"
+)
+
+const (
+	// Name of the ValidatingWebhookConfiguration, see
+	// config/webhook/webhook.yaml.
+	webhookName = "validation.webhook.async.knative.dev"
+	// Path the annotations are validated on.
+	webhookPath = "/annotations"
+)
+
+// NewAdmissionController creates the admission controller validating the
+// annotations of Services and Routes and returns the result of NewImpl.
+func NewAdmissionController(
+	ctx context.Context,
+	cmw configmap.Watcher,
+) *controller.Impl {
+	vwhInformer := vwhinformer.Get(ctx)
+	secretInformer := secretinformer.Get(ctx)
+
+	key := types.NamespacedName{Name: webhookName}
+	wh := &reconciler{
+		LeaderAwareFuncs: pkgreconciler.LeaderAwareFuncs{
+			// Have this reconciler enqueue our singleton whenever it becomes leader.
+			PromoteFunc: func(bkt pkgreconciler.Bucket, enq func(pkgreconciler.Bucket, types.NamespacedName)) error {
+				enq(bkt, key)
+				return nil
+			},
+		},
+
+		key:  key,
+		path: webhookPath,
+
+		client:       kubeclient.Get(ctx),
+		vwhlister:    vwhInformer.Lister(),
+		secretlister: secretInformer.Lister(),
+		secretName:   webhook.GetOptions(ctx).SecretName,
+	}
+
+	const queueName = "AnnotationWebhook"
+	c := controller.NewImpl(wh, logging.FromContext(ctx).Named(queueName), queueName)
+
+	// Reconcile when the ValidatingWebhookConfiguration or the certificates
+	// change. The key does not matter, the named webhook is reconciled.
+	vwhInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: controller.FilterWithName(webhookName),
+		Handler:    controller.HandleAll(c.Enqueue),
+	})
+	secretInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: controller.FilterWithNameAndNamespace(system.Namespace(), wh.secretName),
+		Handler:    controller.HandleAll(c.Enqueue),
+	})
+
+	return c
+}
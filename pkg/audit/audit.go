@@ -0,0 +1,171 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package audit records an append-only trail of the lifecycle of requests:
+// who submitted them, their delivery attempts and their outcome. The
+// producer and consumer write the events to a sink: a file, an HTTP endpoint
+// or a Redis stream.
+package audit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// SinkFile appends the events to AUDIT_FILE, a JSON object per line.
+	SinkFile = "file"
+	// SinkHTTP POSTs each event to AUDIT_URL as JSON.
+	SinkHTTP = "http"
+	// SinkStream adds the events to the AUDIT_STREAM Redis stream, using
+	// the Redis settings of the queue.
+	SinkStream = "stream"
+)
+
+// Type is the lifecycle event an Event records.
+type Type string
+
+const (
+	// Submitted requests were accepted by the producer and queued.
+	Submitted Type = "submitted"
+	// Cancelled requests were cancelled by their caller.
+	Cancelled Type = "cancelled"
+	// Attempted is a delivery attempt of a request to its service.
+	Attempted Type = "attempted"
+	// Succeeded requests got a successful response from their service.
+	Succeeded Type = "succeeded"
+	// Failed requests got an error response, or could not be delivered.
+	Failed Type = "failed"
+	// DeadLettered requests were moved to the dead-letter queue.
+	DeadLettered Type = "dead-lettered"
+	// Expired requests were not delivered because their deadline passed.
+	Expired Type = "expired"
+)
+
+// Event is an entry of the audit trail.
+type Event struct {
+	Time time.Time `json:"time"`
+	Type Type      `json:"type"`
+	// Component is the component that recorded the event.
+	Component string `json:"component"`
+	RequestID string `json:"requestID"`
+	// Target is the host of the service the request is sent to.
+	Target string `json:"target,omitempty"`
+	Method string `json:"method,omitempty"`
+	Path   string `json:"path,omitempty"`
+	// Subject identifies the caller, when it was authenticated, and
+	// RemoteAddr is the address it connected from.
+	Subject    string `json:"subject,omitempty"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	// Attempt is the number of the delivery attempt, or the number of
+	// attempts made for the outcome of a delivery.
+	Attempt int `json:"attempt,omitempty"`
+	// StatusCode is the status of the response of the service.
+	StatusCode int    `json:"statusCode,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// Sink is the interface implemented by the destinations of the audit trail.
+type Sink interface {
+	// Write appends e to the trail.
+	Write(ctx context.Context, e Event) error
+	// Close releases the resources held by the sink.
+	Close() error
+}
+
+// AuditConfig selects and configures the sink of the audit trail, which is
+// not recorded when AUDIT_SINK is empty. It is meant to be embedded in a
+// component's envconfig struct next to queue.Config.
+type AuditConfig struct {
+	AuditSink string `envconfig:"AUDIT_SINK"`
+	// AuditFile is the file the file sink appends to, "-" for the standard
+	// output.
+	AuditFile string `envconfig:"AUDIT_FILE" default:"-"`
+	// AuditURL is the endpoint of the http sink.
+	AuditURL string `envconfig:"AUDIT_URL"`
+	// AuditStream is the Redis stream of the stream sink, and
+	// AuditStreamMaxLen the approximate number of events it keeps, all of
+	// them when zero.
+	AuditStream       string `envconfig:"AUDIT_STREAM" default:"async-audit"`
+	AuditStreamMaxLen int64  `envconfig:"AUDIT_STREAM_MAX_LEN"`
+	// AuditTimeout bounds the writes of each event.
+	AuditTimeout time.Duration `envconfig:"AUDIT_TIMEOUT" default:"5s"`
+}
+
+// New returns the Recorder of component writing to the sink described by
+// cfg, or nil if the audit trail is not recorded. The stream sink connects
+// with the queue's Redis settings.
+func New(cfg AuditConfig, redisCfg queue.RedisConfig, component string) (*Recorder, error) {
+	var sink Sink
+	switch cfg.AuditSink {
+	case "":
+		return nil, nil
+	case SinkFile:
+		f, err := NewFile(cfg.AuditFile)
+		if err != nil {
+			return nil, err
+		}
+		sink = f
+	case SinkHTTP:
+		if cfg.AuditURL == "" {
+			return nil, fmt.Errorf("AUDIT_URL must be set with the %q sink", SinkHTTP)
+		}
+		sink = NewHTTP(cfg.AuditURL)
+	case SinkStream:
+		client, err := queue.NewRedisClient(redisCfg)
+		if err != nil {
+			return nil, err
+		}
+		sink = NewRedis(client, cfg.AuditStream, cfg.AuditStreamMaxLen)
+	default:
+		return nil, fmt.Errorf("unknown audit sink %q", cfg.AuditSink)
+	}
+	return NewRecorder(sink, component, cfg.AuditTimeout), nil
+}
+
+// Recorder writes the events of a component to a sink.
+type Recorder struct {
+	sink      Sink
+	component string
+	timeout   time.Duration
+	now       func() time.Time
+}
+
+// NewRecorder returns a Recorder writing the events of component to sink,
+// each within timeout.
+func NewRecorder(sink Sink, component string, timeout time.Duration) *Recorder {
+	return &Recorder{sink: sink, component: component, timeout: timeout, now: time.Now}
+}
+
+// Record writes e, stamped with the time and the component. Events are
+// written even when ctx is cancelled, and failures are logged rather than
+// failing the request.
+func (r *Recorder) Record(ctx context.Context, e Event) {
+	e.Time, e.Component = r.now(), r.component
+	wctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	if err := r.sink.Write(wctx, e); err != nil {
+		logging.FromContext(ctx).Errorw("Error writing audit event", zap.Error(err),
+			zap.String("type", string(e.Type)), zap.String("requestID", e.RequestID))
+	}
+}
+
+// Close closes the sink.
+func (r *Recorder) Close() error {
+	return r.sink.Close()
+}
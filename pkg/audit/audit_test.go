@@ -0,0 +1,233 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+	"knative.dev/async-component/pkg/queue"
+)
+
+func TestNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		cfg     AuditConfig
+		wantNil bool
+		wantErr bool
+	}{{
+		name:    "disabled",
+		wantNil: true,
+	}, {
+		name: "file",
+		cfg:  AuditConfig{AuditSink: SinkFile, AuditFile: filepath.Join(dir, "audit.log")},
+	}, {
+		name:    "file in a missing directory",
+		cfg:     AuditConfig{AuditSink: SinkFile, AuditFile: filepath.Join(dir, "missing", "audit.log")},
+		wantErr: true,
+	}, {
+		name: "http",
+		cfg:  AuditConfig{AuditSink: SinkHTTP, AuditURL: "http://audit.example.com"},
+	}, {
+		name:    "http without url",
+		cfg:     AuditConfig{AuditSink: SinkHTTP},
+		wantErr: true,
+	}, {
+		name:    "unknown sink",
+		cfg:     AuditConfig{AuditSink: "syslog"},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := New(test.cfg, queue.RedisConfig{}, "producer")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("New() = %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && (r == nil) != test.wantNil {
+				t.Errorf("New() = %v, want nil: %v", r, test.wantNil)
+			}
+			if r != nil {
+				r.Close()
+			}
+		})
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	if err := ioutil.WriteFile(path, []byte("earlier\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewFile(path)
+	if err != nil {
+		t.Fatal("NewFile() =", err)
+	}
+	for _, typ := range []Type{Submitted, Succeeded} {
+		if err := f.Write(context.Background(), Event{Type: typ, RequestID: "1"}); err != nil {
+			t.Fatal("Write() =", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal("Close() =", err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	// The events are appended to the file.
+	if len(lines) != 3 || lines[0] != "earlier" {
+		t.Fatalf("file = %q, want the earlier line and 2 events", b)
+	}
+	var e Event
+	if err := json.Unmarshal([]byte(lines[2]), &e); err != nil {
+		t.Fatal("Error decoding event:", err)
+	}
+	if e.Type != Succeeded || e.RequestID != "1" {
+		t.Errorf("last event = %+v, want request 1 succeeded", e)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	var got []Event
+	code := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with Content-Type %q, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		var e Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error("Error decoding event:", err)
+		}
+		got = append(got, e)
+		w.WriteHeader(code)
+	}))
+	defer server.Close()
+	h := NewHTTP(server.URL)
+	defer h.Close()
+
+	want := Event{Type: Attempted, RequestID: "1", Attempt: 2, StatusCode: 503}
+	if err := h.Write(context.Background(), want); err != nil {
+		t.Fatal("Write() =", err)
+	}
+	if diff := cmp.Diff([]Event{want}, got); diff != "" {
+		t.Error("events (-want, +got):", diff)
+	}
+	code = http.StatusInternalServerError
+	if err := h.Write(context.Background(), want); err == nil {
+		t.Error("Write() = nil, want the error of the endpoint")
+	}
+}
+
+// streamWriter records the entries added to redis streams.
+type streamWriter struct {
+	redis.Cmdable
+	args []*redis.XAddArgs
+	err  error
+}
+
+func (f *streamWriter) XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd {
+	f.args = append(f.args, a)
+	cmd := redis.NewStringCmd(ctx)
+	cmd.SetErr(f.err)
+	return cmd
+}
+
+func TestRedis(t *testing.T) {
+	client := &streamWriter{}
+	r := NewRedis(client, "async-audit", 1000)
+	e := Event{Type: DeadLettered, RequestID: "1", Reason: "expired"}
+	if err := r.Write(context.Background(), e); err != nil {
+		t.Fatal("Write() =", err)
+	}
+	if len(client.args) != 1 {
+		t.Fatalf("got %d entries, want 1", len(client.args))
+	}
+	a := client.args[0]
+	if a.Stream != "async-audit" || a.MaxLenApprox != 1000 {
+		t.Errorf("XAdd() to %q with MAXLEN ~ %d, want async-audit and 1000", a.Stream, a.MaxLenApprox)
+	}
+	var got Event
+	if err := json.Unmarshal(a.Values.(map[string]interface{})[redisEventField].([]byte), &got); err != nil {
+		t.Fatal("Error decoding event:", err)
+	}
+	if diff := cmp.Diff(e, got); diff != "" {
+		t.Error("event (-want, +got):", diff)
+	}
+
+	client.err = errors.New("connection refused")
+	if err := r.Write(context.Background(), e); err == nil {
+		t.Error("Write() = nil, want the error of Redis")
+	}
+}
+
+// memorySink records the events written.
+type memorySink struct {
+	events []Event
+	err    error
+}
+
+func (m *memorySink) Write(ctx context.Context, e Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.events = append(m.events, e)
+	return m.err
+}
+
+func (m *memorySink) Close() error { return nil }
+
+func TestRecorder(t *testing.T) {
+	sink := &memorySink{}
+	r := NewRecorder(sink, "consumer", time.Second)
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+
+	// Events of cancelled requests are still written.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r.Record(ctx, Event{Type: Succeeded, RequestID: "1", Attempt: 1, StatusCode: 200})
+	want := []Event{{Time: now, Type: Succeeded, Component: "consumer", RequestID: "1", Attempt: 1, StatusCode: 200}}
+	if diff := cmp.Diff(want, sink.events); diff != "" {
+		t.Error("events (-want, +got):", diff)
+	}
+
+	// Failures are only logged.
+	sink.err = errors.New("disk full")
+	r.Record(context.Background(), Event{Type: Failed, RequestID: "2"})
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// File is a Sink appending the events to a file, a JSON object per line.
+type File struct {
+	mu  sync.Mutex
+	out io.WriteCloser
+}
+
+// NewFile opens path to append to it, creating it if needed. "-" is the
+// standard output.
+func NewFile(path string) (*File, error) {
+	if path == "-" {
+		return &File{out: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the audit file: %w", err)
+	}
+	return &File{out: f}, nil
+}
+
+// Write implements Sink.
+func (f *File) Write(ctx context.Context, e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.out.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit event: %w", err)
+	}
+	return nil
+}
+
+// Close implements Sink. The standard output is left open.
+func (f *File) Close() error {
+	if f.out == os.Stdout {
+		return nil
+	}
+	return f.out.Close()
+}
+
+// HTTP is a Sink POSTing each event to an endpoint as JSON.
+type HTTP struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTP returns a Sink POSTing the events to url, which must answer 2xx.
+func NewHTTP(url string) *HTTP {
+	return &HTTP{url: url, client: &http.Client{}}
+}
+
+// Write implements Sink.
+func (h *HTTP) Write(ctx context.Context, e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed to create audit request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send audit event: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("audit endpoint answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close implements Sink.
+func (h *HTTP) Close() error {
+	h.client.CloseIdleConnections()
+	return nil
+}
+
+// Field of the stream entries holding the JSON of the event.
+const redisEventField = "event"
+
+// Redis is a Sink adding the events to a Redis stream.
+type Redis struct {
+	client redis.Cmdable
+	stream string
+	maxLen int64
+}
+
+// NewRedis returns a Sink adding the events to stream, trimmed to about
+// maxLen entries when it is positive.
+func NewRedis(client redis.Cmdable, stream string, maxLen int64) *Redis {
+	return &Redis{client: client, stream: stream, maxLen: maxLen}
+}
+
+// Write implements Sink.
+func (r *Redis) Write(ctx context.Context, e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+	args := &redis.XAddArgs{
+		Stream:       r.stream,
+		MaxLenApprox: r.maxLen,
+		Values:       map[string]interface{}{redisEventField: b},
+	}
+	if err := r.client.XAdd(ctx, args).Err(); err != nil {
+		return fmt.Errorf("failed to add audit event to %q: %w", r.stream, err)
+	}
+	return nil
+}
+
+// Close implements Sink.
+func (r *Redis) Close() error {
+	if c, ok := r.client.(*redis.Client); ok {
+		return c.Close()
+	}
+	return nil
+}
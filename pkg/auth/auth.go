@@ -0,0 +1,252 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package auth checks that callers are allowed to submit asynchronous
+// requests, before their payload is stored.
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/form3tech-oss/jwt-go"
+	"knative.dev/async-component/pkg/headers"
+)
+
+const (
+	// ModeJWT validates the bearer token of the requests.
+	ModeJWT = "jwt"
+	// ModeService asks an external service whether requests are allowed.
+	ModeService = "service"
+)
+
+var (
+	// ErrUnauthenticated is returned for requests without valid credentials.
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// ErrForbidden is returned for callers not allowed to submit requests.
+	ErrForbidden = errors.New("forbidden")
+)
+
+// AuthConfig configures the authorization of callers. Requests are not
+// checked when AUTH_MODE is empty.
+type AuthConfig struct {
+	// AuthMode is how callers are checked: jwt or service.
+	AuthMode string `envconfig:"AUTH_MODE"`
+	// AuthJWTKeyFile is the PEM encoded RSA or ECDSA public key tokens are
+	// signed with.
+	AuthJWTKeyFile string `envconfig:"AUTH_JWT_KEY_FILE"`
+	// AuthJWTIssuer and AuthJWTAudience are the iss and aud tokens must
+	// have, when set.
+	AuthJWTIssuer   string `envconfig:"AUTH_JWT_ISSUER"`
+	AuthJWTAudience string `envconfig:"AUTH_JWT_AUDIENCE"`
+	// AuthJWTScope is a scope tokens must grant, when set.
+	AuthJWTScope string `envconfig:"AUTH_JWT_SCOPE"`
+	// AuthURL is the service asked with the service mode.
+	AuthURL string `envconfig:"AUTH_URL"`
+	// AuthTimeout bounds the calls to the service.
+	AuthTimeout time.Duration `envconfig:"AUTH_TIMEOUT" default:"5s"`
+}
+
+// Authorizer checks the callers of the producer.
+type Authorizer struct {
+	cfg AuthConfig
+
+	// key and methods verify tokens with the jwt mode.
+	key     interface{}
+	methods []string
+	now     func() time.Time
+
+	client *http.Client
+}
+
+// New returns the Authorizer described by cfg, or nil if callers are not
+// checked.
+func New(cfg AuthConfig) (*Authorizer, error) {
+	a := &Authorizer{cfg: cfg, now: time.Now}
+	switch cfg.AuthMode {
+	case "":
+		return nil, nil
+	case ModeJWT:
+		if cfg.AuthJWTKeyFile == "" {
+			return nil, fmt.Errorf("AUTH_JWT_KEY_FILE must be set with the %q mode", ModeJWT)
+		}
+		b, err := ioutil.ReadFile(cfg.AuthJWTKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWT key: %w", err)
+		}
+		if a.key, a.methods, err = parseKey(b); err != nil {
+			return nil, fmt.Errorf("failed to parse JWT key: %w", err)
+		}
+	case ModeService:
+		if cfg.AuthURL == "" {
+			return nil, fmt.Errorf("AUTH_URL must be set with the %q mode", ModeService)
+		}
+		a.client = &http.Client{}
+	default:
+		return nil, fmt.Errorf("unknown auth mode %q", cfg.AuthMode)
+	}
+	return a, nil
+}
+
+// parseKey parses a PEM encoded public key, returning the signing methods
+// it verifies. Tokens are only accepted with these, so an RSA key cannot be
+// used as an HMAC secret.
+func parseKey(b []byte) (interface{}, []string, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, nil, errors.New("no PEM data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return key, []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}, nil
+	case *ecdsa.PublicKey:
+		return key, []string{"ES256", "ES384", "ES512"}, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// Authorize returns nil if the caller of r may submit it. Errors wrap
+// ErrUnauthenticated or ErrForbidden for callers that may not, other errors
+// mean their permissions could not be checked.
+func (a *Authorizer) Authorize(r *http.Request) error {
+	if a.cfg.AuthMode == ModeJWT {
+		return a.checkToken(r)
+	}
+	return a.askService(r)
+}
+
+// Subject returns the subject of the caller of r, the sub claim of its
+// token with the jwt mode. It is empty when the token is not valid, and with
+// the service mode.
+func (a *Authorizer) Subject(r *http.Request) string {
+	if a.cfg.AuthMode != ModeJWT {
+		return ""
+	}
+	claims, err := a.parseToken(r)
+	if err != nil {
+		return ""
+	}
+	sub, _ := claims["sub"].(string)
+	return sub
+}
+
+// parseToken returns the claims of the bearer token of r, once its signature
+// is verified.
+func (a *Authorizer) parseToken(r *http.Request) (jwt.MapClaims, error) {
+	token := r.Header.Get("Authorization")
+	if len(token) < 7 || !strings.EqualFold(token[:7], "Bearer ") {
+		return nil, fmt.Errorf("%w: no bearer token", ErrUnauthenticated)
+	}
+	claims := jwt.MapClaims{}
+	parser := &jwt.Parser{ValidMethods: a.methods, SkipClaimsValidation: true}
+	if _, err := parser.ParseWithClaims(strings.TrimSpace(token[7:]), claims, func(*jwt.Token) (interface{}, error) {
+		return a.key, nil
+	}); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+	return claims, nil
+}
+
+func (a *Authorizer) checkToken(r *http.Request) error {
+	claims, err := a.parseToken(r)
+	if err != nil {
+		return err
+	}
+	now := a.now().Unix()
+	if !claims.VerifyExpiresAt(now, false) || !claims.VerifyNotBefore(now, false) {
+		return fmt.Errorf("%w: token expired or not valid yet", ErrUnauthenticated)
+	}
+	if a.cfg.AuthJWTIssuer != "" && !claims.VerifyIssuer(a.cfg.AuthJWTIssuer, true) {
+		return fmt.Errorf("%w: token not issued by %q", ErrUnauthenticated, a.cfg.AuthJWTIssuer)
+	}
+	if a.cfg.AuthJWTAudience != "" && !hasAudience(claims, a.cfg.AuthJWTAudience) {
+		return fmt.Errorf("%w: token not intended for %q", ErrUnauthenticated, a.cfg.AuthJWTAudience)
+	}
+	if a.cfg.AuthJWTScope != "" {
+		scope, _ := claims["scope"].(string)
+		for _, s := range strings.Fields(scope) {
+			if s == a.cfg.AuthJWTScope {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: token does not grant the %q scope", ErrForbidden, a.cfg.AuthJWTScope)
+	}
+	return nil
+}
+
+// hasAudience reports whether aud is the audience of claims, or one of
+// them. MapClaims.VerifyAudience misses audiences decoded from JSON arrays.
+func hasAudience(claims jwt.MapClaims, aud string) bool {
+	switch v := claims["aud"].(type) {
+	case string:
+		return v == aud
+	case []interface{}:
+		for _, a := range v {
+			if a == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// askService sends the headers of r to the auth service, along with its
+// method, host and URI in the X-Forwarded headers, as for the external
+// authentication of ingresses. A 2xx response allows the request, 401 and
+// 403 deny it.
+func (a *Authorizer) askService(r *http.Request) error {
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.AuthTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.cfg.AuthURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create auth request: %w", err)
+	}
+	for k, v := range r.Header {
+		req.Header[k] = v
+	}
+	// The body of r is not sent.
+	req.Header.Del("Content-Length")
+	req.Header.Del("Transfer-Encoding")
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Host", r.Header.Get(headers.OriginalHost))
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call auth service: %w", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized:
+		return fmt.Errorf("%w: denied by auth service", ErrUnauthenticated)
+	case resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%w: denied by auth service", ErrForbidden)
+	default:
+		return fmt.Errorf("auth service answered %d", resp.StatusCode)
+	}
+}
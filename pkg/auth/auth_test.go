@@ -0,0 +1,320 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/form3tech-oss/jwt-go"
+)
+
+// writeKey writes the public key of a new RSA key to a file in dir.
+func writeKey(t *testing.T, dir string) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return key, path
+}
+
+func TestNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, keyFile := writeKey(t, dir)
+	notPEM := filepath.Join(dir, "not-pem")
+	if err := ioutil.WriteFile(notPEM, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cfg     AuthConfig
+		wantNil bool
+		wantErr bool
+	}{{
+		name:    "disabled",
+		wantNil: true,
+	}, {
+		name: "jwt",
+		cfg:  AuthConfig{AuthMode: ModeJWT, AuthJWTKeyFile: keyFile},
+	}, {
+		name:    "jwt without key",
+		cfg:     AuthConfig{AuthMode: ModeJWT},
+		wantErr: true,
+	}, {
+		name:    "jwt with an HMAC secret",
+		cfg:     AuthConfig{AuthMode: ModeJWT, AuthJWTKeyFile: notPEM},
+		wantErr: true,
+	}, {
+		name: "service",
+		cfg:  AuthConfig{AuthMode: ModeService, AuthURL: "http://auth.default.svc.cluster.local/check"},
+	}, {
+		name:    "service without URL",
+		cfg:     AuthConfig{AuthMode: ModeService},
+		wantErr: true,
+	}, {
+		name:    "unknown mode",
+		cfg:     AuthConfig{AuthMode: "basic"},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, err := New(test.cfg)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err == nil && (a == nil) != test.wantNil {
+				t.Errorf("New() = %v, want nil: %v", a, test.wantNil)
+			}
+		})
+	}
+}
+
+func TestCheckToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, keyFile := writeKey(t, dir)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(AuthConfig{
+		AuthMode:        ModeJWT,
+		AuthJWTKeyFile:  keyFile,
+		AuthJWTIssuer:   "https://issuer.example.com",
+		AuthJWTAudience: "async",
+		AuthJWTScope:    "async:submit",
+	})
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	now := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":   "https://issuer.example.com",
+			"aud":   []string{"other", "async"},
+			"exp":   now.Add(time.Hour).Unix(),
+			"scope": "openid async:submit",
+		}
+	}
+	sign := func(method jwt.SigningMethod, claims jwt.MapClaims, key interface{}) string {
+		s, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + s
+	}
+	with := func(k string, v interface{}) jwt.MapClaims {
+		c := valid()
+		c[k] = v
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{{
+		name:  "valid",
+		token: sign(jwt.SigningMethodRS256, valid(), key),
+	}, {
+		name: "no token",
+		want: ErrUnauthenticated,
+	}, {
+		name:  "basic credentials",
+		token: "Basic dXNlcjpwYXNz",
+		want:  ErrUnauthenticated,
+	}, {
+		name:  "signed with another key",
+		token: sign(jwt.SigningMethodRS256, valid(), otherKey),
+		want:  ErrUnauthenticated,
+	}, {
+		name:  "signed with the public key as an HMAC secret",
+		token: sign(jwt.SigningMethodHS256, valid(), x509.MarshalPKCS1PublicKey(&key.PublicKey)),
+		want:  ErrUnauthenticated,
+	}, {
+		name:  "expired",
+		token: sign(jwt.SigningMethodRS256, with("exp", now.Add(-time.Minute).Unix()), key),
+		want:  ErrUnauthenticated,
+	}, {
+		name:  "not valid yet",
+		token: sign(jwt.SigningMethodRS256, with("nbf", now.Add(time.Minute).Unix()), key),
+		want:  ErrUnauthenticated,
+	}, {
+		name:  "other issuer",
+		token: sign(jwt.SigningMethodRS256, with("iss", "https://evil.example.com"), key),
+		want:  ErrUnauthenticated,
+	}, {
+		name:  "other audience",
+		token: sign(jwt.SigningMethodRS256, with("aud", "other"), key),
+		want:  ErrUnauthenticated,
+	}, {
+		name:  "missing scope",
+		token: sign(jwt.SigningMethodRS256, with("scope", "openid"), key),
+		want:  ErrForbidden,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "http://example.com/", nil)
+			if test.token != "" {
+				r.Header.Set("Authorization", test.token)
+			}
+			if err := a.Authorize(r); !errors.Is(err, test.want) || (err != nil) != (test.want != nil) {
+				t.Errorf("Authorize() = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestSubject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, keyFile := writeKey(t, dir)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(AuthConfig{AuthMode: ModeJWT, AuthJWTKeyFile: keyFile})
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	sign := func(claims jwt.MapClaims, key interface{}) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + s
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{{
+		name:  "subject",
+		token: sign(jwt.MapClaims{"sub": "alice@example.com"}, key),
+		want:  "alice@example.com",
+	}, {
+		name:  "no subject",
+		token: sign(jwt.MapClaims{"scope": "async:submit"}, key),
+	}, {
+		name:  "signed with another key",
+		token: sign(jwt.MapClaims{"sub": "mallory@example.com"}, otherKey),
+	}, {
+		name: "no token",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "http://example.com/", nil)
+			if test.token != "" {
+				r.Header.Set("Authorization", test.token)
+			}
+			if got := a.Subject(r); got != test.want {
+				t.Errorf("Subject() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAskService(t *testing.T) {
+	var got *http.Request
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		switch r.Header.Get("Authorization") {
+		case "Bearer allowed":
+			w.WriteHeader(http.StatusNoContent)
+		case "Bearer forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		case "Bearer broken":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer service.Close()
+	a, err := New(AuthConfig{AuthMode: ModeService, AuthURL: service.URL, AuthTimeout: time.Second})
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+
+	tests := []struct {
+		token   string
+		want    error
+		wantErr bool
+	}{{
+		token: "Bearer allowed",
+	}, {
+		token:   "Bearer forbidden",
+		want:    ErrForbidden,
+		wantErr: true,
+	}, {
+		want:    ErrUnauthenticated,
+		wantErr: true,
+	}, {
+		token:   "Bearer broken",
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.token, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "http://example.com/orders?id=1", nil)
+			r.Header.Set("Async-Original-Host", "orders.default.svc.cluster.local")
+			if test.token != "" {
+				r.Header.Set("Authorization", test.token)
+			}
+			err := a.Authorize(r)
+			if (err != nil) != test.wantErr || (test.want != nil && !errors.Is(err, test.want)) {
+				t.Fatalf("Authorize() = %v, want %v", err, test.want)
+			}
+			if test.want == nil && err != nil && (errors.Is(err, ErrForbidden) || errors.Is(err, ErrUnauthenticated)) {
+				t.Errorf("Authorize() = %v, want an error checking the caller", err)
+			}
+			if got.Method != http.MethodGet || got.Header.Get("X-Forwarded-Method") != http.MethodPut ||
+				got.Header.Get("X-Forwarded-Host") != "orders.default.svc.cluster.local" ||
+				got.Header.Get("X-Forwarded-Uri") != "/orders?id=1" {
+				t.Errorf("auth service got %s with headers %v", got.Method, got.Header)
+			}
+		})
+	}
+}
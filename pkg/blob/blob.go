@@ -0,0 +1,94 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package blob stores request bodies too large to be written to the queue.
+// The producer uploads them and enqueues a reference, which the consumer
+// resolves at delivery time.
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"knative.dev/async-component/pkg/queue"
+)
+
+const (
+	// BackendS3 stores bodies in an S3 compatible bucket.
+	BackendS3 = "s3"
+	// BackendRedis stores bodies in chunks on the Redis instance of the
+	// queue configuration.
+	BackendRedis = "redis"
+)
+
+// ErrTooLarge is returned by the stores refusing bodies over BLOB_MAX_SIZE.
+var ErrTooLarge = errors.New("body too large")
+
+// Store is the interface implemented by object storage backends.
+type Store interface {
+	// Put streams body to the object key and returns a reference to it.
+	Put(ctx context.Context, key string, body io.Reader) (string, error)
+	// Get opens the object referenced by ref.
+	Get(ctx context.Context, ref string) (io.ReadCloser, error)
+	// Delete removes the object referenced by ref.
+	Delete(ctx context.Context, ref string) error
+}
+
+// StorageConfig configures the object storage used for large bodies. Any S3
+// compatible service can be used: Amazon S3, MinIO, or Google Cloud Storage
+// through its interoperability endpoint, https://storage.googleapis.com,
+// with HMAC keys. With the s3 backend, offloading is disabled when no bucket
+// is set.
+type StorageConfig struct {
+	BlobBackend   string `envconfig:"BLOB_BACKEND" default:"s3"`
+	BlobBucket    string `envconfig:"BLOB_BUCKET"`
+	BlobPrefix    string `envconfig:"BLOB_PREFIX" default:"async-bodies/"`
+	BlobEndpoint  string `envconfig:"BLOB_ENDPOINT"`
+	BlobPathStyle bool   `envconfig:"BLOB_PATH_STYLE"`
+	// BlobChunkSize is the size in bytes of the chunks of the redis backend.
+	BlobChunkSize int `envconfig:"BLOB_CHUNK_SIZE" default:"524288"`
+	// BlobMaxSize is the size in bytes of the largest body offloaded, 0
+	// for no limit.
+	BlobMaxSize int64 `envconfig:"BLOB_MAX_SIZE" default:"104857600"`
+	// BlobTTL is the time after which the redis backend drops a body, 0 to
+	// keep them until deleted. It must be longer than requests wait in the
+	// queue, delays and retries included.
+	BlobTTL time.Duration `envconfig:"BLOB_TTL" default:"168h"`
+}
+
+// New returns the Store described by cfg, or nil if offloading is disabled.
+// The Redis backend connects with the queue's Redis settings.
+func New(cfg StorageConfig, redisCfg queue.RedisConfig) (Store, error) {
+	switch cfg.BlobBackend {
+	case BackendS3, "":
+		if cfg.BlobBucket == "" {
+			return nil, nil
+		}
+		s, err := NewS3(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case BackendRedis:
+		r, err := NewRedis(cfg, redisCfg)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	default:
+		return nil, fmt.Errorf("unknown blob backend %q", cfg.BlobBackend)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"knative.dev/async-component/pkg/queue"
+)
+
+// Scheme of the references returned by Redis.
+const redisScheme = "redis://"
+
+// Redis is a Store keeping each body in a Redis list of chunks of
+// BLOB_CHUNK_SIZE bytes, so bodies are written and read a chunk at a time
+// and never held in memory as a whole. Bodies expire after BLOB_TTL, so
+// those that are never deleted do not fill up the instance.
+type Redis struct {
+	client    redis.Cmdable
+	prefix    string
+	chunkSize int
+	maxSize   int64
+	ttl       time.Duration
+}
+
+var _ Store = (*Redis)(nil)
+
+// NewRedis returns a Store keeping the bodies in chunks of BLOB_CHUNK_SIZE
+// bytes in Redis, connected to with queue.NewRedisClient.
+func NewRedis(cfg StorageConfig, redisCfg queue.RedisConfig) (*Redis, error) {
+	client, err := queue.NewRedisClient(redisCfg)
+	if err != nil {
+		return nil, err
+	}
+	return newRedisFromClient(client, cfg)
+}
+
+func newRedisFromClient(client redis.Cmdable, cfg StorageConfig) (*Redis, error) {
+	if cfg.BlobChunkSize <= 0 {
+		return nil, fmt.Errorf("BLOB_CHUNK_SIZE must be positive, got %d", cfg.BlobChunkSize)
+	}
+	if cfg.BlobMaxSize < 0 {
+		return nil, fmt.Errorf("BLOB_MAX_SIZE must not be negative, got %d", cfg.BlobMaxSize)
+	}
+	if cfg.BlobTTL < 0 {
+		return nil, fmt.Errorf("BLOB_TTL must not be negative, got %v", cfg.BlobTTL)
+	}
+	return &Redis{client: client, prefix: cfg.BlobPrefix, chunkSize: cfg.BlobChunkSize, maxSize: cfg.BlobMaxSize, ttl: cfg.BlobTTL}, nil
+}
+
+// Put implements Store. Bodies over BLOB_MAX_SIZE are refused with
+// ErrTooLarge.
+func (r *Redis) Put(ctx context.Context, key string, body io.Reader) (string, error) {
+	key = r.prefix + key
+	buf := make([]byte, r.chunkSize)
+	var size int64
+	for chunks := 0; ; chunks++ {
+		n, err := io.ReadFull(body, buf)
+		done := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !done {
+			r.client.Del(ctx, key)
+			return "", fmt.Errorf("failed to read body of %q: %w", key, err)
+		}
+		if size += int64(n); r.maxSize > 0 && size > r.maxSize {
+			r.client.Del(ctx, key)
+			return "", fmt.Errorf("failed to store %q: %w", key, ErrTooLarge)
+		}
+		// Empty bodies are stored as a single empty chunk.
+		if n > 0 || chunks == 0 {
+			if err := r.client.RPush(ctx, key, buf[:n]).Err(); err != nil {
+				r.client.Del(ctx, key)
+				return "", fmt.Errorf("failed to store %q: %w", key, err)
+			}
+		}
+		if chunks == 0 && r.ttl > 0 {
+			if err := r.client.Expire(ctx, key, r.ttl).Err(); err != nil {
+				r.client.Del(ctx, key)
+				return "", fmt.Errorf("failed to set the expiry of %q: %w", key, err)
+			}
+		}
+		if done {
+			return redisScheme + key, nil
+		}
+	}
+}
+
+// Get implements Store.
+func (r *Redis) Get(ctx context.Context, ref string) (io.ReadCloser, error) {
+	key, err := parseRedisRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := r.client.LLen(ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %w", ref, err)
+	}
+	if chunks == 0 {
+		return nil, fmt.Errorf("body %q not found", ref)
+	}
+	return &redisReader{ctx: ctx, client: r.client, key: key, chunks: chunks}, nil
+}
+
+// Delete implements Store.
+func (r *Redis) Delete(ctx context.Context, ref string) error {
+	key, err := parseRedisRef(ref)
+	if err != nil {
+		return err
+	}
+	if err := r.client.Del(ctx, key).Err(); err != nil {
+		return fmt.Errorf("failed to delete %q: %w", ref, err)
+	}
+	return nil
+}
+
+// redisReader reads the chunks of a body one at a time.
+type redisReader struct {
+	ctx    context.Context
+	client redis.Cmdable
+	key    string
+	chunks int64
+
+	next int64
+	buf  []byte
+}
+
+func (rr *redisReader) Read(p []byte) (int, error) {
+	for len(rr.buf) == 0 {
+		if rr.next == rr.chunks {
+			return 0, io.EOF
+		}
+		chunk, err := rr.client.LIndex(rr.ctx, rr.key, rr.next).Bytes()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read chunk %d of %q: %w", rr.next, rr.key, err)
+		}
+		rr.buf = chunk
+		rr.next++
+	}
+	n := copy(p, rr.buf)
+	rr.buf = rr.buf[n:]
+	return n, nil
+}
+
+func (rr *redisReader) Close() error {
+	return nil
+}
+
+// parseRedisRef returns the key of a redis://key reference.
+func parseRedisRef(ref string) (string, error) {
+	key := strings.TrimPrefix(ref, redisScheme)
+	if !strings.HasPrefix(ref, redisScheme) || key == "" {
+		return "", fmt.Errorf("invalid object reference %q", ref)
+	}
+	return key, nil
+}
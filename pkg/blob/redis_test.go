@@ -0,0 +1,193 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blob
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// fakeRedis implements the list commands used by Redis.
+type fakeRedis struct {
+	redis.Cmdable
+	lists   map[string][]string
+	ttls    map[string]time.Duration
+	failAt  int
+	pushes  int
+	indexes int
+}
+
+func (f *fakeRedis) RPush(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
+	f.pushes++
+	if f.pushes == f.failAt {
+		return redis.NewIntResult(0, errors.New("connection refused"))
+	}
+	for _, v := range values {
+		f.lists[key] = append(f.lists[key], string(v.([]byte)))
+	}
+	return redis.NewIntResult(int64(len(f.lists[key])), nil)
+}
+
+func (f *fakeRedis) LLen(ctx context.Context, key string) *redis.IntCmd {
+	return redis.NewIntResult(int64(len(f.lists[key])), nil)
+}
+
+func (f *fakeRedis) LIndex(ctx context.Context, key string, index int64) *redis.StringCmd {
+	f.indexes++
+	l := f.lists[key]
+	if index >= int64(len(l)) {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(l[index], nil)
+}
+
+func (f *fakeRedis) Expire(ctx context.Context, key string, ttl time.Duration) *redis.BoolCmd {
+	if _, ok := f.lists[key]; !ok {
+		return redis.NewBoolResult(false, nil)
+	}
+	f.ttls[key] = ttl
+	return redis.NewBoolResult(true, nil)
+}
+
+func (f *fakeRedis) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	for _, k := range keys {
+		delete(f.lists, k)
+		delete(f.ttls, k)
+	}
+	return redis.NewIntResult(int64(len(keys)), nil)
+}
+
+func TestRedis(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeRedis{lists: make(map[string][]string)}
+	r, err := newRedisFromClient(fake, StorageConfig{BlobPrefix: "async/", BlobChunkSize: 4})
+	if err != nil {
+		t.Fatal("newRedisFromClient() =", err)
+	}
+
+	ref, err := r.Put(ctx, "123", strings.NewReader("a large body"))
+	if err != nil {
+		t.Fatal("Put() =", err)
+	}
+	if want := "redis://async/123"; ref != want {
+		t.Errorf("Put() = %q, want %q", ref, want)
+	}
+	if got := fake.lists["async/123"]; len(got) != 3 || got[0] != "a la" {
+		t.Errorf("stored chunks = %q, want 3 chunks of 4 bytes", got)
+	}
+
+	body, err := r.Get(ctx, ref)
+	if err != nil {
+		t.Fatal("Get() =", err)
+	}
+	b, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil || string(b) != "a large body" {
+		t.Errorf("Get() body = %q, %v", b, err)
+	}
+	// Chunks are read one at a time.
+	if fake.indexes != 3 {
+		t.Errorf("read %d chunks, want 3", fake.indexes)
+	}
+
+	if err := r.Delete(ctx, ref); err != nil {
+		t.Fatal("Delete() =", err)
+	}
+	if _, err := r.Get(ctx, ref); err == nil {
+		t.Error("Get() of a deleted body succeeded")
+	}
+}
+
+func TestRedisEmptyBody(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newRedisFromClient(&fakeRedis{lists: make(map[string][]string)}, StorageConfig{BlobChunkSize: 4})
+	ref, err := r.Put(ctx, "123", strings.NewReader(""))
+	if err != nil {
+		t.Fatal("Put() =", err)
+	}
+	body, err := r.Get(ctx, ref)
+	if err != nil {
+		t.Fatal("Get() =", err)
+	}
+	if b, err := ioutil.ReadAll(body); err != nil || len(b) != 0 {
+		t.Errorf("Get() body = %q, %v, want empty", b, err)
+	}
+}
+
+func TestRedisPutFailure(t *testing.T) {
+	fake := &fakeRedis{lists: make(map[string][]string), failAt: 2}
+	r, _ := newRedisFromClient(fake, StorageConfig{BlobChunkSize: 4})
+	if _, err := r.Put(context.Background(), "123", strings.NewReader("a large body")); err == nil {
+		t.Fatal("Put() succeeded")
+	}
+	// The chunks written before the failure are removed.
+	if _, ok := fake.lists["123"]; ok {
+		t.Error("partial body was not deleted")
+	}
+}
+
+func TestRedisExpiry(t *testing.T) {
+	fake := &fakeRedis{lists: make(map[string][]string), ttls: make(map[string]time.Duration)}
+	r, _ := newRedisFromClient(fake, StorageConfig{BlobChunkSize: 4, BlobTTL: time.Hour})
+	if _, err := r.Put(context.Background(), "123", strings.NewReader("a large body")); err != nil {
+		t.Fatal("Put() =", err)
+	}
+	if got := fake.ttls["123"]; got != time.Hour {
+		t.Errorf("body expires after %v, want %v", got, time.Hour)
+	}
+}
+
+func TestRedisPutTooLarge(t *testing.T) {
+	fake := &fakeRedis{lists: make(map[string][]string), ttls: make(map[string]time.Duration)}
+	r, _ := newRedisFromClient(fake, StorageConfig{BlobChunkSize: 4, BlobMaxSize: 10})
+	if _, err := r.Put(context.Background(), "123", strings.NewReader("body of 10")); err != nil {
+		t.Fatal("Put() of a body of the max size =", err)
+	}
+	_, err := r.Put(context.Background(), "456", strings.NewReader("a large body"))
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Put() = %v, want %v", err, ErrTooLarge)
+	}
+	if _, ok := fake.lists["456"]; ok {
+		t.Error("partial body was not deleted")
+	}
+}
+
+func TestNewRedisInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  StorageConfig
+	}{{
+		name: "no chunk size",
+		cfg:  StorageConfig{},
+	}, {
+		name: "negative max size",
+		cfg:  StorageConfig{BlobChunkSize: 4, BlobMaxSize: -1},
+	}, {
+		name: "negative TTL",
+		cfg:  StorageConfig{BlobChunkSize: 4, BlobTTL: -time.Second},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newRedisFromClient(&fakeRedis{}, test.cfg); err == nil {
+				t.Error("newRedisFromClient() succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Scheme of the references returned by S3.
+const s3Scheme = "s3://"
+
+// S3 is a Store backed by an S3 compatible bucket. Credentials and region
+// are read from the standard AWS environment.
+type S3 struct {
+	bucket   string
+	prefix   string
+	client   s3iface.S3API
+	uploader *s3manager.Uploader
+}
+
+var _ Store = (*S3)(nil)
+
+// NewS3 creates an S3 client for the bucket described by cfg.
+func NewS3(cfg StorageConfig) (*S3, error) {
+	awsCfg := aws.NewConfig().WithS3ForcePathStyle(cfg.BlobPathStyle)
+	if cfg.BlobEndpoint != "" {
+		awsCfg = awsCfg.WithEndpoint(cfg.BlobEndpoint)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsCfg,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aws session: %w", err)
+	}
+	client := s3.New(sess)
+	return &S3{
+		bucket:   cfg.BlobBucket,
+		prefix:   cfg.BlobPrefix,
+		client:   client,
+		uploader: s3manager.NewUploaderWithClient(client),
+	}, nil
+}
+
+// Put implements Store. Bodies are uploaded in parts, so they are never held
+// in memory as a whole.
+func (s *S3) Put(ctx context.Context, key string, body io.Reader) (string, error) {
+	key = s.prefix + key
+	if _, err := s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	}); err != nil {
+		return "", fmt.Errorf("failed to upload %q: %w", key, err)
+	}
+	return s3Scheme + s.bucket + "/" + key, nil
+}
+
+// Get implements Store.
+func (s *S3) Get(ctx context.Context, ref string) (io.ReadCloser, error) {
+	bucket, key, err := parseS3Ref(ref)
+	if err != nil {
+		return nil, err
+	}
+	out, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %q: %w", ref, err)
+	}
+	return out.Body, nil
+}
+
+// Delete implements Store.
+func (s *S3) Delete(ctx context.Context, ref string) error {
+	bucket, key, err := parseS3Ref(ref)
+	if err != nil {
+		return err
+	}
+	if _, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}); err != nil {
+		return fmt.Errorf("failed to delete %q: %w", ref, err)
+	}
+	return nil
+}
+
+// parseS3Ref splits an s3://bucket/key reference.
+func parseS3Ref(ref string) (string, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(ref, s3Scheme), "/", 2)
+	if !strings.HasPrefix(ref, s3Scheme) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid object reference %q", ref)
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blob
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"knative.dev/async-component/pkg/queue"
+)
+
+// fakeS3 serves the path style object API of a single bucket.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		b, _ := ioutil.ReadAll(r.Body)
+		f.objects[r.URL.Path] = string(b)
+	case http.MethodGet:
+		obj, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(obj))
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3(t *testing.T) {
+	for k, v := range map[string]string{
+		"AWS_REGION":            "us-east-1",
+		"AWS_ACCESS_KEY_ID":     "key",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+	} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+	fake := &fakeS3{objects: make(map[string]string)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	s, err := New(StorageConfig{
+		BlobBucket:    "bodies",
+		BlobPrefix:    "async/",
+		BlobEndpoint:  server.URL,
+		BlobPathStyle: true,
+	}, queue.RedisConfig{})
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	ctx := context.Background()
+	ref, err := s.Put(ctx, "123", strings.NewReader("a large body"))
+	if err != nil {
+		t.Fatal("Put() =", err)
+	}
+	if want := "s3://bodies/async/123"; ref != want {
+		t.Errorf("Put() = %q, want %q", ref, want)
+	}
+	if got := fake.objects["/bodies/async/123"]; got != "a large body" {
+		t.Errorf("stored object = %q", got)
+	}
+
+	body, err := s.Get(ctx, ref)
+	if err != nil {
+		t.Fatal("Get() =", err)
+	}
+	b, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(b) != "a large body" {
+		t.Errorf("Get() = %q", b)
+	}
+
+	if err := s.Delete(ctx, ref); err != nil {
+		t.Fatal("Delete() =", err)
+	}
+	if _, ok := fake.objects["/bodies/async/123"]; ok {
+		t.Error("object was not deleted")
+	}
+}
+
+func TestNewDisabled(t *testing.T) {
+	s, err := New(StorageConfig{}, queue.RedisConfig{})
+	if s != nil || err != nil {
+		t.Errorf("New() = %v, %v, want offloading disabled", s, err)
+	}
+}
+
+func TestParseS3Ref(t *testing.T) {
+	tests := []struct {
+		ref        string
+		wantBucket string
+		wantKey    string
+		wantErr    bool
+	}{{
+		ref:        "s3://bucket/some/key",
+		wantBucket: "bucket",
+		wantKey:    "some/key",
+	}, {
+		ref:     "gs://bucket/key",
+		wantErr: true,
+	}, {
+		ref:     "s3://bucket",
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.ref, func(t *testing.T) {
+			bucket, key, err := parseS3Ref(test.ref)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseS3Ref() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if bucket != test.wantBucket || key != test.wantKey {
+				t.Errorf("parseS3Ref() = %q, %q, want %q, %q", bucket, key, test.wantBucket, test.wantKey)
+			}
+		})
+	}
+}
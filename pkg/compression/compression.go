@@ -0,0 +1,130 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package compression compresses the request bodies stored in the queue.
+// Compressed bodies are base64 encoded, so they can be stored in the JSON
+// document of the request.
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// Gzip compresses bodies with gzip.
+	Gzip = "gzip"
+	// Zstd compresses bodies with Zstandard.
+	Zstd = "zstd"
+)
+
+// CompressionConfig configures the compression of request bodies. Bodies
+// are not compressed when no algorithm is set.
+type CompressionConfig struct {
+	BodyCompression string `envconfig:"BODY_COMPRESSION"`
+	// BodyCompressionThreshold is the size in bytes from which bodies are
+	// compressed.
+	BodyCompressionThreshold int `envconfig:"BODY_COMPRESSION_THRESHOLD" default:"1024"`
+}
+
+// The zstd encoder and decoder are safe for concurrent use with EncodeAll
+// and DecodeAll.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// Compressor compresses request bodies above a size threshold.
+type Compressor struct {
+	algorithm string
+	threshold int
+}
+
+// New returns the Compressor described by cfg, or nil if compression is
+// disabled.
+func New(cfg CompressionConfig) (*Compressor, error) {
+	switch cfg.BodyCompression {
+	case "":
+		return nil, nil
+	case Gzip, Zstd:
+		return &Compressor{algorithm: cfg.BodyCompression, threshold: cfg.BodyCompressionThreshold}, nil
+	default:
+		return nil, fmt.Errorf("unknown body compression %q", cfg.BodyCompression)
+	}
+}
+
+// Compress returns body compressed and base64 encoded, with the encoding to
+// pass to Decompress. Bodies below the threshold, or that do not get
+// smaller, are returned as is with an empty encoding.
+func (c *Compressor) Compress(body string) (string, string, error) {
+	if len(body) < c.threshold {
+		return body, "", nil
+	}
+	var compressed []byte
+	switch c.algorithm {
+	case Gzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write([]byte(body)); err != nil {
+			return "", "", fmt.Errorf("failed to compress body: %w", err)
+		}
+		if err := zw.Close(); err != nil {
+			return "", "", fmt.Errorf("failed to compress body: %w", err)
+		}
+		compressed = buf.Bytes()
+	case Zstd:
+		compressed = zstdEncoder.EncodeAll([]byte(body), nil)
+	}
+	encoded := base64.StdEncoding.EncodeToString(compressed)
+	if len(encoded) >= len(body) {
+		return body, "", nil
+	}
+	return encoded, c.algorithm, nil
+}
+
+// Decompress returns the original of a body returned by Compress with the
+// given encoding.
+func Decompress(body, encoding string) (string, error) {
+	if encoding == "" {
+		return body, nil
+	}
+	compressed, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode %s body: %w", encoding, err)
+	}
+	var b []byte
+	switch encoding {
+	case Gzip:
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return "", fmt.Errorf("failed to decompress body: %w", err)
+		}
+		b, err = ioutil.ReadAll(zr)
+		if err != nil {
+			return "", fmt.Errorf("failed to decompress body: %w", err)
+		}
+	case Zstd:
+		b, err = zstdDecoder.DecodeAll(compressed, nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to decompress body: %w", err)
+		}
+	default:
+		return "", fmt.Errorf("unknown body encoding %q", encoding)
+	}
+	return string(b), nil
+}
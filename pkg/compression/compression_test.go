@@ -0,0 +1,101 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package compression
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	large := strings.Repeat(`{"name":"value"},`, 100)
+	tests := []struct {
+		name         string
+		cfg          CompressionConfig
+		body         string
+		wantEncoding string
+	}{{
+		name:         "gzip",
+		cfg:          CompressionConfig{BodyCompression: Gzip, BodyCompressionThreshold: 100},
+		body:         large,
+		wantEncoding: Gzip,
+	}, {
+		name:         "zstd",
+		cfg:          CompressionConfig{BodyCompression: Zstd, BodyCompressionThreshold: 100},
+		body:         large,
+		wantEncoding: Zstd,
+	}, {
+		name: "below threshold",
+		cfg:  CompressionConfig{BodyCompression: Zstd, BodyCompressionThreshold: 10000},
+		body: large,
+	}, {
+		name: "incompressible",
+		cfg:  CompressionConfig{BodyCompression: Gzip},
+		body: "short",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(test.cfg)
+			if err != nil {
+				t.Fatal("New() =", err)
+			}
+			got, encoding, err := c.Compress(test.body)
+			if err != nil {
+				t.Fatal("Compress() =", err)
+			}
+			if encoding != test.wantEncoding {
+				t.Errorf("encoding = %q, want %q", encoding, test.wantEncoding)
+			}
+			if encoding != "" && len(got) >= len(test.body) {
+				t.Errorf("compressed body has %d bytes, the original %d", len(got), len(test.body))
+			}
+			body, err := Decompress(got, encoding)
+			if err != nil {
+				t.Fatal("Decompress() =", err)
+			}
+			if body != test.body {
+				t.Errorf("Decompress() = %q, want %q", body, test.body)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	if c, err := New(CompressionConfig{}); c != nil || err != nil {
+		t.Errorf("New() of the disabled config = %v, %v, want nil", c, err)
+	}
+	if _, err := New(CompressionConfig{BodyCompression: "brotli"}); err == nil {
+		t.Error("New() of an unknown algorithm succeeded")
+	}
+}
+
+func TestDecompressErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		encoding string
+	}{
+		{"not base64", "%%%", Gzip},
+		{"not gzip", "aGVsbG8=", Gzip},
+		{"not zstd", "aGVsbG8=", Zstd},
+		{"unknown encoding", "aGVsbG8=", "br"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Decompress(test.body, test.encoding); err == nil {
+				t.Error("Decompress() succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config watches the config-async ConfigMap, through which operators
+// tune the async components while they run.
+package config
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"knative.dev/pkg/configmap/informer"
+)
+
+// Name is the name of the ConfigMap holding the runtime configuration.
+const Name = "config-async"
+
+// Watch calls apply with the config-async ConfigMap of namespace once it is
+// synced and on every change. The ConfigMap is optional: while it does not
+// exist apply is called with an empty one, so the components fall back to
+// their environment.
+func Watch(ctx context.Context, namespace string, apply func(*corev1.ConfigMap)) error {
+	return WatchAll(ctx, namespace, map[string]func(*corev1.ConfigMap){Name: apply})
+}
+
+// WatchAll is Watch for several ConfigMaps of namespace, such as config-async
+// and config-observability, calling the function of each name. They are
+// watched through a single informer.
+func WatchAll(ctx context.Context, namespace string, watchers map[string]func(*corev1.ConfigMap)) error {
+	kc, err := NewClient()
+	if err != nil {
+		return err
+	}
+	return watch(ctx, kc, namespace, watchers)
+}
+
+// NewClient returns a client of the cluster the component runs in, with the
+// credentials of its service account.
+func NewClient() (kubernetes.Interface, error) {
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get in-cluster config: %w", err)
+	}
+	kc, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+	}
+	return kc, nil
+}
+
+func watch(ctx context.Context, kc kubernetes.Interface, namespace string, watchers map[string]func(*corev1.ConfigMap)) error {
+	w := informer.NewInformedWatcher(kc, namespace)
+	for name, apply := range watchers {
+		w.WatchWithDefault(corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		}, apply)
+	}
+	if err := w.Start(ctx.Done()); err != nil {
+		return fmt.Errorf("failed to watch ConfigMaps of %s: %w", namespace, err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	kc := fake.NewSimpleClientset()
+	applied := make(chan map[string]string, 10)
+	observability := make(chan string, 10)
+	if err := watch(ctx, kc, "knative-serving", map[string]func(*corev1.ConfigMap){
+		Name: func(cm *corev1.ConfigMap) {
+			applied <- cm.Data
+		},
+		"config-observability": func(cm *corev1.ConfigMap) {
+			observability <- cm.Name
+		},
+	}); err != nil {
+		t.Fatal("watch() =", err)
+	}
+	// Every ConfigMap is applied, even when it does not exist.
+	select {
+	case name := <-observability:
+		if name != "config-observability" {
+			t.Errorf("applied %q, want config-observability", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("config-observability was not applied")
+	}
+
+	next := func() map[string]string {
+		t.Helper()
+		select {
+		case data := <-applied:
+			return data
+		case <-time.After(5 * time.Second):
+			t.Fatal("ConfigMap was not applied")
+			return nil
+		}
+	}
+	// Without a ConfigMap the defaults are applied.
+	if data := next(); len(data) != 0 {
+		t.Errorf("applied %v, want no data", data)
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: Name, Namespace: "knative-serving"},
+		Data:       map[string]string{"request-size-limit": "1000"},
+	}
+	if _, err := kc.CoreV1().ConfigMaps("knative-serving").Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal("Create() =", err)
+	}
+	if data := next(); data["request-size-limit"] != "1000" {
+		t.Errorf("applied %v, want the created ConfigMap", data)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deadletter
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// ListPath is the path the ListHandler is served on.
+	ListPath = "/dead-letters"
+	// Number of requests listed when the limit parameter is not set.
+	defaultListLimit = 100
+	// maxListLimit bounds the limit parameter, as the requests are read
+	// from the backend for each call.
+	maxListLimit = 1000
+)
+
+// Entry is a dead-lettered request, with the failure that got it
+// dead-lettered.
+type Entry struct {
+	// ID is the ID of the request, which selects it for replays.
+	ID string `json:"id"`
+	// Target is the host of the service the request was delivered to.
+	Target string `json:"target,omitempty"`
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// StatusCode is the status of the last response of the service, unset
+	// if it could not be reached.
+	StatusCode     int        `json:"statusCode,omitempty"`
+	Attempts       int        `json:"attempts,omitempty"`
+	EnqueuedAt     *time.Time `json:"enqueuedAt,omitempty"`
+	DeadLetteredAt *time.Time `json:"deadLetteredAt,omitempty"`
+}
+
+type listResponse struct {
+	DeadLetters []Entry `json:"deadLetters"`
+}
+
+// ListHandler answers with up to the limit query parameter of the oldest
+// dead-lettered requests of q, leaving them dead-lettered.
+func ListHandler(q queue.Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		limit := defaultListLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxListLimit {
+				http.Error(w, "limit must be a number from 1 to "+strconv.Itoa(maxListLimit), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		logger := logging.FromContext(r.Context())
+		msgs, err := queue.ListDeadLetters(r.Context(), q, limit)
+		if errors.Is(err, queue.ErrListNotSupported) {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		} else if err != nil {
+			logger.Errorw("Error listing dead-lettered requests", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		resp := listResponse{DeadLetters: make([]Entry, 0, len(msgs))}
+		for _, msg := range msgs {
+			resp.DeadLetters = append(resp.DeadLetters, NewEntry(msg))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			logger.Errorw("Error writing dead-lettered requests", zap.Error(err))
+		}
+	})
+}
+
+// NewEntry describes msg, with the fields of its record when it can be
+// read.
+func NewEntry(msg queue.DeadLetteredMessage) Entry {
+	dl := Entry{
+		ID:         msg.ID,
+		Reason:     msg.Reason,
+		StatusCode: msg.Failure.StatusCode,
+		Attempts:   msg.Failure.Attempts,
+	}
+	if !msg.DeadLettered.IsZero() {
+		dl.DeadLetteredAt = &msg.DeadLettered
+	}
+	if d, err := request.Unmarshal(msg.Data); err == nil {
+		if d.ID != "" {
+			dl.ID = d.ID
+		}
+		dl.Method, dl.URL, dl.EnqueuedAt = d.ReqMethod, d.ReqURL, d.EnqueuedAt
+		if u, err := url.Parse(d.ReqURL); err == nil {
+			dl.Target = u.Host
+		}
+	}
+	return dl
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+)
+
+func TestListHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		query    string
+		hidden   bool
+		wantCode int
+		wantIDs  []string
+	}{{
+		name:     "lists the oldest first",
+		method:   http.MethodGet,
+		wantCode: http.StatusOK,
+		wantIDs:  []string{"request-0", "request-1", "2"},
+	}, {
+		name:     "up to limit",
+		method:   http.MethodGet,
+		query:    "?limit=1",
+		wantCode: http.StatusOK,
+		wantIDs:  []string{"request-0"},
+	}, {
+		name:     "invalid limit",
+		method:   http.MethodGet,
+		query:    "?limit=5000",
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "wrong method",
+		method:   http.MethodPost,
+		wantCode: http.StatusMethodNotAllowed,
+	}, {
+		name:     "not supported",
+		method:   http.MethodGet,
+		hidden:   true,
+		wantCode: http.StatusNotImplemented,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Now()
+			name := fmt.Sprint(t.Name(), time.Now().UnixNano())
+			mem := queue.NewMemory(queue.MemoryConfig{MemoryQueueName: name, MemoryReadTimeout: time.Second})
+			for i := 0; i < 3; i++ {
+				id := fmt.Sprint(i)
+				// The last record cannot be read, and is listed by its
+				// message ID.
+				b := []byte("not a record")
+				if i < 2 {
+					var err error
+					b, err = request.Marshal(request.Data{
+						ID:         "request-" + id,
+						ReqURL:     "http://orders.default.svc/orders?id=" + id,
+						ReqMethod:  http.MethodPost,
+						EnqueuedAt: &now,
+					}, request.FormatJSON, now)
+					if err != nil {
+						t.Fatal("Marshal() =", err)
+					}
+				}
+				if err := mem.Enqueue(ctx, id, b); err != nil {
+					t.Fatal("Enqueue() =", err)
+				}
+				msgs, err := mem.Dequeue(ctx)
+				if err != nil || len(msgs) != 1 {
+					t.Fatalf("Dequeue() = %v, %v, want 1 message", msgs, err)
+				}
+				failure := queue.Failure{StatusCode: http.StatusInternalServerError, Attempts: 3}
+				if err := mem.DeadLetter(queue.WithFailure(ctx, failure), msgs[0], "url returned 500"); err != nil {
+					t.Fatal("DeadLetter() =", err)
+				}
+			}
+			var q queue.Queue = mem
+			if test.hidden {
+				// Hides the ListDeadLetters method of the memory queue.
+				q = struct{ queue.Queue }{mem}
+			}
+
+			rec := httptest.NewRecorder()
+			ListHandler(q).ServeHTTP(rec, httptest.NewRequest(test.method, ListPath+test.query, nil))
+			if rec.Code != test.wantCode {
+				t.Fatalf("got status %d, want %d", rec.Code, test.wantCode)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			var resp listResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal("Decode() =", err)
+			}
+			var ids []string
+			for _, dl := range resp.DeadLetters {
+				ids = append(ids, dl.ID)
+			}
+			if diff := cmp.Diff(test.wantIDs, ids); diff != "" {
+				t.Error("listed IDs (-want, +got):", diff)
+			}
+			first := resp.DeadLetters[0]
+			if first.Target != "orders.default.svc" || first.Method != http.MethodPost || first.Reason != "url returned 500" ||
+				first.StatusCode != http.StatusInternalServerError || first.Attempts != 3 ||
+				first.EnqueuedAt == nil || first.DeadLetteredAt == nil {
+				t.Errorf("first dead letter = %+v, want the request and its failure", first)
+			}
+			if got := len(mem.DeadLetters()); got != 3 {
+				t.Errorf("got %d dead letters left, want 3", got)
+			}
+		})
+	}
+}
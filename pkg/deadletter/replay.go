@@ -0,0 +1,160 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package deadletter serves the dead-lettered requests of a queue to
+// operators, who list them and replay them once their cause is fixed.
+package deadletter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/headers"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// ReplayPath is the path the ReplayHandler is served on.
+	ReplayPath = "/dead-letters/replay"
+	// Number of requests replayed when the max parameter is not set.
+	defaultReplayMax = 100
+
+	// Header carrying the Host the request was sent to, stored by the
+	// producer.
+	requestHostHeader = "Async-Request-Host"
+)
+
+// replayRequest is the optional body of a replay, selecting the requests
+// replayed. All of them are replayed as they are when it is empty.
+type replayRequest struct {
+	// IDs are the IDs of the requests to replay.
+	IDs []string `json:"ids,omitempty"`
+	// Target replaces the scheme and host of the URL of the requests, such as
+	// to deliver them to another revision of the service.
+	Target string `json:"target,omitempty"`
+}
+
+type replayResponse struct {
+	Replayed int `json:"replayed"`
+}
+
+// ReplayHandler moves up to the max query parameter of dead-lettered requests
+// back to q, so they are delivered again. The requests are selected by the
+// replayRequest of the body, if any.
+func ReplayHandler(q queue.Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		max := defaultReplayMax
+		if v := r.URL.Query().Get("max"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, "max must be a positive number", http.StatusBadRequest)
+				return
+			}
+			max = n
+		}
+		var body replayRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			http.Error(w, "invalid replay request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		fn, err := replayFunc(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx := r.Context()
+		if fn != nil {
+			ctx = queue.WithReplayFunc(ctx, fn)
+		}
+		logger := logging.FromContext(ctx)
+		n, err := queue.Replay(ctx, q, max)
+		if errors.Is(err, queue.ErrReplayNotSupported) {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		} else if err != nil {
+			logger.Errorw("Error replaying dead-lettered requests", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		logger.Infow("Replayed dead-lettered requests", zap.Int("count", n))
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(replayResponse{Replayed: n}); err != nil {
+			logger.Errorw("Error writing replay response", zap.Error(err))
+		}
+	})
+}
+
+// replayFunc returns the queue.ReplayFunc selecting the requests of rr, or nil
+// when all of them are replayed as they are. Requests that cannot be read are
+// only replayed when no ID is selected and the target is not replaced.
+func replayFunc(rr replayRequest) (queue.ReplayFunc, error) {
+	var target *url.URL
+	if rr.Target != "" {
+		u, err := url.Parse(rr.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("target %q is not an http or https URL", rr.Target)
+		}
+		target = u
+	}
+	if len(rr.IDs) == 0 && target == nil {
+		return nil, nil
+	}
+	ids := make(map[string]bool, len(rr.IDs))
+	for _, id := range rr.IDs {
+		ids[id] = true
+	}
+	return func(b []byte) ([]byte, bool) {
+		format, err := request.FormatOf(b)
+		if err != nil {
+			return nil, false
+		}
+		d, err := request.Unmarshal(b)
+		if err != nil || (len(ids) > 0 && !ids[d.ID]) {
+			return nil, false
+		}
+		if target == nil {
+			return b, true
+		}
+		u, err := url.Parse(d.ReqURL)
+		if err != nil {
+			return nil, false
+		}
+		u.Scheme, u.Host = target.Scheme, target.Host
+		d.ReqURL = u.String()
+		// The addresses of the original service no longer apply.
+		http.Header(d.ReqHeader).Del(headers.OriginalHost)
+		http.Header(d.ReqHeader).Del(requestHostHeader)
+		t := time.Now()
+		if d.EnqueuedAt != nil {
+			t = *d.EnqueuedAt
+		}
+		out, err := request.Marshal(*d, format, t)
+		if err != nil {
+			return nil, false
+		}
+		return out, true
+	}, nil
+}
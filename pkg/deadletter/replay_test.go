@@ -0,0 +1,167 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deadletter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"knative.dev/async-component/pkg/headers"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+)
+
+func TestReplayHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		query    string
+		body     string
+		hidden   bool
+		wantCode int
+		wantBody string
+		wantLeft int
+		// wantURL and wantOriginalHost are the URL and cluster-local host of
+		// the first request replayed, if checked.
+		wantURL          string
+		wantOriginalHost string
+	}{{
+		name:     "replays up to max",
+		method:   http.MethodPost,
+		query:    "?max=2",
+		wantCode: http.StatusOK,
+		wantBody: `{"replayed":2}`,
+		wantLeft: 1,
+	}, {
+		name:     "replays all by default",
+		method:   http.MethodPost,
+		wantCode: http.StatusOK,
+		wantBody: `{"replayed":3}`,
+	}, {
+		name:     "replays selected requests",
+		method:   http.MethodPost,
+		body:     `{"ids": ["1"]}`,
+		wantCode: http.StatusOK,
+		wantBody: `{"replayed":1}`,
+		wantLeft: 2,
+		wantURL:  "http://orders.default.svc/orders?id=1",
+		// Selected requests are replayed as they are.
+		wantOriginalHost: "orders.default.svc.cluster.local",
+	}, {
+		name:     "replaces the target",
+		method:   http.MethodPost,
+		body:     `{"target": "https://orders-v2.default.svc"}`,
+		wantCode: http.StatusOK,
+		wantBody: `{"replayed":3}`,
+		wantURL:  "https://orders-v2.default.svc/orders?id=0",
+	}, {
+		name:     "invalid target",
+		method:   http.MethodPost,
+		body:     `{"target": "orders-v2"}`,
+		wantCode: http.StatusBadRequest,
+		wantLeft: 3,
+	}, {
+		name:     "invalid body",
+		method:   http.MethodPost,
+		body:     `{"ids": "1"}`,
+		wantCode: http.StatusBadRequest,
+		wantLeft: 3,
+	}, {
+		name:     "invalid max",
+		method:   http.MethodPost,
+		query:    "?max=none",
+		wantCode: http.StatusBadRequest,
+		wantLeft: 3,
+	}, {
+		name:     "wrong method",
+		method:   http.MethodGet,
+		wantCode: http.StatusMethodNotAllowed,
+		wantLeft: 3,
+	}, {
+		name:     "not supported",
+		method:   http.MethodPost,
+		hidden:   true,
+		wantCode: http.StatusNotImplemented,
+		wantLeft: 3,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			// Memory queues of the same name share their messages, so each
+			// run gets its own.
+			name := fmt.Sprint(t.Name(), time.Now().UnixNano())
+			mem := queue.NewMemory(queue.MemoryConfig{MemoryQueueName: name, MemoryReadTimeout: time.Second})
+			for i := 0; i < 3; i++ {
+				id := fmt.Sprint(i)
+				b, err := request.Marshal(request.Data{
+					ID:        id,
+					ReqURL:    "http://orders.default.svc/orders?id=" + id,
+					ReqHeader: map[string][]string{headers.OriginalHost: {"orders.default.svc.cluster.local"}},
+				}, request.FormatJSON, time.Now())
+				if err != nil {
+					t.Fatal("Marshal() =", err)
+				}
+				if err := mem.Enqueue(ctx, id, b); err != nil {
+					t.Fatal("Enqueue() =", err)
+				}
+				msgs, err := mem.Dequeue(ctx)
+				if err != nil || len(msgs) != 1 {
+					t.Fatalf("Dequeue() = %v, %v, want 1 message", msgs, err)
+				}
+				if err := mem.DeadLetter(ctx, msgs[0], "failed"); err != nil {
+					t.Fatal("DeadLetter() =", err)
+				}
+			}
+			var q queue.Queue = mem
+			if test.hidden {
+				// Hides the Replay method of the memory queue.
+				q = struct{ queue.Queue }{mem}
+			}
+
+			rec := httptest.NewRecorder()
+			ReplayHandler(q).ServeHTTP(rec, httptest.NewRequest(test.method, ReplayPath+test.query, strings.NewReader(test.body)))
+			if rec.Code != test.wantCode {
+				t.Errorf("got status %d, want %d", rec.Code, test.wantCode)
+			}
+			if got := strings.TrimSpace(rec.Body.String()); test.wantBody != "" && got != test.wantBody {
+				t.Errorf("got body %s, want %s", got, test.wantBody)
+			}
+			if got := len(mem.DeadLetters()); got != test.wantLeft {
+				t.Errorf("got %d dead letters left, want %d", got, test.wantLeft)
+			}
+			if test.wantURL == "" {
+				return
+			}
+			msgs, err := mem.Dequeue(ctx)
+			if err != nil || len(msgs) != 1 {
+				t.Fatalf("Dequeue() = %v, %v, want 1 message", msgs, err)
+			}
+			d, err := request.Unmarshal(msgs[0].Data)
+			if err != nil {
+				t.Fatal("Unmarshal() =", err)
+			}
+			if d.ReqURL != test.wantURL {
+				t.Errorf("replayed request URL = %q, want %q", d.ReqURL, test.wantURL)
+			}
+			if got := http.Header(d.ReqHeader).Get(headers.OriginalHost); got != test.wantOriginalHost {
+				t.Errorf("replayed request %s = %q, want %q", headers.OriginalHost, got, test.wantOriginalHost)
+			}
+		})
+	}
+}
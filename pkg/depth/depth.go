@@ -0,0 +1,79 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package depth counts the requests of a queue that are not acked yet by the
+// service they are sent to.
+package depth
+
+import (
+	"net/url"
+	"sort"
+	"time"
+
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+)
+
+// Service is the backlog of a service.
+type Service struct {
+	// Target is the host of the service, empty for the requests that could
+	// not be read.
+	Target string
+	// Depth is the number of requests waiting or being delivered, of which
+	// InFlight are being delivered.
+	Depth    int
+	InFlight int
+	// Oldest is the time the oldest request was enqueued, zero when
+	// unknown.
+	Oldest time.Time
+}
+
+// ByService groups msgs by the host of the URL of their request, sorted by
+// decreasing depth, then by target.
+func ByService(msgs []queue.PendingMessage) []Service {
+	byTarget := make(map[string]*Service)
+	for _, msg := range msgs {
+		target, enqueued := "", msg.Enqueued
+		if d, err := request.Unmarshal(msg.Data); err == nil {
+			if u, err := url.Parse(d.ReqURL); err == nil {
+				target = u.Host
+			}
+			if d.EnqueuedAt != nil {
+				enqueued = *d.EnqueuedAt
+			}
+		}
+		s, ok := byTarget[target]
+		if !ok {
+			s = &Service{Target: target}
+			byTarget[target] = s
+		}
+		s.Depth++
+		if msg.InFlight {
+			s.InFlight++
+		}
+		if !enqueued.IsZero() && (s.Oldest.IsZero() || enqueued.Before(s.Oldest)) {
+			s.Oldest = enqueued
+		}
+	}
+	services := make([]Service, 0, len(byTarget))
+	for _, s := range byTarget {
+		services = append(services, *s)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Depth != services[j].Depth {
+			return services[i].Depth > services[j].Depth
+		}
+		return services[i].Target < services[j].Target
+	})
+	return services
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package depth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+)
+
+func TestByService(t *testing.T) {
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	record := func(url string, enqueued time.Time) []byte {
+		b, err := request.Marshal(request.Data{ReqURL: url, EnqueuedAt: &enqueued}, request.FormatJSON, enqueued)
+		if err != nil {
+			t.Fatal("Marshal() =", err)
+		}
+		return b
+	}
+	msgs := []queue.PendingMessage{{
+		Message:  queue.Message{ID: "1", Data: record("http://orders.default.svc/orders", now.Add(-2*time.Minute))},
+		InFlight: true,
+	}, {
+		Message: queue.Message{ID: "2", Data: record("http://users.default.svc/", now.Add(-3*time.Minute))},
+	}, {
+		Message: queue.Message{ID: "3", Data: record("http://orders.default.svc/orders", now.Add(-time.Minute))},
+	}, {
+		Message:  queue.Message{ID: "4", Data: []byte("not a request")},
+		Enqueued: now,
+	}, {
+		Message: queue.Message{ID: "5", Data: []byte("not a request")},
+	}}
+
+	want := []Service{{
+		// Requests that cannot be read are enqueued when the queue tells.
+		Depth:  2,
+		Oldest: now,
+	}, {
+		Target:   "orders.default.svc",
+		Depth:    2,
+		InFlight: 1,
+		Oldest:   now.Add(-2 * time.Minute),
+	}, {
+		Target: "users.default.svc",
+		Depth:  1,
+		Oldest: now.Add(-3 * time.Minute),
+	}}
+	if diff := cmp.Diff(want, ByService(msgs)); diff != "" {
+		t.Error("ByService() (-want, +got):", diff)
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package encryption encrypts the bodies and headers of the stored requests,
+// which often carry personal data and bearer tokens.
+//
+// Requests are sealed with envelope encryption: each one is encrypted with
+// AES-GCM under a random data key, which is itself encrypted under a key
+// encryption key read from a Kubernetes Secret. Sealed requests name the key
+// encryption key they were sealed with, so keys can be rotated by adding a
+// key to the Secret and switching ENCRYPTION_KEY_ID once every consumer has
+// it, while requests sealed with the previous key are still opened.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"knative.dev/async-component/pkg/request"
+)
+
+// Size in bytes of the data keys.
+const dataKeySize = 32
+
+// Separator of the key ID, data key and ciphertext of a sealed request.
+const sep = ":"
+
+// EncryptionConfig configures the encryption of stored requests. Requests
+// are not encrypted when no key directory is set.
+type EncryptionConfig struct {
+	// EncryptionKeysDir is the directory the Secret holding the key
+	// encryption keys is mounted at. Each file holds a base64 encoded 16,
+	// 24 or 32 byte AES key, named by its ID.
+	EncryptionKeysDir string `envconfig:"ENCRYPTION_KEYS_DIR"`
+	// EncryptionKeyID is the ID of the key new requests are sealed with. It
+	// is not needed to only open requests.
+	EncryptionKeyID string `envconfig:"ENCRYPTION_KEY_ID"`
+}
+
+// Encryptor seals and opens stored requests.
+type Encryptor struct {
+	keys   map[string]cipher.AEAD
+	active string
+}
+
+// sealed is the plaintext of a sealed request.
+type sealed struct {
+	Body   string              `json:"body,omitempty"`
+	Header map[string][]string `json:"header,omitempty"`
+}
+
+// New returns the Encryptor described by cfg, with the keys read from its
+// directory, or nil if encryption is disabled.
+func New(cfg EncryptionConfig) (*Encryptor, error) {
+	if cfg.EncryptionKeysDir == "" {
+		return nil, nil
+	}
+	files, err := ioutil.ReadDir(cfg.EncryptionKeysDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption keys: %w", err)
+	}
+	keys := make(map[string][]byte, len(files))
+	for _, f := range files {
+		// Secret volumes hold the keys next to hidden directories.
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(cfg.EncryptionKeysDir, f.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption key %q: %w", f.Name(), err)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode encryption key %q: %w", f.Name(), err)
+		}
+		keys[f.Name()] = key
+	}
+	return newEncryptor(keys, cfg.EncryptionKeyID)
+}
+
+// newEncryptor returns an Encryptor sealing with the key active among keys,
+// or only opening requests when active is empty. Requests are opened with
+// any of the keys.
+func newEncryptor(keys map[string][]byte, active string) (*Encryptor, error) {
+	if _, ok := keys[active]; !ok && active != "" {
+		return nil, fmt.Errorf("encryption key %q not found", active)
+	}
+	e := &Encryptor{keys: make(map[string]cipher.AEAD, len(keys)), active: active}
+	for id, key := range keys {
+		if strings.Contains(id, sep) {
+			return nil, fmt.Errorf("invalid encryption key ID %q", id)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %q: %w", id, err)
+		}
+		e.keys[id] = aead
+	}
+	return e, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal moves the body and headers of d to d.Sealed, encrypted. The ID of
+// the request is authenticated, so sealed data cannot be moved to another
+// request.
+func (e *Encryptor) Seal(d *request.Data) error {
+	if e.active == "" {
+		return errors.New("no encryption key to seal requests with")
+	}
+	plaintext, err := json.Marshal(sealed{Body: d.ReqBody, Header: d.ReqHeader})
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return fmt.Errorf("failed to generate data key: %w", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := seal(aead, plaintext, []byte(d.ID))
+	if err != nil {
+		return err
+	}
+	wrappedKey, err := seal(e.keys[e.active], dataKey, []byte(d.ID))
+	if err != nil {
+		return err
+	}
+	d.Sealed = strings.Join([]string{
+		e.active,
+		base64.StdEncoding.EncodeToString(wrappedKey),
+		base64.StdEncoding.EncodeToString(ciphertext),
+	}, sep)
+	d.ReqBody, d.ReqHeader = "", nil
+	return nil
+}
+
+// Open restores the body and headers of a request sealed by Seal, with
+// any of the keys of e.
+func (e *Encryptor) Open(d *request.Data) error {
+	parts := strings.Split(d.Sealed, sep)
+	if len(parts) != 3 {
+		return errors.New("invalid sealed request")
+	}
+	kek, ok := e.keys[parts[0]]
+	if !ok {
+		return fmt.Errorf("encryption key %q not found", parts[0])
+	}
+	wrappedKey, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("failed to decode data key: %w", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("failed to decode sealed request: %w", err)
+	}
+	dataKey, err := open(kek, wrappedKey, []byte(d.ID))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+	plaintext, err := open(aead, ciphertext, []byte(d.ID))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt request: %w", err)
+	}
+	var s sealed
+	if err := json.Unmarshal(plaintext, &s); err != nil {
+		return fmt.Errorf("failed to unmarshal sealed request: %w", err)
+	}
+	d.ReqBody, d.ReqHeader, d.Sealed = s.Body, s.Header, ""
+	return nil
+}
+
+// seal encrypts plaintext with a random nonce, which prefixes the result.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts the result of seal.
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"knative.dev/async-component/pkg/request"
+)
+
+var (
+	key1 = bytes.Repeat([]byte{1}, 32)
+	key2 = bytes.Repeat([]byte{2}, 16)
+)
+
+func testRequest() request.Data {
+	return request.Data{
+		ID:        "123",
+		ReqBody:   `{"card":"4111 1111 1111 1111"}`,
+		ReqHeader: map[string][]string{"Authorization": {"Bearer secret"}},
+		ReqURL:    "http://example.com/",
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	e, err := newEncryptor(map[string][]byte{"key1": key1}, "key1")
+	if err != nil {
+		t.Fatal("newEncryptor() =", err)
+	}
+	want := testRequest()
+	d := testRequest()
+	if err := e.Seal(&d); err != nil {
+		t.Fatal("Seal() =", err)
+	}
+	if d.ReqBody != "" || d.ReqHeader != nil || !strings.HasPrefix(d.Sealed, "key1:") {
+		t.Errorf("sealed request = %+v, want the body and headers in Sealed", d)
+	}
+	if strings.Contains(d.Sealed, "secret") || strings.Contains(d.Sealed, "4111") {
+		t.Error("sealed request holds the plaintext")
+	}
+
+	opened := d
+	if err := e.Open(&opened); err != nil {
+		t.Fatal("Open() =", err)
+	}
+	if diff := cmp.Diff(want, opened); diff != "" {
+		t.Error("opened request (-want, +got):", diff)
+	}
+
+	// The ID is authenticated.
+	moved := d
+	moved.ID = "456"
+	if err := e.Open(&moved); err == nil {
+		t.Error("Open() succeeded with another request ID")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	old, err := newEncryptor(map[string][]byte{"key1": key1}, "key1")
+	if err != nil {
+		t.Fatal("newEncryptor() =", err)
+	}
+	d := testRequest()
+	if err := old.Seal(&d); err != nil {
+		t.Fatal("Seal() =", err)
+	}
+
+	// Requests sealed with the previous key are opened after switching to
+	// a new one, as long as the previous key is kept.
+	rotated, err := newEncryptor(map[string][]byte{"key1": key1, "key2": key2}, "key2")
+	if err != nil {
+		t.Fatal("newEncryptor() =", err)
+	}
+	if err := rotated.Open(&d); err != nil {
+		t.Fatal("Open() =", err)
+	}
+	if err := rotated.Seal(&d); err != nil {
+		t.Fatal("Seal() =", err)
+	}
+	if !strings.HasPrefix(d.Sealed, "key2:") {
+		t.Errorf("request sealed with %q, want key2", strings.SplitN(d.Sealed, ":", 2)[0])
+	}
+
+	retired, err := newEncryptor(map[string][]byte{"key2": key2}, "")
+	if err != nil {
+		t.Fatal("newEncryptor() =", err)
+	}
+	if err := retired.Open(&d); err != nil {
+		t.Fatal("Open() =", err)
+	}
+	d = testRequest()
+	if err := old.Seal(&d); err != nil {
+		t.Fatal("Seal() =", err)
+	}
+	if err := retired.Open(&d); err == nil {
+		t.Error("Open() succeeded with a removed key")
+	}
+	if err := retired.Seal(&d); err == nil {
+		t.Error("Seal() succeeded without an active key")
+	}
+}
+
+func TestNew(t *testing.T) {
+	encode := func(key []byte) string {
+		return base64.StdEncoding.EncodeToString(key) + "\n"
+	}
+	tests := []struct {
+		name    string
+		files   map[string]string
+		keyID   string
+		wantErr bool
+	}{{
+		name:  "keys",
+		files: map[string]string{"key1": encode(key1), "key2": encode(key2), "..data/key1": "ignored"},
+		keyID: "key2",
+	}, {
+		name:  "open only",
+		files: map[string]string{"key1": encode(key1)},
+	}, {
+		name:    "unknown key ID",
+		files:   map[string]string{"key1": encode(key1)},
+		keyID:   "key2",
+		wantErr: true,
+	}, {
+		name:    "not base64",
+		files:   map[string]string{"key1": "not base64!"},
+		keyID:   "key1",
+		wantErr: true,
+	}, {
+		name:    "invalid key size",
+		files:   map[string]string{"key1": encode([]byte("short"))},
+		keyID:   "key1",
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "keys")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			for name, content := range test.files {
+				path := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			e, err := New(EncryptionConfig{EncryptionKeysDir: dir, EncryptionKeyID: test.keyID})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err == nil && e == nil {
+				t.Error("New() = nil, want an Encryptor")
+			}
+		})
+	}
+
+	if e, err := New(EncryptionConfig{}); e != nil || err != nil {
+		t.Errorf("New() = %v, %v, want nil when disabled", e, err)
+	}
+}
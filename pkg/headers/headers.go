@@ -0,0 +1,145 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package headers keeps sensitive headers, such as long-lived tokens, out of
+// the stored requests, and adds credentials to the requests when they are
+// delivered instead. It also names the headers the components share.
+package headers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// OriginalHost is the header carrying the cluster-local host of the service
+// a request was sent to. It is set by the ingress and stored with the
+// request.
+const OriginalHost = "Async-Original-Host"
+
+// Separator of the host and the header name in the keys of the Secret
+// holding the injected headers.
+const hostSep = "_"
+
+// FilterConfig configures the headers stored with the requests. All headers
+// are stored when both lists are empty.
+type FilterConfig struct {
+	// HeaderAllowlist lists the only headers stored, when set.
+	HeaderAllowlist []string `envconfig:"HEADER_ALLOWLIST"`
+	// HeaderDenylist lists headers that are never stored.
+	HeaderDenylist []string `envconfig:"HEADER_DENYLIST"`
+}
+
+// Filter removes the headers that must not be stored.
+type Filter struct {
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+// NewFilter returns the Filter described by cfg, or nil if all headers are
+// stored.
+func NewFilter(cfg FilterConfig) *Filter {
+	if len(cfg.HeaderAllowlist) == 0 && len(cfg.HeaderDenylist) == 0 {
+		return nil
+	}
+	return &Filter{allow: canonicalSet(cfg.HeaderAllowlist), deny: canonicalSet(cfg.HeaderDenylist)}
+}
+
+func canonicalSet(names []string) map[string]bool {
+	if len(names) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+	}
+	return set
+}
+
+// Apply returns a copy of h without the headers that must not be stored.
+func (f *Filter) Apply(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for name, values := range h {
+		name = http.CanonicalHeaderKey(name)
+		if f.deny[name] || (f.allow != nil && !f.allow[name]) {
+			continue
+		}
+		out[name] = values
+	}
+	return out
+}
+
+// InjectionConfig configures the headers added to the requests when they are
+// delivered.
+type InjectionConfig struct {
+	// HeaderSecretDir is the directory the Secret holding the headers is
+	// mounted at. Each file holds the value of a header, named after it for
+	// all requests, or after the host of a service, an underscore and the
+	// header for the requests to this service only.
+	HeaderSecretDir string `envconfig:"HEADER_SECRET_DIR"`
+}
+
+// Injector adds the headers of a Secret to the requests.
+type Injector struct {
+	dir string
+}
+
+// NewInjector returns the Injector described by cfg, or nil if no headers
+// are added.
+func NewInjector(cfg InjectionConfig) *Injector {
+	if cfg.HeaderSecretDir == "" {
+		return nil
+	}
+	return &Injector{dir: cfg.HeaderSecretDir}
+}
+
+// Inject sets the headers of the Secret in h, for a request to host. Headers
+// scoped to host take precedence over those of all requests. The Secret is
+// read on every call, so rotated credentials are picked up once the kubelet
+// updates the volume.
+func (i *Injector) Inject(h http.Header, host string) error {
+	files, err := ioutil.ReadDir(i.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read injected headers: %w", err)
+	}
+	scoped := make(map[string]string)
+	for _, f := range files {
+		// Secret volumes hold the keys next to hidden directories.
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		name := f.Name()
+		if idx := strings.LastIndex(name, hostSep); idx >= 0 {
+			if name[:idx] != host {
+				continue
+			}
+			name = name[idx+1:]
+		}
+		b, err := ioutil.ReadFile(filepath.Join(i.dir, f.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read injected header %q: %w", f.Name(), err)
+		}
+		value := strings.TrimSpace(string(b))
+		if name != f.Name() {
+			scoped[name] = value
+		} else {
+			h.Set(name, value)
+		}
+	}
+	for name, value := range scoped {
+		h.Set(name, value)
+	}
+	return nil
+}
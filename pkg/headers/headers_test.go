@@ -0,0 +1,114 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package headers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFilter(t *testing.T) {
+	in := http.Header{
+		"Authorization": {"Bearer token"},
+		"Cookie":        {"session=1"},
+		"Content-Type":  {"application/json"},
+		"X-Request-Id":  {"abc"},
+	}
+	tests := []struct {
+		name string
+		cfg  FilterConfig
+		want http.Header
+	}{{
+		name: "denylist",
+		cfg:  FilterConfig{HeaderDenylist: []string{"authorization", " Cookie"}},
+		want: http.Header{"Content-Type": {"application/json"}, "X-Request-Id": {"abc"}},
+	}, {
+		name: "allowlist",
+		cfg:  FilterConfig{HeaderAllowlist: []string{"Content-Type", "Authorization"}},
+		want: http.Header{"Authorization": {"Bearer token"}, "Content-Type": {"application/json"}},
+	}, {
+		name: "both",
+		cfg:  FilterConfig{HeaderAllowlist: []string{"Content-Type", "Authorization"}, HeaderDenylist: []string{"Authorization"}},
+		want: http.Header{"Content-Type": {"application/json"}},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := NewFilter(test.cfg).Apply(in)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Error("Apply() (-want, +got):", diff)
+			}
+		})
+	}
+	if len(in) != 4 {
+		t.Errorf("Apply() modified its input: %v", in)
+	}
+	if f := NewFilter(FilterConfig{}); f != nil {
+		t.Errorf("NewFilter() = %v, want nil when disabled", f)
+	}
+}
+
+func TestInject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, value := range map[string]string{
+		"Authorization": "Bearer shared\n",
+		"X-Api-Key":     "key",
+		"orders.default.svc.cluster.local_Authorization": "Bearer orders",
+		"payments.default.svc.cluster.local_X-Api-Key":   "payments",
+		"..data/Authorization":                           "ignored",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(value), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	injector := NewInjector(InjectionConfig{HeaderSecretDir: dir})
+
+	tests := []struct {
+		host string
+		want http.Header
+	}{{
+		host: "orders.default.svc.cluster.local",
+		want: http.Header{"Authorization": {"Bearer orders"}, "X-Api-Key": {"key"}, "Content-Type": {"text/plain"}},
+	}, {
+		host: "payments.default.svc.cluster.local",
+		want: http.Header{"Authorization": {"Bearer shared"}, "X-Api-Key": {"payments"}, "Content-Type": {"text/plain"}},
+	}}
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			h := http.Header{"Authorization": {"Bearer stale"}, "Content-Type": {"text/plain"}}
+			if err := injector.Inject(h, test.host); err != nil {
+				t.Fatal("Inject() =", err)
+			}
+			if diff := cmp.Diff(test.want, h); diff != "" {
+				t.Error("Inject() (-want, +got):", diff)
+			}
+		})
+	}
+
+	if err := NewInjector(InjectionConfig{HeaderSecretDir: filepath.Join(dir, "missing")}).Inject(http.Header{}, "orders"); err == nil {
+		t.Error("Inject() succeeded without the Secret")
+	}
+}
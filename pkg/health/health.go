@@ -0,0 +1,57 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package health serves the liveness and readiness probes of the async
+// components.
+package health
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// LivenessPath is the path of the liveness probe.
+	LivenessPath = "/healthz"
+	// ReadinessPath is the path of the readiness probe.
+	ReadinessPath = "/readyz"
+
+	// checkTimeout bounds a readiness check, so probes answer before the
+	// kubelet gives up on them.
+	checkTimeout = 3 * time.Second
+)
+
+// Liveness answers 200 as long as the process serves HTTP.
+func Liveness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+}
+
+// Readiness answers 200 when check succeeds and 503 otherwise.
+func Readiness(check func(ctx context.Context) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+		defer cancel()
+		if err := check(ctx); err != nil {
+			logging.FromContext(r.Context()).Infow("Readiness check failed", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantCode int
+	}{{
+		name:     "ready",
+		wantCode: http.StatusOK,
+	}, {
+		name:     "not ready",
+		err:      errors.New("redis is down"),
+		wantCode: http.StatusServiceUnavailable,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := Readiness(func(ctx context.Context) error {
+				if _, ok := ctx.Deadline(); !ok {
+					t.Error("check was called without a deadline")
+				}
+				return test.err
+			})
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, ReadinessPath, nil))
+			if rr.Code != test.wantCode {
+				t.Errorf("got %d, want %d", rr.Code, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	rr := httptest.NewRecorder()
+	Liveness().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, LivenessPath, nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("got %d, want %d", rr.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package history ships the records of completed requests to external sinks
+// for long-term analysis. The consumer adds a record to a Redis stream when a
+// delivery reaches a final state, and the history exporter reads the stream
+// and writes the records to Elasticsearch, object storage or an HTTP
+// endpoint in batches, so a slow or unavailable sink never delays deliveries.
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/status"
+)
+
+// Record describes a completed request.
+type Record struct {
+	ID string `json:"id"`
+	// Target is the host of the service the request was sent to.
+	Target string       `json:"target,omitempty"`
+	Method string       `json:"method,omitempty"`
+	Path   string       `json:"path,omitempty"`
+	State  status.State `json:"state"`
+	// StatusCode is the status of the response of the service, if any.
+	StatusCode int    `json:"statusCode,omitempty"`
+	Attempts   int    `json:"attempts,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	// EnqueuedAt is the time the request was queued, when known.
+	EnqueuedAt  *time.Time `json:"enqueuedAt,omitempty"`
+	CompletedAt time.Time  `json:"completedAt"`
+	// Payload is only recorded with HISTORY_PAYLOAD.
+	Payload *Payload `json:"payload,omitempty"`
+}
+
+// Payload holds the headers and bodies of a request and of its response.
+// Bodies are cut to HISTORY_BODY_LIMIT bytes, and the body of requests
+// offloaded to object storage is not recorded.
+type Payload struct {
+	RequestHeader     map[string][]string `json:"requestHeader,omitempty"`
+	RequestBody       string              `json:"requestBody,omitempty"`
+	RequestTruncated  bool                `json:"requestTruncated,omitempty"`
+	ResponseHeader    map[string][]string `json:"responseHeader,omitempty"`
+	ResponseBody      string              `json:"responseBody,omitempty"`
+	ResponseTruncated bool                `json:"responseTruncated,omitempty"`
+}
+
+// HistoryConfig configures the stream the consumer adds the records to, and
+// is meant to be embedded in the envconfig struct of the consumer and of the
+// exporter next to queue.Config. No history is recorded when HISTORY_STREAM
+// is empty.
+type HistoryConfig struct {
+	HistoryStream string `envconfig:"HISTORY_STREAM"`
+	// HistoryStreamMaxLen is the approximate number of records the stream
+	// keeps while the exporter is behind, all of them when zero.
+	HistoryStreamMaxLen int64 `envconfig:"HISTORY_STREAM_MAX_LEN"`
+	// HistoryPayload records the headers and bodies along with the metadata
+	// of the requests, and HistoryBodyLimit bounds each body.
+	HistoryPayload   bool  `envconfig:"HISTORY_PAYLOAD"`
+	HistoryBodyLimit int64 `envconfig:"HISTORY_BODY_LIMIT" default:"65536"`
+}
+
+// Field of the stream entries holding the JSON of the record.
+const recordField = "record"
+
+// Stream is the Redis stream of the records of completed requests.
+type Stream struct {
+	client redis.Cmdable
+	name   string
+	maxLen int64
+}
+
+// New returns the Stream described by cfg, connected with the queue's Redis
+// settings, or nil if no history is recorded.
+func New(cfg HistoryConfig, redisCfg queue.RedisConfig) (*Stream, error) {
+	if cfg.HistoryStream == "" {
+		return nil, nil
+	}
+	client, err := queue.NewRedisClient(redisCfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewStream(client, cfg.HistoryStream, cfg.HistoryStreamMaxLen), nil
+}
+
+// NewStream returns the stream name, trimmed to about maxLen entries when it
+// is positive.
+func NewStream(client redis.Cmdable, name string, maxLen int64) *Stream {
+	return &Stream{client: client, name: name, maxLen: maxLen}
+}
+
+// Add appends r to the stream.
+func (s *Stream) Add(ctx context.Context, r Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to marshal history record: %w", err)
+	}
+	args := &redis.XAddArgs{
+		Stream:       s.name,
+		MaxLenApprox: s.maxLen,
+		Values:       map[string]interface{}{recordField: b},
+	}
+	if err := s.client.XAdd(ctx, args).Err(); err != nil {
+		return fmt.Errorf("failed to add history record to %q: %w", s.name, err)
+	}
+	return nil
+}
+
+// Entry is a record read from the stream. Record is nil when the entry
+// could not be read, and the entry is only to be acknowledged.
+type Entry struct {
+	ID     string
+	Record *Record
+}
+
+// CreateGroup creates the consumer group reading the stream, and the stream,
+// unless they exist.
+func (s *Stream) CreateGroup(ctx context.Context, group string) error {
+	err := s.client.XGroupCreateMkStream(ctx, s.name, group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("failed to create group %q of %q: %w", group, s.name, err)
+	}
+	return nil
+}
+
+// Read returns up to count entries for consumer of group. With pending, the
+// entries it read but did not acknowledge are returned, from the oldest;
+// otherwise new entries, waiting up to block for them.
+func (s *Stream) Read(ctx context.Context, group, consumer string, pending bool, count int64, block time.Duration) ([]Entry, error) {
+	id := ">"
+	if pending {
+		id = "0"
+	}
+	streams, err := s.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    group,
+		Consumer: consumer,
+		Streams:  []string{s.name, id},
+		Count:    count,
+		Block:    block,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %w", s.name, err)
+	}
+	var entries []Entry
+	for _, stream := range streams {
+		for _, msg := range stream.Messages {
+			entries = append(entries, Entry{ID: msg.ID, Record: parseRecord(msg.Values)})
+		}
+	}
+	return entries, nil
+}
+
+// parseRecord returns the record of the values of an entry, or nil.
+func parseRecord(values map[string]interface{}) *Record {
+	v, ok := values[recordField].(string)
+	if !ok {
+		return nil
+	}
+	var r Record
+	if err := json.Unmarshal([]byte(v), &r); err != nil {
+		return nil
+	}
+	return &r
+}
+
+// Ack acknowledges the entries ids of group and removes them from the
+// stream, once their records were shipped.
+func (s *Stream) Ack(ctx context.Context, group string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := s.client.XAck(ctx, s.name, group, ids...).Err(); err != nil {
+		return fmt.Errorf("failed to acknowledge history records: %w", err)
+	}
+	if err := s.client.XDel(ctx, s.name, ids...).Err(); err != nil {
+		return fmt.Errorf("failed to delete history records: %w", err)
+	}
+	return nil
+}
+
+// Close closes the connection to Redis.
+func (s *Stream) Close() error {
+	if c, ok := s.client.(*redis.Client); ok {
+		return c.Close()
+	}
+	return nil
+}
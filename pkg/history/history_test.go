@@ -0,0 +1,349 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+	"knative.dev/async-component/pkg/blob"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/status"
+)
+
+// fakeStream is a redis stream read by a single consumer group.
+type fakeStream struct {
+	redis.Cmdable
+	maxLen  int64
+	entries []redis.XMessage
+	// delivered is the number of entries read by the group, and acked the
+	// IDs acknowledged.
+	delivered int
+	acked     map[string]bool
+	deleted   []string
+}
+
+func (f *fakeStream) XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd {
+	f.maxLen = a.MaxLenApprox
+	values := map[string]interface{}{}
+	for k, v := range a.Values.(map[string]interface{}) {
+		// Redis returns the values as strings.
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		values[k] = v
+	}
+	id := fmt.Sprintf("%d-0", len(f.entries)+1)
+	f.entries = append(f.entries, redis.XMessage{ID: id, Values: values})
+	return redis.NewStringResult(id, nil)
+}
+
+func (f *fakeStream) XReadGroup(ctx context.Context, a *redis.XReadGroupArgs) *redis.XStreamSliceCmd {
+	var msgs []redis.XMessage
+	if a.Streams[1] == "0" {
+		for _, m := range f.entries[:f.delivered] {
+			if !f.acked[m.ID] && int64(len(msgs)) < a.Count {
+				msgs = append(msgs, m)
+			}
+		}
+		return redis.NewXStreamSliceCmdResult([]redis.XStream{{Stream: a.Streams[0], Messages: msgs}}, nil)
+	}
+	for f.delivered < len(f.entries) && int64(len(msgs)) < a.Count {
+		msgs = append(msgs, f.entries[f.delivered])
+		f.delivered++
+	}
+	if len(msgs) == 0 {
+		return redis.NewXStreamSliceCmdResult(nil, redis.Nil)
+	}
+	return redis.NewXStreamSliceCmdResult([]redis.XStream{{Stream: a.Streams[0], Messages: msgs}}, nil)
+}
+
+func (f *fakeStream) XAck(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd {
+	if f.acked == nil {
+		f.acked = map[string]bool{}
+	}
+	for _, id := range ids {
+		f.acked[id] = true
+	}
+	return redis.NewIntResult(int64(len(ids)), nil)
+}
+
+func (f *fakeStream) XDel(ctx context.Context, stream string, ids ...string) *redis.IntCmd {
+	f.deleted = append(f.deleted, ids...)
+	return redis.NewIntResult(int64(len(ids)), nil)
+}
+
+func TestStream(t *testing.T) {
+	ctx := context.Background()
+	client := &fakeStream{}
+	s := NewStream(client, "async-history", 1000)
+	completed := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	records := []Record{
+		{ID: "1", Target: "orders.default.example.com", State: status.Succeeded, StatusCode: 200, Attempts: 1, CompletedAt: completed},
+		{ID: "2", State: status.Failed, Reason: "request expired", CompletedAt: completed},
+		{ID: "3", State: status.Succeeded, Payload: &Payload{RequestBody: "{}", ResponseBody: "ok"}, CompletedAt: completed},
+	}
+	for _, r := range records {
+		if err := s.Add(ctx, r); err != nil {
+			t.Fatal("Add() =", err)
+		}
+	}
+	if client.maxLen != 1000 {
+		t.Errorf("MAXLEN ~ %d, want 1000", client.maxLen)
+	}
+	client.entries = append(client.entries, redis.XMessage{ID: "4-0", Values: map[string]interface{}{recordField: "{"}})
+
+	entries, err := s.Read(ctx, "async-history", "exporter", false, 3, time.Second)
+	if err != nil {
+		t.Fatal("Read() =", err)
+	}
+	var got []Record
+	for _, e := range entries {
+		got = append(got, *e.Record)
+	}
+	if diff := cmp.Diff(records, got); diff != "" {
+		t.Error("records (-want, +got):", diff)
+	}
+	if err := s.Ack(ctx, "async-history", entries[0].ID); err != nil {
+		t.Fatal("Ack() =", err)
+	}
+
+	// Entries read but not acknowledged are read again.
+	entries, err = s.Read(ctx, "async-history", "exporter", true, 10, time.Second)
+	if err != nil {
+		t.Fatal("Read(pending) =", err)
+	}
+	if len(entries) != 2 || entries[0].ID != "2-0" || entries[1].ID != "3-0" {
+		t.Errorf("Read(pending) = %+v, want entries 2-0 and 3-0", entries)
+	}
+	// Unreadable entries have no record.
+	entries, err = s.Read(ctx, "async-history", "exporter", false, 10, time.Second)
+	if err != nil {
+		t.Fatal("Read() =", err)
+	}
+	if len(entries) != 1 || entries[0].ID != "4-0" || entries[0].Record != nil {
+		t.Errorf("Read() = %+v, want entry 4-0 without a record", entries)
+	}
+	if entries, err = s.Read(ctx, "async-history", "exporter", false, 10, time.Second); err != nil || len(entries) != 0 {
+		t.Errorf("Read() = %v, %v, want no entries", entries, err)
+	}
+	if diff := cmp.Diff([]string{"1-0"}, client.deleted); diff != "" {
+		t.Error("deleted (-want, +got):", diff)
+	}
+}
+
+func TestNewSink(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     SinkConfig
+		storage blob.StorageConfig
+		want    Sink
+		wantErr bool
+	}{{
+		name: "elasticsearch",
+		cfg:  SinkConfig{HistorySink: SinkElasticsearch, HistoryURL: "http://es.example.com"},
+		want: &Elasticsearch{},
+	}, {
+		name:    "elasticsearch without url",
+		cfg:     SinkConfig{HistorySink: SinkElasticsearch},
+		wantErr: true,
+	}, {
+		name: "http",
+		cfg:  SinkConfig{HistorySink: SinkHTTP, HistoryURL: "http://collector.example.com"},
+		want: &HTTP{},
+	}, {
+		name:    "blob",
+		cfg:     SinkConfig{HistorySink: SinkBlob},
+		storage: blob.StorageConfig{BlobBackend: blob.BackendS3, BlobBucket: "history"},
+		want:    &Blob{},
+	}, {
+		name:    "blob without bucket",
+		cfg:     SinkConfig{HistorySink: SinkBlob},
+		storage: blob.StorageConfig{BlobBackend: blob.BackendS3},
+		wantErr: true,
+	}, {
+		name:    "unknown sink",
+		cfg:     SinkConfig{HistorySink: "bigtable"},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := NewSink(test.cfg, test.storage, queue.RedisConfig{})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("NewSink() = %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && fmt.Sprintf("%T", s) != fmt.Sprintf("%T", test.want) {
+				t.Errorf("NewSink() = %T, want %T", s, test.want)
+			}
+		})
+	}
+}
+
+// readLines returns the JSON objects of a newline delimited body.
+func readLines(t *testing.T, body io.Reader) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("Error decoding line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestElasticsearch(t *testing.T) {
+	records := []Record{{ID: "1", State: status.Succeeded}, {ID: "2", State: status.Failed}}
+	tests := []struct {
+		name     string
+		code     int
+		response string
+		wantErr  bool
+	}{{
+		name:     "indexed",
+		code:     http.StatusOK,
+		response: `{"errors":false,"items":[{"index":{"status":201}},{"index":{"status":201}}]}`,
+	}, {
+		name:     "rejected record",
+		code:     http.StatusOK,
+		response: `{"errors":true,"items":[{"index":{"status":201}},{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}]}`,
+		wantErr:  true,
+	}, {
+		name:     "unavailable",
+		code:     http.StatusServiceUnavailable,
+		response: `{}`,
+		wantErr:  true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var lines []map[string]interface{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/_bulk" || r.Header.Get("Authorization") != "ApiKey secret" {
+					t.Errorf("got %s with Authorization %q, want /_bulk with the API key", r.URL.Path, r.Header.Get("Authorization"))
+				}
+				lines = readLines(t, r.Body)
+				w.WriteHeader(test.code)
+				io.WriteString(w, test.response)
+			}))
+			defer server.Close()
+			e := NewElasticsearch(server.URL+"/", "async-requests", "ApiKey secret")
+			defer e.Close()
+
+			if err := e.Ship(context.Background(), records); (err != nil) != test.wantErr {
+				t.Fatalf("Ship() = %v, want error %v", err, test.wantErr)
+			}
+			// Each record is indexed by its ID.
+			want := []map[string]interface{}{
+				{"index": map[string]interface{}{"_index": "async-requests", "_id": "1"}},
+				{"id": "1", "state": "succeeded", "completedAt": "0001-01-01T00:00:00Z"},
+				{"index": map[string]interface{}{"_index": "async-requests", "_id": "2"}},
+				{"id": "2", "state": "failed", "completedAt": "0001-01-01T00:00:00Z"},
+			}
+			if diff := cmp.Diff(want, lines); diff != "" {
+				t.Error("bulk request (-want, +got):", diff)
+			}
+		})
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	var lines []map[string]interface{}
+	code := http.StatusAccepted
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("got %s with Content-Type %q, want a newline delimited JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		lines = readLines(t, r.Body)
+		w.WriteHeader(code)
+	}))
+	defer server.Close()
+	h := NewHTTP(server.URL, "")
+	defer h.Close()
+
+	records := []Record{{ID: "1", State: status.Succeeded}, {ID: "2", State: status.Failed}}
+	if err := h.Ship(context.Background(), records); err != nil {
+		t.Fatal("Ship() =", err)
+	}
+	if len(lines) != 2 || lines[0]["id"] != "1" || lines[1]["id"] != "2" {
+		t.Errorf("body = %v, want records 1 and 2", lines)
+	}
+	code = http.StatusInternalServerError
+	if err := h.Ship(context.Background(), records); err == nil {
+		t.Error("Ship() = nil, want the error of the endpoint")
+	}
+}
+
+// memoryStore is a blob.Store keeping the objects put.
+type memoryStore struct {
+	objects map[string][]byte
+	err     error
+}
+
+func (m *memoryStore) Put(ctx context.Context, key string, body io.Reader) (string, error) {
+	if m.err != nil {
+		return "", m.err
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	m.objects[key] = b
+	return key, nil
+}
+
+func (m *memoryStore) Get(ctx context.Context, ref string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(m.objects[ref])), nil
+}
+
+func (m *memoryStore) Delete(ctx context.Context, ref string) error {
+	delete(m.objects, ref)
+	return nil
+}
+
+func TestBlob(t *testing.T) {
+	store := &memoryStore{objects: map[string][]byte{}}
+	b := NewBlob(store)
+	completed := time.Date(2021, 3, 1, 23, 30, 0, 0, time.FixedZone("", -2*60*60))
+	records := []Record{{ID: "a", State: status.Succeeded, CompletedAt: completed}, {ID: "b", State: status.Failed, CompletedAt: completed}}
+	if err := b.Ship(context.Background(), records); err != nil {
+		t.Fatal("Ship() =", err)
+	}
+	// Objects are keyed by the UTC date of the batch.
+	body, ok := store.objects["history/2021/03/02/a-b.ndjson"]
+	if !ok {
+		t.Fatalf("objects = %v, want history/2021/03/02/a-b.ndjson", store.objects)
+	}
+	if lines := readLines(t, bytes.NewReader(body)); len(lines) != 2 || lines[1]["id"] != "b" {
+		t.Errorf("object = %s, want records a and b", body)
+	}
+
+	store.err = errors.New("access denied")
+	if err := b.Ship(context.Background(), records); err == nil {
+		t.Error("Ship() = nil, want the error of the store")
+	}
+}
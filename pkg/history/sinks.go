@@ -0,0 +1,262 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package history
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"knative.dev/async-component/pkg/blob"
+	"knative.dev/async-component/pkg/queue"
+)
+
+const (
+	// SinkElasticsearch indexes the records in the HISTORY_INDEX index of
+	// the Elasticsearch cluster at HISTORY_URL, with the bulk API.
+	SinkElasticsearch = "elasticsearch"
+	// SinkBlob uploads each batch as a newline delimited JSON object to the
+	// object storage described by the BLOB_* settings, from which it can be
+	// loaded into BigQuery, Athena or a data lake.
+	SinkBlob = "blob"
+	// SinkHTTP POSTs each batch to HISTORY_URL as newline delimited JSON.
+	SinkHTTP = "http"
+)
+
+// Sink is the interface implemented by the destinations of the history.
+type Sink interface {
+	// Ship writes a batch of records. A batch may be shipped again after a
+	// failure, so sinks should write it idempotently when they can.
+	Ship(ctx context.Context, records []Record) error
+	// Close releases the resources held by the sink.
+	Close() error
+}
+
+// SinkConfig selects and configures the sink of the history exporter.
+type SinkConfig struct {
+	HistorySink string `envconfig:"HISTORY_SINK" required:"true"`
+	// HistoryURL is the address of the Elasticsearch cluster, or the
+	// endpoint of the http sink.
+	HistoryURL string `envconfig:"HISTORY_URL"`
+	// HistoryIndex is the Elasticsearch index of the records.
+	HistoryIndex string `envconfig:"HISTORY_INDEX" default:"async-requests"`
+	// HistoryAuthorization is sent as the Authorization header to
+	// Elasticsearch and to the http sink, such as "ApiKey ...".
+	HistoryAuthorization string `envconfig:"HISTORY_AUTHORIZATION"`
+}
+
+// NewSink returns the Sink described by cfg. The blob sink uploads to the
+// store described by storage, connected with the queue's Redis settings for
+// the redis backend.
+func NewSink(cfg SinkConfig, storage blob.StorageConfig, redisCfg queue.RedisConfig) (Sink, error) {
+	switch cfg.HistorySink {
+	case SinkElasticsearch, SinkHTTP:
+		if cfg.HistoryURL == "" {
+			return nil, fmt.Errorf("HISTORY_URL must be set with the %q sink", cfg.HistorySink)
+		}
+		if cfg.HistorySink == SinkHTTP {
+			return NewHTTP(cfg.HistoryURL, cfg.HistoryAuthorization), nil
+		}
+		return NewElasticsearch(cfg.HistoryURL, cfg.HistoryIndex, cfg.HistoryAuthorization), nil
+	case SinkBlob:
+		store, err := blob.New(storage, redisCfg)
+		if err != nil {
+			return nil, err
+		}
+		if store == nil {
+			return nil, fmt.Errorf("BLOB_BUCKET must be set with the %q sink", SinkBlob)
+		}
+		return NewBlob(store), nil
+	default:
+		return nil, fmt.Errorf("unknown history sink %q", cfg.HistorySink)
+	}
+}
+
+// Elasticsearch is a Sink indexing the records with the bulk API. Records
+// are indexed by request ID, so shipping a batch again overwrites them.
+type Elasticsearch struct {
+	url           string
+	index         string
+	authorization string
+	client        *http.Client
+}
+
+// NewElasticsearch returns a Sink indexing the records in index of the
+// cluster at url.
+func NewElasticsearch(url, index, authorization string) *Elasticsearch {
+	return &Elasticsearch{url: strings.TrimSuffix(url, "/"), index: index, authorization: authorization, client: &http.Client{}}
+}
+
+// bulkResponse is the part of the answer of the bulk API reporting failures.
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// Ship implements Sink.
+func (e *Elasticsearch) Ship(ctx context.Context, records []Record) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, r := range records {
+		action := map[string]interface{}{"index": map[string]string{"_index": e.index, "_id": r.ID}}
+		if err := enc.Encode(action); err != nil {
+			return fmt.Errorf("failed to marshal bulk action: %w", err)
+		}
+		if err := enc.Encode(r); err != nil {
+			return fmt.Errorf("failed to marshal history record: %w", err)
+		}
+	}
+	resp, err := post(ctx, e.client, e.url+"/_bulk", e.authorization, &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var bulk bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&bulk); err != nil {
+		return fmt.Errorf("failed to read bulk response: %w", err)
+	}
+	if !bulk.Errors {
+		return nil
+	}
+	for _, item := range bulk.Items {
+		for _, result := range item {
+			if result.Error != nil {
+				return fmt.Errorf("failed to index history record: %s: %s", result.Error.Type, result.Error.Reason)
+			}
+		}
+	}
+	return errors.New("failed to index history records")
+}
+
+// Close implements Sink.
+func (e *Elasticsearch) Close() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+// HTTP is a Sink POSTing each batch to an endpoint as newline delimited
+// JSON.
+type HTTP struct {
+	url           string
+	authorization string
+	client        *http.Client
+}
+
+// NewHTTP returns a Sink POSTing the batches to url, which must answer 2xx.
+func NewHTTP(url, authorization string) *HTTP {
+	return &HTTP{url: url, authorization: authorization, client: &http.Client{}}
+}
+
+// Ship implements Sink.
+func (h *HTTP) Ship(ctx context.Context, records []Record) error {
+	body, err := encode(records)
+	if err != nil {
+		return err
+	}
+	resp, err := post(ctx, h.client, h.url, h.authorization, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// Close implements Sink.
+func (h *HTTP) Close() error {
+	h.client.CloseIdleConnections()
+	return nil
+}
+
+// Blob is a Sink uploading each batch as an object of newline delimited
+// JSON. Objects are keyed by the completion date of the first record of the
+// batch, as history/YYYY/MM/DD/<first ID>-<last ID>.ndjson, so shipping a
+// batch again overwrites it.
+type Blob struct {
+	store blob.Store
+}
+
+// NewBlob returns a Sink uploading the batches to store.
+func NewBlob(store blob.Store) *Blob {
+	return &Blob{store: store}
+}
+
+// Ship implements Sink.
+func (b *Blob) Ship(ctx context.Context, records []Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	body, err := encode(records)
+	if err != nil {
+		return err
+	}
+	first, last := records[0], records[len(records)-1]
+	key := fmt.Sprintf("history/%s/%s-%s.ndjson", first.CompletedAt.UTC().Format("2006/01/02"), first.ID, last.ID)
+	if _, err := b.store.Put(ctx, key, body); err != nil {
+		return fmt.Errorf("failed to upload history records: %w", err)
+	}
+	return nil
+}
+
+// Close implements Sink.
+func (b *Blob) Close() error {
+	return nil
+}
+
+// encode returns records as newline delimited JSON.
+func encode(records []Record) (*bytes.Buffer, error) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return nil, fmt.Errorf("failed to marshal history record: %w", err)
+		}
+	}
+	return &body, nil
+}
+
+// post sends body to url as newline delimited JSON, and returns the response
+// unless it is not 2xx.
+func post(ctx context.Context, client *http.Client, url, authorization string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create history request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send history records: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("history endpoint answered %d", resp.StatusCode)
+	}
+	return resp, nil
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package idempotency detects duplicate submissions of a request carrying
+// the same Idempotency-Key header.
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"knative.dev/async-component/pkg/queue"
+)
+
+const (
+	// Header is the request header carrying the idempotency key.
+	Header = "Idempotency-Key"
+
+	// BackendRedis stores keys in Redis, using the queue's Redis settings.
+	BackendRedis = "redis"
+	// BackendMemory stores keys in the memory of the process.
+	BackendMemory = "memory"
+)
+
+// ErrPending is returned, along with the ID claimed first, for the claims of
+// a key whose first claim is still pending, see Store.ClaimPending.
+var ErrPending = errors.New("idempotency key is claimed by a pending submission")
+
+// Store remembers the request ID submitted with each idempotency key for the
+// length of the deduplication window.
+type Store interface {
+	// Claim records id for key unless the key was already claimed within
+	// the window, in which case the ID recorded first is returned with
+	// claimed set to false.
+	Claim(ctx context.Context, key, id string) (existing string, claimed bool, err error)
+	// ClaimPending claims key for id as Claim does, but the claim stays
+	// pending until it is confirmed: the claims of key then return the ID
+	// claimed first and ErrPending. Pending claims expire after the pending
+	// timeout, so those that are neither confirmed nor released, such as
+	// by a crashed process, do not hold the key for the whole window.
+	ClaimPending(ctx context.Context, key, id string) (existing string, claimed bool, err error)
+	// Confirm records the pending claim of key by id for the window.
+	Confirm(ctx context.Context, key, id string) error
+	// Release forgets key, so a submission whose request could not be
+	// enqueued can be retried.
+	Release(ctx context.Context, key string) error
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// DedupConfig selects and configures the idempotency key store.
+// Deduplication is disabled when no backend is set.
+type DedupConfig struct {
+	IdempotencyBackend string        `envconfig:"IDEMPOTENCY_BACKEND"`
+	IdempotencyWindow  time.Duration `envconfig:"IDEMPOTENCY_WINDOW" default:"24h"`
+	// IdempotencyPendingTimeout is how long a pending claim holds its key.
+	// It must be longer than it takes to accept a request.
+	IdempotencyPendingTimeout time.Duration `envconfig:"IDEMPOTENCY_PENDING_TIMEOUT" default:"1m"`
+}
+
+// New returns the Store described by cfg, or nil if deduplication is
+// disabled. The Redis backend connects with the queue's Redis settings.
+func New(ctx context.Context, cfg DedupConfig, redisCfg queue.RedisConfig) (Store, error) {
+	switch cfg.IdempotencyBackend {
+	case "":
+		return nil, nil
+	case BackendRedis:
+		r, err := NewRedis(cfg, redisCfg)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	case BackendMemory:
+		return NewMemory(cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown idempotency backend %q", cfg.IdempotencyBackend)
+	}
+}
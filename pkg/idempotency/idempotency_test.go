@@ -0,0 +1,125 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"knative.dev/async-component/pkg/queue"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       DedupConfig
+		redisCfg  queue.RedisConfig
+		wantStore bool
+		wantErr   bool
+	}{{
+		name: "disabled",
+	}, {
+		name:      "redis backend",
+		cfg:       DedupConfig{IdempotencyBackend: BackendRedis},
+		redisCfg:  queue.RedisConfig{RedisAddress: "redis://localhost:6379"},
+		wantStore: true,
+	}, {
+		name:     "redis backend with bad address",
+		cfg:      DedupConfig{IdempotencyBackend: BackendRedis},
+		redisCfg: queue.RedisConfig{RedisAddress: "notredis://localhost:6379"},
+		wantErr:  true,
+	}, {
+		name:      "memory backend",
+		cfg:       DedupConfig{IdempotencyBackend: BackendMemory},
+		wantStore: true,
+	}, {
+		name:    "unknown backend",
+		cfg:     DedupConfig{IdempotencyBackend: "unknown"},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := New(context.Background(), test.cfg, test.redisCfg)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if (s != nil) != test.wantStore {
+				t.Fatalf("New() = %v, want a store: %v", s, test.wantStore)
+			}
+			if s != nil {
+				s.Close()
+			}
+		})
+	}
+}
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	m := NewMemory(DedupConfig{IdempotencyWindow: time.Minute})
+	m.now = func() time.Time { return now }
+
+	claim := func(key, id, wantID string, wantClaimed bool) {
+		t.Helper()
+		got, claimed, err := m.Claim(ctx, key, id)
+		if err != nil || got != wantID || claimed != wantClaimed {
+			t.Errorf("Claim(%q, %q) = %q, %v, %v, want %q, %v", key, id, got, claimed, err, wantID, wantClaimed)
+		}
+	}
+	claim("key", "1", "1", true)
+	claim("key", "2", "1", false)
+	claim("other", "3", "3", true)
+
+	m.Release(ctx, "key")
+	claim("key", "4", "4", true)
+
+	now = now.Add(2 * time.Minute)
+	claim("key", "5", "5", true)
+}
+
+func TestMemoryPending(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	m := NewMemory(DedupConfig{IdempotencyWindow: time.Hour, IdempotencyPendingTimeout: time.Minute})
+	m.now = func() time.Time { return now }
+
+	if got, claimed, err := m.ClaimPending(ctx, "key", "1"); err != nil || !claimed || got != "1" {
+		t.Fatalf("ClaimPending() = %q, %v, %v, want 1 claimed", got, claimed, err)
+	}
+	// The claims of a pending key get its ID and ErrPending.
+	if got, claimed, err := m.ClaimPending(ctx, "key", "2"); !errors.Is(err, ErrPending) || claimed || got != "1" {
+		t.Errorf("ClaimPending() of a pending key = %q, %v, %v, want 1 and %v", got, claimed, err, ErrPending)
+	}
+	if got, claimed, err := m.Claim(ctx, "key", "2"); !errors.Is(err, ErrPending) || claimed || got != "1" {
+		t.Errorf("Claim() of a pending key = %q, %v, %v, want 1 and %v", got, claimed, err, ErrPending)
+	}
+
+	// Confirmed claims hold the key for the window.
+	if err := m.Confirm(ctx, "key", "1"); err != nil {
+		t.Fatal("Confirm() =", err)
+	}
+	now = now.Add(30 * time.Minute)
+	if got, claimed, err := m.ClaimPending(ctx, "key", "3"); err != nil || claimed || got != "1" {
+		t.Errorf("ClaimPending() of a confirmed key = %q, %v, %v, want 1 not claimed", got, claimed, err)
+	}
+
+	// Pending claims that are never confirmed expire after the timeout.
+	m.ClaimPending(ctx, "other", "4")
+	now = now.Add(2 * time.Minute)
+	if got, claimed, err := m.ClaimPending(ctx, "other", "5"); err != nil || !claimed || got != "5" {
+		t.Errorf("ClaimPending() after the pending timeout = %q, %v, %v, want 5 claimed", got, claimed, err)
+	}
+}
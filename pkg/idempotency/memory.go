@@ -0,0 +1,93 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package idempotency
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Memory is a process-local Store for development and tests.
+type Memory struct {
+	window         time.Duration
+	pendingTimeout time.Duration
+	now            func() time.Time
+
+	mu   sync.Mutex
+	keys map[string]memoryClaim
+}
+
+type memoryClaim struct {
+	id      string
+	expires time.Time
+	pending bool
+}
+
+var _ Store = (*Memory)(nil)
+
+// NewMemory returns an empty Memory store.
+func NewMemory(cfg DedupConfig) *Memory {
+	return &Memory{
+		window:         cfg.IdempotencyWindow,
+		pendingTimeout: cfg.IdempotencyPendingTimeout,
+		now:            time.Now,
+		keys:           make(map[string]memoryClaim),
+	}
+}
+
+// Claim implements Store.
+func (m *Memory) Claim(ctx context.Context, key, id string) (string, bool, error) {
+	return m.claim(key, memoryClaim{id: id, expires: m.now().Add(m.window)})
+}
+
+// ClaimPending implements Store.
+func (m *Memory) ClaimPending(ctx context.Context, key, id string) (string, bool, error) {
+	return m.claim(key, memoryClaim{id: id, expires: m.now().Add(m.pendingTimeout), pending: true})
+}
+
+// claim records c for key unless the key is claimed.
+func (m *Memory) claim(key string, c memoryClaim) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, ok := m.keys[key]; ok && m.now().Before(existing.expires) {
+		if existing.pending {
+			return existing.id, false, ErrPending
+		}
+		return existing.id, false, nil
+	}
+	m.keys[key] = c
+	return c.id, true, nil
+}
+
+// Confirm implements Store.
+func (m *Memory) Confirm(ctx context.Context, key, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[key] = memoryClaim{id: id, expires: m.now().Add(m.window)}
+	return nil
+}
+
+// Release implements Store.
+func (m *Memory) Release(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keys, key)
+	return nil
+}
+
+// Close implements Store.
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package idempotency
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"knative.dev/async-component/pkg/queue"
+)
+
+const (
+	// Prefix of the Redis keys holding idempotency keys.
+	redisKeyPrefix = "async-idempotency:"
+	// Prefix of the IDs of pending claims.
+	pendingPrefix = "pending:"
+)
+
+// confirmClaim sets the idempotency key KEYS[1] to the ID ARGV[2], expiring
+// in ARGV[3] milliseconds, unless another submission claimed it after the
+// pending claim ARGV[1] expired.
+var confirmClaim = redis.NewScript(`
+local v = redis.call('GET', KEYS[1])
+if v and v ~= ARGV[1] then
+  return 0
+end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+return 1
+`)
+
+// Redis is a Store claiming keys with SETNX, expiring after the window.
+// Pending claims hold the ID with a "pending:" prefix.
+type Redis struct {
+	client         *redis.Client
+	window         time.Duration
+	pendingTimeout time.Duration
+}
+
+var _ Store = (*Redis)(nil)
+
+// NewRedis returns a Store claiming the keys for IDEMPOTENCY_WINDOW in Redis,
+// connected to with queue.NewRedisClient.
+func NewRedis(cfg DedupConfig, redisCfg queue.RedisConfig) (*Redis, error) {
+	client, err := queue.NewRedisClient(redisCfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Redis{
+		client:         client,
+		window:         cfg.IdempotencyWindow,
+		pendingTimeout: cfg.IdempotencyPendingTimeout,
+	}, nil
+}
+
+// Claim implements Store.
+func (r *Redis) Claim(ctx context.Context, key, id string) (string, bool, error) {
+	return r.claim(ctx, key, id, r.window)
+}
+
+// ClaimPending implements Store.
+func (r *Redis) ClaimPending(ctx context.Context, key, id string) (string, bool, error) {
+	return r.claim(ctx, key, pendingPrefix+id, r.pendingTimeout)
+}
+
+// claim sets key to value for ttl unless it is set, and returns the ID it was
+// set to.
+func (r *Redis) claim(ctx context.Context, key, value string, ttl time.Duration) (string, bool, error) {
+	claimed, err := r.client.SetNX(ctx, redisKeyPrefix+key, value, ttl).Result()
+	if err != nil {
+		return "", false, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+	if claimed {
+		return strings.TrimPrefix(value, pendingPrefix), true, nil
+	}
+	existing, err := r.client.Get(ctx, redisKeyPrefix+key).Result()
+	if err == redis.Nil {
+		// The key expired in between, try again.
+		return r.claim(ctx, key, value, ttl)
+	} else if err != nil {
+		return "", false, fmt.Errorf("failed to read idempotency key: %w", err)
+	}
+	if strings.HasPrefix(existing, pendingPrefix) {
+		return strings.TrimPrefix(existing, pendingPrefix), false, ErrPending
+	}
+	return existing, false, nil
+}
+
+// Confirm implements Store.
+func (r *Redis) Confirm(ctx context.Context, key, id string) error {
+	err := confirmClaim.Run(ctx, r.client, []string{redisKeyPrefix + key}, pendingPrefix+id, id, r.window.Milliseconds()).Err()
+	if err != nil {
+		return fmt.Errorf("failed to confirm idempotency key: %w", err)
+	}
+	return nil
+}
+
+// Release implements Store.
+func (r *Redis) Release(ctx context.Context, key string) error {
+	if err := r.client.Del(ctx, redisKeyPrefix+key).Err(); err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
+
+// Close implements Store.
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
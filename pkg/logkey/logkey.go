@@ -0,0 +1,25 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package logkey holds the keys of the fields the async components add to
+// their log lines.
+package logkey
+
+const (
+	// RequestID is the key of the ID of the request being handled.
+	RequestID = "requestID"
+	// Host is the key of the host of the service a request is sent to.
+	Host = "host"
+	// Stream is the key of the name of the stream requests are queued in.
+	Stream = "stream"
+)
@@ -0,0 +1,97 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package observability configures the logging and profiling of the producer
+// and consumer from the config-logging and config-observability ConfigMaps,
+// as sharedmain does for the controller and webhook.
+package observability
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/metrics"
+	"knative.dev/pkg/profiling"
+
+	"knative.dev/async-component/pkg/config"
+)
+
+// NewLogger returns the logger of component and its level. When namespace is
+// set, they are configured by the config-logging ConfigMap of namespace, such
+// as the encoding and the loglevel.<component> key; the defaults are used
+// otherwise, or while the ConfigMap does not exist.
+func NewLogger(component, namespace string) (*zap.SugaredLogger, zap.AtomicLevel) {
+	cfg, err := loggingConfig(context.Background(), namespace, config.NewClient)
+	if err != nil {
+		cfg, _ = logging.NewConfigFromMap(nil)
+	}
+	logger, level := logging.NewLoggerFromConfig(cfg, component)
+	if err != nil {
+		logger.Errorw("Failed to read "+logging.ConfigMapName()+", using the defaults", zap.Error(err))
+	}
+	return logger, level
+}
+
+// loggingConfig returns the logging configuration of namespace, read with the
+// client of newClient.
+func loggingConfig(ctx context.Context, namespace string, newClient func() (kubernetes.Interface, error)) (*logging.Config, error) {
+	if namespace == "" {
+		return logging.NewConfigFromMap(nil)
+	}
+	kc, err := newClient()
+	if err != nil {
+		return nil, err
+	}
+	cm, err := kc.CoreV1().ConfigMaps(namespace).Get(ctx, logging.ConfigMapName(), metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		return logging.NewConfigFromMap(nil)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", logging.ConfigMapName(), err)
+	}
+	return logging.NewConfigFromConfigMap(cm)
+}
+
+// Watchers returns the functions applying config-logging and
+// config-observability, for config.WatchAll: the level of logger is updated
+// from loglevel.<component>, updateMetrics is called with
+// config-observability, and the profiling endpoints are served on port 8008,
+// PROFILING_PORT, while profiling.enable is true, until ctx is done.
+func Watchers(ctx context.Context, component string, level zap.AtomicLevel, updateMetrics func(*corev1.ConfigMap)) map[string]func(*corev1.ConfigMap) {
+	logger := logging.FromContext(ctx)
+	handler := profiling.NewHandler(logger, false)
+	server := profiling.NewServer(handler)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorw("Failed to serve the profiling endpoints", zap.Error(err))
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	return map[string]func(*corev1.ConfigMap){
+		logging.ConfigMapName(): logging.UpdateLevelFromConfigMap(logger, level, component),
+		metrics.ConfigMapName(): func(cm *corev1.ConfigMap) {
+			updateMetrics(cm)
+			handler.UpdateFromConfigMap(cm)
+		},
+	}
+}
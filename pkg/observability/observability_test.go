@@ -0,0 +1,81 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package observability
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLoggingConfig(t *testing.T) {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "config-logging", Namespace: "knative-serving"},
+		Data:       map[string]string{"loglevel.async-producer": "debug"},
+	}
+	tests := []struct {
+		name      string
+		namespace string
+		objects   []*corev1.ConfigMap
+		clientErr error
+		wantLevel zapcore.Level
+		wantSet   bool
+		wantErr   bool
+	}{{
+		name: "no namespace",
+		// The client is not needed.
+		clientErr: errors.New("not in a cluster"),
+	}, {
+		name:      "configured",
+		namespace: "knative-serving",
+		objects:   []*corev1.ConfigMap{cm},
+		wantLevel: zapcore.DebugLevel,
+		wantSet:   true,
+	}, {
+		name:      "no ConfigMap",
+		namespace: "knative-serving",
+	}, {
+		name:      "no client",
+		namespace: "knative-serving",
+		clientErr: errors.New("not in a cluster"),
+		wantErr:   true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kc := fake.NewSimpleClientset()
+			for _, cm := range test.objects {
+				kc.CoreV1().ConfigMaps(cm.Namespace).Create(context.Background(), cm, metav1.CreateOptions{})
+			}
+			got, err := loggingConfig(context.Background(), test.namespace, func() (kubernetes.Interface, error) {
+				return kc, test.clientErr
+			})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("loggingConfig() = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			level, ok := got.LoggingLevel["async-producer"]
+			if ok != test.wantSet || level != test.wantLevel {
+				t.Errorf("level = %v, %v, want %v, %v", level, ok, test.wantLevel, test.wantSet)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package paths parses the paths of a service that accept asynchronous
+// requests, such as `/reports/*, /export`.
+package paths
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Filter are the paths of a service that accept asynchronous requests. A
+// path ending with "/*" matches the paths under it, others match exactly.
+type Filter []string
+
+// Parse returns the comma separated paths of s, which start with "/" and
+// only contain a "*" in a trailing "/*".
+func Parse(s string) (Filter, error) {
+	var f Filter
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("path %q does not start with /", p)
+		}
+		if i := strings.Index(p, "*"); i >= 0 && (i != len(p)-1 || !strings.HasSuffix(p, "/*")) {
+			return nil, fmt.Errorf("path %q has a * other than a trailing /*", p)
+		}
+		f = append(f, p)
+	}
+	if len(f) == 0 {
+		return nil, fmt.Errorf("no path in %q", s)
+	}
+	return f, nil
+}
+
+// Match reports whether path is one of the paths of f.
+func (f Filter) Match(path string) bool {
+	for _, p := range f {
+		if strings.HasSuffix(p, "/*") {
+			if strings.HasPrefix(path, p[:len(p)-1]) {
+				return true
+			}
+		} else if path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Prefixes returns the prefixes of the paths of f, which an ingress routes
+// on: the paths under a "/*" path share its prefix, and the prefix of an
+// exact path also matches longer paths, so Match still applies.
+func (f Filter) Prefixes() []string {
+	prefixes := make([]string, 0, len(f))
+	for _, p := range f {
+		prefixes = append(prefixes, strings.TrimSuffix(p, "*"))
+	}
+	return prefixes
+}
+
+// String returns the paths of f as parsed by Parse.
+func (f Filter) String() string {
+	return strings.Join(f, ",")
+}
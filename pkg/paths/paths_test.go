@@ -0,0 +1,84 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package paths
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Filter
+		wantErr bool
+	}{{
+		in:   "/reports/*",
+		want: Filter{"/reports/*"},
+	}, {
+		in:   " /reports/* , /export,",
+		want: Filter{"/reports/*", "/export"},
+	}, {
+		in:   "/*",
+		want: Filter{"/*"},
+	}, {
+		in:      "",
+		wantErr: true,
+	}, {
+		in:      "reports",
+		wantErr: true,
+	}, {
+		in:      "/reports*",
+		wantErr: true,
+	}, {
+		in:      "/*/reports",
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			got, err := Parse(test.in)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Parse() = %v, want error %v", err, test.wantErr)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Error("Parse() (-want, +got):", diff)
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	f := Filter{"/reports/*", "/export"}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/reports/", true},
+		{"/reports/2021/q1", true},
+		{"/reports", false},
+		{"/export", true},
+		{"/export/all", false},
+		{"/exports", false},
+		{"/", false},
+	}
+	for _, test := range tests {
+		if got := f.Match(test.path); got != test.want {
+			t.Errorf("Match(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+	if diff := cmp.Diff([]string{"/reports/", "/export"}, f.Prefixes()); diff != "" {
+		t.Error("Prefixes() (-want, +got):", diff)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package pause holds the services whose deliveries operators paused or
+// resumed through the admin service. They are kept in the
+// config-async-pauses ConfigMap, which the consumer watches.
+package pause
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ConfigMapName is the name of the ConfigMap holding the services, under the
+// keys returned by Key.
+const ConfigMapName = "config-async-pauses"
+
+// Service is the delivery state of a service set by an operator.
+type Service struct {
+	// Paused is set while the requests of the service are held in the
+	// queue. They are still accepted by the producer.
+	Paused bool `json:"paused,omitempty"`
+	// Since is when the service was paused or resumed.
+	Since time.Time `json:"since"`
+	// DrainRate caps the requests delivered to the service per second once
+	// it is resumed, until DrainUntil.
+	DrainRate  float64    `json:"drainRate,omitempty"`
+	DrainUntil *time.Time `json:"drainUntil,omitempty"`
+}
+
+// Draining returns the requests per second the deliveries to s are capped to
+// at now, or 0 when they are not.
+func (s Service) Draining(now time.Time) float64 {
+	if s.Paused || s.DrainUntil == nil || !now.Before(*s.DrainUntil) {
+		return 0
+	}
+	return s.DrainRate
+}
+
+// Expired reports whether s no longer changes the deliveries at now, so it
+// can be deleted.
+func (s Service) Expired(now time.Time) bool {
+	return !s.Paused && s.Draining(now) == 0
+}
+
+// Services are the services paused or draining, by the Key of their
+// namespace and name.
+type Services map[string]Service
+
+// Key returns the key of service name of namespace.
+func Key(namespace, name string) string {
+	return namespace + "." + name
+}
+
+// Parse reads the services of the data of the ConfigMap.
+func Parse(data map[string]string) (Services, error) {
+	services := make(Services, len(data))
+	for key, v := range data {
+		var s Service
+		if err := json.Unmarshal([]byte(v), &s); err != nil {
+			return nil, fmt.Errorf("failed to parse service %q: %w", key, err)
+		}
+		services[key] = s
+	}
+	return services, nil
+}
+
+// Data returns the data of the ConfigMap holding services.
+func (services Services) Data() (map[string]string, error) {
+	data := make(map[string]string, len(services))
+	for key, s := range services {
+		b, err := json.Marshal(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal service %q: %w", key, err)
+		}
+		data[key] = string(b)
+	}
+	return data, nil
+}
+
+// Lookup returns the state of the service of host, which starts with the
+// name and namespace of the service, as its cluster-local host does.
+func (services Services) Lookup(host string) Service {
+	if len(services) == 0 {
+		return Service{}
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	labels := strings.SplitN(host, ".", 3)
+	if len(labels) < 2 {
+		return Service{}
+	}
+	return services[Key(labels[1], labels[0])]
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pause
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestServices(t *testing.T) {
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	until := now.Add(time.Minute)
+	want := Services{
+		Key("default", "orders"):  {Paused: true, Since: now},
+		Key("default", "billing"): {Since: now, DrainRate: 5, DrainUntil: &until},
+	}
+	data, err := want.Data()
+	if err != nil {
+		t.Fatal("Data() =", err)
+	}
+	got, err := Parse(data)
+	if err != nil {
+		t.Fatal("Parse() =", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("Parse() (-want, +got):", diff)
+	}
+	if _, err := Parse(map[string]string{"default.orders": "paused"}); err == nil {
+		t.Error("Parse() of an invalid service = nil, want an error")
+	}
+
+	tests := []struct {
+		name        string
+		host        string
+		at          time.Time
+		wantPaused  bool
+		wantRate    float64
+		wantExpired bool
+	}{{
+		name:       "paused",
+		host:       "orders.default.svc.cluster.local",
+		at:         now,
+		wantPaused: true,
+	}, {
+		name:       "paused with a port",
+		host:       "orders.default.svc.cluster.local:8080",
+		at:         now,
+		wantPaused: true,
+	}, {
+		name:     "draining",
+		host:     "billing.default.example.com",
+		at:       now,
+		wantRate: 5,
+	}, {
+		name:        "drained",
+		host:        "billing.default.example.com",
+		at:          until,
+		wantExpired: true,
+	}, {
+		name:        "other namespace",
+		host:        "orders.prod.svc.cluster.local",
+		at:          now,
+		wantExpired: true,
+	}, {
+		name:        "single label",
+		host:        "localhost",
+		at:          now,
+		wantExpired: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := got.Lookup(test.host)
+			if s.Paused != test.wantPaused {
+				t.Errorf("Paused = %v, want %v", s.Paused, test.wantPaused)
+			}
+			if rate := s.Draining(test.at); rate != test.wantRate {
+				t.Errorf("Draining() = %v, want %v", rate, test.wantRate)
+			}
+			if expired := s.Expired(test.at); expired != test.wantExpired {
+				t.Errorf("Expired() = %v, want %v", expired, test.wantExpired)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package prefer parses the Prefer request header defined in RFC 7240.
+package prefer
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	// Header is the request header carrying preferences.
+	Header = "Prefer"
+	// AppliedHeader is the response header listing the honored preferences.
+	AppliedHeader = "Preference-Applied"
+	// RespondAsync asks the server to process the request asynchronously.
+	RespondAsync = "respond-async"
+	// Wait is the number of seconds the client is willing to wait.
+	Wait = "wait"
+)
+
+// Preference is a single preference of a Prefer header, such as
+// `return=minimal; foo="bar"`. Names are lower cased, values unquoted.
+type Preference struct {
+	Name   string
+	Value  string
+	Params map[string]string
+}
+
+// Preferences are the preferences of a request, in the order they were sent.
+type Preferences []Preference
+
+// Parse returns the preferences of all Prefer headers in h. Malformed
+// preferences without a name are ignored.
+func Parse(h http.Header) Preferences {
+	var prefs Preferences
+	for _, line := range h.Values(Header) {
+		for _, raw := range split(line, ',') {
+			parts := split(raw, ';')
+			name, value := nameValue(parts[0])
+			if name == "" {
+				continue
+			}
+			pref := Preference{Name: name, Value: value}
+			for _, param := range parts[1:] {
+				if k, v := nameValue(param); k != "" {
+					if pref.Params == nil {
+						pref.Params = make(map[string]string)
+					}
+					pref.Params[k] = v
+				}
+			}
+			prefs = append(prefs, pref)
+		}
+	}
+	return prefs
+}
+
+// Get returns the preference called name. As required by RFC 7240 only the
+// first instance of a repeated preference is considered.
+func (p Preferences) Get(name string) (Preference, bool) {
+	name = strings.ToLower(name)
+	for _, pref := range p {
+		if pref.Name == name {
+			return pref, true
+		}
+	}
+	return Preference{}, false
+}
+
+// Has reports whether the preference called name is present.
+func (p Preferences) Has(name string) bool {
+	_, ok := p.Get(name)
+	return ok
+}
+
+// nameValue splits `token [= word]`, trimming whitespace around the equals
+// sign and unquoting the value.
+func nameValue(s string) (string, string) {
+	name, value := s, ""
+	if i := strings.IndexByte(s, '='); i >= 0 {
+		name, value = s[:i], unquote(strings.TrimSpace(s[i+1:]))
+	}
+	return strings.ToLower(strings.TrimSpace(name)), value
+}
+
+// split splits s at every sep outside of quoted strings.
+func split(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquote returns the content of a quoted-string, or s if it is not quoted.
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	var b strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] == '\\' && i+1 < len(s)-1 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
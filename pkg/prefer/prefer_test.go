@@ -0,0 +1,82 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prefer
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []string
+		want   Preferences
+	}{{
+		name: "no header",
+	}, {
+		name:   "single preference",
+		header: []string{"respond-async"},
+		want:   Preferences{{Name: "respond-async"}},
+	}, {
+		name:   "preference list",
+		header: []string{"respond-async, wait=10"},
+		want:   Preferences{{Name: "respond-async"}, {Name: "wait", Value: "10"}},
+	}, {
+		name:   "multiple headers",
+		header: []string{"return=minimal", "Respond-Async"},
+		want:   Preferences{{Name: "return", Value: "minimal"}, {Name: "respond-async"}},
+	}, {
+		name:   "parameters and quoted values",
+		header: []string{`respond-async; callback="https://example.com/a,b;c" ; foo , handling = "le\"nient"`},
+		want: Preferences{{
+			Name:   "respond-async",
+			Params: map[string]string{"callback": "https://example.com/a,b;c", "foo": ""},
+		}, {
+			Name:  "handling",
+			Value: `le"nient`,
+		}},
+	}, {
+		name:   "empty elements are ignored",
+		header: []string{" , respond-async,,"},
+		want:   Preferences{{Name: "respond-async"}},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := http.Header{}
+			for _, v := range test.header {
+				h.Add(Header, v)
+			}
+			if got := Parse(h); !cmp.Equal(got, test.want) {
+				t.Error("Parse() (-want, +got):", cmp.Diff(test.want, got))
+			}
+		})
+	}
+}
+
+func TestGet(t *testing.T) {
+	h := http.Header{Header: []string{"wait=10, respond-async, wait=20"}}
+	prefs := Parse(h)
+	if got, ok := prefs.Get("Wait"); !ok || got.Value != "10" {
+		t.Errorf("Get(wait) = %v, %v, want the first instance", got, ok)
+	}
+	if !prefs.Has(RespondAsync) {
+		t.Error("Has(respond-async) = false")
+	}
+	if prefs.Has("return") {
+		t.Error("Has(return) = true")
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Backlog describes the requests of a queue that are not acked yet.
+type Backlog struct {
+	// Depth is the number of requests waiting for a consumer or being
+	// delivered. Dead-lettered requests and those delayed to a later time
+	// are not counted.
+	Depth int64
+	// Oldest is the time the oldest of them was enqueued, zero when there
+	// is none.
+	Oldest time.Time
+}
+
+// ErrBacklogNotSupported is returned by ReadBacklog for backends that cannot
+// tell how many requests they hold, such as those only known to the broker.
+var ErrBacklogNotSupported = errors.New("reading the backlog is not supported by this queue backend")
+
+// BacklogReader is implemented by backends that can report their backlog.
+type BacklogReader interface {
+	// Backlog returns the requests of the queue that are not acked yet.
+	Backlog(ctx context.Context) (Backlog, error)
+}
+
+// ReadBacklog returns the backlog of q if its backend supports it, and
+// ErrBacklogNotSupported otherwise.
+func ReadBacklog(ctx context.Context, q Queue) (Backlog, error) {
+	if r, ok := q.(BacklogReader); ok {
+		return r.Backlog(ctx)
+	}
+	return Backlog{}, ErrBacklogNotSupported
+}
+
+// StreamBacklogReader is implemented by backends that can report the backlog
+// of each of their streams, such as the shards of a Redis queue.
+type StreamBacklogReader interface {
+	// StreamBacklogs returns the backlog of each stream, by name.
+	StreamBacklogs(ctx context.Context) (map[string]Backlog, error)
+}
+
+// ReadStreamBacklogs returns the backlog of each stream of q if its backend
+// reports them, and its whole backlog under the empty name otherwise.
+func ReadStreamBacklogs(ctx context.Context, q Queue) (map[string]Backlog, error) {
+	if r, ok := q.(StreamBacklogReader); ok {
+		return r.StreamBacklogs(ctx)
+	}
+	b, err := ReadBacklog(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]Backlog{"": b}, nil
+}
+
+// add adds the requests of o to b.
+func (b *Backlog) add(o Backlog) {
+	b.Depth += o.Depth
+	if !o.Oldest.IsZero() && (b.Oldest.IsZero() || o.Oldest.Before(b.Oldest)) {
+		b.Oldest = o.Oldest
+	}
+}
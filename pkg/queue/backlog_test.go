@@ -0,0 +1,165 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+)
+
+// backlogReporter answers the backlog script with the backlog of each
+// stream.
+type backlogReporter struct {
+	redis.Cmdable
+	backlogs map[string][]interface{}
+}
+
+func (f *backlogReporter) EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *redis.Cmd {
+	return redis.NewCmdResult(f.backlogs[keys[0]], nil)
+}
+
+func TestRedisBacklog(t *testing.T) {
+	client := &backlogReporter{backlogs: map[string][]interface{}{
+		"requests":   {int64(3), "1614592800000-1"},
+		"requests-1": {int64(0), nil},
+		"requests-2": {int64(2), "1614592860000-0"},
+	}}
+	s, err := NewShardedFromClient(client, RedisConfig{
+		StreamName:  "requests",
+		ShardConfig: ShardConfig{RedisShards: 3, RedisShardBy: ShardByHost},
+	})
+	if err != nil {
+		t.Fatal("NewShardedFromClient() =", err)
+	}
+	oldest := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	got, err := ReadBacklog(context.Background(), s.shards[0])
+	if err != nil {
+		t.Fatal("ReadBacklog() =", err)
+	}
+	if want := (Backlog{Depth: 3, Oldest: oldest}); got.Depth != want.Depth || !got.Oldest.Equal(want.Oldest) {
+		t.Errorf("ReadBacklog() = %+v, want %+v", got, want)
+	}
+	if got, err := ReadBacklog(context.Background(), s.shards[1]); err != nil || got != (Backlog{}) {
+		t.Errorf("ReadBacklog() = %+v, %v, want an empty backlog", got, err)
+	}
+
+	// Shards add up.
+	got, err = ReadBacklog(context.Background(), s)
+	if err != nil {
+		t.Fatal("ReadBacklog() =", err)
+	}
+	if got.Depth != 5 || !got.Oldest.Equal(oldest) {
+		t.Errorf("ReadBacklog() = %+v, want 5 requests since %v", got, oldest)
+	}
+}
+
+func TestReadStreamBacklogs(t *testing.T) {
+	client := &backlogReporter{backlogs: map[string][]interface{}{
+		"requests":   {int64(3), "1614592800000-1"},
+		"requests-1": {int64(0), nil},
+	}}
+	s, err := NewShardedFromClient(client, RedisConfig{
+		StreamName:  "requests",
+		ShardConfig: ShardConfig{RedisShards: 2, RedisShardBy: ShardByHost},
+	})
+	if err != nil {
+		t.Fatal("NewShardedFromClient() =", err)
+	}
+	ctx := context.Background()
+	got, err := ReadStreamBacklogs(ctx, s)
+	if err != nil {
+		t.Fatal("ReadStreamBacklogs() =", err)
+	}
+	oldest := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	if len(got) != 2 || got["requests"].Depth != 3 || !got["requests"].Oldest.Equal(oldest) || got["requests-1"] != (Backlog{}) {
+		t.Errorf("ReadStreamBacklogs() = %+v, want the backlog of each shard", got)
+	}
+
+	// Backends without streams report their whole backlog.
+	q := NewMemory(MemoryConfig{MemoryQueueName: fmt.Sprint(t.Name(), time.Now().UnixNano()), MemoryReadTimeout: time.Second})
+	if err := q.Enqueue(ctx, "1", nil); err != nil {
+		t.Fatal("Enqueue() =", err)
+	}
+	got, err = ReadStreamBacklogs(ctx, q)
+	if err != nil {
+		t.Fatal("ReadStreamBacklogs() =", err)
+	}
+	if len(got) != 1 || got[""].Depth != 1 {
+		t.Errorf("ReadStreamBacklogs() = %+v, want the backlog of the queue", got)
+	}
+}
+
+func TestMemoryBacklog(t *testing.T) {
+	ctx := context.Background()
+	q := NewMemory(MemoryConfig{MemoryQueueName: fmt.Sprint(t.Name(), time.Now().UnixNano()), MemoryReadTimeout: time.Second})
+	if got, err := ReadBacklog(ctx, q); err != nil || got != (Backlog{}) {
+		t.Fatalf("ReadBacklog() = %+v, %v, want an empty backlog", got, err)
+	}
+
+	start := time.Now()
+	for _, id := range []string{"1", "2", "3"} {
+		if err := q.Enqueue(ctx, id, []byte("request "+id)); err != nil {
+			t.Fatal("Enqueue() =", err)
+		}
+	}
+	if err := q.Enqueue(WithDeliverAt(ctx, time.Now().Add(time.Hour)), "later", nil); err != nil {
+		t.Fatal("Enqueue() =", err)
+	}
+	msgs, err := q.Dequeue(ctx)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Dequeue() = %v, %v, want 1 message", msgs, err)
+	}
+
+	// Requests in flight are counted until they are acked, delayed ones
+	// once they are due.
+	got, err := ReadBacklog(ctx, q)
+	if err != nil {
+		t.Fatal("ReadBacklog() =", err)
+	}
+	if got.Depth != 3 || got.Oldest.Before(start) || got.Oldest.After(time.Now()) {
+		t.Errorf("ReadBacklog() = %+v, want 3 requests since %v", got, start)
+	}
+	if err := q.Ack(ctx, msgs[0]); err != nil {
+		t.Fatal("Ack() =", err)
+	}
+	if got, err := ReadBacklog(ctx, q); err != nil || got.Depth != 2 {
+		t.Errorf("ReadBacklog() = %+v, %v, want 2 requests", got, err)
+	}
+}
+
+func TestReadBacklogNotSupported(t *testing.T) {
+	c := &Channel{}
+	if _, err := ReadBacklog(context.Background(), c); !errors.Is(err, ErrBacklogNotSupported) {
+		t.Errorf("ReadBacklog() = %v, want %v", err, ErrBacklogNotSupported)
+	}
+}
+
+func TestBacklogAdd(t *testing.T) {
+	early := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	late := early.Add(time.Minute)
+	var b Backlog
+	for _, o := range []Backlog{{Depth: 1, Oldest: late}, {}, {Depth: 2, Oldest: early}, {Depth: 1, Oldest: late}} {
+		b.add(o)
+	}
+	if diff := cmp.Diff(Backlog{Depth: 4, Oldest: early}, b); diff != "" {
+		t.Error("add() (-want, +got):", diff)
+	}
+}
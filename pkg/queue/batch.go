@@ -0,0 +1,119 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// errBatcherClosed is returned for writes submitted after the queue was closed.
+var errBatcherClosed = errors.New("queue is closed")
+
+// batcher groups concurrent writes, so they are sent to the backend in a
+// single round-trip. A batch is flushed once it holds size writes or interval
+// has passed since its first write, and every write waits for the outcome of
+// its batch, so callers still only succeed once their write is durable.
+type batcher struct {
+	size     int
+	interval time.Duration
+	// flush writes a batch, returning the error of each write.
+	flush func(ctx context.Context, batch [][]byte) []error
+
+	writes  chan batchWrite
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+type batchWrite struct {
+	data []byte
+	done chan error
+}
+
+func newBatcher(size int, interval time.Duration, flush func(ctx context.Context, batch [][]byte) []error) *batcher {
+	b := &batcher{
+		size:     size,
+		interval: interval,
+		flush:    flush,
+		writes:   make(chan batchWrite),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// add writes data with the next batch. ctx only bounds the wait for a place
+// in a batch: once it has one, the write may land whatever happens to ctx, so
+// its outcome is waited for. Returning ctx.Err() then would have callers
+// falling back to another delivery of a request that was stored.
+func (b *batcher) add(ctx context.Context, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	w := batchWrite{data: data, done: make(chan error, 1)}
+	select {
+	case b.writes <- w:
+	case <-b.stop:
+		return errBatcherClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-w.done
+}
+
+// close flushes the pending batch and stops the batcher.
+func (b *batcher) close() {
+	close(b.stop)
+	<-b.stopped
+}
+
+func (b *batcher) run() {
+	defer close(b.stopped)
+	for {
+		var batch []batchWrite
+		select {
+		case w := <-b.writes:
+			batch = append(batch, w)
+		case <-b.stop:
+			return
+		}
+		timer := time.NewTimer(b.interval)
+	collect:
+		for len(batch) < b.size {
+			select {
+			case w := <-b.writes:
+				batch = append(batch, w)
+			case <-timer.C:
+				break collect
+			case <-b.stop:
+				break collect
+			}
+		}
+		timer.Stop()
+		b.write(batch)
+	}
+}
+
+func (b *batcher) write(batch []batchWrite) {
+	data := make([][]byte, len(batch))
+	for i, w := range batch {
+		data[i] = w.data
+	}
+	errs := b.flush(context.Background(), data)
+	for i, w := range batch {
+		w.done <- errs[i]
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingFlush records the batches it is given and fails the writes of
+// "fail".
+type recordingFlush struct {
+	mu      sync.Mutex
+	batches [][]string
+}
+
+func (f *recordingFlush) flush(ctx context.Context, batch [][]byte) []error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var got []string
+	errs := make([]error, len(batch))
+	for i, data := range batch {
+		got = append(got, string(data))
+		if string(data) == "fail" {
+			errs[i] = errors.New("write failed")
+		}
+	}
+	f.batches = append(f.batches, got)
+	return errs
+}
+
+func TestBatcher(t *testing.T) {
+	f := &recordingFlush{}
+	b := newBatcher(3, time.Hour, f.flush)
+	defer b.close()
+
+	// A full batch is flushed at once, each write getting its own outcome.
+	var wg sync.WaitGroup
+	errs := make(map[string]error)
+	var mu sync.Mutex
+	for _, data := range []string{"a", "fail", "c"} {
+		wg.Add(1)
+		go func(data string) {
+			defer wg.Done()
+			err := b.add(context.Background(), []byte(data))
+			mu.Lock()
+			errs[data] = err
+			mu.Unlock()
+		}(data)
+	}
+	wg.Wait()
+	if len(f.batches) != 1 || len(f.batches[0]) != 3 {
+		t.Errorf("batches = %v, want a single batch of 3", f.batches)
+	}
+	if errs["a"] != nil || errs["c"] != nil || errs["fail"] == nil {
+		t.Errorf("write errors = %v, want only fail to fail", errs)
+	}
+}
+
+func TestBatcherInterval(t *testing.T) {
+	f := &recordingFlush{}
+	b := newBatcher(100, 10*time.Millisecond, f.flush)
+	defer b.close()
+
+	if err := b.add(context.Background(), []byte("a")); err != nil {
+		t.Fatal("add() =", err)
+	}
+	if len(f.batches) != 1 {
+		t.Errorf("batches = %v, want the write flushed after the interval", f.batches)
+	}
+}
+
+func TestBatcherClose(t *testing.T) {
+	f := &recordingFlush{}
+	b := newBatcher(100, time.Hour, f.flush)
+
+	// Closing flushes the pending batch without waiting for the interval.
+	w := batchWrite{data: []byte("a"), done: make(chan error, 1)}
+	b.writes <- w
+	b.close()
+	if err := <-w.done; err != nil {
+		t.Error("pending write =", err)
+	}
+	if len(f.batches) != 1 {
+		t.Errorf("batches = %v, want the pending write flushed", f.batches)
+	}
+	if err := b.add(context.Background(), []byte("b")); !errors.Is(err, errBatcherClosed) {
+		t.Errorf("add() after close = %v, want %v", err, errBatcherClosed)
+	}
+}
+
+func TestBatcherCancelled(t *testing.T) {
+	f := &recordingFlush{}
+	b := newBatcher(100, 50*time.Millisecond, f.flush)
+	defer b.close()
+
+	// A write given a place in a batch reports its outcome, even when its
+	// context is done before the batch is flushed.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.add(ctx, []byte("a")); err != nil {
+		t.Errorf("add() = %v, want the outcome of the flush", err)
+	}
+	if len(f.batches) != 1 {
+		t.Errorf("batches = %v, want the write flushed", f.batches)
+	}
+
+	// A write whose context is done before it has a place is not made.
+	cancel()
+	if err := b.add(ctx, []byte("b")); !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+		t.Errorf("add() = %v, want the error of the context", err)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by Enqueue while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open, queue writes are failing")
+
+// BreakerConfig configures the circuit breaker around queue writes. The
+// breaker is disabled when the threshold is 0.
+type BreakerConfig struct {
+	BreakerFailureThreshold int           `envconfig:"BREAKER_FAILURE_THRESHOLD" default:"5"`
+	BreakerOpenTimeout      time.Duration `envconfig:"BREAKER_OPEN_TIMEOUT" default:"30s"`
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// Breaker is a circuit breaker around the writes of a Queue. After
+// BREAKER_FAILURE_THRESHOLD consecutive failed writes it opens and fails
+// writes at once, instead of letting every request wait for the backend to
+// time out. Once BREAKER_OPEN_TIMEOUT has passed a single write is let
+// through to probe the backend: the breaker closes if it succeeds and opens
+// again otherwise. Writes cancelled by their caller are not counted.
+type Breaker struct {
+	Queue
+	cfg BreakerConfig
+	now func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+var (
+	_ Queue         = (*Breaker)(nil)
+	_ HealthChecker = (*Breaker)(nil)
+	_ BatchEnqueuer = (*Breaker)(nil)
+)
+
+// NewBreaker wraps the writes of q in a circuit breaker.
+func NewBreaker(q Queue, cfg BreakerConfig) *Breaker {
+	return &Breaker{Queue: q, cfg: cfg, now: time.Now}
+}
+
+// Enqueue implements Queue.
+func (b *Breaker) Enqueue(ctx context.Context, id string, data []byte) error {
+	if !b.allow() {
+		return ErrCircuitOpen
+	}
+	err := b.Queue.Enqueue(ctx, id, data)
+	if errors.Is(err, context.Canceled) {
+		b.release()
+		return err
+	}
+	// Rejected delays are the caller's fault, not the backend's.
+	b.record(err == nil || errors.Is(err, ErrDelayNotSupported))
+	return err
+}
+
+// EnqueueBatch implements BatchEnqueuer if the wrapped queue does.
+func (b *Breaker) EnqueueBatch(ctx context.Context, ids []string, data [][]byte) error {
+	if _, ok := b.Queue.(BatchEnqueuer); !ok {
+		return ErrBatchNotSupported
+	}
+	if !b.allow() {
+		return ErrCircuitOpen
+	}
+	err := EnqueueBatch(ctx, b.Queue, ids, data)
+	if errors.Is(err, context.Canceled) {
+		b.release()
+		return err
+	}
+	b.record(err == nil || errors.Is(err, ErrDelayNotSupported) || errors.Is(err, ErrBatchNotSupported))
+	return err
+}
+
+// CheckHealth implements HealthChecker by checking the wrapped queue.
+func (b *Breaker) CheckHealth(ctx context.Context, consuming bool) error {
+	return CheckHealth(ctx, b.Queue, consuming)
+}
+
+// allow reports whether a write may go through, moving an open breaker to
+// half-open once the open timeout has passed.
+func (b *Breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cfg.BreakerOpenTimeout {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// A probe is already in flight.
+		return false
+	default:
+		return true
+	}
+}
+
+// release ends a write cancelled by its caller, such as a client that went
+// away, which tells nothing of the backend and is not recorded. A cancelled
+// probe leaves the breaker open, to let the next write probe again.
+func (b *Breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+	}
+}
+
+// record updates the state of the breaker with the outcome of a write.
+func (b *Breaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		b.state, b.failures = breakerClosed, 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.cfg.BreakerFailureThreshold {
+		b.state, b.openedAt = breakerOpen, b.now()
+	}
+}
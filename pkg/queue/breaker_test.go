@@ -0,0 +1,139 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// failingQueue fails writes while down is set, and those whose context is
+// cancelled.
+type failingQueue struct {
+	Queue
+	down   bool
+	writes int
+}
+
+func (f *failingQueue) Enqueue(ctx context.Context, id string, data []byte) error {
+	f.writes++
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if f.down {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestBreaker(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	backend := &failingQueue{down: true}
+	b := NewBreaker(backend, BreakerConfig{BreakerFailureThreshold: 2, BreakerOpenTimeout: time.Minute})
+	b.now = func() time.Time { return now }
+
+	enqueue := func(wantErr error, wantWrites int) {
+		t.Helper()
+		err := b.Enqueue(ctx, "id", nil)
+		if (wantErr == nil) != (err == nil) || (wantErr == ErrCircuitOpen) != errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("Enqueue() = %v, want %v", err, wantErr)
+		}
+		if backend.writes != wantWrites {
+			t.Errorf("backend got %d writes, want %d", backend.writes, wantWrites)
+		}
+	}
+	backendErr := errors.New("backend error")
+
+	// Consecutive failures open the breaker, which then fails fast.
+	enqueue(backendErr, 1)
+	enqueue(backendErr, 2)
+	enqueue(ErrCircuitOpen, 2)
+
+	// After the open timeout a failed probe opens it again.
+	now = now.Add(time.Minute)
+	enqueue(backendErr, 3)
+	enqueue(ErrCircuitOpen, 3)
+
+	// A successful probe closes it.
+	now = now.Add(time.Minute)
+	backend.down = false
+	enqueue(nil, 4)
+	enqueue(nil, 5)
+}
+
+func TestBreakerEnqueueBatch(t *testing.T) {
+	ctx := context.Background()
+	b := NewBreaker(&failingQueue{}, BreakerConfig{BreakerFailureThreshold: 1, BreakerOpenTimeout: time.Minute})
+	if err := b.EnqueueBatch(ctx, []string{"id"}, [][]byte{nil}); !errors.Is(err, ErrBatchNotSupported) {
+		t.Errorf("EnqueueBatch() = %v, want %v", err, ErrBatchNotSupported)
+	}
+	if !b.allow() {
+		t.Error("unsupported batch opened the breaker")
+	}
+
+	b = NewBreaker(NewMemory(MemoryConfig{MemoryQueueName: t.Name()}), BreakerConfig{BreakerFailureThreshold: 1, BreakerOpenTimeout: time.Minute})
+	if err := b.EnqueueBatch(ctx, []string{"id"}, [][]byte{nil}); err != nil {
+		t.Error("EnqueueBatch() =", err)
+	}
+	b.record(false)
+	if err := b.EnqueueBatch(ctx, []string{"id"}, [][]byte{nil}); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("EnqueueBatch() = %v, want %v", err, ErrCircuitOpen)
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	b := NewBreaker(&failingQueue{}, BreakerConfig{BreakerFailureThreshold: 1, BreakerOpenTimeout: time.Minute})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	b.record(false)
+
+	now = now.Add(time.Minute)
+	if !b.allow() {
+		t.Fatal("probe was not allowed after the open timeout")
+	}
+	if b.allow() {
+		t.Error("second write was allowed while the probe is in flight")
+	}
+}
+
+func TestBreakerCancelled(t *testing.T) {
+	backend := &failingQueue{down: true}
+	b := NewBreaker(backend, BreakerConfig{BreakerFailureThreshold: 1, BreakerOpenTimeout: time.Minute})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Callers that went away do not open the breaker.
+	if err := b.Enqueue(cancelled, "id", nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Enqueue() = %v, want %v", err, context.Canceled)
+	}
+	if !b.allow() {
+		t.Fatal("cancelled write opened the breaker")
+	}
+
+	// A cancelled probe lets the next write probe again.
+	b.record(false)
+	now = now.Add(time.Minute)
+	if err := b.Enqueue(cancelled, "id", nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Enqueue() = %v, want %v", err, context.Canceled)
+	}
+	backend.down = false
+	if err := b.Enqueue(context.Background(), "id", nil); err != nil {
+		t.Errorf("Enqueue() after a cancelled probe = %v, want a new probe", err)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+const (
+	// The CloudEvent type of async requests sent through a Channel or Broker.
+	RequestEventType = "dev.knative.async.request"
+	// The CloudEvent source of async requests.
+	RequestEventSource = "knative.dev/async-component/producer"
+)
+
+// errPushBased is returned by the pull methods of push-based backends.
+var errPushBased = errors.New("requests are pushed by the channel backend, use Receive")
+
+// Receiver is implemented by backends that push requests to the consumer
+// rather than being read with Dequeue. Delivery retries and dead-lettering
+// are left to the backend.
+type Receiver interface {
+	// Receive calls fn for every request until ctx is done. A non-nil error
+	// from fn reports the delivery as failed to the backend.
+	Receive(ctx context.Context, fn func(ctx context.Context, data []byte) error) error
+}
+
+// ChannelConfig holds the environment configuration of the channel backend.
+// K_SINK is set when the producer is the subject of a SinkBinding.
+type ChannelConfig struct {
+	ChannelSink string `envconfig:"CHANNEL_SINK"`
+	KSink       string `envconfig:"K_SINK"`
+	ChannelPort int    `envconfig:"CHANNEL_PORT" default:"8080"`
+}
+
+// Channel delegates durability to Knative Eventing. The producer sends each
+// request as a CloudEvent to a Channel or Broker, and the consumer is the
+// sink of a Subscription or Trigger, so retries and dead-lettering follow the
+// delivery spec configured there.
+type Channel struct {
+	cfg    ChannelConfig
+	client cloudevents.Client
+}
+
+var (
+	_ Queue    = (*Channel)(nil)
+	_ Receiver = (*Channel)(nil)
+)
+
+// NewChannel returns a channel backend. The sink is only required to enqueue.
+func NewChannel(ctx context.Context, cfg ChannelConfig) (*Channel, error) {
+	if cfg.ChannelSink == "" {
+		cfg.ChannelSink = cfg.KSink
+	}
+	p, err := cloudevents.NewHTTP(cloudevents.WithPort(cfg.ChannelPort))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cloudevents protocol: %w", err)
+	}
+	client, err := cloudevents.NewClient(p, cloudevents.WithTimeNow())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cloudevents client: %w", err)
+	}
+	return &Channel{cfg: cfg, client: client}, nil
+}
+
+// Enqueue implements Queue by sending the request to the sink as a CloudEvent
+// whose ID is the async request ID.
+func (c *Channel) Enqueue(ctx context.Context, id string, data []byte) error {
+	if err := checkNoDelay(ctx); err != nil {
+		return err
+	}
+	if c.cfg.ChannelSink == "" {
+		return errors.New("CHANNEL_SINK or K_SINK must be set")
+	}
+	event := cloudevents.NewEvent()
+	event.SetID(id)
+	event.SetType(RequestEventType)
+	event.SetSource(RequestEventSource)
+	if err := event.SetData(cloudevents.ApplicationJSON, data); err != nil {
+		return fmt.Errorf("failed to set event data for %q: %w", id, err)
+	}
+	result := c.client.Send(cloudevents.ContextWithTarget(ctx, c.cfg.ChannelSink), event)
+	if !cloudevents.IsACK(result) {
+		return fmt.Errorf("failed to publish %q: %w", id, result)
+	}
+	return nil
+}
+
+// Receive implements Receiver by serving CloudEvents on CHANNEL_PORT.
+func (c *Channel) Receive(ctx context.Context, fn func(ctx context.Context, data []byte) error) error {
+	return c.client.StartReceiver(ctx, func(ctx context.Context, event cloudevents.Event) cloudevents.Result {
+		if err := fn(ctx, event.Data()); err != nil {
+			return cloudevents.NewHTTPResult(http.StatusInternalServerError, "failed to deliver %q: %v", event.ID(), err)
+		}
+		return nil
+	})
+}
+
+// Dequeue implements Queue. Requests are pushed to Receive instead.
+func (c *Channel) Dequeue(ctx context.Context) ([]Message, error) {
+	return nil, errPushBased
+}
+
+// Ack implements Queue. Requests are pushed to Receive instead.
+func (c *Channel) Ack(ctx context.Context, msg Message) error {
+	return errPushBased
+}
+
+// DeadLetter implements Queue. Requests are pushed to Receive instead.
+func (c *Channel) DeadLetter(ctx context.Context, msg Message, reason string) error {
+	return errPushBased
+}
+
+// Close implements Queue.
+func (c *Channel) Close() error {
+	return nil
+}
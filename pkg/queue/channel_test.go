@@ -0,0 +1,138 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+)
+
+func TestChannelEnqueue(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		wantErr    bool
+	}{{
+		name:       "accepted by the channel",
+		statusCode: http.StatusAccepted,
+	}, {
+		name:       "rejected by the channel",
+		statusCode: http.StatusServiceUnavailable,
+		wantErr:    true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var gotID, gotType, gotBody string
+			sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotID = r.Header.Get("Ce-Id")
+				gotType = r.Header.Get("Ce-Type")
+				body, _ := ioutil.ReadAll(r.Body)
+				gotBody = string(body)
+				w.WriteHeader(test.statusCode)
+			}))
+			defer sink.Close()
+
+			c, err := NewChannel(context.Background(), ChannelConfig{KSink: sink.URL})
+			if err != nil {
+				t.Fatal("NewChannel() =", err)
+			}
+			err = c.Enqueue(context.Background(), "1234", []byte(`{"id":"1234"}`))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Enqueue() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if gotID != "1234" || gotType != RequestEventType || gotBody != `{"id":"1234"}` {
+				t.Errorf("sink got id %q, type %q, body %q", gotID, gotType, gotBody)
+			}
+		})
+	}
+}
+
+func TestChannelEnqueueWithoutSink(t *testing.T) {
+	c, err := NewChannel(context.Background(), ChannelConfig{})
+	if err != nil {
+		t.Fatal("NewChannel() =", err)
+	}
+	if err := c.Enqueue(context.Background(), "1234", nil); err == nil {
+		t.Error("Enqueue() succeeded without a sink")
+	}
+}
+
+func TestChannelReceive(t *testing.T) {
+	tests := []struct {
+		name       string
+		deliverErr error
+		wantStatus int
+	}{{
+		name:       "delivered",
+		wantStatus: http.StatusOK,
+	}, {
+		name:       "delivery failed",
+		deliverErr: errors.New("connection refused"),
+		wantStatus: http.StatusInternalServerError,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := cloudevents.NewHTTP(cloudevents.WithListener(l))
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := cloudevents.NewClient(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &Channel{client: client}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			received := make(chan string, 1)
+			go c.Receive(ctx, func(ctx context.Context, data []byte) error {
+				received <- string(data)
+				return test.deliverErr
+			})
+
+			event := cloudevents.NewEvent()
+			event.SetID("1234")
+			event.SetType(RequestEventType)
+			event.SetSource(RequestEventSource)
+			event.SetData(cloudevents.ApplicationJSON, []byte(`{"id":"1234"}`))
+			sender, err := cloudevents.NewDefaultClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			result := sender.Send(cloudevents.ContextWithTarget(ctx, "http://"+l.Addr().String()), event)
+			var httpResult *cehttp.Result
+			if !cloudevents.ResultAs(result, &httpResult) {
+				t.Fatalf("Send() = %v, want an HTTP result", result)
+			}
+			if httpResult.StatusCode != test.wantStatus {
+				t.Errorf("status = %d, want %d", httpResult.StatusCode, test.wantStatus)
+			}
+			if got := <-received; got != `{"id":"1234"}` {
+				t.Errorf("delivered data = %q", got)
+			}
+		})
+	}
+}
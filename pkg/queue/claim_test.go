@@ -0,0 +1,173 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+)
+
+// claimRecorder records the listings of pending entries and the claims.
+type claimRecorder struct {
+	redis.Cmdable
+	listed int
+	claims []*redis.XClaimArgs
+}
+
+func (f *claimRecorder) XPendingExt(ctx context.Context, a *redis.XPendingExtArgs) *redis.XPendingExtCmd {
+	f.listed++
+	return redis.NewXPendingExtCmd(ctx)
+}
+
+func (f *claimRecorder) XClaim(ctx context.Context, a *redis.XClaimArgs) *redis.XMessageSliceCmd {
+	f.claims = append(f.claims, a)
+	msgs := make([]redis.XMessage, 0, len(a.Messages))
+	for _, id := range a.Messages {
+		msgs = append(msgs, redis.XMessage{ID: id, Values: map[string]interface{}{redisDataField: "request " + id}})
+	}
+	return redis.NewXMessageSliceCmdResult(msgs, nil)
+}
+
+func TestRedisClaimPending(t *testing.T) {
+	client := &claimRecorder{}
+	r := NewRedisFromClient(client, RedisConfig{
+		StreamName:         "requests",
+		ConsumerGroup:      "group",
+		ConsumerName:       "consumer",
+		RedisClaimIdle:     5 * time.Minute,
+		RedisClaimInterval: time.Hour,
+	})
+
+	// Only the requests idle for long enough are claimed, which counts as a
+	// delivery.
+	got, err := r.claimPending(context.Background(), []redis.XPendingExt{
+		{ID: "1-0", Consumer: "crashed", Idle: 10 * time.Minute, RetryCount: 1},
+		{ID: "2-0", Consumer: "crashed", Idle: 6 * time.Minute, RetryCount: 3},
+		{ID: "3-0", Consumer: "healthy", Idle: time.Second},
+	})
+	if err != nil {
+		t.Fatal("claimPending() =", err)
+	}
+	want := []Message{
+		{ID: "1-0", Data: []byte("request 1-0"), Deliveries: 2},
+		{ID: "2-0", Data: []byte("request 2-0"), Deliveries: 4},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("claimPending() (-want, +got):", diff)
+	}
+	if len(client.claims) != 1 || client.claims[0].Consumer != "consumer" || client.claims[0].MinIdle != 5*time.Minute {
+		t.Errorf("got claims %+v, want one by consumer with a 5m idle time", client.claims)
+	}
+
+	// Nothing is claimed when no request is idle.
+	if got, err := r.claimPending(context.Background(), []redis.XPendingExt{{ID: "3-0", Idle: time.Second}}); err != nil || len(got) != 0 {
+		t.Errorf("claimPending() = %v, %v, want no claims", got, err)
+	}
+	if len(client.claims) != 1 {
+		t.Errorf("got %d claims, want 1", len(client.claims))
+	}
+}
+
+func TestRedisClaimDue(t *testing.T) {
+	tests := []struct {
+		name       string
+		idle       time.Duration
+		interval   time.Duration
+		wantListed int
+	}{{
+		name:       "every interval",
+		idle:       time.Minute,
+		interval:   time.Hour,
+		wantListed: 1,
+	}, {
+		name:     "no idle time",
+		interval: time.Hour,
+	}, {
+		name: "no interval",
+		idle: time.Minute,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &claimRecorder{}
+			r := NewRedisFromClient(client, RedisConfig{StreamName: "requests", RedisClaimIdle: test.idle, RedisClaimInterval: test.interval})
+			// The second read is within the interval.
+			for i := 0; i < 2; i++ {
+				if got := r.claimDue(context.Background()); len(got) != 0 {
+					t.Errorf("claimDue() = %v, want none", got)
+				}
+			}
+			if client.listed != test.wantListed {
+				t.Errorf("pending requests listed %d times, want %d", client.listed, test.wantListed)
+			}
+		})
+	}
+}
+
+// consumerRemover records the arguments of the script removing consumers.
+type consumerRemover struct {
+	redis.Cmdable
+	args []interface{}
+}
+
+func (f *consumerRemover) EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *redis.Cmd {
+	f.args = append(append([]interface{}{}, keys[0]), args...)
+	return redis.NewCmdResult([]interface{}{"scaled-down"}, nil)
+}
+
+func TestRedisExpireConsumers(t *testing.T) {
+	client := &consumerRemover{}
+	r := NewRedisFromClient(client, RedisConfig{
+		StreamName:          "requests",
+		ConsumerGroup:       "group",
+		ConsumerName:        "consumer",
+		RedisConsumerExpiry: time.Hour,
+	})
+	removed, err := r.expireConsumers(context.Background())
+	if err != nil {
+		t.Fatal("expireConsumers() =", err)
+	}
+	if diff := cmp.Diff([]string{"scaled-down"}, removed); diff != "" {
+		t.Error("expireConsumers() (-want, +got):", diff)
+	}
+	// The consumer itself is never removed.
+	want := []interface{}{"requests", "group", "consumer", int64(3600000)}
+	if diff := cmp.Diff(want, client.args); diff != "" {
+		t.Error("script arguments (-want, +got):", diff)
+	}
+
+	// Consumers are kept without an expiry.
+	client.args = nil
+	r = NewRedisFromClient(client, RedisConfig{StreamName: "requests"})
+	if removed, err := r.expireConsumers(context.Background()); err != nil || len(removed) != 0 || client.args != nil {
+		t.Errorf("expireConsumers() = %v, %v, want no consumers removed", removed, err)
+	}
+}
+
+func TestRedisCheckGroup(t *testing.T) {
+	r := NewRedisFromClient(&claimRecorder{}, RedisConfig{StreamName: "requests"})
+	r.groupReady = true
+	r.checkGroup(errors.New("ERR timeout"))
+	if !r.groupReady {
+		t.Error("group is created again after an unrelated error")
+	}
+	r.checkGroup(errors.New("NOGROUP No such key 'requests' or consumer group 'group' in XREADGROUP with GROUP option"))
+	if r.groupReady {
+		t.Error("group is not created again after it went missing")
+	}
+}
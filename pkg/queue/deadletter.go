@@ -0,0 +1,179 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Failure describes the delivery attempts of a dead-lettered request, for
+// operators inspecting failures.
+type Failure struct {
+	// StatusCode is the status of the last response of the service, zero
+	// if it could not be reached.
+	StatusCode int
+	// Attempts is the number of times the request was sent.
+	Attempts int
+	// FirstAttempt and LastAttempt are the times of the first and last
+	// attempts.
+	FirstAttempt time.Time
+	LastAttempt  time.Time
+}
+
+// Names of the failure fields stored along with dead-lettered requests, see
+// Failure.Fields.
+const (
+	FailureStatusField       = "status"
+	FailureAttemptsField     = "attempts"
+	FailureFirstAttemptField = "first-attempt"
+	FailureLastAttemptField  = "last-attempt"
+)
+
+// Fields returns the fields of f that are set as strings, keyed by the
+// Failure*Field names, for backends storing them as headers or attributes.
+// Times are in RFC 3339 format.
+func (f Failure) Fields() map[string]string {
+	fields := make(map[string]string, 4)
+	if f.StatusCode != 0 {
+		fields[FailureStatusField] = strconv.Itoa(f.StatusCode)
+	}
+	if f.Attempts != 0 {
+		fields[FailureAttemptsField] = strconv.Itoa(f.Attempts)
+	}
+	if !f.FirstAttempt.IsZero() {
+		fields[FailureFirstAttemptField] = f.FirstAttempt.UTC().Format(time.RFC3339Nano)
+	}
+	if !f.LastAttempt.IsZero() {
+		fields[FailureLastAttemptField] = f.LastAttempt.UTC().Format(time.RFC3339Nano)
+	}
+	return fields
+}
+
+// failureFromFields returns the Failure stored as fields by Fields, read
+// with field. Fields that are missing or invalid are left unset.
+func failureFromFields(field func(string) string) Failure {
+	var f Failure
+	f.StatusCode, _ = strconv.Atoi(field(FailureStatusField))
+	f.Attempts, _ = strconv.Atoi(field(FailureAttemptsField))
+	f.FirstAttempt, _ = time.Parse(time.RFC3339Nano, field(FailureFirstAttemptField))
+	f.LastAttempt, _ = time.Parse(time.RFC3339Nano, field(FailureLastAttemptField))
+	return f
+}
+
+// failureHeaderPrefix prefixes the failure fields stored as message headers
+// or attributes, next to the dead-letter reason.
+const failureHeaderPrefix = "async-dead-letter-"
+
+type failureKey struct{}
+
+// WithFailure returns a context passing f to DeadLetter, so backends store
+// it along with the reason.
+func WithFailure(ctx context.Context, f Failure) context.Context {
+	return context.WithValue(ctx, failureKey{}, f)
+}
+
+// FailureFrom returns the failure set on ctx, or the zero Failure.
+func FailureFrom(ctx context.Context) Failure {
+	f, _ := ctx.Value(failureKey{}).(Failure)
+	return f
+}
+
+// ErrReplayNotSupported is returned by Replay for backends whose dead-lettered
+// requests cannot be moved back to the queue by the consumer, such as those
+// using a dead-letter queue of the broker.
+var ErrReplayNotSupported = errors.New("replaying dead-lettered requests is not supported by this queue backend")
+
+// Replayer is implemented by backends that can move dead-lettered requests
+// back to the queue.
+type Replayer interface {
+	// Replay moves up to max of the oldest dead-lettered requests back to
+	// the queue, and returns how many were moved.
+	Replay(ctx context.Context, max int) (int, error)
+}
+
+// Replay moves up to max dead-lettered requests of q back to the queue if its
+// backend supports it, and returns ErrReplayNotSupported otherwise.
+func Replay(ctx context.Context, q Queue, max int) (int, error) {
+	if r, ok := q.(Replayer); ok {
+		return r.Replay(ctx, max)
+	}
+	return 0, ErrReplayNotSupported
+}
+
+// ReplayFunc selects a dead-lettered request to replay, returning the record
+// it is replayed with and true, or false to leave it dead-lettered.
+type ReplayFunc func(data []byte) ([]byte, bool)
+
+type replayFuncKey struct{}
+
+// WithReplayFunc returns a context passing fn to Replay, so only the
+// requests it selects are replayed, with the records it returns. Backends
+// then go through their dead-lettered requests until max are selected.
+func WithReplayFunc(ctx context.Context, fn ReplayFunc) context.Context {
+	return context.WithValue(ctx, replayFuncKey{}, fn)
+}
+
+// ReplayFuncFrom returns the ReplayFunc set on ctx, or nil if every request
+// is replayed as it is.
+func ReplayFuncFrom(ctx context.Context) ReplayFunc {
+	fn, _ := ctx.Value(replayFuncKey{}).(ReplayFunc)
+	return fn
+}
+
+// DeadLetteredMessage is a message moved out of a queue after failing.
+type DeadLetteredMessage struct {
+	Message
+	Reason  string
+	Failure Failure
+	// DeadLettered is when the message was dead-lettered, zero when unknown.
+	DeadLettered time.Time
+}
+
+// DeadLetterLister is implemented by backends that can list their
+// dead-lettered requests.
+type DeadLetterLister interface {
+	// ListDeadLetters returns up to max of the oldest dead-lettered
+	// requests, which are left dead-lettered.
+	ListDeadLetters(ctx context.Context, max int) ([]DeadLetteredMessage, error)
+}
+
+// ListDeadLetters returns up to max dead-lettered requests of q if its backend
+// supports it, and ErrListNotSupported otherwise.
+func ListDeadLetters(ctx context.Context, q Queue, max int) ([]DeadLetteredMessage, error) {
+	if l, ok := q.(DeadLetterLister); ok {
+		return l.ListDeadLetters(ctx, max)
+	}
+	return nil, ErrListNotSupported
+}
+
+// RecentDeadLetterLister is implemented by backends that can list their
+// most recently dead-lettered requests.
+type RecentDeadLetterLister interface {
+	// ListRecentDeadLetters returns up to max of the newest dead-lettered
+	// requests, newest first, which are left dead-lettered.
+	ListRecentDeadLetters(ctx context.Context, max int) ([]DeadLetteredMessage, error)
+}
+
+// ListRecentDeadLetters returns up to max of the newest dead-lettered
+// requests of q, newest first, if its backend can list them, or
+// ErrListNotSupported.
+func ListRecentDeadLetters(ctx context.Context, q Queue, max int) ([]DeadLetteredMessage, error) {
+	if l, ok := q.(RecentDeadLetterLister); ok {
+		return l.ListRecentDeadLetters(ctx, max)
+	}
+	return nil, ErrListNotSupported
+}
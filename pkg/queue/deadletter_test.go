@@ -0,0 +1,226 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFailureFields(t *testing.T) {
+	first := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		failure Failure
+		want    map[string]string
+	}{{
+		name:    "empty",
+		failure: Failure{},
+		want:    map[string]string{},
+	}, {
+		name: "unreachable",
+		failure: Failure{
+			Attempts:     2,
+			FirstAttempt: first,
+			LastAttempt:  first.Add(1500 * time.Millisecond),
+		},
+		want: map[string]string{
+			FailureAttemptsField:     "2",
+			FailureFirstAttemptField: "2021-03-01T10:00:00Z",
+			FailureLastAttemptField:  "2021-03-01T10:00:01.5Z",
+		},
+	}, {
+		name: "failed",
+		failure: Failure{
+			StatusCode:   503,
+			Attempts:     1,
+			FirstAttempt: first.In(time.FixedZone("CET", 3600)),
+			LastAttempt:  first,
+		},
+		want: map[string]string{
+			FailureStatusField:       "503",
+			FailureAttemptsField:     "1",
+			FailureFirstAttemptField: "2021-03-01T10:00:00Z",
+			FailureLastAttemptField:  "2021-03-01T10:00:00Z",
+		},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if diff := cmp.Diff(test.want, test.failure.Fields()); diff != "" {
+				t.Error("Fields() (-want, +got):", diff)
+			}
+		})
+	}
+}
+
+// deadLetterRecorder records the entries added to redis streams.
+type deadLetterRecorder struct {
+	redis.Cmdable
+	added map[string]map[string]interface{}
+}
+
+func (f *deadLetterRecorder) XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd {
+	f.added[a.Stream] = a.Values.(map[string]interface{})
+	return redis.NewStringResult("1-0", nil)
+}
+
+func (f *deadLetterRecorder) XAck(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd {
+	return redis.NewIntResult(int64(len(ids)), nil)
+}
+
+func TestRedisDeadLetterFailure(t *testing.T) {
+	client := &deadLetterRecorder{added: make(map[string]map[string]interface{})}
+	r := NewRedisFromClient(client, RedisConfig{StreamName: "requests", ConsumerGroup: "group"})
+	at := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	ctx := WithFailure(context.Background(), Failure{StatusCode: 500, Attempts: 3, FirstAttempt: at, LastAttempt: at})
+
+	if err := r.DeadLetter(ctx, Message{ID: "1-0", Data: []byte("request")}, "url returned 500"); err != nil {
+		t.Fatal("DeadLetter() =", err)
+	}
+	want := map[string]interface{}{
+		redisDataField:           []byte("request"),
+		redisReasonField:         "url returned 500",
+		FailureStatusField:       "500",
+		FailureAttemptsField:     "3",
+		FailureFirstAttemptField: "2021-03-01T10:00:00Z",
+		FailureLastAttemptField:  "2021-03-01T10:00:00Z",
+	}
+	if diff := cmp.Diff(want, client.added["requests"+deadLetterSuffix]); diff != "" {
+		t.Error("dead-lettered entry (-want, +got):", diff)
+	}
+}
+
+// deadLetterReader answers reads of redis streams with entries.
+type deadLetterReader struct {
+	redis.Cmdable
+	entries map[string][]redis.XMessage
+}
+
+func (f *deadLetterReader) XRangeN(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd {
+	entries := f.entries[stream]
+	if int64(len(entries)) > count {
+		entries = entries[:count]
+	}
+	return redis.NewXMessageSliceCmdResult(entries, nil)
+}
+
+func (f *deadLetterReader) XRevRangeN(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd {
+	var entries []redis.XMessage
+	for i := len(f.entries[stream]) - 1; i >= 0 && int64(len(entries)) < count; i-- {
+		entries = append(entries, f.entries[stream][i])
+	}
+	return redis.NewXMessageSliceCmdResult(entries, nil)
+}
+
+func TestRedisListDeadLetters(t *testing.T) {
+	at := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	client := &deadLetterReader{entries: map[string][]redis.XMessage{
+		"requests" + deadLetterSuffix: {{
+			ID: "1614592800000-0",
+			Values: map[string]interface{}{
+				redisDataField:           "request 1",
+				redisReasonField:         "url returned 500",
+				FailureStatusField:       "500",
+				FailureAttemptsField:     "3",
+				FailureFirstAttemptField: "2021-03-01T10:00:00Z",
+				FailureLastAttemptField:  "2021-03-01T10:00:00Z",
+			},
+		}, {
+			ID:     "1614592800001-0",
+			Values: map[string]interface{}{redisDataField: "request 2", redisReasonField: "expired"},
+		}},
+	}}
+	r := NewRedisFromClient(client, RedisConfig{StreamName: "requests", ConsumerGroup: "group"})
+
+	got, err := ListDeadLetters(context.Background(), r, 10)
+	if err != nil {
+		t.Fatal("ListDeadLetters() =", err)
+	}
+	want := []DeadLetteredMessage{{
+		Message:      Message{ID: "1614592800000-0", Data: []byte("request 1")},
+		Reason:       "url returned 500",
+		Failure:      Failure{StatusCode: 500, Attempts: 3, FirstAttempt: at, LastAttempt: at},
+		DeadLettered: at.Local(),
+	}, {
+		Message:      Message{ID: "1614592800001-0", Data: []byte("request 2")},
+		Reason:       "expired",
+		DeadLettered: at.Add(time.Millisecond).Local(),
+	}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("ListDeadLetters() (-want, +got):", diff)
+	}
+}
+
+func TestRedisListRecentDeadLetters(t *testing.T) {
+	client := &deadLetterReader{entries: map[string][]redis.XMessage{
+		"requests" + deadLetterSuffix: {
+			{ID: "1614592800000-0", Values: map[string]interface{}{redisDataField: "request 1", redisReasonField: "expired"}},
+			{ID: "1614592800001-0", Values: map[string]interface{}{redisDataField: "request 2", redisReasonField: "expired"}},
+			{ID: "1614592800002-0", Values: map[string]interface{}{redisDataField: "request 3", redisReasonField: "expired"}},
+		},
+	}}
+	r := NewRedisFromClient(client, RedisConfig{StreamName: "requests", ConsumerGroup: "group"})
+
+	got, err := ListRecentDeadLetters(context.Background(), r, 2)
+	if err != nil {
+		t.Fatal("ListRecentDeadLetters() =", err)
+	}
+	if len(got) != 2 || got[0].ID != "1614592800002-0" || got[1].ID != "1614592800001-0" {
+		t.Errorf("ListRecentDeadLetters() = %v, want requests 3 and 2", got)
+	}
+}
+
+func TestMemoryListDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	q := NewMemory(MemoryConfig{MemoryQueueName: fmt.Sprint(t.Name(), time.Now().UnixNano()), MemoryReadTimeout: time.Second})
+	for _, id := range []string{"1", "2", "3"} {
+		if err := q.Enqueue(ctx, id, []byte("request "+id)); err != nil {
+			t.Fatal("Enqueue() =", err)
+		}
+		msgs, err := q.Dequeue(ctx)
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("Dequeue() = %v, %v, want 1 message", msgs, err)
+		}
+		if err := q.DeadLetter(WithFailure(ctx, Failure{Attempts: 1}), msgs[0], "failed"); err != nil {
+			t.Fatal("DeadLetter() =", err)
+		}
+	}
+
+	got, err := ListDeadLetters(ctx, q, 2)
+	if err != nil {
+		t.Fatal("ListDeadLetters() =", err)
+	}
+	if len(got) != 2 || got[0].ID != "1" || got[1].ID != "2" {
+		t.Fatalf("ListDeadLetters() = %v, want requests 1 and 2", got)
+	}
+	if got[0].Reason != "failed" || got[0].Failure.Attempts != 1 || got[0].DeadLettered.IsZero() {
+		t.Errorf("ListDeadLetters()[0] = %+v, want the reason, failure and time of the dead letter", got[0])
+	}
+	recent, err := ListRecentDeadLetters(ctx, q, 2)
+	if err != nil {
+		t.Fatal("ListRecentDeadLetters() =", err)
+	}
+	if len(recent) != 2 || recent[0].ID != "3" || recent[1].ID != "2" {
+		t.Fatalf("ListRecentDeadLetters() = %v, want requests 3 and 2", recent)
+	}
+	// Listed requests stay dead-lettered.
+	if n := len(q.DeadLetters()); n != 3 {
+		t.Errorf("got %d dead letters left, want 3", n)
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// DelayedMessage is a request held by a queue until its delivery time.
+type DelayedMessage struct {
+	Message
+	// DeliverAt is the time the request is due.
+	DeliverAt time.Time
+}
+
+// ErrDelayedNotSupported is returned by ListDelayed for backends that do not
+// hold their delayed requests apart from the others.
+var ErrDelayedNotSupported = errors.New("listing delayed requests is not supported by this queue backend")
+
+// DelayedLister is implemented by backends holding the requests enqueued with
+// a delivery time, see WithDeliverAt, apart from the others until they are
+// due. Dequeue does not return them before then.
+type DelayedLister interface {
+	// Delayed returns up to max of the delayed requests, the first due
+	// first.
+	Delayed(ctx context.Context, max int) ([]DelayedMessage, error)
+	// RemoveDelayed deletes a delayed request returned by Delayed. Requests
+	// that became due in the meantime are not deleted.
+	RemoveDelayed(ctx context.Context, msg DelayedMessage) error
+}
+
+// ListDelayed returns up to max of the delayed requests of q if its backend
+// supports it, and ErrDelayedNotSupported otherwise.
+func ListDelayed(ctx context.Context, q Queue, max int) ([]DelayedMessage, error) {
+	if l, ok := q.(DelayedLister); ok {
+		return l.Delayed(ctx, max)
+	}
+	return nil, ErrDelayedNotSupported
+}
+
+// RemoveDelayed deletes a delayed request of q returned by ListDelayed.
+func RemoveDelayed(ctx context.Context, q Queue, msg DelayedMessage) error {
+	if l, ok := q.(DelayedLister); ok {
+		return l.RemoveDelayed(ctx, msg)
+	}
+	return ErrDelayedNotSupported
+}
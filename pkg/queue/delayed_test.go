@@ -0,0 +1,149 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMemoryDelayed(t *testing.T) {
+	ctx := context.Background()
+	q := NewMemory(MemoryConfig{MemoryQueueName: fmt.Sprint(t.Name(), time.Now().UnixNano()), MemoryReadTimeout: 10 * time.Millisecond})
+	now := time.Now().Truncate(time.Millisecond)
+	for i, after := range []time.Duration{3 * time.Hour, time.Hour, 2 * time.Hour} {
+		if err := q.Enqueue(WithDeliverAt(ctx, now.Add(after)), fmt.Sprint(i), []byte(fmt.Sprint("delayed ", i))); err != nil {
+			t.Fatal("Enqueue() =", err)
+		}
+	}
+	if err := q.Enqueue(ctx, "due", []byte("due")); err != nil {
+		t.Fatal("Enqueue() =", err)
+	}
+
+	msgs, err := ListDelayed(ctx, q, 2)
+	if err != nil {
+		t.Fatal("ListDelayed() =", err)
+	}
+	want := []DelayedMessage{
+		{Message: Message{ID: "1", Data: []byte("delayed 1")}, DeliverAt: now.Add(time.Hour)},
+		{Message: Message{ID: "2", Data: []byte("delayed 2")}, DeliverAt: now.Add(2 * time.Hour)},
+	}
+	if diff := cmp.Diff(want, msgs); diff != "" {
+		t.Error("ListDelayed() (-want, +got):", diff)
+	}
+
+	if err := RemoveDelayed(ctx, q, msgs[0]); err != nil {
+		t.Fatal("RemoveDelayed() =", err)
+	}
+	msgs, err = ListDelayed(ctx, q, 10)
+	if err != nil {
+		t.Fatal("ListDelayed() =", err)
+	}
+	if len(msgs) != 2 || msgs[0].ID != "2" || msgs[1].ID != "0" {
+		t.Errorf("ListDelayed() after RemoveDelayed() = %v, want requests 2 and 0", msgs)
+	}
+}
+
+// delayedSet is a redis sorted set of delayed requests.
+type delayedSet struct {
+	redis.Cmdable
+	members []redis.Z
+}
+
+func (f *delayedSet) ZRangeWithScores(ctx context.Context, key string, start, stop int64) *redis.ZSliceCmd {
+	if stop >= int64(len(f.members)) {
+		stop = int64(len(f.members)) - 1
+	}
+	if start > stop {
+		return redis.NewZSliceCmdResult(nil, nil)
+	}
+	return redis.NewZSliceCmdResult(append([]redis.Z(nil), f.members[start:stop+1]...), nil)
+}
+
+func (f *delayedSet) ZRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	kept := f.members[:0]
+	for _, m := range f.members {
+		if m.Member != members[0] {
+			kept = append(kept, m)
+		}
+	}
+	f.members = kept
+	return redis.NewIntResult(1, nil)
+}
+
+func TestRedisDelayed(t *testing.T) {
+	ctx := context.Background()
+	at := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	client := &delayedSet{members: []redis.Z{
+		{Score: float64(at.UnixNano() / int64(time.Millisecond)), Member: "first"},
+		{Score: float64(at.Add(time.Minute).UnixNano() / int64(time.Millisecond)), Member: "second"},
+	}}
+	r := NewRedisFromClient(client, RedisConfig{StreamName: "requests", ConsumerGroup: "group"})
+
+	msgs, err := ListDelayed(ctx, r, 10)
+	if err != nil {
+		t.Fatal("ListDelayed() =", err)
+	}
+	if len(msgs) != 2 || string(msgs[0].Data) != "first" || !msgs[0].DeliverAt.Equal(at) || !msgs[1].DeliverAt.Equal(at.Add(time.Minute)) {
+		t.Fatalf("ListDelayed() = %v, want both requests with their delivery time", msgs)
+	}
+	if err := RemoveDelayed(ctx, r, msgs[0]); err != nil {
+		t.Fatal("RemoveDelayed() =", err)
+	}
+	if len(client.members) != 1 || client.members[0].Member != "second" {
+		t.Errorf("delayed requests = %v, want the second one left", client.members)
+	}
+}
+
+func TestPrioritizedDelayed(t *testing.T) {
+	ctx := context.Background()
+	q, err := NewPrioritized(ctx, priorityConfig(fmt.Sprint(t.Name(), time.Now().UnixNano())))
+	if err != nil {
+		t.Fatal("NewPrioritized() =", err)
+	}
+	defer q.Close()
+	at := time.Now().Add(time.Hour)
+	if err := q.Enqueue(WithPriority(WithDeliverAt(ctx, at), PriorityLow), "low", []byte("low")); err != nil {
+		t.Fatal("Enqueue() =", err)
+	}
+
+	msgs, err := ListDelayed(ctx, q, 10)
+	if err != nil {
+		t.Fatal("ListDelayed() =", err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("ListDelayed() = %v, want the low priority request", msgs)
+	}
+	if p, ok := MessagePriority(msgs[0].Message); !ok || p != PriorityLow {
+		t.Errorf("MessagePriority() = %q, %v, want %q", p, ok, PriorityLow)
+	}
+	if err := RemoveDelayed(ctx, q, msgs[0]); err != nil {
+		t.Fatal("RemoveDelayed() =", err)
+	}
+	if msgs, err := ListDelayed(ctx, q, 10); err != nil || len(msgs) != 0 {
+		t.Errorf("ListDelayed() after RemoveDelayed() = %v, %v, want none", msgs, err)
+	}
+}
+
+func TestDelayedNotSupported(t *testing.T) {
+	if _, err := ListDelayed(context.Background(), &Channel{}, 10); !errors.Is(err, ErrDelayedNotSupported) {
+		t.Errorf("ListDelayed() = %v, want %v", err, ErrDelayedNotSupported)
+	}
+}
@@ -0,0 +1,330 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+	"knative.dev/pkg/logging"
+)
+
+// The Kafka record header holding the dead-letter reason.
+const kafkaReasonHeader = "async-dead-letter-reason"
+
+// KafkaConfig holds the environment configuration of the Kafka backend.
+type KafkaConfig struct {
+	KafkaBrokers           []string      `envconfig:"KAFKA_BROKERS"`
+	KafkaTopic             string        `envconfig:"KAFKA_TOPIC"`
+	KafkaDeadLetterTopic   string        `envconfig:"KAFKA_DEAD_LETTER_TOPIC"`
+	KafkaConsumerGroup     string        `envconfig:"KAFKA_CONSUMER_GROUP" default:"async-consumer"`
+	KafkaVersion           string        `envconfig:"KAFKA_VERSION" default:"2.0.0"`
+	KafkaNumPartitions     int32         `envconfig:"KAFKA_NUM_PARTITIONS"`
+	KafkaReplicationFactor int16         `envconfig:"KAFKA_REPLICATION_FACTOR" default:"1"`
+	KafkaReadTimeout       time.Duration `envconfig:"KAFKA_READ_TIMEOUT" default:"5s"`
+}
+
+// Kafka is a Queue backed by a Kafka topic and consumer group. Requests are
+// keyed by their async request ID so they are spread across partitions.
+type Kafka struct {
+	cfg      KafkaConfig
+	client   sarama.Client
+	producer sarama.SyncProducer
+
+	// The consumer group is only started on the first Dequeue, so the
+	// producer never joins it. startMu guards group and cancel, which are
+	// only set once the group was joined, so failures are retried.
+	startMu  sync.Mutex
+	group    sarama.ConsumerGroup
+	cancel   context.CancelFunc
+	messages chan kafkaDelivery
+
+	mu         sync.Mutex
+	inflight   map[string]kafkaDelivery
+	partitions map[kafkaPartitionKey]*kafkaPartition
+}
+
+// kafkaPartitionKey identifies a partition claimed in a group session.
+type kafkaPartitionKey struct {
+	session   sarama.ConsumerGroupSession
+	partition int32
+}
+
+// kafkaPartition holds the messages of a claimed partition handed out to
+// Dequeue and not marked yet. Marking an offset commits every earlier one, so
+// messages are only marked once all those before them are acked as well.
+type kafkaPartition struct {
+	// pending is in offset order.
+	pending []*sarama.ConsumerMessage
+	acked   map[int64]bool
+}
+
+// kafkaDelivery is a message handed out by Dequeue along with the group
+// session it must be marked in.
+type kafkaDelivery struct {
+	session sarama.ConsumerGroupSession
+	msg     *sarama.ConsumerMessage
+}
+
+var (
+	_ Queue         = (*Kafka)(nil)
+	_ HealthChecker = (*Kafka)(nil)
+)
+
+// NewKafka connects to the Kafka cluster described by cfg, creating the topic
+// when KAFKA_NUM_PARTITIONS is set and it does not exist yet.
+func NewKafka(ctx context.Context, cfg KafkaConfig) (*Kafka, error) {
+	if len(cfg.KafkaBrokers) == 0 || cfg.KafkaTopic == "" {
+		return nil, errors.New("KAFKA_BROKERS and KAFKA_TOPIC must be set")
+	}
+	if cfg.KafkaDeadLetterTopic == "" {
+		cfg.KafkaDeadLetterTopic = cfg.KafkaTopic + deadLetterSuffix
+	}
+	version, err := sarama.ParseKafkaVersion(cfg.KafkaVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse kafka version: %w", err)
+	}
+	sc := sarama.NewConfig()
+	sc.Version = version
+	sc.Producer.RequiredAcks = sarama.WaitForAll
+	sc.Producer.Return.Successes = true
+	sc.Consumer.Offsets.Initial = sarama.OffsetOldest
+
+	client, err := sarama.NewClient(cfg.KafkaBrokers, sc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kafka client: %w", err)
+	}
+	if cfg.KafkaNumPartitions > 0 {
+		if err := createKafkaTopic(client, cfg); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to create kafka producer: %w", err)
+	}
+	return &Kafka{
+		cfg:        cfg,
+		client:     client,
+		producer:   producer,
+		messages:   make(chan kafkaDelivery),
+		inflight:   make(map[string]kafkaDelivery),
+		partitions: make(map[kafkaPartitionKey]*kafkaPartition),
+	}, nil
+}
+
+// createKafkaTopic creates the request topic, ignoring topics that already exist.
+func createKafkaTopic(client sarama.Client, cfg KafkaConfig) error {
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		return fmt.Errorf("failed to create kafka admin: %w", err)
+	}
+	err = admin.CreateTopic(cfg.KafkaTopic, &sarama.TopicDetail{
+		NumPartitions:     cfg.KafkaNumPartitions,
+		ReplicationFactor: cfg.KafkaReplicationFactor,
+	}, false)
+	var topicErr *sarama.TopicError
+	if errors.As(err, &topicErr) && topicErr.Err == sarama.ErrTopicAlreadyExists {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to create topic %q: %w", cfg.KafkaTopic, err)
+	}
+	return nil
+}
+
+// Enqueue implements Queue.
+func (k *Kafka) Enqueue(ctx context.Context, id string, data []byte) error {
+	if err := checkNoDelay(ctx); err != nil {
+		return err
+	}
+	_, _, err := k.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: k.cfg.KafkaTopic,
+		Key:   sarama.StringEncoder(id),
+		Value: sarama.ByteEncoder(data),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish %q: %w", id, err)
+	}
+	return nil
+}
+
+// Dequeue implements Queue.
+func (k *Kafka) Dequeue(ctx context.Context) ([]Message, error) {
+	if err := k.start(logging.FromContext(ctx)); err != nil {
+		return nil, err
+	}
+	select {
+	case d := <-k.messages:
+		id := fmt.Sprintf("%d/%d", d.msg.Partition, d.msg.Offset)
+		k.mu.Lock()
+		k.inflight[id] = d
+		k.mu.Unlock()
+		return []Message{{ID: id, Data: d.msg.Value}}, nil
+	case <-time.After(k.cfg.KafkaReadTimeout):
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Ack implements Queue by marking in its group session the offset up to
+// which every message of the partition was acked. Messages acked before
+// earlier ones of their partition are only marked with them, so a crash
+// never commits the offset of a message still being delivered.
+func (k *Kafka) Ack(ctx context.Context, msg Message) error {
+	k.mu.Lock()
+	d, ok := k.inflight[msg.ID]
+	if !ok {
+		k.mu.Unlock()
+		return fmt.Errorf("failed to ack %q: unknown message", msg.ID)
+	}
+	delete(k.inflight, msg.ID)
+	var mark *sarama.ConsumerMessage
+	// Partitions are dropped when their session ends, the messages of
+	// which are then read again by the next one.
+	if p := k.partitions[kafkaPartitionKey{d.session, d.msg.Partition}]; p != nil {
+		p.acked[d.msg.Offset] = true
+		for len(p.pending) > 0 && p.acked[p.pending[0].Offset] {
+			mark = p.pending[0]
+			delete(p.acked, mark.Offset)
+			p.pending = p.pending[1:]
+		}
+	}
+	k.mu.Unlock()
+	if mark != nil {
+		d.session.MarkMessage(mark, "")
+	}
+	return nil
+}
+
+// DeadLetter implements Queue by publishing the message to the dead-letter
+// topic and acking the original.
+func (k *Kafka) DeadLetter(ctx context.Context, msg Message, reason string) error {
+	headers := []sarama.RecordHeader{{
+		Key:   []byte(kafkaReasonHeader),
+		Value: []byte(reason),
+	}}
+	for k, v := range FailureFrom(ctx).Fields() {
+		headers = append(headers, sarama.RecordHeader{Key: []byte(failureHeaderPrefix + k), Value: []byte(v)})
+	}
+	_, _, err := k.producer.SendMessage(&sarama.ProducerMessage{
+		Topic:   k.cfg.KafkaDeadLetterTopic,
+		Value:   sarama.ByteEncoder(msg.Data),
+		Headers: headers,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to dead-letter %q: %w", msg.ID, err)
+	}
+	return k.Ack(ctx, msg)
+}
+
+// CheckHealth implements HealthChecker by refreshing the metadata of the
+// topic, which fails when no broker can be reached.
+func (k *Kafka) CheckHealth(ctx context.Context, consuming bool) error {
+	if err := k.client.RefreshMetadata(k.cfg.KafkaTopic); err != nil {
+		return fmt.Errorf("failed to reach kafka: %w", err)
+	}
+	return nil
+}
+
+// Close implements Queue.
+func (k *Kafka) Close() error {
+	k.startMu.Lock()
+	if k.cancel != nil {
+		k.cancel()
+	}
+	if k.group != nil {
+		k.group.Close()
+	}
+	k.startMu.Unlock()
+	k.producer.Close()
+	return k.client.Close()
+}
+
+// start joins the consumer group unless it was joined already.
+func (k *Kafka) start(logger *zap.SugaredLogger) error {
+	k.startMu.Lock()
+	defer k.startMu.Unlock()
+	if k.group != nil {
+		return nil
+	}
+	return k.consume(logger)
+}
+
+// consume joins the consumer group and keeps consuming until Close is called.
+func (k *Kafka) consume(logger *zap.SugaredLogger) error {
+	group, err := sarama.NewConsumerGroupFromClient(k.cfg.KafkaConsumerGroup, k.client)
+	if err != nil {
+		return fmt.Errorf("failed to join consumer group %q: %w", k.cfg.KafkaConsumerGroup, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	k.group, k.cancel = group, cancel
+	go func() {
+		// Consume returns whenever the group rebalances, so it is called in a loop.
+		for ctx.Err() == nil {
+			if err := group.Consume(ctx, []string{k.cfg.KafkaTopic}, k); err != nil {
+				logger.Errorw("Error consuming from kafka", zap.Error(err))
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+	return nil
+}
+
+// Setup implements sarama.ConsumerGroupHandler.
+func (k *Kafka) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// Cleanup implements sarama.ConsumerGroupHandler by dropping the partitions
+// of the session.
+func (k *Kafka) Cleanup(session sarama.ConsumerGroupSession) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for key := range k.partitions {
+		if key.session == session {
+			delete(k.partitions, key)
+		}
+	}
+	return nil
+}
+
+// ConsumeClaim implements sarama.ConsumerGroupHandler by handing the claimed
+// messages to Dequeue. They are tracked in offset order before being handed
+// out, as concurrent reads may receive them in any order.
+func (k *Kafka) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	key := kafkaPartitionKey{session, claim.Partition()}
+	k.mu.Lock()
+	p := &kafkaPartition{acked: make(map[int64]bool)}
+	k.partitions[key] = p
+	k.mu.Unlock()
+	for msg := range claim.Messages() {
+		k.mu.Lock()
+		p.pending = append(p.pending, msg)
+		k.mu.Unlock()
+		select {
+		case k.messages <- kafkaDelivery{session: session, msg: msg}:
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+	return nil
+}
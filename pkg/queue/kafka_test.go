@@ -0,0 +1,193 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+)
+
+func TestKafkaEnqueue(t *testing.T) {
+	tests := []struct {
+		name    string
+		sendErr error
+		wantErr bool
+	}{{
+		name: "message is published keyed by id",
+	}, {
+		name:    "publish failure",
+		sendErr: errors.New("broker unavailable"),
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			producer := mocks.NewSyncProducer(t, nil)
+			checker := func(msg *sarama.ProducerMessage) error {
+				if msg.Topic != "requests" {
+					return fmt.Errorf("got topic %q, want %q", msg.Topic, "requests")
+				}
+				if key, _ := msg.Key.Encode(); string(key) != "123" {
+					return fmt.Errorf("got key %q, want %q", key, "123")
+				}
+				return nil
+			}
+			if test.sendErr != nil {
+				producer.ExpectSendMessageWithMessageCheckerFunctionAndFail(checker, test.sendErr)
+			} else {
+				producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(checker)
+			}
+			k := &Kafka{
+				cfg:      KafkaConfig{KafkaTopic: "requests"},
+				producer: producer,
+			}
+			err := k.Enqueue(context.Background(), "123", []byte("data"))
+			if (err != nil) != test.wantErr {
+				t.Errorf("Enqueue() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err := producer.Close(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestNewKafkaValidation(t *testing.T) {
+	if _, err := NewKafka(context.Background(), KafkaConfig{KafkaTopic: "requests"}); err == nil {
+		t.Error("expected an error when no brokers are configured")
+	}
+	if _, err := NewKafka(context.Background(), KafkaConfig{KafkaBrokers: []string{"localhost:9092"}}); err == nil {
+		t.Error("expected an error when no topic is configured")
+	}
+}
+
+// closedKafkaClient is a sarama client that was closed, with which the
+// consumer group cannot be joined.
+type closedKafkaClient struct {
+	sarama.Client
+	cfg *sarama.Config
+}
+
+func (c *closedKafkaClient) Config() *sarama.Config { return c.cfg }
+func (c *closedKafkaClient) Closed() bool           { return true }
+
+func TestKafkaDequeueRetriesJoin(t *testing.T) {
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V2_0_0_0
+	k := &Kafka{cfg: KafkaConfig{KafkaConsumerGroup: "async-consumer"}, client: &closedKafkaClient{cfg: cfg}}
+	// Failing to join the group fails every read, rather than only the
+	// first one.
+	for i := 0; i < 2; i++ {
+		if _, err := k.Dequeue(context.Background()); err == nil {
+			t.Fatalf("Dequeue() #%d succeeded", i+1)
+		}
+	}
+	if k.group != nil {
+		t.Error("group was set after failing to join it")
+	}
+}
+
+// fakeKafkaSession is a group session recording the marked offsets.
+type fakeKafkaSession struct {
+	sarama.ConsumerGroupSession
+	ctx    context.Context
+	mu     sync.Mutex
+	marked []int64
+}
+
+func (s *fakeKafkaSession) Context() context.Context { return s.ctx }
+
+func (s *fakeKafkaSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.marked = append(s.marked, msg.Offset)
+}
+
+func (s *fakeKafkaSession) markedOffsets() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int64(nil), s.marked...)
+}
+
+// fakeKafkaClaim is a claimed partition holding messages.
+type fakeKafkaClaim struct {
+	sarama.ConsumerGroupClaim
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c *fakeKafkaClaim) Partition() int32                         { return 3 }
+func (c *fakeKafkaClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+func TestKafkaAckInOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	session := &fakeKafkaSession{ctx: ctx}
+	claim := &fakeKafkaClaim{messages: make(chan *sarama.ConsumerMessage, 3)}
+	for offset := int64(10); offset < 13; offset++ {
+		claim.messages <- &sarama.ConsumerMessage{Partition: 3, Offset: offset, Value: []byte("data")}
+	}
+	close(claim.messages)
+	k := &Kafka{
+		cfg:        KafkaConfig{KafkaReadTimeout: time.Second},
+		group:      &fakeKafkaGroup{},
+		messages:   make(chan kafkaDelivery),
+		inflight:   make(map[string]kafkaDelivery),
+		partitions: make(map[kafkaPartitionKey]*kafkaPartition),
+	}
+	go k.ConsumeClaim(session, claim)
+
+	var msgs []Message
+	for len(msgs) < 3 {
+		got, err := k.Dequeue(ctx)
+		if err != nil {
+			t.Fatal("Dequeue() =", err)
+		}
+		msgs = append(msgs, got...)
+	}
+	// The later messages are acked first, while the first one is still
+	// being delivered.
+	for _, i := range []int{2, 1} {
+		if err := k.Ack(ctx, msgs[i]); err != nil {
+			t.Fatal("Ack() =", err)
+		}
+	}
+	if got := session.markedOffsets(); len(got) != 0 {
+		t.Errorf("marked offsets %v before the first message was acked", got)
+	}
+	if err := k.Ack(ctx, msgs[0]); err != nil {
+		t.Fatal("Ack() =", err)
+	}
+	if got := session.markedOffsets(); len(got) != 1 || got[0] != 12 {
+		t.Errorf("marked offsets = %v, want [12]", got)
+	}
+	if err := k.Ack(ctx, msgs[0]); err == nil {
+		t.Error("Ack() of an acked message succeeded")
+	}
+
+	k.Cleanup(session)
+	if len(k.partitions) != 0 {
+		t.Errorf("partitions = %v after the session ended", k.partitions)
+	}
+}
+
+// fakeKafkaGroup is a consumer group that was joined.
+type fakeKafkaGroup struct {
+	sarama.ConsumerGroup
+}
@@ -0,0 +1,398 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryConfig holds the environment configuration of the in-memory backend.
+type MemoryConfig struct {
+	MemoryQueueName   string        `envconfig:"MEMORY_QUEUE_NAME" default:"default"`
+	MemoryReadTimeout time.Duration `envconfig:"MEMORY_READ_TIMEOUT" default:"5s"`
+}
+
+// Memory is a process-local Queue meant for development and tests. Queues
+// with the same name share their messages, so a producer and a consumer
+// running in one process can talk to each other. Nothing is persisted.
+type Memory struct {
+	store   *memoryStore
+	timeout time.Duration
+}
+
+// memoryStore holds the messages of a named Memory queue.
+type memoryStore struct {
+	mu          sync.Mutex
+	pending     []Message
+	inflight    map[string]Message
+	deadLetters []DeadLetteredMessage
+	// delayed holds the messages enqueued with a future delivery time.
+	delayed []delayedMessage
+	// enqueued holds the time the pending and in-flight messages were
+	// enqueued, or became due, by ID.
+	enqueued map[string]time.Time
+	// ready is signaled when pending becomes non-empty.
+	ready chan struct{}
+}
+
+type delayedMessage struct {
+	Message
+	at time.Time
+}
+
+var (
+	memoryStoresMu sync.Mutex
+	memoryStores   = map[string]*memoryStore{}
+)
+
+var (
+	_ Queue                  = (*Memory)(nil)
+	_ BatchEnqueuer          = (*Memory)(nil)
+	_ Replayer               = (*Memory)(nil)
+	_ BacklogReader          = (*Memory)(nil)
+	_ PendingLister          = (*Memory)(nil)
+	_ DeadLetterLister       = (*Memory)(nil)
+	_ RecentDeadLetterLister = (*Memory)(nil)
+	_ Purger                 = (*Memory)(nil)
+	_ DelayedLister          = (*Memory)(nil)
+)
+
+// NewMemory returns the in-memory queue named in cfg, creating it if needed.
+func NewMemory(cfg MemoryConfig) *Memory {
+	memoryStoresMu.Lock()
+	defer memoryStoresMu.Unlock()
+	store, ok := memoryStores[cfg.MemoryQueueName]
+	if !ok {
+		store = &memoryStore{
+			inflight: make(map[string]Message),
+			enqueued: make(map[string]time.Time),
+			ready:    make(chan struct{}, 1),
+		}
+		memoryStores[cfg.MemoryQueueName] = store
+	}
+	return &Memory{store: store, timeout: cfg.MemoryReadTimeout}
+}
+
+// Enqueue implements Queue. Requests with a delivery time, see WithDeliverAt,
+// are held back until then.
+func (m *Memory) Enqueue(ctx context.Context, id string, data []byte) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	msg := Message{ID: id, Data: append([]byte(nil), data...)}
+	if at := DeliverAtFrom(ctx); at.After(time.Now()) {
+		m.store.delayed = append(m.store.delayed, delayedMessage{Message: msg, at: at})
+		return nil
+	}
+	m.store.push(msg)
+	return nil
+}
+
+// EnqueueBatch implements BatchEnqueuer.
+func (m *Memory) EnqueueBatch(ctx context.Context, ids []string, data [][]byte) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	at := DeliverAtFrom(ctx)
+	for i, id := range ids {
+		msg := Message{ID: id, Data: append([]byte(nil), data[i]...)}
+		if at.After(time.Now()) {
+			m.store.delayed = append(m.store.delayed, delayedMessage{Message: msg, at: at})
+		} else {
+			m.store.push(msg)
+		}
+	}
+	return nil
+}
+
+// Dequeue implements Queue.
+func (m *Memory) Dequeue(ctx context.Context) ([]Message, error) {
+	timeout := time.NewTimer(m.timeout)
+	defer timeout.Stop()
+	for {
+		msg, next, ok := m.store.pop()
+		if ok {
+			return []Message{msg}, nil
+		}
+		var due <-chan time.Time
+		if !next.IsZero() {
+			due = time.After(time.Until(next))
+		}
+		select {
+		case <-m.store.ready:
+		case <-due:
+		case <-timeout.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Ack implements Queue.
+func (m *Memory) Ack(ctx context.Context, msg Message) error {
+	_, err := m.store.take(msg.ID)
+	return err
+}
+
+// DeadLetter implements Queue. Dead-lettered messages are kept in memory and
+// returned by DeadLetters.
+func (m *Memory) DeadLetter(ctx context.Context, msg Message, reason string) error {
+	taken, err := m.store.take(msg.ID)
+	if err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.store.deadLetters = append(m.store.deadLetters, DeadLetteredMessage{
+		Message:      taken,
+		Reason:       reason,
+		Failure:      FailureFrom(ctx),
+		DeadLettered: time.Now(),
+	})
+	return nil
+}
+
+// Replay implements Replayer.
+func (m *Memory) Replay(ctx context.Context, max int) (int, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	fn := ReplayFuncFrom(ctx)
+	n := 0
+	var kept []DeadLetteredMessage
+	for _, d := range m.store.deadLetters {
+		if n < max {
+			data, ok := d.Data, true
+			if fn != nil {
+				data, ok = fn(d.Data)
+			}
+			if ok {
+				d.Message.Data = data
+				d.Message.Deliveries = 0
+				m.store.push(d.Message)
+				n++
+				continue
+			}
+		}
+		kept = append(kept, d)
+	}
+	m.store.deadLetters = kept
+	return n, nil
+}
+
+// Backlog implements BacklogReader.
+func (m *Memory) Backlog(ctx context.Context) (Backlog, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	b := Backlog{Depth: int64(len(m.store.pending) + len(m.store.inflight))}
+	for _, at := range m.store.enqueued {
+		b.add(Backlog{Oldest: at})
+	}
+	now := time.Now()
+	for _, d := range m.store.delayed {
+		if !d.at.After(now) {
+			b.add(Backlog{Depth: 1, Oldest: d.at})
+		}
+	}
+	return b, nil
+}
+
+// Pending implements PendingLister.
+func (m *Memory) Pending(ctx context.Context, max int) ([]PendingMessage, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	var msgs []PendingMessage
+	for _, msg := range m.store.inflight {
+		msgs = append(msgs, PendingMessage{Message: msg, InFlight: true, Enqueued: m.store.enqueued[msg.ID]})
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Enqueued.Before(msgs[j].Enqueued) })
+	for _, msg := range m.store.pending {
+		msgs = append(msgs, PendingMessage{Message: msg, Enqueued: m.store.enqueued[msg.ID]})
+	}
+	now := time.Now()
+	for _, d := range m.store.delayed {
+		if !d.at.After(now) {
+			msgs = append(msgs, PendingMessage{Message: d.Message, Enqueued: d.at})
+		}
+	}
+	if len(msgs) > max {
+		msgs = msgs[:max]
+	}
+	return msgs, nil
+}
+
+// Purge implements Purger.
+func (m *Memory) Purge(ctx context.Context, fn PurgeFunc) (int, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	n := 0
+	pending := m.store.pending[:0]
+	for _, msg := range m.store.pending {
+		if fn(msg.Data) {
+			delete(m.store.enqueued, msg.ID)
+			n++
+			continue
+		}
+		pending = append(pending, msg)
+	}
+	m.store.pending = pending
+	delayed := m.store.delayed[:0]
+	for _, d := range m.store.delayed {
+		if fn(d.Data) {
+			n++
+			continue
+		}
+		delayed = append(delayed, d)
+	}
+	m.store.delayed = delayed
+	return n, nil
+}
+
+// Delayed implements DelayedLister.
+func (m *Memory) Delayed(ctx context.Context, max int) ([]DelayedMessage, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	msgs := make([]DelayedMessage, 0, len(m.store.delayed))
+	for _, d := range m.store.delayed {
+		msgs = append(msgs, DelayedMessage{Message: d.Message, DeliverAt: d.at})
+	}
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].DeliverAt.Before(msgs[j].DeliverAt) })
+	if len(msgs) > max {
+		msgs = msgs[:max]
+	}
+	return msgs, nil
+}
+
+// RemoveDelayed implements DelayedLister.
+func (m *Memory) RemoveDelayed(ctx context.Context, msg DelayedMessage) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	for i, d := range m.store.delayed {
+		if d.ID == msg.ID {
+			m.store.delayed = append(m.store.delayed[:i], m.store.delayed[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// ListDeadLetters implements DeadLetterLister.
+func (m *Memory) ListDeadLetters(ctx context.Context, max int) ([]DeadLetteredMessage, error) {
+	msgs := m.DeadLetters()
+	if len(msgs) > max {
+		msgs = msgs[:max]
+	}
+	return msgs, nil
+}
+
+// ListRecentDeadLetters implements RecentDeadLetterLister.
+func (m *Memory) ListRecentDeadLetters(ctx context.Context, max int) ([]DeadLetteredMessage, error) {
+	all := m.DeadLetters()
+	var msgs []DeadLetteredMessage
+	for i := len(all) - 1; i >= 0 && len(msgs) < max; i-- {
+		msgs = append(msgs, all[i])
+	}
+	return msgs, nil
+}
+
+// DeadLetters returns the messages dead-lettered so far.
+func (m *Memory) DeadLetters() []DeadLetteredMessage {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	return append([]DeadLetteredMessage(nil), m.store.deadLetters...)
+}
+
+// Close implements Queue. Messages that were dequeued but not acked are made
+// available again, as a broker would redeliver them.
+func (m *Memory) Close() error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	for id, msg := range m.store.inflight {
+		delete(m.store.inflight, id)
+		m.store.push(msg)
+	}
+	return nil
+}
+
+// push appends msg to the pending messages. It must be called with mu held.
+func (s *memoryStore) push(msg Message) {
+	if _, ok := s.enqueued[msg.ID]; !ok {
+		s.enqueued[msg.ID] = time.Now()
+	}
+	s.pending = append(s.pending, msg)
+	s.signal()
+}
+
+// pop moves the oldest pending message in flight. When there is none, it
+// returns when the next delayed message is due, if any.
+func (s *memoryStore) pop() (Message, time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := s.promote(time.Now())
+	if len(s.pending) == 0 {
+		return Message{}, next, false
+	}
+	msg := s.pending[0]
+	s.pending = s.pending[1:]
+	msg.Deliveries++
+	s.inflight[msg.ID] = msg
+	if len(s.pending) > 0 {
+		// Wake up the next reader, the signal consumed by this one may have
+		// been the only one sent.
+		s.signal()
+	}
+	return msg, time.Time{}, true
+}
+
+// promote moves the delayed messages due at now to the pending messages and
+// returns when the next one is due. It must be called with mu held.
+func (s *memoryStore) promote(now time.Time) time.Time {
+	var next time.Time
+	delayed := s.delayed[:0]
+	for _, d := range s.delayed {
+		if !d.at.After(now) {
+			s.pending = append(s.pending, d.Message)
+			s.enqueued[d.ID] = d.at
+			continue
+		}
+		if next.IsZero() || d.at.Before(next) {
+			next = d.at
+		}
+		delayed = append(delayed, d)
+	}
+	s.delayed = delayed
+	return next
+}
+
+// take removes and returns an in-flight message.
+func (s *memoryStore) take(id string) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg, ok := s.inflight[id]
+	if !ok {
+		return Message{}, fmt.Errorf("unknown message %q", id)
+	}
+	delete(s.inflight, id)
+	delete(s.enqueued, id)
+	return msg, nil
+}
+
+func (s *memoryStore) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	cfg := MemoryConfig{MemoryQueueName: t.Name(), MemoryReadTimeout: 10 * time.Millisecond}
+	producer, consumer := NewMemory(cfg), NewMemory(cfg)
+
+	if msgs, err := consumer.Dequeue(ctx); err != nil || len(msgs) != 0 {
+		t.Fatalf("Dequeue() on empty queue = %v, %v, want no messages", msgs, err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		if err := producer.Enqueue(ctx, id, []byte("request "+id)); err != nil {
+			t.Fatalf("Enqueue(%q) = %v", id, err)
+		}
+	}
+
+	dequeue := func() Message {
+		t.Helper()
+		msgs, err := consumer.Dequeue(ctx)
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("Dequeue() = %v, %v, want one message", msgs, err)
+		}
+		return msgs[0]
+	}
+	if msg := dequeue(); msg.ID != "1" || string(msg.Data) != "request 1" {
+		t.Errorf("Dequeue() = %+v, want request 1", msg)
+	} else if err := consumer.Ack(ctx, msg); err != nil {
+		t.Error("Ack() =", err)
+	}
+	if msg := dequeue(); msg.ID != "2" {
+		t.Errorf("Dequeue() = %+v, want request 2", msg)
+	} else if err := consumer.DeadLetter(ctx, msg, "bad request"); err != nil {
+		t.Error("DeadLetter() =", err)
+	}
+	if err := consumer.Ack(ctx, Message{ID: "2"}); err == nil {
+		t.Error("Ack() of a dead-lettered message succeeded")
+	}
+
+	// Closing with request 3 in flight makes it available again.
+	dequeue()
+	consumer.Close()
+	if msg := dequeue(); msg.ID != "3" {
+		t.Errorf("Dequeue() after Close = %+v, want request 3", msg)
+	}
+
+	got := producer.DeadLetters()
+	if len(got) != 1 || got[0].ID != "2" || got[0].Reason != "bad request" {
+		t.Errorf("DeadLetters() = %+v, want request 2", got)
+	}
+}
+
+func TestMemoryDequeueWaits(t *testing.T) {
+	ctx := context.Background()
+	cfg := MemoryConfig{MemoryQueueName: t.Name(), MemoryReadTimeout: time.Minute}
+	q := NewMemory(cfg)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Enqueue(ctx, "1", nil)
+	}()
+	msgs, err := q.Dequeue(ctx)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Dequeue() = %v, %v, want one message", msgs, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := q.Dequeue(ctx); err != context.Canceled {
+		t.Errorf("Dequeue() with canceled context = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestMemoryDelay(t *testing.T) {
+	ctx := context.Background()
+	cfg := MemoryConfig{MemoryQueueName: t.Name(), MemoryReadTimeout: time.Minute}
+	q := NewMemory(cfg)
+
+	start := time.Now()
+	if err := q.Enqueue(WithDeliverAt(ctx, start.Add(50*time.Millisecond)), "delayed", nil); err != nil {
+		t.Fatal("Enqueue() =", err)
+	}
+	if err := q.Enqueue(ctx, "now", nil); err != nil {
+		t.Fatal("Enqueue() =", err)
+	}
+	for _, want := range []string{"now", "delayed"} {
+		msgs, err := q.Dequeue(ctx)
+		if err != nil || len(msgs) != 1 || msgs[0].ID != want {
+			t.Fatalf("Dequeue() = %v, %v, want request %q", msgs, err, want)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("delayed request was delivered after %v", elapsed)
+	}
+}
+
+func TestMemoryEnqueueBatch(t *testing.T) {
+	ctx := context.Background()
+	cfg := MemoryConfig{MemoryQueueName: t.Name(), MemoryReadTimeout: 10 * time.Millisecond}
+	q := NewMemory(cfg)
+
+	if err := EnqueueBatch(ctx, q, []string{"1", "2"}, [][]byte{[]byte("request 1"), []byte("request 2")}); err != nil {
+		t.Fatal("EnqueueBatch() =", err)
+	}
+	for _, want := range []string{"1", "2"} {
+		msgs, err := q.Dequeue(ctx)
+		if err != nil || len(msgs) != 1 || msgs[0].ID != want || string(msgs[0].Data) != "request "+want {
+			t.Fatalf("Dequeue() = %v, %v, want request %s", msgs, err, want)
+		}
+	}
+
+	// Delayed batches are held back together.
+	delayed := WithDeliverAt(ctx, time.Now().Add(time.Hour))
+	if err := EnqueueBatch(delayed, q, []string{"3", "4"}, [][]byte{nil, nil}); err != nil {
+		t.Fatal("EnqueueBatch() =", err)
+	}
+	if msgs, err := q.Dequeue(ctx); err != nil || len(msgs) != 0 {
+		t.Errorf("Dequeue() = %v, %v, want no messages before the delivery time", msgs, err)
+	}
+}
+
+func TestMemoryReplay(t *testing.T) {
+	ctx := context.Background()
+	cfg := MemoryConfig{MemoryQueueName: t.Name(), MemoryReadTimeout: 10 * time.Millisecond}
+	q := NewMemory(cfg)
+
+	for _, id := range []string{"1", "2"} {
+		if err := q.Enqueue(ctx, id, []byte("request "+id)); err != nil {
+			t.Fatal("Enqueue() =", err)
+		}
+		msgs, err := q.Dequeue(ctx)
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("Dequeue() = %v, %v, want 1 message", msgs, err)
+		}
+		if err := q.DeadLetter(WithFailure(ctx, Failure{StatusCode: 500}), msgs[0], "failed"); err != nil {
+			t.Fatal("DeadLetter() =", err)
+		}
+	}
+	if dead := q.DeadLetters(); len(dead) != 2 || dead[0].Failure.StatusCode != 500 {
+		t.Fatalf("DeadLetters() = %+v, want 2 messages with their failure", dead)
+	}
+
+	// The oldest dead-lettered messages are replayed first.
+	if n, err := Replay(ctx, q, 1); err != nil || n != 1 {
+		t.Fatalf("Replay() = %d, %v, want 1", n, err)
+	}
+	// Replayed messages start counting their deliveries again.
+	msgs, err := q.Dequeue(ctx)
+	if err != nil || len(msgs) != 1 || msgs[0].ID != "1" || msgs[0].Deliveries != 1 {
+		t.Errorf("Dequeue() = %v, %v, want request 1 delivered once", msgs, err)
+	}
+	if dead := q.DeadLetters(); len(dead) != 1 || dead[0].ID != "2" {
+		t.Errorf("DeadLetters() = %+v, want request 2", dead)
+	}
+}
+
+func TestMemoryReplaySelected(t *testing.T) {
+	ctx := context.Background()
+	cfg := MemoryConfig{MemoryQueueName: fmt.Sprint(t.Name(), time.Now().UnixNano()), MemoryReadTimeout: 10 * time.Millisecond}
+	q := NewMemory(cfg)
+
+	for _, id := range []string{"1", "2", "3"} {
+		if err := q.Enqueue(ctx, id, []byte("request "+id)); err != nil {
+			t.Fatal("Enqueue() =", err)
+		}
+		msgs, err := q.Dequeue(ctx)
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("Dequeue() = %v, %v, want 1 message", msgs, err)
+		}
+		if err := q.DeadLetter(ctx, msgs[0], "failed"); err != nil {
+			t.Fatal("DeadLetter() =", err)
+		}
+	}
+
+	// Only the selected requests are replayed, with the records returned.
+	ctx = WithReplayFunc(ctx, func(data []byte) ([]byte, bool) {
+		return append(data, " replayed"...), string(data) != "request 1"
+	})
+	if n, err := Replay(ctx, q, 10); err != nil || n != 2 {
+		t.Fatalf("Replay() = %d, %v, want 2", n, err)
+	}
+	for _, want := range []string{"request 2 replayed", "request 3 replayed"} {
+		msgs, err := q.Dequeue(ctx)
+		if err != nil || len(msgs) != 1 || string(msgs[0].Data) != want {
+			t.Fatalf("Dequeue() = %v, %v, want %q", msgs, err, want)
+		}
+		if err := q.Ack(ctx, msgs[0]); err != nil {
+			t.Fatal("Ack() =", err)
+		}
+	}
+	if dead := q.DeadLetters(); len(dead) != 1 || dead[0].ID != "1" {
+		t.Errorf("DeadLetters() = %+v, want request 1", dead)
+	}
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	trimmedEntries = stats.Int64("queue_trimmed_entries", "Number of entries removed from a stream by trimming", stats.UnitDimensionless)
+	claimedEntries = stats.Int64("queue_claimed_entries", "Number of pending entries of a stream claimed from idle consumers", stats.UnitDimensionless)
+
+	streamKey = tag.MustNewKey("stream")
+)
+
+// Views are the views of the queue metrics, to be registered by the
+// components exporting them.
+var Views = []*view.View{{
+	Description: trimmedEntries.Description(),
+	Measure:     trimmedEntries,
+	Aggregation: view.Sum(),
+	TagKeys:     []tag.Key{streamKey},
+}, {
+	Description: claimedEntries.Description(),
+	Measure:     claimedEntries,
+	Aggregation: view.Sum(),
+	TagKeys:     []tag.Key{streamKey},
+}}
+
+// recordTrimmed records that n entries were trimmed from stream.
+func recordTrimmed(stream string, n int64) {
+	stats.RecordWithTags(context.Background(), []tag.Mutator{tag.Upsert(streamKey, stream)}, trimmedEntries.M(n))
+}
+
+// recordClaimed records that n pending entries of stream were claimed.
+func recordClaimed(stream string, n int64) {
+	stats.RecordWithTags(context.Background(), []tag.Mutator{tag.Upsert(streamKey, stream)}, claimedEntries.M(n))
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// PendingMessage is a request of a queue that is not acked yet.
+type PendingMessage struct {
+	Message
+	// InFlight reports that a consumer read the request and is delivering
+	// it. Deliveries counts the reads of in-flight requests only.
+	InFlight bool
+	// Enqueued is when the request was enqueued, zero when unknown.
+	Enqueued time.Time
+}
+
+// ErrListNotSupported is returned by ListPending for backends that cannot
+// list the requests they hold.
+var ErrListNotSupported = errors.New("listing requests is not supported by this queue backend")
+
+// PendingLister is implemented by backends that can list their backlog.
+type PendingLister interface {
+	// Pending returns up to max of the requests of the queue that are not
+	// acked yet, in-flight ones first. Dead-lettered requests and those
+	// delayed to a later time are not listed.
+	Pending(ctx context.Context, max int) ([]PendingMessage, error)
+}
+
+// ListPending returns up to max of the requests of q that are not acked yet
+// if its backend supports it, and ErrListNotSupported otherwise.
+func ListPending(ctx context.Context, q Queue, max int) ([]PendingMessage, error) {
+	if l, ok := q.(PendingLister); ok {
+		return l.Pending(ctx, max)
+	}
+	return nil, ErrListNotSupported
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+)
+
+// pendingReporter answers the pending script with the entries of each
+// stream, recording how many were asked for.
+type pendingReporter struct {
+	redis.Cmdable
+	entries map[string][]interface{}
+	max     []interface{}
+}
+
+func (f *pendingReporter) EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *redis.Cmd {
+	f.max = append(f.max, args[1])
+	return redis.NewCmdResult(f.entries[keys[0]], nil)
+}
+
+func TestRedisPending(t *testing.T) {
+	client := &pendingReporter{entries: map[string][]interface{}{
+		"requests": {
+			[]interface{}{"1614592800000-0", "request 1", int64(1), int64(2)},
+			[]interface{}{"1614592860000-0", "request 2", int64(0), int64(0)},
+		},
+		"requests-2": {
+			[]interface{}{"1614592920000-0", "request 3", int64(0), int64(0)},
+		},
+	}}
+	s, err := NewShardedFromClient(client, RedisConfig{
+		StreamName:  "requests",
+		ShardConfig: ShardConfig{RedisShards: 3, RedisShardBy: ShardByHost},
+	})
+	if err != nil {
+		t.Fatal("NewShardedFromClient() =", err)
+	}
+	at := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	got, err := ListPending(context.Background(), s, 3)
+	if err != nil {
+		t.Fatal("ListPending() =", err)
+	}
+	want := []PendingMessage{{
+		Message:  Message{ID: "1614592800000-0", Data: []byte("request 1"), Deliveries: 2},
+		InFlight: true,
+		Enqueued: at,
+	}, {
+		Message:  Message{ID: "1614592860000-0", Data: []byte("request 2")},
+		Enqueued: at.Add(time.Minute),
+	}, {
+		Message:  Message{ID: "1614592920000-0", Data: []byte("request 3")},
+		Enqueued: at.Add(2 * time.Minute),
+	}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("ListPending() (-want, +got):", diff)
+	}
+	// The shards are asked for what the previous ones left.
+	if diff := cmp.Diff([]interface{}{3, 1, 1}, client.max); diff != "" {
+		t.Error("Pending script max (-want, +got):", diff)
+	}
+}
+
+func TestMemoryPending(t *testing.T) {
+	ctx := context.Background()
+	q := NewMemory(MemoryConfig{MemoryQueueName: fmt.Sprint(t.Name(), time.Now().UnixNano()), MemoryReadTimeout: time.Second})
+	for _, id := range []string{"1", "2", "3"} {
+		if err := q.Enqueue(ctx, id, []byte("request "+id)); err != nil {
+			t.Fatal("Enqueue() =", err)
+		}
+	}
+	if err := q.Enqueue(WithDeliverAt(ctx, time.Now().Add(time.Hour)), "later", nil); err != nil {
+		t.Fatal("Enqueue() =", err)
+	}
+	if msgs, err := q.Dequeue(ctx); err != nil || len(msgs) != 1 {
+		t.Fatalf("Dequeue() = %v, %v, want 1 message", msgs, err)
+	}
+
+	got, err := ListPending(ctx, q, 2)
+	if err != nil {
+		t.Fatal("ListPending() =", err)
+	}
+	want := []PendingMessage{
+		{Message: Message{ID: "1", Data: []byte("request 1"), Deliveries: 1}, InFlight: true},
+		{Message: Message{ID: "2", Data: []byte("request 2")}},
+	}
+	for i := range got {
+		if got[i].Enqueued.IsZero() {
+			t.Errorf("request %s has no enqueue time", got[i].ID)
+		}
+		got[i].Enqueued = time.Time{}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("ListPending() (-want, +got):", diff)
+	}
+}
+
+func TestListPendingNotSupported(t *testing.T) {
+	c := &Channel{}
+	if _, err := ListPending(context.Background(), c, 10); !errors.Is(err, ErrListNotSupported) {
+		t.Errorf("ListPending() = %v, want %v", err, ErrListNotSupported)
+	}
+}
@@ -0,0 +1,376 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PostgresConfig holds the environment configuration of the PostgreSQL
+// backend. POSTGRES_URL is a lib/pq connection string or URL.
+type PostgresConfig struct {
+	PostgresURL          string        `envconfig:"POSTGRES_URL"`
+	PostgresTable        string        `envconfig:"POSTGRES_TABLE" default:"async_requests"`
+	PostgresPollInterval time.Duration `envconfig:"POSTGRES_POLL_INTERVAL" default:"1s"`
+	PostgresReadTimeout  time.Duration `envconfig:"POSTGRES_READ_TIMEOUT" default:"5s"`
+}
+
+// postgresMigrations are applied in order on startup, each at most once. The
+// table name is substituted for %[1]s. Never edit a released migration,
+// append a new one instead.
+var postgresMigrations = []string{
+	`CREATE TABLE %[1]s (
+		seq BIGSERIAL PRIMARY KEY,
+		id TEXT NOT NULL UNIQUE,
+		data BYTEA NOT NULL,
+		enqueued_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		dead_lettered_at TIMESTAMPTZ,
+		dead_letter_reason TEXT
+	)`,
+	`CREATE INDEX ON %[1]s (seq) WHERE dead_lettered_at IS NULL`,
+	`ALTER TABLE %[1]s ADD COLUMN deliver_at TIMESTAMPTZ`,
+	`ALTER TABLE %[1]s
+		ADD COLUMN dead_letter_status INT,
+		ADD COLUMN dead_letter_attempts INT,
+		ADD COLUMN first_attempt_at TIMESTAMPTZ,
+		ADD COLUMN last_attempt_at TIMESTAMPTZ`,
+}
+
+// Postgres is a Queue backed by a PostgreSQL table. A dequeued row stays
+// locked by an open transaction until it is acked, so concurrent consumers
+// skip it and it becomes available again if the consumer dies. Dead-lettered
+// rows are kept in the table with the reason they failed.
+type Postgres struct {
+	cfg   PostgresConfig
+	db    *sql.DB
+	table string
+
+	mu       sync.Mutex
+	inflight map[string]*sql.Tx
+}
+
+var (
+	_ Queue         = (*Postgres)(nil)
+	_ HealthChecker = (*Postgres)(nil)
+	_ BatchEnqueuer = (*Postgres)(nil)
+	_ Replayer      = (*Postgres)(nil)
+	_ BacklogReader = (*Postgres)(nil)
+)
+
+// NewPostgres connects to the database described by cfg and migrates the
+// request table to the latest schema.
+func NewPostgres(ctx context.Context, cfg PostgresConfig) (*Postgres, error) {
+	if cfg.PostgresURL == "" {
+		return nil, errors.New("POSTGRES_URL must be set")
+	}
+	db, err := sql.Open("postgres", cfg.PostgresURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open postgres connection: %w", err)
+	}
+	p := newPostgresFromDB(db, cfg)
+	if err := p.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// newPostgresFromDB returns a Postgres storing the requests in db.
+func newPostgresFromDB(db *sql.DB, cfg PostgresConfig) *Postgres {
+	return &Postgres{
+		cfg:      cfg,
+		db:       db,
+		table:    pq.QuoteIdentifier(cfg.PostgresTable),
+		inflight: make(map[string]*sql.Tx),
+	}
+}
+
+// Enqueue implements Queue. Rows with a delivery time, see WithDeliverAt, are
+// skipped by Dequeue until then.
+func (p *Postgres) Enqueue(ctx context.Context, id string, data []byte) error {
+	at := DeliverAtFrom(ctx)
+	deliverAt := sql.NullTime{Time: at, Valid: !at.IsZero()}
+	if _, err := p.db.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (id, data, deliver_at) VALUES ($1, $2, $3)`, p.table), id, data, deliverAt); err != nil {
+		return fmt.Errorf("failed to publish %q: %w", id, err)
+	}
+	return nil
+}
+
+// EnqueueBatch implements BatchEnqueuer, inserting the rows in a
+// transaction.
+func (p *Postgres) EnqueueBatch(ctx context.Context, ids []string, data [][]byte) error {
+	at := DeliverAtFrom(ctx)
+	deliverAt := sql.NullTime{Time: at, Valid: !at.IsZero()}
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	for i, id := range ids {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (id, data, deliver_at) VALUES ($1, $2, $3)`, p.table), id, data[i], deliverAt); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to publish %q: %w", id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to publish a batch of %d requests: %w", len(ids), err)
+	}
+	return nil
+}
+
+// Dequeue implements Queue by polling every POSTGRES_POLL_INTERVAL for the
+// oldest row not locked by another consumer.
+func (p *Postgres) Dequeue(ctx context.Context) ([]Message, error) {
+	deadline := time.Now().Add(p.cfg.PostgresReadTimeout)
+	for {
+		msg, ok, err := p.lockNext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return []Message{msg}, nil
+		}
+		if time.Now().Add(p.cfg.PostgresPollInterval).After(deadline) {
+			return nil, nil
+		}
+		select {
+		case <-time.After(p.cfg.PostgresPollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Ack implements Queue by deleting the row.
+func (p *Postgres) Ack(ctx context.Context, msg Message) error {
+	return p.settle(ctx, msg.ID, `DELETE FROM %s WHERE id = $1`, msg.ID)
+}
+
+// DeadLetter implements Queue by marking the row as dead-lettered, along
+// with the failure set with WithFailure.
+func (p *Postgres) DeadLetter(ctx context.Context, msg Message, reason string) error {
+	f := FailureFrom(ctx)
+	return p.settle(ctx, msg.ID, `UPDATE %s SET dead_lettered_at = now(), dead_letter_reason = $2,
+		dead_letter_status = $3, dead_letter_attempts = $4, first_attempt_at = $5, last_attempt_at = $6
+		WHERE id = $1`,
+		msg.ID, reason,
+		sql.NullInt64{Int64: int64(f.StatusCode), Valid: f.StatusCode != 0},
+		sql.NullInt64{Int64: int64(f.Attempts), Valid: f.Attempts != 0},
+		sql.NullTime{Time: f.FirstAttempt, Valid: !f.FirstAttempt.IsZero()},
+		sql.NullTime{Time: f.LastAttempt, Valid: !f.LastAttempt.IsZero()})
+}
+
+// postgresReplaySet clears the dead-letter columns of replayed rows.
+const postgresReplaySet = `dead_lettered_at = NULL, dead_letter_reason = NULL,
+		dead_letter_status = NULL, dead_letter_attempts = NULL, first_attempt_at = NULL, last_attempt_at = NULL`
+
+// postgresReplayCount is the most dead-lettered rows read at once when they
+// are selected by a ReplayFunc.
+const postgresReplayCount = 100
+
+// Replay implements Replayer by clearing the dead-letter columns of the
+// oldest dead-lettered rows, or of those selected by the ReplayFunc of ctx.
+func (p *Postgres) Replay(ctx context.Context, max int) (int, error) {
+	if fn := ReplayFuncFrom(ctx); fn != nil {
+		return p.replaySelected(ctx, max, fn)
+	}
+	res, err := p.db.ExecContext(ctx, fmt.Sprintf(`UPDATE %[1]s SET %[2]s
+		WHERE seq IN (SELECT seq FROM %[1]s WHERE dead_lettered_at IS NOT NULL ORDER BY seq LIMIT $1 FOR UPDATE SKIP LOCKED)`, p.table, postgresReplaySet), max)
+	if err != nil {
+		return 0, fmt.Errorf("failed to replay dead-lettered requests: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to replay dead-lettered requests: %w", err)
+	}
+	return int(n), nil
+}
+
+// replaySelected goes through the dead-lettered rows in order, replaying up
+// to max of those fn selects with the data it returns.
+func (p *Postgres) replaySelected(ctx context.Context, max int, fn ReplayFunc) (int, error) {
+	type row struct {
+		seq  int64
+		data []byte
+	}
+	replayed := 0
+	var after int64
+	for replayed < max {
+		rows, err := p.db.QueryContext(ctx, fmt.Sprintf(`SELECT seq, data FROM %s
+			WHERE dead_lettered_at IS NOT NULL AND seq > $1 ORDER BY seq LIMIT $2`, p.table), after, postgresReplayCount)
+		if err != nil {
+			return replayed, fmt.Errorf("failed to read dead-lettered requests: %w", err)
+		}
+		var page []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.seq, &r.data); err != nil {
+				rows.Close()
+				return replayed, fmt.Errorf("failed to read dead-lettered requests: %w", err)
+			}
+			page = append(page, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return replayed, fmt.Errorf("failed to read dead-lettered requests: %w", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, r := range page {
+			if replayed == max {
+				break
+			}
+			after = r.seq
+			data, ok := fn(r.data)
+			if !ok {
+				continue
+			}
+			// Rows replayed by another consumer in the meantime are left alone.
+			res, err := p.db.ExecContext(ctx, fmt.Sprintf(`UPDATE %s SET data = $2, %s
+				WHERE seq = $1 AND dead_lettered_at IS NOT NULL`, p.table, postgresReplaySet), r.seq, data)
+			if err != nil {
+				return replayed, fmt.Errorf("failed to replay dead-lettered request: %w", err)
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return replayed, fmt.Errorf("failed to replay dead-lettered request: %w", err)
+			}
+			replayed += int(n)
+		}
+	}
+	return replayed, nil
+}
+
+// Backlog implements BacklogReader by counting the rows that are due and not
+// dead-lettered. Delayed rows count from their delivery time.
+func (p *Postgres) Backlog(ctx context.Context) (Backlog, error) {
+	var (
+		b      Backlog
+		oldest sql.NullTime
+	)
+	err := p.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT count(*), min(COALESCE(deliver_at, enqueued_at)) FROM %s
+		WHERE dead_lettered_at IS NULL AND (deliver_at IS NULL OR deliver_at <= now())`, p.table)).Scan(&b.Depth, &oldest)
+	if err != nil {
+		return Backlog{}, fmt.Errorf("failed to read the backlog of %s: %w", p.table, err)
+	}
+	if oldest.Valid {
+		b.Oldest = oldest.Time
+	}
+	return b, nil
+}
+
+// Close implements Queue. Rows still in flight are unlocked.
+func (p *Postgres) Close() error {
+	p.mu.Lock()
+	for id, tx := range p.inflight {
+		tx.Rollback()
+		delete(p.inflight, id)
+	}
+	p.mu.Unlock()
+	return p.db.Close()
+}
+
+// CheckHealth implements HealthChecker.
+func (p *Postgres) CheckHealth(ctx context.Context, consuming bool) error {
+	if err := p.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("failed to reach postgres: %w", err)
+	}
+	return nil
+}
+
+// lockNext locks the oldest available row in a new transaction.
+func (p *Postgres) lockNext(ctx context.Context) (Message, bool, error) {
+	// The transaction outlives ctx, it is only ended by Ack or DeadLetter.
+	tx, err := p.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return Message{}, false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	var msg Message
+	err = tx.QueryRowContext(ctx, fmt.Sprintf(`SELECT id, data FROM %s
+		WHERE dead_lettered_at IS NULL AND (deliver_at IS NULL OR deliver_at <= now())
+		ORDER BY seq
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED`, p.table)).Scan(&msg.ID, &msg.Data)
+	if err != nil {
+		tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return Message{}, false, nil
+		}
+		return Message{}, false, fmt.Errorf("failed to read from %s: %w", p.table, err)
+	}
+	p.mu.Lock()
+	p.inflight[msg.ID] = tx
+	p.mu.Unlock()
+	return msg, true, nil
+}
+
+// settle runs query, formatted with the table name, in the transaction of the
+// in-flight message id and commits it.
+func (p *Postgres) settle(ctx context.Context, id, query string, args ...interface{}) error {
+	p.mu.Lock()
+	tx, ok := p.inflight[id]
+	delete(p.inflight, id)
+	p.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown message %q", id)
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(query, p.table), args...); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to update %q: %w", id, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit %q: %w", id, err)
+	}
+	return nil
+}
+
+// migrate applies the migrations missing from the database. An advisory lock
+// keeps replicas starting at the same time from racing each other.
+func (p *Postgres) migrate(ctx context.Context) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin migration: %w", err)
+	}
+	defer tx.Rollback()
+	migrations := pq.QuoteIdentifier(p.cfg.PostgresTable + "_migrations")
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, migrations); err != nil {
+		return fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (version INT PRIMARY KEY)`, migrations)); err != nil {
+		return fmt.Errorf("failed to create %s: %w", migrations, err)
+	}
+	var version int
+	if err := tx.QueryRowContext(ctx, fmt.Sprintf(`SELECT COALESCE(MAX(version), 0) FROM %s`, migrations)).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	for i := version; i < len(postgresMigrations); i++ {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(postgresMigrations[i], p.table)); err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (version) VALUES ($1)`, migrations), i+1); err != nil {
+			return fmt.Errorf("failed to record migration %d: %w", i+1, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migrations: %w", err)
+	}
+	return nil
+}
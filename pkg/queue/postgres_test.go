@@ -0,0 +1,246 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func newTestPostgres(t *testing.T) (*Postgres, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal("sqlmock.New() =", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return newPostgresFromDB(db, PostgresConfig{
+		PostgresTable:        "requests",
+		PostgresPollInterval: time.Millisecond,
+		PostgresReadTimeout:  10 * time.Millisecond,
+	}), mock
+}
+
+// postgresSQL matches a statement containing each of fragments, in order.
+func postgresSQL(fragments ...string) string {
+	quoted := make([]string, len(fragments))
+	for i, f := range fragments {
+		quoted[i] = regexp.QuoteMeta(f)
+	}
+	return strings.Join(quoted, `(?s:.*)`)
+}
+
+func expectLockNext(mock sqlmock.Sqlmock) *sqlmock.ExpectedQuery {
+	mock.ExpectBegin()
+	return mock.ExpectQuery(postgresSQL(`SELECT id, data FROM "requests"`,
+		`WHERE dead_lettered_at IS NULL AND (deliver_at IS NULL OR deliver_at <= now())`,
+		`ORDER BY seq`, `LIMIT 1`, `FOR UPDATE SKIP LOCKED`))
+}
+
+func TestPostgresMigrate(t *testing.T) {
+	for _, version := range []int{0, 2, len(postgresMigrations)} {
+		t.Run(fmt.Sprint("from version ", version), func(t *testing.T) {
+			p, mock := newTestPostgres(t)
+			mock.ExpectBegin()
+			mock.ExpectExec(postgresSQL(`SELECT pg_advisory_xact_lock(hashtext($1))`)).
+				WithArgs(`"requests_migrations"`).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(postgresSQL(`CREATE TABLE IF NOT EXISTS "requests_migrations" (version INT PRIMARY KEY)`)).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(postgresSQL(`SELECT COALESCE(MAX(version), 0) FROM "requests_migrations"`)).
+				WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(version))
+			for i := version; i < len(postgresMigrations); i++ {
+				mock.ExpectExec(regexp.QuoteMeta(fmt.Sprintf(postgresMigrations[i], `"requests"`))).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(postgresSQL(`INSERT INTO "requests_migrations" (version) VALUES ($1)`)).
+					WithArgs(i + 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			mock.ExpectCommit()
+
+			if err := p.migrate(context.Background()); err != nil {
+				t.Fatal("migrate() =", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestPostgresMigrateFailure(t *testing.T) {
+	p, mock := newTestPostgres(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(postgresSQL(`pg_advisory_xact_lock`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(postgresSQL(`CREATE TABLE IF NOT EXISTS`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(postgresSQL(`SELECT COALESCE(MAX(version), 0)`)).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(0))
+	mock.ExpectExec(regexp.QuoteMeta(fmt.Sprintf(postgresMigrations[0], `"requests"`))).
+		WillReturnError(errors.New("permission denied"))
+	mock.ExpectRollback()
+
+	if err := p.migrate(context.Background()); err == nil {
+		t.Fatal("migrate() = nil, want the migration error")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostgresEnqueue(t *testing.T) {
+	at := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		deliverAt interface{}
+	}{{
+		name: "now",
+		ctx:  context.Background(),
+	}, {
+		name:      "delayed",
+		ctx:       WithDeliverAt(context.Background(), at),
+		deliverAt: at,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, mock := newTestPostgres(t)
+			mock.ExpectExec(postgresSQL(`INSERT INTO "requests" (id, data, deliver_at) VALUES ($1, $2, $3)`)).
+				WithArgs("id", []byte("data"), tt.deliverAt).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+
+			if err := p.Enqueue(tt.ctx, "id", []byte("data")); err != nil {
+				t.Fatal("Enqueue() =", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestPostgresDequeueAck(t *testing.T) {
+	p, mock := newTestPostgres(t)
+	expectLockNext(mock).WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).AddRow("id", []byte("data")))
+	mock.ExpectExec(postgresSQL(`DELETE FROM "requests" WHERE id = $1`)).
+		WithArgs("id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	ctx := context.Background()
+	msgs, err := p.Dequeue(ctx)
+	if err != nil {
+		t.Fatal("Dequeue() =", err)
+	}
+	if len(msgs) != 1 || msgs[0].ID != "id" || string(msgs[0].Data) != "data" {
+		t.Fatalf("Dequeue() = %+v, want id with data", msgs)
+	}
+	if err := p.Ack(ctx, msgs[0]); err != nil {
+		t.Fatal("Ack() =", err)
+	}
+	if err := p.Ack(ctx, msgs[0]); err == nil {
+		t.Error("second Ack() = nil, want an unknown message error")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostgresDequeueEmpty(t *testing.T) {
+	p, mock := newTestPostgres(t)
+	// Polling once only.
+	p.cfg.PostgresPollInterval = p.cfg.PostgresReadTimeout
+	expectLockNext(mock).WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	msgs, err := p.Dequeue(context.Background())
+	if err != nil || len(msgs) != 0 {
+		t.Errorf("Dequeue() = %v, %v, want nothing", msgs, err)
+	}
+	if len(p.inflight) != 0 {
+		t.Errorf("%d transactions in flight, want none", len(p.inflight))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostgresDeadLetter(t *testing.T) {
+	first := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	last := first.Add(time.Minute)
+	tests := []struct {
+		name    string
+		failure Failure
+		args    []driver.Value
+	}{{
+		name:    "with failure",
+		failure: Failure{StatusCode: 503, Attempts: 3, FirstAttempt: first, LastAttempt: last},
+		args:    []driver.Value{"id", "too many attempts", int64(503), int64(3), first, last},
+	}, {
+		name: "without failure",
+		args: []driver.Value{"id", "too many attempts", nil, nil, nil, nil},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, mock := newTestPostgres(t)
+			expectLockNext(mock).WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).AddRow("id", []byte("data")))
+			mock.ExpectExec(postgresSQL(`UPDATE "requests" SET dead_lettered_at = now(), dead_letter_reason = $2`,
+				`dead_letter_status = $3, dead_letter_attempts = $4, first_attempt_at = $5, last_attempt_at = $6`,
+				`WHERE id = $1`)).
+				WithArgs(tt.args...).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			msgs, err := p.Dequeue(context.Background())
+			if err != nil || len(msgs) != 1 {
+				t.Fatalf("Dequeue() = %v, %v, want one message", msgs, err)
+			}
+			ctx := WithFailure(context.Background(), tt.failure)
+			if err := p.DeadLetter(ctx, msgs[0], "too many attempts"); err != nil {
+				t.Fatal("DeadLetter() =", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestPostgresSettleFailure(t *testing.T) {
+	p, mock := newTestPostgres(t)
+	expectLockNext(mock).WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).AddRow("id", []byte("data")))
+	mock.ExpectExec(postgresSQL(`DELETE FROM "requests"`)).
+		WithArgs("id").
+		WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	msgs, err := p.Dequeue(context.Background())
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Dequeue() = %v, %v, want one message", msgs, err)
+	}
+	if err := p.Ack(context.Background(), msgs[0]); err == nil {
+		t.Error("Ack() = nil, want the delete error")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,430 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Priority is the priority level of a request.
+type Priority string
+
+const (
+	// PriorityHigh requests are dequeued before the others.
+	PriorityHigh Priority = "high"
+	// PriorityNormal is the priority of requests that don't ask for one.
+	PriorityNormal Priority = "normal"
+	// PriorityLow requests are dequeued after the others.
+	PriorityLow Priority = "low"
+)
+
+// Priorities are the priority levels, from highest to lowest.
+var Priorities = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+// ParsePriority returns the priority level called s.
+func ParsePriority(s string) (Priority, error) {
+	for _, p := range Priorities {
+		if strings.EqualFold(s, string(p)) {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown priority %q", s)
+}
+
+// Cap returns p, lowered to max if it is higher.
+func (p Priority) Cap(max Priority) Priority {
+	if p.rank() < max.rank() {
+		return max
+	}
+	return p
+}
+
+// rank orders priorities, the highest being 0.
+func (p Priority) rank() int {
+	for i, l := range Priorities {
+		if p == l {
+			return i
+		}
+	}
+	return PriorityNormal.rank()
+}
+
+// PriorityConfig enables priority levels. Each level is stored in its own
+// queue, named after the configured one with a "-high" or "-low" suffix, and
+// the consumer dequeues from the levels in proportion to their weights.
+type PriorityConfig struct {
+	PriorityQueues      bool           `envconfig:"PRIORITY_QUEUES"`
+	PriorityWeights     map[string]int `envconfig:"PRIORITY_WEIGHTS" default:"high:6,normal:3,low:1"`
+	PriorityReadTimeout time.Duration  `envconfig:"PRIORITY_READ_TIMEOUT" default:"5s"`
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a context asking for requests enqueued with it to be
+// stored at priority p. It is ignored unless priority levels are enabled.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFrom returns the priority set on ctx, PriorityNormal by default.
+func PriorityFrom(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+	return PriorityNormal
+}
+
+// Prioritized is a Queue storing each priority level in a separate queue of
+// the same backend. Every level is read in the background, one message at a
+// time, and Dequeue picks among the levels having a message by smooth
+// weighted round-robin, so low priority requests are not starved.
+type Prioritized struct {
+	timeout time.Duration
+	levels  []*priorityLevel
+
+	mu sync.Mutex
+	// current holds the smooth weighted round-robin state of each level.
+	current []int
+
+	start  sync.Once
+	cancel context.CancelFunc
+	errs   chan error
+}
+
+type priorityLevel struct {
+	priority Priority
+	queue    Queue
+	weight   int
+	messages chan Message
+}
+
+var (
+	_ Queue         = (*Prioritized)(nil)
+	_ HealthChecker = (*Prioritized)(nil)
+	_ BatchEnqueuer = (*Prioritized)(nil)
+	_ Replayer      = (*Prioritized)(nil)
+	_ BacklogReader = (*Prioritized)(nil)
+	_ DelayedLister = (*Prioritized)(nil)
+)
+
+// NewPrioritized creates a queue of the backend described by cfg for every
+// priority level.
+func NewPrioritized(ctx context.Context, cfg Config) (*Prioritized, error) {
+	p := &Prioritized{
+		timeout: cfg.PriorityReadTimeout,
+		current: make([]int, len(Priorities)),
+		errs:    make(chan error),
+	}
+	for _, priority := range Priorities {
+		weight := cfg.PriorityWeights[string(priority)]
+		if weight <= 0 {
+			p.closeLevels()
+			return nil, fmt.Errorf("priority %q must have a positive weight", priority)
+		}
+		levelCfg, err := cfg.forPriority(priority)
+		if err != nil {
+			p.closeLevels()
+			return nil, err
+		}
+		q, err := newBackend(ctx, levelCfg)
+		if err != nil {
+			p.closeLevels()
+			return nil, fmt.Errorf("failed to create %s priority queue: %w", priority, err)
+		}
+		p.levels = append(p.levels, &priorityLevel{
+			priority: priority,
+			queue:    q,
+			weight:   weight,
+			messages: make(chan Message),
+		})
+	}
+	return p, nil
+}
+
+// Enqueue implements Queue by storing data in the queue of the priority set
+// on ctx, see WithPriority.
+func (p *Prioritized) Enqueue(ctx context.Context, id string, data []byte) error {
+	return p.level(PriorityFrom(ctx)).queue.Enqueue(ctx, id, data)
+}
+
+// EnqueueBatch implements BatchEnqueuer if the queues of the priorities do.
+func (p *Prioritized) EnqueueBatch(ctx context.Context, ids []string, data [][]byte) error {
+	return EnqueueBatch(ctx, p.level(PriorityFrom(ctx)).queue, ids, data)
+}
+
+// Dequeue implements Queue.
+func (p *Prioritized) Dequeue(ctx context.Context) ([]Message, error) {
+	p.start.Do(p.fetch)
+	// Take a message of the level whose turn it is, or of any other level
+	// with a message waiting.
+	for _, l := range p.order() {
+		select {
+		case msg := <-l.messages:
+			return []Message{msg}, nil
+		default:
+		}
+	}
+	timeout := time.NewTimer(p.timeout)
+	defer timeout.Stop()
+	select {
+	case msg := <-p.levels[0].messages:
+		return []Message{msg}, nil
+	case msg := <-p.levels[1].messages:
+		return []Message{msg}, nil
+	case msg := <-p.levels[2].messages:
+		return []Message{msg}, nil
+	case err := <-p.errs:
+		return nil, err
+	case <-timeout.C:
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Ack implements Queue.
+func (p *Prioritized) Ack(ctx context.Context, msg Message) error {
+	l, msg, err := p.unwrap(msg)
+	if err != nil {
+		return err
+	}
+	return l.queue.Ack(ctx, msg)
+}
+
+// DeadLetter implements Queue using the dead-letter queue of the message's
+// priority level.
+func (p *Prioritized) DeadLetter(ctx context.Context, msg Message, reason string) error {
+	l, msg, err := p.unwrap(msg)
+	if err != nil {
+		return err
+	}
+	return l.queue.DeadLetter(ctx, msg, reason)
+}
+
+// Replay implements Replayer, emptying the dead-letter queues of the levels
+// from the highest priority down.
+func (p *Prioritized) Replay(ctx context.Context, max int) (int, error) {
+	replayed := 0
+	for _, l := range p.levels {
+		if replayed >= max {
+			break
+		}
+		n, err := Replay(ctx, l.queue, max-replayed)
+		replayed += n
+		if err != nil {
+			return replayed, fmt.Errorf("%s priority queue: %w", l.priority, err)
+		}
+	}
+	return replayed, nil
+}
+
+// Backlog implements BacklogReader, adding up the backlogs of the levels.
+func (p *Prioritized) Backlog(ctx context.Context) (Backlog, error) {
+	var b Backlog
+	for _, l := range p.levels {
+		lb, err := ReadBacklog(ctx, l.queue)
+		if err != nil {
+			return Backlog{}, fmt.Errorf("%s priority queue: %w", l.priority, err)
+		}
+		b.add(lb)
+	}
+	return b, nil
+}
+
+// Delayed implements DelayedLister, listing the levels from the highest
+// priority down. The requests are tagged with their level, see
+// MessagePriority.
+func (p *Prioritized) Delayed(ctx context.Context, max int) ([]DelayedMessage, error) {
+	var msgs []DelayedMessage
+	for _, l := range p.levels {
+		if len(msgs) >= max {
+			break
+		}
+		lm, err := ListDelayed(ctx, l.queue, max-len(msgs))
+		if errors.Is(err, ErrDelayedNotSupported) {
+			return nil, err
+		} else if err != nil {
+			return nil, fmt.Errorf("%s priority queue: %w", l.priority, err)
+		}
+		for _, msg := range lm {
+			msg.ID = string(l.priority) + ":" + msg.ID
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+// RemoveDelayed implements DelayedLister.
+func (p *Prioritized) RemoveDelayed(ctx context.Context, msg DelayedMessage) error {
+	l, m, err := p.unwrap(msg.Message)
+	if err != nil {
+		return err
+	}
+	msg.Message = m
+	return RemoveDelayed(ctx, l.queue, msg)
+}
+
+// Close implements Queue.
+func (p *Prioritized) Close() error {
+	// Stop the readers, or keep them from starting.
+	p.start.Do(func() {})
+	if p.cancel != nil {
+		p.cancel()
+	}
+	return p.closeLevels()
+}
+
+// CheckHealth implements HealthChecker by checking every level.
+func (p *Prioritized) CheckHealth(ctx context.Context, consuming bool) error {
+	for _, l := range p.levels {
+		if err := CheckHealth(ctx, l.queue, consuming); err != nil {
+			return fmt.Errorf("%s priority queue: %w", l.priority, err)
+		}
+	}
+	return nil
+}
+
+func (p *Prioritized) closeLevels() error {
+	var firstErr error
+	for _, l := range p.levels {
+		if err := l.queue.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// fetch starts reading every level in the background. Messages are tagged
+// with their level so they can be acked on the right queue.
+func (p *Prioritized) fetch() {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	for _, l := range p.levels {
+		go func(l *priorityLevel) {
+			for ctx.Err() == nil {
+				msgs, err := l.queue.Dequeue(ctx)
+				if err != nil {
+					select {
+					case p.errs <- fmt.Errorf("failed to read %s priority queue: %w", l.priority, err):
+					case <-ctx.Done():
+					}
+					continue
+				}
+				for _, msg := range msgs {
+					msg.ID = string(l.priority) + ":" + msg.ID
+					select {
+					case l.messages <- msg:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}(l)
+	}
+}
+
+// order returns the levels in the order they should be tried: the one
+// selected by smooth weighted round-robin first, then the others from highest
+// to lowest priority.
+func (p *Prioritized) order() []*priorityLevel {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	total, best := 0, 0
+	for i, l := range p.levels {
+		p.current[i] += l.weight
+		total += l.weight
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= total
+	order := []*priorityLevel{p.levels[best]}
+	for i, l := range p.levels {
+		if i != best {
+			order = append(order, l)
+		}
+	}
+	return order
+}
+
+func (p *Prioritized) level(priority Priority) *priorityLevel {
+	return p.levels[priority.rank()]
+}
+
+// unwrap returns the level of msg and the message as dequeued from it.
+func (p *Prioritized) unwrap(msg Message) (*priorityLevel, Message, error) {
+	parts := strings.SplitN(msg.ID, ":", 2)
+	if len(parts) != 2 {
+		return nil, msg, fmt.Errorf("message %q has no priority", msg.ID)
+	}
+	priority, err := ParsePriority(parts[0])
+	if err != nil {
+		return nil, msg, err
+	}
+	msg.ID = parts[1]
+	return p.level(priority), msg, nil
+}
+
+// MessagePriority returns the priority level of a message read from a
+// Prioritized queue, and false for the messages of other queues.
+func MessagePriority(msg Message) (Priority, bool) {
+	parts := strings.SplitN(msg.ID, ":", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	p, err := ParsePriority(parts[0])
+	return p, err == nil
+}
+
+// forPriority returns the configuration of the queue storing priority level
+// p. Normal priority uses the configured queue, so enabling priorities keeps
+// existing requests.
+func (cfg Config) forPriority(p Priority) (Config, error) {
+	if p == PriorityNormal {
+		return cfg, nil
+	}
+	cfg, ok := cfg.withSuffix(string(p))
+	if !ok {
+		return cfg, fmt.Errorf("priorities are not supported by the %q backend", cfg.Backend)
+	}
+	return cfg, nil
+}
+
+// withSuffix returns the configuration of the queue named after the
+// configured one with suffix s, and whether the backend supports it.
+func (cfg Config) withSuffix(s string) (Config, bool) {
+	suffix := "-" + s
+	switch cfg.Backend {
+	case BackendRedis:
+		cfg.StreamName += suffix
+	case BackendKafka:
+		cfg.KafkaTopic += suffix
+	case BackendRabbitMQ:
+		cfg.RabbitMQQueue += suffix
+	case BackendServiceBus:
+		cfg.ServiceBusQueue += suffix
+	case BackendPostgres:
+		cfg.PostgresTable += "_" + s
+	case BackendMemory:
+		cfg.MemoryQueueName += suffix
+	default:
+		return cfg, false
+	}
+	return cfg, true
+}
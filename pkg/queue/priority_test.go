@@ -0,0 +1,132 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func priorityConfig(name string) Config {
+	return Config{
+		Backend:      BackendMemory,
+		MemoryConfig: MemoryConfig{MemoryQueueName: name, MemoryReadTimeout: 10 * time.Millisecond},
+		PriorityConfig: PriorityConfig{
+			PriorityQueues:      true,
+			PriorityWeights:     map[string]int{"high": 6, "normal": 3, "low": 1},
+			PriorityReadTimeout: time.Second,
+		},
+	}
+}
+
+func TestPrioritized(t *testing.T) {
+	ctx := context.Background()
+	cfg := priorityConfig(t.Name())
+	q, err := New(ctx, cfg)
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	defer q.Close()
+
+	for _, p := range Priorities {
+		if err := q.Enqueue(WithPriority(ctx, p), string(p), nil); err != nil {
+			t.Fatalf("Enqueue(%q) = %v", p, err)
+		}
+	}
+	// Each level is stored in its own queue.
+	high := NewMemory(MemoryConfig{MemoryQueueName: t.Name() + "-high"})
+	if len(high.store.pending)+len(high.store.inflight) != 1 {
+		t.Error("high priority request was not stored in the -high queue")
+	}
+
+	got := map[string]bool{}
+	for range Priorities {
+		msgs, err := q.Dequeue(ctx)
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("Dequeue() = %v, %v, want one message", msgs, err)
+		}
+		if err := q.Ack(ctx, msgs[0]); err != nil {
+			t.Error("Ack() =", err)
+		}
+		got[msgs[0].ID] = true
+	}
+	for _, p := range Priorities {
+		if !got[string(p)+":"+string(p)] {
+			t.Errorf("request of priority %q was not dequeued, got %v", p, got)
+		}
+	}
+	if err := q.Ack(ctx, Message{ID: "123"}); err == nil {
+		t.Error("Ack() of a message without priority succeeded")
+	}
+}
+
+func TestPrioritizedOrder(t *testing.T) {
+	p, err := NewPrioritized(context.Background(), priorityConfig(t.Name()))
+	if err != nil {
+		t.Fatal("NewPrioritized() =", err)
+	}
+	defer p.Close()
+
+	got := map[Priority]int{}
+	for i := 0; i < 20; i++ {
+		got[p.order()[0].priority]++
+	}
+	want := map[Priority]int{PriorityHigh: 12, PriorityNormal: 6, PriorityLow: 2}
+	for priority, n := range want {
+		if got[priority] != n {
+			t.Errorf("%s priority was first %d times, want %d", priority, got[priority], n)
+		}
+	}
+}
+
+func TestNewPrioritizedErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+	}{{
+		name:   "unsupported backend",
+		modify: func(cfg *Config) { cfg.Backend = BackendChannel },
+	}, {
+		name:   "missing weight",
+		modify: func(cfg *Config) { delete(cfg.PriorityWeights, "low") },
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := priorityConfig(t.Name())
+			test.modify(&cfg)
+			if _, err := NewPrioritized(context.Background(), cfg); err == nil {
+				t.Error("NewPrioritized() succeeded")
+			}
+		})
+	}
+}
+
+func TestPriorityCap(t *testing.T) {
+	tests := []struct {
+		priority Priority
+		max      Priority
+		want     Priority
+	}{
+		{PriorityHigh, PriorityHigh, PriorityHigh},
+		{PriorityHigh, PriorityNormal, PriorityNormal},
+		{PriorityLow, PriorityNormal, PriorityLow},
+		{PriorityNormal, PriorityLow, PriorityLow},
+	}
+	for _, test := range tests {
+		if got := test.priority.Cap(test.max); got != test.want {
+			t.Errorf("%q.Cap(%q) = %q, want %q", test.priority, test.max, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/zap"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// The Pub/Sub message attribute holding the async request ID.
+	pubSubIDAttribute = "async-request-id"
+	// The Pub/Sub message attribute holding the dead-letter reason.
+	pubSubReasonAttribute = "async-dead-letter-reason"
+)
+
+// PubSubConfig holds the environment configuration of the Pub/Sub backend.
+type PubSubConfig struct {
+	PubSubProjectID       string        `envconfig:"PUBSUB_PROJECT_ID"`
+	PubSubTopic           string        `envconfig:"PUBSUB_TOPIC"`
+	PubSubSubscription    string        `envconfig:"PUBSUB_SUBSCRIPTION"`
+	PubSubDeadLetterTopic string        `envconfig:"PUBSUB_DEAD_LETTER_TOPIC"`
+	PubSubMaxExtension    time.Duration `envconfig:"PUBSUB_MAX_EXTENSION" default:"10m"`
+	PubSubMaxOutstanding  int           `envconfig:"PUBSUB_MAX_OUTSTANDING" default:"1"`
+	PubSubReadTimeout     time.Duration `envconfig:"PUBSUB_READ_TIMEOUT" default:"5s"`
+	PubSubMessageOrdering bool          `envconfig:"PUBSUB_MESSAGE_ORDERING" default:"true"`
+}
+
+// PubSub is a Queue backed by a Google Cloud Pub/Sub topic and subscription.
+// The client library extends the ack deadline of received messages until
+// they are acked, up to PUBSUB_MAX_EXTENSION.
+type PubSub struct {
+	cfg        PubSubConfig
+	client     *pubsub.Client
+	topic      *pubsub.Topic
+	deadLetter *pubsub.Topic
+
+	startReceive sync.Once
+	cancel       context.CancelFunc
+	messages     chan *pubsub.Message
+
+	mu       sync.Mutex
+	inflight map[string]*pubsub.Message
+}
+
+var _ Queue = (*PubSub)(nil)
+
+// NewPubSub creates a Pub/Sub client for the topic and subscription in cfg.
+func NewPubSub(ctx context.Context, cfg PubSubConfig) (*PubSub, error) {
+	if cfg.PubSubProjectID == "" || cfg.PubSubTopic == "" {
+		return nil, errors.New("PUBSUB_PROJECT_ID and PUBSUB_TOPIC must be set")
+	}
+	client, err := pubsub.NewClient(ctx, cfg.PubSubProjectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pubsub client: %w", err)
+	}
+	return newPubSubFromClient(client, cfg), nil
+}
+
+func newPubSubFromClient(client *pubsub.Client, cfg PubSubConfig) *PubSub {
+	p := &PubSub{
+		cfg:      cfg,
+		client:   client,
+		topic:    client.Topic(cfg.PubSubTopic),
+		messages: make(chan *pubsub.Message),
+		inflight: make(map[string]*pubsub.Message),
+	}
+	p.topic.EnableMessageOrdering = cfg.PubSubMessageOrdering
+	if cfg.PubSubDeadLetterTopic != "" {
+		p.deadLetter = client.Topic(cfg.PubSubDeadLetterTopic)
+	}
+	return p
+}
+
+// Enqueue implements Queue. Requests enqueued with the same ordering key, see
+// WithOrderingKey, are delivered in order when message ordering is enabled
+// on the topic and subscription.
+func (p *PubSub) Enqueue(ctx context.Context, id string, data []byte) error {
+	if err := checkNoDelay(ctx); err != nil {
+		return err
+	}
+	msg := &pubsub.Message{
+		Data:       data,
+		Attributes: map[string]string{pubSubIDAttribute: id},
+	}
+	if p.cfg.PubSubMessageOrdering {
+		msg.OrderingKey = OrderingKeyFrom(ctx)
+	}
+	if _, err := p.topic.Publish(ctx, msg).Get(ctx); err != nil {
+		if msg.OrderingKey != "" {
+			// Publishing for a key is paused after a failure until resumed.
+			p.topic.ResumePublish(msg.OrderingKey)
+		}
+		return fmt.Errorf("failed to publish %q: %w", id, err)
+	}
+	return nil
+}
+
+// Dequeue implements Queue.
+func (p *PubSub) Dequeue(ctx context.Context) ([]Message, error) {
+	if p.cfg.PubSubSubscription == "" {
+		return nil, errors.New("PUBSUB_SUBSCRIPTION must be set")
+	}
+	p.startReceive.Do(func() { p.receive(logging.FromContext(ctx)) })
+	select {
+	case m := <-p.messages:
+		p.mu.Lock()
+		p.inflight[m.ID] = m
+		p.mu.Unlock()
+		msg := Message{ID: m.ID, Data: m.Data}
+		// Delivery attempts are only counted with a dead letter policy.
+		if m.DeliveryAttempt != nil {
+			msg.Deliveries = *m.DeliveryAttempt
+		}
+		return []Message{msg}, nil
+	case <-time.After(p.cfg.PubSubReadTimeout):
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Ack implements Queue.
+func (p *PubSub) Ack(ctx context.Context, msg Message) error {
+	m, err := p.take(msg.ID)
+	if err != nil {
+		return err
+	}
+	m.Ack()
+	return nil
+}
+
+// DeadLetter implements Queue. When PUBSUB_DEAD_LETTER_TOPIC is set the
+// message is published there and acked. Otherwise it is nacked so the dead
+// letter policy of the subscription applies.
+func (p *PubSub) DeadLetter(ctx context.Context, msg Message, reason string) error {
+	m, err := p.take(msg.ID)
+	if err != nil {
+		return err
+	}
+	if p.deadLetter == nil {
+		m.Nack()
+		return nil
+	}
+	attrs := map[string]string{pubSubReasonAttribute: reason}
+	for k, v := range FailureFrom(ctx).Fields() {
+		attrs[failureHeaderPrefix+k] = v
+	}
+	for k, v := range m.Attributes {
+		attrs[k] = v
+	}
+	if _, err := p.deadLetter.Publish(ctx, &pubsub.Message{Data: m.Data, Attributes: attrs}).Get(ctx); err != nil {
+		m.Nack()
+		return fmt.Errorf("failed to dead-letter %q: %w", msg.ID, err)
+	}
+	m.Ack()
+	return nil
+}
+
+// Close implements Queue.
+func (p *PubSub) Close() error {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	p.topic.Stop()
+	if p.deadLetter != nil {
+		p.deadLetter.Stop()
+	}
+	return p.client.Close()
+}
+
+// receive starts pulling from the subscription until Close is called.
+func (p *PubSub) receive(logger *zap.SugaredLogger) {
+	sub := p.client.Subscription(p.cfg.PubSubSubscription)
+	sub.ReceiveSettings.MaxExtension = p.cfg.PubSubMaxExtension
+	sub.ReceiveSettings.MaxOutstandingMessages = p.cfg.PubSubMaxOutstanding
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	go func() {
+		for ctx.Err() == nil {
+			err := sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+				select {
+				case p.messages <- m:
+				case <-ctx.Done():
+					m.Nack()
+				}
+			})
+			if err != nil {
+				logger.Errorw("Error receiving from pubsub", zap.Error(err))
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+}
+
+// take removes and returns an in-flight message.
+func (p *PubSub) take(id string) (*pubsub.Message, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m, ok := p.inflight[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown message %q", id)
+	}
+	delete(p.inflight, id)
+	return m, nil
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func TestPubSub(t *testing.T) {
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal("Failed to dial fake server:", err)
+	}
+	client, err := pubsub.NewClient(ctx, "project", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal("Failed to create client:", err)
+	}
+	topic, err := client.CreateTopic(ctx, "requests")
+	if err != nil {
+		t.Fatal("Failed to create topic:", err)
+	}
+	if _, err := client.CreateSubscription(ctx, "async-consumer", pubsub.SubscriptionConfig{
+		Topic:                 topic,
+		EnableMessageOrdering: true,
+	}); err != nil {
+		t.Fatal("Failed to create subscription:", err)
+	}
+
+	p := newPubSubFromClient(client, PubSubConfig{
+		PubSubTopic:           "requests",
+		PubSubSubscription:    "async-consumer",
+		PubSubMaxExtension:    time.Minute,
+		PubSubMaxOutstanding:  1,
+		PubSubReadTimeout:     5 * time.Second,
+		PubSubMessageOrdering: true,
+	})
+	defer p.Close()
+
+	if err := p.Enqueue(WithOrderingKey(ctx, "key"), "123", []byte("data")); err != nil {
+		t.Fatal("Enqueue() =", err)
+	}
+	if got := srv.Messages()[0].OrderingKey; got != "key" {
+		t.Errorf("OrderingKey = %q, want %q", got, "key")
+	}
+	msgs, err := p.Dequeue(ctx)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Dequeue() = %v, %v; want one message", msgs, err)
+	}
+	if string(msgs[0].Data) != "data" {
+		t.Errorf("Data = %q, want %q", msgs[0].Data, "data")
+	}
+	if err := p.Ack(ctx, msgs[0]); err != nil {
+		t.Error("Ack() =", err)
+	}
+	if err := p.Ack(ctx, msgs[0]); err == nil {
+		t.Error("expected acking an unknown message to fail")
+	}
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+)
+
+// PurgeFunc selects the requests deleted by Purge, by their record.
+type PurgeFunc func(data []byte) bool
+
+// ErrPurgeNotSupported is returned by Purge for backends that cannot delete
+// the requests they hold.
+var ErrPurgeNotSupported = errors.New("purging requests is not supported by this queue backend")
+
+// Purger is implemented by backends that can delete the requests they hold.
+type Purger interface {
+	// Purge deletes the requests waiting for a consumer that fn selects,
+	// including delayed ones, and returns how many were deleted. Requests
+	// in flight are left to their consumer, and dead-lettered ones are not
+	// considered.
+	Purge(ctx context.Context, fn PurgeFunc) (int, error)
+}
+
+// Purge deletes the requests of q that fn selects if its backend supports it,
+// and returns ErrPurgeNotSupported otherwise.
+func Purge(ctx context.Context, q Queue, fn PurgeFunc) (int, error) {
+	if p, ok := q.(Purger); ok {
+		return p.Purge(ctx, fn)
+	}
+	return 0, ErrPurgeNotSupported
+}
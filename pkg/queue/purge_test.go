@@ -0,0 +1,191 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// selectDrop selects the requests whose record starts with "drop".
+func selectDrop(data []byte) bool {
+	return strings.HasPrefix(string(data), "drop")
+}
+
+func TestMemoryPurge(t *testing.T) {
+	ctx := context.Background()
+	q := NewMemory(MemoryConfig{MemoryQueueName: fmt.Sprint(t.Name(), time.Now().UnixNano()), MemoryReadTimeout: time.Second})
+	for i, data := range []string{"drop in flight", "drop", "keep", "drop"} {
+		if err := q.Enqueue(ctx, fmt.Sprint(i), []byte(data)); err != nil {
+			t.Fatal("Enqueue() =", err)
+		}
+	}
+	if err := q.Enqueue(WithDeliverAt(ctx, time.Now().Add(time.Hour)), "delayed", []byte("drop later")); err != nil {
+		t.Fatal("Enqueue() =", err)
+	}
+	if msgs, err := q.Dequeue(ctx); err != nil || len(msgs) != 1 {
+		t.Fatalf("Dequeue() = %v, %v, want 1 message", msgs, err)
+	}
+
+	n, err := Purge(ctx, q, selectDrop)
+	if err != nil {
+		t.Fatal("Purge() =", err)
+	}
+	if n != 3 {
+		t.Errorf("Purge() = %d, want 3", n)
+	}
+	left, err := ListPending(ctx, q, 10)
+	if err != nil {
+		t.Fatal("ListPending() =", err)
+	}
+	if len(left) != 2 || left[0].ID != "0" || left[1].ID != "2" {
+		t.Errorf("requests left = %v, want the one in flight and the one kept", left)
+	}
+	if b, err := q.Backlog(ctx); err != nil || b.Depth != 2 {
+		t.Errorf("Backlog() = %v, %v, want a depth of 2", b, err)
+	}
+}
+
+// purgeStream is a redis stream and sorted set of delayed requests, whose
+// first inflight entries are in flight.
+type purgeStream struct {
+	redis.Cmdable
+	entries  []redis.XMessage
+	inflight int
+	delayed  []string
+}
+
+func (f *purgeStream) EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *redis.Cmd {
+	max := args[1].(int)
+	var res []interface{}
+	for i, e := range f.entries {
+		if len(res) == max {
+			break
+		}
+		inflight := int64(0)
+		if i < f.inflight {
+			inflight = 1
+		}
+		res = append(res, []interface{}{e.ID, e.Values[redisDataField], inflight, inflight})
+	}
+	return redis.NewCmdResult(res, nil)
+}
+
+func (f *purgeStream) XRangeN(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd {
+	var res []redis.XMessage
+	for _, e := range f.entries {
+		if redisIDTime(e.ID).Before(redisIDTime(start)) {
+			continue
+		}
+		if int64(len(res)) == count {
+			break
+		}
+		res = append(res, e)
+	}
+	return redis.NewXMessageSliceCmdResult(res, nil)
+}
+
+func (f *purgeStream) XDel(ctx context.Context, stream string, ids ...string) *redis.IntCmd {
+	deleted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		deleted[id] = true
+	}
+	entries := f.entries[:0]
+	for _, e := range f.entries {
+		if !deleted[e.ID] {
+			entries = append(entries, e)
+		}
+	}
+	f.entries = entries
+	return redis.NewIntResult(int64(len(ids)), nil)
+}
+
+func (f *purgeStream) ZRange(ctx context.Context, key string, start, stop int64) *redis.StringSliceCmd {
+	if start >= int64(len(f.delayed)) {
+		return redis.NewStringSliceResult(nil, nil)
+	}
+	if stop >= int64(len(f.delayed)) {
+		stop = int64(len(f.delayed)) - 1
+	}
+	return redis.NewStringSliceResult(append([]string(nil), f.delayed[start:stop+1]...), nil)
+}
+
+func (f *purgeStream) ZRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	removed := make(map[interface{}]bool, len(members))
+	for _, m := range members {
+		removed[m] = true
+	}
+	delayed := f.delayed[:0]
+	for _, m := range f.delayed {
+		if !removed[m] {
+			delayed = append(delayed, m)
+		}
+	}
+	f.delayed = delayed
+	return redis.NewIntResult(int64(len(members)), nil)
+}
+
+func TestRedisPurge(t *testing.T) {
+	// Spans several pages, with the entries kept and purged interleaved.
+	client := &purgeStream{inflight: 10}
+	for i := 0; i < 2*redisPurgeCount+10; i++ {
+		data := "keep"
+		if i%2 == 0 {
+			data = "drop"
+		}
+		client.entries = append(client.entries, redis.XMessage{
+			ID:     fmt.Sprint(i+1, "-0"),
+			Values: map[string]interface{}{redisDataField: data},
+		})
+		client.delayed = append(client.delayed, fmt.Sprint(data, " ", i))
+	}
+	r := NewRedisFromClient(client, RedisConfig{StreamName: "requests", ConsumerGroup: "group"})
+
+	n, err := Purge(context.Background(), r, selectDrop)
+	if err != nil {
+		t.Fatal("Purge() =", err)
+	}
+	// Half of the delayed requests and of those not in flight.
+	if want := redisPurgeCount + 5 + redisPurgeCount; n != want {
+		t.Errorf("Purge() = %d, want %d", n, want)
+	}
+	for i, e := range client.entries {
+		if i >= client.inflight && e.Values[redisDataField] != "keep" {
+			t.Fatalf("entry %s = %v, want the entries not in flight to be purged", e.ID, e.Values)
+		}
+	}
+	if got, want := len(client.entries), client.inflight+redisPurgeCount; got != want {
+		t.Errorf("got %d entries left, want %d", got, want)
+	}
+	for _, m := range client.delayed {
+		if selectDrop([]byte(m)) {
+			t.Fatalf("delayed request %q was not purged", m)
+		}
+	}
+	if got := len(client.delayed); got != redisPurgeCount+5 {
+		t.Errorf("got %d delayed requests left, want %d", got, redisPurgeCount+5)
+	}
+}
+
+func TestPurgeNotSupported(t *testing.T) {
+	if _, err := Purge(context.Background(), &Channel{}, selectDrop); !errors.Is(err, ErrPurgeNotSupported) {
+		t.Errorf("Purge() = %v, want %v", err, ErrPurgeNotSupported)
+	}
+}
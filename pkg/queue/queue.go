@@ -0,0 +1,288 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package queue defines the storage layer shared by the async producer and
+// consumer, along with the supported backend implementations.
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// BackendRedis selects the Redis Streams backend.
+	BackendRedis = "redis"
+	// BackendKafka selects the Kafka backend.
+	BackendKafka = "kafka"
+	// BackendRabbitMQ selects the RabbitMQ backend.
+	BackendRabbitMQ = "rabbitmq"
+	// BackendSQS selects the Amazon SQS backend.
+	BackendSQS = "sqs"
+	// BackendPubSub selects the Google Cloud Pub/Sub backend.
+	BackendPubSub = "pubsub"
+	// BackendServiceBus selects the Azure Service Bus backend.
+	BackendServiceBus = "servicebus"
+	// BackendPostgres selects the PostgreSQL backend.
+	BackendPostgres = "postgres"
+	// BackendChannel delegates delivery to a Knative Channel or Broker.
+	BackendChannel = "channel"
+	// BackendMemory selects the process-local in-memory backend.
+	BackendMemory = "memory"
+)
+
+// Message is a single request read from a queue.
+type Message struct {
+	// ID is the backend specific identifier used to ack the message.
+	ID string
+	// Data is the serialized request as written by the producer.
+	Data []byte
+	// Deliveries is the number of times the message was read by consumers,
+	// this time included, for backends tracking it. It is zero otherwise.
+	Deliveries int
+}
+
+// Queue is the interface implemented by every storage backend.
+type Queue interface {
+	// Enqueue durably stores data. id is the async request ID.
+	Enqueue(ctx context.Context, id string, data []byte) error
+	// Dequeue blocks until messages are available or the backend's read
+	// timeout expires, in which case it returns no messages and no error.
+	Dequeue(ctx context.Context) ([]Message, error)
+	// Ack marks the message as processed so it is not delivered again.
+	Ack(ctx context.Context, msg Message) error
+	// DeadLetter moves the message out of the queue, recording the reason
+	// it could not be delivered.
+	DeadLetter(ctx context.Context, msg Message, reason string) error
+	// Close releases the resources held by the backend.
+	Close() error
+}
+
+// HealthChecker is implemented by backends that can check their connection
+// to the storage, for readiness probes.
+type HealthChecker interface {
+	// CheckHealth returns an error if the storage cannot be used. When
+	// consuming is set it also checks what reading requires, such as the
+	// consumer group of a Redis stream.
+	CheckHealth(ctx context.Context, consuming bool) error
+}
+
+// CheckHealth checks the health of q if its backend supports it.
+func CheckHealth(ctx context.Context, q Queue, consuming bool) error {
+	if hc, ok := q.(HealthChecker); ok {
+		return hc.CheckHealth(ctx, consuming)
+	}
+	return nil
+}
+
+// ErrBatchNotSupported is returned by EnqueueBatch for backends that cannot
+// store several requests atomically.
+var ErrBatchNotSupported = errors.New("atomic batches are not supported by this queue backend")
+
+// BatchEnqueuer is implemented by backends that can store several requests
+// atomically, so either all of them are queued or none is.
+type BatchEnqueuer interface {
+	// EnqueueBatch durably stores data, with the options of ctx applying to
+	// all the requests. ids are the async request IDs.
+	EnqueueBatch(ctx context.Context, ids []string, data [][]byte) error
+}
+
+// EnqueueBatch stores data in q atomically if its backend supports it, and
+// returns ErrBatchNotSupported otherwise.
+func EnqueueBatch(ctx context.Context, q Queue, ids []string, data [][]byte) error {
+	if b, ok := q.(BatchEnqueuer); ok {
+		return b.EnqueueBatch(ctx, ids, data)
+	}
+	return ErrBatchNotSupported
+}
+
+// Config selects and configures a queue backend. It is meant to be embedded
+// in a component's envconfig struct.
+type Config struct {
+	Backend string `envconfig:"QUEUE_BACKEND" default:"redis"`
+	RedisConfig
+	KafkaConfig
+	RabbitMQConfig
+	SQSConfig
+	PubSubConfig
+	ServiceBusConfig
+	PostgresConfig
+	ChannelConfig
+	MemoryConfig
+	PriorityConfig
+	RouteConfig
+}
+
+// New returns the Queue described by cfg, or that of the route it selects.
+func New(ctx context.Context, cfg Config) (Queue, error) {
+	if cfg.QueueRoute != "" {
+		routeCfg, err := cfg.forRoute(cfg.QueueRoute)
+		if err != nil {
+			return nil, err
+		}
+		cfg = routeCfg
+		cfg.QueueRoute = ""
+	}
+	if cfg.PriorityQueues {
+		p, err := NewPrioritized(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	return newBackend(ctx, cfg)
+}
+
+// newBackend returns the Queue of the backend selected by cfg.
+func newBackend(ctx context.Context, cfg Config) (Queue, error) {
+	switch cfg.Backend {
+	case BackendRedis:
+		if len(cfg.RedisConsumerStreams) > 0 {
+			s, err := NewStreams(ctx, cfg.RedisConfig)
+			if err != nil {
+				return nil, err
+			}
+			return s, nil
+		}
+		if cfg.RedisShards > 1 {
+			s, err := NewSharded(ctx, cfg.RedisConfig)
+			if err != nil {
+				return nil, err
+			}
+			return s, nil
+		}
+		r, err := NewRedis(ctx, cfg.RedisConfig)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	case BackendKafka:
+		k, err := NewKafka(ctx, cfg.KafkaConfig)
+		if err != nil {
+			return nil, err
+		}
+		return k, nil
+	case BackendRabbitMQ:
+		r, err := NewRabbitMQ(ctx, cfg.RabbitMQConfig)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	case BackendSQS:
+		s, err := NewSQS(ctx, cfg.SQSConfig)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case BackendPubSub:
+		p, err := NewPubSub(ctx, cfg.PubSubConfig)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	case BackendServiceBus:
+		s, err := NewServiceBus(ctx, cfg.ServiceBusConfig)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case BackendPostgres:
+		p, err := NewPostgres(ctx, cfg.PostgresConfig)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	case BackendChannel:
+		c, err := NewChannel(ctx, cfg.ChannelConfig)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case BackendMemory:
+		return NewMemory(cfg.MemoryConfig), nil
+	default:
+		return nil, fmt.Errorf("unknown queue backend %q", cfg.Backend)
+	}
+}
+
+type orderingKey struct{}
+
+// WithOrderingKey returns a context asking backends that support ordered
+// delivery to deliver requests enqueued with the same key in order.
+func WithOrderingKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, orderingKey{}, key)
+}
+
+// OrderingKeyFrom returns the ordering key set on ctx, if any.
+func OrderingKeyFrom(ctx context.Context) string {
+	key, _ := ctx.Value(orderingKey{}).(string)
+	return key
+}
+
+type readLimitKey struct{}
+
+// WithReadLimit returns a context capping the requests returned by a Dequeue
+// of backends reading several at once, such as to the free workers of a
+// consumer.
+func WithReadLimit(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, readLimitKey{}, n)
+}
+
+// ReadLimitFrom returns the limit set on ctx, or zero when there is none.
+func ReadLimitFrom(ctx context.Context) int {
+	n, _ := ctx.Value(readLimitKey{}).(int)
+	return n
+}
+
+// readCount returns how many requests to read at once: max, capped by the
+// limit set on ctx, and at least one.
+func readCount(ctx context.Context, max int64) int64 {
+	if n := int64(ReadLimitFrom(ctx)); n > 0 && n < max {
+		max = n
+	}
+	if max < 1 {
+		return 1
+	}
+	return max
+}
+
+type deliverAt struct{}
+
+// ErrDelayNotSupported is returned by Enqueue when a delivery time is set on
+// the context but the backend cannot delay messages.
+var ErrDelayNotSupported = errors.New("delayed delivery is not supported by this queue backend")
+
+// WithDeliverAt returns a context asking backends to hold requests enqueued
+// with it until t. Backends that cannot delay delivery return
+// ErrDelayNotSupported from Enqueue.
+func WithDeliverAt(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, deliverAt{}, t)
+}
+
+// DeliverAtFrom returns the delivery time set on ctx, or the zero time if the
+// request may be delivered at once.
+func DeliverAtFrom(ctx context.Context) time.Time {
+	t, _ := ctx.Value(deliverAt{}).(time.Time)
+	return t
+}
+
+// checkNoDelay is used by backends without delayed delivery to reject
+// delayed requests.
+func checkNoDelay(ctx context.Context) error {
+	if !DeliverAtFrom(ctx).IsZero() {
+		return ErrDelayNotSupported
+	}
+	return nil
+}
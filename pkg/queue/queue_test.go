@@ -0,0 +1,87 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{{
+		name: "redis backend",
+		cfg: Config{
+			Backend:     BackendRedis,
+			RedisConfig: RedisConfig{RedisAddress: "redis://localhost:6379", StreamName: "mystream"},
+		},
+	}, {
+		name: "redis backend with bad address",
+		cfg: Config{
+			Backend:     BackendRedis,
+			RedisConfig: RedisConfig{RedisAddress: "notredis://localhost:6379"},
+		},
+		wantErr: true,
+	}, {
+		name:    "rabbitmq backend without url",
+		cfg:     Config{Backend: BackendRabbitMQ, RabbitMQConfig: RabbitMQConfig{RabbitMQQueue: "requests"}},
+		wantErr: true,
+	}, {
+		name:    "servicebus backend without credentials",
+		cfg:     Config{Backend: BackendServiceBus, ServiceBusConfig: ServiceBusConfig{ServiceBusQueue: "requests"}},
+		wantErr: true,
+	}, {
+		name:    "postgres backend without url",
+		cfg:     Config{Backend: BackendPostgres, PostgresConfig: PostgresConfig{PostgresTable: "async_requests"}},
+		wantErr: true,
+	}, {
+		name: "channel backend",
+		cfg:  Config{Backend: BackendChannel, ChannelConfig: ChannelConfig{ChannelSink: "http://broker-ingress.knative-eventing.svc.cluster.local/default/default"}},
+	}, {
+		name:    "unknown backend",
+		cfg:     Config{Backend: "unknown"},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q, err := New(context.Background(), test.cfg)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if q != nil {
+				q.Close()
+			}
+		})
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	ctx := context.Background()
+	unreachable, err := NewRedis(ctx, RedisConfig{RedisAddress: "redis://127.0.0.1:1", StreamName: "mystream"})
+	if err != nil {
+		t.Fatal("NewRedis() =", err)
+	}
+	defer unreachable.Close()
+	if err := CheckHealth(ctx, unreachable, false); err == nil {
+		t.Error("CheckHealth() of an unreachable redis succeeded")
+	}
+
+	// Backends without health checks are always healthy.
+	if err := CheckHealth(ctx, NewMemory(MemoryConfig{MemoryQueueName: t.Name()}), true); err != nil {
+		t.Error("CheckHealth() =", err)
+	}
+}
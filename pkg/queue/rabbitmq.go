@@ -0,0 +1,284 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// The AMQP message header holding the dead-letter reason.
+const rabbitMQReasonHeader = "async-dead-letter-reason"
+
+// RabbitMQConfig holds the environment configuration of the RabbitMQ backend.
+type RabbitMQConfig struct {
+	RabbitMQURL             string        `envconfig:"RABBITMQ_URL"`
+	RabbitMQQueue           string        `envconfig:"RABBITMQ_QUEUE"`
+	RabbitMQDeadLetterQueue string        `envconfig:"RABBITMQ_DEAD_LETTER_QUEUE"`
+	RabbitMQPrefetch        int           `envconfig:"RABBITMQ_PREFETCH" default:"1"`
+	RabbitMQReadTimeout     time.Duration `envconfig:"RABBITMQ_READ_TIMEOUT" default:"5s"`
+}
+
+// RabbitMQ is a Queue backed by a durable AMQP 0.9.1 queue. Writes wait for
+// publisher confirms and deliveries are acked manually.
+type RabbitMQ struct {
+	cfg  RabbitMQConfig
+	conn rabbitMQConnection
+
+	// publish guards the publishing channel, so each write waits for its
+	// own confirmation. published is the delivery tag of the last publish.
+	publish   sync.Mutex
+	pubCh     rabbitMQChannel
+	confirms  chan amqp.Confirmation
+	published uint64
+
+	// consuming guards deliveries, which are only set once the consumer
+	// started, so failures to start it are retried by the next Dequeue.
+	consuming  sync.Mutex
+	deliveries <-chan amqp.Delivery
+
+	mu       sync.Mutex
+	inflight map[string]amqp.Delivery
+}
+
+// rabbitMQConnection is the part of *amqp.Connection used by RabbitMQ.
+type rabbitMQConnection interface {
+	channel() (rabbitMQChannel, error)
+	IsClosed() bool
+	Close() error
+}
+
+// rabbitMQChannel is the part of *amqp.Channel used by RabbitMQ.
+type rabbitMQChannel interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Close() error
+}
+
+// amqpConnection is a rabbitMQConnection to a broker.
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+func (c amqpConnection) channel() (rabbitMQChannel, error) {
+	return c.Channel()
+}
+
+var (
+	_ Queue         = (*RabbitMQ)(nil)
+	_ HealthChecker = (*RabbitMQ)(nil)
+)
+
+// NewRabbitMQ connects to the broker described by cfg and declares the
+// request and dead-letter queues.
+func NewRabbitMQ(ctx context.Context, cfg RabbitMQConfig) (*RabbitMQ, error) {
+	if cfg.RabbitMQURL == "" || cfg.RabbitMQQueue == "" {
+		return nil, errors.New("RABBITMQ_URL and RABBITMQ_QUEUE must be set")
+	}
+	if cfg.RabbitMQDeadLetterQueue == "" {
+		cfg.RabbitMQDeadLetterQueue = cfg.RabbitMQQueue + deadLetterSuffix
+	}
+	conn, err := amqp.Dial(cfg.RabbitMQURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to rabbitmq: %w", err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open rabbitmq channel: %w", err)
+	}
+	for _, name := range []string{cfg.RabbitMQQueue, cfg.RabbitMQDeadLetterQueue} {
+		if _, err := ch.QueueDeclare(name, true, false, false, false, nil); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to declare queue %q: %w", name, err)
+		}
+	}
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+	return newRabbitMQFromChannel(amqpConnection{conn}, ch, ch.NotifyPublish(make(chan amqp.Confirmation, 1)), cfg), nil
+}
+
+// newRabbitMQFromChannel returns a RabbitMQ publishing on ch, in confirm mode
+// with its confirmations sent to confirms, and consuming on channels of conn.
+func newRabbitMQFromChannel(conn rabbitMQConnection, ch rabbitMQChannel, confirms chan amqp.Confirmation, cfg RabbitMQConfig) *RabbitMQ {
+	return &RabbitMQ{
+		cfg:      cfg,
+		conn:     conn,
+		pubCh:    ch,
+		confirms: confirms,
+		inflight: make(map[string]amqp.Delivery),
+	}
+}
+
+// Enqueue implements Queue.
+func (r *RabbitMQ) Enqueue(ctx context.Context, id string, data []byte) error {
+	if err := checkNoDelay(ctx); err != nil {
+		return err
+	}
+	if err := r.publishConfirmed(ctx, r.cfg.RabbitMQQueue, amqp.Publishing{
+		MessageId:    id,
+		DeliveryMode: amqp.Persistent,
+		Body:         data,
+	}); err != nil {
+		return fmt.Errorf("failed to publish %q: %w", id, err)
+	}
+	return nil
+}
+
+// Dequeue implements Queue.
+func (r *RabbitMQ) Dequeue(ctx context.Context) ([]Message, error) {
+	deliveries, err := r.startConsuming()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case d, ok := <-deliveries:
+		if !ok {
+			// The consumer is started again by the next read.
+			r.consuming.Lock()
+			if r.deliveries == deliveries {
+				r.deliveries = nil
+			}
+			r.consuming.Unlock()
+			return nil, errors.New("rabbitmq delivery channel closed")
+		}
+		id := strconv.FormatUint(d.DeliveryTag, 10)
+		r.mu.Lock()
+		r.inflight[id] = d
+		r.mu.Unlock()
+		return []Message{{ID: id, Data: d.Body}}, nil
+	case <-time.After(r.cfg.RabbitMQReadTimeout):
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Ack implements Queue.
+func (r *RabbitMQ) Ack(ctx context.Context, msg Message) error {
+	r.mu.Lock()
+	d, ok := r.inflight[msg.ID]
+	delete(r.inflight, msg.ID)
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("failed to ack %q: unknown message", msg.ID)
+	}
+	if err := d.Ack(false); err != nil {
+		return fmt.Errorf("failed to ack %q: %w", msg.ID, err)
+	}
+	return nil
+}
+
+// DeadLetter implements Queue by publishing the message to the dead-letter
+// queue and acking the original.
+func (r *RabbitMQ) DeadLetter(ctx context.Context, msg Message, reason string) error {
+	headers := amqp.Table{rabbitMQReasonHeader: reason}
+	for k, v := range FailureFrom(ctx).Fields() {
+		headers[failureHeaderPrefix+k] = v
+	}
+	if err := r.publishConfirmed(ctx, r.cfg.RabbitMQDeadLetterQueue, amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		Headers:      headers,
+		Body:         msg.Data,
+	}); err != nil {
+		return fmt.Errorf("failed to dead-letter %q: %w", msg.ID, err)
+	}
+	return r.Ack(ctx, msg)
+}
+
+// CheckHealth implements HealthChecker.
+func (r *RabbitMQ) CheckHealth(ctx context.Context, consuming bool) error {
+	if r.conn.IsClosed() {
+		return errors.New("rabbitmq connection is closed")
+	}
+	return nil
+}
+
+// Close implements Queue.
+func (r *RabbitMQ) Close() error {
+	return r.conn.Close()
+}
+
+// startConsuming returns the deliveries of the consumer, starting it unless
+// it runs already.
+func (r *RabbitMQ) startConsuming() (<-chan amqp.Delivery, error) {
+	r.consuming.Lock()
+	defer r.consuming.Unlock()
+	if r.deliveries != nil {
+		return r.deliveries, nil
+	}
+	deliveries, err := r.consume()
+	if err != nil {
+		return nil, err
+	}
+	r.deliveries = deliveries
+	return deliveries, nil
+}
+
+// consume starts delivering messages from the request queue on a dedicated
+// channel limited to RABBITMQ_PREFETCH unacked messages.
+func (r *RabbitMQ) consume() (<-chan amqp.Delivery, error) {
+	ch, err := r.conn.channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rabbitmq channel: %w", err)
+	}
+	if err := ch.Qos(r.cfg.RabbitMQPrefetch, 0, false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to set prefetch: %w", err)
+	}
+	deliveries, err := ch.Consume(r.cfg.RabbitMQQueue, "", false, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to consume from queue %q: %w", r.cfg.RabbitMQQueue, err)
+	}
+	return deliveries, nil
+}
+
+// publishConfirmed publishes msg to the named queue through the default
+// exchange and waits for the broker to confirm it.
+func (r *RabbitMQ) publishConfirmed(ctx context.Context, queue string, msg amqp.Publishing) error {
+	r.publish.Lock()
+	defer r.publish.Unlock()
+	if err := r.pubCh.Publish("", queue, false, false, msg); err != nil {
+		return err
+	}
+	r.published++
+	for {
+		select {
+		case c, ok := <-r.confirms:
+			if !ok {
+				return errors.New("rabbitmq channel closed")
+			}
+			// Skip confirmations of earlier writes whose caller gave up waiting.
+			if c.DeliveryTag < r.published {
+				continue
+			}
+			if !c.Ack {
+				return errors.New("message was not confirmed by the broker")
+			}
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
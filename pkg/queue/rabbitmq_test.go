@@ -0,0 +1,248 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeRabbitMQ is a broker with a single channel, confirming the messages
+// published on it unless nack is set.
+type fakeRabbitMQ struct {
+	mu         sync.Mutex
+	confirms   chan amqp.Confirmation
+	nack       bool
+	published  []fakePublishing
+	consumeErr []error
+	deliveries chan amqp.Delivery
+	acked      []uint64
+	closed     bool
+}
+
+type fakePublishing struct {
+	queue string
+	msg   amqp.Publishing
+}
+
+func newFakeRabbitMQ() *fakeRabbitMQ {
+	return &fakeRabbitMQ{
+		confirms:   make(chan amqp.Confirmation, 10),
+		deliveries: make(chan amqp.Delivery, 10),
+	}
+}
+
+func (f *fakeRabbitMQ) channel() (rabbitMQChannel, error) { return f, nil }
+func (f *fakeRabbitMQ) IsClosed() bool                    { return f.closed }
+func (f *fakeRabbitMQ) Close() error                      { return nil }
+
+func (f *fakeRabbitMQ) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published = append(f.published, fakePublishing{queue: key, msg: msg})
+	f.confirms <- amqp.Confirmation{DeliveryTag: uint64(len(f.published)), Ack: !f.nack}
+	return nil
+}
+
+func (f *fakeRabbitMQ) Qos(prefetchCount, prefetchSize int, global bool) error {
+	return nil
+}
+
+func (f *fakeRabbitMQ) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if autoAck {
+		return nil, errors.New("deliveries must be acked manually")
+	}
+	if len(f.consumeErr) > 0 {
+		err := f.consumeErr[0]
+		f.consumeErr = f.consumeErr[1:]
+		return nil, err
+	}
+	return f.deliveries, nil
+}
+
+// Ack, Nack and Reject implement amqp.Acknowledger for the deliveries.
+func (f *fakeRabbitMQ) Ack(tag uint64, multiple bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.acked = append(f.acked, tag)
+	return nil
+}
+
+func (f *fakeRabbitMQ) Nack(tag uint64, multiple, requeue bool) error { return nil }
+func (f *fakeRabbitMQ) Reject(tag uint64, requeue bool) error         { return nil }
+
+func (f *fakeRabbitMQ) deliver(tag uint64, body string) {
+	f.deliveries <- amqp.Delivery{Acknowledger: f, DeliveryTag: tag, Body: []byte(body)}
+}
+
+func newTestRabbitMQ(f *fakeRabbitMQ) *RabbitMQ {
+	return newRabbitMQFromChannel(f, f, f.confirms, RabbitMQConfig{
+		RabbitMQQueue:           "requests",
+		RabbitMQDeadLetterQueue: "requests-dlq",
+		RabbitMQPrefetch:        1,
+		RabbitMQReadTimeout:     time.Second,
+	})
+}
+
+func TestRabbitMQDequeueRetriesConsume(t *testing.T) {
+	f := newFakeRabbitMQ()
+	f.consumeErr = []error{errors.New("NOT_FOUND - no queue 'requests'")}
+	r := newTestRabbitMQ(f)
+	f.deliver(1, "data")
+
+	if _, err := r.Dequeue(context.Background()); err == nil {
+		t.Fatal("Dequeue() succeeded while the queue could not be consumed")
+	}
+	msgs, err := r.Dequeue(context.Background())
+	if err != nil {
+		t.Fatal("Dequeue() =", err)
+	}
+	if len(msgs) != 1 || string(msgs[0].Data) != "data" {
+		t.Errorf("Dequeue() = %v, want the delivery", msgs)
+	}
+}
+
+func TestRabbitMQDequeueRestartsClosedConsumer(t *testing.T) {
+	f := newFakeRabbitMQ()
+	r := newTestRabbitMQ(f)
+	close(f.deliveries)
+	if _, err := r.Dequeue(context.Background()); err == nil {
+		t.Fatal("Dequeue() succeeded on a closed delivery channel")
+	}
+	f.deliveries = make(chan amqp.Delivery, 1)
+	f.deliver(1, "data")
+	if msgs, err := r.Dequeue(context.Background()); err != nil || len(msgs) != 1 {
+		t.Errorf("Dequeue() = %v, %v, want the delivery of the new consumer", msgs, err)
+	}
+}
+
+func TestRabbitMQEnqueueConfirms(t *testing.T) {
+	tests := []struct {
+		name    string
+		nack    bool
+		wantErr bool
+	}{{
+		name: "confirmed",
+	}, {
+		name:    "nacked by the broker",
+		nack:    true,
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeRabbitMQ()
+			f.nack = test.nack
+			r := newTestRabbitMQ(f)
+			err := r.Enqueue(context.Background(), "123", []byte("data"))
+			if (err != nil) != test.wantErr {
+				t.Errorf("Enqueue() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if len(f.published) != 1 {
+				t.Fatalf("published %d messages, want 1", len(f.published))
+			}
+			p := f.published[0]
+			if p.queue != "requests" || p.msg.MessageId != "123" || p.msg.DeliveryMode != amqp.Persistent || string(p.msg.Body) != "data" {
+				t.Errorf("published %+v to %q, want a persistent message 123 to requests", p.msg, p.queue)
+			}
+		})
+	}
+}
+
+func TestRabbitMQEnqueueSkipsStaleConfirms(t *testing.T) {
+	f := newFakeRabbitMQ()
+	r := newTestRabbitMQ(f)
+	// The confirmation of a write whose caller gave up waiting.
+	r.published = 1
+	f.published = []fakePublishing{{queue: "requests"}}
+	f.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: false}
+	if err := r.Enqueue(context.Background(), "123", []byte("data")); err != nil {
+		t.Error("Enqueue() =", err)
+	}
+}
+
+func TestRabbitMQAck(t *testing.T) {
+	f := newFakeRabbitMQ()
+	r := newTestRabbitMQ(f)
+	f.deliver(7, "data")
+	msgs, err := r.Dequeue(context.Background())
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Dequeue() = %v, %v", msgs, err)
+	}
+	if len(f.acked) != 0 {
+		t.Error("delivery was acked before Ack")
+	}
+	if err := r.Ack(context.Background(), msgs[0]); err != nil {
+		t.Fatal("Ack() =", err)
+	}
+	if len(f.acked) != 1 || f.acked[0] != 7 {
+		t.Errorf("acked = %v, want [7]", f.acked)
+	}
+	if err := r.Ack(context.Background(), msgs[0]); err == nil {
+		t.Error("Ack() of an acked message succeeded")
+	}
+}
+
+func TestRabbitMQDeadLetter(t *testing.T) {
+	f := newFakeRabbitMQ()
+	r := newTestRabbitMQ(f)
+	f.deliver(7, "data")
+	msgs, err := r.Dequeue(context.Background())
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Dequeue() = %v, %v", msgs, err)
+	}
+	ctx := WithFailure(context.Background(), Failure{StatusCode: 503, Attempts: 3})
+	if err := r.DeadLetter(ctx, msgs[0], "url returned 503"); err != nil {
+		t.Fatal("DeadLetter() =", err)
+	}
+	if len(f.published) != 1 {
+		t.Fatalf("published %d messages, want 1", len(f.published))
+	}
+	p := f.published[0]
+	if p.queue != "requests-dlq" || string(p.msg.Body) != "data" || p.msg.DeliveryMode != amqp.Persistent {
+		t.Errorf("published %+v to %q, want the request to requests-dlq", p.msg, p.queue)
+	}
+	if got := p.msg.Headers[rabbitMQReasonHeader]; got != "url returned 503" {
+		t.Errorf("reason header = %v, want %q", got, "url returned 503")
+	}
+	if got := p.msg.Headers[failureHeaderPrefix+FailureStatusField]; got != "503" {
+		t.Errorf("failure headers = %v, want the status of the failure", p.msg.Headers)
+	}
+	if len(f.acked) != 1 || f.acked[0] != 7 {
+		t.Errorf("acked = %v, want the original acked", f.acked)
+	}
+}
+
+func TestRabbitMQDeadLetterNotConfirmed(t *testing.T) {
+	f := newFakeRabbitMQ()
+	r := newTestRabbitMQ(f)
+	f.deliver(7, "data")
+	msgs, err := r.Dequeue(context.Background())
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Dequeue() = %v, %v", msgs, err)
+	}
+	f.nack = true
+	if err := r.DeadLetter(context.Background(), msgs[0], "failed"); err == nil {
+		t.Error("DeadLetter() succeeded without a confirmation")
+	}
+	if len(f.acked) != 0 {
+		t.Error("original was acked though it was not dead-lettered")
+	}
+}
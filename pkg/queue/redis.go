@@ -0,0 +1,1040 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// The stream entry field holding the request.
+	redisDataField = "data"
+	// The stream entry field holding the dead-letter reason.
+	redisReasonField = "reason"
+	// Suffix appended to the stream name for the dead-letter stream.
+	deadLetterSuffix = "-dlq"
+	// Suffix appended to the stream name for the sorted set holding delayed
+	// requests, scored by their delivery time in milliseconds.
+	delayedSuffix = "-delayed"
+	// The most pending requests claimed at once.
+	redisClaimCount = 10
+	// The most dead-lettered requests read at once when they are selected.
+	redisReplayCount = 100
+	// The most requests read at once when they are purged.
+	redisPurgeCount = 1000
+)
+
+// promoteDelayed atomically moves the delayed requests that are due from the
+// sorted set KEYS[1] to the stream KEYS[2]. ARGV[1] is the current time in
+// milliseconds.
+var promoteDelayed = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for _, data in ipairs(due) do
+	redis.call('XADD', KEYS[2], '*', 'data', data)
+	redis.call('ZREM', KEYS[1], data)
+end
+return #due
+`)
+
+// removeIdleConsumers atomically removes the consumers of group ARGV[1] of
+// stream KEYS[1] that have no pending requests and are idle for ARGV[3]
+// milliseconds, except consumer ARGV[2], and returns their names.
+var removeIdleConsumers = redis.NewScript(`
+local removed = {}
+for _, fields in ipairs(redis.call('XINFO', 'CONSUMERS', KEYS[1], ARGV[1])) do
+	local c = {}
+	for i = 1, #fields, 2 do
+		c[fields[i]] = fields[i + 1]
+	end
+	if c['name'] ~= ARGV[2] and c['pending'] == 0 and c['idle'] >= tonumber(ARGV[3]) then
+		redis.call('XGROUP', 'DELCONSUMER', KEYS[1], ARGV[1], c['name'])
+		table.insert(removed, c['name'])
+	end
+end
+return removed
+`)
+
+// streamBacklog returns the number of entries of stream KEYS[1] that group
+// ARGV[1] has not acked and the ID of the oldest, if any. The entries not read
+// yet are counted with the lag of the group when the server reports it, and
+// listed otherwise.
+var streamBacklog = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return {0, false}
+end
+local group
+for _, fields in ipairs(redis.call('XINFO', 'GROUPS', KEYS[1])) do
+	local g = {}
+	for i = 1, #fields, 2 do
+		g[fields[i]] = fields[i + 1]
+	end
+	if g['name'] == ARGV[1] then
+		group = g
+	end
+end
+if not group then
+	return {0, false}
+end
+local last = group['last-delivered-id']
+local unread = redis.call('XRANGE', KEYS[1], last, '+', 'COUNT', 2)
+if #unread > 0 and unread[1][1] == last then
+	table.remove(unread, 1)
+end
+local oldest = false
+if group['pending'] > 0 then
+	oldest = redis.call('XPENDING', KEYS[1], ARGV[1])[2]
+elseif #unread > 0 then
+	oldest = unread[1][1]
+end
+local lag = group['lag']
+if type(lag) ~= 'number' then
+	local all = redis.call('XRANGE', KEYS[1], last, '+')
+	lag = #all
+	if lag > 0 and all[1][1] == last then
+		lag = lag - 1
+	end
+end
+return {group['pending'] + lag, oldest}
+`)
+
+// streamPending lists up to ARGV[2] entries of stream KEYS[1] that group
+// ARGV[1] has not acked, as {id, value of field ARGV[3], in flight, reads}.
+// The entries pending in the group come first, then those not read yet, all
+// of them when the group does not exist.
+var streamPending = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return {}
+end
+local max = tonumber(ARGV[2])
+local function value(fields)
+	for i = 1, #fields, 2 do
+		if fields[i] == ARGV[3] then
+			return fields[i + 1]
+		end
+	end
+	return false
+end
+local start = '-'
+local found = false
+for _, fields in ipairs(redis.call('XINFO', 'GROUPS', KEYS[1])) do
+	local g = {}
+	for i = 1, #fields, 2 do
+		g[fields[i]] = fields[i + 1]
+	end
+	if g['name'] == ARGV[1] then
+		start = g['last-delivered-id']
+		found = true
+	end
+end
+local entries = {}
+if found then
+	for _, p in ipairs(redis.call('XPENDING', KEYS[1], ARGV[1], '-', '+', max)) do
+		local e = redis.call('XRANGE', KEYS[1], p[1], p[1])
+		if #e > 0 then
+			table.insert(entries, {p[1], value(e[1][2]), 1, p[4]})
+		end
+	end
+end
+for _, e in ipairs(redis.call('XRANGE', KEYS[1], start, '+', 'COUNT', max - #entries + 1)) do
+	if #entries < max and e[1] ~= start then
+		table.insert(entries, {e[1], value(e[2]), 0, 0})
+	end
+end
+return entries
+`)
+
+// RedisConfig holds the environment configuration of the Redis backend.
+type RedisConfig struct {
+	RedisAddress  string        `envconfig:"REDIS_ADDRESS"`
+	StreamName    string        `envconfig:"REDIS_STREAM_NAME"`
+	ConsumerGroup string        `envconfig:"REDIS_CONSUMER_GROUP" default:"async-consumer"`
+	ConsumerName  string        `envconfig:"REDIS_CONSUMER_NAME"`
+	ReadBlock     time.Duration `envconfig:"REDIS_READ_BLOCK" default:"5s"`
+	// ReadCount is the most entries read from a stream at once.
+	ReadCount int64 `envconfig:"REDIS_READ_COUNT" default:"10"`
+	// Credentials, overriding those of REDIS_ADDRESS. The password can be
+	// read from a file, such as a mounted Secret.
+	RedisUsername     string `envconfig:"REDIS_USERNAME"`
+	RedisPassword     string `envconfig:"REDIS_PASSWORD"`
+	RedisPasswordFile string `envconfig:"REDIS_PASSWORD_FILE"`
+	// TLS is used for rediss:// addresses or when any of these is set.
+	// TLS_CERT holds the PEM encoded CA certificates trusted to verify the
+	// server, TLS_CA_FILE is a file holding them. The client certificate
+	// and key files authenticate the client.
+	TlsCert           string `envconfig:"TLS_CERT"`
+	TLSCAFile         string `envconfig:"TLS_CA_FILE"`
+	TLSClientCertFile string `envconfig:"TLS_CLIENT_CERT_FILE"`
+	TLSClientKeyFile  string `envconfig:"TLS_CLIENT_KEY_FILE"`
+	// Connection pool, timeout and retry settings of the client. Zero keeps
+	// the client's default, -1 disables timeouts and backoff.
+	RedisPoolSize        int           `envconfig:"REDIS_POOL_SIZE"`
+	RedisMinIdleConns    int           `envconfig:"REDIS_MIN_IDLE_CONNS"`
+	RedisPoolTimeout     time.Duration `envconfig:"REDIS_POOL_TIMEOUT"`
+	RedisIdleTimeout     time.Duration `envconfig:"REDIS_IDLE_TIMEOUT"`
+	RedisDialTimeout     time.Duration `envconfig:"REDIS_DIAL_TIMEOUT"`
+	RedisReadTimeout     time.Duration `envconfig:"REDIS_READ_TIMEOUT"`
+	RedisWriteTimeout    time.Duration `envconfig:"REDIS_WRITE_TIMEOUT"`
+	RedisMaxRetries      int           `envconfig:"REDIS_MAX_RETRIES"`
+	RedisMinRetryBackoff time.Duration `envconfig:"REDIS_MIN_RETRY_BACKOFF"`
+	RedisMaxRetryBackoff time.Duration `envconfig:"REDIS_MAX_RETRY_BACKOFF"`
+	// Writes are pipelined in batches of up to REDIS_BATCH_SIZE, flushed
+	// after REDIS_BATCH_INTERVAL, when the size is larger than 1.
+	RedisBatchSize     int           `envconfig:"REDIS_BATCH_SIZE"`
+	RedisBatchInterval time.Duration `envconfig:"REDIS_BATCH_INTERVAL" default:"5ms"`
+	// Streams are capped to about REDIS_MAX_LEN entries when it is set:
+	// writes trim them approximately, and consumers trim them every
+	// REDIS_TRIM_INTERVAL so they stay bounded while nothing is written.
+	RedisMaxLen       int64         `envconfig:"REDIS_MAX_LEN"`
+	RedisTrimInterval time.Duration `envconfig:"REDIS_TRIM_INTERVAL" default:"1m"`
+	// Requests read but not acked for REDIS_CLAIM_IDLE, such as those of a
+	// consumer that crashed, are claimed by the consumers checking every
+	// REDIS_CLAIM_INTERVAL and delivered again. Claiming is disabled when
+	// either is zero.
+	RedisClaimIdle     time.Duration `envconfig:"REDIS_CLAIM_IDLE" default:"5m"`
+	RedisClaimInterval time.Duration `envconfig:"REDIS_CLAIM_INTERVAL" default:"30s"`
+	// Consumers idle for REDIS_CONSUMER_EXPIRY with no pending requests,
+	// such as those of scaled down pods, are removed from the group when
+	// claiming. They are kept when it is zero.
+	RedisConsumerExpiry time.Duration `envconfig:"REDIS_CONSUMER_EXPIRY" default:"1h"`
+	ShardConfig
+	StreamsConfig
+}
+
+// Redis is a Queue backed by a Redis Stream and consumer group.
+type Redis struct {
+	client   redis.Cmdable
+	stream   string
+	group    string
+	consumer string
+	block    time.Duration
+	count    int64
+	// batcher pipelines writes when batching is enabled.
+	batcher *batcher
+	// maxLen caps the length of the stream when it is positive, see
+	// RedisMaxLen.
+	maxLen       int64
+	trimInterval time.Duration
+	trimStart    sync.Once
+	trimStop     chan struct{}
+	trimDone     chan struct{}
+	// stopOnce makes closing the queue more than once safe.
+	stopOnce sync.Once
+	// Pending requests idle for claimIdle are claimed every claimInterval,
+	// from nextClaim on.
+	claimIdle     time.Duration
+	claimInterval time.Duration
+	nextClaim     time.Time
+	// consumerExpiry is the idle time after which consumers with no
+	// pending requests are removed from the group.
+	consumerExpiry time.Duration
+
+	groupReady bool
+}
+
+var (
+	_ Queue                  = (*Redis)(nil)
+	_ HealthChecker          = (*Redis)(nil)
+	_ BatchEnqueuer          = (*Redis)(nil)
+	_ Replayer               = (*Redis)(nil)
+	_ BacklogReader          = (*Redis)(nil)
+	_ PendingLister          = (*Redis)(nil)
+	_ DeadLetterLister       = (*Redis)(nil)
+	_ RecentDeadLetterLister = (*Redis)(nil)
+	_ Purger                 = (*Redis)(nil)
+	_ DelayedLister          = (*Redis)(nil)
+)
+
+// NewRedis returns a Queue on the stream of cfg, connected to with
+// NewRedisClient.
+func NewRedis(ctx context.Context, cfg RedisConfig) (*Redis, error) {
+	client, err := NewRedisClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewRedisFromClient(client, cfg), nil
+}
+
+// NewRedisClient returns a client for the Redis instance described by cfg.
+func NewRedisClient(cfg RedisConfig) (*redis.Client, error) {
+	opt, err := redis.ParseURL(cfg.RedisAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse redis address: %w", err)
+	}
+	if cfg.RedisUsername != "" {
+		opt.Username = cfg.RedisUsername
+	}
+	if cfg.RedisPassword != "" {
+		opt.Password = cfg.RedisPassword
+	}
+	if cfg.RedisPasswordFile != "" {
+		b, err := ioutil.ReadFile(cfg.RedisPasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read redis password: %w", err)
+		}
+		opt.Password = strings.TrimSpace(string(b))
+	}
+	if err := configureRedisTLS(opt, cfg); err != nil {
+		return nil, err
+	}
+	configureRedisPool(opt, cfg)
+	return redis.NewClient(opt), nil
+}
+
+// configureRedisPool applies the pool, timeout and retry settings of cfg
+// that are set to opt.
+func configureRedisPool(opt *redis.Options, cfg RedisConfig) {
+	setInt := func(dst *int, v int) {
+		if v != 0 {
+			*dst = v
+		}
+	}
+	setDuration := func(dst *time.Duration, v time.Duration) {
+		if v != 0 {
+			*dst = v
+		}
+	}
+	setInt(&opt.PoolSize, cfg.RedisPoolSize)
+	setInt(&opt.MinIdleConns, cfg.RedisMinIdleConns)
+	setDuration(&opt.PoolTimeout, cfg.RedisPoolTimeout)
+	setDuration(&opt.IdleTimeout, cfg.RedisIdleTimeout)
+	setDuration(&opt.DialTimeout, cfg.RedisDialTimeout)
+	setDuration(&opt.ReadTimeout, cfg.RedisReadTimeout)
+	setDuration(&opt.WriteTimeout, cfg.RedisWriteTimeout)
+	setInt(&opt.MaxRetries, cfg.RedisMaxRetries)
+	setDuration(&opt.MinRetryBackoff, cfg.RedisMinRetryBackoff)
+	setDuration(&opt.MaxRetryBackoff, cfg.RedisMaxRetryBackoff)
+}
+
+// configureRedisTLS sets up the TLS configuration of opt from cfg.
+func configureRedisTLS(opt *redis.Options, cfg RedisConfig) error {
+	if cfg.TlsCert == "" && cfg.TLSCAFile == "" && cfg.TLSClientCertFile == "" && cfg.TLSClientKeyFile == "" {
+		return nil
+	}
+	if opt.TLSConfig == nil {
+		host, _, err := net.SplitHostPort(opt.Addr)
+		if err != nil {
+			return fmt.Errorf("failed to parse redis address: %w", err)
+		}
+		opt.TLSConfig = &tls.Config{ServerName: host}
+	}
+	if cfg.TlsCert != "" || cfg.TLSCAFile != "" {
+		roots := x509.NewCertPool()
+		pem := []byte(cfg.TlsCert)
+		if cfg.TLSCAFile != "" {
+			b, err := ioutil.ReadFile(cfg.TLSCAFile)
+			if err != nil {
+				return fmt.Errorf("failed to read redis CA certificates: %w", err)
+			}
+			pem = append(pem, b...)
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return errors.New("no valid redis CA certificate found in TLS_CERT or TLS_CA_FILE")
+		}
+		opt.TLSConfig.RootCAs = roots
+	}
+	if cfg.TLSClientCertFile != "" || cfg.TLSClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSClientCertFile, cfg.TLSClientKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load redis client certificate: %w", err)
+		}
+		opt.TLSConfig.Certificates = []tls.Certificate{cert}
+	}
+	return nil
+}
+
+// NewRedisFromClient returns a Redis queue using an existing client.
+func NewRedisFromClient(client redis.Cmdable, cfg RedisConfig) *Redis {
+	consumer := cfg.ConsumerName
+	if consumer == "" {
+		consumer, _ = os.Hostname()
+	}
+	r := &Redis{
+		client:   client,
+		stream:   cfg.StreamName,
+		group:    cfg.ConsumerGroup,
+		consumer: consumer,
+		block:    cfg.ReadBlock,
+		count:    cfg.ReadCount,
+		maxLen:   cfg.RedisMaxLen,
+		// Trimming is started by the first read.
+		trimInterval:   cfg.RedisTrimInterval,
+		trimStop:       make(chan struct{}),
+		trimDone:       make(chan struct{}),
+		claimIdle:      cfg.RedisClaimIdle,
+		claimInterval:  cfg.RedisClaimInterval,
+		consumerExpiry: cfg.RedisConsumerExpiry,
+	}
+	if cfg.RedisBatchSize > 1 {
+		r.batcher = newBatcher(cfg.RedisBatchSize, cfg.RedisBatchInterval, r.flush)
+	}
+	return r
+}
+
+// Enqueue implements Queue. Requests with a delivery time, see WithDeliverAt,
+// are added to a sorted set instead of the stream, and moved to the stream by
+// Dequeue once they are due.
+func (r *Redis) Enqueue(ctx context.Context, id string, data []byte) error {
+	if at := DeliverAtFrom(ctx); !at.IsZero() {
+		err := r.client.ZAdd(ctx, r.stream+delayedSuffix, &redis.Z{
+			Score:  float64(at.UnixNano() / int64(time.Millisecond)),
+			Member: data,
+		}).Err()
+		if err != nil {
+			return fmt.Errorf("failed to schedule %q: %w", id, err)
+		}
+		return nil
+	}
+	if r.batcher != nil {
+		if err := r.batcher.add(ctx, data); err != nil {
+			return fmt.Errorf("failed to publish %q: %w", id, err)
+		}
+		return nil
+	}
+	strCMD := r.client.XAdd(ctx, r.xaddArgs(data))
+	if strCMD.Err() != nil {
+		return fmt.Errorf("failed to publish %q: %w", id, strCMD.Err())
+	}
+	return nil
+}
+
+// EnqueueBatch implements BatchEnqueuer with a MULTI/EXEC transaction, so
+// consumers see either all the requests or none.
+func (r *Redis) EnqueueBatch(ctx context.Context, ids []string, data [][]byte) error {
+	at := DeliverAtFrom(ctx)
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, d := range data {
+			if at.IsZero() {
+				pipe.XAdd(ctx, r.xaddArgs(d))
+			} else {
+				pipe.ZAdd(ctx, r.stream+delayedSuffix, &redis.Z{
+					Score:  float64(at.UnixNano() / int64(time.Millisecond)),
+					Member: d,
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish a batch of %d requests: %w", len(data), err)
+	}
+	return nil
+}
+
+// flush adds a batch of requests to the stream in a single pipeline.
+func (r *Redis) flush(ctx context.Context, batch [][]byte) []error {
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(batch))
+	for i, data := range batch {
+		cmds[i] = pipe.XAdd(ctx, r.xaddArgs(data))
+	}
+	// The errors are those of the commands.
+	pipe.Exec(ctx)
+	errs := make([]error, len(batch))
+	for i, cmd := range cmds {
+		errs[i] = cmd.Err()
+	}
+	return errs
+}
+
+func (r *Redis) xaddArgs(data []byte) *redis.XAddArgs {
+	return &redis.XAddArgs{
+		Stream:       r.stream,
+		MaxLenApprox: r.maxLen,
+		Values: map[string]interface{}{
+			redisDataField: data,
+		},
+	}
+}
+
+// Dequeue implements Queue, reading up to REDIS_READ_COUNT requests at once,
+// or the limit set with WithReadLimit. Requests left pending by other
+// consumers are returned first when they are claimed.
+func (r *Redis) Dequeue(ctx context.Context) ([]Message, error) {
+	if err := r.prepareRead(ctx); err != nil {
+		return nil, err
+	}
+	if claimed := r.claimDue(ctx); len(claimed) > 0 {
+		return claimed, nil
+	}
+	streams, err := r.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    r.group,
+		Consumer: r.consumer,
+		Streams:  []string{r.stream, ">"},
+		Count:    readCount(ctx, r.count),
+		Block:    r.block,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		r.checkGroup(err)
+		return nil, fmt.Errorf("failed to read from stream %q: %w", r.stream, err)
+	}
+	msgs := make([]Message, 0, 1)
+	for _, s := range streams {
+		for _, m := range s.Messages {
+			msgs = append(msgs, Message{ID: m.ID, Data: redisData(m.Values[redisDataField]), Deliveries: 1})
+		}
+	}
+	return msgs, nil
+}
+
+// Ack implements Queue.
+func (r *Redis) Ack(ctx context.Context, msg Message) error {
+	if err := r.client.XAck(ctx, r.stream, r.group, msg.ID).Err(); err != nil {
+		return fmt.Errorf("failed to ack %q: %w", msg.ID, err)
+	}
+	return nil
+}
+
+// DeadLetter implements Queue by writing the message to the stream named
+// after the queue stream with a "-dlq" suffix and acking the original. The
+// failure set with WithFailure is stored in fields named as in
+// Failure.Fields.
+func (r *Redis) DeadLetter(ctx context.Context, msg Message, reason string) error {
+	values := map[string]interface{}{
+		redisDataField:   msg.Data,
+		redisReasonField: reason,
+	}
+	for k, v := range FailureFrom(ctx).Fields() {
+		values[k] = v
+	}
+	err := r.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: r.stream + deadLetterSuffix,
+		Values: values,
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to dead-letter %q: %w", msg.ID, err)
+	}
+	return r.Ack(ctx, msg)
+}
+
+// Replay implements Replayer. Each request is moved from the dead-letter
+// stream to the queue stream in a MULTI/EXEC transaction. The stream is read
+// by pages of redisReplayCount entries, skipping those the ReplayFunc of ctx
+// leaves dead-lettered.
+func (r *Redis) Replay(ctx context.Context, max int) (int, error) {
+	dlq := r.stream + deadLetterSuffix
+	fn := ReplayFuncFrom(ctx)
+	replayed := 0
+	// The entries are read from the last one of the previous page, which is
+	// skipped if it is still there.
+	start, last := "-", ""
+	for replayed < max {
+		count := max - replayed
+		if fn != nil {
+			count = redisReplayCount
+		}
+		entries, err := r.client.XRangeN(ctx, dlq, start, "+", int64(count)+1).Result()
+		if err != nil {
+			return replayed, fmt.Errorf("failed to read dead-lettered requests: %w", err)
+		}
+		if len(entries) > 0 && entries[0].ID == last {
+			entries = entries[1:]
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for _, entry := range entries {
+			if replayed == max {
+				break
+			}
+			data, ok := entry.Values[redisDataField].(string)
+			if !ok {
+				return replayed, fmt.Errorf("dead-lettered entry %q has no %s field", entry.ID, redisDataField)
+			}
+			record := []byte(data)
+			if fn != nil {
+				if record, ok = fn(record); !ok {
+					continue
+				}
+			}
+			_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.XAdd(ctx, r.xaddArgs(record))
+				pipe.XDel(ctx, dlq, entry.ID)
+				return nil
+			})
+			if err != nil {
+				return replayed, fmt.Errorf("failed to replay %q: %w", entry.ID, err)
+			}
+			replayed++
+		}
+		start, last = entries[len(entries)-1].ID, entries[len(entries)-1].ID
+	}
+	return replayed, nil
+}
+
+// ListDeadLetters implements DeadLetterLister, reading the oldest entries of
+// the dead-letter stream.
+func (r *Redis) ListDeadLetters(ctx context.Context, max int) ([]DeadLetteredMessage, error) {
+	if max <= 0 {
+		return nil, nil
+	}
+	dlq := r.stream + deadLetterSuffix
+	entries, err := r.client.XRangeN(ctx, dlq, "-", "+", int64(max)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead-lettered requests: %w", err)
+	}
+	return deadLetteredMessages(entries), nil
+}
+
+// ListRecentDeadLetters implements RecentDeadLetterLister, reading the newest
+// entries of the dead-letter stream.
+func (r *Redis) ListRecentDeadLetters(ctx context.Context, max int) ([]DeadLetteredMessage, error) {
+	if max <= 0 {
+		return nil, nil
+	}
+	dlq := r.stream + deadLetterSuffix
+	entries, err := r.client.XRevRangeN(ctx, dlq, "+", "-", int64(max)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead-lettered requests: %w", err)
+	}
+	return deadLetteredMessages(entries), nil
+}
+
+// deadLetteredMessages returns the requests of the entries of a dead-letter
+// stream.
+func deadLetteredMessages(entries []redis.XMessage) []DeadLetteredMessage {
+	msgs := make([]DeadLetteredMessage, 0, len(entries))
+	for _, entry := range entries {
+		field := func(name string) string {
+			v, _ := entry.Values[name].(string)
+			return v
+		}
+		msgs = append(msgs, DeadLetteredMessage{
+			Message:      Message{ID: entry.ID, Data: []byte(field(redisDataField))},
+			Reason:       field(redisReasonField),
+			Failure:      failureFromFields(field),
+			DeadLettered: redisIDTime(entry.ID),
+		})
+	}
+	return msgs
+}
+
+// Purge implements Purger. The delayed requests are read from their sorted
+// set, and the others from the stream after those in flight, by pages of
+// redisPurgeCount entries. The selected ones are deleted once each page is
+// read.
+func (r *Redis) Purge(ctx context.Context, fn PurgeFunc) (int, error) {
+	purged, err := r.purgeDelayed(ctx, fn)
+	if err != nil {
+		return purged, err
+	}
+	msgs, err := r.Pending(ctx, redisPurgeCount)
+	if err != nil {
+		return purged, err
+	}
+	// The first page lists the entries in flight first, then those not
+	// read yet, from which the next pages are read.
+	last := ""
+	for {
+		var ids []string
+		for _, msg := range msgs {
+			if msg.InFlight {
+				continue
+			}
+			last = msg.ID
+			if fn(msg.Data) {
+				ids = append(ids, msg.ID)
+			}
+		}
+		if len(ids) > 0 {
+			if err := r.client.XDel(ctx, r.stream, ids...).Err(); err != nil {
+				return purged, fmt.Errorf("failed to purge the requests of stream %q: %w", r.stream, err)
+			}
+			purged += len(ids)
+		}
+		if len(msgs) < redisPurgeCount || last == "" {
+			return purged, nil
+		}
+		entries, err := r.client.XRangeN(ctx, r.stream, last, "+", redisPurgeCount+1).Result()
+		if err != nil {
+			return purged, fmt.Errorf("failed to read the requests of stream %q: %w", r.stream, err)
+		}
+		if len(entries) > 0 && entries[0].ID == last {
+			entries = entries[1:]
+		}
+		msgs = msgs[:0]
+		for _, entry := range entries {
+			msgs = append(msgs, PendingMessage{Message: Message{ID: entry.ID, Data: redisData(entry.Values[redisDataField])}})
+		}
+	}
+}
+
+// purgeDelayed deletes the delayed requests that fn selects.
+func (r *Redis) purgeDelayed(ctx context.Context, fn PurgeFunc) (int, error) {
+	key := r.stream + delayedSuffix
+	purged := 0
+	for start := int64(0); ; {
+		members, err := r.client.ZRange(ctx, key, start, start+redisPurgeCount-1).Result()
+		if err != nil {
+			return purged, fmt.Errorf("failed to read the delayed requests of stream %q: %w", r.stream, err)
+		}
+		var selected []interface{}
+		for _, m := range members {
+			if fn([]byte(m)) {
+				selected = append(selected, m)
+			}
+		}
+		if len(selected) > 0 {
+			if err := r.client.ZRem(ctx, key, selected...).Err(); err != nil {
+				return purged, fmt.Errorf("failed to purge the delayed requests of stream %q: %w", r.stream, err)
+			}
+			purged += len(selected)
+		}
+		if len(members) < redisPurgeCount {
+			return purged, nil
+		}
+		// The members left are read again from where the page ended.
+		start += int64(len(members) - len(selected))
+	}
+}
+
+// Delayed implements DelayedLister, reading the sorted set of the delayed
+// requests. Their ID is left empty, they are removed by their record.
+func (r *Redis) Delayed(ctx context.Context, max int) ([]DelayedMessage, error) {
+	members, err := r.client.ZRangeWithScores(ctx, r.stream+delayedSuffix, 0, int64(max)-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the delayed requests of stream %q: %w", r.stream, err)
+	}
+	msgs := make([]DelayedMessage, 0, len(members))
+	for _, m := range members {
+		data, _ := m.Member.(string)
+		msgs = append(msgs, DelayedMessage{
+			Message:   Message{Data: []byte(data)},
+			DeliverAt: time.Unix(0, int64(m.Score)*int64(time.Millisecond)),
+		})
+	}
+	return msgs, nil
+}
+
+// RemoveDelayed implements DelayedLister.
+func (r *Redis) RemoveDelayed(ctx context.Context, msg DelayedMessage) error {
+	if err := r.client.ZRem(ctx, r.stream+delayedSuffix, string(msg.Data)).Err(); err != nil {
+		return fmt.Errorf("failed to remove a delayed request of stream %q: %w", r.stream, err)
+	}
+	return nil
+}
+
+// Backlog implements BacklogReader. Without the lag of the consumer group,
+// which Redis 7 reports, the requests not read yet are listed to be counted.
+func (r *Redis) Backlog(ctx context.Context) (Backlog, error) {
+	res, err := streamBacklog.Run(ctx, r.client, []string{r.stream}, r.group).Result()
+	if err != nil {
+		return Backlog{}, fmt.Errorf("failed to read the backlog of stream %q: %w", r.stream, err)
+	}
+	vals, ok := res.([]interface{})
+	if !ok || len(vals) == 0 {
+		return Backlog{}, fmt.Errorf("unexpected backlog of stream %q: %v", r.stream, res)
+	}
+	depth, _ := vals[0].(int64)
+	b := Backlog{Depth: depth}
+	if len(vals) > 1 {
+		if id, ok := vals[1].(string); ok {
+			b.Oldest = redisIDTime(id)
+		}
+	}
+	return b, nil
+}
+
+// StreamBacklogs implements StreamBacklogReader.
+func (r *Redis) StreamBacklogs(ctx context.Context) (map[string]Backlog, error) {
+	b, err := r.Backlog(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]Backlog{r.stream: b}, nil
+}
+
+// Pending implements PendingLister. Entries pending in the group for longer
+// than the delivery of a request, see REDIS_CLAIM_IDLE, are listed as in
+// flight until they are claimed.
+func (r *Redis) Pending(ctx context.Context, max int) ([]PendingMessage, error) {
+	if max <= 0 {
+		return nil, nil
+	}
+	res, err := streamPending.Run(ctx, r.client, []string{r.stream}, r.group, max, redisDataField).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to list the requests of stream %q: %w", r.stream, err)
+	}
+	entries, _ := res.([]interface{})
+	msgs := make([]PendingMessage, 0, len(entries))
+	for _, e := range entries {
+		vals, ok := e.([]interface{})
+		if !ok || len(vals) != 4 {
+			return nil, fmt.Errorf("unexpected request of stream %q: %v", r.stream, e)
+		}
+		id, _ := vals[0].(string)
+		inflight, _ := vals[2].(int64)
+		reads, _ := vals[3].(int64)
+		msgs = append(msgs, PendingMessage{
+			Message:  Message{ID: id, Data: redisData(vals[1]), Deliveries: int(reads)},
+			InFlight: inflight == 1,
+			Enqueued: redisIDTime(id),
+		})
+	}
+	return msgs, nil
+}
+
+// Close implements Queue. Pending batched writes are flushed first.
+func (r *Redis) Close() error {
+	r.stopBackground()
+	if c, ok := r.client.(*redis.Client); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// CheckHealth implements HealthChecker. Consumers also check that the stream
+// and consumer group, which Dequeue creates, exist.
+func (r *Redis) CheckHealth(ctx context.Context, consuming bool) error {
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("failed to reach redis: %w", err)
+	}
+	if !consuming {
+		return nil
+	}
+	groups, err := r.client.XInfoGroups(ctx, r.stream).Result()
+	if err != nil {
+		return fmt.Errorf("failed to list consumer groups of %q: %w", r.stream, err)
+	}
+	for _, g := range groups {
+		if g.Name == r.group {
+			return nil
+		}
+	}
+	return fmt.Errorf("consumer group %q of stream %q does not exist", r.group, r.stream)
+}
+
+// prepareRead makes sure the consumer group exists and moves the delayed
+// requests that are due to the stream. The first call starts trimming the
+// stream if it is capped.
+func (r *Redis) prepareRead(ctx context.Context) error {
+	if err := r.ensureGroup(ctx); err != nil {
+		return err
+	}
+	r.trimStart.Do(func() {
+		if r.maxLen > 0 && r.trimInterval > 0 {
+			go r.trimLoop(logging.FromContext(ctx))
+		} else {
+			close(r.trimDone)
+		}
+	})
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	err := promoteDelayed.Run(ctx, r.client, []string{r.stream + delayedSuffix, r.stream}, now).Err()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to promote delayed requests: %w", err)
+	}
+	return nil
+}
+
+// trimLoop trims the stream every trim interval until the queue is closed.
+func (r *Redis) trimLoop(logger *zap.SugaredLogger) {
+	defer close(r.trimDone)
+	ticker := time.NewTicker(r.trimInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.trim(context.Background()); err != nil {
+				logger.Errorw("Error trimming stream", zap.Error(err))
+			}
+		case <-r.trimStop:
+			return
+		}
+	}
+}
+
+// trim caps the stream to about maxLen entries and records how many were
+// removed. Trimmed requests are lost, whether they were read or not.
+func (r *Redis) trim(ctx context.Context) error {
+	n, err := r.client.XTrimApprox(ctx, r.stream, r.maxLen).Result()
+	if err != nil {
+		return fmt.Errorf("failed to trim %q: %w", r.stream, err)
+	}
+	if n > 0 {
+		recordTrimmed(r.stream, n)
+	}
+	return nil
+}
+
+// claimDue claims the requests left pending by consumers when a claim is
+// due. Claims go on with the next read as long as full batches are claimed,
+// then expired consumers are removed. Errors are logged, so reading goes on.
+func (r *Redis) claimDue(ctx context.Context) []Message {
+	if r.claimIdle <= 0 || r.claimInterval <= 0 || time.Now().Before(r.nextClaim) {
+		return nil
+	}
+	logger := logging.FromContext(ctx)
+	msgs, err := r.claim(ctx)
+	if err != nil {
+		logger.Errorw("Error claiming pending requests", zap.Error(err))
+	}
+	if len(msgs) < redisClaimCount {
+		r.nextClaim = time.Now().Add(r.claimInterval)
+		if removed, err := r.expireConsumers(ctx); err != nil {
+			logger.Errorw("Error removing idle consumers", zap.Error(err))
+		} else if len(removed) > 0 {
+			logger.Infow("Removed idle consumers from the group", zap.Strings("consumers", removed))
+		}
+	}
+	return msgs
+}
+
+// expireConsumers removes the other consumers of the group that are idle for
+// consumerExpiry with no pending requests, and returns their names. Consumers
+// removed while alive are added back by their next read.
+func (r *Redis) expireConsumers(ctx context.Context) ([]string, error) {
+	if r.consumerExpiry <= 0 {
+		return nil, nil
+	}
+	res, err := removeIdleConsumers.Run(ctx, r.client, []string{r.stream}, r.group, r.consumer, int64(r.consumerExpiry/time.Millisecond)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to remove idle consumers of %q: %w", r.group, err)
+	}
+	names, _ := res.([]interface{})
+	removed := make([]string, 0, len(names))
+	for _, n := range names {
+		if s, ok := n.(string); ok {
+			removed = append(removed, s)
+		}
+	}
+	return removed, nil
+}
+
+// claim takes over the oldest pending requests that were not acked for
+// claimIdle, whichever consumer read them, and records how many were
+// claimed. Requests claimed again while their delivery is in flight are
+// delivered twice, so claimIdle must be longer than the longest delivery.
+func (r *Redis) claim(ctx context.Context) ([]Message, error) {
+	pending, err := r.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: r.stream,
+		Group:  r.group,
+		Start:  "-",
+		End:    "+",
+		Count:  redisClaimCount,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pending requests of %q: %w", r.stream, err)
+	}
+	return r.claimPending(ctx, pending)
+}
+
+// claimPending claims the pending requests that are idle for claimIdle.
+func (r *Redis) claimPending(ctx context.Context, pending []redis.XPendingExt) ([]Message, error) {
+	ids := make([]string, 0, len(pending))
+	// Claiming counts as a delivery.
+	deliveries := make(map[string]int, len(pending))
+	for _, p := range pending {
+		if p.Idle >= r.claimIdle {
+			ids = append(ids, p.ID)
+			deliveries[p.ID] = int(p.RetryCount) + 1
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	// XCLAIM checks the idle time again, so requests acked or claimed by
+	// another consumer in the meantime are left alone.
+	claimed, err := r.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   r.stream,
+		Group:    r.group,
+		Consumer: r.consumer,
+		MinIdle:  r.claimIdle,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim pending requests of %q: %w", r.stream, err)
+	}
+	msgs := make([]Message, 0, len(claimed))
+	for _, m := range claimed {
+		msgs = append(msgs, Message{ID: m.ID, Data: redisData(m.Values[redisDataField]), Deliveries: deliveries[m.ID]})
+	}
+	if len(msgs) > 0 {
+		recordClaimed(r.stream, int64(len(msgs)))
+	}
+	return msgs, nil
+}
+
+// stopBackground flushes pending batched writes and stops trimming. Only the
+// first call does anything.
+func (r *Redis) stopBackground() {
+	r.stopOnce.Do(func() {
+		if r.batcher != nil {
+			r.batcher.close()
+		}
+		// Keep trimming from starting.
+		r.trimStart.Do(func() { close(r.trimDone) })
+		close(r.trimStop)
+		<-r.trimDone
+	})
+}
+
+// ensureGroup creates the consumer group, and the stream if needed, the first
+// time it is called.
+func (r *Redis) ensureGroup(ctx context.Context) error {
+	if r.groupReady {
+		return nil
+	}
+	err := r.client.XGroupCreateMkStream(ctx, r.stream, r.group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("failed to create consumer group %q: %w", r.group, err)
+	}
+	r.groupReady = true
+	return nil
+}
+
+// checkGroup makes the next read create the consumer group again when err
+// reports it missing, such as after the stream was deleted.
+func (r *Redis) checkGroup(err error) {
+	if strings.HasPrefix(err.Error(), "NOGROUP") {
+		r.groupReady = false
+	}
+}
+
+// redisData converts a stream value, which go-redis returns as a string,
+// back to bytes.
+func redisData(v interface{}) []byte {
+	switch d := v.(type) {
+	case string:
+		return []byte(d)
+	case []byte:
+		return d
+	}
+	return nil
+}
+
+// redisIDTime returns the time a stream entry was added, the first part of
+// its ID in milliseconds, or the zero time if id is not an entry ID.
+func redisIDTime(id string) time.Time {
+	ms, err := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Route names are used as queue name suffixes, so they are kept to what
+// every backend accepts.
+var routeName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// reservedRouteWords are the suffixes of the other queues stored next to the
+// configured one, which route names cannot contain as a dash-separated word:
+// a route named "dlq", or "orders-dlq", would share the dead-letter queue of
+// the configured queue, or of the "orders" route. Numbers, the suffixes of
+// shards, are reserved as well.
+var reservedRouteWords = map[string]bool{
+	strings.TrimPrefix(deadLetterSuffix, "-"): true,
+	strings.TrimPrefix(delayedSuffix, "-"):    true,
+	string(PriorityHigh):                      true,
+	string(PriorityNormal):                    true,
+	string(PriorityLow):                       true,
+}
+
+// RouteConfig selects a named queue, stored next to the configured one with
+// the route name as suffix, so workloads can be isolated from each other.
+type RouteConfig struct {
+	// QueueRoute is the route read by a consumer. It uses the configured
+	// queue when empty.
+	QueueRoute string `envconfig:"QUEUE_ROUTE"`
+}
+
+// CheckRoute returns an error if name cannot be used as a route name.
+func CheckRoute(name string) error {
+	if !routeName.MatchString(name) {
+		return fmt.Errorf("invalid route name %q, want lowercase letters, digits and dashes", name)
+	}
+	for _, word := range strings.Split(name, "-") {
+		if _, err := strconv.Atoi(word); err == nil || reservedRouteWords[word] {
+			return fmt.Errorf("invalid route name %q, %q is reserved", name, word)
+		}
+	}
+	return nil
+}
+
+type routeKey struct{}
+
+// WithRoute returns a context asking routed queues to store requests
+// enqueued with it in the queue of route name.
+func WithRoute(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, routeKey{}, name)
+}
+
+// RouteFrom returns the route set on ctx, or "" for the configured queue.
+func RouteFrom(ctx context.Context) string {
+	name, _ := ctx.Value(routeKey{}).(string)
+	return name
+}
+
+// Routed is a Queue writing requests to the queue of the route set on their
+// context, see WithRoute. It reads from, and acks on, the configured queue:
+// each route is read by consumers with QUEUE_ROUTE set to its name.
+type Routed struct {
+	Queue
+	routes map[string]Queue
+}
+
+var (
+	_ Queue         = (*Routed)(nil)
+	_ HealthChecker = (*Routed)(nil)
+	_ BatchEnqueuer = (*Routed)(nil)
+)
+
+// NewRouted creates the queue described by cfg, and one for every route.
+func NewRouted(ctx context.Context, cfg Config, routes []string) (*Routed, error) {
+	q, err := New(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	r := &Routed{Queue: q, routes: make(map[string]Queue, len(routes))}
+	for _, name := range routes {
+		routeCfg := cfg
+		routeCfg.QueueRoute = name
+		q, err := New(ctx, routeCfg)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("failed to create queue of route %q: %w", name, err)
+		}
+		r.routes[name] = q
+	}
+	return r, nil
+}
+
+// Enqueue implements Queue.
+func (r *Routed) Enqueue(ctx context.Context, id string, data []byte) error {
+	name := RouteFrom(ctx)
+	if name == "" {
+		return r.Queue.Enqueue(ctx, id, data)
+	}
+	q, ok := r.routes[name]
+	if !ok {
+		return fmt.Errorf("unknown route %q", name)
+	}
+	return q.Enqueue(ctx, id, data)
+}
+
+// EnqueueBatch implements BatchEnqueuer if the queue of the route does.
+func (r *Routed) EnqueueBatch(ctx context.Context, ids []string, data [][]byte) error {
+	name := RouteFrom(ctx)
+	if name == "" {
+		return EnqueueBatch(ctx, r.Queue, ids, data)
+	}
+	q, ok := r.routes[name]
+	if !ok {
+		return fmt.Errorf("unknown route %q", name)
+	}
+	return EnqueueBatch(ctx, q, ids, data)
+}
+
+// Close implements Queue.
+func (r *Routed) Close() error {
+	firstErr := r.Queue.Close()
+	for _, q := range r.routes {
+		if err := q.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// CheckHealth implements HealthChecker by checking the queue of every route.
+func (r *Routed) CheckHealth(ctx context.Context, consuming bool) error {
+	if err := CheckHealth(ctx, r.Queue, consuming); err != nil {
+		return err
+	}
+	for name, q := range r.routes {
+		if err := CheckHealth(ctx, q, consuming); err != nil {
+			return fmt.Errorf("route %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// forRoute returns the configuration of the queue of route name.
+func (cfg Config) forRoute(name string) (Config, error) {
+	if err := CheckRoute(name); err != nil {
+		return cfg, err
+	}
+	cfg, ok := cfg.withSuffix(name)
+	if !ok {
+		return cfg, fmt.Errorf("routes are not supported by the %q backend", cfg.Backend)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRouted(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{
+		Backend:      BackendMemory,
+		MemoryConfig: MemoryConfig{MemoryQueueName: t.Name(), MemoryReadTimeout: 10 * time.Millisecond},
+	}
+	r, err := NewRouted(ctx, cfg, []string{"batch"})
+	if err != nil {
+		t.Fatal("NewRouted() =", err)
+	}
+	defer r.Close()
+
+	if err := r.Enqueue(WithRoute(ctx, "batch"), "routed", nil); err != nil {
+		t.Fatal("Enqueue() =", err)
+	}
+	if err := r.Enqueue(ctx, "default", nil); err != nil {
+		t.Fatal("Enqueue() =", err)
+	}
+	if err := r.Enqueue(WithRoute(ctx, "unknown"), "unknown", nil); err == nil {
+		t.Error("Enqueue() to an unknown route succeeded")
+	}
+
+	// Consumers of the route read its queue.
+	cfg.QueueRoute = "batch"
+	batch, err := New(ctx, cfg)
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	defer batch.Close()
+	for _, test := range []struct {
+		q    Queue
+		want string
+	}{{batch, "routed"}, {r, "default"}} {
+		msgs, err := test.q.Dequeue(ctx)
+		if err != nil || len(msgs) != 1 || msgs[0].ID != test.want {
+			t.Errorf("Dequeue() = %v, %v, want %q", msgs, err, test.want)
+		}
+	}
+}
+
+func TestForRoute(t *testing.T) {
+	cfg := Config{Backend: BackendRedis, RedisConfig: RedisConfig{StreamName: "requests"}}
+	got, err := cfg.forRoute("batch")
+	if err != nil || got.StreamName != "requests-batch" {
+		t.Errorf("forRoute() = %q, %v, want requests-batch", got.StreamName, err)
+	}
+	if _, err := cfg.forRoute("Batch"); err == nil {
+		t.Error("forRoute() with an invalid name succeeded")
+	}
+	if got, err := cfg.forRoute("batch2"); err != nil || got.StreamName != "requests-batch2" {
+		t.Errorf("forRoute() = %q, %v, want requests-batch2", got.StreamName, err)
+	}
+	cfg.Backend = BackendSQS
+	if _, err := cfg.forRoute("batch"); err == nil {
+		t.Error("forRoute() of an unsupported backend succeeded")
+	}
+}
+
+func TestCheckRouteReserved(t *testing.T) {
+	// These would share the stream, or sorted set, of a dead-letter queue,
+	// delayed requests, a priority level or a shard.
+	for _, name := range []string{"dlq", "delayed", "high", "normal", "low", "1", "orders-dlq", "orders-delayed", "orders-high", "low-orders", "orders-2"} {
+		if err := CheckRoute(name); err == nil {
+			t.Errorf("CheckRoute(%q) succeeded", name)
+		}
+	}
+}
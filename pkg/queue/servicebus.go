@@ -0,0 +1,275 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	servicebus "github.com/Azure/azure-service-bus-go"
+	"go.uber.org/zap"
+	"knative.dev/pkg/logging"
+)
+
+// ServiceBusConfig holds the environment configuration of the Azure Service
+// Bus backend. When no connection string is set, the namespace is accessed
+// with the Azure AD identity found in the environment: a service principal
+// from AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET, or else the
+// managed identity of the pod.
+type ServiceBusConfig struct {
+	ServiceBusConnectionString string        `envconfig:"SERVICEBUS_CONNECTION_STRING"`
+	ServiceBusNamespace        string        `envconfig:"SERVICEBUS_NAMESPACE"`
+	ServiceBusQueue            string        `envconfig:"SERVICEBUS_QUEUE"`
+	ServiceBusSessions         bool          `envconfig:"SERVICEBUS_SESSIONS"`
+	ServiceBusSessionIdle      time.Duration `envconfig:"SERVICEBUS_SESSION_IDLE_TIMEOUT" default:"10s"`
+	ServiceBusPrefetch         uint32        `envconfig:"SERVICEBUS_PREFETCH" default:"1"`
+	ServiceBusReadTimeout      time.Duration `envconfig:"SERVICEBUS_READ_TIMEOUT" default:"5s"`
+}
+
+// ServiceBus is a Queue backed by an Azure Service Bus queue. Undeliverable
+// requests are moved to the native dead-letter sub-queue.
+type ServiceBus struct {
+	cfg   ServiceBusConfig
+	queue serviceBusQueue
+
+	startReceive sync.Once
+	cancel       context.CancelFunc
+	messages     chan serviceBusDelivery
+
+	mu       sync.Mutex
+	inflight map[string]serviceBusDelivery
+}
+
+// serviceBusDelivery is a message handed out by Dequeue. The receive handler
+// blocks until done is closed, so the message is not settled with the
+// queue's default disposition before it is acked.
+type serviceBusDelivery struct {
+	msg  *servicebus.Message
+	done chan struct{}
+}
+
+var _ Queue = (*ServiceBus)(nil)
+
+// serviceBusQueue is the part of *servicebus.Queue used by ServiceBus, with
+// the settlement of the messages it received.
+type serviceBusQueue interface {
+	Send(ctx context.Context, msg *servicebus.Message) error
+	Receive(ctx context.Context, handler servicebus.Handler) error
+	NewSession(sessionID *string) *servicebus.QueueSession
+	Close(ctx context.Context) error
+
+	complete(ctx context.Context, msg *servicebus.Message) error
+	abandon(ctx context.Context, msg *servicebus.Message) error
+	deadLetter(ctx context.Context, msg *servicebus.Message, reason error, fields map[string]string) error
+}
+
+// azureQueue is a serviceBusQueue on a Service Bus namespace.
+type azureQueue struct {
+	*servicebus.Queue
+}
+
+func (q azureQueue) complete(ctx context.Context, msg *servicebus.Message) error {
+	return msg.Complete(ctx)
+}
+
+func (q azureQueue) abandon(ctx context.Context, msg *servicebus.Message) error {
+	return msg.Abandon(ctx)
+}
+
+func (q azureQueue) deadLetter(ctx context.Context, msg *servicebus.Message, reason error, fields map[string]string) error {
+	return msg.DeadLetterWithInfo(ctx, reason, servicebus.ErrorInternalError, fields)
+}
+
+// NewServiceBus connects to the Service Bus queue described by cfg.
+func NewServiceBus(ctx context.Context, cfg ServiceBusConfig) (*ServiceBus, error) {
+	if cfg.ServiceBusQueue == "" {
+		return nil, errors.New("SERVICEBUS_QUEUE must be set")
+	}
+	var opt servicebus.NamespaceOption
+	switch {
+	case cfg.ServiceBusConnectionString != "":
+		opt = servicebus.NamespaceWithConnectionString(cfg.ServiceBusConnectionString)
+	case cfg.ServiceBusNamespace != "":
+		opt = servicebus.NamespaceWithEnvironmentBinding(cfg.ServiceBusNamespace)
+	default:
+		return nil, errors.New("SERVICEBUS_CONNECTION_STRING or SERVICEBUS_NAMESPACE must be set")
+	}
+	ns, err := servicebus.NewNamespace(opt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create servicebus namespace: %w", err)
+	}
+	q, err := ns.NewQueue(cfg.ServiceBusQueue, servicebus.QueueWithPrefetchCount(cfg.ServiceBusPrefetch))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create servicebus queue client: %w", err)
+	}
+	return newServiceBusFromQueue(azureQueue{q}, cfg), nil
+}
+
+// newServiceBusFromQueue returns a ServiceBus sending to and receiving from q.
+func newServiceBusFromQueue(q serviceBusQueue, cfg ServiceBusConfig) *ServiceBus {
+	return &ServiceBus{
+		cfg:      cfg,
+		queue:    q,
+		messages: make(chan serviceBusDelivery),
+		inflight: make(map[string]serviceBusDelivery),
+	}
+}
+
+// Enqueue implements Queue. On session enabled queues the ordering key, see
+// WithOrderingKey, is used as the session ID so requests sharing it are
+// delivered in order. Delivery times, see WithDeliverAt, are passed as the
+// scheduled enqueue time of the message.
+func (s *ServiceBus) Enqueue(ctx context.Context, id string, data []byte) error {
+	msg := servicebus.NewMessage(data)
+	msg.ID = id
+	if at := DeliverAtFrom(ctx); !at.IsZero() {
+		msg.ScheduleAt(at)
+	}
+	if s.cfg.ServiceBusSessions {
+		session := OrderingKeyFrom(ctx)
+		if session == "" {
+			session = id
+		}
+		msg.SessionID = &session
+	}
+	if err := s.queue.Send(ctx, msg); err != nil {
+		return fmt.Errorf("failed to publish %q: %w", id, err)
+	}
+	return nil
+}
+
+// Dequeue implements Queue.
+func (s *ServiceBus) Dequeue(ctx context.Context) ([]Message, error) {
+	s.startReceive.Do(func() { s.receive(logging.FromContext(ctx)) })
+	select {
+	case d := <-s.messages:
+		id := d.msg.LockToken.String()
+		s.mu.Lock()
+		s.inflight[id] = d
+		s.mu.Unlock()
+		return []Message{{ID: id, Data: d.msg.Data, Deliveries: int(d.msg.DeliveryCount)}}, nil
+	case <-time.After(s.cfg.ServiceBusReadTimeout):
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Ack implements Queue.
+func (s *ServiceBus) Ack(ctx context.Context, msg Message) error {
+	d, err := s.take(msg.ID)
+	if err != nil {
+		return err
+	}
+	defer close(d.done)
+	if err := s.queue.complete(ctx, d.msg); err != nil {
+		return fmt.Errorf("failed to complete %q: %w", msg.ID, err)
+	}
+	return nil
+}
+
+// DeadLetter implements Queue.
+func (s *ServiceBus) DeadLetter(ctx context.Context, msg Message, reason string) error {
+	d, err := s.take(msg.ID)
+	if err != nil {
+		return err
+	}
+	defer close(d.done)
+	if err := s.queue.deadLetter(ctx, d.msg, errors.New(reason), FailureFrom(ctx).Fields()); err != nil {
+		return fmt.Errorf("failed to dead-letter %q: %w", msg.ID, err)
+	}
+	return nil
+}
+
+// Close implements Queue.
+func (s *ServiceBus) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	return s.queue.Close(context.Background())
+}
+
+// receive starts receiving from the queue, or from its sessions one at a
+// time, until Close is called.
+func (s *ServiceBus) receive(logger *zap.SugaredLogger) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go func() {
+		for ctx.Err() == nil {
+			var err error
+			if s.cfg.ServiceBusSessions {
+				err = s.receiveSession(ctx)
+			} else {
+				err = s.queue.Receive(ctx, servicebus.HandlerFunc(s.handle))
+			}
+			if err != nil && ctx.Err() == nil {
+				logger.Errorw("Error receiving from servicebus", zap.Error(err))
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+}
+
+// receiveSession locks the next available session and receives from it until
+// it has been idle for SERVICEBUS_SESSION_IDLE_TIMEOUT.
+func (s *ServiceBus) receiveSession(ctx context.Context) error {
+	session := s.queue.NewSession(nil)
+	defer session.Close(context.Background())
+
+	var idle *time.Timer
+	handler := servicebus.NewSessionHandler(
+		servicebus.HandlerFunc(func(ctx context.Context, msg *servicebus.Message) error {
+			idle.Stop()
+			defer idle.Reset(s.cfg.ServiceBusSessionIdle)
+			return s.handle(ctx, msg)
+		}),
+		func(ms *servicebus.MessageSession) error {
+			idle = time.AfterFunc(s.cfg.ServiceBusSessionIdle, ms.Close)
+			return nil
+		},
+		func() {
+			idle.Stop()
+		})
+	return session.ReceiveOne(ctx, handler)
+}
+
+// handle hands msg to Dequeue and waits for it to be settled.
+func (s *ServiceBus) handle(ctx context.Context, msg *servicebus.Message) error {
+	d := serviceBusDelivery{msg: msg, done: make(chan struct{})}
+	select {
+	case s.messages <- d:
+	case <-ctx.Done():
+		return s.queue.abandon(context.Background(), msg)
+	}
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+// take removes and returns an in-flight message.
+func (s *ServiceBus) take(id string) (serviceBusDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.inflight[id]
+	if !ok {
+		return serviceBusDelivery{}, fmt.Errorf("unknown message %q", id)
+	}
+	delete(s.inflight, id)
+	return d, nil
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-amqp-common-go/v3/uuid"
+	servicebus "github.com/Azure/azure-service-bus-go"
+)
+
+// fakeServiceBus is a queue handing the messages of deliveries to the
+// receive handler and recording how they are settled.
+type fakeServiceBus struct {
+	serviceBusQueue
+
+	mu           sync.Mutex
+	sent         []*servicebus.Message
+	deliveries   chan *servicebus.Message
+	handled      chan error
+	completed    []*servicebus.Message
+	abandoned    []*servicebus.Message
+	deadLettered []fakeDeadLetter
+}
+
+type fakeDeadLetter struct {
+	msg    *servicebus.Message
+	reason string
+	fields map[string]string
+}
+
+func newFakeServiceBus() *fakeServiceBus {
+	return &fakeServiceBus{
+		deliveries: make(chan *servicebus.Message, 10),
+		handled:    make(chan error, 10),
+	}
+}
+
+func (f *fakeServiceBus) Send(_ context.Context, msg *servicebus.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, msg)
+	return nil
+}
+
+func (f *fakeServiceBus) Receive(ctx context.Context, handler servicebus.Handler) error {
+	for {
+		select {
+		case msg := <-f.deliveries:
+			f.handled <- handler.Handle(ctx, msg)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (f *fakeServiceBus) Close(context.Context) error {
+	return nil
+}
+
+func (f *fakeServiceBus) complete(_ context.Context, msg *servicebus.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.completed = append(f.completed, msg)
+	return nil
+}
+
+func (f *fakeServiceBus) abandon(_ context.Context, msg *servicebus.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.abandoned = append(f.abandoned, msg)
+	return nil
+}
+
+func (f *fakeServiceBus) deadLetter(_ context.Context, msg *servicebus.Message, reason error, fields map[string]string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deadLettered = append(f.deadLettered, fakeDeadLetter{msg: msg, reason: reason.Error(), fields: fields})
+	return nil
+}
+
+// deliver queues a message received for the nth time.
+func (f *fakeServiceBus) deliver(t *testing.T, data string, count uint32) *servicebus.Message {
+	t.Helper()
+	token, err := uuid.NewV4()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := servicebus.NewMessageFromString(data)
+	msg.LockToken = &token
+	msg.DeliveryCount = count
+	f.deliveries <- msg
+	return msg
+}
+
+func newTestServiceBus(f *fakeServiceBus, sessions bool) *ServiceBus {
+	return newServiceBusFromQueue(f, ServiceBusConfig{
+		ServiceBusQueue:       "requests",
+		ServiceBusSessions:    sessions,
+		ServiceBusReadTimeout: time.Second,
+	})
+}
+
+func TestServiceBusEnqueue(t *testing.T) {
+	at := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		sessions bool
+		ctx      context.Context
+		session  string
+		schedule time.Time
+	}{{
+		name: "plain",
+		ctx:  context.Background(),
+	}, {
+		name:     "delayed",
+		ctx:      WithDeliverAt(context.Background(), at),
+		schedule: at,
+	}, {
+		name: "ordering key without sessions",
+		ctx:  WithOrderingKey(context.Background(), "tenant"),
+	}, {
+		name:     "session from ordering key",
+		sessions: true,
+		ctx:      WithOrderingKey(context.Background(), "tenant"),
+		session:  "tenant",
+	}, {
+		name:     "session from id",
+		sessions: true,
+		ctx:      context.Background(),
+		session:  "id",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeServiceBus()
+			s := newTestServiceBus(f, tt.sessions)
+			if err := s.Enqueue(tt.ctx, "id", []byte("data")); err != nil {
+				t.Fatal("Enqueue() =", err)
+			}
+			if len(f.sent) != 1 {
+				t.Fatalf("sent %d messages, want 1", len(f.sent))
+			}
+			msg := f.sent[0]
+			if msg.ID != "id" || string(msg.Data) != "data" {
+				t.Errorf("sent %q with %q, want id with data", msg.ID, msg.Data)
+			}
+			var session string
+			if msg.SessionID != nil {
+				session = *msg.SessionID
+			}
+			if session != tt.session {
+				t.Errorf("session = %q, want %q", session, tt.session)
+			}
+			var schedule time.Time
+			if msg.SystemProperties != nil && msg.SystemProperties.ScheduledEnqueueTime != nil {
+				schedule = *msg.SystemProperties.ScheduledEnqueueTime
+			}
+			if !schedule.Equal(tt.schedule) {
+				t.Errorf("scheduled at %v, want %v", schedule, tt.schedule)
+			}
+		})
+	}
+}
+
+func TestServiceBusAck(t *testing.T) {
+	f := newFakeServiceBus()
+	s := newTestServiceBus(f, false)
+	defer s.Close()
+	sent := f.deliver(t, "data", 2)
+
+	ctx := context.Background()
+	msgs, err := s.Dequeue(ctx)
+	if err != nil {
+		t.Fatal("Dequeue() =", err)
+	}
+	if len(msgs) != 1 || string(msgs[0].Data) != "data" || msgs[0].Deliveries != 2 {
+		t.Fatalf("Dequeue() = %+v, want data delivered twice", msgs)
+	}
+	if msgs[0].ID != sent.LockToken.String() {
+		t.Errorf("ID = %q, want the lock token %q", msgs[0].ID, sent.LockToken)
+	}
+	select {
+	case <-f.handled:
+		t.Fatal("handler returned before the message was settled")
+	default:
+	}
+
+	if err := s.Ack(ctx, msgs[0]); err != nil {
+		t.Fatal("Ack() =", err)
+	}
+	if err := <-f.handled; err != nil {
+		t.Error("handler =", err)
+	}
+	if len(f.completed) != 1 || f.completed[0] != sent {
+		t.Errorf("completed %v, want the delivered message", f.completed)
+	}
+	if len(f.abandoned) != 0 || len(f.deadLettered) != 0 {
+		t.Errorf("abandoned %v and dead-lettered %v, want none", f.abandoned, f.deadLettered)
+	}
+	if err := s.Ack(ctx, msgs[0]); err == nil {
+		t.Error("second Ack() = nil, want an unknown message error")
+	}
+}
+
+func TestServiceBusDeadLetter(t *testing.T) {
+	f := newFakeServiceBus()
+	s := newTestServiceBus(f, false)
+	defer s.Close()
+	sent := f.deliver(t, "data", 3)
+
+	msgs, err := s.Dequeue(context.Background())
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Dequeue() = %v, %v, want one message", msgs, err)
+	}
+	ctx := WithFailure(context.Background(), Failure{StatusCode: 503, Attempts: 3})
+	if err := s.DeadLetter(ctx, msgs[0], "too many attempts"); err != nil {
+		t.Fatal("DeadLetter() =", err)
+	}
+	if err := <-f.handled; err != nil {
+		t.Error("handler =", err)
+	}
+	if len(f.deadLettered) != 1 {
+		t.Fatalf("dead-lettered %d messages, want 1", len(f.deadLettered))
+	}
+	got := f.deadLettered[0]
+	if got.msg != sent {
+		t.Error("dead-lettered another message than the one delivered")
+	}
+	if got.reason != "too many attempts" {
+		t.Errorf("reason = %q, want %q", got.reason, "too many attempts")
+	}
+	if got.fields[FailureStatusField] != "503" || got.fields[FailureAttemptsField] != "3" {
+		t.Errorf("fields = %v, want the status and attempts of the failure", got.fields)
+	}
+	if len(f.completed) != 0 {
+		t.Errorf("completed %v, want none", f.completed)
+	}
+}
+
+func TestServiceBusDeadLetterUnknown(t *testing.T) {
+	f := newFakeServiceBus()
+	s := newTestServiceBus(f, false)
+	if err := s.DeadLetter(context.Background(), Message{ID: "unknown"}, "reason"); err == nil {
+		t.Error("DeadLetter() = nil, want an unknown message error")
+	}
+	if len(f.deadLettered) != 0 {
+		t.Errorf("dead-lettered %v, want none", f.deadLettered)
+	}
+}
+
+func TestServiceBusAbandonsUndelivered(t *testing.T) {
+	f := newFakeServiceBus()
+	s := newTestServiceBus(f, false)
+	token, _ := uuid.NewV4()
+	msg := servicebus.NewMessageFromString("data")
+	msg.LockToken = &token
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.handle(ctx, msg); err != nil {
+		t.Fatal("handle() =", err)
+	}
+	if len(f.abandoned) != 1 || f.abandoned[0] != msg {
+		t.Errorf("abandoned %v, want the message nobody dequeued", f.abandoned)
+	}
+}
+
+func TestServiceBusDequeueTimeout(t *testing.T) {
+	f := newFakeServiceBus()
+	s := newTestServiceBus(f, false)
+	defer s.Close()
+	s.cfg.ServiceBusReadTimeout = 10 * time.Millisecond
+
+	msgs, err := s.Dequeue(context.Background())
+	if err != nil || len(msgs) != 0 {
+		t.Errorf("Dequeue() = %v, %v, want nothing", msgs, err)
+	}
+}
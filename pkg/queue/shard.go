@@ -0,0 +1,469 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// ShardByHost sends the requests of a service to the same shard.
+	ShardByHost = "host"
+	// ShardByNamespace sends the requests of a namespace to the same shard.
+	ShardByNamespace = "namespace"
+
+	// Points of every shard on the hash ring.
+	shardVirtualNodes = 128
+)
+
+// ShardConfig spreads the requests of the Redis backend over REDIS_SHARDS
+// streams when it is larger than 1. Requests are assigned to a stream by
+// consistent hashing of their host or namespace, so changing the number of
+// shards only moves a fraction of the services. Consumers read the shards
+// listed in REDIS_CONSUMER_SHARDS, all of them by default.
+type ShardConfig struct {
+	RedisShards         int    `envconfig:"REDIS_SHARDS"`
+	RedisShardBy        string `envconfig:"REDIS_SHARD_BY" default:"host"`
+	RedisConsumerShards []int  `envconfig:"REDIS_CONSUMER_SHARDS"`
+}
+
+type shardKey struct{}
+
+// WithShardKey returns a context asking sharded queues to store requests
+// enqueued with it in the shard of host.
+func WithShardKey(ctx context.Context, host string) context.Context {
+	return context.WithValue(ctx, shardKey{}, host)
+}
+
+// ShardKeyFrom returns the host set on ctx, if any.
+func ShardKeyFrom(ctx context.Context) string {
+	host, _ := ctx.Value(shardKey{}).(string)
+	return host
+}
+
+// Sharded is a Queue storing requests in several Redis streams sharing a
+// client. Shard 0 is the configured stream, so enabling sharding keeps
+// existing requests, and shard i is named after it with a "-i" suffix.
+type Sharded struct {
+	client  redis.Cmdable
+	by      string
+	shards  []*Redis
+	claimed []*Redis
+
+	// ring holds the sorted hashes of the virtual nodes, owners the shard
+	// of each.
+	ring   []uint32
+	owners []int
+}
+
+var (
+	_ Queue                  = (*Sharded)(nil)
+	_ HealthChecker          = (*Sharded)(nil)
+	_ BatchEnqueuer          = (*Sharded)(nil)
+	_ Replayer               = (*Sharded)(nil)
+	_ BacklogReader          = (*Sharded)(nil)
+	_ PendingLister          = (*Sharded)(nil)
+	_ DeadLetterLister       = (*Sharded)(nil)
+	_ RecentDeadLetterLister = (*Sharded)(nil)
+	_ Purger                 = (*Sharded)(nil)
+	_ DelayedLister          = (*Sharded)(nil)
+)
+
+// NewSharded connects to the Redis instance described by cfg.
+func NewSharded(ctx context.Context, cfg RedisConfig) (*Sharded, error) {
+	client, err := NewRedisClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewShardedFromClient(client, cfg)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewShardedFromClient returns a sharded queue using an existing client.
+func NewShardedFromClient(client redis.Cmdable, cfg RedisConfig) (*Sharded, error) {
+	if cfg.RedisShardBy != ShardByHost && cfg.RedisShardBy != ShardByNamespace {
+		return nil, fmt.Errorf("unknown shard key %q, want %q or %q", cfg.RedisShardBy, ShardByHost, ShardByNamespace)
+	}
+	s := &Sharded{client: client, by: cfg.RedisShardBy}
+	for i := 0; i < cfg.RedisShards; i++ {
+		shardCfg := cfg
+		if i > 0 {
+			shardCfg.StreamName += "-" + strconv.Itoa(i)
+		}
+		s.shards = append(s.shards, NewRedisFromClient(client, shardCfg))
+		for v := 0; v < shardVirtualNodes; v++ {
+			s.ring = append(s.ring, hash32(strconv.Itoa(i)+"#"+strconv.Itoa(v)))
+			s.owners = append(s.owners, i)
+		}
+	}
+	sort.Sort(ringSorter{s})
+
+	if len(cfg.RedisConsumerShards) == 0 {
+		s.claimed = s.shards
+	}
+	for _, i := range cfg.RedisConsumerShards {
+		if i < 0 || i >= len(s.shards) {
+			s.stopBackground()
+			return nil, fmt.Errorf("consumer shard %d is not in [0, %d)", i, len(s.shards))
+		}
+		s.claimed = append(s.claimed, s.shards[i])
+	}
+	return s, nil
+}
+
+// Enqueue implements Queue by storing data in the shard of the host set on
+// ctx, see WithShardKey. Requests without a host are spread by id.
+func (s *Sharded) Enqueue(ctx context.Context, id string, data []byte) error {
+	key := s.key(ShardKeyFrom(ctx))
+	if key == "" {
+		key = id
+	}
+	return s.shards[s.shard(key)].Enqueue(ctx, id, data)
+}
+
+// EnqueueBatch implements BatchEnqueuer, storing the whole batch in the shard
+// of the host set on ctx, or of the first id.
+func (s *Sharded) EnqueueBatch(ctx context.Context, ids []string, data [][]byte) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	key := s.key(ShardKeyFrom(ctx))
+	if key == "" {
+		key = ids[0]
+	}
+	return s.shards[s.shard(key)].EnqueueBatch(ctx, ids, data)
+}
+
+// Dequeue implements Queue by reading the claimed shards at once.
+func (s *Sharded) Dequeue(ctx context.Context) ([]Message, error) {
+	return readStreams(ctx, s.client, s.claimed, s.shardOf)
+}
+
+// Ack implements Queue.
+func (s *Sharded) Ack(ctx context.Context, msg Message) error {
+	r, msg, err := s.unwrap(msg)
+	if err != nil {
+		return err
+	}
+	return r.Ack(ctx, msg)
+}
+
+// DeadLetter implements Queue using the dead-letter stream of the message's
+// shard.
+func (s *Sharded) DeadLetter(ctx context.Context, msg Message, reason string) error {
+	r, msg, err := s.unwrap(msg)
+	if err != nil {
+		return err
+	}
+	return r.DeadLetter(ctx, msg, reason)
+}
+
+// Replay implements Replayer, emptying the dead-letter streams of the shards
+// in order.
+func (s *Sharded) Replay(ctx context.Context, max int) (int, error) {
+	replayed := 0
+	for _, r := range s.shards {
+		if replayed >= max {
+			break
+		}
+		n, err := r.Replay(ctx, max-replayed)
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+// Backlog implements BacklogReader, adding up the backlogs of all shards.
+func (s *Sharded) Backlog(ctx context.Context) (Backlog, error) {
+	var b Backlog
+	for _, r := range s.shards {
+		rb, err := r.Backlog(ctx)
+		if err != nil {
+			return Backlog{}, err
+		}
+		b.add(rb)
+	}
+	return b, nil
+}
+
+// StreamBacklogs implements StreamBacklogReader, with the backlog of each
+// shard.
+func (s *Sharded) StreamBacklogs(ctx context.Context) (map[string]Backlog, error) {
+	backlogs := make(map[string]Backlog, len(s.shards))
+	for _, r := range s.shards {
+		b, err := r.Backlog(ctx)
+		if err != nil {
+			return nil, err
+		}
+		backlogs[r.stream] = b
+	}
+	return backlogs, nil
+}
+
+// Pending implements PendingLister, listing the shards in turn.
+func (s *Sharded) Pending(ctx context.Context, max int) ([]PendingMessage, error) {
+	var msgs []PendingMessage
+	for _, r := range s.shards {
+		rm, err := r.Pending(ctx, max-len(msgs))
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, rm...)
+	}
+	return msgs, nil
+}
+
+// ListRecentDeadLetters implements RecentDeadLetterLister, merging the newest
+// requests of each shard.
+func (s *Sharded) ListRecentDeadLetters(ctx context.Context, max int) ([]DeadLetteredMessage, error) {
+	var msgs []DeadLetteredMessage
+	for _, r := range s.shards {
+		rm, err := r.ListRecentDeadLetters(ctx, max)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, rm...)
+	}
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].DeadLettered.After(msgs[j].DeadLettered) })
+	if len(msgs) > max {
+		msgs = msgs[:max]
+	}
+	return msgs, nil
+}
+
+// Purge implements Purger, purging the shards in turn.
+func (s *Sharded) Purge(ctx context.Context, fn PurgeFunc) (int, error) {
+	purged := 0
+	for _, r := range s.shards {
+		n, err := r.Purge(ctx, fn)
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// Delayed implements DelayedLister, listing the shards in turn.
+func (s *Sharded) Delayed(ctx context.Context, max int) ([]DelayedMessage, error) {
+	var msgs []DelayedMessage
+	for _, r := range s.shards {
+		if len(msgs) >= max {
+			break
+		}
+		rm, err := r.Delayed(ctx, max-len(msgs))
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, rm...)
+	}
+	return msgs, nil
+}
+
+// RemoveDelayed implements DelayedLister. The shard of the request is not
+// known, so it is removed from every shard.
+func (s *Sharded) RemoveDelayed(ctx context.Context, msg DelayedMessage) error {
+	for _, r := range s.shards {
+		if err := r.RemoveDelayed(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListDeadLetters implements DeadLetterLister, listing the shards in turn.
+func (s *Sharded) ListDeadLetters(ctx context.Context, max int) ([]DeadLetteredMessage, error) {
+	var msgs []DeadLetteredMessage
+	for _, r := range s.shards {
+		rm, err := r.ListDeadLetters(ctx, max-len(msgs))
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, rm...)
+	}
+	return msgs, nil
+}
+
+// Close implements Queue. Pending batched writes are flushed first.
+func (s *Sharded) Close() error {
+	s.stopBackground()
+	if c, ok := s.client.(*redis.Client); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// CheckHealth implements HealthChecker. Consumers check the consumer group
+// of every claimed shard.
+func (s *Sharded) CheckHealth(ctx context.Context, consuming bool) error {
+	if !consuming {
+		return s.shards[0].CheckHealth(ctx, false)
+	}
+	for _, r := range s.claimed {
+		if err := r.CheckHealth(ctx, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Sharded) stopBackground() {
+	for _, r := range s.shards {
+		r.stopBackground()
+	}
+}
+
+// key returns what host is sharded by.
+func (s *Sharded) key(host string) string {
+	if s.by == ShardByNamespace {
+		// Service hosts are name.namespace.svc.cluster.local.
+		if parts := strings.SplitN(host, ".", 3); len(parts) > 1 {
+			return parts[1]
+		}
+	}
+	return host
+}
+
+// shard returns the shard owning key: the one of the first virtual node
+// following its hash on the ring.
+func (s *Sharded) shard(key string) int {
+	h := hash32(key)
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i] >= h })
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.owners[i]
+}
+
+// shardOf returns the index of the shard reading stream.
+func (s *Sharded) shardOf(stream string) int {
+	for i, r := range s.shards {
+		if r.stream == stream {
+			return i
+		}
+	}
+	return -1
+}
+
+// unwrap returns the shard of msg and the message as read from it.
+func (s *Sharded) unwrap(msg Message) (*Redis, Message, error) {
+	return unwrapStream(s.shards, msg)
+}
+
+// readStreams reads the streams rs of client at once, returning the requests
+// left pending by other consumers first when they are claimed. Message IDs
+// are prefixed with the index of their stream, see unwrapStream.
+func readStreams(ctx context.Context, client redis.Cmdable, rs []*Redis, index func(stream string) int) ([]Message, error) {
+	streams := make([]string, 0, 2*len(rs))
+	for _, r := range rs {
+		if err := r.prepareRead(ctx); err != nil {
+			return nil, err
+		}
+		streams = append(streams, r.stream)
+	}
+	for range rs {
+		streams = append(streams, ">")
+	}
+	for _, r := range rs {
+		if claimed := r.claimDue(ctx); len(claimed) > 0 {
+			i := index(r.stream)
+			for j := range claimed {
+				claimed[j].ID = strconv.Itoa(i) + ":" + claimed[j].ID
+			}
+			return claimed, nil
+		}
+	}
+	first := rs[0]
+	res, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    first.group,
+		Consumer: first.consumer,
+		Streams:  streams,
+		Count:    shardReadCount(readCount(ctx, first.count), len(rs)),
+		Block:    first.block,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		for _, r := range rs {
+			r.checkGroup(err)
+		}
+		return nil, fmt.Errorf("failed to read from streams: %w", err)
+	}
+	var msgs []Message
+	for _, stream := range res {
+		i := index(stream.Stream)
+		for _, m := range stream.Messages {
+			msgs = append(msgs, Message{
+				ID:         strconv.Itoa(i) + ":" + m.ID,
+				Data:       redisData(m.Values[redisDataField]),
+				Deliveries: 1,
+			})
+		}
+	}
+	return msgs, nil
+}
+
+// unwrapStream returns the stream of rs msg was read from and the message as
+// read from it.
+func unwrapStream(rs []*Redis, msg Message) (*Redis, Message, error) {
+	parts := strings.SplitN(msg.ID, ":", 2)
+	if len(parts) != 2 {
+		return nil, msg, fmt.Errorf("message %q has no shard", msg.ID)
+	}
+	i, err := strconv.Atoi(parts[0])
+	if err != nil || i < 0 || i >= len(rs) {
+		return nil, msg, fmt.Errorf("message %q has an invalid shard", msg.ID)
+	}
+	msg.ID = parts[1]
+	return rs[i], msg, nil
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// ringSorter sorts the virtual nodes of a ring along with their owners.
+type ringSorter struct{ s *Sharded }
+
+func (r ringSorter) Len() int           { return len(r.s.ring) }
+func (r ringSorter) Less(i, j int) bool { return r.s.ring[i] < r.s.ring[j] }
+func (r ringSorter) Swap(i, j int) {
+	r.s.ring[i], r.s.ring[j] = r.s.ring[j], r.s.ring[i]
+	r.s.owners[i], r.s.owners[j] = r.s.owners[j], r.s.owners[i]
+}
+
+// shardReadCount returns how many entries to read from each of n streams to
+// read about count entries in all. XREADGROUP applies its count to every
+// stream.
+func shardReadCount(count int64, n int) int64 {
+	if c := count / int64(n); c > 1 {
+		return c
+	}
+	return 1
+}
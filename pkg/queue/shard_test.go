@@ -0,0 +1,173 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// streamRecorder records the streams written to.
+type streamRecorder struct {
+	redis.Cmdable
+	streams []string
+}
+
+func (f *streamRecorder) XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd {
+	f.streams = append(f.streams, a.Stream)
+	return redis.NewStringResult("1-0", nil)
+}
+
+func shardConfig(shards int) RedisConfig {
+	return RedisConfig{
+		StreamName:  "requests",
+		ShardConfig: ShardConfig{RedisShards: shards, RedisShardBy: ShardByHost},
+	}
+}
+
+func TestShardedEnqueue(t *testing.T) {
+	client := &streamRecorder{}
+	cfg := shardConfig(4)
+	cfg.RedisShardBy = ShardByNamespace
+	s, err := NewShardedFromClient(client, cfg)
+	if err != nil {
+		t.Fatal("NewShardedFromClient() =", err)
+	}
+
+	// Services of a namespace share a shard.
+	for _, host := range []string{"a.ns.svc.cluster.local", "b.ns.svc.cluster.local"} {
+		if err := s.Enqueue(WithShardKey(context.Background(), host), "id", nil); err != nil {
+			t.Fatal("Enqueue() =", err)
+		}
+	}
+	if client.streams[0] != client.streams[1] {
+		t.Errorf("namespace was written to streams %v, want one", client.streams)
+	}
+	want := "requests"
+	if i := s.shard("ns"); i > 0 {
+		want = fmt.Sprintf("requests-%d", i)
+	}
+	if client.streams[0] != want {
+		t.Errorf("stream = %q, want %q", client.streams[0], want)
+	}
+}
+
+func TestShardedConsistentHashing(t *testing.T) {
+	four, _ := NewShardedFromClient(&streamRecorder{}, shardConfig(4))
+	five, _ := NewShardedFromClient(&streamRecorder{}, shardConfig(5))
+
+	counts := make([]int, 4)
+	moved := 0
+	const hosts = 10000
+	for i := 0; i < hosts; i++ {
+		host := fmt.Sprintf("service-%d.default.svc.cluster.local", i)
+		shard := four.shard(host)
+		counts[shard]++
+		if five.shard(host) != shard {
+			moved++
+		}
+	}
+	for i, n := range counts {
+		if n < hosts/8 {
+			t.Errorf("shard %d got %d of %d hosts", i, n, hosts)
+		}
+	}
+	// Only the hosts taken over by the new shard move.
+	if moved > hosts/3 {
+		t.Errorf("%d of %d hosts moved when adding a shard", moved, hosts)
+	}
+}
+
+func TestShardedUnwrap(t *testing.T) {
+	s, _ := NewShardedFromClient(&streamRecorder{}, shardConfig(3))
+	r, msg, err := s.unwrap(Message{ID: "2:1-0"})
+	if err != nil || r != s.shards[2] || msg.ID != "1-0" {
+		t.Errorf("unwrap() = %v, %q, %v, want shard 2 and 1-0", r, msg.ID, err)
+	}
+	for _, id := range []string{"1-0", "3:1-0", "x:1-0"} {
+		if _, _, err := s.unwrap(Message{ID: id}); err == nil {
+			t.Errorf("unwrap(%q) succeeded", id)
+		}
+	}
+	if got := s.shardOf("requests-1"); got != 1 {
+		t.Errorf("shardOf() = %d, want 1", got)
+	}
+}
+
+func TestNewShardedClaims(t *testing.T) {
+	tests := []struct {
+		name    string
+		claims  []int
+		by      string
+		want    []string
+		wantErr bool
+	}{{
+		name: "all shards by default",
+		want: []string{"requests", "requests-1", "requests-2"},
+	}, {
+		name:   "subset",
+		claims: []int{0, 2},
+		want:   []string{"requests", "requests-2"},
+	}, {
+		name:    "unknown shard",
+		claims:  []int{3},
+		wantErr: true,
+	}, {
+		name:    "unknown shard key",
+		by:      "path",
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := shardConfig(3)
+			cfg.RedisConsumerShards = test.claims
+			if test.by != "" {
+				cfg.RedisShardBy = test.by
+			}
+			s, err := NewShardedFromClient(&streamRecorder{}, cfg)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("NewShardedFromClient() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var got []string
+			for _, r := range s.claimed {
+				got = append(got, r.stream)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("claimed = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestShardReadCount(t *testing.T) {
+	for _, test := range []struct {
+		count int64
+		n     int
+		want  int64
+	}{
+		{count: 10, n: 1, want: 10},
+		{count: 10, n: 4, want: 2},
+		{count: 3, n: 4, want: 1},
+	} {
+		if got := shardReadCount(test.count, test.n); got != test.want {
+			t.Errorf("shardReadCount(%d, %d) = %d, want %d", test.count, test.n, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"go.uber.org/zap"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// The SQS message attribute holding the dead-letter reason.
+	sqsReasonAttribute = "AsyncDeadLetterReason"
+	// The longest delay SQS accepts on a message.
+	sqsMaxDelay = 15 * time.Minute
+)
+
+// SQSConfig holds the environment configuration of the SQS backend. AWS
+// credentials and region are read from the standard AWS environment, which
+// includes IAM roles for service accounts on EKS.
+type SQSConfig struct {
+	SQSQueueURL           string        `envconfig:"SQS_QUEUE_URL"`
+	SQSDeadLetterQueueURL string        `envconfig:"SQS_DEAD_LETTER_QUEUE_URL"`
+	SQSWaitTime           time.Duration `envconfig:"SQS_WAIT_TIME" default:"20s"`
+	SQSVisibilityTimeout  time.Duration `envconfig:"SQS_VISIBILITY_TIMEOUT" default:"30s"`
+	SQSMaxMessages        int64         `envconfig:"SQS_MAX_MESSAGES" default:"1"`
+}
+
+// SQS is a Queue backed by an Amazon SQS queue. The visibility timeout of
+// messages being delivered is extended until they are acked, so slow
+// deliveries are not handed to another consumer.
+type SQS struct {
+	cfg    SQSConfig
+	client sqsiface.SQSAPI
+
+	mu sync.Mutex
+	// inflight maps receipt handles to the function stopping the visibility
+	// extension of the message.
+	inflight map[string]context.CancelFunc
+}
+
+var _ Queue = (*SQS)(nil)
+
+// NewSQS creates an SQS client for the queue described by cfg.
+func NewSQS(ctx context.Context, cfg SQSConfig) (*SQS, error) {
+	if cfg.SQSQueueURL == "" {
+		return nil, errors.New("SQS_QUEUE_URL must be set")
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aws session: %w", err)
+	}
+	return newSQSFromClient(sqs.New(sess), cfg), nil
+}
+
+func newSQSFromClient(client sqsiface.SQSAPI, cfg SQSConfig) *SQS {
+	return &SQS{
+		cfg:      cfg,
+		client:   client,
+		inflight: make(map[string]context.CancelFunc),
+	}
+}
+
+// Enqueue implements Queue. Delivery times, see WithDeliverAt, are passed as
+// the message delay, which SQS limits to 15 minutes on standard queues.
+func (s *SQS) Enqueue(ctx context.Context, id string, data []byte) error {
+	input := s.sendInput(s.cfg.SQSQueueURL, id, data)
+	if at := DeliverAtFrom(ctx); !at.IsZero() {
+		delay := time.Until(at).Round(time.Second)
+		if delay > sqsMaxDelay || strings.HasSuffix(s.cfg.SQSQueueURL, ".fifo") {
+			return fmt.Errorf("%w: SQS only delays messages of standard queues, by up to %v", ErrDelayNotSupported, sqsMaxDelay)
+		}
+		if delay > 0 {
+			input.DelaySeconds = aws.Int64(int64(delay / time.Second))
+		}
+	}
+	if _, err := s.client.SendMessageWithContext(ctx, input); err != nil {
+		return fmt.Errorf("failed to publish %q: %w", id, err)
+	}
+	return nil
+}
+
+// Dequeue implements Queue using long polling.
+func (s *SQS) Dequeue(ctx context.Context) ([]Message, error) {
+	out, err := s.client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(s.cfg.SQSQueueURL),
+		MaxNumberOfMessages: aws.Int64(readCount(ctx, s.cfg.SQSMaxMessages)),
+		WaitTimeSeconds:     aws.Int64(int64(s.cfg.SQSWaitTime / time.Second)),
+		VisibilityTimeout:   aws.Int64(int64(s.cfg.SQSVisibilityTimeout / time.Second)),
+		AttributeNames:      []*string{aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive from %q: %w", s.cfg.SQSQueueURL, err)
+	}
+	msgs := make([]Message, 0, len(out.Messages))
+	for _, m := range out.Messages {
+		handle := aws.StringValue(m.ReceiptHandle)
+		s.extendVisibility(logging.FromContext(ctx), handle)
+		deliveries, _ := strconv.Atoi(aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+		msgs = append(msgs, Message{ID: handle, Data: []byte(aws.StringValue(m.Body)), Deliveries: deliveries})
+	}
+	return msgs, nil
+}
+
+// Ack implements Queue by deleting the message.
+func (s *SQS) Ack(ctx context.Context, msg Message) error {
+	s.release(msg.ID)
+	if _, err := s.client.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(s.cfg.SQSQueueURL),
+		ReceiptHandle: aws.String(msg.ID),
+	}); err != nil {
+		return fmt.Errorf("failed to delete message: %w", err)
+	}
+	return nil
+}
+
+// DeadLetter implements Queue. When SQS_DEAD_LETTER_QUEUE_URL is set the
+// message is copied there and deleted. Otherwise it is made visible again so
+// the redrive policy of the queue moves it once its maxReceiveCount is hit.
+func (s *SQS) DeadLetter(ctx context.Context, msg Message, reason string) error {
+	if s.cfg.SQSDeadLetterQueueURL == "" {
+		s.release(msg.ID)
+		_, err := s.client.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(s.cfg.SQSQueueURL),
+			ReceiptHandle:     aws.String(msg.ID),
+			VisibilityTimeout: aws.Int64(0),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to release message: %w", err)
+		}
+		return nil
+	}
+	input := s.sendInput(s.cfg.SQSDeadLetterQueueURL, "", msg.Data)
+	input.MessageAttributes = map[string]*sqs.MessageAttributeValue{
+		sqsReasonAttribute: {
+			DataType:    aws.String("String"),
+			StringValue: aws.String(reason),
+		},
+	}
+	for k, v := range FailureFrom(ctx).Fields() {
+		input.MessageAttributes[sqsFailureAttribute(k)] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(v),
+		}
+	}
+	if _, err := s.client.SendMessageWithContext(ctx, input); err != nil {
+		return fmt.Errorf("failed to dead-letter message: %w", err)
+	}
+	return s.Ack(ctx, msg)
+}
+
+// Close implements Queue.
+func (s *SQS) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for handle, cancel := range s.inflight {
+		cancel()
+		delete(s.inflight, handle)
+	}
+	return nil
+}
+
+// sendInput builds the SendMessageInput for url, filling in the fields that
+// FIFO queues require.
+func (s *SQS) sendInput(url, id string, data []byte) *sqs.SendMessageInput {
+	input := &sqs.SendMessageInput{
+		QueueUrl:    aws.String(url),
+		MessageBody: aws.String(string(data)),
+	}
+	if strings.HasSuffix(url, ".fifo") {
+		input.MessageGroupId = aws.String(url)
+		if id != "" {
+			input.MessageDeduplicationId = aws.String(id)
+		}
+	}
+	return input
+}
+
+// extendVisibility keeps the message hidden from other consumers until
+// release is called, by renewing its visibility timeout at half its length.
+func (s *SQS) extendVisibility(logger *zap.SugaredLogger, handle string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	s.inflight[handle] = cancel
+	s.mu.Unlock()
+	go func() {
+		ticker := time.NewTicker(s.cfg.SQSVisibilityTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_, err := s.client.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          aws.String(s.cfg.SQSQueueURL),
+					ReceiptHandle:     aws.String(handle),
+					VisibilityTimeout: aws.Int64(int64(s.cfg.SQSVisibilityTimeout / time.Second)),
+				})
+				if err != nil && ctx.Err() == nil {
+					logger.Errorw("Error extending message visibility", zap.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+// release stops extending the visibility of the message.
+func (s *SQS) release(handle string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cancel, ok := s.inflight[handle]; ok {
+		cancel()
+		delete(s.inflight, handle)
+	}
+}
+
+// sqsFailureAttribute returns the message attribute holding a failure field,
+// such as AsyncDeadLetterFirstAttempt for first-attempt.
+func sqsFailureAttribute(field string) string {
+	name := "AsyncDeadLetter"
+	for _, part := range strings.Split(field, "-") {
+		name += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return name
+}
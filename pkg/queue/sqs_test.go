@@ -0,0 +1,164 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+type fakeSQS struct {
+	sqsiface.SQSAPI
+	sent     []*sqs.SendMessageInput
+	deleted  []string
+	released []string
+	messages []*sqs.Message
+}
+
+func (f *fakeSQS) SendMessageWithContext(ctx aws.Context, in *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	f.sent = append(f.sent, in)
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func (f *fakeSQS) ReceiveMessageWithContext(ctx aws.Context, in *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	return &sqs.ReceiveMessageOutput{Messages: f.messages}, nil
+}
+
+func (f *fakeSQS) DeleteMessageWithContext(ctx aws.Context, in *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	f.deleted = append(f.deleted, aws.StringValue(in.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (f *fakeSQS) ChangeMessageVisibilityWithContext(ctx aws.Context, in *sqs.ChangeMessageVisibilityInput, opts ...request.Option) (*sqs.ChangeMessageVisibilityOutput, error) {
+	if aws.Int64Value(in.VisibilityTimeout) == 0 {
+		f.released = append(f.released, aws.StringValue(in.ReceiptHandle))
+	}
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func TestSQSEnqueueFIFO(t *testing.T) {
+	fake := &fakeSQS{}
+	s := newSQSFromClient(fake, SQSConfig{SQSQueueURL: "https://sqs/requests.fifo"})
+	if err := s.Enqueue(context.Background(), "123", []byte("data")); err != nil {
+		t.Fatal("Enqueue() =", err)
+	}
+	if got := aws.StringValue(fake.sent[0].MessageDeduplicationId); got != "123" {
+		t.Errorf("MessageDeduplicationId = %q, want %q", got, "123")
+	}
+	if fake.sent[0].MessageGroupId == nil {
+		t.Error("expected MessageGroupId to be set for a FIFO queue")
+	}
+}
+
+func TestSQSEnqueueDelay(t *testing.T) {
+	tests := []struct {
+		name      string
+		url       string
+		delay     time.Duration
+		wantDelay int64
+		wantErr   bool
+	}{{
+		name:      "delayed",
+		url:       "https://sqs/requests",
+		delay:     2 * time.Minute,
+		wantDelay: 120,
+	}, {
+		name:    "longer than the SQS limit",
+		url:     "https://sqs/requests",
+		delay:   time.Hour,
+		wantErr: true,
+	}, {
+		name:    "fifo queue",
+		url:     "https://sqs/requests.fifo",
+		delay:   time.Minute,
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &fakeSQS{}
+			s := newSQSFromClient(fake, SQSConfig{SQSQueueURL: test.url})
+			ctx := WithDeliverAt(context.Background(), time.Now().Add(test.delay))
+			err := s.Enqueue(ctx, "123", []byte("data"))
+			if test.wantErr {
+				if !errors.Is(err, ErrDelayNotSupported) {
+					t.Fatalf("Enqueue() = %v, want %v", err, ErrDelayNotSupported)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Enqueue() =", err)
+			}
+			if got := aws.Int64Value(fake.sent[0].DelaySeconds); got != test.wantDelay {
+				t.Errorf("DelaySeconds = %d, want %d", got, test.wantDelay)
+			}
+		})
+	}
+}
+
+func TestSQSDequeueAndAck(t *testing.T) {
+	tests := []struct {
+		name         string
+		deadLetter   string
+		wantSent     int
+		wantDeleted  int
+		wantReleased int
+	}{{
+		name:         "dead-letter through redrive policy",
+		wantReleased: 1,
+	}, {
+		name:        "dead-letter to configured queue",
+		deadLetter:  "https://sqs/requests-dlq",
+		wantSent:    1,
+		wantDeleted: 1,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &fakeSQS{messages: []*sqs.Message{{
+				ReceiptHandle: aws.String("handle"),
+				Body:          aws.String("data"),
+				Attributes:    map[string]*string{sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("2")},
+			}}}
+			s := newSQSFromClient(fake, SQSConfig{
+				SQSQueueURL:           "https://sqs/requests",
+				SQSDeadLetterQueueURL: test.deadLetter,
+				SQSVisibilityTimeout:  time.Minute,
+			})
+			ctx := context.Background()
+			msgs, err := s.Dequeue(ctx)
+			if err != nil || len(msgs) != 1 {
+				t.Fatalf("Dequeue() = %v, %v; want one message", msgs, err)
+			}
+			if string(msgs[0].Data) != "data" || msgs[0].Deliveries != 2 {
+				t.Errorf("Data, Deliveries = %q, %d, want %q, 2", msgs[0].Data, msgs[0].Deliveries, "data")
+			}
+			if err := s.DeadLetter(ctx, msgs[0], "failed"); err != nil {
+				t.Fatal("DeadLetter() =", err)
+			}
+			if len(fake.sent) != test.wantSent || len(fake.deleted) != test.wantDeleted || len(fake.released) != test.wantReleased {
+				t.Errorf("sent, deleted, released = %d, %d, %d; want %d, %d, %d", len(fake.sent), len(fake.deleted),
+					len(fake.released), test.wantSent, test.wantDeleted, test.wantReleased)
+			}
+			if len(s.inflight) != 0 {
+				t.Error("expected the visibility extension to be stopped")
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"knative.dev/pkg/logging"
+)
+
+// The most keys returned by each SCAN when listing streams.
+const streamsScanCount = 100
+
+// StreamsConfig makes consumers of the Redis backend read the streams listed
+// in REDIS_CONSUMER_STREAMS instead of REDIS_STREAM_NAME and its shards.
+// Entries holding glob characters, such as "tenant-*", match the existing
+// streams, which are listed again every REDIS_STREAMS_INTERVAL so streams
+// created later are read as well.
+type StreamsConfig struct {
+	RedisConsumerStreams []string      `envconfig:"REDIS_CONSUMER_STREAMS"`
+	RedisStreamsInterval time.Duration `envconfig:"REDIS_STREAMS_INTERVAL" default:"1m"`
+}
+
+// Streams is a Queue reading several Redis streams sharing a client and
+// consumer group, such as those of different tenants. Requests are written to
+// REDIS_STREAM_NAME.
+type Streams struct {
+	client   redis.Cmdable
+	cfg      RedisConfig
+	out      *Redis
+	patterns []string
+	// nextList is when the patterns are matched again.
+	nextList time.Time
+
+	// mu guards streams, which are only ever added to, so the index of a
+	// stream in message IDs stays valid.
+	mu      sync.RWMutex
+	streams []*Redis
+	indexes map[string]int
+}
+
+var (
+	_ Queue         = (*Streams)(nil)
+	_ HealthChecker = (*Streams)(nil)
+	_ Replayer      = (*Streams)(nil)
+	_ BacklogReader = (*Streams)(nil)
+)
+
+// NewStreams connects to the Redis instance described by cfg.
+func NewStreams(ctx context.Context, cfg RedisConfig) (*Streams, error) {
+	client, err := NewRedisClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamsFromClient(client, cfg), nil
+}
+
+// NewStreamsFromClient returns a queue reading the streams of cfg using an
+// existing client.
+func NewStreamsFromClient(client redis.Cmdable, cfg RedisConfig) *Streams {
+	s := &Streams{
+		client:  client,
+		cfg:     cfg,
+		out:     NewRedisFromClient(client, cfg),
+		indexes: make(map[string]int),
+	}
+	for _, name := range cfg.RedisConsumerStreams {
+		if strings.ContainsAny(name, "*?[") {
+			s.patterns = append(s.patterns, name)
+		} else {
+			s.addStream(name)
+		}
+	}
+	return s
+}
+
+// Enqueue implements Queue by writing to REDIS_STREAM_NAME.
+func (s *Streams) Enqueue(ctx context.Context, id string, data []byte) error {
+	return s.out.Enqueue(ctx, id, data)
+}
+
+// Dequeue implements Queue by reading all the streams at once. Until a
+// pattern matches a stream, it waits for REDIS_READ_BLOCK and returns no
+// message.
+func (s *Streams) Dequeue(ctx context.Context) ([]Message, error) {
+	if len(s.patterns) > 0 && !time.Now().Before(s.nextList) {
+		if err := s.listStreams(ctx); err != nil {
+			logging.FromContext(ctx).Errorw("Error listing streams", zap.Error(err))
+		}
+		s.nextList = time.Now().Add(s.cfg.RedisStreamsInterval)
+	}
+	streams := s.read()
+	if len(streams) == 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(s.cfg.ReadBlock):
+		}
+		return nil, nil
+	}
+	return readStreams(ctx, s.client, streams, s.indexOf)
+}
+
+// Ack implements Queue.
+func (s *Streams) Ack(ctx context.Context, msg Message) error {
+	r, msg, err := s.unwrap(msg)
+	if err != nil {
+		return err
+	}
+	return r.Ack(ctx, msg)
+}
+
+// DeadLetter implements Queue using the dead-letter stream of the stream the
+// message was read from.
+func (s *Streams) DeadLetter(ctx context.Context, msg Message, reason string) error {
+	r, msg, err := s.unwrap(msg)
+	if err != nil {
+		return err
+	}
+	return r.DeadLetter(ctx, msg, reason)
+}
+
+// Replay implements Replayer, emptying the dead-letter streams of the streams
+// read so far in order.
+func (s *Streams) Replay(ctx context.Context, max int) (int, error) {
+	replayed := 0
+	for _, r := range s.read() {
+		if replayed >= max {
+			break
+		}
+		n, err := r.Replay(ctx, max-replayed)
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+// Backlog implements BacklogReader, adding up the backlogs of the streams
+// read so far.
+func (s *Streams) Backlog(ctx context.Context) (Backlog, error) {
+	var b Backlog
+	for _, r := range s.read() {
+		rb, err := r.Backlog(ctx)
+		if err != nil {
+			return Backlog{}, err
+		}
+		b.add(rb)
+	}
+	return b, nil
+}
+
+// Close implements Queue. Pending batched writes are flushed first.
+func (s *Streams) Close() error {
+	s.out.stopBackground()
+	for _, r := range s.read() {
+		r.stopBackground()
+	}
+	if c, ok := s.client.(*redis.Client); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// CheckHealth implements HealthChecker. Consumers check the consumer group
+// of every stream read so far.
+func (s *Streams) CheckHealth(ctx context.Context, consuming bool) error {
+	if !consuming {
+		return s.out.CheckHealth(ctx, false)
+	}
+	for _, r := range s.read() {
+		if err := r.CheckHealth(ctx, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listStreams adds the streams matching the patterns that are not read yet.
+// Dead-letter streams are left out.
+func (s *Streams) listStreams(ctx context.Context) error {
+	for _, pattern := range s.patterns {
+		var cursor uint64
+		for {
+			keys, next, err := s.client.Scan(ctx, cursor, pattern, streamsScanCount).Result()
+			if err != nil {
+				return fmt.Errorf("failed to list streams matching %q: %w", pattern, err)
+			}
+			for _, key := range keys {
+				if strings.HasSuffix(key, deadLetterSuffix) || s.indexOf(key) >= 0 {
+					continue
+				}
+				// Patterns also match the sorted sets of delayed requests.
+				typ, err := s.client.Type(ctx, key).Result()
+				if err != nil {
+					return fmt.Errorf("failed to get the type of %q: %w", key, err)
+				}
+				if typ == "stream" {
+					s.addStream(key)
+				}
+			}
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// addStream starts reading stream.
+func (s *Streams) addStream(stream string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.indexes[stream]; ok {
+		return
+	}
+	cfg := s.cfg
+	cfg.StreamName = stream
+	// Only writes to REDIS_STREAM_NAME are batched.
+	cfg.RedisBatchSize = 0
+	s.indexes[stream] = len(s.streams)
+	s.streams = append(s.streams, NewRedisFromClient(s.client, cfg))
+}
+
+// read returns the streams read so far.
+func (s *Streams) read() []*Redis {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.streams
+}
+
+// indexOf returns the index of stream in message IDs, or -1 if it is not
+// read.
+func (s *Streams) indexOf(stream string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if i, ok := s.indexes[stream]; ok {
+		return i
+	}
+	return -1
+}
+
+// unwrap returns the stream msg was read from and the message as read from
+// it.
+func (s *Streams) unwrap(msg Message) (*Redis, Message, error) {
+	return unwrapStream(s.read(), msg)
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// keyspace holds keys of each type, lists them two by two and answers reads
+// of streams with one entry each.
+type keyspace struct {
+	redis.Cmdable
+	types map[string]string
+	keys  []string
+	read  [][]string
+	acked []string
+}
+
+func (f *keyspace) Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd {
+	var keys []string
+	end := cursor + 2
+	if end >= uint64(len(f.keys)) {
+		end = uint64(len(f.keys))
+	}
+	for _, k := range f.keys[cursor:end] {
+		if ok, _ := path.Match(match, k); ok {
+			keys = append(keys, k)
+		}
+	}
+	if end == uint64(len(f.keys)) {
+		end = 0
+	}
+	return redis.NewScanCmdResult(keys, end, nil)
+}
+
+func (f *keyspace) Type(ctx context.Context, key string) *redis.StatusCmd {
+	return redis.NewStatusResult(f.types[key], nil)
+}
+
+func (f *keyspace) XGroupCreateMkStream(ctx context.Context, stream, group, start string) *redis.StatusCmd {
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (f *keyspace) EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *redis.Cmd {
+	return redis.NewCmdResult(int64(0), nil)
+}
+
+func (f *keyspace) XReadGroup(ctx context.Context, a *redis.XReadGroupArgs) *redis.XStreamSliceCmd {
+	names := a.Streams[:len(a.Streams)/2]
+	f.read = append(f.read, names)
+	var res []redis.XStream
+	for _, name := range names {
+		res = append(res, redis.XStream{Stream: name, Messages: []redis.XMessage{{ID: "1-0", Values: map[string]interface{}{redisDataField: name}}}})
+	}
+	return redis.NewXStreamSliceCmdResult(res, nil)
+}
+
+func (f *keyspace) XAck(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd {
+	f.acked = append(f.acked, stream+"/"+ids[0])
+	return redis.NewIntResult(1, nil)
+}
+
+func TestStreamsDequeue(t *testing.T) {
+	client := &keyspace{
+		types: map[string]string{
+			"tenant-a":         "stream",
+			"tenant-a-dlq":     "stream",
+			"tenant-a-delayed": "zset",
+			"tenant-b":         "stream",
+			"other":            "stream",
+		},
+		keys: []string{"tenant-a", "tenant-a-dlq", "tenant-a-delayed", "other", "tenant-b"},
+	}
+	s := NewStreamsFromClient(client, RedisConfig{
+		StreamName:    "requests",
+		ConsumerGroup: "group",
+		ReadCount:     10,
+		StreamsConfig: StreamsConfig{
+			RedisConsumerStreams: []string{"requests", "tenant-*"},
+			RedisStreamsInterval: time.Hour,
+		},
+	})
+	ctx := context.Background()
+
+	msgs, err := s.Dequeue(ctx)
+	if err != nil {
+		t.Fatal("Dequeue() =", err)
+	}
+	if want := "[[requests tenant-a tenant-b]]"; fmt.Sprint(client.read) != want {
+		t.Errorf("read streams %v, want %s", client.read, want)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("Dequeue() = %d messages, want 3", len(msgs))
+	}
+	for _, msg := range msgs {
+		if err := s.Ack(ctx, msg); err != nil {
+			t.Fatal("Ack() =", err)
+		}
+	}
+	if want := "[requests/1-0 tenant-a/1-0 tenant-b/1-0]"; fmt.Sprint(client.acked) != want {
+		t.Errorf("acked %v, want %s", client.acked, want)
+	}
+
+	// New streams are only listed once the interval is over.
+	client.types["tenant-c"] = "stream"
+	client.keys = append(client.keys, "tenant-c")
+	if _, err := s.Dequeue(ctx); err != nil {
+		t.Fatal("Dequeue() =", err)
+	}
+	if got := client.read[1]; len(got) != 3 {
+		t.Errorf("read streams %v before listing them again, want 3", got)
+	}
+	s.nextList = time.Time{}
+	if _, err := s.Dequeue(ctx); err != nil {
+		t.Fatal("Dequeue() =", err)
+	}
+	if got, want := fmt.Sprint(client.read[2]), "[requests tenant-a tenant-b tenant-c]"; got != want {
+		t.Errorf("read streams %s, want %s", got, want)
+	}
+}
+
+func TestStreamsDequeueNoMatch(t *testing.T) {
+	client := &keyspace{}
+	s := NewStreamsFromClient(client, RedisConfig{
+		ReadBlock:     10 * time.Millisecond,
+		StreamsConfig: StreamsConfig{RedisConsumerStreams: []string{"tenant-*"}, RedisStreamsInterval: time.Hour},
+	})
+	start := time.Now()
+	msgs, err := s.Dequeue(context.Background())
+	if err != nil || len(msgs) != 0 {
+		t.Errorf("Dequeue() = %v, %v, want no message", msgs, err)
+	}
+	if len(client.read) != 0 {
+		t.Errorf("read streams %v, want none", client.read)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("Dequeue() returned after %v, want it to wait for the read block", elapsed)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"go.opencensus.io/stats/view"
+)
+
+// trimRecorder records trims, removing trimmed entries each time.
+type trimRecorder struct {
+	redis.Cmdable
+	trimmed int64
+	maxLens []int64
+}
+
+func (f *trimRecorder) XTrimApprox(ctx context.Context, key string, maxLen int64) *redis.IntCmd {
+	f.maxLens = append(f.maxLens, maxLen)
+	return redis.NewIntResult(f.trimmed, nil)
+}
+
+func TestRedisTrim(t *testing.T) {
+	if err := view.Register(Views...); err != nil {
+		t.Fatal("Register() =", err)
+	}
+	defer view.Unregister(Views...)
+
+	client := &trimRecorder{trimmed: 42}
+	r := NewRedisFromClient(client, RedisConfig{StreamName: "trimmed", RedisMaxLen: 1000})
+	if got := r.xaddArgs(nil).MaxLenApprox; got != 1000 {
+		t.Errorf("XADD MAXLEN = %d, want ~1000", got)
+	}
+	if err := r.trim(context.Background()); err != nil {
+		t.Fatal("trim() =", err)
+	}
+	if len(client.maxLens) != 1 || client.maxLens[0] != 1000 {
+		t.Errorf("XTRIM MAXLEN = %v, want ~1000", client.maxLens)
+	}
+
+	rows, err := view.RetrieveData(trimmedEntries.Name())
+	if err != nil {
+		t.Fatal("RetrieveData() =", err)
+	}
+	for _, row := range rows {
+		if row.Tags[0].Value == "trimmed" {
+			if got := row.Data.(*view.SumData).Value; got != 42 {
+				t.Errorf("trimmed entries = %v, want 42", got)
+			}
+			return
+		}
+	}
+	t.Errorf("no trimmed entries recorded for the stream, got %v", rows)
+}
+
+func TestRedisCloseWithoutTrim(t *testing.T) {
+	r := NewRedisFromClient(&trimRecorder{}, RedisConfig{StreamName: "untrimmed"})
+	if got := r.xaddArgs(nil).MaxLenApprox; got != 0 {
+		t.Errorf("XADD MAXLEN = %d, want none", got)
+	}
+	// Close returns although trimming never started.
+	if err := r.Close(); err != nil {
+		t.Error("Close() =", err)
+	}
+}
+
+func TestRedisCloseTwice(t *testing.T) {
+	r := NewRedisFromClient(&trimRecorder{}, RedisConfig{
+		StreamName:     "closed",
+		RedisMaxLen:    1000,
+		RedisBatchSize: 10,
+	})
+	// Closing again, as sharded queues and streams may do, does not panic.
+	for i := 0; i < 2; i++ {
+		if err := r.Close(); err != nil {
+			t.Errorf("Close() #%d = %v", i+1, err)
+		}
+	}
+}
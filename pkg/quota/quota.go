@@ -0,0 +1,287 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package quota bounds the requests each namespace keeps in the queue, in
+// number and in bytes, so a single tenant cannot fill the shared queue. The
+// usage of the namespaces is read from the backlog of the queue at regular
+// intervals, and the requests admitted in between are added to it.
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+	"knative.dev/pkg/logging"
+)
+
+// Quota bounds the requests of a namespace that are queued or being
+// delivered. Zero values are unlimited.
+type Quota struct {
+	MaxPendingRequests int64 `json:"maxPendingRequests,omitempty"`
+	MaxStoredBytes     int64 `json:"maxStoredBytes,omitempty"`
+}
+
+// Namespaces are the quotas of namespaces that differ from the default one.
+// It is read from JSON, such as {"tenant-a":{"maxPendingRequests":100}}.
+type Namespaces map[string]Quota
+
+// Decode implements envconfig.Decoder.
+func (n *Namespaces) Decode(value string) error {
+	quotas := Namespaces{}
+	if strings.TrimSpace(value) != "" {
+		if err := json.Unmarshal([]byte(value), &quotas); err != nil {
+			return fmt.Errorf("failed to parse namespace quotas: %w", err)
+		}
+	}
+	for ns, q := range quotas {
+		if q.MaxPendingRequests < 0 || q.MaxStoredBytes < 0 {
+			return fmt.Errorf("quota of namespace %q must not be negative", ns)
+		}
+	}
+	*n = quotas
+	return nil
+}
+
+// AsNamespaces parses the namespace quotas of key, for configmap.Parse.
+func AsNamespaces(key string, target *Namespaces) func(map[string]string) error {
+	return func(data map[string]string) error {
+		if raw, ok := data[key]; ok {
+			return target.Decode(raw)
+		}
+		return nil
+	}
+}
+
+// QuotaConfig configures the quotas of the producer. Requests are not
+// counted when no quota is set.
+type QuotaConfig struct {
+	// QuotaMaxPendingRequests and QuotaMaxStoredBytes are the quota of the
+	// namespaces that are not in QuotaNamespaces.
+	QuotaMaxPendingRequests int64      `envconfig:"QUOTA_MAX_PENDING_REQUESTS"`
+	QuotaMaxStoredBytes     int64      `envconfig:"QUOTA_MAX_STORED_BYTES"`
+	QuotaNamespaces         Namespaces `envconfig:"QUOTA_NAMESPACES"`
+	// QuotaRefresh is how often the usage is read from the queue, and
+	// QuotaScanLimit the most requests read to do so.
+	QuotaRefresh   time.Duration `envconfig:"QUOTA_REFRESH" default:"10s"`
+	QuotaScanLimit int           `envconfig:"QUOTA_SCAN_LIMIT" default:"100000"`
+}
+
+// Enabled reports whether any quota is set.
+func (c QuotaConfig) Enabled() bool {
+	return c.QuotaMaxPendingRequests > 0 || c.QuotaMaxStoredBytes > 0 || len(c.QuotaNamespaces) > 0
+}
+
+// For returns the quota of namespace.
+func (c QuotaConfig) For(namespace string) Quota {
+	if q, ok := c.QuotaNamespaces[namespace]; ok {
+		return q
+	}
+	return Quota{MaxPendingRequests: c.QuotaMaxPendingRequests, MaxStoredBytes: c.QuotaMaxStoredBytes}
+}
+
+// Validate checks the settings that cannot be checked by envconfig.
+func (c QuotaConfig) Validate() error {
+	if c.QuotaMaxPendingRequests < 0 || c.QuotaMaxStoredBytes < 0 {
+		return errors.New("QUOTA_MAX_PENDING_REQUESTS and QUOTA_MAX_STORED_BYTES must not be negative")
+	}
+	if c.Enabled() && (c.QuotaRefresh <= 0 || c.QuotaScanLimit <= 0) {
+		return errors.New("QUOTA_REFRESH and QUOTA_SCAN_LIMIT must be positive")
+	}
+	return nil
+}
+
+// Namespace returns the namespace of the service at host. Service hosts are
+// name.namespace followed by the domain.
+func Namespace(host string) string {
+	if parts := strings.SplitN(host, ".", 3); len(parts) > 1 {
+		return parts[1]
+	}
+	return ""
+}
+
+// Usage is what a namespace keeps in the queue.
+type Usage struct {
+	Requests int64 `json:"requests"`
+	Bytes    int64 `json:"bytes"`
+}
+
+func (u Usage) add(o Usage) Usage {
+	return Usage{Requests: u.Requests + o.Requests, Bytes: u.Bytes + o.Bytes}
+}
+
+// ExceededError is returned for requests that would take a namespace over
+// its quota.
+type ExceededError struct {
+	Namespace string
+	// Limit is the quota that would be exceeded, maxPendingRequests or
+	// maxStoredBytes, and Max its value.
+	Limit string
+	Max   int64
+	// Used is what the namespace keeps in the queue.
+	Used Usage
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("namespace %q is over its %s quota of %d", e.Namespace, e.Limit, e.Max)
+}
+
+// Tracker keeps the usage of the namespaces.
+type Tracker struct {
+	queue     queue.Queue
+	scanLimit int
+
+	mu sync.Mutex
+	// scanned is the usage read by the last scan of the queue. reserved is
+	// what was admitted since, and previous what was admitted before the
+	// scan in progress started, which it may not have seen yet.
+	scanned  map[string]Usage
+	reserved map[string]Usage
+	previous map[string]Usage
+	// unsupported is set once the queue told it cannot list its requests,
+	// and then no request is turned away.
+	unsupported bool
+}
+
+// NewTracker returns a Tracker reading the usage from the first scanLimit
+// requests of q.
+func NewTracker(q queue.Queue, scanLimit int) *Tracker {
+	return &Tracker{
+		queue:     q,
+		scanLimit: scanLimit,
+		scanned:   map[string]Usage{},
+		reserved:  map[string]Usage{},
+	}
+}
+
+// Run refreshes the usage every interval while enabled reports quotas are
+// set, until ctx is done. It stops early when the queue cannot list its
+// requests.
+func (t *Tracker) Run(ctx context.Context, interval time.Duration, enabled func() bool) {
+	logger := logging.FromContext(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if enabled() {
+			err := t.Refresh(ctx)
+			if errors.Is(err, queue.ErrListNotSupported) {
+				logger.Error("The queue backend cannot list its requests, quotas are not enforced")
+				t.mu.Lock()
+				t.unsupported = true
+				t.mu.Unlock()
+				return
+			} else if err != nil {
+				logger.Errorw("Error reading the usage of the quotas", zap.Error(err))
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Refresh reads the usage of the namespaces from the queue.
+func (t *Tracker) Refresh(ctx context.Context) error {
+	t.mu.Lock()
+	t.previous, t.reserved = t.reserved, map[string]Usage{}
+	t.mu.Unlock()
+	msgs, err := queue.ListPending(ctx, t.queue, t.scanLimit)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		for ns, u := range t.previous {
+			t.reserved[ns] = t.reserved[ns].add(u)
+		}
+		t.previous = nil
+		return err
+	}
+	if len(msgs) == t.scanLimit {
+		logging.FromContext(ctx).Warnw("Only the first requests of the queue are counted against the quotas", zap.Int("limit", t.scanLimit))
+	}
+	scanned := make(map[string]Usage)
+	for _, msg := range msgs {
+		ns, size := "", int64(len(msg.Data))
+		if d, err := request.Unmarshal(msg.Data); err == nil {
+			if u, err := url.Parse(d.ReqURL); err == nil {
+				ns = Namespace(u.Host)
+			}
+			if d.ReqBodyRef != "" {
+				size += offloadedLength(d.ReqHeader)
+			}
+		}
+		scanned[ns] = scanned[ns].add(Usage{Requests: 1, Bytes: size})
+	}
+	t.scanned, t.previous = scanned, nil
+	return nil
+}
+
+// offloadedLength returns the length of a body offloaded to object storage,
+// from the headers of its request, or zero when unknown.
+func offloadedLength(header map[string][]string) int64 {
+	for k, v := range header {
+		if strings.EqualFold(k, "Content-Length") && len(v) > 0 {
+			if n, err := strconv.ParseInt(v[0], 10, 64); err == nil && n > 0 {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// Usage returns the usage of namespace.
+func (t *Tracker) Usage(namespace string) Usage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.usage(namespace)
+}
+
+func (t *Tracker) usage(namespace string) Usage {
+	return t.scanned[namespace].add(t.previous[namespace]).add(t.reserved[namespace])
+}
+
+// Reserve admits requests of namespace taking bytes in the queue, unless
+// they would take it over q. It returns an *ExceededError when they would.
+func (t *Tracker) Reserve(namespace string, q Quota, requests, bytes int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.unsupported {
+		return nil
+	}
+	used := t.usage(namespace)
+	if q.MaxPendingRequests > 0 && used.Requests+requests > q.MaxPendingRequests {
+		return &ExceededError{Namespace: namespace, Limit: "maxPendingRequests", Max: q.MaxPendingRequests, Used: used}
+	}
+	if q.MaxStoredBytes > 0 && used.Bytes+bytes > q.MaxStoredBytes {
+		return &ExceededError{Namespace: namespace, Limit: "maxStoredBytes", Max: q.MaxStoredBytes, Used: used}
+	}
+	t.reserved[namespace] = t.reserved[namespace].add(Usage{Requests: requests, Bytes: bytes})
+	return nil
+}
+
+// Release gives back a reservation whose requests were not queued.
+func (t *Tracker) Release(namespace string, requests, bytes int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reserved[namespace] = t.reserved[namespace].add(Usage{Requests: -requests, Bytes: -bytes})
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/request"
+)
+
+func TestNamespacesDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    Namespaces
+		wantErr bool
+	}{{
+		name: "empty",
+		want: Namespaces{},
+	}, {
+		name:  "quotas",
+		value: `{"tenant-a":{"maxPendingRequests":100},"tenant-b":{"maxStoredBytes":5000}}`,
+		want:  Namespaces{"tenant-a": {MaxPendingRequests: 100}, "tenant-b": {MaxStoredBytes: 5000}},
+	}, {
+		name:    "negative",
+		value:   `{"tenant-a":{"maxPendingRequests":-1}}`,
+		wantErr: true,
+	}, {
+		name:    "invalid",
+		value:   "tenant-a=100",
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got Namespaces
+			err := got.Decode(test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Decode() = %v, want error %v", err, test.wantErr)
+			}
+			if diff := cmp.Diff(test.want, got); err == nil && diff != "" {
+				t.Error("Decode() (-want, +got):", diff)
+			}
+		})
+	}
+}
+
+func TestFor(t *testing.T) {
+	cfg := QuotaConfig{
+		QuotaMaxPendingRequests: 10,
+		QuotaMaxStoredBytes:     1000,
+		QuotaNamespaces:         Namespaces{"tenant-a": {MaxPendingRequests: 100}},
+	}
+	if got, want := cfg.For("tenant-b"), (Quota{MaxPendingRequests: 10, MaxStoredBytes: 1000}); got != want {
+		t.Errorf("For(tenant-b) = %+v, want the default %+v", got, want)
+	}
+	// The quota of a namespace replaces the default one.
+	if got, want := cfg.For("tenant-a"), (Quota{MaxPendingRequests: 100}); got != want {
+		t.Errorf("For(tenant-a) = %+v, want %+v", got, want)
+	}
+	if (QuotaConfig{}).Enabled() {
+		t.Error("Enabled() = true without quotas")
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	for host, want := range map[string]string{
+		"orders.tenant-a.svc.cluster.local": "tenant-a",
+		"orders.tenant-a.example.com":       "tenant-a",
+		"orders.tenant-a":                   "tenant-a",
+		"localhost:8080":                    "",
+	} {
+		if got := Namespace(host); got != want {
+			t.Errorf("Namespace(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestTracker(t *testing.T) {
+	ctx := context.Background()
+	q := queue.NewMemory(queue.MemoryConfig{MemoryQueueName: fmt.Sprint(t.Name(), time.Now().UnixNano()), MemoryReadTimeout: time.Second})
+	var records [][]byte
+	for i, data := range []request.Data{
+		{ReqURL: "http://orders.tenant-a.svc/", ReqBody: "1234"},
+		{ReqURL: "http://users.tenant-a.svc/"},
+		{ReqURL: "http://orders.tenant-b.svc/", ReqBodyRef: "s3://bodies/3", ReqHeader: map[string][]string{"Content-Length": {"1000"}}},
+	} {
+		b, err := request.Marshal(data, request.FormatJSON, time.Now())
+		if err != nil {
+			t.Fatal("Marshal() =", err)
+		}
+		if err := q.Enqueue(ctx, fmt.Sprint(i), b); err != nil {
+			t.Fatal("Enqueue() =", err)
+		}
+		records = append(records, b)
+	}
+
+	tracker := NewTracker(q, 100)
+	if err := tracker.Refresh(ctx); err != nil {
+		t.Fatal("Refresh() =", err)
+	}
+	tenantA := Usage{Requests: 2, Bytes: int64(len(records[0]) + len(records[1]))}
+	if got := tracker.Usage("tenant-a"); got != tenantA {
+		t.Errorf("Usage(tenant-a) = %+v, want %+v", got, tenantA)
+	}
+	// Offloaded bodies are counted with the records.
+	if got, want := tracker.Usage("tenant-b"), (Usage{Requests: 1, Bytes: int64(len(records[2])) + 1000}); got != want {
+		t.Errorf("Usage(tenant-b) = %+v, want %+v", got, want)
+	}
+
+	quota := Quota{MaxPendingRequests: 3, MaxStoredBytes: tenantA.Bytes + 100}
+	if err := tracker.Reserve("tenant-a", quota, 1, 50); err != nil {
+		t.Fatal("Reserve() =", err)
+	}
+	var exceeded *ExceededError
+	err := tracker.Reserve("tenant-a", quota, 1, 10)
+	if !errors.As(err, &exceeded) || exceeded.Limit != "maxPendingRequests" || exceeded.Used.Requests != 3 {
+		t.Errorf("Reserve() = %v, want the maxPendingRequests quota exceeded with 3 requests", err)
+	}
+	// Reservations given back no longer count.
+	tracker.Release("tenant-a", 1, 50)
+	err = tracker.Reserve("tenant-a", quota, 1, 101)
+	if !errors.As(err, &exceeded) || exceeded.Limit != "maxStoredBytes" {
+		t.Errorf("Reserve() = %v, want the maxStoredBytes quota exceeded", err)
+	}
+	if err := tracker.Reserve("tenant-c", quota, 3, 0); err != nil {
+		t.Error("Reserve() of another namespace =", err)
+	}
+
+	// Requests delivered since the last refresh no longer count.
+	msgs, err := q.Dequeue(ctx)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Dequeue() = %v, %v, want a request", msgs, err)
+	}
+	if err := q.Ack(ctx, msgs[0]); err != nil {
+		t.Fatal("Ack() =", err)
+	}
+	if err := tracker.Refresh(ctx); err != nil {
+		t.Fatal("Refresh() =", err)
+	}
+	if got, want := tracker.Usage("tenant-a"), (Usage{Requests: 1, Bytes: int64(len(records[1]))}); got != want {
+		t.Errorf("Usage(tenant-a) after delivery = %+v, want %+v", got, want)
+	}
+}
+
+// unlistedQueue is a queue that cannot list its requests.
+type unlistedQueue struct {
+	queue.Queue
+}
+
+func TestTrackerUnsupported(t *testing.T) {
+	tracker := NewTracker(unlistedQueue{}, 100)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Run returns as soon as the queue tells it cannot list its requests.
+	tracker.Run(ctx, time.Hour, func() bool { return true })
+	if ctx.Err() != nil {
+		t.Fatal("Run() did not return")
+	}
+	if err := tracker.Reserve("tenant-a", Quota{MaxPendingRequests: 1}, 2, 0); err != nil {
+		t.Error("Reserve() =", err, "want requests admitted when quotas are not enforced")
+	}
+}
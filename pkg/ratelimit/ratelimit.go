@@ -0,0 +1,158 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ratelimit limits the rate at which each client can submit
+// asynchronous requests, so a single tenant cannot flood the shared queue.
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"knative.dev/async-component/pkg/headers"
+)
+
+const (
+	// KeyNamespace gives every namespace its own limit.
+	KeyNamespace = "namespace"
+	// KeyHost gives every service its own limit.
+	KeyHost = "host"
+	// KeyHeader gives every value of RATE_LIMIT_HEADER its own limit.
+	KeyHeader = "header"
+)
+
+// How often buckets of clients that went quiet are dropped.
+const sweepInterval = time.Minute
+
+// RateLimitConfig configures the rate limiter. Requests are not limited when
+// RATE_LIMIT is 0.
+type RateLimitConfig struct {
+	// RateLimit is the number of requests per second each client may submit.
+	RateLimit float64 `envconfig:"RATE_LIMIT"`
+	// RateLimitBurst is the number of requests a client may submit at once.
+	RateLimitBurst int `envconfig:"RATE_LIMIT_BURST" default:"10"`
+	// RateLimitKey is what clients are told apart by: namespace, host or
+	// header.
+	RateLimitKey string `envconfig:"RATE_LIMIT_KEY" default:"namespace"`
+	// RateLimitHeader is the header identifying clients with the header key.
+	RateLimitHeader string `envconfig:"RATE_LIMIT_HEADER" default:"Async-Client-Id"`
+}
+
+// Limiter is a token bucket rate limiter keeping a bucket per client.
+type Limiter struct {
+	cfg RateLimitConfig
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+// New returns the Limiter described by cfg, or nil if rate limiting is
+// disabled.
+func New(cfg RateLimitConfig) (*Limiter, error) {
+	if cfg.RateLimit == 0 {
+		return nil, nil
+	}
+	if cfg.RateLimit < 0 || cfg.RateLimitBurst <= 0 {
+		return nil, fmt.Errorf("RATE_LIMIT and RATE_LIMIT_BURST must be positive, got %v and %d", cfg.RateLimit, cfg.RateLimitBurst)
+	}
+	switch cfg.RateLimitKey {
+	case KeyNamespace, KeyHost:
+	case KeyHeader:
+		if cfg.RateLimitHeader == "" {
+			return nil, fmt.Errorf("RATE_LIMIT_HEADER must be set with the %q key", KeyHeader)
+		}
+	default:
+		return nil, fmt.Errorf("unknown rate limit key %q", cfg.RateLimitKey)
+	}
+	return &Limiter{
+		cfg:     cfg,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}, nil
+}
+
+// Key returns the client r is counted against. With the header key, requests
+// without the header are counted against the service they were sent to.
+func (l *Limiter) Key(r *http.Request) string {
+	host := r.Header.Get(headers.OriginalHost)
+	switch l.cfg.RateLimitKey {
+	case KeyNamespace:
+		// Service hosts are name.namespace.svc.cluster.local.
+		if parts := strings.SplitN(host, ".", 3); len(parts) > 1 {
+			return "namespace/" + parts[1]
+		}
+	case KeyHeader:
+		if client := r.Header.Get(l.cfg.RateLimitHeader); client != "" {
+			return "header/" + client
+		}
+	}
+	return "host/" + host
+}
+
+// Allow takes a token from the bucket of key. When it is empty, it returns
+// false and how long until the next token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	return l.AllowN(key, 1)
+}
+
+// AllowN takes n tokens at once from the bucket of key, for a batch of
+// requests. Batches larger than the burst take a full bucket. When there are
+// not enough tokens, it returns false and how long until there are.
+func (l *Limiter) AllowN(key string, n int) (bool, time.Duration) {
+	if n > l.cfg.RateLimitBurst {
+		n = l.cfg.RateLimitBurst
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(l.cfg.RateLimit), l.cfg.RateLimitBurst)}
+		l.buckets[key] = b
+	}
+	b.seen = now
+	r := b.limiter.ReserveN(now, n)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// sweep drops the buckets that have been refilled since they were last used,
+// which behave like new ones, so the number of buckets stays bounded by the
+// number of active clients.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	refill := time.Duration(float64(l.cfg.RateLimitBurst) / l.cfg.RateLimit * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.seen) > refill {
+			delete(l.buckets, key)
+		}
+	}
+}
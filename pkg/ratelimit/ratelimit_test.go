@@ -0,0 +1,159 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     RateLimitConfig
+		wantNil bool
+		wantErr bool
+	}{{
+		name:    "disabled",
+		wantNil: true,
+	}, {
+		name: "enabled",
+		cfg:  RateLimitConfig{RateLimit: 1, RateLimitBurst: 1, RateLimitKey: KeyHost},
+	}, {
+		name:    "unknown key",
+		cfg:     RateLimitConfig{RateLimit: 1, RateLimitBurst: 1, RateLimitKey: "ip"},
+		wantErr: true,
+	}, {
+		name:    "header key without header",
+		cfg:     RateLimitConfig{RateLimit: 1, RateLimitBurst: 1, RateLimitKey: KeyHeader},
+		wantErr: true,
+	}, {
+		name:    "no burst",
+		cfg:     RateLimitConfig{RateLimit: 1, RateLimitKey: KeyHost},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l, err := New(test.cfg)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err == nil && (l == nil) != test.wantNil {
+				t.Errorf("New() = %v, want nil: %v", l, test.wantNil)
+			}
+		})
+	}
+}
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    string
+		header map[string]string
+		want   string
+	}{{
+		name:   "namespace",
+		key:    KeyNamespace,
+		header: map[string]string{"Async-Original-Host": "hello.tenant-a.svc.cluster.local"},
+		want:   "namespace/tenant-a",
+	}, {
+		name:   "host",
+		key:    KeyHost,
+		header: map[string]string{"Async-Original-Host": "hello.tenant-a.svc.cluster.local"},
+		want:   "host/hello.tenant-a.svc.cluster.local",
+	}, {
+		name:   "client header",
+		key:    KeyHeader,
+		header: map[string]string{"Async-Original-Host": "hello.tenant-a.svc.cluster.local", "Async-Client-Id": "client-1"},
+		want:   "header/client-1",
+	}, {
+		name:   "missing client header",
+		key:    KeyHeader,
+		header: map[string]string{"Async-Original-Host": "hello.tenant-a.svc.cluster.local"},
+		want:   "host/hello.tenant-a.svc.cluster.local",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l, err := New(RateLimitConfig{RateLimit: 1, RateLimitBurst: 1, RateLimitKey: test.key, RateLimitHeader: "Async-Client-Id"})
+			if err != nil {
+				t.Fatal("New() =", err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "http://example.com/", nil)
+			for k, v := range test.header {
+				r.Header.Set(k, v)
+			}
+			if got := l.Key(r); got != test.want {
+				t.Errorf("Key() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAllow(t *testing.T) {
+	l, err := New(RateLimitConfig{RateLimit: 1, RateLimitBurst: 2, RateLimitKey: KeyHost})
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	allow := func(key string, want bool) {
+		t.Helper()
+		if got, retry := l.Allow(key); got != want || (!got && retry <= 0) {
+			t.Errorf("Allow(%q) = %v, %v, want %v", key, got, retry, want)
+		}
+	}
+	// The burst is allowed, then the bucket is empty.
+	allow("a", true)
+	allow("a", true)
+	allow("a", false)
+	// Other clients have their own bucket.
+	allow("b", true)
+	// Tokens are refilled at the configured rate.
+	now = now.Add(time.Second)
+	allow("a", true)
+	allow("a", false)
+
+	// Buckets of quiet clients are dropped.
+	now = now.Add(time.Hour)
+	allow("c", true)
+	if len(l.buckets) != 1 {
+		t.Errorf("got %d buckets after the sweep, want 1", len(l.buckets))
+	}
+}
+
+func TestAllowN(t *testing.T) {
+	l, err := New(RateLimitConfig{RateLimit: 1, RateLimitBurst: 5, RateLimitKey: KeyHost})
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	if ok, _ := l.AllowN("a", 3); !ok {
+		t.Error("AllowN(3) = false, want true")
+	}
+	if ok, retry := l.AllowN("a", 3); ok || retry != time.Second {
+		t.Errorf("AllowN(3) = %v, %v, want false, 1s", ok, retry)
+	}
+	// Batches larger than the burst take a full bucket.
+	if ok, _ := l.AllowN("b", 10); !ok {
+		t.Error("AllowN(10) = false, want true")
+	}
+	if ok, _ := l.Allow("b"); ok {
+		t.Error("Allow() = true after a batch larger than the burst, want false")
+	}
+}
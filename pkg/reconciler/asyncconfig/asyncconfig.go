@@ -0,0 +1,544 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package asyncconfig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"knative.dev/async-component/pkg/quota"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/logging"
+	pkgreconciler "knative.dev/pkg/reconciler"
+	"knative.dev/pkg/system"
+)
+
+// Reconciler implements controller.Reconciler for the AsyncConfig of the
+// system namespace, writing it to the config-async ConfigMap and to the
+// environment of the producer and consumer, and for those of other
+// namespaces, stamping out a producer and consumer for the namespace. Only
+// the leader of an AsyncConfig reconciles it. Failures are recorded as
+// Events of the AsyncConfig.
+type Reconciler struct {
+	pkgreconciler.LeaderAwareFuncs
+
+	kubeclient    kubernetes.Interface
+	dynamicclient dynamic.Interface
+	recorder      record.EventRecorder
+}
+
+const (
+	// Reasons of the Events of the AsyncConfigs.
+	invalidSpecReason   = "InvalidSpec"
+	internalErrorReason = "InternalError"
+	secretMissingReason = "SecretMissing"
+	// Name of the AsyncConfig that is reconciled in each namespace.
+	asyncConfigName        = "default"
+	configMapName          = "config-async"
+	consumerDeploymentName = "async-consumer"
+	producerServiceName    = "async-producer"
+	// Annotations recording the keys and Secret set from the AsyncConfig,
+	// so they are removed once they are no longer in its spec.
+	ManagedKeysAnnotationKey   = "async.knative.dev/managed-keys"
+	ManagedSecretAnnotationKey = "async.knative.dev/managed-secret"
+)
+
+var (
+	// AsyncConfigResource is the resource of AsyncConfigs, see
+	// config/async/300-asyncconfig.yaml.
+	AsyncConfigResource = schema.GroupVersionResource{Group: "async.knative.dev", Version: "v1alpha1", Resource: "asyncconfigs"}
+	// serviceResource is the Knative Service of the producer.
+	serviceResource = schema.GroupVersionResource{Group: "serving.knative.dev", Version: "v1", Resource: "services"}
+)
+
+// Queue backends, see the queue package.
+var backends = map[string]bool{
+	"redis": true, "kafka": true, "rabbitmq": true, "sqs": true, "pubsub": true,
+	"servicebus": true, "postgres": true, "channel": true, "memory": true,
+}
+
+var envName = regexp.MustCompile(`^[A-Z_][A-Z0-9_]*$`)
+
+// Spec is the spec of an AsyncConfig.
+type Spec struct {
+	Backend   Backend   `json:"backend,omitempty"`
+	Limits    Limits    `json:"limits,omitempty"`
+	Retries   Retries   `json:"retries,omitempty"`
+	Retention Retention `json:"retention,omitempty"`
+	Quotas    Quotas    `json:"quotas,omitempty"`
+	// NetworkPolicy, when set, makes the controller restrict the egress of
+	// the producer and consumer.
+	NetworkPolicy *NetworkPolicy `json:"networkPolicy,omitempty"`
+}
+
+// Backend is the queue backend of the producer and consumer.
+type Backend struct {
+	// Type is the QUEUE_BACKEND.
+	Type string `json:"type,omitempty"`
+	// Settings are the environment variables configuring the backend, such
+	// as REDIS_ADDRESS.
+	Settings map[string]string `json:"settings,omitempty"`
+	// CredentialsSecret is the Secret of the namespace whose keys are added
+	// to the environment, such as REDIS_PASSWORD.
+	CredentialsSecret string `json:"credentialsSecret,omitempty"`
+}
+
+// Limits bound the requests accepted and delivered in parallel.
+type Limits struct {
+	RequestSizeLimit *int64 `json:"requestSizeLimit,omitempty"`
+	RequestTTL       string `json:"requestTTL,omitempty"`
+	Concurrency      *int   `json:"concurrency,omitempty"`
+	HostConcurrency  *int   `json:"hostConcurrency,omitempty"`
+}
+
+// Retries are the default delivery retries of the services.
+type Retries struct {
+	Attempts   *int   `json:"attempts,omitempty"`
+	Backoff    string `json:"backoff,omitempty"`
+	MaxBackoff string `json:"maxBackoff,omitempty"`
+	Timeout    string `json:"timeout,omitempty"`
+}
+
+// Retention is how long the state of requests is kept.
+type Retention struct {
+	StatusTTL string `json:"statusTTL,omitempty"`
+}
+
+// Quotas bound the requests each namespace keeps in the queue. The default
+// quota applies to the namespaces that are not in Namespaces.
+type Quotas struct {
+	MaxPendingRequests *int64           `json:"maxPendingRequests,omitempty"`
+	MaxStoredBytes     *int64           `json:"maxStoredBytes,omitempty"`
+	Namespaces         quota.Namespaces `json:"namespaces,omitempty"`
+}
+
+// Reconcile implements controller.Reconciler.
+func (r *Reconciler) Reconcile(ctx context.Context, key string) error {
+	logger := logging.FromContext(ctx)
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		logger.Errorf("invalid resource key: %s", key)
+		return nil
+	}
+	if !r.IsLeaderFor(types.NamespacedName{Namespace: namespace, Name: name}) {
+		return controller.NewSkipKey(key)
+	}
+	obj, err := r.dynamicclient.Resource(AsyncConfigResource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		// The configuration it set is left in place, the components it
+		// stamped out for a namespace are garbage collected.
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get AsyncConfig: %w", err)
+	}
+	if err := r.reconcile(ctx, key, obj); err != nil {
+		reason := internalErrorReason
+		if controller.IsPermanentError(err) {
+			reason = invalidSpecReason
+		}
+		r.recorder.Event(obj, corev1.EventTypeWarning, reason, err.Error())
+		return err
+	}
+	return nil
+}
+
+// reconcile applies the AsyncConfig obj of key.
+func (r *Reconciler) reconcile(ctx context.Context, key string, obj *unstructured.Unstructured) error {
+	logger := logging.FromContext(ctx)
+	namespace := obj.GetNamespace()
+	spec, err := specOf(obj)
+	if err != nil {
+		return controller.NewPermanentError(err)
+	}
+	data, err := MakeConfigData(spec)
+	if err != nil {
+		logger.Errorf("error making the config-async data of %s: %v", key, err)
+		return controller.NewPermanentError(err)
+	}
+	policies, err := MakeNetworkPolicies(namespace, spec.NetworkPolicy)
+	if err != nil {
+		logger.Errorf("error making the NetworkPolicies of %s: %v", key, err)
+		return controller.NewPermanentError(err)
+	}
+	if err := r.checkSecret(ctx, obj, spec.Backend.CredentialsSecret); err != nil {
+		return err
+	}
+	if namespace != system.Namespace() {
+		// The AsyncConfig of another namespace stamps out its own components.
+		if err := r.reconcileConfigMap(ctx, namespace, data); err != nil {
+			return err
+		}
+		if err := r.reconcileNamespace(ctx, obj, spec); err != nil {
+			return err
+		}
+		return r.reconcileNetworkPolicies(ctx, namespace, policies, []metav1.OwnerReference{ownerReference(obj)})
+	}
+	env, err := MakeEnv(spec)
+	if err != nil {
+		logger.Errorf("error making the environment of %s: %v", key, err)
+		return controller.NewPermanentError(err)
+	}
+	if err := r.reconcileConfigMap(ctx, namespace, data); err != nil {
+		return err
+	}
+	if err := r.reconcileConsumer(ctx, namespace, env, spec.Backend.CredentialsSecret); err != nil {
+		return err
+	}
+	if err := r.reconcileProducer(ctx, namespace, env, spec.Backend.CredentialsSecret); err != nil {
+		return err
+	}
+	return r.reconcileNetworkPolicies(ctx, namespace, policies, nil)
+}
+
+// checkSecret records an Event of obj when the Secret of the backend
+// credentials is missing, which keeps the components from starting until it
+// is created.
+func (r *Reconciler) checkSecret(ctx context.Context, obj *unstructured.Unstructured, secret string) error {
+	if secret == "" {
+		return nil
+	}
+	_, err := r.kubeclient.CoreV1().Secrets(obj.GetNamespace()).Get(ctx, secret, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		r.recorder.Eventf(obj, corev1.EventTypeWarning, secretMissingReason,
+			"Secret %q of the backend credentials does not exist", secret)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get Secret: %w", err)
+	}
+	return nil
+}
+
+// specOf returns the spec of the AsyncConfig obj.
+func specOf(obj *unstructured.Unstructured) (Spec, error) {
+	var spec Spec
+	b, err := json.Marshal(obj.Object["spec"])
+	if err != nil {
+		return spec, fmt.Errorf("failed to marshal spec of AsyncConfig %s: %w", obj.GetName(), err)
+	}
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return spec, fmt.Errorf("failed to unmarshal spec of AsyncConfig %s: %w", obj.GetName(), err)
+	}
+	return spec, nil
+}
+
+// MakeConfigData returns the config-async keys set by spec, which the
+// producer and consumer apply without a restart.
+func MakeConfigData(spec Spec) (map[string]string, error) {
+	data := make(map[string]string)
+	setInt := func(key string, v *int64) error {
+		if v == nil {
+			return nil
+		}
+		if *v < 0 {
+			return fmt.Errorf("Invalid value for %s: %d", key, *v)
+		}
+		data[key] = strconv.FormatInt(*v, 10)
+		return nil
+	}
+	setDuration := func(key, v string) error {
+		if v == "" {
+			return nil
+		}
+		if d, err := time.ParseDuration(v); err != nil || d < 0 {
+			return fmt.Errorf("Invalid value for %s: %q", key, v)
+		}
+		data[key] = v
+		return nil
+	}
+	for _, err := range []error{
+		setInt("request-size-limit", spec.Limits.RequestSizeLimit),
+		setDuration("request-ttl", spec.Limits.RequestTTL),
+		setInt("concurrency", int64Ptr(spec.Limits.Concurrency)),
+		setInt("host-concurrency", int64Ptr(spec.Limits.HostConcurrency)),
+		setInt("delivery-attempts", int64Ptr(spec.Retries.Attempts)),
+		setDuration("delivery-backoff", spec.Retries.Backoff),
+		setDuration("delivery-max-backoff", spec.Retries.MaxBackoff),
+		setDuration("delivery-timeout", spec.Retries.Timeout),
+		setInt("quota-max-pending-requests", spec.Quotas.MaxPendingRequests),
+		setInt("quota-max-stored-bytes", spec.Quotas.MaxStoredBytes),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if spec.Retries.Attempts != nil && *spec.Retries.Attempts < 1 {
+		return nil, fmt.Errorf("Invalid value for delivery-attempts: %d", *spec.Retries.Attempts)
+	}
+	if len(spec.Quotas.Namespaces) > 0 {
+		for ns, q := range spec.Quotas.Namespaces {
+			if q.MaxPendingRequests < 0 || q.MaxStoredBytes < 0 {
+				return nil, fmt.Errorf("Invalid quota for namespace %q", ns)
+			}
+		}
+		b, err := json.Marshal(spec.Quotas.Namespaces)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal namespace quotas: %w", err)
+		}
+		data["quota-namespaces"] = string(b)
+	}
+	return data, nil
+}
+
+func int64Ptr(v *int) *int64 {
+	if v == nil {
+		return nil
+	}
+	i := int64(*v)
+	return &i
+}
+
+// MakeEnv returns the environment variables set by spec on the producer and
+// consumer, sorted by name. They are applied when the components restart.
+func MakeEnv(spec Spec) ([]corev1.EnvVar, error) {
+	var env []corev1.EnvVar
+	if t := spec.Backend.Type; t != "" {
+		if !backends[t] {
+			return nil, fmt.Errorf("unknown queue backend %q", t)
+		}
+		env = append(env, corev1.EnvVar{Name: "QUEUE_BACKEND", Value: t})
+	}
+	for name, value := range spec.Backend.Settings {
+		if !envName.MatchString(name) || name == "QUEUE_BACKEND" || name == "STATUS_TTL" {
+			return nil, fmt.Errorf("Invalid backend setting %q", name)
+		}
+		env = append(env, corev1.EnvVar{Name: name, Value: value})
+	}
+	if ttl := spec.Retention.StatusTTL; ttl != "" {
+		if d, err := time.ParseDuration(ttl); err != nil || d <= 0 {
+			return nil, fmt.Errorf("Invalid value for statusTTL: %q", ttl)
+		}
+		env = append(env, corev1.EnvVar{Name: "STATUS_TTL", Value: ttl})
+	}
+	sort.Slice(env, func(i, j int) bool { return env[i].Name < env[j].Name })
+	return env, nil
+}
+
+// managedKeys returns the keys recorded in the annotations of an object.
+func managedKeys(annotations map[string]string) map[string]bool {
+	keys := make(map[string]bool)
+	for _, k := range strings.Split(annotations[ManagedKeysAnnotationKey], ",") {
+		if k != "" {
+			keys[k] = true
+		}
+	}
+	return keys
+}
+
+// keyList returns the annotation value recording keys.
+func keyList(keys []string) string {
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+func (r *Reconciler) reconcileConfigMap(ctx context.Context, namespace string, data map[string]string) error {
+	client := r.kubeclient.CoreV1().ConfigMaps(namespace)
+	existing, err := client.Get(ctx, configMapName, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: configMapName, Namespace: namespace}, Data: data}
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		cm.Annotations = map[string]string{ManagedKeysAnnotationKey: keyList(keys)}
+		if _, err := client.Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create ConfigMap: %w", err)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get ConfigMap: %w", err)
+	}
+	// Don't modify the copy of the informer.
+	cm := existing.DeepCopy()
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	for k := range managedKeys(cm.Annotations) {
+		if _, ok := data[k]; !ok {
+			delete(cm.Data, k)
+		}
+	}
+	keys := make([]string, 0, len(data))
+	for k, v := range data {
+		cm.Data[k] = v
+		keys = append(keys, k)
+	}
+	if cm.Annotations == nil {
+		cm.Annotations = make(map[string]string)
+	}
+	cm.Annotations[ManagedKeysAnnotationKey] = keyList(keys)
+	if equality.Semantic.DeepEqual(existing, cm) {
+		return nil
+	}
+	if _, err := client.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update ConfigMap: %w", err)
+	}
+	return nil
+}
+
+// applyEnv sets env and the credentials Secret on container c of an object
+// with annotations, removing those set before that are no longer wanted.
+func applyEnv(c *corev1.Container, annotations map[string]string, env []corev1.EnvVar, secret string) {
+	previous := managedKeys(annotations)
+	wanted := make(map[string]corev1.EnvVar, len(env))
+	keys := make([]string, 0, len(env))
+	for _, e := range env {
+		wanted[e.Name] = e
+		keys = append(keys, e.Name)
+	}
+	kept := c.Env[:0]
+	for _, e := range c.Env {
+		if w, ok := wanted[e.Name]; ok {
+			kept = append(kept, w)
+			delete(wanted, e.Name)
+		} else if !previous[e.Name] {
+			kept = append(kept, e)
+		}
+	}
+	for _, e := range env {
+		if _, ok := wanted[e.Name]; ok {
+			kept = append(kept, e)
+		}
+	}
+	c.Env = kept
+	annotations[ManagedKeysAnnotationKey] = keyList(keys)
+
+	if old := annotations[ManagedSecretAnnotationKey]; old != "" && old != secret {
+		from := c.EnvFrom[:0]
+		for _, f := range c.EnvFrom {
+			if f.SecretRef == nil || f.SecretRef.Name != old {
+				from = append(from, f)
+			}
+		}
+		c.EnvFrom = from
+	}
+	delete(annotations, ManagedSecretAnnotationKey)
+	if secret == "" {
+		return
+	}
+	annotations[ManagedSecretAnnotationKey] = secret
+	for _, f := range c.EnvFrom {
+		if f.SecretRef != nil && f.SecretRef.Name == secret {
+			return
+		}
+	}
+	c.EnvFrom = append(c.EnvFrom, corev1.EnvFromSource{
+		SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: secret}},
+	})
+}
+
+func (r *Reconciler) reconcileConsumer(ctx context.Context, namespace string, env []corev1.EnvVar, secret string) error {
+	client := r.kubeclient.AppsV1().Deployments(namespace)
+	existing, err := client.Get(ctx, consumerDeploymentName, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		logging.FromContext(ctx).Info("Consumer Deployment not found, skipping it")
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get consumer Deployment: %w", err)
+	}
+	d := existing.DeepCopy()
+	containers := d.Spec.Template.Spec.Containers
+	if len(containers) == 0 {
+		return nil
+	}
+	if d.Annotations == nil {
+		d.Annotations = make(map[string]string)
+	}
+	applyEnv(&containers[0], d.Annotations, env, secret)
+	if equality.Semantic.DeepEqual(existing, d) {
+		return nil
+	}
+	if _, err := client.Update(ctx, d, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update consumer Deployment: %w", err)
+	}
+	return nil
+}
+
+func (r *Reconciler) reconcileProducer(ctx context.Context, namespace string, env []corev1.EnvVar, secret string) error {
+	client := r.dynamicclient.Resource(serviceResource).Namespace(namespace)
+	existing, err := client.Get(ctx, producerServiceName, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		logging.FromContext(ctx).Info("Producer Service not found, skipping it")
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get producer Service: %w", err)
+	}
+	svc := existing.DeepCopy()
+	annotations := svc.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	changed, err := updateContainer(svc, func(c *corev1.Container) {
+		applyEnv(c, annotations, env, secret)
+	})
+	if err != nil {
+		return err
+	}
+	if !changed && equality.Semantic.DeepEqual(existing.GetAnnotations(), annotations) {
+		return nil
+	}
+	svc.SetAnnotations(annotations)
+	if _, err := client.Update(ctx, svc, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update producer Service: %w", err)
+	}
+	return nil
+}
+
+// updateContainer applies update to the first container of the Knative
+// Service svc, and reports whether it changed.
+func updateContainer(svc *unstructured.Unstructured, update func(c *corev1.Container)) (bool, error) {
+	containers, found, err := unstructured.NestedSlice(svc.Object, "spec", "template", "spec", "containers")
+	if err != nil || !found || len(containers) == 0 {
+		return false, nil
+	}
+	first, ok := containers[0].(map[string]interface{})
+	if !ok {
+		return false, nil
+	}
+	var c corev1.Container
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(first, &c); err != nil {
+		return false, controller.NewPermanentError(fmt.Errorf("failed to read producer container: %w", err))
+	}
+	// The container is compared before being written back, as converting it
+	// adds its empty fields.
+	original := c.DeepCopy()
+	update(&c)
+	if equality.Semantic.DeepEqual(original, &c) {
+		return false, nil
+	}
+	if containers[0], err = runtime.DefaultUnstructuredConverter.ToUnstructured(&c); err != nil {
+		return false, fmt.Errorf("failed to write producer container: %w", err)
+	}
+	if err := unstructured.SetNestedSlice(svc.Object, containers, "spec", "template", "spec", "containers"); err != nil {
+		return false, fmt.Errorf("failed to write producer container: %w", err)
+	}
+	return true, nil
+}
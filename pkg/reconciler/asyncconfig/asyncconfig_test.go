@@ -0,0 +1,351 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package asyncconfig
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"knative.dev/async-component/pkg/quota"
+	"knative.dev/pkg/controller"
+	logtesting "knative.dev/pkg/logging/testing"
+	pkgreconciler "knative.dev/pkg/reconciler"
+)
+
+const testNamespace = "knative-testing"
+
+func asyncConfig(spec map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	obj.SetAPIVersion(AsyncConfigResource.GroupVersion().String())
+	obj.SetKind("AsyncConfig")
+	obj.SetName(asyncConfigName)
+	obj.SetNamespace(testNamespace)
+	return obj
+}
+
+func producerService(env ...interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{map[string]interface{}{
+						"image": "producer",
+						"env":   env,
+					}},
+				},
+			},
+		},
+	}}
+	obj.SetAPIVersion(serviceResource.GroupVersion().String())
+	obj.SetKind("Service")
+	obj.SetName(producerServiceName)
+	obj.SetNamespace(testNamespace)
+	return obj
+}
+
+func consumerDeployment(annotations map[string]string, env ...corev1.EnvVar) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: consumerDeploymentName, Namespace: testNamespace, Annotations: annotations},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: consumerDeploymentName, Env: env}},
+				},
+			},
+		},
+	}
+}
+
+func TestMakeConfigData(t *testing.T) {
+	three, minus := 3, -1
+	size := int64(1000)
+	tests := []struct {
+		name    string
+		spec    Spec
+		want    map[string]string
+		wantErr bool
+	}{{
+		name: "empty",
+		want: map[string]string{},
+	}, {
+		name: "limits and retries",
+		spec: Spec{
+			Limits:  Limits{RequestSizeLimit: &size, RequestTTL: "1h", Concurrency: &three},
+			Retries: Retries{Attempts: &three, Backoff: "2s", MaxBackoff: "1m", Timeout: "30s"},
+		},
+		want: map[string]string{
+			"request-size-limit":   "1000",
+			"request-ttl":          "1h",
+			"concurrency":          "3",
+			"delivery-attempts":    "3",
+			"delivery-backoff":     "2s",
+			"delivery-max-backoff": "1m",
+			"delivery-timeout":     "30s",
+		},
+	}, {
+		name: "quotas",
+		spec: Spec{Quotas: Quotas{
+			MaxPendingRequests: &size,
+			Namespaces:         quota.Namespaces{"tenant-a": {MaxPendingRequests: 10, MaxStoredBytes: 5000}},
+		}},
+		want: map[string]string{
+			"quota-max-pending-requests": "1000",
+			"quota-namespaces":           `{"tenant-a":{"maxPendingRequests":10,"maxStoredBytes":5000}}`,
+		},
+	}, {
+		name:    "negative namespace quota",
+		spec:    Spec{Quotas: Quotas{Namespaces: quota.Namespaces{"tenant-a": {MaxStoredBytes: -1}}}},
+		wantErr: true,
+	}, {
+		name:    "invalid duration",
+		spec:    Spec{Retries: Retries{Backoff: "soon"}},
+		wantErr: true,
+	}, {
+		name:    "negative concurrency",
+		spec:    Spec{Limits: Limits{HostConcurrency: &minus}},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := MakeConfigData(test.spec)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("MakeConfigData() = %v, want error %v", err, test.wantErr)
+			}
+			if diff := cmp.Diff(test.want, got); err == nil && diff != "" {
+				t.Error("MakeConfigData() (-want, +got):", diff)
+			}
+		})
+	}
+}
+
+func TestMakeEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    Spec
+		want    []corev1.EnvVar
+		wantErr bool
+	}{{
+		name: "empty",
+	}, {
+		name: "backend and retention",
+		spec: Spec{
+			Backend:   Backend{Type: "redis", Settings: map[string]string{"REDIS_STREAM_NAME": "mystream", "REDIS_ADDRESS": "redis://redis:6379"}},
+			Retention: Retention{StatusTTL: "48h"},
+		},
+		want: []corev1.EnvVar{
+			{Name: "QUEUE_BACKEND", Value: "redis"},
+			{Name: "REDIS_ADDRESS", Value: "redis://redis:6379"},
+			{Name: "REDIS_STREAM_NAME", Value: "mystream"},
+			{Name: "STATUS_TTL", Value: "48h"},
+		},
+	}, {
+		name:    "unknown backend",
+		spec:    Spec{Backend: Backend{Type: "mongodb"}},
+		wantErr: true,
+	}, {
+		name:    "invalid setting name",
+		spec:    Spec{Backend: Backend{Settings: map[string]string{"redis-address": "redis://redis:6379"}}},
+		wantErr: true,
+	}, {
+		name:    "invalid retention",
+		spec:    Spec{Retention: Retention{StatusTTL: "0s"}},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := MakeEnv(test.spec)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("MakeEnv() = %v, want error %v", err, test.wantErr)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Error("MakeEnv() (-want, +got):", diff)
+			}
+		})
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	config := asyncConfig(map[string]interface{}{
+		"backend": map[string]interface{}{
+			"type":              "redis",
+			"settings":          map[string]interface{}{"REDIS_ADDRESS": "redis://redis:6379"},
+			"credentialsSecret": "redis-credentials",
+		},
+		"retries": map[string]interface{}{"attempts": int64(5)},
+	})
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        configMapName,
+			Namespace:   testNamespace,
+			Annotations: map[string]string{ManagedKeysAnnotationKey: "delivery-timeout"},
+		},
+		Data: map[string]string{"delivery-timeout": "1m", "concurrency": "4"},
+	}
+	// REDIS_STREAM_NAME was set by a previous AsyncConfig, CONFIG_NAMESPACE
+	// by the operator.
+	d := consumerDeployment(map[string]string{ManagedKeysAnnotationKey: "REDIS_STREAM_NAME"},
+		corev1.EnvVar{Name: "CONFIG_NAMESPACE", Value: testNamespace},
+		corev1.EnvVar{Name: "REDIS_STREAM_NAME", Value: "old"},
+		corev1.EnvVar{Name: "QUEUE_BACKEND", Value: "kafka"},
+	)
+	kc := kubefake.NewSimpleClientset(cm, d)
+	dc := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), config,
+		producerService(map[string]interface{}{"name": "REQUEST_SIZE_LIMIT", "value": "6000000"}))
+	r := &Reconciler{kubeclient: kc, dynamicclient: dc, recorder: record.NewFakeRecorder(10)}
+	r.Promote(pkgreconciler.UniversalBucket(), nil)
+	ctx := logtesting.TestContextWithLogger(t)
+
+	for i := 0; i < 2; i++ {
+		if err := r.Reconcile(ctx, testNamespace+"/"+asyncConfigName); err != nil {
+			t.Fatal("Reconcile() =", err)
+		}
+	}
+
+	gotCM, err := kc.CoreV1().ConfigMaps(testNamespace).Get(context.Background(), configMapName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal("Error getting ConfigMap:", err)
+	}
+	if diff := cmp.Diff(map[string]string{"delivery-attempts": "5", "concurrency": "4"}, gotCM.Data); diff != "" {
+		t.Error("ConfigMap data (-want, +got):", diff)
+	}
+
+	wantEnv := []corev1.EnvVar{
+		{Name: "CONFIG_NAMESPACE", Value: testNamespace},
+		{Name: "QUEUE_BACKEND", Value: "redis"},
+		{Name: "REDIS_ADDRESS", Value: "redis://redis:6379"},
+	}
+	wantFrom := []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "redis-credentials"}}}}
+	gotD, err := kc.AppsV1().Deployments(testNamespace).Get(context.Background(), consumerDeploymentName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal("Error getting Deployment:", err)
+	}
+	c := gotD.Spec.Template.Spec.Containers[0]
+	if diff := cmp.Diff(wantEnv, c.Env); diff != "" {
+		t.Error("consumer env (-want, +got):", diff)
+	}
+	if diff := cmp.Diff(wantFrom, c.EnvFrom); diff != "" {
+		t.Error("consumer envFrom (-want, +got):", diff)
+	}
+
+	gotSvc, err := dc.Resource(serviceResource).Namespace(testNamespace).Get(context.Background(), producerServiceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal("Error getting Service:", err)
+	}
+	containers, _, _ := unstructured.NestedSlice(gotSvc.Object, "spec", "template", "spec", "containers")
+	var pc corev1.Container
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(containers[0].(map[string]interface{}), &pc); err != nil {
+		t.Fatal("Error reading producer container:", err)
+	}
+	wantEnv[0] = corev1.EnvVar{Name: "REQUEST_SIZE_LIMIT", Value: "6000000"}
+	if diff := cmp.Diff(wantEnv, pc.Env); diff != "" {
+		t.Error("producer env (-want, +got):", diff)
+	}
+	if diff := cmp.Diff(wantFrom, pc.EnvFrom); diff != "" {
+		t.Error("producer envFrom (-want, +got):", diff)
+	}
+	if pc.Image != "producer" {
+		t.Errorf("producer image = %q, want it kept", pc.Image)
+	}
+}
+
+func TestReconcileInvalid(t *testing.T) {
+	dc := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), asyncConfig(map[string]interface{}{
+		"retries": map[string]interface{}{"backoff": "soon"},
+	}))
+	recorder := record.NewFakeRecorder(10)
+	r := &Reconciler{kubeclient: kubefake.NewSimpleClientset(), dynamicclient: dc, recorder: recorder}
+	r.Promote(pkgreconciler.UniversalBucket(), nil)
+	err := r.Reconcile(logtesting.TestContextWithLogger(t), testNamespace+"/"+asyncConfigName)
+	if !controller.IsPermanentError(err) {
+		t.Errorf("Reconcile() = %v, want a permanent error", err)
+	}
+	if got := <-recorder.Events; !strings.HasPrefix(got, "Warning InvalidSpec ") {
+		t.Errorf("Event = %q, want an InvalidSpec warning", got)
+	}
+}
+
+func TestReconcileSecretMissing(t *testing.T) {
+	dc := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), asyncConfig(map[string]interface{}{
+		"backend": map[string]interface{}{"type": "redis", "credentialsSecret": "redis-credentials"},
+	}), producerService())
+	kc := kubefake.NewSimpleClientset(consumerDeployment(nil))
+	recorder := record.NewFakeRecorder(10)
+	r := &Reconciler{kubeclient: kc, dynamicclient: dc, recorder: recorder}
+	r.Promote(pkgreconciler.UniversalBucket(), nil)
+
+	// The components are still configured, they start once it is created.
+	if err := r.Reconcile(logtesting.TestContextWithLogger(t), testNamespace+"/"+asyncConfigName); err != nil {
+		t.Fatal("Reconcile() =", err)
+	}
+	want := `Warning SecretMissing Secret "redis-credentials" of the backend credentials does not exist`
+	if got := <-recorder.Events; got != want {
+		t.Errorf("Event = %q, want %q", got, want)
+	}
+
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "redis-credentials", Namespace: testNamespace}}
+	if _, err := kc.CoreV1().Secrets(testNamespace).Create(context.Background(), secret, metav1.CreateOptions{}); err != nil {
+		t.Fatal("Error creating Secret:", err)
+	}
+	if err := r.Reconcile(logtesting.TestContextWithLogger(t), testNamespace+"/"+asyncConfigName); err != nil {
+		t.Fatal("Reconcile() =", err)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("Event = %q, want none once the Secret exists", <-recorder.Events)
+	}
+}
+
+func TestReconcileNotLeader(t *testing.T) {
+	kc := kubefake.NewSimpleClientset()
+	dc := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), asyncConfig(map[string]interface{}{
+		"retries": map[string]interface{}{"attempts": int64(5)},
+	}))
+	r := &Reconciler{kubeclient: kc, dynamicclient: dc}
+	err := r.Reconcile(logtesting.TestContextWithLogger(t), testNamespace+"/"+asyncConfigName)
+	if !controller.IsSkipKey(err) {
+		t.Errorf("Reconcile() = %v, want the key skipped", err)
+	}
+	if actions := kc.Actions(); len(actions) != 0 {
+		t.Errorf("Reconcile() made %d actions, want none from a replica that is not the leader", len(actions))
+	}
+}
+
+func TestApplyEnvSecret(t *testing.T) {
+	c := &corev1.Container{EnvFrom: []corev1.EnvFromSource{
+		{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "tls-secret-name"}}},
+	}}
+	annotations := make(map[string]string)
+	applyEnv(c, annotations, nil, "old-credentials")
+	applyEnv(c, annotations, nil, "new-credentials")
+	var got []string
+	for _, f := range c.EnvFrom {
+		got = append(got, f.SecretRef.Name)
+	}
+	if diff := cmp.Diff([]string{"tls-secret-name", "new-credentials"}, got); diff != "" {
+		t.Error("envFrom Secrets (-want, +got):", diff)
+	}
+	applyEnv(c, annotations, nil, "")
+	if len(c.EnvFrom) != 1 || annotations[ManagedSecretAnnotationKey] != "" {
+		t.Errorf("envFrom = %v, annotations = %v, want the credentials removed", c.EnvFrom, annotations)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package asyncconfig
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	kubeclient "knative.dev/pkg/client/injection/kube/client"
+	"knative.dev/pkg/configmap"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/injection"
+	"knative.dev/pkg/injection/clients/dynamicclient"
+	"knative.dev/pkg/kmeta"
+	"knative.dev/pkg/logging"
+	pkgreconciler "knative.dev/pkg/reconciler"
+
+	"knative.dev/async-component/pkg/reconciler/events"
+)
+
+func init() {
+	injection.Default.RegisterInformer(withInformer)
+}
+
+// informerKey is the context key of the AsyncConfig informer.
+type informerKey struct{}
+
+// withInformer adds the informer of AsyncConfigs to ctx. AsyncConfigs have
+// no generated informer, they are watched as unstructured objects; the
+// informer is started by sharedmain with the injected ones.
+func withInformer(ctx context.Context) (context.Context, controller.Informer) {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynamicclient.Get(ctx), controller.GetResyncPeriod(ctx), metav1.NamespaceAll, nil)
+	informer := factory.ForResource(AsyncConfigResource).Informer()
+	return context.WithValue(ctx, informerKey{}, informer), informer
+}
+
+// getInformer returns the informer of AsyncConfigs added by withInformer.
+func getInformer(ctx context.Context) cache.SharedIndexInformer {
+	informer, ok := ctx.Value(informerKey{}).(cache.SharedIndexInformer)
+	if !ok {
+		logging.FromContext(ctx).Panic("Unable to fetch the AsyncConfig informer from context.")
+	}
+	return informer
+}
+
+// NewController creates a Reconciler of the AsyncConfigs and returns the
+// result of NewImpl.
+func NewController(
+	ctx context.Context,
+	cmw configmap.Watcher,
+) *controller.Impl {
+	logger := logging.FromContext(ctx)
+
+	r := &Reconciler{
+		kubeclient:    kubeclient.Get(ctx),
+		dynamicclient: dynamicclient.Get(ctx),
+		recorder:      events.NewRecorder(ctx, "asyncconfig-controller"),
+	}
+	impl := controller.NewImpl(r, logger, "AsyncConfigs")
+
+	logger.Info("Setting up event handlers.")
+
+	informer := getInformer(ctx)
+	informer.AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: controller.FilterWithName(asyncConfigName),
+		Handler:    controller.HandleAll(impl.Enqueue),
+	})
+	r.PromoteFunc = func(bkt pkgreconciler.Bucket, enq func(pkgreconciler.Bucket, types.NamespacedName)) error {
+		for _, obj := range informer.GetIndexer().List() {
+			config, err := kmeta.DeletionHandlingAccessor(obj)
+			if err == nil && config.GetName() == asyncConfigName {
+				enq(bkt, types.NamespacedName{Namespace: config.GetNamespace(), Name: config.GetName()})
+			}
+		}
+		return nil
+	}
+
+	return impl
+}
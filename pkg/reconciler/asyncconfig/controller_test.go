@@ -0,0 +1,49 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package asyncconfig
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	_ "knative.dev/pkg/client/injection/kube/client/fake"
+	"knative.dev/pkg/configmap"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/injection/clients/dynamicclient"
+	_ "knative.dev/pkg/injection/clients/dynamicclient/fake"
+
+	. "knative.dev/pkg/reconciler/testing"
+)
+
+func TestNew(t *testing.T) {
+	ctx, cancel, _ := SetupFakeContextWithCancel(t)
+	defer cancel()
+	// AsyncConfigs are listed as unstructured objects.
+	client := fakedynamic.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{AsyncConfigResource: "AsyncConfigList"})
+	ctx = context.WithValue(ctx, dynamicclient.Key{}, client)
+	ctx, informer := withInformer(ctx)
+
+	c := NewController(ctx, configmap.NewStaticWatcher())
+
+	if c == nil {
+		t.Fatal("Expected NewController to return a non-nil value")
+	}
+	if err := controller.StartInformers(ctx.Done(), informer); err != nil {
+		t.Fatal("StartInformers() =", err)
+	}
+}
@@ -0,0 +1,286 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package asyncconfig
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/ptr"
+	"knative.dev/pkg/system"
+)
+
+const (
+	// Service account of the producer and consumer of a namespace, bound to
+	// the ClusterRole of the components in that namespace only.
+	componentServiceAccountName = "async-config-reader"
+	componentClusterRoleName    = "async-component"
+)
+
+// queueNameSettings are the settings naming the queue of each backend. They
+// default to a name of their own in each namespace, so namespaces don't
+// share a queue.
+var queueNameSettings = map[string][]string{
+	"redis":      {"REDIS_STREAM_NAME"},
+	"kafka":      {"KAFKA_TOPIC"},
+	"rabbitmq":   {"RABBITMQ_QUEUE"},
+	"servicebus": {"SERVICEBUS_QUEUE"},
+	"pubsub":     {"PUBSUB_TOPIC", "PUBSUB_SUBSCRIPTION"},
+	"postgres":   {"POSTGRES_TABLE"},
+	"memory":     {"MEMORY_QUEUE_NAME"},
+}
+
+// requiredSettings are the settings of the backends whose queue cannot be
+// named after the namespace.
+var requiredSettings = map[string]string{
+	"sqs":     "SQS_QUEUE_URL",
+	"channel": "CHANNEL_SINK",
+}
+
+// MakeNamespaceEnv returns the environment of the producer and consumer of
+// namespace, sorted by name. Unlike the shared components, they don't inherit
+// any setting, so the backend must be set by spec.
+func MakeNamespaceEnv(namespace string, spec Spec) ([]corev1.EnvVar, error) {
+	backend := spec.Backend.Type
+	if backend == "" {
+		return nil, fmt.Errorf("backend.type is required for the components of namespace %s", namespace)
+	}
+	env, err := MakeEnv(spec)
+	if err != nil {
+		return nil, err
+	}
+	if name := requiredSettings[backend]; name != "" && spec.Backend.Settings[name] == "" {
+		return nil, fmt.Errorf("backend setting %s is required for the components of namespace %s", name, namespace)
+	}
+	queue := "async-" + namespace
+	if backend == "postgres" {
+		queue = strings.ReplaceAll(queue, "-", "_")
+	}
+	for _, name := range queueNameSettings[backend] {
+		if _, ok := spec.Backend.Settings[name]; !ok {
+			env = append(env, corev1.EnvVar{Name: name, Value: queue})
+		}
+	}
+	env = append(env, corev1.EnvVar{Name: "CONFIG_NAMESPACE", Value: namespace})
+	sort.Slice(env, func(i, j int) bool { return env[i].Name < env[j].Name })
+	return env, nil
+}
+
+// ownerReference returns the reference making the components of a namespace
+// deleted with its AsyncConfig.
+func ownerReference(obj *unstructured.Unstructured) metav1.OwnerReference {
+	return metav1.OwnerReference{
+		APIVersion:         obj.GetAPIVersion(),
+		Kind:               obj.GetKind(),
+		Name:               obj.GetName(),
+		UID:                obj.GetUID(),
+		Controller:         ptr.Bool(true),
+		BlockOwnerDeletion: ptr.Bool(true),
+	}
+}
+
+// setComponentContainer sets the image, environment and credentials of the
+// container of a component of a namespace.
+func setComponentContainer(c *corev1.Container, image string, env []corev1.EnvVar, secret string) {
+	c.Image = image
+	c.Env = env
+	c.EnvFrom = nil
+	if secret != "" {
+		c.EnvFrom = []corev1.EnvFromSource{{
+			SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: secret}},
+		}}
+	}
+}
+
+// reconcileNamespace stamps out the producer and consumer of the namespace of
+// the AsyncConfig obj, with their own queue and credentials. They are made
+// from the shared components of the system namespace, of which only the
+// container image and pod settings are kept.
+func (r *Reconciler) reconcileNamespace(ctx context.Context, obj *unstructured.Unstructured, spec Spec) error {
+	namespace := obj.GetNamespace()
+	env, err := MakeNamespaceEnv(namespace, spec)
+	if err != nil {
+		logging.FromContext(ctx).Errorf("error making the environment of namespace %s: %v", namespace, err)
+		return controller.NewPermanentError(err)
+	}
+	owner := ownerReference(obj)
+	if err := r.reconcileServiceAccount(ctx, namespace, owner); err != nil {
+		return err
+	}
+	if err := r.reconcileNamespaceConsumer(ctx, namespace, owner, env, spec.Backend.CredentialsSecret); err != nil {
+		return err
+	}
+	return r.reconcileNamespaceProducer(ctx, namespace, owner, env, spec.Backend.CredentialsSecret)
+}
+
+func (r *Reconciler) reconcileServiceAccount(ctx context.Context, namespace string, owner metav1.OwnerReference) error {
+	meta := metav1.ObjectMeta{
+		Name:            componentServiceAccountName,
+		Namespace:       namespace,
+		OwnerReferences: []metav1.OwnerReference{owner},
+	}
+	accounts := r.kubeclient.CoreV1().ServiceAccounts(namespace)
+	if _, err := accounts.Get(ctx, meta.Name, metav1.GetOptions{}); apierrs.IsNotFound(err) {
+		if _, err := accounts.Create(ctx, &corev1.ServiceAccount{ObjectMeta: meta}, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create ServiceAccount: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to get ServiceAccount: %w", err)
+	}
+	bindings := r.kubeclient.RbacV1().RoleBindings(namespace)
+	if _, err := bindings.Get(ctx, meta.Name, metav1.GetOptions{}); apierrs.IsNotFound(err) {
+		rb := &rbacv1.RoleBinding{
+			ObjectMeta: meta,
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: componentServiceAccountName, Namespace: namespace}},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: componentClusterRoleName},
+		}
+		if _, err := bindings.Create(ctx, rb, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create RoleBinding: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to get RoleBinding: %w", err)
+	}
+	return nil
+}
+
+func (r *Reconciler) reconcileNamespaceConsumer(ctx context.Context, namespace string, owner metav1.OwnerReference, env []corev1.EnvVar, secret string) error {
+	shared, err := r.kubeclient.AppsV1().Deployments(system.Namespace()).Get(ctx, consumerDeploymentName, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		logging.FromContext(ctx).Info("Shared consumer Deployment not found, skipping the consumer of the namespace")
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get shared consumer Deployment: %w", err)
+	} else if len(shared.Spec.Template.Spec.Containers) == 0 {
+		return nil
+	}
+	image := shared.Spec.Template.Spec.Containers[0].Image
+	update := func(d *appsv1.Deployment) {
+		d.Spec.Template.Spec.ServiceAccountName = componentServiceAccountName
+		setComponentContainer(&d.Spec.Template.Spec.Containers[0], image, env, secret)
+	}
+
+	client := r.kubeclient.AppsV1().Deployments(namespace)
+	existing, err := client.Get(ctx, consumerDeploymentName, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		d := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            consumerDeploymentName,
+				Namespace:       namespace,
+				Labels:          shared.Labels,
+				OwnerReferences: []metav1.OwnerReference{owner},
+			},
+			Spec: appsv1.DeploymentSpec{
+				Replicas: shared.Spec.Replicas,
+				Selector: shared.Spec.Selector.DeepCopy(),
+				Template: *shared.Spec.Template.DeepCopy(),
+			},
+		}
+		update(d)
+		if _, err := client.Create(ctx, d, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create consumer Deployment: %w", err)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get consumer Deployment: %w", err)
+	} else if len(existing.Spec.Template.Spec.Containers) == 0 {
+		return nil
+	}
+	// Only the fields set by the controller are compared, the others are
+	// defaulted by the API server.
+	d := existing.DeepCopy()
+	update(d)
+	if equality.Semantic.DeepEqual(existing, d) {
+		return nil
+	}
+	if _, err := client.Update(ctx, d, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update consumer Deployment: %w", err)
+	}
+	return nil
+}
+
+func (r *Reconciler) reconcileNamespaceProducer(ctx context.Context, namespace string, owner metav1.OwnerReference, env []corev1.EnvVar, secret string) error {
+	shared, err := r.dynamicclient.Resource(serviceResource).Namespace(system.Namespace()).Get(ctx, producerServiceName, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		logging.FromContext(ctx).Info("Shared producer Service not found, skipping the producer of the namespace")
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get shared producer Service: %w", err)
+	}
+	var image string
+	if _, err := updateContainer(shared, func(c *corev1.Container) { image = c.Image }); err != nil {
+		return err
+	}
+	update := func(svc *unstructured.Unstructured) (bool, error) {
+		changed, err := updateContainer(svc, func(c *corev1.Container) {
+			setComponentContainer(c, image, env, secret)
+		})
+		if err != nil {
+			return false, err
+		}
+		if sa, _, _ := unstructured.NestedString(svc.Object, "spec", "template", "spec", "serviceAccountName"); sa != componentServiceAccountName {
+			changed = true
+			if err := unstructured.SetNestedField(svc.Object, componentServiceAccountName, "spec", "template", "spec", "serviceAccountName"); err != nil {
+				return false, fmt.Errorf("failed to write producer service account: %w", err)
+			}
+		}
+		return changed, nil
+	}
+
+	client := r.dynamicclient.Resource(serviceResource).Namespace(namespace)
+	existing, err := client.Get(ctx, producerServiceName, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		template, _, err := unstructured.NestedMap(shared.Object, "spec", "template")
+		if err != nil {
+			return controller.NewPermanentError(fmt.Errorf("failed to read shared producer template: %w", err))
+		}
+		unstructured.RemoveNestedField(template, "metadata", "name")
+		svc := &unstructured.Unstructured{Object: map[string]interface{}{
+			"spec": map[string]interface{}{"template": template},
+		}}
+		svc.SetAPIVersion(shared.GetAPIVersion())
+		svc.SetKind(shared.GetKind())
+		svc.SetName(producerServiceName)
+		svc.SetNamespace(namespace)
+		svc.SetLabels(shared.GetLabels())
+		svc.SetOwnerReferences([]metav1.OwnerReference{owner})
+		if _, err := update(svc); err != nil {
+			return err
+		}
+		if _, err := client.Create(ctx, svc, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create producer Service: %w", err)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get producer Service: %w", err)
+	}
+	svc := existing.DeepCopy()
+	if changed, err := update(svc); err != nil || !changed {
+		return err
+	}
+	if _, err := client.Update(ctx, svc, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update producer Service: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package asyncconfig
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	logtesting "knative.dev/pkg/logging/testing"
+	pkgreconciler "knative.dev/pkg/reconciler"
+)
+
+const tenantNamespace = "tenant-a"
+
+func TestMakeNamespaceEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    Spec
+		want    []corev1.EnvVar
+		wantErr bool
+	}{{
+		name:    "no backend",
+		wantErr: true,
+	}, {
+		name: "queue named after the namespace",
+		spec: Spec{Backend: Backend{Type: "redis", Settings: map[string]string{"REDIS_ADDRESS": "redis://redis:6379"}}},
+		want: []corev1.EnvVar{
+			{Name: "CONFIG_NAMESPACE", Value: tenantNamespace},
+			{Name: "QUEUE_BACKEND", Value: "redis"},
+			{Name: "REDIS_ADDRESS", Value: "redis://redis:6379"},
+			{Name: "REDIS_STREAM_NAME", Value: "async-tenant-a"},
+		},
+	}, {
+		name: "queue set",
+		spec: Spec{Backend: Backend{Type: "kafka", Settings: map[string]string{"KAFKA_TOPIC": "requests"}}},
+		want: []corev1.EnvVar{
+			{Name: "CONFIG_NAMESPACE", Value: tenantNamespace},
+			{Name: "KAFKA_TOPIC", Value: "requests"},
+			{Name: "QUEUE_BACKEND", Value: "kafka"},
+		},
+	}, {
+		name: "postgres table",
+		spec: Spec{Backend: Backend{Type: "postgres"}},
+		want: []corev1.EnvVar{
+			{Name: "CONFIG_NAMESPACE", Value: tenantNamespace},
+			{Name: "POSTGRES_TABLE", Value: "async_tenant_a"},
+			{Name: "QUEUE_BACKEND", Value: "postgres"},
+		},
+	}, {
+		name:    "sqs queue required",
+		spec:    Spec{Backend: Backend{Type: "sqs"}},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := MakeNamespaceEnv(tenantNamespace, test.spec)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("MakeNamespaceEnv() = %v, want error %v", err, test.wantErr)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Error("MakeNamespaceEnv() (-want, +got):", diff)
+			}
+		})
+	}
+}
+
+func TestReconcileNamespace(t *testing.T) {
+	config := asyncConfig(map[string]interface{}{
+		"backend": map[string]interface{}{
+			"type":              "redis",
+			"settings":          map[string]interface{}{"REDIS_ADDRESS": "redis://tenant-redis:6379"},
+			"credentialsSecret": "tenant-credentials",
+		},
+		"limits": map[string]interface{}{"concurrency": int64(2)},
+	})
+	config.SetNamespace(tenantNamespace)
+	config.SetUID("uid")
+	// The shared components use the credentials of the system namespace.
+	shared := consumerDeployment(nil, corev1.EnvVar{Name: "REDIS_ADDRESS", Value: "redis://shared:6379"})
+	shared.Spec.Template.Spec.Containers[0].Image = "consumer"
+	shared.Spec.Template.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{
+		{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "tls-secret-name"}}},
+	}
+	kc := kubefake.NewSimpleClientset(shared)
+	dc := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), config,
+		producerService(map[string]interface{}{"name": "REDIS_ADDRESS", "value": "redis://shared:6379"}))
+	r := &Reconciler{kubeclient: kc, dynamicclient: dc, recorder: record.NewFakeRecorder(10)}
+	r.Promote(pkgreconciler.UniversalBucket(), nil)
+	ctx := logtesting.TestContextWithLogger(t)
+
+	for i := 0; i < 2; i++ {
+		if err := r.Reconcile(ctx, tenantNamespace+"/"+asyncConfigName); err != nil {
+			t.Fatal("Reconcile() =", err)
+		}
+	}
+
+	cm, err := kc.CoreV1().ConfigMaps(tenantNamespace).Get(context.Background(), configMapName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal("Error getting ConfigMap:", err)
+	}
+	if diff := cmp.Diff(map[string]string{"concurrency": "2"}, cm.Data); diff != "" {
+		t.Error("ConfigMap data (-want, +got):", diff)
+	}
+	if _, err := kc.CoreV1().ServiceAccounts(tenantNamespace).Get(context.Background(), componentServiceAccountName, metav1.GetOptions{}); err != nil {
+		t.Error("Error getting ServiceAccount:", err)
+	}
+	rb, err := kc.RbacV1().RoleBindings(tenantNamespace).Get(context.Background(), componentServiceAccountName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal("Error getting RoleBinding:", err)
+	}
+	if rb.RoleRef.Name != componentClusterRoleName {
+		t.Errorf("RoleBinding role = %q, want %q", rb.RoleRef.Name, componentClusterRoleName)
+	}
+
+	wantEnv := []corev1.EnvVar{
+		{Name: "CONFIG_NAMESPACE", Value: tenantNamespace},
+		{Name: "QUEUE_BACKEND", Value: "redis"},
+		{Name: "REDIS_ADDRESS", Value: "redis://tenant-redis:6379"},
+		{Name: "REDIS_STREAM_NAME", Value: "async-tenant-a"},
+	}
+	wantFrom := []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "tenant-credentials"}}}}
+	wantOwners := []metav1.OwnerReference{ownerReference(config)}
+
+	d, err := kc.AppsV1().Deployments(tenantNamespace).Get(context.Background(), consumerDeploymentName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal("Error getting consumer Deployment:", err)
+	}
+	if diff := cmp.Diff(wantOwners, d.OwnerReferences); diff != "" {
+		t.Error("consumer owners (-want, +got):", diff)
+	}
+	if sa := d.Spec.Template.Spec.ServiceAccountName; sa != componentServiceAccountName {
+		t.Errorf("consumer service account = %q, want %q", sa, componentServiceAccountName)
+	}
+	c := d.Spec.Template.Spec.Containers[0]
+	if c.Image != "consumer" {
+		t.Errorf("consumer image = %q, want the shared image", c.Image)
+	}
+	if diff := cmp.Diff(wantEnv, c.Env); diff != "" {
+		t.Error("consumer env (-want, +got):", diff)
+	}
+	if diff := cmp.Diff(wantFrom, c.EnvFrom); diff != "" {
+		t.Error("consumer envFrom (-want, +got):", diff)
+	}
+
+	svc, err := dc.Resource(serviceResource).Namespace(tenantNamespace).Get(context.Background(), producerServiceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal("Error getting producer Service:", err)
+	}
+	if diff := cmp.Diff(wantOwners, svc.GetOwnerReferences()); diff != "" {
+		t.Error("producer owners (-want, +got):", diff)
+	}
+	if sa, _, _ := unstructured.NestedString(svc.Object, "spec", "template", "spec", "serviceAccountName"); sa != componentServiceAccountName {
+		t.Errorf("producer service account = %q, want %q", sa, componentServiceAccountName)
+	}
+	var pc corev1.Container
+	if _, err := updateContainer(svc, func(c *corev1.Container) { pc = *c }); err != nil {
+		t.Fatal("Error reading producer container:", err)
+	}
+	if pc.Image != "producer" {
+		t.Errorf("producer image = %q, want the shared image", pc.Image)
+	}
+	if diff := cmp.Diff(wantEnv, pc.Env); diff != "" {
+		t.Error("producer env (-want, +got):", diff)
+	}
+	if diff := cmp.Diff(wantFrom, pc.EnvFrom); diff != "" {
+		t.Error("producer envFrom (-want, +got):", diff)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package asyncconfig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// Label of the NetworkPolicies created by the controller, which are the
+	// only ones it updates or deletes.
+	managedByLabelKey   = "app.kubernetes.io/managed-by"
+	managedByLabelValue = "async-controller"
+	// Labels of the pods of the producer and consumer.
+	producerPodLabelKey = "serving.knative.dev/service"
+	consumerPodLabelKey = "app"
+	// Label set by Kubernetes on namespaces to their name.
+	namespaceNameLabelKey = "kubernetes.io/metadata.name"
+)
+
+// NetworkPolicy restricts where the producer and consumer can connect to, as
+// they proxy arbitrary request payloads.
+type NetworkPolicy struct {
+	// Backend are the egress rules of the queue backend, and of the other
+	// destinations of the components, such as the API server when
+	// CONFIG_NAMESPACE is set.
+	Backend []networkingv1.NetworkPolicyEgressRule `json:"backend,omitempty"`
+	// TargetNamespaces are the namespaces of the services requests are
+	// delivered to, and of the gateways they go through. Any namespace of the
+	// cluster when empty.
+	TargetNamespaces []string `json:"targetNamespaces,omitempty"`
+}
+
+// MakeNetworkPolicies returns the NetworkPolicies of the producer and consumer
+// of namespace, which only let them resolve names and connect to the backend
+// and the target namespaces. There are none when np is nil.
+func MakeNetworkPolicies(namespace string, np *NetworkPolicy) ([]*networkingv1.NetworkPolicy, error) {
+	if np == nil {
+		return nil, nil
+	}
+	if len(np.Backend) == 0 {
+		return nil, errors.New("networkPolicy.backend is required")
+	}
+	udp, tcp, dns := corev1.ProtocolUDP, corev1.ProtocolTCP, intstr.FromInt(53)
+	egress := []networkingv1.NetworkPolicyEgressRule{{
+		Ports: []networkingv1.NetworkPolicyPort{{Protocol: &udp, Port: &dns}, {Protocol: &tcp, Port: &dns}},
+	}}
+	egress = append(egress, np.Backend...)
+	targets := metav1.LabelSelector{}
+	if len(np.TargetNamespaces) > 0 {
+		targets.MatchExpressions = []metav1.LabelSelectorRequirement{{
+			Key:      namespaceNameLabelKey,
+			Operator: metav1.LabelSelectorOpIn,
+			Values:   np.TargetNamespaces,
+		}}
+	}
+	egress = append(egress, networkingv1.NetworkPolicyEgressRule{
+		To: []networkingv1.NetworkPolicyPeer{{NamespaceSelector: &targets}},
+	})
+
+	policy := func(name string, pods map[string]string) *networkingv1.NetworkPolicy {
+		return &networkingv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels:    map[string]string{managedByLabelKey: managedByLabelValue},
+			},
+			Spec: networkingv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: pods},
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+				Egress:      egress,
+			},
+		}
+	}
+	return []*networkingv1.NetworkPolicy{
+		policy(producerServiceName, map[string]string{producerPodLabelKey: producerServiceName}),
+		policy(consumerDeploymentName, map[string]string{consumerPodLabelKey: consumerDeploymentName}),
+	}, nil
+}
+
+// reconcileNetworkPolicies creates or updates the NetworkPolicies of the
+// components of namespace, owned by owners, and deletes those it created
+// once they are no longer desired.
+func (r *Reconciler) reconcileNetworkPolicies(ctx context.Context, namespace string, desired []*networkingv1.NetworkPolicy, owners []metav1.OwnerReference) error {
+	client := r.kubeclient.NetworkingV1().NetworkPolicies(namespace)
+	if len(desired) == 0 {
+		for _, name := range []string{producerServiceName, consumerDeploymentName} {
+			existing, err := client.Get(ctx, name, metav1.GetOptions{})
+			if apierrs.IsNotFound(err) || (err == nil && existing.Labels[managedByLabelKey] != managedByLabelValue) {
+				continue
+			} else if err != nil {
+				return fmt.Errorf("failed to get NetworkPolicy: %w", err)
+			}
+			if err := client.Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrs.IsNotFound(err) {
+				return fmt.Errorf("failed to delete NetworkPolicy: %w", err)
+			}
+		}
+		return nil
+	}
+	for _, np := range desired {
+		np.OwnerReferences = owners
+		existing, err := client.Get(ctx, np.Name, metav1.GetOptions{})
+		if apierrs.IsNotFound(err) {
+			if _, err := client.Create(ctx, np, metav1.CreateOptions{}); err != nil {
+				return fmt.Errorf("failed to create NetworkPolicy: %w", err)
+			}
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to get NetworkPolicy: %w", err)
+		}
+		if existing.Labels[managedByLabelKey] != managedByLabelValue {
+			logging.FromContext(ctx).Infof("NetworkPolicy %s/%s is not managed by the controller, leaving it alone", namespace, np.Name)
+			continue
+		}
+		if equality.Semantic.DeepEqual(existing.Spec, np.Spec) &&
+			equality.Semantic.DeepEqual(existing.OwnerReferences, np.OwnerReferences) {
+			continue
+		}
+		update := existing.DeepCopy()
+		update.Spec = np.Spec
+		update.OwnerReferences = np.OwnerReferences
+		if _, err := client.Update(ctx, update, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("failed to update NetworkPolicy: %w", err)
+		}
+	}
+	return nil
+}
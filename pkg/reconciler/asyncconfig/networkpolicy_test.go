@@ -0,0 +1,154 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package asyncconfig
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	logtesting "knative.dev/pkg/logging/testing"
+	pkgreconciler "knative.dev/pkg/reconciler"
+)
+
+// redisEgress is the egress rule of a Redis of the redis namespace.
+var redisEgress = map[string]interface{}{
+	"to": []interface{}{map[string]interface{}{
+		"namespaceSelector": map[string]interface{}{
+			"matchLabels": map[string]interface{}{namespaceNameLabelKey: "redis"},
+		},
+	}},
+}
+
+func TestMakeNetworkPolicies(t *testing.T) {
+	backend := []networkingv1.NetworkPolicyEgressRule{{
+		To: []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/24"}}},
+	}}
+	tests := []struct {
+		name string
+		np   *NetworkPolicy
+		// wantTargets is the namespace selector of the last egress rule.
+		wantTargets *metav1.LabelSelector
+		wantNone    bool
+		wantErr     bool
+	}{{
+		name:     "not set",
+		wantNone: true,
+	}, {
+		name:    "no backend",
+		np:      &NetworkPolicy{TargetNamespaces: []string{"default"}},
+		wantErr: true,
+	}, {
+		name:        "any namespace",
+		np:          &NetworkPolicy{Backend: backend},
+		wantTargets: &metav1.LabelSelector{},
+	}, {
+		name: "target namespaces",
+		np:   &NetworkPolicy{Backend: backend, TargetNamespaces: []string{"default", "istio-system"}},
+		wantTargets: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{
+			Key:      namespaceNameLabelKey,
+			Operator: metav1.LabelSelectorOpIn,
+			Values:   []string{"default", "istio-system"},
+		}}},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := MakeNetworkPolicies(tenantNamespace, test.np)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("MakeNetworkPolicies() = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil || test.wantNone {
+				if len(got) != 0 {
+					t.Errorf("MakeNetworkPolicies() = %v, want none", got)
+				}
+				return
+			}
+			if len(got) != 2 {
+				t.Fatalf("got %d NetworkPolicies, want those of the producer and consumer", len(got))
+			}
+			for _, np := range got {
+				egress := np.Spec.Egress
+				// DNS, the backend and the targets.
+				if len(egress) != 3 {
+					t.Fatalf("NetworkPolicy %s has %d egress rules, want 3", np.Name, len(egress))
+				}
+				if diff := cmp.Diff(backend[0], egress[1]); diff != "" {
+					t.Errorf("NetworkPolicy %s backend (-want, +got): %s", np.Name, diff)
+				}
+				if diff := cmp.Diff(test.wantTargets, egress[2].To[0].NamespaceSelector); diff != "" {
+					t.Errorf("NetworkPolicy %s targets (-want, +got): %s", np.Name, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileNetworkPolicies(t *testing.T) {
+	config := asyncConfig(map[string]interface{}{
+		"backend": map[string]interface{}{"type": "redis"},
+		"networkPolicy": map[string]interface{}{
+			"backend":          []interface{}{redisEgress},
+			"targetNamespaces": []interface{}{tenantNamespace},
+		},
+	})
+	config.SetNamespace(tenantNamespace)
+	config.SetUID("uid")
+	// A NetworkPolicy of the tenant is left alone.
+	own := &networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: consumerDeploymentName, Namespace: tenantNamespace}}
+	kc := kubefake.NewSimpleClientset(own)
+	dc := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), config)
+	r := &Reconciler{kubeclient: kc, dynamicclient: dc, recorder: record.NewFakeRecorder(10)}
+	r.Promote(pkgreconciler.UniversalBucket(), nil)
+	ctx := logtesting.TestContextWithLogger(t)
+
+	if err := r.Reconcile(ctx, tenantNamespace+"/"+asyncConfigName); err != nil {
+		t.Fatal("Reconcile() =", err)
+	}
+	policies := kc.NetworkingV1().NetworkPolicies(tenantNamespace)
+	np, err := policies.Get(context.Background(), producerServiceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal("Error getting producer NetworkPolicy:", err)
+	}
+	if diff := cmp.Diff([]metav1.OwnerReference{ownerReference(config)}, np.OwnerReferences); diff != "" {
+		t.Error("NetworkPolicy owners (-want, +got):", diff)
+	}
+	if got := np.Spec.PodSelector.MatchLabels[producerPodLabelKey]; got != producerServiceName {
+		t.Errorf("NetworkPolicy selects the pods of %q, want the producer", got)
+	}
+	if got, err := policies.Get(context.Background(), consumerDeploymentName, metav1.GetOptions{}); err != nil || len(got.Spec.Egress) != 0 {
+		t.Errorf("Get() = %v, %v, want the NetworkPolicy of the tenant unchanged", got, err)
+	}
+
+	// Removing the networkPolicy deletes the NetworkPolicies created.
+	delete(config.Object["spec"].(map[string]interface{}), "networkPolicy")
+	if _, err := dc.Resource(AsyncConfigResource).Namespace(tenantNamespace).Update(context.Background(), config, metav1.UpdateOptions{}); err != nil {
+		t.Fatal("Error updating AsyncConfig:", err)
+	}
+	if err := r.Reconcile(ctx, tenantNamespace+"/"+asyncConfigName); err != nil {
+		t.Fatal("Reconcile() =", err)
+	}
+	if _, err := policies.Get(context.Background(), producerServiceName, metav1.GetOptions{}); !apierrs.IsNotFound(err) {
+		t.Errorf("Get() = %v, want the producer NetworkPolicy deleted", err)
+	}
+	if _, err := policies.Get(context.Background(), consumerDeploymentName, metav1.GetOptions{}); err != nil {
+		t.Errorf("Get() = %v, want the NetworkPolicy of the tenant kept", err)
+	}
+}
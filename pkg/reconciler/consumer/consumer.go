@@ -0,0 +1,315 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	appsv1listers "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/logging"
+	pkgreconciler "knative.dev/pkg/reconciler"
+)
+
+// Reconciler implements controller.Reconciler for the consumer Deployment,
+// scaling it with a KEDA ScaledObject when it asks for one, and replaying its
+// dead-lettered requests, see ReplayAnnotationKey. Only the leader of the
+// consumer reconciles it. Failures are recorded as Events of the Deployment.
+type Reconciler struct {
+	pkgreconciler.LeaderAwareFuncs
+
+	deploymentLister appsv1listers.DeploymentLister
+	kubeclient       kubernetes.Interface
+	dynamicclient    dynamic.Interface
+	recorder         record.EventRecorder
+	// httpClient calls the replay endpoint of the consumer.
+	httpClient *http.Client
+}
+
+const (
+	AutoscalerAnnotationKey    = "async.knative.dev/autoscaler"
+	MinScaleAnnotationKey      = "async.knative.dev/min-scale"
+	MaxScaleAnnotationKey      = "async.knative.dev/max-scale"
+	TargetBacklogAnnotationKey = "async.knative.dev/target-backlog"
+	kedaAutoscaler             = "keda"
+	consumerDeploymentName     = "async-consumer"
+	defaultMinScale            = 0
+	defaultMaxScale            = 10
+	defaultTargetBacklog       = 5
+	defaultConsumerGroup       = "async-consumer"
+	redisStreamsTrigger        = "redis-streams"
+	// Reasons of the Events of the Deployment.
+	invalidConfigurationReason = "InvalidConfiguration"
+	internalErrorReason        = "InternalError"
+)
+
+// scaledObjectResource is the KEDA resource scaling the consumer.
+var scaledObjectResource = schema.GroupVersionResource{Group: "keda.sh", Version: "v1alpha1", Resource: "scaledobjects"}
+
+// Reconcile implements controller.Reconciler.
+func (r *Reconciler) Reconcile(ctx context.Context, key string) error {
+	logger := logging.FromContext(ctx)
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		logger.Errorf("invalid resource key: %s", key)
+		return nil
+	}
+	if !r.IsLeaderFor(types.NamespacedName{Namespace: namespace, Name: name}) {
+		return controller.NewSkipKey(key)
+	}
+	d, err := r.deploymentLister.Deployments(namespace).Get(name)
+	if apierrs.IsNotFound(err) {
+		// The ScaledObject is owned by the Deployment and deleted with it.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := r.reconcile(ctx, key, d); err != nil {
+		reason := internalErrorReason
+		if controller.IsPermanentError(err) {
+			reason = invalidConfigurationReason
+		}
+		r.recorder.Event(d, corev1.EventTypeWarning, reason, err.Error())
+		return err
+	}
+	return nil
+}
+
+// reconcile scales the Deployment d of key, then replays its dead-lettered
+// requests when it asks for it.
+func (r *Reconciler) reconcile(ctx context.Context, key string, d *appsv1.Deployment) error {
+	if err := r.reconcileScaling(ctx, key, d); err != nil {
+		return err
+	}
+	return r.reconcileReplay(ctx, d)
+}
+
+// reconcileScaling creates, updates or deletes the ScaledObject of the
+// Deployment d of key.
+func (r *Reconciler) reconcileScaling(ctx context.Context, key string, d *appsv1.Deployment) error {
+	if d.Annotations[AutoscalerAnnotationKey] != kedaAutoscaler {
+		return r.deleteScaledObject(ctx, d)
+	}
+	desired, err := MakeScaledObject(d)
+	if err != nil {
+		logging.FromContext(ctx).Errorf("error making the ScaledObject of %s: %v", key, err)
+		return controller.NewPermanentError(err)
+	}
+	return r.reconcileScaledObject(ctx, desired)
+}
+
+func (r *Reconciler) reconcileScaledObject(ctx context.Context, desired *unstructured.Unstructured) error {
+	logger := logging.FromContext(ctx)
+	client := r.dynamicclient.Resource(scaledObjectResource).Namespace(desired.GetNamespace())
+	existing, err := client.Get(ctx, desired.GetName(), metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		if _, err := client.Create(ctx, desired, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create ScaledObject: %w", err)
+		}
+		logger.Info("Created ScaledObject: ", desired.GetName())
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get ScaledObject: %w", err)
+	}
+	if equality.Semantic.DeepEqual(existing.Object["spec"], desired.Object["spec"]) {
+		return nil
+	}
+	// Don't modify the copy of the client.
+	updated := existing.DeepCopy()
+	updated.Object["spec"] = desired.Object["spec"]
+	if _, err := client.Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update ScaledObject: %w", err)
+	}
+	return nil
+}
+
+// deleteScaledObject deletes the ScaledObject of d, if any, so the replicas
+// of d are left alone.
+func (r *Reconciler) deleteScaledObject(ctx context.Context, d *appsv1.Deployment) error {
+	err := r.dynamicclient.Resource(scaledObjectResource).Namespace(d.Namespace).Delete(ctx, d.Name, metav1.DeleteOptions{})
+	if err != nil && !apierrs.IsNotFound(err) {
+		return fmt.Errorf("failed to delete ScaledObject: %w", err)
+	}
+	return nil
+}
+
+// MakeScaledObject constructs the KEDA ScaledObject scaling the consumer
+// Deployment d with the backlog of its Redis streams, down to zero replicas
+// unless the min-scale annotation says otherwise. The streams, consumer
+// group and address are read from the environment of the consumer.
+func MakeScaledObject(d *appsv1.Deployment) (*unstructured.Unstructured, error) {
+	minScale, err := annotationInt(d.Annotations, MinScaleAnnotationKey, defaultMinScale)
+	if err != nil {
+		return nil, err
+	}
+	maxScale, err := annotationInt(d.Annotations, MaxScaleAnnotationKey, defaultMaxScale)
+	if err != nil {
+		return nil, err
+	}
+	if maxScale < 1 || minScale > maxScale {
+		return nil, fmt.Errorf("Invalid scale bounds %s: %d and %s: %d", MinScaleAnnotationKey, minScale, MaxScaleAnnotationKey, maxScale)
+	}
+	target, err := annotationInt(d.Annotations, TargetBacklogAnnotationKey, defaultTargetBacklog)
+	if err != nil {
+		return nil, err
+	}
+	if target < 1 {
+		return nil, fmt.Errorf("Invalid value for key %s: %d", TargetBacklogAnnotationKey, target)
+	}
+
+	env := consumerEnv(d)
+	if backend := env["QUEUE_BACKEND"].Value; backend != "" && backend != "redis" {
+		return nil, fmt.Errorf("queue backend %q cannot be scaled with KEDA, only redis can", backend)
+	}
+	streams, err := consumerStreams(d.Name, env)
+	if err != nil {
+		return nil, err
+	}
+	group := env["REDIS_CONSUMER_GROUP"].Value
+	if group == "" {
+		group = defaultConsumerGroup
+	}
+	address, err := url.Parse(env["REDIS_ADDRESS"].Value)
+	if err != nil || address.Host == "" {
+		return nil, fmt.Errorf("REDIS_ADDRESS of %s is not set to a redis URL", d.Name)
+	}
+	metadata := map[string]interface{}{
+		"address":       address.Host,
+		"consumerGroup": group,
+		"lagCount":      strconv.Itoa(target),
+	}
+	if address.Scheme == "rediss" {
+		metadata["enableTLS"] = "true"
+	}
+	// Credentials are read by KEDA from the environment of the consumer.
+	if _, ok := env["REDIS_USERNAME"]; ok {
+		metadata["usernameFromEnv"] = "REDIS_USERNAME"
+	}
+	if _, ok := env["REDIS_PASSWORD"]; ok {
+		metadata["passwordFromEnv"] = "REDIS_PASSWORD"
+	}
+
+	triggers := make([]interface{}, 0, len(streams))
+	for _, stream := range streams {
+		m := make(map[string]interface{}, len(metadata)+1)
+		for k, v := range metadata {
+			m[k] = v
+		}
+		m["stream"] = stream
+		triggers = append(triggers, map[string]interface{}{
+			"type":     redisStreamsTrigger,
+			"metadata": m,
+		})
+	}
+
+	so := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"scaleTargetRef": map[string]interface{}{
+				"name": d.Name,
+			},
+			"minReplicaCount": int64(minScale),
+			"maxReplicaCount": int64(maxScale),
+			"triggers":        triggers,
+		},
+	}}
+	so.SetAPIVersion(scaledObjectResource.GroupVersion().String())
+	so.SetKind("ScaledObject")
+	so.SetName(d.Name)
+	so.SetNamespace(d.Namespace)
+	so.SetOwnerReferences([]metav1.OwnerReference{*metav1.NewControllerRef(d, appsv1.SchemeGroupVersion.WithKind("Deployment"))})
+	return so, nil
+}
+
+// consumerStreams returns the streams read by the consumer named name with
+// environment env: those of REDIS_CONSUMER_STREAMS, or REDIS_STREAM_NAME and
+// its shards. Patterns cannot be scaled on, as KEDA reads fixed streams.
+func consumerStreams(name string, env map[string]corev1.EnvVar) ([]string, error) {
+	if v := env["REDIS_CONSUMER_STREAMS"].Value; v != "" {
+		streams := strings.Split(v, ",")
+		for _, stream := range streams {
+			if strings.ContainsAny(stream, "*?[") {
+				return nil, fmt.Errorf("REDIS_CONSUMER_STREAMS of %s holds the pattern %q, list the streams instead", name, stream)
+			}
+		}
+		return streams, nil
+	}
+	stream := env["REDIS_STREAM_NAME"].Value
+	if stream == "" {
+		return nil, fmt.Errorf("REDIS_STREAM_NAME of %s is not set to a value", name)
+	}
+	// Sharded queues are read from one stream per shard.
+	shards := 1
+	if v := env["REDIS_SHARDS"].Value; v != "" {
+		var err error
+		if shards, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("Invalid value for REDIS_SHARDS: %q", v)
+		}
+	}
+	streams := []string{stream}
+	for i := 1; i < shards; i++ {
+		streams = append(streams, stream+"-"+strconv.Itoa(i))
+	}
+	return streams, nil
+}
+
+// consumerEnv returns the environment variables declared by the consumer
+// container of d, or by its first container, by name.
+func consumerEnv(d *appsv1.Deployment) map[string]corev1.EnvVar {
+	env := make(map[string]corev1.EnvVar)
+	containers := d.Spec.Template.Spec.Containers
+	if len(containers) == 0 {
+		return env
+	}
+	c := containers[0]
+	for _, other := range containers {
+		if other.Name == consumerDeploymentName {
+			c = other
+		}
+	}
+	for _, e := range c.Env {
+		env[e.Name] = e
+	}
+	return env
+}
+
+// annotationInt returns the integer value of annotation key, or def when it
+// is not set.
+func annotationInt(annotations map[string]string, key string, def int) (int, error) {
+	v, ok := annotations[key]
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid value for key %s: %q", key, v)
+	}
+	return n, nil
+}
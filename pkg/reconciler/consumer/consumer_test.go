@@ -0,0 +1,242 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	appsv1listers "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"knative.dev/pkg/controller"
+	logtesting "knative.dev/pkg/logging/testing"
+	pkgreconciler "knative.dev/pkg/reconciler"
+)
+
+const testNamespace = "knative-testing"
+
+func deployment(annotations map[string]string, env ...corev1.EnvVar) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        consumerDeploymentName,
+			Namespace:   testNamespace,
+			UID:         "uid",
+			Annotations: annotations,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "sidecar"}, {Name: consumerDeploymentName, Env: env}},
+				},
+			},
+		},
+	}
+}
+
+var redisEnv = []corev1.EnvVar{
+	{Name: "REDIS_ADDRESS", Value: "redis://redis.redis.svc.cluster.local:6379"},
+	{Name: "REDIS_STREAM_NAME", Value: "mystream"},
+}
+
+var kedaAnnotations = map[string]string{AutoscalerAnnotationKey: kedaAutoscaler}
+
+func trigger(stream string, metadata map[string]interface{}) interface{} {
+	m := map[string]interface{}{
+		"address":       "redis.redis.svc.cluster.local:6379",
+		"consumerGroup": defaultConsumerGroup,
+		"lagCount":      "5",
+		"stream":        stream,
+	}
+	for k, v := range metadata {
+		m[k] = v
+	}
+	return map[string]interface{}{"type": redisStreamsTrigger, "metadata": m}
+}
+
+func scaledObjectSpec(min, max int64, triggers ...interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"scaleTargetRef":  map[string]interface{}{"name": consumerDeploymentName},
+		"minReplicaCount": min,
+		"maxReplicaCount": max,
+		"triggers":        triggers,
+	}
+}
+
+func TestMakeScaledObject(t *testing.T) {
+	tests := []struct {
+		name       string
+		deployment *appsv1.Deployment
+		want       map[string]interface{}
+		wantErr    bool
+	}{{
+		name:       "defaults",
+		deployment: deployment(kedaAnnotations, redisEnv...),
+		want:       scaledObjectSpec(0, 10, trigger("mystream", nil)),
+	}, {
+		name: "scale bounds and target",
+		deployment: deployment(map[string]string{
+			AutoscalerAnnotationKey:    kedaAutoscaler,
+			MinScaleAnnotationKey:      "1",
+			MaxScaleAnnotationKey:      "20",
+			TargetBacklogAnnotationKey: "100",
+		}, redisEnv...),
+		want: scaledObjectSpec(1, 20, trigger("mystream", map[string]interface{}{"lagCount": "100"})),
+	}, {
+		name: "shards, TLS and credentials",
+		deployment: deployment(kedaAnnotations,
+			corev1.EnvVar{Name: "REDIS_ADDRESS", Value: "rediss://redis.redis.svc.cluster.local:6379"},
+			corev1.EnvVar{Name: "REDIS_STREAM_NAME", Value: "mystream"},
+			corev1.EnvVar{Name: "REDIS_CONSUMER_GROUP", Value: "group"},
+			corev1.EnvVar{Name: "REDIS_SHARDS", Value: "2"},
+			corev1.EnvVar{Name: "REDIS_PASSWORD", ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "redis"}, Key: "password"},
+			}}),
+		want: scaledObjectSpec(0, 10,
+			trigger("mystream", map[string]interface{}{"consumerGroup": "group", "enableTLS": "true", "passwordFromEnv": "REDIS_PASSWORD"}),
+			trigger("mystream-1", map[string]interface{}{"consumerGroup": "group", "enableTLS": "true", "passwordFromEnv": "REDIS_PASSWORD"})),
+	}, {
+		name: "consumer streams",
+		deployment: deployment(kedaAnnotations,
+			corev1.EnvVar{Name: "REDIS_ADDRESS", Value: "redis://redis.redis.svc.cluster.local:6379"},
+			corev1.EnvVar{Name: "REDIS_CONSUMER_STREAMS", Value: "tenant-a,tenant-b"}),
+		want: scaledObjectSpec(0, 10, trigger("tenant-a", nil), trigger("tenant-b", nil)),
+	}, {
+		name: "consumer stream patterns",
+		deployment: deployment(kedaAnnotations,
+			corev1.EnvVar{Name: "REDIS_ADDRESS", Value: "redis://redis.redis.svc.cluster.local:6379"},
+			corev1.EnvVar{Name: "REDIS_CONSUMER_STREAMS", Value: "tenant-*"}),
+		wantErr: true,
+	}, {
+		name:       "invalid scale bounds",
+		deployment: deployment(map[string]string{AutoscalerAnnotationKey: kedaAutoscaler, MinScaleAnnotationKey: "5", MaxScaleAnnotationKey: "2"}, redisEnv...),
+		wantErr:    true,
+	}, {
+		name:       "invalid target",
+		deployment: deployment(map[string]string{AutoscalerAnnotationKey: kedaAutoscaler, TargetBacklogAnnotationKey: "many"}, redisEnv...),
+		wantErr:    true,
+	}, {
+		name:       "other backend",
+		deployment: deployment(kedaAnnotations, append([]corev1.EnvVar{{Name: "QUEUE_BACKEND", Value: "kafka"}}, redisEnv...)...),
+		wantErr:    true,
+	}, {
+		name:       "stream from a secret",
+		deployment: deployment(kedaAnnotations, corev1.EnvVar{Name: "REDIS_ADDRESS", Value: "redis://redis:6379"}),
+		wantErr:    true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := MakeScaledObject(test.deployment)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("MakeScaledObject() = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(test.want, got.Object["spec"]); diff != "" {
+				t.Error("MakeScaledObject() spec (-want, +got):", diff)
+			}
+			if refs := got.GetOwnerReferences(); len(refs) != 1 || refs[0].Kind != "Deployment" || refs[0].UID != "uid" {
+				t.Errorf("got owner references %+v, want the consumer Deployment", refs)
+			}
+		})
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	stale := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "keda.sh/v1alpha1",
+		"kind":       "ScaledObject",
+		"metadata":   map[string]interface{}{"name": consumerDeploymentName, "namespace": testNamespace},
+		"spec":       scaledObjectSpec(0, 1, trigger("old", nil)),
+	}}
+	tests := []struct {
+		name       string
+		deployment *appsv1.Deployment
+		existing   []runtime.Object
+		want       map[string]interface{}
+		wantErr    bool
+	}{{
+		name:       "create",
+		deployment: deployment(kedaAnnotations, redisEnv...),
+		want:       scaledObjectSpec(0, 10, trigger("mystream", nil)),
+	}, {
+		name:       "update",
+		deployment: deployment(kedaAnnotations, redisEnv...),
+		existing:   []runtime.Object{stale},
+		want:       scaledObjectSpec(0, 10, trigger("mystream", nil)),
+	}, {
+		name:       "delete when disabled",
+		deployment: deployment(nil, redisEnv...),
+		existing:   []runtime.Object{stale},
+	}, {
+		name:       "not enabled",
+		deployment: deployment(nil, redisEnv...),
+	}, {
+		name:       "invalid configuration",
+		deployment: deployment(kedaAnnotations),
+		wantErr:    true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			indexer.Add(test.deployment)
+			client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), test.existing...)
+			recorder := record.NewFakeRecorder(10)
+			r := &Reconciler{
+				deploymentLister: appsv1listers.NewDeploymentLister(indexer),
+				dynamicclient:    client,
+				recorder:         recorder,
+			}
+			r.Promote(pkgreconciler.UniversalBucket(), nil)
+			ctx := logtesting.TestContextWithLogger(t)
+
+			err := r.Reconcile(ctx, testNamespace+"/"+consumerDeploymentName)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Reconcile() = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				if !controller.IsPermanentError(err) {
+					t.Errorf("Reconcile() = %v, want a permanent error", err)
+				}
+				if got := <-recorder.Events; !strings.HasPrefix(got, "Warning InvalidConfiguration ") {
+					t.Errorf("Event = %q, want an InvalidConfiguration warning", got)
+				}
+				return
+			}
+			got, err := client.Resource(scaledObjectResource).Namespace(testNamespace).Get(context.Background(), consumerDeploymentName, metav1.GetOptions{})
+			if test.want == nil {
+				if !apierrs.IsNotFound(err) {
+					t.Errorf("Get() = %v, %v, want no ScaledObject", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Get() =", err)
+			}
+			if diff := cmp.Diff(test.want, got.Object["spec"]); diff != "" {
+				t.Error("ScaledObject spec (-want, +got):", diff)
+			}
+		})
+	}
+}
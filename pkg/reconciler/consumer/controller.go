@@ -0,0 +1,66 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	kubeclient "knative.dev/pkg/client/injection/kube/client"
+	deploymentinformer "knative.dev/pkg/client/injection/kube/informers/apps/v1/deployment"
+	"knative.dev/pkg/configmap"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/injection/clients/dynamicclient"
+	"knative.dev/pkg/logging"
+	pkgreconciler "knative.dev/pkg/reconciler"
+	"knative.dev/pkg/system"
+
+	"knative.dev/async-component/pkg/reconciler/events"
+)
+
+// NewController creates a Reconciler of the consumer Deployment and returns
+// the result of NewImpl.
+func NewController(
+	ctx context.Context,
+	cmw configmap.Watcher,
+) *controller.Impl {
+	logger := logging.FromContext(ctx)
+
+	deploymentInformer := deploymentinformer.Get(ctx)
+
+	r := &Reconciler{
+		deploymentLister: deploymentInformer.Lister(),
+		kubeclient:       kubeclient.Get(ctx),
+		dynamicclient:    dynamicclient.Get(ctx),
+		recorder:         events.NewRecorder(ctx, "async-consumer-controller"),
+		httpClient:       &http.Client{Timeout: replayTimeout},
+	}
+	impl := controller.NewImpl(r, logger, "AsyncConsumers")
+	r.PromoteFunc = func(bkt pkgreconciler.Bucket, enq func(pkgreconciler.Bucket, types.NamespacedName)) error {
+		enq(bkt, types.NamespacedName{Namespace: system.Namespace(), Name: consumerDeploymentName})
+		return nil
+	}
+
+	logger.Info("Setting up event handlers.")
+
+	// Only the consumer of the system namespace is scaled.
+	deploymentInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: controller.FilterWithNameAndNamespace(system.Namespace(), consumerDeploymentName),
+		Handler:    controller.HandleAll(impl.Enqueue),
+	})
+
+	return impl
+}
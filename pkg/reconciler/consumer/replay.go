@@ -0,0 +1,165 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// ReplayAnnotationKey asks the controller to replay the dead-lettered
+	// requests of the consumer. Its value is the body of the replay
+	// endpoint of the consumer, such as {"ids": ["..."], "target": "..."},
+	// {} replaying all of them. A value is replayed once, change it to
+	// replay again.
+	ReplayAnnotationKey = "async.knative.dev/replay"
+	// ReplayedAnnotationKey is set by the controller to the value of
+	// ReplayAnnotationKey once it was replayed.
+	ReplayedAnnotationKey = "async.knative.dev/replayed"
+	// Path of the replay endpoint on the health port of the consumer.
+	replayPath = "/dead-letters/replay"
+	// Name of the container port of the health endpoints of the consumer.
+	healthPortName = "health"
+	// replayBatch is the number of requests replayed per call of the replay
+	// endpoint, which is called until a call replays fewer.
+	replayBatch = 100
+	// replayTimeout bounds a call of the replay endpoint.
+	replayTimeout = 30 * time.Second
+	// Reason of the Events of the replays.
+	replayedReason = "Replayed"
+)
+
+// replayResponse is the response of the replay endpoint of the consumer.
+type replayResponse struct {
+	Replayed int `json:"replayed"`
+}
+
+// reconcileReplay replays the dead-lettered requests selected by the
+// ReplayAnnotationKey of d, if it was not replayed yet, with the replay
+// endpoint of a ready pod of d.
+func (r *Reconciler) reconcileReplay(ctx context.Context, d *appsv1.Deployment) error {
+	want := d.Annotations[ReplayAnnotationKey]
+	if want == "" || want == d.Annotations[ReplayedAnnotationKey] {
+		return nil
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(want), &body); err != nil {
+		return controller.NewPermanentError(fmt.Errorf("Invalid value for key %s: %w", ReplayAnnotationKey, err))
+	}
+	addr, err := r.replayAddress(ctx, d)
+	if err != nil {
+		return err
+	}
+	replayed := 0
+	for {
+		n, err := r.replay(ctx, addr, want)
+		replayed += n
+		if err != nil {
+			return fmt.Errorf("failed to replay dead-lettered requests after %d: %w", replayed, err)
+		}
+		if n < replayBatch {
+			break
+		}
+	}
+	logging.FromContext(ctx).Infof("Replayed %d dead-lettered requests", replayed)
+	r.recorder.Eventf(d, corev1.EventTypeNormal, replayedReason, "Replayed %d dead-lettered requests", replayed)
+
+	updated := d.DeepCopy()
+	updated.Annotations[ReplayedAnnotationKey] = want
+	if _, err := r.kubeclient.AppsV1().Deployments(d.Namespace).Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to record the replay: %w", err)
+	}
+	return nil
+}
+
+// replayAddress returns the address of the health port of a ready pod of d.
+func (r *Reconciler) replayAddress(ctx context.Context, d *appsv1.Deployment) (string, error) {
+	selector, err := metav1.LabelSelectorAsSelector(d.Spec.Selector)
+	if err != nil {
+		return "", controller.NewPermanentError(fmt.Errorf("invalid selector of the consumer: %w", err))
+	}
+	pods, err := r.kubeclient.CoreV1().Pods(d.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return "", fmt.Errorf("failed to list consumer pods: %w", err)
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.PodIP == "" || !podReady(&pod) {
+			continue
+		}
+		for _, c := range pod.Spec.Containers {
+			for _, p := range c.Ports {
+				if p.Name == healthPortName {
+					return net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(int(p.ContainerPort))), nil
+				}
+			}
+		}
+	}
+	// Pods becoming ready do not trigger a reconcile, so this is retried.
+	return "", errors.New("no ready consumer pod with a health port to replay dead-lettered requests")
+}
+
+// replay calls the replay endpoint at addr with body, returning how many
+// requests were replayed.
+func (r *Reconciler) replay(ctx context.Context, addr, body string) (int, error) {
+	url := fmt.Sprintf("http://%s%s?max=%d", addr, replayPath, replayBatch)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBufferString(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		err := fmt.Errorf("consumer answered %s: %s", resp.Status, bytes.TrimSpace(msg))
+		if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusNotImplemented {
+			// The replay is invalid, or not supported by the backend.
+			err = controller.NewPermanentError(err)
+		}
+		return 0, err
+	}
+	var rr replayResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rr); err != nil {
+		return 0, fmt.Errorf("invalid replay response: %w", err)
+	}
+	return rr.Replayed, nil
+}
+
+// podReady reports whether pod passes its readiness probe.
+func podReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
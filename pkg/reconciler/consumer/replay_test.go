@@ -0,0 +1,203 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	appsv1listers "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"knative.dev/pkg/controller"
+	logtesting "knative.dev/pkg/logging/testing"
+	pkgreconciler "knative.dev/pkg/reconciler"
+)
+
+// replayDeployment returns the consumer Deployment with annotations, whose
+// pods are selected by their app label.
+func replayDeployment(annotations map[string]string) *appsv1.Deployment {
+	d := deployment(annotations)
+	d.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": consumerDeploymentName}}
+	return d
+}
+
+// consumerPod returns a pod of the consumer serving its health port at addr.
+func consumerPod(t *testing.T, addr string, ready bool) *corev1.Pod {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal("SplitHostPort() =", err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal("Atoi() =", err)
+	}
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      consumerDeploymentName + "-abc",
+			Namespace: testNamespace,
+			Labels:    map[string]string{"app": consumerDeploymentName},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:  consumerDeploymentName,
+				Ports: []corev1.ContainerPort{{Name: healthPortName, ContainerPort: int32(p)}},
+			}},
+		},
+		Status: corev1.PodStatus{
+			PodIP:      host,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+		},
+	}
+}
+
+func TestReconcileReplay(t *testing.T) {
+	const selection = `{"ids": ["a", "b"]}`
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		// pending is the number of requests the consumer replays.
+		pending  int
+		code     int
+		notReady bool
+		// wantCalls is the number of calls of the replay endpoint.
+		wantCalls     int
+		wantEvent     string
+		wantPermanent bool
+		wantErr       bool
+	}{{
+		name:        "replays in batches",
+		annotations: map[string]string{ReplayAnnotationKey: selection},
+		pending:     replayBatch + 3,
+		wantCalls:   2,
+		wantEvent:   "Normal Replayed Replayed 103 dead-lettered requests",
+	}, {
+		name:        "already replayed",
+		annotations: map[string]string{ReplayAnnotationKey: selection, ReplayedAnnotationKey: selection},
+		pending:     3,
+	}, {
+		name:    "no replay",
+		pending: 3,
+	}, {
+		name:          "invalid value",
+		annotations:   map[string]string{ReplayAnnotationKey: "all"},
+		wantErr:       true,
+		wantPermanent: true,
+		wantEvent:     "Warning InvalidConfiguration ",
+	}, {
+		name:          "rejected by the consumer",
+		annotations:   map[string]string{ReplayAnnotationKey: selection},
+		code:          http.StatusBadRequest,
+		wantCalls:     1,
+		wantErr:       true,
+		wantPermanent: true,
+		wantEvent:     "Warning InvalidConfiguration ",
+	}, {
+		name:        "no ready pod",
+		annotations: map[string]string{ReplayAnnotationKey: selection},
+		notReady:    true,
+		wantErr:     true,
+		wantEvent:   "Warning InternalError ",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pending, calls := test.pending, 0
+			consumer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if r.Method != http.MethodPost || r.URL.Path != replayPath {
+					t.Errorf("got %s %s, want POST %s", r.Method, r.URL.Path, replayPath)
+				}
+				if body, _ := ioutil.ReadAll(r.Body); string(body) != selection {
+					t.Errorf("got body %s, want %s", body, selection)
+				}
+				if test.code != 0 {
+					w.WriteHeader(test.code)
+					return
+				}
+				n := replayBatch
+				if pending < n {
+					n = pending
+				}
+				pending -= n
+				json.NewEncoder(w).Encode(replayResponse{Replayed: n})
+			}))
+			defer consumer.Close()
+
+			d := replayDeployment(test.annotations)
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			indexer.Add(d)
+			kc := kubefake.NewSimpleClientset(d, consumerPod(t, consumer.Listener.Addr().String(), !test.notReady))
+			recorder := record.NewFakeRecorder(10)
+			r := &Reconciler{
+				deploymentLister: appsv1listers.NewDeploymentLister(indexer),
+				kubeclient:       kc,
+				dynamicclient:    dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()),
+				recorder:         recorder,
+				httpClient:       consumer.Client(),
+			}
+			r.Promote(pkgreconciler.UniversalBucket(), nil)
+			ctx := logtesting.TestContextWithLogger(t)
+
+			err := r.Reconcile(ctx, testNamespace+"/"+consumerDeploymentName)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Reconcile() = %v, want error %v", err, test.wantErr)
+			}
+			if controller.IsPermanentError(err) != test.wantPermanent {
+				t.Errorf("Reconcile() = %v, want a permanent error %v", err, test.wantPermanent)
+			}
+			if calls != test.wantCalls {
+				t.Errorf("got %d calls of the replay endpoint, want %d", calls, test.wantCalls)
+			}
+			select {
+			case got := <-recorder.Events:
+				if test.wantEvent == "" || !strings.HasPrefix(got, test.wantEvent) {
+					t.Errorf("Event = %q, want %q", got, test.wantEvent)
+				}
+			default:
+				if test.wantEvent != "" {
+					t.Errorf("no Event, want %q", test.wantEvent)
+				}
+			}
+
+			got, err := kc.AppsV1().Deployments(testNamespace).Get(context.Background(), consumerDeploymentName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal("Get() =", err)
+			}
+			want := test.annotations[ReplayedAnnotationKey]
+			if test.wantCalls > 0 && !test.wantErr {
+				want = test.annotations[ReplayAnnotationKey]
+			}
+			if replayed := got.Annotations[ReplayedAnnotationKey]; replayed != want {
+				t.Errorf("%s = %q, want %q", ReplayedAnnotationKey, replayed, want)
+			}
+		})
+	}
+}
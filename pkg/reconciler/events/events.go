@@ -0,0 +1,51 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package events creates the recorders of the Kubernetes Events of the
+// reconcilers that are not generated, as the generated ones do.
+package events
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	kubeclient "knative.dev/pkg/client/injection/kube/client"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/logging"
+)
+
+// NewRecorder returns the event recorder of ctx, or one writing the Events of
+// agentName with the kube client of ctx until ctx is done.
+func NewRecorder(ctx context.Context, agentName string) record.EventRecorder {
+	if recorder := controller.GetEventRecorder(ctx); recorder != nil {
+		return recorder
+	}
+	logger := logging.FromContext(ctx)
+	broadcaster := record.NewBroadcaster()
+	watches := []watch.Interface{
+		broadcaster.StartLogging(logger.Named("event-broadcaster").Infof),
+		broadcaster.StartRecordingToSink(
+			&typedcorev1.EventSinkImpl{Interface: kubeclient.Get(ctx).CoreV1().Events("")}),
+	}
+	go func() {
+		<-ctx.Done()
+		for _, w := range watches {
+			w.Stop()
+		}
+	}()
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: agentName})
+}
@@ -18,14 +18,24 @@ import (
 
 	"knative.dev/networking/pkg/apis/networking"
 
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/dynamic/dynamiclister"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/tools/cache"
 	netclient "knative.dev/networking/pkg/client/injection/client"
 	kubeclient "knative.dev/pkg/client/injection/kube/client"
 	serviceinformer "knative.dev/pkg/client/injection/kube/informers/core/v1/service"
 	"knative.dev/pkg/configmap"
 	"knative.dev/pkg/controller"
+	"knative.dev/pkg/injection"
+	"knative.dev/pkg/injection/clients/dynamicclient"
+	"knative.dev/pkg/kmeta"
 	"knative.dev/pkg/logging"
 	knativeReconciler "knative.dev/pkg/reconciler"
+	"knative.dev/pkg/system"
 
 	ingressinformer "knative.dev/networking/pkg/client/injection/informers/networking/v1alpha1/ingress"
 	v1alpha1ingress "knative.dev/networking/pkg/client/injection/reconciler/networking/v1alpha1/ingress"
@@ -35,6 +45,35 @@ const (
 	asyncIngressClassName = "async.ingress.networking.knative.dev"
 )
 
+func init() {
+	injection.Default.RegisterInformer(withProducerInformer)
+}
+
+// producerInformerKey is the context key of the producer informer.
+type producerInformerKey struct{}
+
+// withProducerInformer adds the informer of the Knative Services of the
+// producers to ctx. They have no generated informer, they are watched as
+// unstructured objects; the informer is started by sharedmain with the
+// injected ones.
+func withProducerInformer(ctx context.Context) (context.Context, controller.Informer) {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynamicclient.Get(ctx),
+		controller.GetResyncPeriod(ctx), metav1.NamespaceAll, func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", producerServiceName).String()
+		})
+	informer := factory.ForResource(ProducerResource)
+	return context.WithValue(ctx, producerInformerKey{}, informer), informer.Informer()
+}
+
+// getProducerInformer returns the informer added by withProducerInformer.
+func getProducerInformer(ctx context.Context) informers.GenericInformer {
+	informer, ok := ctx.Value(producerInformerKey{}).(informers.GenericInformer)
+	if !ok {
+		logging.FromContext(ctx).Panic("Unable to fetch the producer informer from context.")
+	}
+	return informer
+}
+
 // NewController creates a Reconciler and returns the result of NewImpl.
 func NewController(
 	ctx context.Context,
@@ -44,12 +83,20 @@ func NewController(
 
 	ingressInformer := ingressinformer.Get(ctx)
 	serviceInformer := serviceinformer.Get(ctx)
+	producerInformer := getProducerInformer(ctx)
+
+	gateways, err := gatewayConfigFromEnv()
+	if err != nil {
+		logger.Fatalw("Failed to read the gateway configuration", zap.Error(err))
+	}
 
 	r := &Reconciler{
-		ingressLister: ingressInformer.Lister(),
-		serviceLister: serviceInformer.Lister(),
-		netclient:     netclient.Get(ctx),
-		kubeclient:    kubeclient.Get(ctx),
+		ingressLister:  ingressInformer.Lister(),
+		serviceLister:  serviceInformer.Lister(),
+		netclient:      netclient.Get(ctx),
+		kubeclient:     kubeclient.Get(ctx),
+		producerLister: dynamiclister.New(producerInformer.Informer().GetIndexer(), ProducerResource),
+		gateways:       gateways,
 	}
 	impl := v1alpha1ingress.NewImpl(ctx, r, asyncIngressClassName)
 
@@ -66,5 +113,25 @@ func NewController(
 		Handler:    controller.HandleAll(impl.Enqueue),
 	})
 
+	// Ingresses are routed to the producer of their namespace while it exists,
+	// and report whether it is ready. Those of namespaces without a producer
+	// use the shared one of the system namespace.
+	resyncProducerIngresses := controller.HandleAll(func(obj interface{}) {
+		producer, err := kmeta.DeletionHandlingAccessor(obj)
+		if err != nil {
+			return
+		}
+		impl.FilteredGlobalResync(func(obj interface{}) bool {
+			ing, err := kmeta.DeletionHandlingAccessor(obj)
+			return err == nil && classFilter(obj) &&
+				(ing.GetNamespace() == producer.GetNamespace() || producer.GetNamespace() == system.Namespace())
+		}, ingressInformer.Informer())
+	})
+	serviceInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: controller.FilterWithName(producerServiceName),
+		Handler:    resyncProducerIngresses,
+	})
+	producerInformer.Informer().AddEventHandler(resyncProducerIngresses)
+
 	return impl
 }
@@ -18,18 +18,28 @@ import (
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	network "knative.dev/networking/pkg"
 
 	_ "knative.dev/networking/pkg/client/injection/informers/networking/v1alpha1/ingress/fake"
 	_ "knative.dev/pkg/client/injection/kube/informers/core/v1/service/fake"
 	"knative.dev/pkg/configmap"
+	"knative.dev/pkg/controller"
+	fakedynamicclient "knative.dev/pkg/injection/clients/dynamicclient/fake"
 	"knative.dev/pkg/system"
 
 	. "knative.dev/pkg/reconciler/testing"
 )
 
 func TestNew(t *testing.T) {
-	ctx, _ := SetupFakeContext(t)
+	ctx, cancel, _ := SetupFakeContextWithCancel(t)
+	defer cancel()
+	// The producers are listed as unstructured Knative Services.
+	scheme := runtime.NewScheme()
+	scheme.AddKnownTypeWithName(ProducerResource.GroupVersion().WithKind("ServiceList"), &unstructured.UnstructuredList{})
+	ctx, _ = fakedynamicclient.With(ctx, scheme)
+	ctx, informer := withProducerInformer(ctx)
 
 	c := NewController(ctx, configmap.NewStaticWatcher(&corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
@@ -46,4 +56,7 @@ func TestNew(t *testing.T) {
 	if c == nil {
 		t.Fatal("Expected NewController to return a non-nil value")
 	}
+	if err := controller.StartInformers(ctx.Done(), informer); err != nil {
+		t.Fatal("StartInformers() =", err)
+	}
 }
@@ -3,12 +3,21 @@ package ingress
 import (
 	"context"
 	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/kelseyhightower/envconfig"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic/dynamiclister"
 	"k8s.io/client-go/kubernetes"
 	corev1listers "k8s.io/client-go/listers/core/v1"
 	networkpkg "knative.dev/networking/pkg"
@@ -17,11 +26,16 @@ import (
 	netclientset "knative.dev/networking/pkg/client/clientset/versioned"
 	networkinglisters "knative.dev/networking/pkg/client/listers/networking/v1alpha1"
 
+	"knative.dev/pkg/apis"
+	duckv1 "knative.dev/pkg/apis/duck/v1"
 	"knative.dev/pkg/kmeta"
 	"knative.dev/pkg/logging"
 	network "knative.dev/pkg/network"
 	"knative.dev/pkg/reconciler"
 	"knative.dev/pkg/system"
+
+	"knative.dev/async-component/pkg/headers"
+	"knative.dev/async-component/pkg/paths"
 )
 
 // Reconciler implements controller.Reconciler for Ingress resources.
@@ -30,37 +44,126 @@ type Reconciler struct {
 	serviceLister corev1listers.ServiceLister
 	netclient     netclientset.Interface
 	kubeclient    kubernetes.Interface
+	// producerLister lists the Knative Services of the producers.
+	producerLister dynamiclister.Lister
+	gateways       gatewayConfig
+}
+
+// AsyncIngressReady is the condition of the Ingresses reporting whether the
+// producer their asynchronous requests are routed to is ready. It does not
+// change the readiness of the Ingresses, which keep serving synchronous
+// requests.
+const AsyncIngressReady apis.ConditionType = "AsyncIngressReady"
+
+// ProducerResource is the resource of the Knative Service of the producers.
+var ProducerResource = schema.GroupVersionResource{Group: "serving.knative.dev", Version: "v1", Resource: "services"}
+
+// gatewayConfig is the networking layer realizing the ingresses created by
+// the reconciler.
+type gatewayConfig struct {
+	// IngressClass is the class of the ingresses created, such as that of
+	// net-istio, or that of net-gateway-api, which turns them into HTTPRoutes.
+	IngressClass string `envconfig:"INGRESS_CLASS"`
+	// PublicGateway and PrivateGateway are the hosts of the load balancers of
+	// the external and cluster-local gateways of that layer.
+	PublicGateway  string `envconfig:"PUBLIC_GATEWAY"`
+	PrivateGateway string `envconfig:"PRIVATE_GATEWAY"`
+}
+
+// classGateways are the gateways of the networking layers whose ingress class
+// is known, used when PUBLIC_GATEWAY and PRIVATE_GATEWAY are not set. net-istio
+// turns the ingresses into VirtualServices of these gateways, and net-contour
+// into HTTPProxies of the Envoys of its default visibility classes.
+var classGateways = map[string]gatewayConfig{
+	networkpkg.IstioIngressClassName: {PublicGateway: publicLBDomain, PrivateGateway: privateLBDomain},
+	ContourIngressClassName:          {PublicGateway: contourPublicLBDomain, PrivateGateway: contourPrivateLBDomain},
+}
+
+// gatewayConfigFromEnv returns the gatewayConfig set in the environment,
+// which defaults to the ingress class and gateways of net-istio.
+func gatewayConfigFromEnv() (gatewayConfig, error) {
+	cfg := gatewayConfig{IngressClass: networkpkg.IstioIngressClassName}
+	if err := envconfig.Process("", &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to process the gateway configuration: %w", err)
+	}
+	// The ingresses created would be reconciled again, endlessly.
+	if cfg.IngressClass == asyncIngressClassName {
+		return cfg, fmt.Errorf("Invalid value for INGRESS_CLASS: %q", cfg.IngressClass)
+	}
+	defaults := classGateways[cfg.IngressClass]
+	if cfg.PublicGateway == "" {
+		cfg.PublicGateway = defaults.PublicGateway
+	}
+	if cfg.PrivateGateway == "" {
+		cfg.PrivateGateway = defaults.PrivateGateway
+	}
+	if cfg.PublicGateway == "" || cfg.PrivateGateway == "" {
+		return cfg, fmt.Errorf("PUBLIC_GATEWAY and PRIVATE_GATEWAY are required for ingress class %q", cfg.IngressClass)
+	}
+	return cfg, nil
 }
 
 const (
-	AsyncModeAnnotationKey  = "async.knative.dev/mode"
-	asyncSuffix             = "-async"
-	newSuffix               = "-new"
-	preferHeaderField       = "Prefer"
-	preferAsyncValue        = "respond-async"
-	preferSyncValue         = "respond-sync"
-	asyncAlwaysMode         = "always.async.knative.dev"
-	asyncConditionalMode    = "conditional.async.knative.dev"
-	publicLBDomain          = "istio-ingressgateway.istio-system.svc.cluster.local"
-	privateLBDomain         = "knative-local-gateway.istio-system.svc.cluster.local"
-	producerServiceName     = "async-producer"
-	asyncOriginalHostHeader = "Async-Original-Host"
+	AsyncModeAnnotationKey             = "async.knative.dev/mode"
+	AsyncTTLAnnotationKey              = "async.knative.dev/ttl"
+	AsyncRequestSizeLimitAnnotationKey = "async.knative.dev/request-size-limit"
+	AsyncIdempotentAnnotationKey       = "async.knative.dev/idempotent"
+	AsyncRetriesAnnotationKey          = "async.knative.dev/retries"
+	AsyncBackoffAnnotationKey          = "async.knative.dev/backoff"
+	AsyncDeadLetterSinkAnnotationKey   = "async.knative.dev/dead-letter-sink"
+	AsyncPathsAnnotationKey            = "async.knative.dev/paths"
+	asyncServiceTTLHeader              = "Async-Service-Ttl"
+	asyncServiceSizeLimitHeader        = "Async-Service-Request-Size-Limit"
+	asyncServiceModeHeader             = "Async-Service-Mode"
+	asyncServiceIdempotentHeader       = "Async-Service-Idempotent"
+	asyncServiceRetriesHeader          = "Async-Service-Retries"
+	asyncServiceBackoffHeader          = "Async-Service-Backoff"
+	asyncServiceDeadLetterSinkHeader   = "Async-Service-Dead-Letter-Sink"
+	asyncServicePathsHeader            = "Async-Service-Paths"
+	asyncServiceHeaderPrefix           = "Async-Service-"
+	asyncServiceHeadersHeader          = "Async-Service-Headers"
+	asyncSuffix                        = "-async"
+	newSuffix                          = "-new"
+	preferHeaderField                  = "Prefer"
+	preferAsyncValue                   = "respond-async"
+	preferSyncValue                    = "respond-sync"
+	asyncAlwaysMode                    = "always.async.knative.dev"
+	asyncConditionalMode               = "conditional.async.knative.dev"
+	asyncAlwaysShortMode               = "always"
+	asyncConditionalShortMode          = "conditional"
+	publicLBDomain                     = "istio-ingressgateway.istio-system.svc.cluster.local"
+	privateLBDomain                    = "knative-local-gateway.istio-system.svc.cluster.local"
+	ContourIngressClassName            = "contour.ingress.networking.knative.dev"
+	contourPublicLBDomain              = "envoy.contour-external.svc.cluster.local"
+	contourPrivateLBDomain             = "envoy.contour-internal.svc.cluster.local"
+	producerServiceName                = "async-producer"
+	asyncOriginalHostHeader            = headers.OriginalHost
+	asyncStatusPath                    = "/async/status/"
+	asyncBatchPath                     = "/async/batch"
+	asyncRequestsPath                  = "/async/requests/"
+	asyncResultsPath                   = "/async/results/"
+	// Label set by Knative Serving on the ingresses of DomainMappings.
+	domainMappingUIDLabelKey = "serving.knative.dev/domainMappingUID"
 )
 
 // ReconcileKind implements Interface.ReconcileKind.
 func (r *Reconciler) ReconcileKind(ctx context.Context, ing *v1alpha1.Ingress) reconciler.Event {
 	logger := logging.FromContext(ctx)
-	// TODO(bvennam): allow this ingress class to be configurable
-	ingressClass := networkpkg.IstioIngressClassName
-	err := validateAsyncModeAnnotation(ing.Annotations)
+	err := ValidateAnnotations(ing.Annotations)
 	if err != nil {
 		logger.Errorf("error validating ingress annotations: %w", err)
 		return err
 	}
 
-	markIngressReady(ing) //TODO(bvennam): this just sets the status of KIngress, but load balancer isn't needed.
-	desired := makeNewIngress(ing, ingressClass)
-	service := MakeK8sService(ing)
+	r.markIngressReady(ing) //TODO(bvennam): this just sets the status of KIngress, but load balancer isn't needed.
+	producerNamespace, err := r.producerNamespace(ing.Namespace)
+	if err != nil {
+		return err
+	}
+	r.markAsyncReady(ing, producerNamespace)
+	producerHost := network.GetServiceHostname(producerServiceName, producerNamespace)
+	desired := makeNewIngress(ing, r.gateways.IngressClass, producerHost)
+	service := MakeK8sService(ing, producerHost)
 	_, err = r.reconcileIngress(ctx, desired)
 	if err != nil {
 		logger.Errorf("error reconciling ingress: %s", desired.Name)
@@ -100,48 +203,116 @@ func (r *Reconciler) reconcileIngress(ctx context.Context, desired *v1alpha1.Ing
 	return ingress, err
 }
 
+// producerNamespace returns the namespace of the producer of the services of
+// namespace: namespace when the controller stamped out a producer for it, the
+// system namespace of the shared producer otherwise.
+func (r *Reconciler) producerNamespace(namespace string) (string, error) {
+	if namespace == system.Namespace() {
+		return namespace, nil
+	}
+	if _, err := r.serviceLister.Services(namespace).Get(producerServiceName); err == nil {
+		return namespace, nil
+	} else if !apierrs.IsNotFound(err) {
+		return "", fmt.Errorf("Failed to get producer K8s Service: %w", err)
+	}
+	return system.Namespace(), nil
+}
+
+// markAsyncReady sets the AsyncIngressReady condition of ingress from the
+// Ready condition of the producer Service of namespace, which is not ready
+// while it is not routed or while its readiness probe, checking the queue
+// backend, fails.
+func (r *Reconciler) markAsyncReady(ingress *v1alpha1.Ingress, namespace string) {
+	conditions := ingress.GetConditionSet().Manage(&ingress.Status)
+	obj, err := r.producerLister.Namespace(namespace).Get(producerServiceName)
+	if apierrs.IsNotFound(err) {
+		conditions.MarkFalse(AsyncIngressReady, "ProducerNotFound",
+			"The producer Service %s/%s does not exist", namespace, producerServiceName)
+		return
+	} else if err != nil {
+		conditions.MarkUnknown(AsyncIngressReady, "ProducerUnknown", "Failed to get the producer Service: %v", err)
+		return
+	}
+	var producer duckv1.KResource
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &producer); err != nil {
+		conditions.MarkUnknown(AsyncIngressReady, "ProducerUnknown", "Failed to read the producer Service: %v", err)
+		return
+	}
+	ready := producer.Status.GetCondition(apis.ConditionReady)
+	switch {
+	case ready.IsTrue():
+		conditions.MarkTrue(AsyncIngressReady)
+	case ready.IsFalse():
+		conditions.MarkFalse(AsyncIngressReady, "ProducerNotReady",
+			"The producer Service %s/%s is not ready: %s", namespace, producerServiceName, ready.GetMessage())
+	default:
+		conditions.MarkUnknown(AsyncIngressReady, "ProducerNotReady",
+			"The producer Service %s/%s is not ready yet", namespace, producerServiceName)
+	}
+}
+
 // makeNewIngress creates an Ingress object with respond-async headers pointing to async-producer
-func makeNewIngress(ingress *v1alpha1.Ingress, ingressClass string) *v1alpha1.Ingress {
+func makeNewIngress(ingress *v1alpha1.Ingress, ingressClass, producerHost string) *v1alpha1.Ingress {
 	original := ingress.DeepCopy()
 	splits := make([]v1alpha1.IngressBackendSplit, 0, 1)
 	splits = append(splits, v1alpha1.IngressBackendSplit{
 		IngressBackend: v1alpha1.IngressBackend{
-			ServiceName:      kmeta.ChildName(ingress.Name, asyncSuffix),
+			ServiceName:      asyncServiceName(ingress),
 			ServiceNamespace: original.Namespace,
 			ServicePort:      intstr.FromInt(80),
 		},
 		Percent: int(100),
 	})
+	// Only the paths of async.knative.dev/paths, validated beforehand, are
+	// routed to the producer when it is set.
+	asyncPaths, _ := asyncPathFilter(ingress.Annotations)
 	theRules := []v1alpha1.IngressRule{}
 	for _, rule := range original.Spec.Rules {
 		newRule := rule
 		newPaths := make([]v1alpha1.HTTPIngressPath, 0)
-		if ingress.Annotations[AsyncModeAnnotationKey] == asyncAlwaysMode {
+		if isAlwaysAsync(ingress.Annotations) {
 			for _, path := range rule.HTTP.Paths {
-				defaultPath := path
-				defaultPath.Splits = splits
-				defaultPath.AppendHeaders = map[string]string{
-					asyncOriginalHostHeader: network.GetServiceHostname(ingress.Name, ingress.Namespace),
+				prefixes := []string{path.Path}
+				if asyncPaths != nil {
+					prefixes = asyncPaths.Prefixes()
+				}
+				for _, prefix := range prefixes {
+					syncPath := *path.DeepCopy()
+					syncPath.Path = prefix
+					defaultPath := *syncPath.DeepCopy()
+					defaultPath.Splits = splits
+					defaultPath.AppendHeaders = producerHeaders(ingress)
+					defaultPath.RewriteHost = producerHost
+					if syncPath.Headers == nil {
+						syncPath.Headers = map[string]v1alpha1.HeaderMatch{}
+					}
+					syncPath.Headers[preferHeaderField] = v1alpha1.HeaderMatch{Exact: preferSyncValue}
+					newPaths = append(newPaths, syncPath, defaultPath)
 				}
-				defaultPath.RewriteHost = network.GetServiceHostname(producerServiceName, system.Namespace())
-				if path.Headers == nil {
-					path.Headers = map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: preferSyncValue}}
-				} else {
-					path.Headers[preferHeaderField] = v1alpha1.HeaderMatch{Exact: preferSyncValue}
+				if asyncPaths != nil {
+					// The endpoints of the producer are not in the paths,
+					// and the other paths are left to the service.
+					newPaths = append(newPaths, producerEndpoints(ingress, splits, producerHost)...)
+					newPaths = append(newPaths, path)
 				}
-				newPaths = append(newPaths, path, defaultPath)
 				newRule.HTTP.Paths = newPaths
 				theRules = append(theRules, newRule)
 			}
 		} else {
-			newPaths = append(newPaths, v1alpha1.HTTPIngressPath{
-				Headers: map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: preferAsyncValue}},
-				Splits:  splits,
-				AppendHeaders: map[string]string{
-					asyncOriginalHostHeader: network.GetServiceHostname(ingress.Name, ingress.Namespace),
-				},
-				RewriteHost: network.GetServiceHostname(producerServiceName, system.Namespace()),
-			})
+			prefixes := []string{""}
+			if asyncPaths != nil {
+				prefixes = asyncPaths.Prefixes()
+			}
+			for _, prefix := range prefixes {
+				newPaths = append(newPaths, v1alpha1.HTTPIngressPath{
+					Path:          prefix,
+					Headers:       map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: preferAsyncValue}},
+					Splits:        splits,
+					AppendHeaders: producerHeaders(ingress),
+					RewriteHost:   producerHost,
+				})
+			}
+			newPaths = append(newPaths, producerEndpoints(ingress, splits, producerHost)...)
 			newPaths = append(newPaths, newRule.HTTP.Paths...)
 			newRule.HTTP.Paths = newPaths
 			theRules = append(theRules, newRule)
@@ -165,30 +336,135 @@ func makeNewIngress(ingress *v1alpha1.Ingress, ingressClass string) *v1alpha1.In
 	}
 }
 
-// TODO(bvennam) track status of upstream ingress that is created "-new"
-func markIngressReady(ingress *v1alpha1.Ingress) {
-	privateDomain := domainForLocalGateway(ingress.Name, true)
-	publicDomain := domainForLocalGateway(ingress.Name, false)
+// producerEndpoints returns the paths of the endpoints the producer serves
+// next to the requests themselves, routed to it whatever the Prefer header.
+func producerEndpoints(ingress *v1alpha1.Ingress, splits []v1alpha1.IngressBackendSplit, producerHost string) []v1alpha1.HTTPIngressPath {
+	return []v1alpha1.HTTPIngressPath{{
+		// The producer serves the status of async requests, which callers
+		// poll without the Prefer header.
+		Path:          asyncStatusPath,
+		Splits:        splits,
+		AppendHeaders: producerHeaders(ingress),
+		RewriteHost:   producerHost,
+	}, {
+		// Batches are always asynchronous.
+		Path:          asyncBatchPath,
+		Splits:        splits,
+		AppendHeaders: producerHeaders(ingress),
+		RewriteHost:   producerHost,
+	}, {
+		// Callers cancel their requests without the Prefer header.
+		Path:          asyncRequestsPath,
+		Splits:        splits,
+		AppendHeaders: producerHeaders(ingress),
+		RewriteHost:   producerHost,
+	}, {
+		// Like the status, results are fetched without the Prefer header.
+		Path:          asyncResultsPath,
+		Splits:        splits,
+		AppendHeaders: producerHeaders(ingress),
+		RewriteHost:   producerHost,
+	}}
+}
+
+// producerHeaders returns the headers added to requests routed to the producer.
+func producerHeaders(ingress *v1alpha1.Ingress) map[string]string {
+	headers := map[string]string{
+		asyncOriginalHostHeader: originalHost(ingress),
+	}
+	if ttl := ingress.Annotations[AsyncTTLAnnotationKey]; ttl != "" {
+		headers[asyncServiceTTLHeader] = ttl
+	}
+	if limit := ingress.Annotations[AsyncRequestSizeLimitAnnotationKey]; limit != "" {
+		headers[asyncServiceSizeLimitHeader] = limit
+	}
+	headers[asyncServiceModeHeader] = asyncConditionalShortMode
+	if isAlwaysAsync(ingress.Annotations) {
+		headers[asyncServiceModeHeader] = asyncAlwaysShortMode
+	}
+	if idempotent := ingress.Annotations[AsyncIdempotentAnnotationKey]; idempotent != "" {
+		headers[asyncServiceIdempotentHeader] = idempotent
+	}
+	if retries := ingress.Annotations[AsyncRetriesAnnotationKey]; retries != "" {
+		headers[asyncServiceRetriesHeader] = retries
+	}
+	if backoff := ingress.Annotations[AsyncBackoffAnnotationKey]; backoff != "" {
+		headers[asyncServiceBackoffHeader] = backoff
+	}
+	if sink := ingress.Annotations[AsyncDeadLetterSinkAnnotationKey]; sink != "" {
+		headers[asyncServiceDeadLetterSinkHeader] = sink
+	}
+	if asyncPaths, _ := asyncPathFilter(ingress.Annotations); asyncPaths != nil {
+		headers[asyncServicePathsHeader] = asyncPaths.String()
+	}
+	// The producer drops the service headers of callers, keeping those
+	// listed here. The mode is always set, so the list is never empty and
+	// always replaces one sent by a caller.
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		if strings.HasPrefix(name, asyncServiceHeaderPrefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	headers[asyncServiceHeadersHeader] = strings.Join(names, ",")
+	return headers
+}
+
+// asyncPathFilter returns the paths of the async.knative.dev/paths
+// annotation, or nil when it is not set, so every path is asynchronous.
+func asyncPathFilter(annotations map[string]string) (paths.Filter, error) {
+	value, ok := annotations[AsyncPathsAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	return paths.Parse(value)
+}
+
+// originalHost returns the cluster-local host of the service the requests
+// to ingress are delivered to. The ingresses of Routes are named after the
+// Route, those of DomainMappings after their custom domain, and they rewrite
+// the host of the requests to that of the service they map to.
+func originalHost(ingress *v1alpha1.Ingress) string {
+	if _, ok := ingress.Labels[domainMappingUIDLabelKey]; ok {
+		for _, rule := range ingress.Spec.Rules {
+			for _, path := range rule.HTTP.Paths {
+				if path.RewriteHost != "" {
+					return path.RewriteHost
+				}
+			}
+		}
+	}
+	return network.GetServiceHostname(ingress.Name, ingress.Namespace)
+}
+
+// asyncServiceName returns the name of the K8s Service routing the requests
+// of ingress to the producer. The dots of the custom domains naming the
+// ingresses of DomainMappings are not allowed in Service names.
+func asyncServiceName(ingress *v1alpha1.Ingress) string {
+	return kmeta.ChildName(strings.ReplaceAll(ingress.Name, ".", "-"), asyncSuffix)
+}
+
+// isAlwaysAsync reports whether the async.knative.dev/mode annotation makes
+// every request to the service asynchronous.
+func isAlwaysAsync(annotations map[string]string) bool {
+	mode := annotations[AsyncModeAnnotationKey]
+	return mode == asyncAlwaysMode || mode == asyncAlwaysShortMode
+}
 
+// TODO(bvennam) track status of upstream ingress that is created "-new"
+func (r *Reconciler) markIngressReady(ingress *v1alpha1.Ingress) {
 	ingress.Status.MarkLoadBalancerReady(
 		[]v1alpha1.LoadBalancerIngressStatus{{
-			DomainInternal: publicDomain,
+			DomainInternal: r.gateways.PublicGateway,
 		}},
 		[]v1alpha1.LoadBalancerIngressStatus{{
-			DomainInternal: privateDomain,
+			DomainInternal: r.gateways.PrivateGateway,
 		}},
 	)
 	ingress.Status.MarkNetworkConfigured()
 }
 
-// TODO(bvennam) we need to pull this from the upstream ingress that is create "-new"
-func domainForLocalGateway(ingressName string, isPrivate bool) string {
-	if isPrivate {
-		return privateLBDomain
-	}
-	return publicLBDomain
-}
-
 func (r *Reconciler) reconcileService(ctx context.Context, desiredSvc *corev1.Service) error {
 	logger := logging.FromContext(ctx)
 
@@ -219,18 +495,19 @@ func (r *Reconciler) reconcileService(ctx context.Context, desiredSvc *corev1.Se
 }
 
 // MakeK8sService constructs a K8s service, that is used to route service to the producer service
-func MakeK8sService(ingress *v1alpha1.Ingress) *corev1.Service {
+// at producerHost
+func MakeK8sService(ingress *v1alpha1.Ingress, producerHost string) *corev1.Service {
 	selector := make(map[string]string)
 	selector["app"] = producerServiceName
 	return &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:            kmeta.ChildName(ingress.ObjectMeta.Name, asyncSuffix),
+			Name:            asyncServiceName(ingress),
 			Namespace:       ingress.Namespace,
 			OwnerReferences: ingress.OwnerReferences,
 		},
 		Spec: corev1.ServiceSpec{
 			Type:         "ExternalName",
-			ExternalName: network.GetServiceHostname(producerServiceName, system.Namespace()),
+			ExternalName: producerHost,
 			Ports: []corev1.ServicePort{{
 				Name:       networking.ServicePortName(networking.ProtocolHTTP1),
 				Protocol:   corev1.ProtocolTCP,
@@ -243,10 +520,45 @@ func MakeK8sService(ingress *v1alpha1.Ingress) *corev1.Service {
 	}
 }
 
-func validateAsyncModeAnnotation(annotations map[string]string) error {
+// ValidateAnnotations returns an error when one of the async.knative.dev
+// annotations of a service has an invalid value.
+func ValidateAnnotations(annotations map[string]string) error {
 	asyncMode := annotations[AsyncModeAnnotationKey]
-	if asyncMode != "" && asyncMode != asyncAlwaysMode && asyncMode != asyncConditionalMode {
-		return fmt.Errorf("Invalid value for key %s: ", AsyncModeAnnotationKey)
+	switch asyncMode {
+	case "", asyncAlwaysMode, asyncConditionalMode, asyncAlwaysShortMode, asyncConditionalShortMode:
+	default:
+		return fmt.Errorf("Invalid value for key %s: %q", AsyncModeAnnotationKey, asyncMode)
+	}
+	if ttl, ok := annotations[AsyncTTLAnnotationKey]; ok {
+		if d, err := time.ParseDuration(ttl); err != nil || d <= 0 {
+			return fmt.Errorf("Invalid value for key %s: %q", AsyncTTLAnnotationKey, ttl)
+		}
+	}
+	if limit, ok := annotations[AsyncRequestSizeLimitAnnotationKey]; ok {
+		if n, err := strconv.ParseInt(limit, 10, 64); err != nil || n <= 0 {
+			return fmt.Errorf("Invalid value for key %s: %q", AsyncRequestSizeLimitAnnotationKey, limit)
+		}
+	}
+	if idempotent, ok := annotations[AsyncIdempotentAnnotationKey]; ok && idempotent != "true" && idempotent != "false" {
+		return fmt.Errorf("Invalid value for key %s: %q", AsyncIdempotentAnnotationKey, idempotent)
+	}
+	if retries, ok := annotations[AsyncRetriesAnnotationKey]; ok {
+		if n, err := strconv.Atoi(retries); err != nil || n < 0 {
+			return fmt.Errorf("Invalid value for key %s: %q", AsyncRetriesAnnotationKey, retries)
+		}
+	}
+	if backoff, ok := annotations[AsyncBackoffAnnotationKey]; ok {
+		if d, err := time.ParseDuration(backoff); err != nil || d <= 0 {
+			return fmt.Errorf("Invalid value for key %s: %q", AsyncBackoffAnnotationKey, backoff)
+		}
+	}
+	if sink, ok := annotations[AsyncDeadLetterSinkAnnotationKey]; ok {
+		if u, err := url.Parse(sink); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid value for key %s: %q", AsyncDeadLetterSinkAnnotationKey, sink)
+		}
+	}
+	if _, err := asyncPathFilter(annotations); err != nil {
+		return fmt.Errorf("Invalid value for key %s: %w", AsyncPathsAnnotationKey, err)
 	}
 	return nil
 }
@@ -18,12 +18,17 @@ package ingress
 
 import (
 	"context"
+	"os"
+	"sort"
+	"strings"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
 	corev1 "k8s.io/api/core/v1"
 
 	"knative.dev/net-contour/pkg/reconciler/contour/config"
 	fakenetworkingclient "knative.dev/networking/pkg/client/injection/client/fake"
+	"knative.dev/pkg/apis"
 	duckv1 "knative.dev/pkg/apis/duck/v1"
 	fakekubeclient "knative.dev/pkg/client/injection/kube/client/fake"
 
@@ -34,6 +39,7 @@ import (
 	"knative.dev/pkg/logging"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	. "knative.dev/async-component/pkg/reconciler/testing"
@@ -59,6 +65,7 @@ const (
 	exampleHost            = "example.com"
 	testHost               = "test.com"
 	serviceName            = "servicename"
+	gatewayAPIIngressClass = "gateway-api.ingress.networking.knative.dev"
 )
 
 var statusReady = v1alpha1.IngressStatus{
@@ -74,6 +81,10 @@ var statusReady = v1alpha1.IngressStatus{
 	},
 	Status: duckv1.Status{
 		Conditions: duckv1.Conditions{{
+			Type:     AsyncIngressReady,
+			Status:   corev1.ConditionTrue,
+			Severity: apis.ConditionSeverityInfo,
+		}, {
 			Type:   v1alpha1.IngressConditionLoadBalancerReady,
 			Status: corev1.ConditionTrue,
 		}, {
@@ -111,6 +122,12 @@ var ingAlwaysAsync = ingress(defaultNamespace, testingAlwaysAsyncName, statusRea
 		AsyncModeAnnotationKey:               asyncAlwaysMode,
 	}),
 )
+var ingAlwaysAsyncShortMode = ingress(defaultNamespace, testingAlwaysAsyncName, statusReady,
+	withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		AsyncModeAnnotationKey:               asyncAlwaysShortMode,
+	}),
+)
 var ingSometimesAsync = ingress(defaultNamespace, testingName, statusReady,
 	withAnnotations(map[string]string{
 		networking.IngressClassAnnotationKey: asyncIngressClassName,
@@ -146,7 +163,11 @@ var alwaysAsyncPaths = []netv1alpha1.HTTPIngressPath{{
 				ServicePort:      intstr.FromInt(80),
 			},
 		}},
-		AppendHeaders: map[string]string{asyncOriginalHostHeader: network.GetServiceHostname(testingAlwaysAsyncName, defaultNamespace)},
+		AppendHeaders: map[string]string{
+			asyncOriginalHostHeader:   network.GetServiceHostname(testingAlwaysAsyncName, defaultNamespace),
+			asyncServiceModeHeader:    asyncAlwaysShortMode,
+			asyncServiceHeadersHeader: asyncServiceModeHeader,
+		},
 	},
 }
 
@@ -162,8 +183,74 @@ var conditionalAsyncPaths = []netv1alpha1.HTTPIngressPath{{
 		Percent: int(100),
 	}},
 	AppendHeaders: map[string]string{
-		asyncOriginalHostHeader: network.GetServiceHostname(testingName, defaultNamespace),
+		asyncOriginalHostHeader:   network.GetServiceHostname(testingName, defaultNamespace),
+		asyncServiceModeHeader:    asyncConditionalShortMode,
+		asyncServiceHeadersHeader: asyncServiceModeHeader,
 	}},
+	{
+		Path:        asyncStatusPath,
+		RewriteHost: network.GetServiceHostname(producerServiceName, knativeTesting),
+		Splits: []netv1alpha1.IngressBackendSplit{{
+			IngressBackend: v1alpha1.IngressBackend{
+				ServiceName:      testingName + asyncSuffix,
+				ServiceNamespace: defaultNamespace,
+				ServicePort:      intstr.FromInt(80),
+			},
+			Percent: int(100),
+		}},
+		AppendHeaders: map[string]string{
+			asyncOriginalHostHeader:   network.GetServiceHostname(testingName, defaultNamespace),
+			asyncServiceModeHeader:    asyncConditionalShortMode,
+			asyncServiceHeadersHeader: asyncServiceModeHeader,
+		}},
+	{
+		Path:        asyncBatchPath,
+		RewriteHost: network.GetServiceHostname(producerServiceName, knativeTesting),
+		Splits: []netv1alpha1.IngressBackendSplit{{
+			IngressBackend: v1alpha1.IngressBackend{
+				ServiceName:      testingName + asyncSuffix,
+				ServiceNamespace: defaultNamespace,
+				ServicePort:      intstr.FromInt(80),
+			},
+			Percent: int(100),
+		}},
+		AppendHeaders: map[string]string{
+			asyncOriginalHostHeader:   network.GetServiceHostname(testingName, defaultNamespace),
+			asyncServiceModeHeader:    asyncConditionalShortMode,
+			asyncServiceHeadersHeader: asyncServiceModeHeader,
+		}},
+	{
+		Path:        asyncRequestsPath,
+		RewriteHost: network.GetServiceHostname(producerServiceName, knativeTesting),
+		Splits: []netv1alpha1.IngressBackendSplit{{
+			IngressBackend: v1alpha1.IngressBackend{
+				ServiceName:      testingName + asyncSuffix,
+				ServiceNamespace: defaultNamespace,
+				ServicePort:      intstr.FromInt(80),
+			},
+			Percent: int(100),
+		}},
+		AppendHeaders: map[string]string{
+			asyncOriginalHostHeader:   network.GetServiceHostname(testingName, defaultNamespace),
+			asyncServiceModeHeader:    asyncConditionalShortMode,
+			asyncServiceHeadersHeader: asyncServiceModeHeader,
+		}},
+	{
+		Path:        asyncResultsPath,
+		RewriteHost: network.GetServiceHostname(producerServiceName, knativeTesting),
+		Splits: []netv1alpha1.IngressBackendSplit{{
+			IngressBackend: v1alpha1.IngressBackend{
+				ServiceName:      testingName + asyncSuffix,
+				ServiceNamespace: defaultNamespace,
+				ServicePort:      intstr.FromInt(80),
+			},
+			Percent: int(100),
+		}},
+		AppendHeaders: map[string]string{
+			asyncOriginalHostHeader:   network.GetServiceHostname(testingName, defaultNamespace),
+			asyncServiceModeHeader:    asyncConditionalShortMode,
+			asyncServiceHeadersHeader: asyncServiceModeHeader,
+		}},
 	{Splits: []netv1alpha1.IngressBackendSplit{{
 		Percent: 100,
 		AppendHeaders: map[string]string{
@@ -177,12 +264,77 @@ var conditionalAsyncPaths = []netv1alpha1.HTTPIngressPath{{
 	}},
 }
 var createdIng = ingressWithPaths(defaultNamespace, testingName, statusUnknown, conditionalAsyncPaths)
+var ingWithTTL = ingress(defaultNamespace, testingName, statusReady,
+	withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		AsyncTTLAnnotationKey:                "1h",
+	}),
+)
+var ingInvalidTTLAnnotation = ingress(defaultNamespace, testingName, statusReady,
+	withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		AsyncTTLAnnotationKey:                "forever",
+	}),
+)
+var ingWithSizeLimit = ingress(defaultNamespace, testingName, statusReady,
+	withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		AsyncRequestSizeLimitAnnotationKey:   "1000",
+	}),
+)
+var ingInvalidSizeLimitAnnotation = ingress(defaultNamespace, testingName, statusReady,
+	withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		AsyncRequestSizeLimitAnnotationKey:   "1MB",
+	}),
+)
+var ingNonIdempotent = ingress(defaultNamespace, testingName, statusReady,
+	withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		AsyncIdempotentAnnotationKey:         "false",
+	}),
+)
+var ingInvalidIdempotentAnnotation = ingress(defaultNamespace, testingName, statusReady,
+	withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		AsyncIdempotentAnnotationKey:         "no",
+	}),
+)
+var ingWithRetryPolicy = ingress(defaultNamespace, testingName, statusReady,
+	withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		AsyncRetriesAnnotationKey:            "5",
+		AsyncBackoffAnnotationKey:            "10s",
+		AsyncDeadLetterSinkAnnotationKey:     "http://sink.default.svc.cluster.local",
+	}),
+)
+var ingInvalidRetriesAnnotation = ingress(defaultNamespace, testingName, statusReady,
+	withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		AsyncRetriesAnnotationKey:            "-1",
+	}),
+)
+var ingInvalidBackoffAnnotation = ingress(defaultNamespace, testingName, statusReady,
+	withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		AsyncBackoffAnnotationKey:            "soon",
+	}),
+)
+var ingInvalidDeadLetterSinkAnnotation = ingress(defaultNamespace, testingName, statusReady,
+	withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		AsyncDeadLetterSinkAnnotationKey:     "sink.default",
+	}),
+)
 var createdIngWithAsyncAlways = ingressWithPaths(defaultNamespace, testingAlwaysAsyncName, statusUnknown, alwaysAsyncPaths)
 
 func TestReconcile(t *testing.T) {
 	createdIng.Status.InitializeConditions()
 	changedService := service(defaultNamespace, testingName)
 	changedService.Spec.ExternalName = "changed"
+	namespaceProducer := network.GetServiceHostname(producerServiceName, defaultNamespace)
+	serviceToNamespaceProducer := service(defaultNamespace, testingName)
+	serviceToNamespaceProducer.Spec.ExternalName = namespaceProducer
 	table := TableTest{{
 		Name: "skip ingress not matching class key",
 		Objects: []runtime.Object{
@@ -210,6 +362,17 @@ func TestReconcile(t *testing.T) {
 		WantUpdates: []ktesting.UpdateActionImpl{{
 			Object: service(defaultNamespace, testingName),
 		}}}, {
+		Name: "route to the producer of the namespace",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+			&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: producerServiceName, Namespace: defaultNamespace}},
+			producer(defaultNamespace, corev1.ConditionTrue, ""),
+		},
+		WantCreates: []runtime.Object{
+			ingressWithPaths(defaultNamespace, testingName, statusUnknown, withProducerHost(conditionalAsyncPaths, namespaceProducer)),
+			serviceToNamespaceProducer,
+		}}, {
 		Name: "create new ingress with async annotation and sometimes mode value",
 		Key:  "default/testing",
 		Objects: []runtime.Object{
@@ -228,6 +391,121 @@ func TestReconcile(t *testing.T) {
 			createdIngWithAsyncAlways,
 			service(defaultNamespace, testingAlwaysAsyncName),
 		}}, {
+		Name: "create new ingress with async annotation and short always mode value",
+		Key:  "default/testing-always",
+		Objects: []runtime.Object{
+			ingAlwaysAsyncShortMode,
+		},
+		WantCreates: []runtime.Object{
+			createdIngWithAsyncAlways,
+			service(defaultNamespace, testingAlwaysAsyncName),
+		}}, {
+		Name: "create new ingress with ttl annotation",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingWithTTL,
+		},
+		WantCreates: []runtime.Object{
+			ingressWithPaths(defaultNamespace, testingName, statusUnknown, withProducerHeader(conditionalAsyncPaths, asyncServiceTTLHeader, "1h")),
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "create new ingress with invalid ttl annotation",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingInvalidTTLAnnotation,
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", `Invalid value for key async.knative.dev/ttl: "forever"`),
+		}}, {
+		Name: "create new ingress with request size limit annotation",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingWithSizeLimit,
+		},
+		WantCreates: []runtime.Object{
+			ingressWithPaths(defaultNamespace, testingName, statusUnknown, withProducerHeader(conditionalAsyncPaths, asyncServiceSizeLimitHeader, "1000")),
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "create new ingress with invalid request size limit annotation",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingInvalidSizeLimitAnnotation,
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", `Invalid value for key async.knative.dev/request-size-limit: "1MB"`),
+		}}, {
+		Name: "create new ingress with idempotent annotation",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingNonIdempotent,
+		},
+		WantCreates: []runtime.Object{
+			ingressWithPaths(defaultNamespace, testingName, statusUnknown, withProducerHeader(conditionalAsyncPaths, asyncServiceIdempotentHeader, "false")),
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "create new ingress with invalid idempotent annotation",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingInvalidIdempotentAnnotation,
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", `Invalid value for key async.knative.dev/idempotent: "no"`),
+		}}, {
+		Name: "create new ingress with retry policy annotations",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingWithRetryPolicy,
+		},
+		WantCreates: []runtime.Object{
+			ingressWithPaths(defaultNamespace, testingName, statusUnknown,
+				withProducerHeader(withProducerHeader(withProducerHeader(conditionalAsyncPaths,
+					asyncServiceRetriesHeader, "5"),
+					asyncServiceBackoffHeader, "10s"),
+					asyncServiceDeadLetterSinkHeader, "http://sink.default.svc.cluster.local")),
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "create new ingress with invalid retries annotation",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingInvalidRetriesAnnotation,
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", `Invalid value for key async.knative.dev/retries: "-1"`),
+		}}, {
+		Name: "create new ingress with invalid backoff annotation",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingInvalidBackoffAnnotation,
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", `Invalid value for key async.knative.dev/backoff: "soon"`),
+		}}, {
+		Name: "create new ingress with invalid dead-letter sink annotation",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingInvalidDeadLetterSinkAnnotation,
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", `Invalid value for key async.knative.dev/dead-letter-sink: "sink.default"`),
+		}}, {
+		Name: "create new ingress with invalid paths annotation",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingress(defaultNamespace, testingName, statusReady, withAnnotations(map[string]string{
+				networking.IngressClassAnnotationKey: asyncIngressClassName,
+				AsyncPathsAnnotationKey:              "reports/*",
+			})),
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", `Invalid value for key async.knative.dev/paths: path "reports/*" does not start with /`),
+		}}, {
 		Name: "create new ingress with async annotation and invalid mode value",
 		Key:  "default/testing",
 		Objects: []runtime.Object{
@@ -235,16 +513,23 @@ func TestReconcile(t *testing.T) {
 		},
 		WantErr: true,
 		WantEvents: []string{
-			Eventf(corev1.EventTypeWarning, "InternalError", "Invalid value for key async.knative.dev/mode: "),
+			Eventf(corev1.EventTypeWarning, "InternalError", `Invalid value for key async.knative.dev/mode: "invalid.mode.annotation.value"`),
 		}},
 	}
 
+	// The shared producer is ready.
+	for i := range table {
+		table[i].Objects = append(table[i].Objects, producer(knativeTesting, corev1.ConditionTrue, ""))
+	}
+
 	table.Test(t, MakeFactory(func(ctx context.Context, listers *Listers, cmw configmap.Watcher) controller.Reconciler {
 		r := &Reconciler{
-			netclient:     fakenetworkingclient.Get(ctx),
-			ingressLister: listers.GetIngressLister(),
-			serviceLister: listers.GetK8sServiceLister(),
-			kubeclient:    fakekubeclient.Get(ctx),
+			netclient:      fakenetworkingclient.Get(ctx),
+			ingressLister:  listers.GetIngressLister(),
+			serviceLister:  listers.GetK8sServiceLister(),
+			kubeclient:     fakekubeclient.Get(ctx),
+			producerLister: listers.GetUnstructuredLister(ProducerResource),
+			gateways:       gatewayConfig{IngressClass: networkpkg.IstioIngressClassName, PublicGateway: publicLBDomain, PrivateGateway: privateLBDomain},
 		}
 		return ingressreconciler.NewReconciler(ctx, logging.FromContext(ctx), fakenetworkingclient.Get(ctx),
 			listers.GetIngressLister(), controller.GetEventRecorder(ctx), r, asyncIngressClassName, controller.Options{})
@@ -314,6 +599,37 @@ func ingressWithPaths(namespace, name string, status v1alpha1.IngressStatus, pat
 	}
 }
 
+// withProducerHeader returns a copy of paths where the paths routed to the
+// producer also append the header key, and list it in the service headers.
+func withProducerHeader(paths []netv1alpha1.HTTPIngressPath, key, value string) []netv1alpha1.HTTPIngressPath {
+	out := make([]netv1alpha1.HTTPIngressPath, 0, len(paths))
+	for _, path := range paths {
+		path := *path.DeepCopy()
+		if path.RewriteHost != "" {
+			path.AppendHeaders[key] = value
+			names := append(strings.Split(path.AppendHeaders[asyncServiceHeadersHeader], ","), key)
+			sort.Strings(names)
+			path.AppendHeaders[asyncServiceHeadersHeader] = strings.Join(names, ",")
+		}
+		out = append(out, path)
+	}
+	return out
+}
+
+// withProducerHost returns a copy of paths where the paths routed to the
+// producer are rewritten to host.
+func withProducerHost(paths []netv1alpha1.HTTPIngressPath, host string) []netv1alpha1.HTTPIngressPath {
+	out := make([]netv1alpha1.HTTPIngressPath, 0, len(paths))
+	for _, path := range paths {
+		path := *path.DeepCopy()
+		if path.RewriteHost != "" {
+			path.RewriteHost = host
+		}
+		out = append(out, path)
+	}
+	return out
+}
+
 func service(namespace, name string) *corev1.Service {
 	selector := make(map[string]string)
 	selector["app"] = producerServiceName
@@ -337,3 +653,348 @@ func service(namespace, name string) *corev1.Service {
 	}
 	return svc
 }
+
+func TestReconcileIngressClasses(t *testing.T) {
+	for _, gateways := range []gatewayConfig{{
+		IngressClass:   gatewayAPIIngressClass,
+		PublicGateway:  "envoy-external.gateway-system.svc.cluster.local",
+		PrivateGateway: "envoy-internal.gateway-system.svc.cluster.local",
+	}, {
+		IngressClass:   ContourIngressClassName,
+		PublicGateway:  contourPublicLBDomain,
+		PrivateGateway: contourPrivateLBDomain,
+	}} {
+		gateways := gateways
+		t.Run(gateways.IngressClass, func(t *testing.T) {
+			status := *statusReady.DeepCopy()
+			status.PublicLoadBalancer.Ingress[0].DomainInternal = gateways.PublicGateway
+			status.PrivateLoadBalancer.Ingress[0].DomainInternal = gateways.PrivateGateway
+			created := ingressWithPaths(defaultNamespace, testingName, statusUnknown, conditionalAsyncPaths)
+			created.Annotations[networking.IngressClassAnnotationKey] = gateways.IngressClass
+			created.Status.InitializeConditions()
+
+			table := TableTest{{
+				Name: "create new ingress of the class",
+				Key:  "default/testing",
+				Objects: []runtime.Object{
+					ingress(defaultNamespace, testingName, status, withAnnotations(map[string]string{
+						networking.IngressClassAnnotationKey: asyncIngressClassName,
+					})),
+				},
+				WantCreates: []runtime.Object{
+					created,
+					service(defaultNamespace, testingName),
+				}},
+			}
+			for i := range table {
+				table[i].Objects = append(table[i].Objects, producer(knativeTesting, corev1.ConditionTrue, ""))
+			}
+
+			table.Test(t, MakeFactory(func(ctx context.Context, listers *Listers, cmw configmap.Watcher) controller.Reconciler {
+				r := &Reconciler{
+					netclient:      fakenetworkingclient.Get(ctx),
+					ingressLister:  listers.GetIngressLister(),
+					serviceLister:  listers.GetK8sServiceLister(),
+					kubeclient:     fakekubeclient.Get(ctx),
+					producerLister: listers.GetUnstructuredLister(ProducerResource),
+					gateways:       gateways,
+				}
+				return ingressreconciler.NewReconciler(ctx, logging.FromContext(ctx), fakenetworkingclient.Get(ctx),
+					listers.GetIngressLister(), controller.GetEventRecorder(ctx), r, asyncIngressClassName, controller.Options{})
+			}))
+		})
+	}
+}
+
+func TestGatewayConfigFromEnv(t *testing.T) {
+	istio := gatewayConfig{IngressClass: networkpkg.IstioIngressClassName, PublicGateway: publicLBDomain, PrivateGateway: privateLBDomain}
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    gatewayConfig
+		wantErr bool
+	}{{
+		name: "default",
+		want: istio,
+	}, {
+		name: "istio",
+		env:  map[string]string{"INGRESS_CLASS": networkpkg.IstioIngressClassName},
+		want: istio,
+	}, {
+		name: "istio with a gateway of its own",
+		env:  map[string]string{"PUBLIC_GATEWAY": "custom-gateway.istio-system.svc.cluster.local"},
+		want: gatewayConfig{IngressClass: networkpkg.IstioIngressClassName, PublicGateway: "custom-gateway.istio-system.svc.cluster.local", PrivateGateway: privateLBDomain},
+	}, {
+		name: "gateway API",
+		env: map[string]string{
+			"INGRESS_CLASS":   gatewayAPIIngressClass,
+			"PUBLIC_GATEWAY":  "envoy-external.gateway-system.svc.cluster.local",
+			"PRIVATE_GATEWAY": "envoy-internal.gateway-system.svc.cluster.local",
+		},
+		want: gatewayConfig{
+			IngressClass:   gatewayAPIIngressClass,
+			PublicGateway:  "envoy-external.gateway-system.svc.cluster.local",
+			PrivateGateway: "envoy-internal.gateway-system.svc.cluster.local",
+		},
+	}, {
+		name: "contour",
+		env:  map[string]string{"INGRESS_CLASS": ContourIngressClassName},
+		want: gatewayConfig{IngressClass: ContourIngressClassName, PublicGateway: contourPublicLBDomain, PrivateGateway: contourPrivateLBDomain},
+	}, {
+		name:    "gateways of an unknown class",
+		env:     map[string]string{"INGRESS_CLASS": gatewayAPIIngressClass},
+		wantErr: true,
+	}, {
+		name:    "async class",
+		env:     map[string]string{"INGRESS_CLASS": asyncIngressClassName},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for k, v := range test.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+			got, err := gatewayConfigFromEnv()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("gatewayConfigFromEnv() = %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && got != test.want {
+				t.Errorf("gatewayConfigFromEnv() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMakeNewIngressIstio(t *testing.T) {
+	producerHost := network.GetServiceHostname(producerServiceName, knativeTesting)
+	tests := []struct {
+		name string
+		ing  *v1alpha1.Ingress
+		// want are the header matches of the paths sent to the producer,
+		// which net-istio turns into the routes of VirtualServices.
+		want []map[string]v1alpha1.HeaderMatch
+	}{{
+		name: "conditional",
+		ing:  ingSometimesAsync,
+		want: []map[string]v1alpha1.HeaderMatch{{preferHeaderField: {Exact: preferAsyncValue}}, nil, nil, nil, nil},
+	}, {
+		name: "always",
+		ing:  ingAlwaysAsync,
+		want: []map[string]v1alpha1.HeaderMatch{nil},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := makeNewIngress(test.ing, networkpkg.IstioIngressClassName, producerHost)
+			if class := got.Annotations[networking.IngressClassAnnotationKey]; class != networkpkg.IstioIngressClassName {
+				t.Errorf("ingress class = %q, want %q", class, networkpkg.IstioIngressClassName)
+			}
+			var headers []map[string]v1alpha1.HeaderMatch
+			for _, rule := range got.Spec.Rules {
+				for _, path := range rule.HTTP.Paths {
+					if path.RewriteHost == "" {
+						continue
+					}
+					if path.RewriteHost != producerHost {
+						t.Errorf("path %q rewrites the host to %q, want %q", path.Path, path.RewriteHost, producerHost)
+					}
+					if want := test.ing.Name + asyncSuffix; path.Splits[0].ServiceName != want {
+						t.Errorf("path %q is sent to %q, want %q", path.Path, path.Splits[0].ServiceName, want)
+					}
+					headers = append(headers, path.Headers)
+				}
+			}
+			if diff := cmp.Diff(test.want, headers); diff != "" {
+				t.Error("producer header matches (-want, +got):", diff)
+			}
+		})
+	}
+}
+
+func TestMakeNewIngressPaths(t *testing.T) {
+	producerHost := network.GetServiceHostname(producerServiceName, knativeTesting)
+	// route is where a path of the ingress sends requests.
+	type route struct {
+		Path     string
+		Prefer   string
+		Producer bool
+	}
+	tests := []struct {
+		name string
+		mode string
+		want []route
+	}{{
+		name: "conditional",
+		mode: asyncConditionalMode,
+		want: []route{
+			{Path: "/reports/", Prefer: preferAsyncValue, Producer: true},
+			{Path: "/export", Prefer: preferAsyncValue, Producer: true},
+			{Path: asyncStatusPath, Producer: true},
+			{Path: asyncBatchPath, Producer: true},
+			{Path: asyncRequestsPath, Producer: true},
+			{Path: asyncResultsPath, Producer: true},
+			{},
+		},
+	}, {
+		name: "always",
+		mode: asyncAlwaysMode,
+		want: []route{
+			{Path: "/reports/", Prefer: preferSyncValue},
+			{Path: "/reports/", Producer: true},
+			{Path: "/export", Prefer: preferSyncValue},
+			{Path: "/export", Producer: true},
+			{Path: asyncStatusPath, Producer: true},
+			{Path: asyncBatchPath, Producer: true},
+			{Path: asyncRequestsPath, Producer: true},
+			{Path: asyncResultsPath, Producer: true},
+			{},
+		},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ing := ingress(defaultNamespace, testingName, statusReady, withAnnotations(map[string]string{
+				networking.IngressClassAnnotationKey: asyncIngressClassName,
+				AsyncModeAnnotationKey:               test.mode,
+				AsyncPathsAnnotationKey:              "/reports/*, /export",
+			}))
+			got := makeNewIngress(ing, networkpkg.IstioIngressClassName, producerHost)
+			var routes []route
+			for _, path := range got.Spec.Rules[0].HTTP.Paths {
+				routes = append(routes, route{
+					Path:     path.Path,
+					Prefer:   path.Headers[preferHeaderField].Exact,
+					Producer: path.RewriteHost == producerHost,
+				})
+				if path.RewriteHost == producerHost && path.AppendHeaders[asyncServicePathsHeader] != "/reports/*,/export" {
+					t.Errorf("path %q sets %s to %q, want the paths", path.Path, asyncServicePathsHeader, path.AppendHeaders[asyncServicePathsHeader])
+				}
+			}
+			if diff := cmp.Diff(test.want, routes); diff != "" {
+				t.Error("paths (-want, +got):", diff)
+			}
+		})
+	}
+}
+
+func TestMakeNewIngressDomainMapping(t *testing.T) {
+	producerHost := network.GetServiceHostname(producerServiceName, knativeTesting)
+	targetHost := network.GetServiceHostname(testingName, defaultNamespace)
+	// Knative Serving names the ingress of a DomainMapping after its domain,
+	// and rewrites the host of the requests to that of the mapped service.
+	dm := ingress(defaultNamespace, "api."+exampleHost, statusReady, withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+	}))
+	dm.Labels = map[string]string{domainMappingUIDLabelKey: "uid"}
+	dm.Spec.Rules[0].HTTP.Paths[0].RewriteHost = targetHost
+
+	got := makeNewIngress(dm, networkpkg.IstioIngressClassName, producerHost)
+	for _, path := range got.Spec.Rules[0].HTTP.Paths {
+		if path.RewriteHost != producerHost {
+			if path.RewriteHost != targetHost {
+				t.Errorf("path to the service rewrites the host to %q, want %q", path.RewriteHost, targetHost)
+			}
+			continue
+		}
+		if host := path.AppendHeaders[asyncOriginalHostHeader]; host != targetHost {
+			t.Errorf("path %q sets %s to %q, want %q", path.Path, asyncOriginalHostHeader, host, targetHost)
+		}
+		if want := "api-example-com" + asyncSuffix; path.Splits[0].ServiceName != want {
+			t.Errorf("path %q is sent to %q, want %q", path.Path, path.Splits[0].ServiceName, want)
+		}
+	}
+	if name := MakeK8sService(dm, producerHost).Name; name != "api-example-com"+asyncSuffix {
+		t.Errorf("K8s Service name = %q, want it without dots", name)
+	}
+}
+
+func TestReconcileProducerStatus(t *testing.T) {
+	withAsyncReady := func(status corev1.ConditionStatus, reason, message string) v1alpha1.IngressStatus {
+		s := *statusReady.DeepCopy()
+		s.Conditions[0] = apis.Condition{
+			Type:     AsyncIngressReady,
+			Status:   status,
+			Severity: apis.ConditionSeverityInfo,
+			Reason:   reason,
+			Message:  message,
+		}
+		return s
+	}
+	table := TableTest{{
+		Name: "producer not found",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: ingress(defaultNamespace, testingName,
+				withAsyncReady(corev1.ConditionFalse, "ProducerNotFound", "The producer Service knative-testing/async-producer does not exist"),
+				withAnnotations(ingWithAsyncAnnotation.Annotations)),
+		}}}, {
+		Name: "producer not ready",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+			producer(knativeTesting, corev1.ConditionFalse, "Readiness probe failed: queue backend unreachable"),
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: ingress(defaultNamespace, testingName,
+				withAsyncReady(corev1.ConditionFalse, "ProducerNotReady", "The producer Service knative-testing/async-producer is not ready: Readiness probe failed: queue backend unreachable"),
+				withAnnotations(ingWithAsyncAnnotation.Annotations)),
+		}}}, {
+		Name: "producer not ready yet",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+			producer(knativeTesting, corev1.ConditionUnknown, ""),
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: ingress(defaultNamespace, testingName,
+				withAsyncReady(corev1.ConditionUnknown, "ProducerNotReady", "The producer Service knative-testing/async-producer is not ready yet"),
+				withAnnotations(ingWithAsyncAnnotation.Annotations)),
+		}}},
+	}
+
+	table.Test(t, MakeFactory(func(ctx context.Context, listers *Listers, cmw configmap.Watcher) controller.Reconciler {
+		r := &Reconciler{
+			netclient:      fakenetworkingclient.Get(ctx),
+			ingressLister:  listers.GetIngressLister(),
+			serviceLister:  listers.GetK8sServiceLister(),
+			kubeclient:     fakekubeclient.Get(ctx),
+			producerLister: listers.GetUnstructuredLister(ProducerResource),
+			gateways:       gatewayConfig{IngressClass: networkpkg.IstioIngressClassName, PublicGateway: publicLBDomain, PrivateGateway: privateLBDomain},
+		}
+		return ingressreconciler.NewReconciler(ctx, logging.FromContext(ctx), fakenetworkingclient.Get(ctx),
+			listers.GetIngressLister(), controller.GetEventRecorder(ctx), r, asyncIngressClassName, controller.Options{})
+	}))
+}
+
+// producer returns the Knative Service of the producer of namespace, with a
+// Ready condition of status.
+func producer(namespace string, status corev1.ConditionStatus, message string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []interface{}{map[string]interface{}{
+				"type":    string(apis.ConditionReady),
+				"status":  string(status),
+				"message": message,
+			}},
+		},
+	}}
+	obj.SetAPIVersion(ProducerResource.GroupVersion().String())
+	obj.SetKind("Service")
+	obj.SetName(producerServiceName)
+	obj.SetNamespace(namespace)
+	return obj
+}
@@ -15,7 +15,10 @@ package ingress
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamiclister"
 	fakekubeclientset "k8s.io/client-go/kubernetes/fake"
 	corev1listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
@@ -32,16 +35,28 @@ var clientSetSchemes = []func(*runtime.Scheme) error{
 
 type Listers struct {
 	sorter testing.ObjectSorter
+	// unstructured holds the objects without a typed client, such as the
+	// Knative Services of the producers.
+	unstructured cache.Indexer
 }
 
 func NewListers(objs []runtime.Object) Listers {
 	scheme := NewScheme()
 
 	ls := Listers{
-		sorter: testing.NewObjectSorter(scheme),
+		sorter:       testing.NewObjectSorter(scheme),
+		unstructured: cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
 	}
 
-	ls.sorter.AddObjects(objs...)
+	typed := make([]runtime.Object, 0, len(objs))
+	for _, obj := range objs {
+		if u, ok := obj.(*unstructured.Unstructured); ok {
+			ls.unstructured.Add(u)
+		} else {
+			typed = append(typed, obj)
+		}
+	}
+	ls.sorter.AddObjects(typed...)
 
 	return ls
 }
@@ -80,3 +95,9 @@ func (l *Listers) GetIngressLister() networkinglisters.IngressLister {
 func (l *Listers) GetK8sServiceLister() corev1listers.ServiceLister {
 	return corev1listers.NewServiceLister(l.IndexerFor(&corev1.Service{}))
 }
+
+// GetUnstructuredLister returns a lister of the unstructured objects of
+// resource.
+func (l *Listers) GetUnstructuredLister(resource schema.GroupVersionResource) dynamiclister.Lister {
+	return dynamiclister.New(l.unstructured, resource)
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package request
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/types"
+	"knative.dev/async-component/pkg/queue"
+)
+
+const (
+	// ExpiresAtExtension is the CloudEvent extension holding the time a
+	// request expires at.
+	ExpiresAtExtension = "expiresat"
+	// DeadlineExtension is the CloudEvent extension holding the deadline
+	// of a request.
+	DeadlineExtension = "deadline"
+	// TraceParentExtension is the CloudEvent distributed tracing extension
+	// holding the W3C traceparent of the request.
+	TraceParentExtension = "traceparent"
+)
+
+// marshalEvent returns d as a structured CloudEvent. The event ID is the
+// request ID, the HTTP request is the data of the event and the expiry time,
+// deadline and trace context extensions, so eventing tooling can inspect and replay
+// the stream.
+func marshalEvent(d Data, t time.Time) ([]byte, error) {
+	event := cloudevents.NewEvent()
+	event.SetID(d.ID)
+	event.SetType(queue.RequestEventType)
+	event.SetSource(queue.RequestEventSource)
+	event.SetTime(t)
+	if d.ExpiresAt != nil {
+		event.SetExtension(ExpiresAtExtension, *d.ExpiresAt)
+	}
+	if d.Deadline != nil {
+		event.SetExtension(DeadlineExtension, *d.Deadline)
+	}
+	if d.TraceParent != "" {
+		event.SetExtension(TraceParentExtension, d.TraceParent)
+	}
+	d.ID, d.ExpiresAt, d.Deadline, d.TraceParent = "", nil, nil, ""
+	if err := event.SetData(cloudevents.ApplicationJSON, d); err != nil {
+		return nil, fmt.Errorf("failed to set event data: %w", err)
+	}
+	return json.Marshal(event)
+}
+
+func unmarshalEvent(b []byte) (*Data, error) {
+	event := cloudevents.NewEvent()
+	if err := json.Unmarshal(b, &event); err != nil {
+		return nil, fmt.Errorf("error unmarshalling cloudevent: %w", err)
+	}
+	d := &Data{}
+	if err := event.DataAs(d); err != nil {
+		return nil, fmt.Errorf("error reading data of cloudevent %q: %w", event.ID(), err)
+	}
+	d.ID = event.ID()
+	if v, ok := event.Extensions()[ExpiresAtExtension]; ok {
+		expiresAt, err := types.ToTime(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s extension of cloudevent %q: %w", ExpiresAtExtension, event.ID(), err)
+		}
+		d.ExpiresAt = &expiresAt
+	}
+	if v, ok := event.Extensions()[DeadlineExtension]; ok {
+		deadline, err := types.ToTime(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s extension of cloudevent %q: %w", DeadlineExtension, event.ID(), err)
+		}
+		d.Deadline = &deadline
+	}
+	if v, ok := event.Extensions()[TraceParentExtension]; ok {
+		traceParent, err := types.ToString(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s extension of cloudevent %q: %w", TraceParentExtension, event.ID(), err)
+		}
+		d.TraceParent = traceParent
+	}
+	return d, nil
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package request
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoVersion is the version of the schema in request.proto, written as the
+// first byte of protobuf records.
+const protoVersion = 1
+
+// Field numbers of request.proto.
+const (
+	fieldID           protowire.Number = 1
+	fieldURL          protowire.Number = 2
+	fieldMethod       protowire.Number = 3
+	fieldHeader       protowire.Number = 4
+	fieldBody         protowire.Number = 5
+	fieldBodyRef      protowire.Number = 6
+	fieldBodyEncoding protowire.Number = 7
+	fieldExpiresAt    protowire.Number = 8
+	fieldTraceParent  protowire.Number = 9
+	fieldEnqueuedAt   protowire.Number = 10
+	fieldSealed       protowire.Number = 11
+	fieldDeadline     protowire.Number = 12
+
+	// Fields of map entries, HeaderValues and google.protobuf.Timestamp.
+	fieldKey     protowire.Number = 1
+	fieldValue   protowire.Number = 2
+	fieldValues  protowire.Number = 1
+	fieldSeconds protowire.Number = 1
+	fieldNanos   protowire.Number = 2
+)
+
+func marshalProto(d Data) []byte {
+	b := []byte{protoVersion}
+	b = appendString(b, fieldID, d.ID)
+	b = appendString(b, fieldURL, d.ReqURL)
+	b = appendString(b, fieldMethod, d.ReqMethod)
+	// Sort the header so records of the same request are identical.
+	names := make([]string, 0, len(d.ReqHeader))
+	for name := range d.ReqHeader {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var values []byte
+		for _, v := range d.ReqHeader[name] {
+			values = protowire.AppendTag(values, fieldValues, protowire.BytesType)
+			values = protowire.AppendString(values, v)
+		}
+		var entry []byte
+		entry = appendString(entry, fieldKey, name)
+		entry = protowire.AppendTag(entry, fieldValue, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, values)
+		b = protowire.AppendTag(b, fieldHeader, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	b = appendString(b, fieldBody, d.ReqBody)
+	b = appendString(b, fieldBodyRef, d.ReqBodyRef)
+	b = appendString(b, fieldBodyEncoding, d.ReqBodyEncoding)
+	b = appendTimestamp(b, fieldExpiresAt, d.ExpiresAt)
+	b = appendString(b, fieldTraceParent, d.TraceParent)
+	b = appendTimestamp(b, fieldEnqueuedAt, d.EnqueuedAt)
+	b = appendString(b, fieldSealed, d.Sealed)
+	b = appendTimestamp(b, fieldDeadline, d.Deadline)
+	return b
+}
+
+// appendTimestamp appends a google.protobuf.Timestamp field, omitted when
+// nil.
+func appendTimestamp(b []byte, num protowire.Number, t *time.Time) []byte {
+	if t == nil {
+		return b
+	}
+	var ts []byte
+	ts = protowire.AppendTag(ts, fieldSeconds, protowire.VarintType)
+	ts = protowire.AppendVarint(ts, uint64(t.Unix()))
+	ts = protowire.AppendTag(ts, fieldNanos, protowire.VarintType)
+	ts = protowire.AppendVarint(ts, uint64(t.Nanosecond()))
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, ts)
+}
+
+// appendString appends a string field, omitted when empty as in proto3.
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func unmarshalProto(b []byte) (*Data, error) {
+	if b[0] != protoVersion {
+		return nil, fmt.Errorf("unsupported protobuf record version %d", b[0])
+	}
+	d := &Data{}
+	err := consumeFields(b[1:], func(num protowire.Number, typ protowire.Type, v []byte) error {
+		// Every field of Request is length-delimited.
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case fieldID:
+			d.ID = string(v)
+		case fieldURL:
+			d.ReqURL = string(v)
+		case fieldMethod:
+			d.ReqMethod = string(v)
+		case fieldHeader:
+			name, values, err := unmarshalHeader(v)
+			if err != nil {
+				return err
+			}
+			if d.ReqHeader == nil {
+				d.ReqHeader = make(map[string][]string)
+			}
+			d.ReqHeader[name] = values
+		case fieldBody:
+			d.ReqBody = string(v)
+		case fieldBodyRef:
+			d.ReqBodyRef = string(v)
+		case fieldBodyEncoding:
+			d.ReqBodyEncoding = string(v)
+		case fieldExpiresAt:
+			t, err := unmarshalTimestamp(v)
+			if err != nil {
+				return err
+			}
+			d.ExpiresAt = &t
+		case fieldTraceParent:
+			d.TraceParent = string(v)
+		case fieldEnqueuedAt:
+			t, err := unmarshalTimestamp(v)
+			if err != nil {
+				return err
+			}
+			d.EnqueuedAt = &t
+		case fieldSealed:
+			d.Sealed = string(v)
+		case fieldDeadline:
+			t, err := unmarshalTimestamp(v)
+			if err != nil {
+				return err
+			}
+			d.Deadline = &t
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling protobuf record: %w", err)
+	}
+	return d, nil
+}
+
+func unmarshalHeader(b []byte) (string, []string, error) {
+	var name string
+	var values []string
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case fieldKey:
+			name = string(v)
+		case fieldValue:
+			return consumeFields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				if num == fieldValues && typ == protowire.BytesType {
+					values = append(values, string(v))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return name, values, err
+}
+
+func unmarshalTimestamp(b []byte) (time.Time, error) {
+	var seconds, nanos int64
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if typ != protowire.VarintType {
+			return nil
+		}
+		n, _ := protowire.ConsumeVarint(v)
+		switch num {
+		case fieldSeconds:
+			seconds = int64(n)
+		case fieldNanos:
+			nanos = int64(int32(n))
+		}
+		return nil
+	})
+	return time.Unix(seconds, nanos).UTC(), err
+}
+
+// consumeFields calls fn with every field of the message b. v is the content
+// of length-delimited fields and the raw value of the others. Fields fn
+// doesn't know are ignored, so newer records can be read.
+func consumeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		v := b
+		if typ == protowire.BytesType {
+			v, n = protowire.ConsumeBytes(b)
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if typ != protowire.BytesType {
+			v = b[:n]
+		}
+		if err := fn(num, typ, v); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
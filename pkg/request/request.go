@@ -0,0 +1,122 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package request defines the records of asynchronous requests the producer
+// writes to the queue and the consumer reads from it.
+package request
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Formats of the records written to the queue. Unmarshal reads all of them.
+const (
+	// FormatCloudEvents stores requests as structured CloudEvents.
+	FormatCloudEvents = "cloudevents"
+	// FormatJSON stores requests as the JSON document of Data.
+	FormatJSON = "json"
+	// FormatProtobuf stores requests in the versioned protobuf schema of
+	// request.proto.
+	FormatProtobuf = "protobuf"
+)
+
+// Data is an asynchronous request.
+type Data struct {
+	ID         string `json:"id,omitempty"`
+	ReqURL     string `json:"url"`
+	ReqBody    string `json:"body"`
+	ReqBodyRef string `json:"bodyRef,omitempty"`
+	// ReqBodyEncoding is the compression of ReqBody, if any.
+	ReqBodyEncoding string              `json:"bodyEncoding,omitempty"`
+	ReqHeader       map[string][]string `json:"header"`
+	ReqMethod       string              `json:"method"`
+	ExpiresAt       *time.Time          `json:"expiresAt,omitempty"`
+	// Deadline is the time set by the caller after which the request is
+	// not delivered anymore.
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// TraceParent is the W3C traceparent of the span that enqueued the
+	// request, from which the consumer continues the trace.
+	TraceParent string `json:"traceparent,omitempty"`
+	// EnqueuedAt is the time the request was written to the queue.
+	EnqueuedAt *time.Time `json:"enqueuedAt,omitempty"`
+	// Sealed holds the body and headers of the request when they are
+	// encrypted, see the encryption package.
+	Sealed string `json:"sealed,omitempty"`
+}
+
+// CheckFormat returns an error unless format is a known record format.
+func CheckFormat(format string) error {
+	switch format {
+	case FormatCloudEvents, FormatJSON, FormatProtobuf:
+		return nil
+	default:
+		return fmt.Errorf("unknown record format %q", format)
+	}
+}
+
+// Marshal returns the record of d in the given format, FormatCloudEvents if
+// empty. t is the time the request was received.
+func Marshal(d Data, format string, t time.Time) ([]byte, error) {
+	switch format {
+	case FormatCloudEvents, "":
+		return marshalEvent(d, t)
+	case FormatJSON:
+		return json.Marshal(d)
+	case FormatProtobuf:
+		return marshalProto(d), nil
+	default:
+		return nil, fmt.Errorf("unknown record format %q", format)
+	}
+}
+
+// Unmarshal returns the request stored in a record of any format.
+func Unmarshal(b []byte) (*Data, error) {
+	format, err := FormatOf(b)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatProtobuf:
+		return unmarshalProto(b)
+	case FormatCloudEvents:
+		return unmarshalEvent(b)
+	}
+	d := &Data{}
+	if err := json.Unmarshal(b, d); err != nil {
+		return nil, fmt.Errorf("error unmarshalling json: %w", err)
+	}
+	return d, nil
+}
+
+// FormatOf returns the format of a record, so it can be written again in the
+// same format.
+func FormatOf(b []byte) (string, error) {
+	if len(b) > 0 && b[0] < ' ' && b[0] != '\t' && b[0] != '\n' && b[0] != '\r' {
+		// JSON documents start with whitespace or a brace, protobuf records
+		// with their schema version.
+		return FormatProtobuf, nil
+	}
+	// Structured CloudEvents have a specversion, Data documents don't.
+	var version struct {
+		SpecVersion string `json:"specversion"`
+	}
+	if err := json.Unmarshal(b, &version); err != nil {
+		return "", fmt.Errorf("error unmarshalling json: %w", err)
+	}
+	if version.SpecVersion != "" {
+		return FormatCloudEvents, nil
+	}
+	return FormatJSON, nil
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package request
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/encoding/protowire"
+	"knative.dev/async-component/pkg/queue"
+)
+
+func testData() Data {
+	expires := time.Date(2021, 7, 1, 13, 0, 0, 500, time.UTC)
+	enqueued := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	deadline := time.Date(2021, 7, 1, 12, 30, 0, 0, time.UTC)
+	return Data{
+		ID:              "123",
+		ReqURL:          "http://hello.default.svc.cluster.local/",
+		ReqBody:         "body \xff with invalid UTF-8",
+		ReqBodyRef:      "s3://bucket/123",
+		ReqBodyEncoding: "zstd",
+		ReqHeader:       map[string][]string{"Content-Type": {"text/plain"}, "X-Multi": {"a", "b"}},
+		ReqMethod:       "POST",
+		ExpiresAt:       &expires,
+		Deadline:        &deadline,
+		TraceParent:     "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		EnqueuedAt:      &enqueued,
+		Sealed:          "key1:a2V5:Ym9keQ==",
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	at := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	for _, format := range []string{FormatCloudEvents, FormatJSON, FormatProtobuf} {
+		t.Run(format, func(t *testing.T) {
+			want := testData()
+			if format != FormatProtobuf {
+				// JSON strings can only hold UTF-8.
+				want.ReqBody = "body"
+			}
+			b, err := Marshal(want, format, at)
+			if err != nil {
+				t.Fatal("Marshal() =", err)
+			}
+			got, err := Unmarshal(b)
+			if err != nil {
+				t.Fatal("Unmarshal() =", err)
+			}
+			if diff := cmp.Diff(&want, got); diff != "" {
+				t.Error("Unmarshal() (-want, +got):", diff)
+			}
+			if got, err := FormatOf(b); err != nil || got != format {
+				t.Errorf("FormatOf() = %q, %v, want %q", got, err, format)
+			}
+		})
+	}
+}
+
+func TestMarshalEvent(t *testing.T) {
+	at := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	b, err := Marshal(testData(), FormatCloudEvents, at)
+	if err != nil {
+		t.Fatal("Marshal() =", err)
+	}
+	event := cloudevents.NewEvent()
+	if err := json.Unmarshal(b, &event); err != nil {
+		t.Fatal("record is not a structured CloudEvent:", err)
+	}
+	if err := event.Validate(); err != nil {
+		t.Error("invalid CloudEvent:", err)
+	}
+	if event.ID() != "123" || event.Type() != queue.RequestEventType || !event.Time().Equal(at) {
+		t.Errorf("event = %s", event)
+	}
+	var payload map[string]interface{}
+	json.Unmarshal(event.Data(), &payload)
+	if _, ok := payload["id"]; ok {
+		t.Error("event data repeats the request ID")
+	}
+}
+
+func TestProtoSize(t *testing.T) {
+	d := testData()
+	d.ReqBody = "body"
+	j, _ := Marshal(d, FormatJSON, time.Time{})
+	p, _ := Marshal(d, FormatProtobuf, time.Time{})
+	if len(p) >= len(j) {
+		t.Errorf("protobuf record has %d bytes, json %d", len(p), len(j))
+	}
+}
+
+func TestUnmarshalProtoUnknownFields(t *testing.T) {
+	b := marshalProto(Data{ID: "123"})
+	// A field added by a newer producer.
+	b = protowire.AppendTag(b, 100, protowire.VarintType)
+	b = protowire.AppendVarint(b, 42)
+	b = appendString(b, fieldURL, "http://hello.default.svc.cluster.local/")
+	got, err := Unmarshal(b)
+	if err != nil {
+		t.Fatal("Unmarshal() =", err)
+	}
+	if got.ID != "123" || got.ReqURL != "http://hello.default.svc.cluster.local/" {
+		t.Errorf("Unmarshal() = %+v", got)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		record []byte
+	}{{
+		name:   "not json",
+		record: []byte("{"),
+	}, {
+		name:   "unknown protobuf version",
+		record: []byte{2},
+	}, {
+		name:   "truncated protobuf",
+		record: append([]byte{protoVersion}, marshalProto(Data{ID: "123"})[1:3]...),
+	}, {
+		name: "invalid expiry extension",
+		record: []byte(`{"specversion":"1.0","id":"123","type":"dev.knative.async.request","source":"knative.dev/async-component/producer",` +
+			`"expiresat":"tomorrow","datacontenttype":"application/json","data":{}}`),
+	}, {
+		name: "invalid deadline extension",
+		record: []byte(`{"specversion":"1.0","id":"123","type":"dev.knative.async.request","source":"knative.dev/async-component/producer",` +
+			`"deadline":"soon","datacontenttype":"application/json","data":{}}`),
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Unmarshal(test.record); err == nil {
+				t.Error("Unmarshal() succeeded")
+			}
+		})
+	}
+}
+
+func TestCheckFormat(t *testing.T) {
+	for _, format := range []string{FormatCloudEvents, FormatJSON, FormatProtobuf} {
+		if err := CheckFormat(format); err != nil {
+			t.Errorf("CheckFormat(%q) = %v", format, err)
+		}
+	}
+	if err := CheckFormat("msgpack"); err == nil {
+		t.Error("CheckFormat() of an unknown format succeeded")
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package routing picks the queue asynchronous requests are written to, so
+// workloads with different latency or size profiles can be isolated.
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"knative.dev/async-component/pkg/headers"
+	"knative.dev/async-component/pkg/queue"
+)
+
+// RoutingConfig holds the routing rules, as a JSON list of Rule. Requests
+// are written to the configured queue when it is empty.
+type RoutingConfig struct {
+	RoutingRules string `envconfig:"ROUTING_RULES"`
+}
+
+// Rule routes the requests matching all of its conditions to the queue of
+// Route. Conditions that are not set match every request.
+type Rule struct {
+	// Route is the name of the queue, see queue.WithRoute.
+	Route string `json:"route"`
+	// Host is the host of the service, or a suffix of it when it starts
+	// with "*.", such as "*.batch.svc.cluster.local" for a namespace.
+	Host string `json:"host,omitempty"`
+	// PathPrefix is a prefix of the request path.
+	PathPrefix string `json:"pathPrefix,omitempty"`
+	// Headers are header values the request must have.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Router routes requests by the first rule they match.
+type Router struct {
+	rules []Rule
+}
+
+// New returns the Router described by cfg, or nil if there are no rules.
+func New(cfg RoutingConfig) (*Router, error) {
+	if cfg.RoutingRules == "" {
+		return nil, nil
+	}
+	var rules []Rule
+	if err := json.Unmarshal([]byte(cfg.RoutingRules), &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse ROUTING_RULES: %w", err)
+	}
+	for i, rule := range rules {
+		if err := queue.CheckRoute(rule.Route); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return &Router{rules: rules}, nil
+}
+
+// Routes returns the names of the routes of the rules.
+func (rt *Router) Routes() []string {
+	seen := make(map[string]bool)
+	var routes []string
+	for _, rule := range rt.rules {
+		if !seen[rule.Route] {
+			seen[rule.Route] = true
+			routes = append(routes, rule.Route)
+		}
+	}
+	return routes
+}
+
+// Route returns the route of r, or "" if it matches no rule.
+func (rt *Router) Route(r *http.Request) string {
+	for _, rule := range rt.rules {
+		if rule.matches(r) {
+			return rule.Route
+		}
+	}
+	return ""
+}
+
+func (rule Rule) matches(r *http.Request) bool {
+	host := r.Header.Get(headers.OriginalHost)
+	if strings.HasPrefix(rule.Host, "*.") {
+		if !strings.HasSuffix(host, rule.Host[1:]) {
+			return false
+		}
+	} else if rule.Host != "" && !strings.EqualFold(host, rule.Host) {
+		return false
+	}
+	if !strings.HasPrefix(r.URL.Path, rule.PathPrefix) {
+		return false
+	}
+	for name, value := range rule.Headers {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
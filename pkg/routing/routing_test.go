@@ -0,0 +1,100 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package routing
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"knative.dev/async-component/pkg/headers"
+)
+
+const rules = `[
+	{"route": "uploads", "pathPrefix": "/upload", "headers": {"Content-Type": "application/octet-stream"}},
+	{"route": "batch", "host": "*.batch.svc.cluster.local"},
+	{"route": "reports", "host": "reports.default.svc.cluster.local"},
+	{"route": "batch", "headers": {"Async-Workload": "batch"}}
+]`
+
+func TestRoute(t *testing.T) {
+	rt, err := New(RoutingConfig{RoutingRules: rules})
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	if got, want := rt.Routes(), []string{"uploads", "batch", "reports"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Routes() = %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		name    string
+		host    string
+		path    string
+		headers map[string]string
+		want    string
+	}{{
+		name:    "path prefix and header",
+		host:    "files.default.svc.cluster.local",
+		path:    "/upload/a",
+		headers: map[string]string{"Content-Type": "application/octet-stream"},
+		want:    "uploads",
+	}, {
+		name: "path prefix without the header",
+		host: "files.default.svc.cluster.local",
+		path: "/upload/a",
+	}, {
+		name: "host wildcard",
+		host: "etl.batch.svc.cluster.local",
+		path: "/",
+		want: "batch",
+	}, {
+		name: "exact host",
+		host: "reports.default.svc.cluster.local",
+		path: "/",
+		want: "reports",
+	}, {
+		name:    "header",
+		host:    "files.default.svc.cluster.local",
+		path:    "/",
+		headers: map[string]string{"Async-Workload": "batch"},
+		want:    "batch",
+	}, {
+		name: "no match",
+		host: "files.default.svc.cluster.local",
+		path: "/",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", test.path, nil)
+			r.Header.Set(headers.OriginalHost, test.host)
+			for k, v := range test.headers {
+				r.Header.Set(k, v)
+			}
+			if got := rt.Route(r); got != test.want {
+				t.Errorf("Route() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	if rt, err := New(RoutingConfig{}); rt != nil || err != nil {
+		t.Errorf("New() = %v, %v, want routing disabled", rt, err)
+	}
+	for _, rules := range []string{`{`, `[{"host": "a"}]`, `[{"route": "Bad Name"}]`, `[{"route": "dlq"}]`} {
+		if _, err := New(RoutingConfig{RoutingRules: rules}); err == nil {
+			t.Errorf("New(%q) succeeded", rules)
+		}
+	}
+}
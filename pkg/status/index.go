@@ -0,0 +1,93 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrSearchNotSupported is returned by Search for the stores that do not
+// index requests.
+var ErrSearchNotSupported = errors.New("the status store does not index requests")
+
+// IndexEntry describes a request when it is submitted, so it can be found
+// by its attributes.
+type IndexEntry struct {
+	ID string `json:"id"`
+	// Target is the host of the service the request is sent to.
+	Target string `json:"target,omitempty"`
+	// Subject is the caller that submitted the request, when it was
+	// authorized.
+	Subject   string    `json:"subject,omitempty"`
+	Submitted time.Time `json:"submitted"`
+}
+
+// Query selects the indexed requests. The empty fields match all of them.
+type Query struct {
+	Target  string
+	Subject string
+	// State matches the current state of the requests.
+	State State
+	// From and To bound the time the requests were submitted, To being
+	// excluded.
+	From time.Time
+	To   time.Time
+	// Limit is the most requests returned, all of them when it is zero.
+	Limit int
+}
+
+// matches reports whether e and s match q.
+func (q Query) matches(e IndexEntry, s Status) bool {
+	return (q.Target == "" || e.Target == q.Target) &&
+		(q.Subject == "" || e.Subject == q.Subject) &&
+		(q.State == "" || s.State == q.State) &&
+		(q.From.IsZero() || !e.Submitted.Before(q.From)) &&
+		(q.To.IsZero() || e.Submitted.Before(q.To))
+}
+
+// Match is a request found by Search, with its current status.
+type Match struct {
+	IndexEntry
+	Status Status `json:"status"`
+}
+
+// Indexer is implemented by the stores indexing requests by their
+// attributes. Entries expire with the statuses of the requests.
+type Indexer interface {
+	// Index records e. The status of the request is written separately
+	// with Set.
+	Index(ctx context.Context, e IndexEntry) error
+	// Search returns the requests matching q that still have a status,
+	// the most recently submitted first.
+	Search(ctx context.Context, q Query) ([]Match, error)
+}
+
+// Index records e in s if it indexes requests, and does nothing otherwise.
+func Index(ctx context.Context, s Store, e IndexEntry) error {
+	if i, ok := s.(Indexer); ok {
+		return i.Index(ctx, e)
+	}
+	return nil
+}
+
+// Search returns the requests of s matching q, or ErrSearchNotSupported if
+// s does not index requests.
+func Search(ctx context.Context, s Store, q Query) ([]Match, error) {
+	if i, ok := s.(Indexer); ok {
+		return i.Search(ctx, q)
+	}
+	return nil, ErrSearchNotSupported
+}
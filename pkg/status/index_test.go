@@ -0,0 +1,133 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	m := NewMemory()
+	for i, e := range []IndexEntry{
+		{ID: "1", Target: "orders.default.svc", Subject: "alice"},
+		{ID: "2", Target: "orders.default.svc", Subject: "bob"},
+		{ID: "3", Target: "billing.default.svc", Subject: "alice"},
+		{ID: "expired", Target: "orders.default.svc", Subject: "alice"},
+	} {
+		e.Submitted = now.Add(time.Duration(i) * time.Minute)
+		if err := Index(ctx, m, e); err != nil {
+			t.Fatal("Index() =", err)
+		}
+		if e.ID == "expired" {
+			continue
+		}
+		state := Pending
+		if e.ID == "2" {
+			state = Succeeded
+		}
+		if err := m.Set(ctx, Status{ID: e.ID, State: state, Updated: e.Submitted}); err != nil {
+			t.Fatal("Set() =", err)
+		}
+	}
+	tests := []struct {
+		name  string
+		query Query
+		want  []string
+	}{{
+		name: "all",
+		want: []string{"3", "2", "1"},
+	}, {
+		name:  "target",
+		query: Query{Target: "orders.default.svc"},
+		want:  []string{"2", "1"},
+	}, {
+		name:  "subject",
+		query: Query{Subject: "alice"},
+		want:  []string{"3", "1"},
+	}, {
+		name:  "state",
+		query: Query{Target: "orders.default.svc", State: Pending},
+		want:  []string{"1"},
+	}, {
+		name:  "time range",
+		query: Query{From: now.Add(time.Minute), To: now.Add(2 * time.Minute)},
+		want:  []string{"2"},
+	}, {
+		name:  "limit",
+		query: Query{Limit: 2},
+		want:  []string{"3", "2"},
+	}, {
+		name:  "no match",
+		query: Query{Target: "unknown"},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matches, err := Search(ctx, m, test.query)
+			if err != nil {
+				t.Fatal("Search() =", err)
+			}
+			var got []string
+			for _, m := range matches {
+				got = append(got, m.ID)
+				if m.Status.ID != m.ID {
+					t.Errorf("Status of %s = %+v", m.ID, m.Status)
+				}
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("Search() = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	if _, err := m.DeleteExpired(ctx, now.Add(time.Hour)); err != nil {
+		t.Fatal("DeleteExpired() =", err)
+	}
+	if len(m.index) != 0 {
+		t.Errorf("index = %v after DeleteExpired(), want it empty", m.index)
+	}
+}
+
+func TestSearchNotSupported(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newFakeResources(StoreConfig{}, nil)
+	if err := Index(ctx, s, IndexEntry{ID: "123"}); err != nil {
+		t.Error("Index() =", err)
+	}
+	if _, err := Search(ctx, s, Query{}); !errors.Is(err, ErrSearchNotSupported) {
+		t.Errorf("Search() = %v, want %v", err, ErrSearchNotSupported)
+	}
+}
+
+func TestResourcesSearch(t *testing.T) {
+	ctx := context.Background()
+	next := NewMemory()
+	s, _ := newFakeResources(StoreConfig{AsyncRequestSampleRate: 1}, next)
+	if err := Index(ctx, s, IndexEntry{ID: "123", Target: "orders.default.svc"}); err != nil {
+		t.Fatal("Index() =", err)
+	}
+	if err := s.Set(ctx, Status{ID: "123", State: Pending}); err != nil {
+		t.Fatal("Set() =", err)
+	}
+	got, err := Search(ctx, s, Query{Target: "orders.default.svc"})
+	if err != nil || len(got) != 1 || got[0].ID != "123" {
+		t.Errorf("Search() = %+v, %v, want request 123", got, err)
+	}
+}
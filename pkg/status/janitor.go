@@ -0,0 +1,57 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+	"knative.dev/pkg/logging"
+)
+
+// Collector is implemented by the stores whose statuses do not expire by
+// themselves, so they are deleted by the janitor of the consumer.
+type Collector interface {
+	// DeleteExpired deletes the statuses, and their results, last updated
+	// before cutoff, and returns how many were deleted.
+	DeleteExpired(ctx context.Context, cutoff time.Time) (int, error)
+}
+
+// RunJanitor deletes the statuses of s last updated more than ttl ago every
+// interval until ctx is done. It returns at once if s does not implement
+// Collector, or ttl or interval is not positive.
+func RunJanitor(ctx context.Context, s Store, ttl, interval time.Duration) {
+	c, ok := s.(Collector)
+	if !ok || ttl <= 0 || interval <= 0 {
+		return
+	}
+	logger := logging.FromContext(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := c.DeleteExpired(ctx, now.Add(-ttl))
+			if err != nil {
+				logger.Errorw("Error deleting expired request statuses", zap.Error(err))
+			}
+			if n > 0 {
+				logger.Infow("Deleted expired request statuses", zap.Int("count", n))
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	logtesting "knative.dev/pkg/logging/testing"
+)
+
+func TestRunJanitor(t *testing.T) {
+	ctx, cancel := context.WithCancel(logtesting.TestContextWithLogger(t))
+	m := NewMemory()
+	now := time.Now()
+	m.Set(ctx, Status{ID: "old", State: Succeeded, Updated: now.Add(-2 * time.Hour), Result: &Result{Body: "done"}})
+	m.Set(ctx, Status{ID: "new", State: Pending, Updated: now})
+
+	done := make(chan struct{})
+	go func() {
+		RunJanitor(ctx, m, time.Hour, 10*time.Millisecond)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := m.Get(ctx, "old"); errors.Is(err, ErrNotFound) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The expired status was not deleted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := m.Get(ctx, "new"); err != nil {
+		t.Error("Get() =", err)
+	}
+	cancel()
+	<-done
+}
+
+func TestRunJanitorNoCollector(t *testing.T) {
+	// Redis expires the statuses by itself, the janitor returns at once.
+	r := &Redis{}
+	RunJanitor(context.Background(), r, time.Hour, time.Minute)
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory is a process-local Store for development and tests, to be used
+// with the memory queue backend. Statuses are kept until they are deleted
+// by the janitor.
+type Memory struct {
+	mu       sync.RWMutex
+	statuses map[string]Status
+	index    map[string]IndexEntry
+}
+
+var (
+	_ Store     = (*Memory)(nil)
+	_ Collector = (*Memory)(nil)
+	_ Indexer   = (*Memory)(nil)
+)
+
+// NewMemory returns an empty Memory store.
+func NewMemory() *Memory {
+	return &Memory{statuses: make(map[string]Status), index: make(map[string]IndexEntry)}
+}
+
+// Set implements Store.
+func (m *Memory) Set(ctx context.Context, s Status) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.statuses[s.ID] = s
+	return nil
+}
+
+// Get implements Store.
+func (m *Memory) Get(ctx context.Context, id string) (Status, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.statuses[id]
+	if !ok {
+		return Status{}, ErrNotFound
+	}
+	return s, nil
+}
+
+// Index implements Indexer.
+func (m *Memory) Index(ctx context.Context, e IndexEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.index[e.ID] = e
+	return nil
+}
+
+// Search implements Indexer.
+func (m *Memory) Search(ctx context.Context, q Query) ([]Match, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var matches []Match
+	for id, e := range m.index {
+		s, ok := m.statuses[id]
+		if ok && q.matches(e, s) {
+			matches = append(matches, Match{IndexEntry: e, Status: s})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Submitted.After(matches[j].Submitted)
+	})
+	if q.Limit > 0 && len(matches) > q.Limit {
+		matches = matches[:q.Limit]
+	}
+	return matches, nil
+}
+
+// DeleteExpired implements Collector. The index entries of the deleted
+// statuses are deleted as well.
+func (m *Memory) DeleteExpired(ctx context.Context, cutoff time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for id, s := range m.statuses {
+		if s.Updated.Before(cutoff) {
+			delete(m.statuses, id)
+			delete(m.index, id)
+			n++
+		}
+	}
+	for id, e := range m.index {
+		if _, ok := m.statuses[id]; !ok && e.Submitted.Before(cutoff) {
+			delete(m.index, id)
+		}
+	}
+	return n, nil
+}
+
+// Close implements Store.
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"knative.dev/async-component/pkg/queue"
+)
+
+const (
+	// Prefix of the Redis keys holding request status.
+	redisKeyPrefix = "async-status:"
+	// Keys of the sorted sets indexing requests, scored by the time they
+	// were submitted in milliseconds, with the JSON of their IndexEntry as
+	// members. Each request is in the set of all the requests, and in the
+	// sets of its target and subject.
+	redisIndexKey        = "async-index:all"
+	redisTargetKeyPrefix = "async-index:target:"
+	redisSubjectPrefix   = "async-index:subject:"
+	// Number of index entries read at once when searching.
+	redisSearchPage = 500
+)
+
+// Redis is a Store keeping each status as a JSON string that expires after
+// STATUS_TTL.
+type Redis struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+var (
+	_ Store   = (*Redis)(nil)
+	_ Indexer = (*Redis)(nil)
+)
+
+// NewRedis returns a Store keeping the statuses for STATUS_TTL in Redis,
+// connected to with queue.NewRedisClient.
+func NewRedis(cfg StoreConfig, redisCfg queue.RedisConfig) (*Redis, error) {
+	client, err := queue.NewRedisClient(redisCfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Redis{client: client, ttl: cfg.StatusTTL}, nil
+}
+
+// Set implements Store.
+func (r *Redis) Set(ctx context.Context, s Status) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to marshal status: %w", err)
+	}
+	if err := r.client.Set(ctx, redisKeyPrefix+s.ID, b, r.ttl).Err(); err != nil {
+		return fmt.Errorf("failed to write status of %q: %w", s.ID, err)
+	}
+	return nil
+}
+
+// Get implements Store.
+func (r *Redis) Get(ctx context.Context, id string) (Status, error) {
+	b, err := r.client.Get(ctx, redisKeyPrefix+id).Bytes()
+	if err == redis.Nil {
+		return Status{}, ErrNotFound
+	} else if err != nil {
+		return Status{}, fmt.Errorf("failed to read status of %q: %w", id, err)
+	}
+	var s Status
+	if err := json.Unmarshal(b, &s); err != nil {
+		return Status{}, fmt.Errorf("failed to unmarshal status of %q: %w", id, err)
+	}
+	return s, nil
+}
+
+// Index implements Indexer. The entries submitted more than STATUS_TTL ago
+// are trimmed from the sets e is added to, which expire when no request is
+// indexed for STATUS_TTL.
+func (r *Redis) Index(ctx context.Context, e IndexEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal index entry: %w", err)
+	}
+	keys := []string{redisIndexKey}
+	if e.Target != "" {
+		keys = append(keys, redisTargetKeyPrefix+e.Target)
+	}
+	if e.Subject != "" {
+		keys = append(keys, redisSubjectPrefix+e.Subject)
+	}
+	_, err = r.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, key := range keys {
+			p.ZAdd(ctx, key, &redis.Z{Score: float64(millis(e.Submitted)), Member: b})
+			if r.ttl > 0 {
+				p.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(millis(e.Submitted.Add(-r.ttl)), 10))
+				p.Expire(ctx, key, r.ttl)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to index %q: %w", e.ID, err)
+	}
+	return nil
+}
+
+// Search implements Indexer. It reads the most selective set of q, and
+// filters its entries with the rest of q and the status of the requests.
+func (r *Redis) Search(ctx context.Context, q Query) ([]Match, error) {
+	key := redisIndexKey
+	if q.Target != "" {
+		key = redisTargetKeyPrefix + q.Target
+	} else if q.Subject != "" {
+		key = redisSubjectPrefix + q.Subject
+	}
+	by := &redis.ZRangeBy{Min: "-inf", Max: "+inf", Count: redisSearchPage}
+	if !q.From.IsZero() {
+		by.Min = strconv.FormatInt(millis(q.From), 10)
+	}
+	if !q.To.IsZero() {
+		by.Max = "(" + strconv.FormatInt(millis(q.To), 10)
+	}
+	var matches []Match
+	for {
+		members, err := r.client.ZRevRangeByScore(ctx, key, by).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read index: %w", err)
+		}
+		page, err := r.matches(ctx, q, members)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, page...)
+		if q.Limit > 0 && len(matches) >= q.Limit {
+			return matches[:q.Limit], nil
+		}
+		if len(members) < redisSearchPage {
+			return matches, nil
+		}
+		by.Offset += redisSearchPage
+	}
+}
+
+// matches returns the requests of the index entries members that match q,
+// with their status.
+func (r *Redis) matches(ctx context.Context, q Query, members []string) ([]Match, error) {
+	var entries []IndexEntry
+	var keys []string
+	for _, m := range members {
+		var e IndexEntry
+		// Entries written by later versions may not be readable.
+		if err := json.Unmarshal([]byte(m), &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+		keys = append(keys, redisKeyPrefix+e.ID)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read statuses: %w", err)
+	}
+	var matches []Match
+	for i, v := range values {
+		b, ok := v.(string)
+		if !ok {
+			// The status expired.
+			continue
+		}
+		var s Status
+		if err := json.Unmarshal([]byte(b), &s); err != nil {
+			continue
+		}
+		if q.matches(entries[i], s) {
+			matches = append(matches, Match{IndexEntry: entries[i], Status: s})
+		}
+	}
+	return matches, nil
+}
+
+// millis returns t in milliseconds since the epoch.
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Close implements Store.
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,261 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"go.uber.org/zap"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"knative.dev/pkg/logging"
+)
+
+// AsyncRequestResource is the resource of the AsyncRequest custom resources
+// mirroring the status of requests, see config/async/300-asyncrequest.yaml.
+var AsyncRequestResource = schema.GroupVersionResource{Group: "async.knative.dev", Version: "v1alpha1", Resource: "asyncrequests"}
+
+// Phases of AsyncRequest resources, for each State.
+var phases = map[State]string{
+	Pending:   "Pending",
+	InFlight:  "Delivering",
+	Succeeded: "Succeeded",
+	Failed:    "Failed",
+	Cancelled: "Cancelled",
+	Expired:   "Expired",
+}
+
+// Resources is a Store mirroring the status of a sample of the requests to
+// AsyncRequest resources, so they can be followed with kubectl. It wraps
+// the store of the status backend, if any, which holds the status of every
+// request and their results.
+type Resources struct {
+	next   Store
+	client dynamic.ResourceInterface
+	rate   float64
+}
+
+var (
+	_ Store     = (*Resources)(nil)
+	_ Collector = (*Resources)(nil)
+	_ Indexer   = (*Resources)(nil)
+)
+
+// resourceStatus is the status of an AsyncRequest resource.
+type resourceStatus struct {
+	Phase      string    `json:"phase"`
+	Host       string    `json:"host,omitempty"`
+	Attempts   int       `json:"attempts,omitempty"`
+	LastError  string    `json:"lastError,omitempty"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Updated    time.Time `json:"updated"`
+}
+
+// newResources wraps next, which may be nil, with the AsyncRequest
+// resources of the namespace set in cfg, using the in-cluster config.
+func newResources(cfg StoreConfig, next Store) (*Resources, error) {
+	rc, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get in-cluster config: %w", err)
+	}
+	client, err := dynamic.NewForConfig(rc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dynamic client: %w", err)
+	}
+	return NewResources(client, cfg, next), nil
+}
+
+// NewResources returns a Store writing the AsyncRequest resources of the
+// namespace set in cfg with client, in front of next, which may be nil.
+func NewResources(client dynamic.Interface, cfg StoreConfig, next Store) *Resources {
+	return &Resources{
+		next:   next,
+		client: client.Resource(AsyncRequestResource).Namespace(cfg.AsyncRequestNamespace),
+		rate:   cfg.AsyncRequestSampleRate,
+	}
+}
+
+// sampled reports whether request id has a resource. The decision only
+// depends on the ID, so the producer and the consumer agree on it.
+func (r *Resources) sampled(id string) bool {
+	if r.rate >= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return float64(h.Sum32()%10000) < r.rate*10000
+}
+
+// Set implements Store. Failures to write the resource are only logged
+// when the status is recorded by the status backend.
+func (r *Resources) Set(ctx context.Context, s Status) error {
+	if r.next != nil {
+		if err := r.next.Set(ctx, s); err != nil {
+			return err
+		}
+	}
+	if !r.sampled(s.ID) {
+		return nil
+	}
+	err := r.write(ctx, s)
+	if err != nil && r.next != nil {
+		logging.FromContext(ctx).Warnw("Error writing AsyncRequest resource", zap.String("id", s.ID), zap.Error(err))
+		return nil
+	}
+	return err
+}
+
+// write updates the status of the resource of s, creating it for the first
+// status of the request.
+func (r *Resources) write(ctx context.Context, s Status) error {
+	rs := resourceStatus{
+		Phase:      phases[s.State],
+		Host:       s.Host,
+		Attempts:   s.Attempts,
+		LastError:  s.Reason,
+		StatusCode: s.StatusCode,
+		Updated:    s.Updated.UTC(),
+	}
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": AsyncRequestResource.GroupVersion().String(),
+		"kind":       "AsyncRequest",
+		"metadata":   map[string]interface{}{"name": s.ID},
+	}}
+	b, err := json.Marshal(rs)
+	if err != nil {
+		return fmt.Errorf("failed to marshal status: %w", err)
+	}
+	var st map[string]interface{}
+	if err := json.Unmarshal(b, &st); err != nil {
+		return fmt.Errorf("failed to unmarshal status: %w", err)
+	}
+	obj.Object["status"] = st
+	patch := []byte(`{"status":` + string(b) + `}`)
+	_, err = r.client.Patch(ctx, s.ID, types.MergePatchType, patch, metav1.PatchOptions{})
+	if !apierrs.IsNotFound(err) {
+		return wrapResourceError(s.ID, err)
+	}
+	_, err = r.client.Create(ctx, obj, metav1.CreateOptions{})
+	if apierrs.IsAlreadyExists(err) {
+		// Created in the meantime by the other component.
+		_, err = r.client.Patch(ctx, s.ID, types.MergePatchType, patch, metav1.PatchOptions{})
+	}
+	return wrapResourceError(s.ID, err)
+}
+
+// wrapResourceError describes a failure to write the resource of request id.
+func wrapResourceError(id string, err error) error {
+	if err != nil {
+		return fmt.Errorf("failed to write AsyncRequest %q: %w", id, err)
+	}
+	return nil
+}
+
+// Get implements Store. The status is read from the status backend when
+// there is one, and from the resource of the request otherwise.
+func (r *Resources) Get(ctx context.Context, id string) (Status, error) {
+	if r.next != nil {
+		return r.next.Get(ctx, id)
+	}
+	obj, err := r.client.Get(ctx, id, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		return Status{}, ErrNotFound
+	} else if err != nil {
+		return Status{}, fmt.Errorf("failed to read AsyncRequest %q: %w", id, err)
+	}
+	rs, err := statusOf(obj)
+	if err != nil {
+		return Status{}, err
+	}
+	s := Status{ID: id, Host: rs.Host, Attempts: rs.Attempts, Reason: rs.LastError, StatusCode: rs.StatusCode, Updated: rs.Updated}
+	for state, phase := range phases {
+		if phase == rs.Phase {
+			s.State = state
+		}
+	}
+	return s, nil
+}
+
+// statusOf returns the status of an AsyncRequest resource.
+func statusOf(obj *unstructured.Unstructured) (resourceStatus, error) {
+	var rs resourceStatus
+	b, err := json.Marshal(obj.Object["status"])
+	if err != nil {
+		return rs, fmt.Errorf("failed to marshal status of AsyncRequest %q: %w", obj.GetName(), err)
+	}
+	if err := json.Unmarshal(b, &rs); err != nil {
+		return rs, fmt.Errorf("failed to unmarshal status of AsyncRequest %q: %w", obj.GetName(), err)
+	}
+	return rs, nil
+}
+
+// DeleteExpired implements Collector. The expired statuses of the status
+// backend are deleted as well when it does not expire them by itself.
+func (r *Resources) DeleteExpired(ctx context.Context, cutoff time.Time) (int, error) {
+	n := 0
+	if c, ok := r.next.(Collector); ok {
+		var err error
+		if n, err = c.DeleteExpired(ctx, cutoff); err != nil {
+			return n, err
+		}
+	}
+	list, err := r.client.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return n, fmt.Errorf("failed to list AsyncRequest resources: %w", err)
+	}
+	for i := range list.Items {
+		obj := &list.Items[i]
+		rs, err := statusOf(obj)
+		if err != nil || !rs.Updated.Before(cutoff) {
+			continue
+		}
+		// Several consumers may delete the same resource.
+		if err := r.client.Delete(ctx, obj.GetName(), metav1.DeleteOptions{}); apierrs.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return n, fmt.Errorf("failed to delete AsyncRequest %q: %w", obj.GetName(), err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Index implements Indexer, indexing e in the status backend when it
+// indexes requests.
+func (r *Resources) Index(ctx context.Context, e IndexEntry) error {
+	return Index(ctx, r.next, e)
+}
+
+// Search implements Indexer. Requests are only searched in the status
+// backend.
+func (r *Resources) Search(ctx context.Context, q Query) ([]Match, error) {
+	return Search(ctx, r.next, q)
+}
+
+// Close implements Store.
+func (r *Resources) Close() error {
+	if r.next != nil {
+		return r.next.Close()
+	}
+	return nil
+}
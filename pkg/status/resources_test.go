@@ -0,0 +1,133 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func newFakeResources(cfg StoreConfig, next Store) (*Resources, *dynamicfake.FakeDynamicClient) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{AsyncRequestResource: "AsyncRequestList"})
+	cfg.AsyncRequestNamespace = "knative-serving"
+	return NewResources(client, cfg, next), client
+}
+
+func TestResourcesSet(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, client := newFakeResources(StoreConfig{AsyncRequestSampleRate: 1}, nil)
+	now := time.Now().Truncate(time.Second)
+
+	for _, s := range []Status{
+		{ID: "123", State: Pending, Updated: now},
+		{ID: "123", State: InFlight, Updated: now},
+		{ID: "123", State: Failed, Attempts: 3, StatusCode: 503, Reason: "503 Service Unavailable", Updated: now},
+	} {
+		if err := r.Set(ctx, s); err != nil {
+			t.Fatal("Set() =", err)
+		}
+	}
+	obj, err := client.Resource(AsyncRequestResource).Namespace("knative-serving").Get(ctx, "123", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal("Error getting AsyncRequest:", err)
+	}
+	rs, err := statusOf(obj)
+	if err != nil {
+		t.Fatal("statusOf() =", err)
+	}
+	want := resourceStatus{Phase: "Failed", Attempts: 3, LastError: "503 Service Unavailable", StatusCode: 503, Updated: now.UTC()}
+	if !rs.Updated.Equal(want.Updated) {
+		t.Errorf("updated = %v, want %v", rs.Updated, want.Updated)
+	}
+	rs.Updated = want.Updated
+	if rs != want {
+		t.Errorf("AsyncRequest status = %+v, want %+v", rs, want)
+	}
+
+	got, err := r.Get(ctx, "123")
+	if err != nil {
+		t.Fatal("Get() =", err)
+	}
+	if got.State != Failed || got.Attempts != 3 || got.Reason != "503 Service Unavailable" {
+		t.Errorf("Get() = %+v, want the failed status", got)
+	}
+	if _, err := r.Get(ctx, "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() = %v, want ErrNotFound", err)
+	}
+}
+
+func TestResourcesSampled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	next := NewMemory()
+	r, client := newFakeResources(StoreConfig{AsyncRequestSampleRate: 0.25}, next)
+
+	for i := 0; i < 1000; i++ {
+		if err := r.Set(ctx, Status{ID: fmt.Sprint("id-", i), State: Pending, Updated: time.Now()}); err != nil {
+			t.Fatal("Set() =", err)
+		}
+	}
+	list, err := client.Resource(AsyncRequestResource).Namespace("knative-serving").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal("Error listing AsyncRequests:", err)
+	}
+	if n := len(list.Items); n < 150 || n > 350 {
+		t.Errorf("got %d AsyncRequests for 1000 requests, want about 250", n)
+	}
+	// Every status is kept by the status backend.
+	if _, err := r.Get(ctx, "id-0"); err != nil {
+		t.Error("Get() =", err)
+	}
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprint("id-", i)
+		if r.sampled(id) != r.sampled(id) {
+			t.Fatalf("sampled(%q) is not stable", id)
+		}
+	}
+}
+
+func TestResourcesDeleteExpired(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	next := NewMemory()
+	r, client := newFakeResources(StoreConfig{AsyncRequestSampleRate: 1}, next)
+	now := time.Now()
+	r.Set(ctx, Status{ID: "old", State: Succeeded, Updated: now.Add(-2 * time.Hour)})
+	r.Set(ctx, Status{ID: "new", State: Pending, Updated: now.Add(-time.Minute)})
+
+	// The status and the resource of the old request are deleted.
+	if n, err := r.DeleteExpired(ctx, now.Add(-time.Hour)); err != nil || n != 2 {
+		t.Fatalf("DeleteExpired() = %d, %v, want 2 deleted", n, err)
+	}
+	if _, err := next.Get(ctx, "old"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() = %v, want the expired status deleted", err)
+	}
+	list, err := client.Resource(AsyncRequestResource).Namespace("knative-serving").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal("Error listing AsyncRequests:", err)
+	}
+	if len(list.Items) != 1 || list.Items[0].GetName() != "new" {
+		t.Errorf("AsyncRequests after deleting expired ones = %v, want new", list.Items)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package status tracks the processing state of async requests. The producer
+// and consumer write it and the producer serves it to callers polling the
+// Location returned with the 202 response.
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"knative.dev/async-component/pkg/queue"
+)
+
+const (
+	// BackendRedis stores status in Redis, using the queue's Redis settings.
+	BackendRedis = "redis"
+	// BackendMemory stores status in the memory of the process.
+	BackendMemory = "memory"
+)
+
+// State is the processing state of a request.
+type State string
+
+const (
+	// Pending requests are queued and waiting for the consumer.
+	Pending State = "pending"
+	// InFlight requests are being delivered to the service.
+	InFlight State = "in-flight"
+	// Succeeded requests got a successful response from the service.
+	Succeeded State = "succeeded"
+	// Failed requests got an error response or could not be delivered.
+	Failed State = "failed"
+	// Cancelled requests were cancelled by the caller before being
+	// delivered.
+	Cancelled State = "cancelled"
+	// Expired requests were read by the consumer after their deadline and
+	// not delivered.
+	Expired State = "expired"
+)
+
+// ErrNotFound is returned by Get for unknown or expired requests.
+var ErrNotFound = errors.New("request status not found")
+
+// Status is the processing status of a single request.
+type Status struct {
+	ID         string    `json:"id"`
+	State      State     `json:"state"`
+	StatusCode int       `json:"status,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Updated    time.Time `json:"updated"`
+	// Host is the cluster-local host of the service the request was sent
+	// to. Its status is only shown to the callers of that service.
+	Host string `json:"host,omitempty"`
+	// Attempts is the number of times the request was sent to the service.
+	Attempts int `json:"attempts,omitempty"`
+	// Result is the response of the service, once there is one and when
+	// results are stored.
+	Result *Result `json:"result,omitempty"`
+}
+
+// Result is the response of the service to a request.
+type Result struct {
+	Header map[string][]string `json:"header,omitempty"`
+	Body   string              `json:"body,omitempty"`
+	// Truncated reports that Body was cut at RESULT_BODY_LIMIT bytes.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Store is the interface implemented by status storage backends.
+type Store interface {
+	// Set records s, replacing the previous status of the request.
+	Set(ctx context.Context, s Status) error
+	// Get returns the status of request id, or ErrNotFound.
+	Get(ctx context.Context, id string) (Status, error)
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// StoreConfig selects and configures a status store. Status tracking is
+// disabled when no backend is set. It is meant to be embedded in a
+// component's envconfig struct next to queue.Config.
+type StoreConfig struct {
+	StatusBackend string        `envconfig:"STATUS_BACKEND"`
+	StatusTTL     time.Duration `envconfig:"STATUS_TTL" default:"24h"`
+	// StatusCollectInterval is how often the janitor of the consumer deletes
+	// the statuses older than STATUS_TTL from the stores that do not expire
+	// them by themselves.
+	StatusCollectInterval time.Duration `envconfig:"STATUS_COLLECT_INTERVAL" default:"10m"`
+	// ResultBodyLimit is the number of bytes of the response body the
+	// consumer stores with the status. Results are not stored when it is
+	// zero.
+	ResultBodyLimit int64 `envconfig:"RESULT_BODY_LIMIT" default:"65536"`
+	// AsyncRequestNamespace is the namespace of the AsyncRequest resources
+	// mirroring the status of requests. They are not created when it is
+	// empty.
+	AsyncRequestNamespace string `envconfig:"ASYNC_REQUEST_NAMESPACE"`
+	// AsyncRequestSampleRate is the fraction of the requests, from 0 to 1,
+	// with an AsyncRequest resource.
+	AsyncRequestSampleRate float64 `envconfig:"ASYNC_REQUEST_SAMPLE_RATE" default:"1"`
+}
+
+// sharedMemory is the memory store of the process, so the producer and
+// consumer share it when running together.
+var sharedMemory = NewMemory()
+
+// New returns the Store described by cfg, or nil if status tracking is
+// disabled. The Redis backend connects with the queue's Redis settings. The
+// store also writes AsyncRequest resources when ASYNC_REQUEST_NAMESPACE is
+// set.
+func New(cfg StoreConfig, redisCfg queue.RedisConfig) (Store, error) {
+	s, err := newBackend(cfg, redisCfg)
+	if err != nil || cfg.AsyncRequestNamespace == "" {
+		return s, err
+	}
+	r, err := newResources(cfg, s)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// newBackend returns the store of the status backend set in cfg, or nil.
+func newBackend(cfg StoreConfig, redisCfg queue.RedisConfig) (Store, error) {
+	switch cfg.StatusBackend {
+	case "":
+		return nil, nil
+	case BackendRedis:
+		r, err := NewRedis(cfg, redisCfg)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	case BackendMemory:
+		return sharedMemory, nil
+	default:
+		return nil, fmt.Errorf("unknown status backend %q", cfg.StatusBackend)
+	}
+}
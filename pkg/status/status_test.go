@@ -0,0 +1,84 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+	"testing"
+
+	"knative.dev/async-component/pkg/queue"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       StoreConfig
+		redisCfg  queue.RedisConfig
+		wantStore bool
+		wantErr   bool
+	}{{
+		name: "disabled",
+	}, {
+		name:      "redis backend",
+		cfg:       StoreConfig{StatusBackend: BackendRedis},
+		redisCfg:  queue.RedisConfig{RedisAddress: "redis://localhost:6379"},
+		wantStore: true,
+	}, {
+		name:     "redis backend with bad address",
+		cfg:      StoreConfig{StatusBackend: BackendRedis},
+		redisCfg: queue.RedisConfig{RedisAddress: "notredis://localhost:6379"},
+		wantErr:  true,
+	}, {
+		name:      "memory backend",
+		cfg:       StoreConfig{StatusBackend: BackendMemory},
+		wantStore: true,
+	}, {
+		name:    "unknown backend",
+		cfg:     StoreConfig{StatusBackend: "unknown"},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := New(test.cfg, test.redisCfg)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if (s != nil) != test.wantStore {
+				t.Fatalf("New() = %v, want a store: %v", s, test.wantStore)
+			}
+			if s != nil {
+				s.Close()
+			}
+		})
+	}
+}
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	if _, err := m.Get(ctx, "123"); err != ErrNotFound {
+		t.Fatalf("Get() of unknown request = %v, want %v", err, ErrNotFound)
+	}
+	for _, want := range []Status{
+		{ID: "123", State: Pending},
+		{ID: "123", State: Succeeded, StatusCode: 200},
+	} {
+		if err := m.Set(ctx, want); err != nil {
+			t.Fatal("Set() =", err)
+		}
+		if got, err := m.Get(ctx, "123"); err != nil || got != want {
+			t.Errorf("Get() = %+v, %v, want %+v", got, err, want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tracing exports the spans of the async components to the backend
+// set in the config-tracing ConfigMap, and carries the trace context of a
+// request from the producer to the consumer through the stored record.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"contrib.go.opencensus.io/exporter/zipkin"
+	zipkinmodel "github.com/openzipkin/zipkin-go/model"
+	zipkinreporter "github.com/openzipkin/zipkin-go/reporter"
+	zipkinhttp "github.com/openzipkin/zipkin-go/reporter/http"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/tracing/config"
+)
+
+// ConfigName is the name of the ConfigMap configuring tracing, shared with
+// Knative Serving.
+const ConfigName = config.ConfigName
+
+// QueueWaitSpan is the name of the span covering the time a request spent
+// in the queue.
+const QueueWaitSpan = "queue-wait"
+
+// Tracer exports the spans of a component. Its exporter is replaced as the
+// config-tracing ConfigMap changes.
+type Tracer struct {
+	serviceName string
+	logger      *zap.SugaredLogger
+
+	mu       sync.Mutex
+	exporter trace.Exporter
+	reporter zipkinreporter.Reporter
+}
+
+// New returns a Tracer exporting the spans of serviceName, logging with the
+// logger of ctx. Nothing is exported until a configuration is applied.
+func New(ctx context.Context, serviceName string) *Tracer {
+	return &Tracer{serviceName: serviceName, logger: logging.FromContext(ctx)}
+}
+
+// ApplyConfig configures the sampler and the exporter from the config-tracing
+// ConfigMap. Invalid ConfigMaps are ignored and the configuration in effect
+// is kept.
+func (t *Tracer) ApplyConfig(cm *corev1.ConfigMap) {
+	cfg, err := config.NewTracingConfigFromConfigMap(cm)
+	if err == nil {
+		err = t.apply(cfg)
+	}
+	if err != nil {
+		t.logger.Errorw("Error applying "+ConfigName+", keeping the current configuration", zap.Error(err))
+		return
+	}
+	t.logger.Info("Applied " + ConfigName)
+}
+
+func (t *Tracer) apply(cfg *config.Config) error {
+	var (
+		exporter trace.Exporter
+		reporter zipkinreporter.Reporter
+		sampler  = trace.NeverSample()
+	)
+	switch cfg.Backend {
+	case config.None:
+	case config.Zipkin:
+		reporter = zipkinhttp.NewReporter(cfg.ZipkinEndpoint)
+		exporter = zipkin.NewExporter(reporter, &zipkinmodel.Endpoint{ServiceName: t.serviceName})
+		sampler = trace.ProbabilitySampler(cfg.SampleRate)
+		if cfg.Debug {
+			sampler = trace.AlwaysSample()
+		}
+	default:
+		return fmt.Errorf("unsupported tracing backend %q", cfg.Backend)
+	}
+
+	// Register the new exporter first, so no spans are dropped.
+	if exporter != nil {
+		trace.RegisterExporter(exporter)
+	}
+	t.mu.Lock()
+	prevExporter, prevReporter := t.exporter, t.reporter
+	t.exporter, t.reporter = exporter, reporter
+	t.mu.Unlock()
+	if prevExporter != nil {
+		trace.UnregisterExporter(prevExporter)
+	}
+	if prevReporter != nil {
+		if err := prevReporter.Close(); err != nil {
+			t.logger.Errorw("Error closing trace reporter", zap.Error(err))
+		}
+	}
+	trace.ApplyConfig(trace.Config{DefaultSampler: sampler})
+	return nil
+}
+
+// Close flushes the spans not exported yet.
+func (t *Tracer) Close() error {
+	return t.apply(config.NoopConfig())
+}
+
+// QueueWait exports a span named queue-wait, child of parent, from the time
+// a request was enqueued to the time it was dequeued. It returns the context
+// of that span, or parent when it is not sampled.
+//
+// The span is exported directly since spans cannot be started in the past.
+func (t *Tracer) QueueWait(parent trace.SpanContext, enqueued, dequeued time.Time) trace.SpanContext {
+	if !parent.IsSampled() {
+		return parent
+	}
+	sc := parent
+	if _, err := rand.Read(sc.SpanID[:]); err != nil {
+		return parent
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.exporter == nil {
+		return parent
+	}
+	t.exporter.ExportSpan(&trace.SpanData{
+		SpanContext:  sc,
+		ParentSpanID: parent.SpanID,
+		Name:         QueueWaitSpan,
+		StartTime:    enqueued,
+		EndTime:      dequeued,
+	})
+	return sc
+}
+
+// TraceParent formats sc as a W3C traceparent.
+func TraceParent(sc trace.SpanContext) string {
+	return fmt.Sprintf("00-%s-%s-%02x", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), uint32(sc.TraceOptions)&0xff)
+}
+
+// ParseTraceParent parses a W3C traceparent.
+func ParseTraceParent(s string) (trace.SpanContext, error) {
+	var sc trace.SpanContext
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	if err := decodeHex(sc.TraceID[:], parts[1]); err != nil {
+		return sc, fmt.Errorf("invalid trace ID in traceparent %q: %w", s, err)
+	}
+	if err := decodeHex(sc.SpanID[:], parts[2]); err != nil {
+		return sc, fmt.Errorf("invalid span ID in traceparent %q: %w", s, err)
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, fmt.Errorf("invalid flags in traceparent %q", s)
+	}
+	sc.TraceOptions = trace.TraceOptions(flags[0] & 1)
+	return sc, nil
+}
+
+// decodeHex decodes s into dst, which it must fill exactly with a value that
+// is not all zeroes.
+func decodeHex(dst []byte, s string) error {
+	if len(s) != hex.EncodedLen(len(dst)) {
+		return fmt.Errorf("want %d hex digits, got %d", hex.EncodedLen(len(dst)), len(s))
+	}
+	if _, err := hex.Decode(dst, []byte(s)); err != nil {
+		return err
+	}
+	for _, b := range dst {
+		if b != 0 {
+			return nil
+		}
+	}
+	return errors.New("all zeroes")
+}
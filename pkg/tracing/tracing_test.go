@@ -0,0 +1,173 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+	corev1 "k8s.io/api/core/v1"
+)
+
+type recordingExporter struct {
+	spans []*trace.SpanData
+}
+
+func (e *recordingExporter) ExportSpan(sd *trace.SpanData) {
+	e.spans = append(e.spans, sd)
+}
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestTraceParent(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{{
+		name: "sampled",
+		in:   testTraceParent,
+		want: testTraceParent,
+	}, {
+		name: "not sampled",
+		in:   "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+		want: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+	}, {
+		name: "future version",
+		in:   "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		want: testTraceParent,
+	}, {
+		name:    "empty",
+		wantErr: true,
+	}, {
+		name:    "invalid version",
+		in:      "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		wantErr: true,
+	}, {
+		name:    "zero trace ID",
+		in:      "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		wantErr: true,
+	}, {
+		name:    "short span ID",
+		in:      "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa-01",
+		wantErr: true,
+	}, {
+		name:    "invalid flags",
+		in:      "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz",
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := ParseTraceParent(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTraceParent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := TraceParent(sc); got != tt.want {
+				t.Errorf("TraceParent() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueWait(t *testing.T) {
+	sampled, err := ParseTraceParent(testTraceParent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsampled := sampled
+	unsampled.TraceOptions = 0
+	enqueued := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	dequeued := enqueued.Add(time.Minute)
+
+	tests := []struct {
+		name       string
+		parent     trace.SpanContext
+		noExporter bool
+		wantSpan   bool
+	}{{
+		name:     "sampled",
+		parent:   sampled,
+		wantSpan: true,
+	}, {
+		name:   "not sampled",
+		parent: unsampled,
+	}, {
+		name:       "no exporter",
+		parent:     sampled,
+		noExporter: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := &recordingExporter{}
+			tracer := New(context.Background(), "test")
+			if !tt.noExporter {
+				tracer.exporter = exporter
+			}
+			got := tracer.QueueWait(tt.parent, enqueued, dequeued)
+			if !tt.wantSpan {
+				if got != tt.parent {
+					t.Errorf("QueueWait() = %v, want the parent %v", got, tt.parent)
+				}
+				if len(exporter.spans) != 0 {
+					t.Errorf("exported %d spans, want none", len(exporter.spans))
+				}
+				return
+			}
+			if len(exporter.spans) != 1 {
+				t.Fatalf("exported %d spans, want 1", len(exporter.spans))
+			}
+			sd := exporter.spans[0]
+			if sd.SpanContext != got {
+				t.Errorf("QueueWait() = %v, want the exported span %v", got, sd.SpanContext)
+			}
+			if got.TraceID != tt.parent.TraceID || got.SpanID == tt.parent.SpanID || sd.ParentSpanID != tt.parent.SpanID {
+				t.Errorf("span %v with parent %v is not a child of %v", got, sd.ParentSpanID, tt.parent)
+			}
+			if sd.Name != QueueWaitSpan || !sd.StartTime.Equal(enqueued) || !sd.EndTime.Equal(dequeued) {
+				t.Errorf("exported %s from %v to %v, want %s from %v to %v", sd.Name, sd.StartTime, sd.EndTime, QueueWaitSpan, enqueued, dequeued)
+			}
+		})
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	tracer := New(context.Background(), "test")
+	defer tracer.Close()
+
+	tracer.ApplyConfig(&corev1.ConfigMap{Data: map[string]string{
+		"backend":         "zipkin",
+		"zipkin-endpoint": "http://zipkin.istio-system.svc.cluster.local:9411/api/v2/spans",
+	}})
+	if tracer.exporter == nil {
+		t.Fatal("no exporter after enabling zipkin")
+	}
+	zipkin := tracer.exporter
+
+	// Invalid configurations keep the exporter in effect.
+	tracer.ApplyConfig(&corev1.ConfigMap{Data: map[string]string{"backend": "zipkin"}})
+	if tracer.exporter != zipkin {
+		t.Error("exporter replaced by an invalid configuration")
+	}
+
+	tracer.ApplyConfig(&corev1.ConfigMap{Data: map[string]string{"backend": "none"}})
+	if tracer.exporter != nil {
+		t.Error("exporter kept after disabling tracing")
+	}
+}
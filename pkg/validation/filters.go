@@ -0,0 +1,95 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validation
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// ContentTypes is a Filter allowing requests with a body only with the
+// listed media types. Types ending with "/*" allow all their subtypes.
+type ContentTypes []string
+
+// Check implements Filter.
+func (c ContentTypes) Check(r *http.Request, body []byte) error {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" && body != nil && len(body) == 0 {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("%w %q", ErrUnsupportedMediaType, contentType)
+	}
+	for _, allowed := range c {
+		allowed = strings.ToLower(allowed)
+		if allowed == mediaType || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, allowed[:len(allowed)-1])) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w %q", ErrUnsupportedMediaType, mediaType)
+}
+
+// MaxHeaders is a Filter capping the number of header values of requests.
+type MaxHeaders int
+
+// Check implements Filter.
+func (m MaxHeaders) Check(r *http.Request, body []byte) error {
+	n := 0
+	for _, values := range r.Header {
+		n += len(values)
+	}
+	if n > int(m) {
+		return fmt.Errorf("%w: %d headers, more than %d", ErrInvalid, n, m)
+	}
+	return nil
+}
+
+// JSONSchema is a Filter checking that bodies conform to a JSON schema.
+// Offloaded bodies are not checked.
+type JSONSchema struct {
+	schema *gojsonschema.Schema
+}
+
+// NewJSONSchema returns the JSONSchema filter of schema.
+func NewJSONSchema(schema []byte) (*JSONSchema, error) {
+	s, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(schema))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %w", err)
+	}
+	return &JSONSchema{schema: s}, nil
+}
+
+// Check implements Filter.
+func (j *JSONSchema) Check(r *http.Request, body []byte) error {
+	if body == nil {
+		return nil
+	}
+	result, err := j.schema.Validate(gojsonschema.NewBytesLoader(body))
+	if err != nil {
+		return fmt.Errorf("%w: body is not JSON: %v", ErrInvalid, err)
+	}
+	if !result.Valid() {
+		reasons := make([]string, 0, len(result.Errors()))
+		for _, e := range result.Errors() {
+			reasons = append(reasons, e.String())
+		}
+		return fmt.Errorf("%w: %s", ErrInvalid, strings.Join(reasons, "; "))
+	}
+	return nil
+}
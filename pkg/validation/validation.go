@@ -0,0 +1,154 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package validation checks asynchronous requests before they are queued, so
+// malformed work is rejected when it is submitted rather than failing when
+// the consumer delivers it.
+package validation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"knative.dev/async-component/pkg/headers"
+)
+
+var (
+	// ErrInvalid is wrapped by the errors of requests failing a check.
+	ErrInvalid = errors.New("invalid request")
+	// ErrUnsupportedMediaType is wrapped by the errors of requests whose
+	// content type is not allowed.
+	ErrUnsupportedMediaType = fmt.Errorf("%w: unsupported media type", ErrInvalid)
+)
+
+// Filter checks a request before it is queued. body is nil for bodies
+// offloaded to the blob store, which are streamed rather than read.
+type Filter interface {
+	Check(r *http.Request, body []byte) error
+}
+
+// Chain is a Filter running its filters in order, stopping at the first
+// failing one.
+type Chain []Filter
+
+// Check implements Filter.
+func (c Chain) Check(r *http.Request, body []byte) error {
+	for _, f := range c {
+		if err := f.Check(r, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidationConfig holds the validation rules, as a JSON list of Rule.
+// Requests are not checked when it is empty.
+type ValidationConfig struct {
+	ValidationRules string `envconfig:"VALIDATION_RULES"`
+}
+
+// Rule checks the requests matching its conditions. Conditions that are not
+// set match every request, checks that are not set are skipped.
+type Rule struct {
+	// Host is the host of the service, or a suffix of it when it starts
+	// with "*.", such as "*.batch.svc.cluster.local" for a namespace.
+	Host string `json:"host,omitempty"`
+	// PathPrefix is a prefix of the request path.
+	PathPrefix string `json:"pathPrefix,omitempty"`
+
+	// ContentTypes lists the media types requests with a body may have,
+	// such as "application/json" or "text/*".
+	ContentTypes []string `json:"contentTypes,omitempty"`
+	// MaxHeaders caps the number of header values of requests.
+	MaxHeaders int `json:"maxHeaders,omitempty"`
+	// JSONSchema is a JSON schema bodies must conform to.
+	JSONSchema json.RawMessage `json:"jsonSchema,omitempty"`
+}
+
+// Validator checks requests with the first rule they match.
+type Validator struct {
+	rules []compiledRule
+}
+
+// compiledRule is a Rule along with the chain of its checks.
+type compiledRule struct {
+	Rule
+	filter Filter
+}
+
+// New returns the Validator described by cfg, or nil if there are no rules.
+func New(cfg ValidationConfig) (*Validator, error) {
+	if cfg.ValidationRules == "" {
+		return nil, nil
+	}
+	var rules []Rule
+	if err := json.Unmarshal([]byte(cfg.ValidationRules), &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse VALIDATION_RULES: %w", err)
+	}
+	v := &Validator{rules: make([]compiledRule, 0, len(rules))}
+	for i, r := range rules {
+		filter, err := r.filter()
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		v.rules = append(v.rules, compiledRule{Rule: r, filter: filter})
+	}
+	return v, nil
+}
+
+// filter returns the chain of the checks of r.
+func (r Rule) filter() (Filter, error) {
+	var chain Chain
+	if len(r.ContentTypes) > 0 {
+		chain = append(chain, ContentTypes(r.ContentTypes))
+	}
+	if r.MaxHeaders < 0 {
+		return nil, fmt.Errorf("invalid max headers %d", r.MaxHeaders)
+	} else if r.MaxHeaders > 0 {
+		chain = append(chain, MaxHeaders(r.MaxHeaders))
+	}
+	if len(r.JSONSchema) > 0 {
+		schema, err := NewJSONSchema(r.JSONSchema)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, schema)
+	}
+	return chain, nil
+}
+
+// Validate checks r with the first rule it matches. Requests matching no
+// rule are valid.
+func (v *Validator) Validate(r *http.Request, body []byte) error {
+	for _, rule := range v.rules {
+		if rule.matches(r) {
+			return rule.filter.Check(r, body)
+		}
+	}
+	return nil
+}
+
+func (rule Rule) matches(r *http.Request) bool {
+	host := r.Header.Get(headers.OriginalHost)
+	if strings.HasPrefix(rule.Host, "*.") {
+		if !strings.HasSuffix(host, rule.Host[1:]) {
+			return false
+		}
+	} else if rule.Host != "" && !strings.EqualFold(host, rule.Host) {
+		return false
+	}
+	return strings.HasPrefix(r.URL.Path, rule.PathPrefix)
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2021 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validation
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"knative.dev/async-component/pkg/headers"
+)
+
+const testRules = `[
+	{"host": "orders.default.svc.cluster.local", "pathPrefix": "/orders", "contentTypes": ["application/json"], "maxHeaders": 3,
+	 "jsonSchema": {"type": "object", "required": ["id"], "properties": {"id": {"type": "integer"}}}},
+	{"host": "*.batch.svc.cluster.local", "contentTypes": ["text/*"]}
+]`
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ValidationConfig
+		wantNil bool
+		wantErr bool
+	}{{
+		name:    "disabled",
+		wantNil: true,
+	}, {
+		name: "rules",
+		cfg:  ValidationConfig{ValidationRules: testRules},
+	}, {
+		name:    "not JSON",
+		cfg:     ValidationConfig{ValidationRules: "contentTypes: [application/json]"},
+		wantErr: true,
+	}, {
+		name:    "invalid schema",
+		cfg:     ValidationConfig{ValidationRules: `[{"jsonSchema": {"type": 1}}]`},
+		wantErr: true,
+	}, {
+		name:    "negative max headers",
+		cfg:     ValidationConfig{ValidationRules: `[{"maxHeaders": -1}]`},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v, err := New(test.cfg)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err == nil && (v == nil) != test.wantNil {
+				t.Errorf("New() = %v, want nil: %v", v, test.wantNil)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	v, err := New(ValidationConfig{ValidationRules: testRules})
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	tests := []struct {
+		name        string
+		host        string
+		path        string
+		contentType string
+		headers     int
+		body        []byte
+		want        error
+	}{{
+		name:        "valid",
+		host:        "orders.default.svc.cluster.local",
+		path:        "/orders",
+		contentType: "application/json; charset=utf-8",
+		body:        []byte(`{"id": 1}`),
+	}, {
+		name:        "unsupported media type",
+		host:        "orders.default.svc.cluster.local",
+		path:        "/orders",
+		contentType: "application/xml",
+		body:        []byte(`<id>1</id>`),
+		want:        ErrUnsupportedMediaType,
+	}, {
+		name:        "schema violation",
+		host:        "orders.default.svc.cluster.local",
+		path:        "/orders",
+		contentType: "application/json",
+		body:        []byte(`{"id": "one"}`),
+		want:        ErrInvalid,
+	}, {
+		name:        "not JSON",
+		host:        "orders.default.svc.cluster.local",
+		path:        "/orders",
+		contentType: "application/json",
+		body:        []byte(`id=1`),
+		want:        ErrInvalid,
+	}, {
+		name:        "offloaded body",
+		host:        "orders.default.svc.cluster.local",
+		path:        "/orders",
+		contentType: "application/json",
+	}, {
+		name:        "too many headers",
+		host:        "orders.default.svc.cluster.local",
+		path:        "/orders",
+		contentType: "application/json",
+		headers:     2,
+		body:        []byte(`{"id": 1}`),
+		want:        ErrInvalid,
+	}, {
+		name: "no body",
+		host: "orders.default.svc.cluster.local",
+		path: "/orders/1",
+		body: []byte{},
+		want: ErrInvalid,
+	}, {
+		name:        "other path",
+		host:        "orders.default.svc.cluster.local",
+		path:        "/health",
+		contentType: "application/xml",
+		body:        []byte(`<ok/>`),
+	}, {
+		name:        "namespace",
+		host:        "report.batch.svc.cluster.local",
+		path:        "/",
+		contentType: "text/csv",
+		body:        []byte(`a,b`),
+	}, {
+		name:        "namespace, unsupported media type",
+		host:        "report.batch.svc.cluster.local",
+		path:        "/",
+		contentType: "application/json",
+		body:        []byte(`{}`),
+		want:        ErrUnsupportedMediaType,
+	}, {
+		name: "namespace, no body",
+		host: "report.batch.svc.cluster.local",
+		path: "/",
+		body: []byte{},
+	}, {
+		name:        "no rule",
+		host:        "hello.default.svc.cluster.local",
+		path:        "/",
+		contentType: "application/xml",
+		body:        []byte(`<hello/>`),
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "http://example.com"+test.path, nil)
+			r.Header.Set(headers.OriginalHost, test.host)
+			if test.contentType != "" {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+			for i := 0; i < test.headers; i++ {
+				r.Header.Add("X-Extra", "value")
+			}
+			err := v.Validate(r, test.body)
+			if !errors.Is(err, test.want) || (err != nil) != (test.want != nil) {
+				t.Errorf("Validate() = %v, want %v", err, test.want)
+			}
+		})
+	}
+}